@@ -1,6 +1,8 @@
 package aws
 
+import "context"
+
 // CreateClient interface with a method to create an AWS client
 type CreateClient interface {
-	CreateClient() (interface{}, error) // Returns an interface{} so it can be flexible for different services
+	CreateClient(ctx context.Context) (interface{}, error) // Returns an interface{} so it can be flexible for different services
 }
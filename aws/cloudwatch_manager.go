@@ -0,0 +1,75 @@
+// aws/cloudwatch_manager.go
+// This file publishes custom metrics to Amazon CloudWatch with PutMetricData, which
+// --metrics uses to publish job statistics.
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// maxMetricDataPerRequest is how many values one PutMetricData request may carry
+const maxMetricDataPerRequest = 1000
+
+// MetricsClient publishes custom metrics to CloudWatch in one region
+type MetricsClient struct {
+	Client *cloudwatch.Client
+}
+
+// MetricDatum is one value of a custom metric
+type MetricDatum struct {
+	Name       string
+	Value      float64
+	Unit       string            // Such as Seconds, Bytes, or Count
+	Dimensions map[string]string // Dimension names and values
+	Timestamp  time.Time         // Zero uses the time CloudWatch receives the value
+}
+
+// NewMetricsClient creates a CloudWatch client in AWS_REGION, or the region of the
+// default configuration
+func NewMetricsClient(ctx context.Context) (*MetricsClient, error) {
+	cfg, err := loadRegionalConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsClient{Client: cloudwatch.NewFromConfig(cfg)}, nil
+}
+
+// PutMetricData publishes data in namespace, in as few requests as the API allows
+func (c *MetricsClient) PutMetricData(ctx context.Context, namespace string, data []MetricDatum) error {
+	for start := 0; start < len(data); start += maxMetricDataPerRequest {
+		end := min(start+maxMetricDataPerRequest, len(data))
+		if _, err := c.Client.PutMetricData(ctx, metricDataInput(namespace, data[start:end])); err != nil {
+			return fmt.Errorf("PutMetricData failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// metricDataInput returns the PutMetricData request that publishes data in namespace
+func metricDataInput(namespace string, data []MetricDatum) *cloudwatch.PutMetricDataInput {
+	input := &cloudwatch.PutMetricDataInput{Namespace: aws.String(namespace)}
+	for _, datum := range data {
+		metric := types.MetricDatum{
+			MetricName: aws.String(datum.Name),
+			Value:      aws.Float64(datum.Value),
+			Unit:       types.StandardUnit(datum.Unit),
+		}
+		if !datum.Timestamp.IsZero() {
+			metric.Timestamp = aws.Time(datum.Timestamp)
+		}
+		for _, name := range slices.Sorted(maps.Keys(datum.Dimensions)) {
+			metric.Dimensions = append(metric.Dimensions, types.Dimension{Name: aws.String(name), Value: aws.String(datum.Dimensions[name])})
+		}
+		input.MetricData = append(input.MetricData, metric)
+	}
+	return input
+}
@@ -0,0 +1,136 @@
+// aws/cloudwatch_manager_test.go
+
+package aws
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/smithy-go"
+)
+
+// fakeMetrics answers PutMetricData requests with status, recording their forms
+func fakeMetrics(t *testing.T, status int, response string) (*MetricsClient, *[]url.Values) {
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/monitoring/aws4_request") {
+			t.Errorf("request not signed for monitoring: %q", r.Header.Get("Authorization"))
+		}
+		// The SDK compresses PutMetricData requests
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("request body is not gzip: %v", err)
+				return
+			}
+			reader = gz
+		}
+		body, _ := io.ReadAll(reader)
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Errorf("request body is not a form: %v", err)
+		}
+		forms = append(forms, form)
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	client := cloudwatch.New(cloudwatch.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return &MetricsClient{Client: client}, &forms
+}
+
+func TestMetricDataInput(t *testing.T) {
+	at := time.Date(2026, 10, 14, 2, 30, 0, 0, time.FixedZone("PDT", -7*3600))
+	input := metricDataInput("AWSMPIRun", []MetricDatum{
+		{Name: "WallTime", Value: 12.5, Unit: "Seconds", Dimensions: map[string]string{"Project": "cfd", "Job": "j1"}, Timestamp: at},
+		{Name: "Ranks", Value: 64},
+	})
+	if aws.ToString(input.Namespace) != "AWSMPIRun" || len(input.MetricData) != 2 {
+		t.Fatalf("input = %+v", input)
+	}
+	wallTime, ranks := input.MetricData[0], input.MetricData[1]
+	if aws.ToString(wallTime.MetricName) != "WallTime" || aws.ToFloat64(wallTime.Value) != 12.5 || wallTime.Unit != "Seconds" || !aws.ToTime(wallTime.Timestamp).Equal(at) {
+		t.Errorf("WallTime = %+v", wallTime)
+	}
+	var dimensions []string
+	for _, dimension := range wallTime.Dimensions {
+		dimensions = append(dimensions, aws.ToString(dimension.Name)+"="+aws.ToString(dimension.Value))
+	}
+	if got := strings.Join(dimensions, ","); got != "Job=j1,Project=cfd" {
+		t.Errorf("dimensions = %s, want them sorted by name", got)
+	}
+	if aws.ToString(ranks.MetricName) != "Ranks" || ranks.Unit != "" || ranks.Timestamp != nil || ranks.Dimensions != nil {
+		t.Errorf("Ranks = %+v, want no unit, timestamp, or dimensions", ranks)
+	}
+}
+
+func TestMetricsClientPutMetricData(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   int
+		wantReqs int
+	}{
+		{name: "none", values: 0, wantReqs: 0},
+		{name: "one request", values: 5, wantReqs: 1},
+		{name: "split", values: maxMetricDataPerRequest + 1, wantReqs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, forms := fakeMetrics(t, http.StatusOK, "<PutMetricDataResponse/>")
+			var data []MetricDatum
+			for i := range tt.values {
+				data = append(data, MetricDatum{Name: fmt.Sprintf("m%d", i), Value: float64(i)})
+			}
+			if err := client.PutMetricData(context.Background(), "AWSMPIRun", data); err != nil {
+				t.Fatal(err)
+			}
+			if len(*forms) != tt.wantReqs {
+				t.Fatalf("%d requests, want %d", len(*forms), tt.wantReqs)
+			}
+			for _, form := range *forms {
+				if form.Get("Action") != "PutMetricData" || form.Get("Namespace") != "AWSMPIRun" {
+					t.Errorf("request form = %v", form)
+				}
+			}
+			if tt.wantReqs == 2 {
+				last := (*forms)[1]
+				if got := last.Get("MetricData.member.1.MetricName"); got != fmt.Sprintf("m%d", maxMetricDataPerRequest) {
+					t.Errorf("second request starts with %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsClientError(t *testing.T) {
+	client, _ := fakeMetrics(t, http.StatusForbidden, `<ErrorResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">
+  <Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized to perform: cloudwatch:PutMetricData</Message></Error>
+  <RequestId>1</RequestId>
+</ErrorResponse>`)
+	err := client.PutMetricData(context.Background(), "AWSMPIRun", []MetricDatum{{Name: "Ranks", Value: 1}})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDenied" || !strings.Contains(apiErr.ErrorMessage(), "cloudwatch:PutMetricData") {
+		t.Fatalf("PutMetricData error = %v, want AccessDenied", err)
+	}
+}
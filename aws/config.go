@@ -0,0 +1,33 @@
+// aws/config.go
+// This file loads the configuration the clients of the services that need a region
+// share, so a missing region fails at once rather than at the first request.
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// loadRegionalConfig loads the default configuration in AWS_REGION, if set, and fails
+// when no region is configured
+func loadRegionalConfig(ctx context.Context) (aws.Config, error) {
+	var cfg aws.Config
+	var err error
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		cfg, err = awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
+	} else {
+		cfg, err = awsConfig.LoadDefaultConfig(ctx)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return cfg, fmt.Errorf("no region configured; set AWS_REGION")
+	}
+	return cfg, nil
+}
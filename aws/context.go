@@ -0,0 +1,23 @@
+// aws/context.go
+// This file holds the helpers polling loops use to honor the caller's context, so a
+// cancelled command or an expired deadline ends a wait at once instead of after the
+// next poll.
+
+package aws
+
+import (
+	"context"
+	"time"
+)
+
+// SleepContext waits for d, or until ctx is done, in which case it returns ctx's error
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
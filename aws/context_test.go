@@ -0,0 +1,34 @@
+// aws/context_test.go
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSleepContext(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		d    time.Duration
+		want error
+	}{
+		{name: "sleeps", ctx: context.Background(), d: time.Millisecond},
+		{name: "cancelled", ctx: cancelled, d: time.Hour, want: context.Canceled},
+		{name: "deadline", ctx: expired, d: time.Hour, want: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SleepContext(tt.ctx, tt.d); !errors.Is(err, tt.want) {
+				t.Errorf("SleepContext = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -6,31 +6,83 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
 )
 
 // SSMClientCreator implements the CreateClient interface for SSM
 type SSMClientCreator struct{}
 
 // CreateClient method creates the SSM client using AWS SDK v2
-func (s *SSMClientCreator) CreateClient() (*ssm.Client, error) {
+func (s *SSMClientCreator) CreateClient(ctx context.Context) (*ssm.Client, error) {
 	var cfg aws.Config
 	var err error
 
 	region := os.Getenv("AWS_REGION")
 	if region != "" {
-		cfg, err = awsConfig.LoadDefaultConfig(context.TODO(), awsConfig.WithRegion(region))
+		cfg, err = awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
 	} else {
-		cfg, err = awsConfig.LoadDefaultConfig(context.TODO())
+		cfg, err = awsConfig.LoadDefaultConfig(ctx)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to load AWS config: %w", err)
 	}
 
-	client := ssm.NewFromConfig(cfg)
+	limiter, err := ssmLimiterFor(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		o.APIOptions = append(o.APIOptions, limiter.addMiddleware)
+	})
 	return client, nil
 }
+
+// SSMOnline returns which of the instances are registered with SSM and report Online
+func SSMOnline(ctx context.Context, svc *ssm.Client, instanceIDs []string) (map[string]bool, error) {
+	online := make(map[string]bool)
+	paginator := ssm.NewDescribeInstanceInformationPaginator(svc, &ssm.DescribeInstanceInformationInput{
+		Filters: []types.InstanceInformationStringFilter{
+			{Key: aws.String("InstanceIds"), Values: instanceIDs},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe SSM instance information: %w", err)
+		}
+		for _, info := range page.InstanceInformationList {
+			if info.PingStatus == types.PingStatusOnline {
+				online[aws.ToString(info.InstanceId)] = true
+			}
+		}
+	}
+	return online, nil
+}
+
+// WaitForSSMOnline blocks until every instance has registered with SSM and reports
+// Online, for at most timeout or until ctx is done
+func WaitForSSMOnline(ctx context.Context, svc *ssm.Client, instanceIDs []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		online, err := SSMOnline(ctx, svc, instanceIDs)
+		if err != nil {
+			return err
+		}
+
+		if len(online) == len(instanceIDs) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s with %d of %d instances online in SSM", timeout, len(online), len(instanceIDs))
+		}
+		if err := SleepContext(ctx, 5*time.Second); err != nil {
+			return fmt.Errorf("stopped waiting with %d of %d instances online in SSM: %w", len(online), len(instanceIDs), err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// aws/dynamodb_manager.go
+// This file handles the DynamoDB table that backs the shared key-value store
+// available to ranks through the mpi.KV helper.
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// KVTableKeyAttribute is the partition key attribute of the key-value table
+const KVTableKeyAttribute = "Key"
+
+// kvTableWaitTimeout bounds how long EnsureKVTable waits for a new table to become active
+const kvTableWaitTimeout = 2 * time.Minute
+
+// DynamoDBClientCreator implements the CreateClient interface for DynamoDB
+type DynamoDBClientCreator struct{}
+
+// CreateClient method creates the DynamoDB client using AWS SDK v2
+func (s *DynamoDBClientCreator) CreateClient(ctx context.Context) (*dynamodb.Client, error) {
+	var cfg aws.Config
+	var err error
+
+	region := os.Getenv("AWS_REGION")
+	if region != "" {
+		cfg, err = awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
+	} else {
+		cfg, err = awsConfig.LoadDefaultConfig(ctx)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+
+	client := dynamodb.NewFromConfig(cfg)
+	return client, nil
+}
+
+// EnsureKVTable creates the key-value table if it does not exist yet and waits until it is active
+func EnsureKVTable(ctx context.Context, svc *dynamodb.Client, tableName string) error {
+	_, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to describe table %s: %v", tableName, err)
+	}
+
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String(KVTableKeyAttribute),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String(KVTableKeyAttribute),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+
+	_, err = svc.CreateTable(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to create table %s: %v", tableName, err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(svc)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, kvTableWaitTimeout)
+	if err != nil {
+		return fmt.Errorf("table %s did not become active: %v", tableName, err)
+	}
+
+	log.Printf("Created key-value table: %s", tableName)
+	return nil
+}
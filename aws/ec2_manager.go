@@ -4,12 +4,16 @@ package aws
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"log"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
 // InstanceInfo holds the instance ID, private IP, public IP, and rank
@@ -17,22 +21,36 @@ type InstanceInfo struct {
 	InstanceID   string
 	PrivateIP    string
 	PublicIP     string
+	InstanceType string
+	ImageID      string
 	InstanceRank int
+	Tags         map[string]string // Filled in by DescribeInstanceInfo and instance discovery
+	LaunchTime   time.Time
+
+	AvailabilityZone string
+	PlacementGroup   string // Empty when the instance is in no placement group
+	Lifecycle        string // LifecycleOnDemand or LifecycleSpot, or another EC2 lifecycle
 }
 
+// Lifecycles of an instance
+const (
+	LifecycleOnDemand = "on-demand"
+	LifecycleSpot     = "spot"
+)
+
 // EC2ClientCreator implements the CreateClient interface for EC2
 type EC2ClientCreator struct{}
 
 // CreateClient method creates the EC2 client using AWS SDK v2
-func (s *EC2ClientCreator) CreateClient() (*ec2.Client, error) {
+func (s *EC2ClientCreator) CreateClient(ctx context.Context) (*ec2.Client, error) {
 	var cfg aws.Config
 	var err error
 
 	region := os.Getenv("AWS_REGION")
 	if region != "" {
-		cfg, err = awsConfig.LoadDefaultConfig(context.TODO(), awsConfig.WithRegion(region))
+		cfg, err = awsConfig.LoadDefaultConfig(ctx, awsConfig.WithRegion(region))
 	} else {
-		cfg, err = awsConfig.LoadDefaultConfig(context.TODO())
+		cfg, err = awsConfig.LoadDefaultConfig(ctx)
 	}
 
 	if err != nil {
@@ -42,3 +60,178 @@ func (s *EC2ClientCreator) CreateClient() (*ec2.Client, error) {
 	client := ec2.NewFromConfig(cfg)
 	return client, nil
 }
+
+// LaunchSpec describes a batch of instances to launch
+type LaunchSpec struct {
+	ImageID          string
+	InstanceType     string
+	SubnetID         string
+	SecurityGroupIDs []string
+	InstanceProfile  string // Instance profile name; needs SSM permissions for the instances to be usable
+	KeyName          string
+	Count            int32
+	Tags             map[string]string
+	PlacementGroup   string
+	Spot             bool   // Launch spot instances at up to the on-demand price
+	UserData         string // Script run at first boot; encoded by LaunchInstances
+}
+
+// LaunchInstances starts the instances described by spec and returns their IDs
+func LaunchInstances(ctx context.Context, svc *ec2.Client, spec LaunchSpec) ([]string, error) {
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(spec.ImageID),
+		InstanceType: types.InstanceType(spec.InstanceType),
+		MinCount:     aws.Int32(spec.Count),
+		MaxCount:     aws.Int32(spec.Count),
+	}
+	if spec.SubnetID != "" {
+		input.SubnetId = aws.String(spec.SubnetID)
+	}
+	if len(spec.SecurityGroupIDs) > 0 {
+		input.SecurityGroupIds = spec.SecurityGroupIDs
+	}
+	if spec.InstanceProfile != "" {
+		input.IamInstanceProfile = &types.IamInstanceProfileSpecification{Name: aws.String(spec.InstanceProfile)}
+	}
+	if spec.KeyName != "" {
+		input.KeyName = aws.String(spec.KeyName)
+	}
+	if spec.PlacementGroup != "" {
+		input.Placement = &types.Placement{GroupName: aws.String(spec.PlacementGroup)}
+	}
+	if spec.Spot {
+		input.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{MarketType: types.MarketTypeSpot}
+	}
+	if spec.UserData != "" {
+		input.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(spec.UserData)))
+	}
+	if len(spec.Tags) > 0 {
+		var tags []types.Tag
+		for key, value := range spec.Tags {
+			tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		input.TagSpecifications = []types.TagSpecification{
+			{ResourceType: types.ResourceTypeInstance, Tags: tags},
+		}
+	}
+
+	result, err := svc.RunInstances(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch instances: %w", err)
+	}
+
+	var instanceIDs []string
+	for _, instance := range result.Instances {
+		instanceIDs = append(instanceIDs, aws.ToString(instance.InstanceId))
+	}
+	log.Printf("Launched %d instances: %v", len(instanceIDs), instanceIDs)
+	return instanceIDs, nil
+}
+
+// WaitForInstancesRunning blocks until the instances are running and returns their addresses
+func WaitForInstancesRunning(ctx context.Context, svc *ec2.Client, instanceIDs []string, timeout time.Duration) ([]InstanceInfo, error) {
+	waiter := ec2.NewInstanceRunningWaiter(svc)
+	err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: instanceIDs}, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("instances did not reach running state: %w", err)
+	}
+	return DescribeInstanceInfo(ctx, svc, instanceIDs)
+}
+
+// DescribeInstanceInfo returns the addresses of the given instances, in the order requested
+func DescribeInstanceInfo(ctx context.Context, svc *ec2.Client, instanceIDs []string) ([]InstanceInfo, error) {
+	result, err := svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: instanceIDs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %w", err)
+	}
+
+	byID := make(map[string]InstanceInfo)
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			byID[aws.ToString(instance.InstanceId)] = InstanceInfo{
+				InstanceID:   aws.ToString(instance.InstanceId),
+				PrivateIP:    aws.ToString(instance.PrivateIpAddress),
+				PublicIP:     aws.ToString(instance.PublicIpAddress),
+				InstanceType: string(instance.InstanceType),
+				ImageID:      aws.ToString(instance.ImageId),
+				InstanceRank: -1,
+				Tags:         tagMap(instance.Tags),
+
+				AvailabilityZone: PlacementZone(instance),
+				PlacementGroup:   PlacementGroup(instance),
+				Lifecycle:        Lifecycle(instance),
+				LaunchTime:       aws.ToTime(instance.LaunchTime),
+			}
+		}
+	}
+
+	var instances []InstanceInfo
+	for _, id := range instanceIDs {
+		instance, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("instance %s not found", id)
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// PlacementZone returns the availability zone of an instance
+func PlacementZone(instance types.Instance) string {
+	if instance.Placement == nil {
+		return ""
+	}
+	return aws.ToString(instance.Placement.AvailabilityZone)
+}
+
+// PlacementGroup returns the placement group of an instance, or "" when it has none
+func PlacementGroup(instance types.Instance) string {
+	if instance.Placement == nil {
+		return ""
+	}
+	return aws.ToString(instance.Placement.GroupName)
+}
+
+// Lifecycle returns how an instance was bought; EC2 leaves the lifecycle of on-demand
+// instances unset
+func Lifecycle(instance types.Instance) string {
+	if instance.InstanceLifecycle == "" {
+		return LifecycleOnDemand
+	}
+	return string(instance.InstanceLifecycle)
+}
+
+// InstanceTags returns the tags of an instance by key
+func InstanceTags(instance types.Instance) map[string]string {
+	return tagMap(instance.Tags)
+}
+
+// tagMap returns EC2 tags by key
+func tagMap(tags []types.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return m
+}
+
+// TerminateInstances terminates the instances and waits until they are gone
+func TerminateInstances(ctx context.Context, svc *ec2.Client, instanceIDs []string, timeout time.Duration) error {
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+
+	_, err := svc.TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: instanceIDs})
+	if err != nil {
+		return fmt.Errorf("failed to terminate instances: %w", err)
+	}
+
+	waiter := ec2.NewInstanceTerminatedWaiter(svc)
+	err = waiter.Wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: instanceIDs}, timeout)
+	if err != nil {
+		return fmt.Errorf("instances did not terminate: %w", err)
+	}
+
+	log.Printf("Terminated %d instances: %v", len(instanceIDs), instanceIDs)
+	return nil
+}
@@ -0,0 +1,172 @@
+// aws/events_manager.go
+// This file wraps the few Amazon EventBridge calls awsmpirun schedule makes: creating
+// a scheduled rule and its target, listing the rules of a project, and deleting one.
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// EventsClient calls the EventBridge API of one region
+type EventsClient struct {
+	Client *eventbridge.Client
+}
+
+// EventRule is an EventBridge rule
+type EventRule struct {
+	Name               string
+	Arn                string
+	ScheduleExpression string
+	State              string
+	Description        string
+}
+
+// EventTarget is what a rule starts when it triggers
+type EventTarget struct {
+	ID      string
+	Arn     string
+	RoleArn string
+	Input   string // JSON passed to the target instead of the event
+}
+
+// NewEventsClient creates an EventBridge client in AWS_REGION, or the region of the
+// default configuration
+func NewEventsClient(ctx context.Context) (*EventsClient, error) {
+	cfg, err := loadRegionalConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &EventsClient{Client: eventbridge.NewFromConfig(cfg)}, nil
+}
+
+// Region returns the region the client calls
+func (c *EventsClient) Region() string {
+	return c.Client.Options().Region
+}
+
+// PutRule creates or updates a scheduled rule and returns its ARN
+func (c *EventsClient) PutRule(ctx context.Context, rule EventRule, tags map[string]string) (string, error) {
+	input := &eventbridge.PutRuleInput{
+		Name:               aws.String(rule.Name),
+		ScheduleExpression: optionalString(rule.ScheduleExpression),
+		State:              types.RuleState(rule.State),
+		Description:        optionalString(rule.Description),
+	}
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	output, err := c.Client.PutRule(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("PutRule failed: %w", err)
+	}
+	return aws.ToString(output.RuleArn), nil
+}
+
+// PutTargets adds targets to a rule, replacing those with the same IDs
+func (c *EventsClient) PutTargets(ctx context.Context, rule string, targets []EventTarget) error {
+	input := &eventbridge.PutTargetsInput{Rule: aws.String(rule)}
+	for _, target := range targets {
+		input.Targets = append(input.Targets, types.Target{
+			Id:      aws.String(target.ID),
+			Arn:     aws.String(target.Arn),
+			RoleArn: optionalString(target.RoleArn),
+			Input:   optionalString(target.Input),
+		})
+	}
+	output, err := c.Client.PutTargets(ctx, input)
+	if err != nil {
+		return fmt.Errorf("PutTargets failed: %w", err)
+	}
+	if len(output.FailedEntries) > 0 {
+		entry := output.FailedEntries[0]
+		return fmt.Errorf("failed to add target %s to rule %s: %s", aws.ToString(entry.TargetId), rule, aws.ToString(entry.ErrorMessage))
+	}
+	return nil
+}
+
+// ListRules returns the rules whose names start with prefix
+func (c *EventsClient) ListRules(ctx context.Context, prefix string) ([]EventRule, error) {
+	var rules []EventRule
+	input := &eventbridge.ListRulesInput{NamePrefix: optionalString(prefix)}
+	for {
+		output, err := c.Client.ListRules(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("ListRules failed: %w", err)
+		}
+		for _, rule := range output.Rules {
+			rules = append(rules, EventRule{
+				Name:               aws.ToString(rule.Name),
+				Arn:                aws.ToString(rule.Arn),
+				ScheduleExpression: aws.ToString(rule.ScheduleExpression),
+				State:              string(rule.State),
+				Description:        aws.ToString(rule.Description),
+			})
+		}
+		if aws.ToString(output.NextToken) == "" {
+			return rules, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// ListTargets returns the targets of a rule
+func (c *EventsClient) ListTargets(ctx context.Context, rule string) ([]EventTarget, error) {
+	var targets []EventTarget
+	input := &eventbridge.ListTargetsByRuleInput{Rule: aws.String(rule)}
+	for {
+		output, err := c.Client.ListTargetsByRule(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("ListTargetsByRule failed: %w", err)
+		}
+		for _, target := range output.Targets {
+			targets = append(targets, EventTarget{
+				ID:      aws.ToString(target.Id),
+				Arn:     aws.ToString(target.Arn),
+				RoleArn: aws.ToString(target.RoleArn),
+				Input:   aws.ToString(target.Input),
+			})
+		}
+		if aws.ToString(output.NextToken) == "" {
+			return targets, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// DeleteRule removes the targets of a rule, which EventBridge requires first, and
+// then the rule
+func (c *EventsClient) DeleteRule(ctx context.Context, rule string) error {
+	targets, err := c.ListTargets(ctx, rule)
+	if err != nil {
+		return err
+	}
+	if len(targets) > 0 {
+		ids := make([]string, len(targets))
+		for i, target := range targets {
+			ids[i] = target.ID
+		}
+		if _, err := c.Client.RemoveTargets(ctx, &eventbridge.RemoveTargetsInput{Rule: aws.String(rule), Ids: ids}); err != nil {
+			return fmt.Errorf("RemoveTargets failed: %w", err)
+		}
+	}
+	if _, err := c.Client.DeleteRule(ctx, &eventbridge.DeleteRuleInput{Name: aws.String(rule)}); err != nil {
+		return fmt.Errorf("DeleteRule failed: %w", err)
+	}
+	return nil
+}
+
+// optionalString returns nil for an empty s, which the API takes as not set
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
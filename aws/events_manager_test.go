@@ -0,0 +1,152 @@
+// aws/events_manager_test.go
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/smithy-go"
+)
+
+// fakeEvents answers EventBridge calls with respond, recording each call's target and
+// body. A call respond has no response for fails with ResourceNotFoundException.
+func fakeEvents(t *testing.T, respond func(target string, body []byte) (string, bool)) (*EventsClient, *[]string) {
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/events/aws4_request") {
+			t.Errorf("request not signed for events: %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		target := r.Header.Get("X-Amz-Target")
+		calls = append(calls, target+" "+string(body))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		response, ok := respond(target, body)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			response = `{"__type":"com.amazonaws.events#ResourceNotFoundException","message":"Rule nightly does not exist."}`
+		}
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	client := eventbridge.New(eventbridge.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return &EventsClient{Client: client}, &calls
+}
+
+// eventsResponses answers each target with a fixed response
+func eventsResponses(responses map[string]string) func(string, []byte) (string, bool) {
+	return func(target string, _ []byte) (string, bool) {
+		response, ok := responses[target]
+		return response, ok
+	}
+}
+
+func TestEventsClientPutRule(t *testing.T) {
+	client, calls := fakeEvents(t, eventsResponses(map[string]string{
+		"AWSEvents.PutRule":    `{"RuleArn":"arn:aws:events:us-west-2:123456789012:rule/nightly"}`,
+		"AWSEvents.PutTargets": `{"FailedEntryCount":0,"FailedEntries":[]}`,
+	}))
+	ctx := context.Background()
+	arn, err := client.PutRule(ctx, EventRule{Name: "nightly", ScheduleExpression: "cron(0 2 * * ? *)", State: "ENABLED"}, map[string]string{"k": "v"})
+	if err != nil || arn != "arn:aws:events:us-west-2:123456789012:rule/nightly" {
+		t.Fatalf("PutRule = %q, %v", arn, err)
+	}
+	if err := client.PutTargets(ctx, "nightly", []EventTarget{{ID: "run", Arn: "arn:b", Input: `{"a":1}`}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		target string
+		body   map[string]any
+	}{
+		{"AWSEvents.PutRule", map[string]any{"Name": "nightly", "ScheduleExpression": "cron(0 2 * * ? *)", "State": "ENABLED", "Tags": []any{map[string]any{"Key": "k", "Value": "v"}}}},
+		{"AWSEvents.PutTargets", map[string]any{"Rule": "nightly", "Targets": []any{map[string]any{"Id": "run", "Arn": "arn:b", "Input": `{"a":1}`}}}},
+	}
+	if len(*calls) != len(want) {
+		t.Fatalf("calls %q, want %d", *calls, len(want))
+	}
+	for i, call := range *calls {
+		target, body, _ := strings.Cut(call, " ")
+		var got map[string]any
+		json.Unmarshal([]byte(body), &got)
+		wantBody, _ := json.Marshal(want[i].body)
+		gotBody, _ := json.Marshal(got)
+		if target != want[i].target || string(gotBody) != string(wantBody) {
+			t.Errorf("call %d = %s %s, want %s %s", i, target, gotBody, want[i].target, wantBody)
+		}
+	}
+}
+
+func TestEventsClientErrors(t *testing.T) {
+	client, _ := fakeEvents(t, eventsResponses(map[string]string{
+		"AWSEvents.PutTargets": `{"FailedEntryCount":1,"FailedEntries":[{"TargetId":"run","ErrorCode":"x","ErrorMessage":"role cannot be assumed"}]}`,
+	}))
+	ctx := context.Background()
+	err := client.DeleteRule(ctx, "nightly")
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "ResourceNotFoundException" || apiErr.ErrorMessage() != "Rule nightly does not exist." {
+		t.Errorf("DeleteRule error = %v", err)
+	}
+	err = client.PutTargets(ctx, "nightly", []EventTarget{{ID: "run", Arn: "arn:b"}})
+	if err == nil || !strings.Contains(err.Error(), "role cannot be assumed") {
+		t.Errorf("PutTargets error = %v", err)
+	}
+}
+
+func TestEventsClientPaging(t *testing.T) {
+	client, calls := fakeEvents(t, func(target string, body []byte) (string, bool) {
+		var input struct{ NextToken string }
+		json.Unmarshal(body, &input)
+		switch {
+		case target == "AWSEvents.ListRules" && input.NextToken == "":
+			return `{"Rules":[{"Name":"a"}],"NextToken":"t1"}`, true
+		case target == "AWSEvents.ListRules":
+			return `{"Rules":[{"Name":"b","State":"DISABLED"}]}`, true
+		}
+		return "", false
+	})
+	rules, err := client.ListRules(context.Background(), "awsmpirun-")
+	if err != nil || len(rules) != 2 || rules[1].Name != "b" || rules[1].State != "DISABLED" {
+		t.Fatalf("ListRules = %+v, %v", rules, err)
+	}
+	if len(*calls) != 2 || !strings.Contains((*calls)[1], `"NextToken":"t1"`) || !strings.Contains((*calls)[1], `"NamePrefix":"awsmpirun-"`) {
+		t.Errorf("requests %q", *calls)
+	}
+}
+
+func TestEventsClientDeleteRule(t *testing.T) {
+	client, calls := fakeEvents(t, eventsResponses(map[string]string{
+		"AWSEvents.ListTargetsByRule": `{"Targets":[{"Id":"run","Arn":"arn:b"}]}`,
+		"AWSEvents.RemoveTargets":     `{"FailedEntryCount":0}`,
+		"AWSEvents.DeleteRule":        `{}`,
+	}))
+	if err := client.DeleteRule(context.Background(), "nightly"); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, call := range *calls {
+		target, body, _ := strings.Cut(call, " ")
+		targets = append(targets, target)
+		if target == "AWSEvents.RemoveTargets" && !strings.Contains(body, `"Ids":["run"]`) {
+			t.Errorf("RemoveTargets %s, want the rule's target", body)
+		}
+	}
+	if got := strings.Join(targets, ","); got != "AWSEvents.ListTargetsByRule,AWSEvents.RemoveTargets,AWSEvents.DeleteRule" {
+		t.Errorf("calls %s, want the targets removed before the rule", got)
+	}
+}
@@ -0,0 +1,26 @@
+// aws/identity.go
+// This file looks up who the configured credentials belong to. GetCallerIdentity needs
+// no permissions, so it works for any credentials that are valid at all.
+
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// CallerARN returns the ARN of the principal the default credentials sign requests as
+func CallerARN(ctx context.Context) (string, error) {
+	cfg, err := loadRegionalConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the caller identity: %w", err)
+	}
+	return aws.ToString(identity.Arn), nil
+}
@@ -1,42 +1,47 @@
 // key_pair_manager.go
 // This file handles the creation of EC2 key pairs, which allow SSH access to EC2 instances.
-// The private key material is returned to the caller for secure access.
+// The private key is saved to a file only the current user can read.
 package aws
 
 import (
 	"context"
+	"fmt"
 	"log"
 
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 )
 
-// CreateKeyPair creates a new key pair in AWS EC2
-func CreateKeyPair(svc *ec2.Client, keyName string) {
+// CreateKeyPair creates a new key pair in AWS EC2 and saves its private key to keyPath,
+// readable only by the current user
+func CreateKeyPair(ctx context.Context, svc *ec2.Client, keyName, keyPath string) error {
 	input := &ec2.CreateKeyPairInput{
 		KeyName: aws.String(keyName),
 	}
 
-	// v2 call includes the context.Context as the first argument
-	result, err := svc.CreateKeyPair(context.TODO(), input)
+	result, err := svc.CreateKeyPair(ctx, input)
 	if err != nil {
-		log.Printf("Failed to create key pair: %v", err)
+		return fmt.Errorf("failed to create key pair: %w", err)
 	}
 
-	log.Printf("Created key pair: %s", *result.KeyName)
-	log.Printf("Private Key Material: \n%s", *result.KeyMaterial)
-
-	// You may want to save the private key to a file for later use
+	err = platform.Current().WritePrivateFile(keyPath, []byte(aws.ToString(result.KeyMaterial)))
+	if err != nil {
+		return fmt.Errorf("created key pair %s but failed to save its private key: %w", keyName, err)
+	}
+	log.Printf("Created key pair %s, private key saved to %s", aws.ToString(result.KeyName), keyPath)
+	return nil
 }
 
 // Delete a key pair
-func DeleteKeyPair(svc *ec2.Client, keyName string) error {
+func DeleteKeyPair(ctx context.Context, svc *ec2.Client, keyName string) error {
 	input := &ec2.DeleteKeyPairInput{
 		KeyName: aws.String(keyName),
 	}
 
 	// Call DeleteKeyPair API
-	_, err := svc.DeleteKeyPair(context.TODO(), input)
+	_, err := svc.DeleteKeyPair(ctx, input)
 	if err != nil {
 		log.Printf("Failed to delete key pair: %v", err)
 		return err
@@ -47,7 +52,7 @@ func DeleteKeyPair(svc *ec2.Client, keyName string) error {
 }
 
 // Describe a key pair
-func DescribeKeyPair(svc *ec2.Client, keyName string) {
+func DescribeKeyPair(ctx context.Context, svc *ec2.Client, keyName string) {
 	var input *ec2.DescribeKeyPairsInput
 
 	if keyName != "" {
@@ -61,7 +66,7 @@ func DescribeKeyPair(svc *ec2.Client, keyName string) {
 	}
 
 	// Call DescribeKeyPairs API
-	result, err := svc.DescribeKeyPairs(context.TODO(), input)
+	result, err := svc.DescribeKeyPairs(ctx, input)
 	if err != nil {
 		log.Printf("Failed to describe key pairs: %v", err)
 		return
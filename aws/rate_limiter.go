@@ -0,0 +1,186 @@
+// aws/rate_limiter.go
+// This file holds the client-side limit on SSM API calls. Every SSM client created by
+// SSMClientCreator in a process shares one token bucket and in-flight ceiling per
+// account and region, applied to each attempt of every operation, so a large job
+// polling hundreds of invocations or several commands running at once stay under the
+// SSM API rate instead of being throttled into partial failures.
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// RateLimit bounds the SSM calls of a process in one account and region
+type RateLimit struct {
+	Rate        float64 // Calls per second; 0 leaves the rate unlimited
+	Burst       int     // Calls that may go out at once after a quiet period
+	MaxInFlight int     // Calls awaiting a response at a time; 0 leaves them unlimited
+}
+
+// RateLimitRule applies a limit to the account and region it names; an empty Account
+// or Region matches any
+type RateLimitRule struct {
+	Account string
+	Region  string
+	Limit   RateLimit
+}
+
+// DefaultSSMRateLimit applies where no rule matches. It stays below the SSM API's
+// default throttling rates for Run Command.
+var DefaultSSMRateLimit = RateLimit{Rate: 20, Burst: 40, MaxInFlight: 32}
+
+var (
+	ssmRulesMu    sync.Mutex
+	ssmRules      []RateLimitRule
+	ssmLimiters   = make(map[string]*rateLimiter)
+	callerAccount string
+)
+
+// SetSSMRateLimits replaces the rules SSM clients created afterwards are limited by
+func SetSSMRateLimits(rules []RateLimitRule) {
+	ssmRulesMu.Lock()
+	defer ssmRulesMu.Unlock()
+	ssmRules = rules
+	ssmLimiters = make(map[string]*rateLimiter)
+}
+
+// MatchRateLimit returns the limit of the most specific rule matching the account and
+// region: one naming both wins over one naming the account, which wins over one naming
+// the region, and DefaultSSMRateLimit applies when none matches
+func MatchRateLimit(rules []RateLimitRule, account, region string) RateLimit {
+	limit, best := DefaultSSMRateLimit, -1
+	for _, rule := range rules {
+		if (rule.Account != "" && rule.Account != account) || (rule.Region != "" && rule.Region != region) {
+			continue
+		}
+		score := 0
+		if rule.Account != "" {
+			score += 2
+		}
+		if rule.Region != "" {
+			score++
+		}
+		if score > best {
+			limit, best = rule.Limit, score
+		}
+	}
+	return limit
+}
+
+// ssmLimiterFor returns the limiter shared by the SSM clients of cfg's account and
+// region. The account is only looked up when a rule names one.
+func ssmLimiterFor(ctx context.Context, cfg aws.Config) (*rateLimiter, error) {
+	ssmRulesMu.Lock()
+	defer ssmRulesMu.Unlock()
+
+	account := ""
+	for _, rule := range ssmRules {
+		if rule.Account == "" {
+			continue
+		}
+		if callerAccount == "" {
+			identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+			if err != nil {
+				return nil, fmt.Errorf("unable to look up the account for the SSM rate limits: %w", err)
+			}
+			callerAccount = aws.ToString(identity.Account)
+		}
+		account = callerAccount
+		break
+	}
+
+	key := account + "/" + cfg.Region
+	limiter, ok := ssmLimiters[key]
+	if !ok {
+		limiter = newRateLimiter(MatchRateLimit(ssmRules, account, cfg.Region), time.Now)
+		ssmLimiters[key] = limiter
+	}
+	return limiter, nil
+}
+
+// rateLimiter is a token bucket with a ceiling on calls in flight
+type rateLimiter struct {
+	limit    RateLimit
+	now      func() time.Time
+	inFlight chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit, now func() time.Time) *rateLimiter {
+	l := &rateLimiter{limit: limit, now: now, tokens: float64(max(limit.Burst, 1)), last: now()}
+	if limit.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, limit.MaxInFlight)
+	}
+	return l
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.
+// Tokens may go negative, so callers arriving together are spaced out in order.
+func (l *rateLimiter) reserve() time.Duration {
+	if l.limit.Rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	burst := float64(max(l.limit.Burst, 1))
+	l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*l.limit.Rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.limit.Rate * float64(time.Second))
+}
+
+// Wait blocks until a call may go out and returns the function to call once the
+// response has arrived
+func (l *rateLimiter) Wait(ctx context.Context) (func(), error) {
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.inFlight != nil {
+			<-l.inFlight
+		}
+	}
+	if wait := l.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// addMiddleware limits every attempt of the client's operations, retries included
+func (l *rateLimiter) addMiddleware(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("AwsmpirunRateLimit",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			release, err := l.Wait(ctx)
+			if err != nil {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+			}
+			defer release()
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+}
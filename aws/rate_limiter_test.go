@@ -0,0 +1,104 @@
+// aws/rate_limiter_test.go
+
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMatchRateLimit(t *testing.T) {
+	region := RateLimit{Rate: 1}
+	account := RateLimit{Rate: 2}
+	both := RateLimit{Rate: 3}
+	rules := []RateLimitRule{
+		{Region: "us-east-1", Limit: region},
+		{Account: "111111111111", Limit: account},
+		{Account: "111111111111", Region: "eu-west-1", Limit: both},
+	}
+	tests := []struct {
+		account, region string
+		want            RateLimit
+	}{
+		{account: "", region: "us-west-2", want: DefaultSSMRateLimit},
+		{account: "", region: "us-east-1", want: region},
+		{account: "111111111111", region: "us-east-1", want: account},
+		{account: "111111111111", region: "eu-west-1", want: both},
+		{account: "222222222222", region: "eu-west-1", want: DefaultSSMRateLimit},
+	}
+
+	for _, tt := range tests {
+		if got := MatchRateLimit(rules, tt.account, tt.region); got != tt.want {
+			t.Errorf("MatchRateLimit(%q, %q) = %+v, want %+v", tt.account, tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+	tests := []struct {
+		name    string
+		limit   RateLimit
+		advance []time.Duration // Clock advance before each call
+		want    []time.Duration
+	}{
+		{
+			name:    "burst then spaced",
+			limit:   RateLimit{Rate: 10, Burst: 2},
+			advance: []time.Duration{0, 0, 0, 0},
+			want:    []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:    "refills over time",
+			limit:   RateLimit{Rate: 10, Burst: 1},
+			advance: []time.Duration{0, 0, 300 * time.Millisecond},
+			want:    []time.Duration{0, 100 * time.Millisecond, 0},
+		},
+		{
+			name:    "refill capped at the burst",
+			limit:   RateLimit{Rate: 10, Burst: 2},
+			advance: []time.Duration{0, time.Hour, 0, 0},
+			want:    []time.Duration{0, 0, 0, 100 * time.Millisecond},
+		},
+		{
+			name:    "unlimited",
+			limit:   RateLimit{},
+			advance: []time.Duration{0, 0, 0},
+			want:    []time.Duration{0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		l := newRateLimiter(tt.limit, clock)
+		for i, advance := range tt.advance {
+			now = now.Add(advance)
+			if got := l.reserve(); got != tt.want[i] {
+				t.Errorf("%s: call %d waits %v, want %v", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestRateLimiterInFlight(t *testing.T) {
+	l := newRateLimiter(RateLimit{MaxInFlight: 1}, time.Now)
+	release, err := l.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second call waits for the first to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Wait(ctx); err == nil {
+		t.Fatal("second call went out while the first was in flight")
+	}
+
+	release()
+	second, err := l.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("call after release: %v", err)
+	}
+	second()
+}
@@ -1,14 +1,19 @@
 package aws
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Client struct {
@@ -16,9 +21,21 @@ type S3Client struct {
 	Bucket string
 }
 
-// NewS3Client initializes a new S3 client
-func NewS3Client(bucket string) (*S3Client, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-west-2"))
+// S3Object is an object found by ListObjects
+type S3Object struct {
+	Key          string
+	Size         int64
+	ETag         string // Without quotes; the MD5 of the content for objects uploaded in one part
+	LastModified time.Time
+}
+
+// NewS3Client initializes a new S3 client in AWS_REGION, defaulting to us-west-2
+func NewS3Client(ctx context.Context, bucket string) (*S3Client, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-west-2"
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
 		return nil, fmt.Errorf("unable to load SDK config, %v", err)
 	}
@@ -27,17 +44,37 @@ func NewS3Client(bucket string) (*S3Client, error) {
 }
 
 // UploadFile uploads a local file to the specified S3 bucket
-func (s *S3Client) UploadFile(localFilePath string, s3Key string) error {
+func (s *S3Client) UploadFile(ctx context.Context, localFilePath string, s3Key string) error {
+	return s.UploadFileWithMetadata(ctx, localFilePath, s3Key, nil)
+}
+
+// UploadFileWithMetadata uploads a local file with user-defined object metadata
+func (s *S3Client) UploadFileWithMetadata(ctx context.Context, localFilePath string, s3Key string, metadata map[string]string) error {
 	file, err := os.Open(localFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %v", err)
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %v", err)
+	}
+	if info.Size() > MultipartThreshold {
+		if err := s.uploadFileInParts(ctx, file, info.Size(), s3Key, metadata); err != nil {
+			return err
+		}
+		log.Printf("Uploaded %s to bucket %s as %s", localFilePath, s.Bucket, s3Key)
+		return nil
+	}
 
-	_, err = s.Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s3Key),
-		Body:   file,
+	err = retryTransfer(ctx, "upload of "+s3Key, func() error {
+		_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(s.Bucket),
+			Key:      aws.String(s3Key),
+			Body:     io.NewSectionReader(file, 0, info.Size()),
+			Metadata: metadata,
+		})
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("failed to upload file: %v", err)
@@ -46,16 +83,36 @@ func (s *S3Client) UploadFile(localFilePath string, s3Key string) error {
 	return nil
 }
 
-// DownloadFile downloads an S3 object to a local file
-func (s *S3Client) DownloadFile(s3Key, downloadPath string) error {
-	resp, err := s.Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s3Key),
+// UploadBytes uploads in-memory content to the specified S3 bucket
+func (s *S3Client) UploadBytes(ctx context.Context, data []byte, s3Key string) error {
+	return s.UploadBytesWithMetadata(ctx, data, s3Key, nil)
+}
+
+// UploadBytesWithMetadata uploads in-memory content with user-defined object metadata
+func (s *S3Client) UploadBytesWithMetadata(ctx context.Context, data []byte, s3Key string, metadata map[string]string) error {
+	err := retryTransfer(ctx, "upload of "+s3Key, func() error {
+		_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(s.Bucket),
+			Key:      aws.String(s3Key),
+			Body:     bytes.NewReader(data),
+			Metadata: metadata,
+		})
+		return err
 	})
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %v", err)
+	}
+	log.Printf("Uploaded %d bytes to bucket %s as %s", len(data), s.Bucket, s3Key)
+	return nil
+}
+
+// DownloadFile downloads an S3 object to a local file
+func (s *S3Client) DownloadFile(ctx context.Context, s3Key, downloadPath string) error {
+	object, err := s.openObject(ctx, s3Key)
 	if err != nil {
 		return fmt.Errorf("failed to download file: %v", err)
 	}
-	defer resp.Body.Close()
+	defer object.Close()
 
 	outFile, err := os.Create(downloadPath)
 	if err != nil {
@@ -63,10 +120,192 @@ func (s *S3Client) DownloadFile(s3Key, downloadPath string) error {
 	}
 	defer outFile.Close()
 
-	_, err = outFile.ReadFrom(resp.Body)
+	_, err = outFile.ReadFrom(object)
 	if err != nil {
 		return fmt.Errorf("failed to read object body: %v", err)
 	}
 	log.Printf("Downloaded %s to %s", s3Key, downloadPath)
 	return nil
 }
+
+// DownloadBytes returns the content of an S3 object. The error wraps the S3 error,
+// so callers can detect a missing object with errors.As and *types.NoSuchKey.
+func (s *S3Client) DownloadBytes(ctx context.Context, s3Key string) ([]byte, error) {
+	object, err := s.openObject(ctx, s3Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s: %w", s3Key, err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", s3Key, err)
+	}
+	return data, nil
+}
+
+// WriteObjectTo streams the content of an S3 object to w and returns its size
+func (s *S3Client) WriteObjectTo(ctx context.Context, s3Key string, w io.Writer) (int64, error) {
+	object, err := s.openObject(ctx, s3Key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download object %s: %w", s3Key, err)
+	}
+	defer object.Close()
+
+	n, err := io.Copy(w, object)
+	if err != nil {
+		return n, fmt.Errorf("failed to read object %s: %w", s3Key, err)
+	}
+	return n, nil
+}
+
+// ObjectSize returns the size in bytes of an S3 object
+func (s *S3Client) ObjectSize(ctx context.Context, s3Key string) (int64, error) {
+	resp, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to describe object %s: %v", s3Key, err)
+	}
+	return aws.ToInt64(resp.ContentLength), nil
+}
+
+// ObjectMetadata returns the user-defined metadata of an S3 object, with lowercase keys
+func (s *S3Client) ObjectMetadata(ctx context.Context, s3Key string) (map[string]string, error) {
+	resp, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe object %s: %w", s3Key, err)
+	}
+	return resp.Metadata, nil
+}
+
+// ListPrefixes returns the common prefixes one level below prefix, ending in "/"
+func (s *S3Client) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var prefixes []string
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.Bucket, err)
+		}
+		for _, common := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.ToString(common.Prefix))
+		}
+	}
+	return prefixes, nil
+}
+
+// ListObjects returns every object under prefix, in key order
+func (s *S3Client) ListObjects(ctx context.Context, prefix string) ([]S3Object, error) {
+	var objects []S3Object
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.Bucket, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, S3Object{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         strings.Trim(aws.ToString(object.ETag), `"`),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// CheckList lists at most one object under prefix, to find out whether the caller may
+// list the prefix without paging through it
+func (s *S3Client) CheckList(ctx context.Context, prefix string) error {
+	_, err := s.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s in bucket %s: %w", prefix, s.Bucket, err)
+	}
+	return nil
+}
+
+// CreateBucket creates the client's bucket in region, with tags
+func (s *S3Client) CreateBucket(ctx context.Context, region string, tags map[string]string) error {
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.Bucket)}
+	// us-east-1 is the one region that rejects its own location constraint
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{LocationConstraint: types.BucketLocationConstraint(region)}
+	}
+	if _, err := s.Client.CreateBucket(ctx, input); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", s.Bucket, err)
+	}
+	if len(tags) > 0 {
+		var tagSet []types.Tag
+		for key, value := range tags {
+			tagSet = append(tagSet, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		_, err := s.Client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+			Bucket:  aws.String(s.Bucket),
+			Tagging: &types.Tagging{TagSet: tagSet},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag bucket %s: %w", s.Bucket, err)
+		}
+	}
+	log.Printf("Created bucket %s in %s", s.Bucket, region)
+	return nil
+}
+
+// DeleteObjects deletes the objects with keys from the client's bucket
+func (s *S3Client) DeleteObjects(ctx context.Context, keys []string) error {
+	// DeleteObjects takes at most 1000 keys per call
+	for start := 0; start < len(keys); start += 1000 {
+		var ids []types.ObjectIdentifier
+		for _, key := range keys[start:min(start+1000, len(keys))] {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		result, err := s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects from bucket %s: %w", s.Bucket, err)
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s from bucket %s: %s", aws.ToString(result.Errors[0].Key), s.Bucket, aws.ToString(result.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+// DeleteBucket deletes every object in the client's bucket and then the bucket
+func (s *S3Client) DeleteBucket(ctx context.Context) error {
+	objects, err := s.ListObjects(ctx, "")
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if err := s.DeleteObjects(ctx, keys); err != nil {
+		return fmt.Errorf("failed to empty bucket %s: %w", s.Bucket, err)
+	}
+	if _, err := s.Client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(s.Bucket)}); err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %w", s.Bucket, err)
+	}
+	log.Printf("Deleted bucket %s and its %d objects", s.Bucket, len(objects))
+	return nil
+}
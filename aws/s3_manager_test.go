@@ -0,0 +1,97 @@
+// aws/s3_manager_test.go
+
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeBucket is an S3 endpoint with one bucket of objects
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects int
+	batches []int // Keys per DeleteObjects call
+	deleted bool
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		var contents strings.Builder
+		for i := 0; i < f.objects; i++ {
+			fmt.Fprintf(&contents, "<Contents><Key>jobs/%04d</Key><Size>1</Size></Contents>", i)
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Name>jobs</Name><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, contents.String())
+	case r.Method == http.MethodPost && query.Has("delete"):
+		var request struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.batches = append(f.batches, len(request.Objects))
+		f.objects -= len(request.Objects)
+		fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+	case r.Method == http.MethodDelete && r.URL.Path == "/jobs":
+		if f.objects > 0 {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `<Error><Code>BucketNotEmpty</Code><Message>not empty</Message></Error>`)
+			return
+		}
+		f.deleted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	tests := []struct {
+		objects int
+		batches []int
+	}{
+		{objects: 0},
+		{objects: 3, batches: []int{3}},
+		{objects: 1000, batches: []int{1000}},
+		{objects: 1500, batches: []int{1000, 500}},
+	}
+	for _, tt := range tests {
+		bucket := &fakeBucket{objects: tt.objects}
+		server := httptest.NewServer(bucket)
+		t.Cleanup(server.Close)
+		client := &S3Client{Client: s3.New(s3.Options{
+			Region:       "us-west-2",
+			BaseEndpoint: aws.String(server.URL),
+			UsePathStyle: true,
+			HTTPClient:   server.Client(),
+			Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+			}),
+			RetryMaxAttempts: 1,
+		}), Bucket: "jobs"}
+
+		if err := client.DeleteBucket(context.Background()); err != nil {
+			t.Fatalf("%d objects: DeleteBucket() = %v", tt.objects, err)
+		}
+		if !reflect.DeepEqual(bucket.batches, tt.batches) || !bucket.deleted {
+			t.Errorf("%d objects: batches %v, deleted %v, want %v and deleted", tt.objects, bucket.batches, bucket.deleted, tt.batches)
+		}
+	}
+}
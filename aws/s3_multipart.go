@@ -0,0 +1,165 @@
+// aws/s3_multipart.go
+// This file uploads an object as it is produced, with an S3 multipart upload, for
+// objects too large to hold in memory. Only the part being filled is buffered; each
+// full part is uploaded before the next one is started, and uploaded again if the
+// connection drops.
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Limits of S3 multipart uploads
+const (
+	MinPartSize  = 5 << 20 // Every part but the last must be at least this large
+	MaxPartCount = 10000
+)
+
+// DefaultPartSize is the part size of multipart uploads whose size is not known beforehand
+const DefaultPartSize = 8 << 20
+
+// PartSizeFor returns the smallest part size, at least DefaultPartSize, that uploads
+// an object of size bytes in at most MaxPartCount parts
+func PartSizeFor(size int64) int {
+	partSize := int64(DefaultPartSize)
+	if need := (size + MaxPartCount - 1) / MaxPartCount; need > partSize {
+		partSize = need
+	}
+	return int(partSize)
+}
+
+// MultipartWriter uploads what is written to it as one S3 object. Close completes the
+// upload; Abort discards it, and must be called if anything fails, since S3 keeps and
+// bills the parts of an upload that is neither completed nor aborted.
+type MultipartWriter struct {
+	ctx      context.Context
+	s3       *S3Client
+	key      string
+	uploadID string
+	partSize int
+	buffer   []byte
+	parts    []types.CompletedPart
+	written  int64
+	err      error // First failure; every later call returns it
+}
+
+// NewMultipartWriter starts a multipart upload of s3Key with user-defined metadata,
+// uploading a part every partSize bytes
+func (s *S3Client) NewMultipartWriter(ctx context.Context, s3Key string, metadata map[string]string, partSize int) (*MultipartWriter, error) {
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d is below the S3 minimum of %d bytes", partSize, MinPartSize)
+	}
+	resp, err := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(s3Key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload of %s: %v", s3Key, err)
+	}
+	return &MultipartWriter{
+		ctx:      ctx,
+		s3:       s,
+		key:      s3Key,
+		uploadID: aws.ToString(resp.UploadId),
+		partSize: partSize,
+		buffer:   make([]byte, 0, partSize),
+	}, nil
+}
+
+// Write buffers p and uploads every part it fills
+func (w *MultipartWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := min(len(p), w.partSize-len(w.buffer))
+		w.buffer = append(w.buffer, p[:room]...)
+		p = p[room:]
+		if len(w.buffer) == w.partSize {
+			if err := w.uploadPart(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close uploads the last part and completes the upload
+func (w *MultipartWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	// An empty object still needs one part
+	if len(w.buffer) > 0 || len(w.parts) == 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	_, err := w.s3.Client.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.s3.Bucket),
+		Key:             aws.String(w.key),
+		UploadId:        aws.String(w.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if err != nil {
+		w.err = fmt.Errorf("failed to complete upload of %s: %v", w.key, err)
+		return w.err
+	}
+	w.err = fmt.Errorf("upload of %s is already complete", w.key)
+	log.Printf("Uploaded %d bytes to bucket %s as %s in %d parts", w.written, w.s3.Bucket, w.key, len(w.parts))
+	return nil
+}
+
+// Abort discards the upload and the parts uploaded so far
+func (w *MultipartWriter) Abort() error {
+	w.err = fmt.Errorf("upload of %s was aborted", w.key)
+	_, err := w.s3.Client.AbortMultipartUpload(context.WithoutCancel(w.ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.s3.Bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort upload of %s: %v", w.key, err)
+	}
+	return nil
+}
+
+func (w *MultipartWriter) uploadPart() error {
+	number := aws.Int32(int32(len(w.parts) + 1))
+	if int(*number) > MaxPartCount {
+		w.err = fmt.Errorf("upload of %s needs more than %d parts of %d bytes", w.key, MaxPartCount, w.partSize)
+		return w.err
+	}
+	var etag *string
+	err := retryTransfer(w.ctx, fmt.Sprintf("part %d of %s", *number, w.key), func() error {
+		resp, err := w.s3.Client.UploadPart(w.ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(w.s3.Bucket),
+			Key:        aws.String(w.key),
+			UploadId:   aws.String(w.uploadID),
+			PartNumber: number,
+			Body:       bytes.NewReader(w.buffer),
+		})
+		if err == nil {
+			etag = resp.ETag
+		}
+		return err
+	})
+	if err != nil {
+		w.err = fmt.Errorf("failed to upload part %d of %s: %v", *number, w.key, err)
+		return w.err
+	}
+	w.parts = append(w.parts, types.CompletedPart{ETag: etag, PartNumber: number})
+	w.written += int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
@@ -0,0 +1,189 @@
+// aws/s3_multipart_test.go
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeUploads is an S3 endpoint that keeps the multipart uploads it is sent
+type fakeUploads struct {
+	mu        sync.Mutex
+	parts     map[int][]byte
+	metadata  string
+	completed []byte // Parts concatenated in the order of the complete request
+	aborted   bool
+	failPart  int // Part number answered with an error, 0 for none
+}
+
+func (f *fakeUploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.metadata = r.Header.Get("X-Amz-Meta-Job")
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>jobs</Bucket><Key>out</Key><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Get("uploadId") == "u1":
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		if number == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<Error><Code>InternalError</Code><Message>disk on fire</Message></Error>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost && query.Get("uploadId") == "u1":
+		var complete struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int
+			} `xml:"Part"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.completed = []byte{}
+		for _, part := range complete.Parts {
+			if part.ETag != fmt.Sprintf(`"etag-%d"`, part.PartNumber) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f.completed = append(f.completed, f.parts[part.PartNumber]...)
+		}
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>jobs</Bucket><Key>out</Key><ETag>"done"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && query.Get("uploadId") == "u1":
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func fakeS3(t *testing.T, uploads *fakeUploads) *S3Client {
+	uploads.parts = make(map[int][]byte)
+	server := httptest.NewServer(uploads)
+	t.Cleanup(server.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return &S3Client{Client: client, Bucket: "jobs"}
+}
+
+func TestMultipartWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []int // Sizes of the writes
+		parts  int
+	}{
+		{name: "empty", writes: nil, parts: 1},
+		{name: "one short part", writes: []int{100}, parts: 1},
+		{name: "exactly one part", writes: []int{MinPartSize}, parts: 1},
+		{name: "write across parts", writes: []int{3, 2*MinPartSize + 10}, parts: 3},
+		{name: "many small writes", writes: []int{MinPartSize / 2, MinPartSize / 2, MinPartSize / 2}, parts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploads := &fakeUploads{}
+			client := fakeS3(t, uploads)
+			w, err := client.NewMultipartWriter(context.Background(), "out", map[string]string{"job": "j1"}, MinPartSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			for i, size := range tt.writes {
+				p := bytes.Repeat([]byte{byte('a' + i)}, size)
+				want.Write(p)
+				if n, err := w.Write(p); n != size || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if len(uploads.parts) != tt.parts {
+				t.Errorf("uploaded %d parts, want %d", len(uploads.parts), tt.parts)
+			}
+			if !bytes.Equal(uploads.completed, want.Bytes()) {
+				t.Errorf("object has %d bytes, want the %d written", len(uploads.completed), want.Len())
+			}
+			if uploads.metadata != "j1" {
+				t.Errorf("metadata job = %q, want j1", uploads.metadata)
+			}
+			if _, err := w.Write([]byte("late")); err == nil {
+				t.Error("Write after Close succeeded")
+			}
+		})
+	}
+}
+
+func TestMultipartWriterFailure(t *testing.T) {
+	uploads := &fakeUploads{failPart: 2}
+	client := fakeS3(t, uploads)
+	w, err := client.NewMultipartWriter(context.Background(), "out", nil, MinPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := w.Write(make([]byte, 2*MinPartSize+1))
+	if err == nil || !strings.Contains(err.Error(), "failed to upload part 2 of out") {
+		t.Fatalf("Write() error = %v, want the failed part", err)
+	}
+	if n != 2*MinPartSize {
+		t.Errorf("Write() = %d, want the %d bytes taken before the failure", n, 2*MinPartSize)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close() after a failed part succeeded")
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !uploads.aborted || uploads.completed != nil {
+		t.Errorf("aborted = %v, completed = %v; want the upload aborted", uploads.aborted, uploads.completed != nil)
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, DefaultPartSize},
+		{DefaultPartSize * MaxPartCount, DefaultPartSize},
+		{1 << 40, 109951163},
+	}
+	for _, tt := range tests {
+		got := PartSizeFor(tt.size)
+		if got != tt.want {
+			t.Errorf("PartSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+		if int64(got)*MaxPartCount < tt.size {
+			t.Errorf("PartSizeFor(%d) = %d does not fit in %d parts", tt.size, got, MaxPartCount)
+		}
+	}
+	if _, err := (&S3Client{}).NewMultipartWriter(context.Background(), "out", nil, MinPartSize-1); err == nil {
+		t.Error("NewMultipartWriter accepted a part below the S3 minimum")
+	}
+}
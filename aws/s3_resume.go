@@ -0,0 +1,291 @@
+// aws/s3_resume.go
+// This file keeps large S3 transfers going over a flaky network. The SDK retries a
+// request that fails outright, but not a body that breaks off halfway, and it
+// restarts a request from its first byte. So a download is read through an
+// objectReader, which reopens the object with a range request at the byte where the
+// connection dropped, pinned to the version it started reading by its ETag. An
+// upload larger than MultipartThreshold goes up in parts, each retried on its own;
+// an upload that gives up is left in S3, and the next upload of the same key resumes
+// it, skipping the parts S3 already holds with the same content.
+
+package aws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// MultipartThreshold is the file size above which UploadFile uploads in parts
+const MultipartThreshold = 64 << 20
+
+// transferAttempts is how many times a transfer is tried before a dropped connection fails it
+const transferAttempts = 5
+
+// transferBackoff is the wait before the first retry, doubled before each one after it
+var transferBackoff = time.Second
+
+// isTransient reports whether err is a dropped, reset, or stalled connection, which
+// a retry may get past
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// A request that got no response at all, after the SDK's own retries
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryTransfer calls fn until it succeeds, fails for another reason than the
+// connection, or has failed transferAttempts times
+func retryTransfer(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransient(err) || attempt == transferAttempts {
+			return err
+		}
+		log.Printf("Retrying %s after: %v", what, err)
+		if err := SleepContext(ctx, transferBackoff<<(attempt-1)); err != nil {
+			return err
+		}
+	}
+}
+
+// objectReader reads an S3 object, reopening it where it stopped when the connection drops
+type objectReader struct {
+	ctx      context.Context
+	s3       *S3Client
+	key      string
+	etag     string // Of the version first opened; a reopened range must match it
+	body     io.ReadCloser
+	offset   int64
+	failures int // Since the last byte read
+}
+
+// openObject opens s3Key for reading. The error of the first request is the S3 error,
+// wrapped, so callers can detect a missing object.
+func (s *S3Client) openObject(ctx context.Context, s3Key string) (*objectReader, error) {
+	r := &objectReader{ctx: ctx, s3: s, key: s3Key}
+	err := retryTransfer(ctx, "download of "+s3Key, r.open)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *objectReader) open() error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.s3.Bucket),
+		Key:    aws.String(r.key),
+	}
+	if r.offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", r.offset))
+		if r.etag != "" {
+			input.IfMatch = aws.String(r.etag)
+		}
+	}
+	resp, err := r.s3.Client.GetObject(r.ctx, input)
+	if err != nil {
+		if r.offset > 0 {
+			return fmt.Errorf("failed to resume %s at byte %d: %w", r.key, r.offset, err)
+		}
+		return err
+	}
+	if r.offset == 0 {
+		r.etag = aws.ToString(resp.ETag)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+// Read reads the object, reopening it after a dropped connection until transferAttempts
+// attempts in a row have failed without reading anything
+func (r *objectReader) Read(p []byte) (int, error) {
+	for {
+		var n int
+		var err error
+		if r.body == nil {
+			err = r.open()
+		} else {
+			n, err = r.body.Read(p)
+			r.offset += int64(n)
+			if n > 0 {
+				r.failures = 0
+			}
+			if isTransient(err) {
+				r.body.Close()
+				r.body = nil
+			}
+		}
+		if err == nil || !isTransient(err) {
+			return n, err
+		}
+		if r.failures++; r.failures == transferAttempts {
+			return n, fmt.Errorf("failed to read %s after %d attempts: %w", r.key, transferAttempts, err)
+		}
+		log.Printf("Resuming download of %s at byte %d after: %v", r.key, r.offset, err)
+		if err := SleepContext(r.ctx, transferBackoff<<(r.failures-1)); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the body being read
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// uploadFileInParts uploads size bytes of file as s3Key in parts, resuming an
+// unfinished upload of s3Key if there is one. An upload that fails on the connection
+// is left for the next call to resume; one that fails otherwise is aborted.
+func (s *S3Client) uploadFileInParts(ctx context.Context, file *os.File, size int64, s3Key string, metadata map[string]string) error {
+	partSize := int64(PartSizeFor(size))
+	uploadID, uploaded := s.unfinishedUpload(ctx, s3Key)
+	if uploadID == "" {
+		resp, err := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(s.Bucket),
+			Key:      aws.String(s3Key),
+			Metadata: metadata,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start upload of %s: %v", s3Key, err)
+		}
+		uploadID = aws.ToString(resp.UploadId)
+	}
+	var parts []types.CompletedPart
+	reused := 0
+	for offset := int64(0); offset < size; offset += partSize {
+		number := int32(len(parts) + 1)
+		section := io.NewSectionReader(file, offset, min(partSize, size-offset))
+		if etag, ok := uploaded[number]; ok && partMatches(section, etag) {
+			parts = append(parts, types.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int32(number)})
+			reused++
+			continue
+		}
+		var etag *string
+		err := retryTransfer(ctx, fmt.Sprintf("part %d of %s", number, s3Key), func() error {
+			resp, err := s.Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.Bucket),
+				Key:        aws.String(s3Key),
+				UploadId:   aws.String(uploadID),
+				PartNumber: aws.Int32(number),
+				Body:       io.NewSectionReader(section, 0, section.Size()),
+			})
+			if err == nil {
+				etag = resp.ETag
+			}
+			return err
+		})
+		if err != nil {
+			if !isTransient(err) {
+				s.abortUpload(ctx, s3Key, uploadID)
+			}
+			return fmt.Errorf("failed to upload part %d of %s: %v", number, s3Key, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: etag, PartNumber: aws.Int32(number)})
+	}
+	err := retryTransfer(ctx, "completion of "+s3Key, func() error {
+		_, err := s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.Bucket),
+			Key:             aws.String(s3Key),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %v", s3Key, err)
+	}
+	if reused > 0 {
+		log.Printf("Resumed upload of %s with %d of its %d parts already in S3", s3Key, reused, len(parts))
+	}
+	return nil
+}
+
+// unfinishedUpload returns the latest unfinished multipart upload of s3Key and the
+// ETags of its parts by number, or no upload when there is none or it cannot be listed
+func (s *S3Client) unfinishedUpload(ctx context.Context, s3Key string) (string, map[int32]string) {
+	resp, err := s.Client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s3Key),
+	})
+	if err != nil {
+		log.Printf("Not resuming an earlier upload of %s: %v", s3Key, err)
+		return "", nil
+	}
+	var latest *types.MultipartUpload
+	for i, upload := range resp.Uploads {
+		if aws.ToString(upload.Key) == s3Key && (latest == nil || aws.ToTime(upload.Initiated).After(aws.ToTime(latest.Initiated))) {
+			latest = &resp.Uploads[i]
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	uploadID := aws.ToString(latest.UploadId)
+	parts := make(map[int32]string)
+	paginator := s3.NewListPartsPaginator(s.Client, &s3.ListPartsInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(s3Key),
+		UploadId: aws.String(uploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Not resuming upload %s of %s: %v", uploadID, s3Key, err)
+			return "", nil
+		}
+		for _, part := range page.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = aws.ToString(part.ETag)
+		}
+	}
+	return uploadID, parts
+}
+
+// partMatches reports whether etag, the ETag of an uploaded part, is the MD5 of
+// section. Parts encrypted with KMS have other ETags, and are uploaded again.
+func partMatches(section *io.SectionReader, etag string) bool {
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(section, 0, section.Size())); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == strings.Trim(etag, `"`)
+}
+
+func (s *S3Client) abortUpload(ctx context.Context, s3Key, uploadID string) {
+	_, err := s.Client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(s3Key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.Printf("Failed to abort upload of %s: %v", s3Key, err)
+	}
+}
@@ -0,0 +1,408 @@
+// aws/s3_resume_test.go
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// flakyStore is an S3 endpoint with one object and at most one multipart upload, that
+// drops the connection of the next drops requests
+type flakyStore struct {
+	mu        sync.Mutex
+	object    []byte
+	drops     int
+	dropAfter int   // Bytes of an object sent before its connection is dropped
+	dropPart  int32 // Part number whose uploads are dropped, 0 for every request
+	changeTo  []byte
+	uploadID  string
+	parts     map[int32][]byte
+	requests  []string // "GET <range>", "PUT", "PUT part <n>"
+	aborted   bool
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *flakyStore) drop(part int32) bool {
+	if f.drops == 0 || (f.dropPart != 0 && part != f.dropPart) {
+		return false
+	}
+	f.drops--
+	return true
+}
+
+// resetRequests forgets the requests served so far
+func (f *flakyStore) resetRequests() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = nil
+}
+
+// state returns the requests served so far, the stored object, the parts of the
+// multipart upload, and whether it was aborted
+func (f *flakyStore) state() (requests []string, object []byte, parts int, aborted bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests), bytes.Clone(f.object), len(f.parts), f.aborted
+}
+
+func (f *flakyStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		var uploads string
+		if f.uploadID != "" {
+			uploads = fmt.Sprintf("<Upload><Key>big</Key><UploadId>%s</UploadId><Initiated>2026-10-14T00:00:00.000Z</Initiated></Upload>", f.uploadID)
+		}
+		fmt.Fprintf(w, `<ListMultipartUploadsResult><Bucket>jobs</Bucket><IsTruncated>false</IsTruncated>%s</ListMultipartUploadsResult>`, uploads)
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		var parts strings.Builder
+		for number := int32(1); number <= int32(len(f.parts)); number++ {
+			fmt.Fprintf(&parts, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>", number, etagOf(f.parts[number]), len(f.parts[number]))
+		}
+		fmt.Fprintf(w, `<ListPartsResult><Bucket>jobs</Bucket><Key>big</Key><IsTruncated>false</IsTruncated>%s</ListPartsResult>`, parts.String())
+	case r.Method == http.MethodGet:
+		f.requests = append(f.requests, "GET "+r.Header.Get("Range"))
+		if match := r.Header.Get("If-Match"); match != "" && match != etagOf(f.object) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>changed</Message></Error>`)
+			return
+		}
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		body := f.object[start:]
+		w.Header().Set("ETag", etagOf(f.object))
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if !f.drop(0) {
+			w.Write(body)
+			return
+		}
+		w.Write(body[:min(f.dropAfter, len(body))])
+		w.(http.Flusher).Flush()
+		if f.changeTo != nil {
+			f.object = f.changeTo
+		}
+		panic(http.ErrAbortHandler)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploadID, f.parts = "u1", make(map[int32][]byte)
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>jobs</Bucket><Key>big</Key><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut:
+		var number int32
+		fmt.Sscan(query.Get("partNumber"), &number)
+		body, _ := io.ReadAll(r.Body)
+		if number > 0 {
+			f.requests = append(f.requests, fmt.Sprintf("PUT part %d", number))
+		} else {
+			f.requests = append(f.requests, "PUT")
+		}
+		if f.drop(number) {
+			panic(http.ErrAbortHandler)
+		}
+		if number > 0 {
+			f.parts[number] = body
+		} else {
+			f.object = body
+		}
+		w.Header().Set("ETag", etagOf(body))
+	case r.Method == http.MethodPost && query.Get("uploadId") == f.uploadID:
+		var complete struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int32
+			} `xml:"Part"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			if part.ETag != etagOf(f.parts[part.PartNumber]) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Error><Code>InvalidPart</Code><Message>wrong etag</Message></Error>`)
+				return
+			}
+			object = append(object, f.parts[part.PartNumber]...)
+		}
+		f.object, f.uploadID, f.parts = object, "", nil
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>jobs</Bucket><Key>big</Key><ETag>"done"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.aborted, f.uploadID = true, ""
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func flakyS3(t *testing.T, store *flakyStore) *S3Client {
+	backoff := transferBackoff
+	transferBackoff = time.Millisecond
+	t.Cleanup(func() { transferBackoff = backoff })
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+	return &S3Client{Client: client, Bucket: "jobs"}
+}
+
+// pattern returns size bytes that differ from one offset to the next
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+func TestDownloadResumes(t *testing.T) {
+	object := pattern(10000)
+	tests := []struct {
+		name      string
+		drops     int
+		dropAfter int
+		changeTo  []byte
+		requests  []string
+		wantErr   string
+	}{
+		{name: "no drops", requests: []string{"GET "}},
+		{
+			name: "two drops", drops: 2, dropAfter: 3000,
+			requests: []string{"GET ", "GET bytes=3000-", "GET bytes=6000-"},
+		},
+		{
+			name: "no progress", drops: transferAttempts, dropAfter: 0,
+			requests: []string{"GET ", "GET ", "GET ", "GET ", "GET "},
+			wantErr:  "after 5 attempts",
+		},
+		{
+			name: "replaced while read", drops: 1, dropAfter: 100, changeTo: []byte("new"),
+			requests: []string{"GET ", "GET bytes=100-"},
+			wantErr:  "failed to resume big at byte 100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyStore{object: object, drops: tt.drops, dropAfter: tt.dropAfter, changeTo: tt.changeTo}
+			client := flakyS3(t, store)
+			path := filepath.Join(t.TempDir(), "big")
+			err := client.DownloadFile(context.Background(), "big", path)
+			if requests, _, _, _ := store.state(); !reflect.DeepEqual(requests, tt.requests) {
+				t.Errorf("requests %q, want %q", requests, tt.requests)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, object) {
+				t.Errorf("downloaded %d bytes that differ from the %d of the object", len(got), len(object))
+			}
+		})
+	}
+}
+
+func TestDownloadBytesMissing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+	}))
+	t.Cleanup(server.Close)
+	client := flakyS3(t, &flakyStore{})
+	client.Client = s3.New(client.Client.Options(), func(o *s3.Options) {
+		o.BaseEndpoint, o.HTTPClient = aws.String(server.URL), server.Client()
+	})
+	_, err := client.DownloadBytes(context.Background(), "checkpoint")
+	var missing *types.NoSuchKey
+	if !errors.As(err, &missing) {
+		t.Errorf("error = %v, want NoSuchKey", err)
+	}
+}
+
+func TestUploadBytesRetries(t *testing.T) {
+	store := &flakyStore{drops: 2}
+	client := flakyS3(t, store)
+	data := pattern(1000)
+	if err := client.UploadBytes(context.Background(), data, "small"); err != nil {
+		t.Fatal(err)
+	}
+	requests, object, _, _ := store.state()
+	if !bytes.Equal(object, data) || len(requests) != 3 {
+		t.Errorf("stored %d bytes in %d requests, want %d in 3", len(object), len(requests), len(data))
+	}
+}
+
+func TestUploadFileResumes(t *testing.T) {
+	const parts = 9 // Of DefaultPartSize, the part size of a file just above MultipartThreshold
+	data := pattern(MultipartThreshold + 1)
+	path := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	partOf := func(number int) []byte {
+		return data[(number-1)*DefaultPartSize : min(number*DefaultPartSize, len(data))]
+	}
+
+	tests := []struct {
+		name     string
+		uploaded []int // Parts an earlier attempt left in S3
+		corrupt  int   // One of them, with other content
+		drops    int
+		dropPart int32
+		uploads  []int // Parts this upload sends
+	}{
+		{name: "fresh", uploads: []int{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{name: "dropped part", drops: 2, dropPart: 3, uploads: []int{1, 2, 3, 3, 3, 4, 5, 6, 7, 8, 9}},
+		{name: "resumed", uploaded: []int{1, 2, 3, 4}, uploads: []int{5, 6, 7, 8, 9}},
+		{name: "resumed over a changed part", uploaded: []int{1, 2, 3}, corrupt: 2, uploads: []int{2, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyStore{drops: tt.drops, dropPart: tt.dropPart}
+			if tt.uploaded != nil {
+				store.uploadID, store.parts = "u0", make(map[int32][]byte)
+				for _, number := range tt.uploaded {
+					store.parts[int32(number)] = partOf(number)
+				}
+				if tt.corrupt != 0 {
+					store.parts[int32(tt.corrupt)] = pattern(DefaultPartSize)[1:]
+				}
+			}
+			client := flakyS3(t, store)
+			if err := client.UploadFile(context.Background(), path, "big"); err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, number := range tt.uploads {
+				want = append(want, fmt.Sprintf("PUT part %d", number))
+			}
+			requests, object, _, _ := store.state()
+			if !reflect.DeepEqual(requests, want) {
+				t.Errorf("requests %q, want %q", requests, want)
+			}
+			if !bytes.Equal(object, data) {
+				t.Errorf("object has %d bytes that differ from the %d of the file", len(object), len(data))
+			}
+		})
+	}
+
+	t.Run("given up, then resumed", func(t *testing.T) {
+		store := &flakyStore{drops: transferAttempts, dropPart: 4}
+		client := flakyS3(t, store)
+		err := client.UploadFile(context.Background(), path, "big")
+		if err == nil || !strings.Contains(err.Error(), "failed to upload part 4 of big") {
+			t.Fatalf("error = %v, want part 4 failed", err)
+		}
+		if _, _, uploaded, aborted := store.state(); aborted || uploaded != 3 {
+			t.Fatalf("aborted = %v with %d parts, want the upload left with 3 parts", aborted, uploaded)
+		}
+		store.resetRequests()
+		if err := client.UploadFile(context.Background(), path, "big"); err != nil {
+			t.Fatal(err)
+		}
+		if requests, object, _, _ := store.state(); len(requests) != parts-3 || !bytes.Equal(object, data) {
+			t.Errorf("resumed with requests %q, object of %d bytes", requests, len(object))
+		}
+	})
+}
+
+func TestMultipartWriterRetriesParts(t *testing.T) {
+	store := &flakyStore{drops: 1, dropPart: 2}
+	client := flakyS3(t, store)
+	store.resetRequests()
+	w, err := client.NewMultipartWriter(context.Background(), "big", nil, MinPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pattern(2*MinPartSize + 10)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PUT part 1", "PUT part 2", "PUT part 2", "PUT part 3"}
+	requests, object, _, _ := store.state()
+	if !reflect.DeepEqual(requests, want) || !bytes.Equal(object, data) {
+		t.Errorf("requests %q and an object of %d bytes, want %q and %d", requests, len(object), want, len(data))
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: io.ErrUnexpectedEOF, want: true},
+		{err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), want: true},
+		{err: io.EOF, want: false},
+		{err: context.Canceled, want: false},
+		{err: &types.NoSuchKey{}, want: false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkDownloadBytes downloads a 64 MiB object through an objectReader
+func BenchmarkDownloadBytes(b *testing.B) {
+	object := pattern(64 << 20)
+	server := httptest.NewServer(&flakyStore{object: object})
+	b.Cleanup(server.Close)
+	client := &S3Client{Bucket: "jobs", Client: s3.New(s3.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+	})}
+	b.SetBytes(int64(len(object)))
+	for i := 0; i < b.N; i++ {
+		if _, err := client.DownloadBytes(context.Background(), "big"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -15,14 +15,14 @@ import (
 )
 
 // Create a new security group
-func CreateSecurityGroup(svc *ec2.Client, groupName, vpcId string) (*ec2.CreateSecurityGroupOutput, error) {
+func CreateSecurityGroup(ctx context.Context, svc *ec2.Client, groupName, vpcId string) (*ec2.CreateSecurityGroupOutput, error) {
 	input := &ec2.CreateSecurityGroupInput{
 		GroupName:   aws.String(groupName),
 		Description: aws.String("Security group for gRPC MPI project"),
 		VpcId:       aws.String(vpcId),
 	}
 
-	result, err := svc.CreateSecurityGroup(context.TODO(), input)
+	result, err := svc.CreateSecurityGroup(ctx, input)
 	if err != nil {
 		log.Printf("Failed to create security group: %v", err)
 		return nil, err
@@ -33,7 +33,7 @@ func CreateSecurityGroup(svc *ec2.Client, groupName, vpcId string) (*ec2.CreateS
 }
 
 // Add ingress rule to allow SSH and dynamic gRPC ports
-func AuthorizeSecurityGroupIngress(svc *ec2.Client, groupId string, port int32) {
+func AuthorizeSecurityGroupIngress(ctx context.Context, svc *ec2.Client, groupId string, port int32) {
 	// Create a list of IpPermissions for each port in the list
 	var ipPermissions []types.IpPermission
 
@@ -69,7 +69,7 @@ func AuthorizeSecurityGroupIngress(svc *ec2.Client, groupId string, port int32)
 	}
 
 	// Call AuthorizeSecurityGroupIngress API
-	_, err := svc.AuthorizeSecurityGroupIngress(context.TODO(), input)
+	_, err := svc.AuthorizeSecurityGroupIngress(ctx, input)
 	if err != nil {
 		log.Printf("Failed to authorize ingress for security group %s: %v", groupId, err)
 		return
@@ -79,13 +79,13 @@ func AuthorizeSecurityGroupIngress(svc *ec2.Client, groupId string, port int32)
 }
 
 // Delete a security group
-func DeleteSecurityGroup(svc *ec2.Client, groupId string) error {
+func DeleteSecurityGroup(ctx context.Context, svc *ec2.Client, groupId string) error {
 	input := &ec2.DeleteSecurityGroupInput{
 		GroupId: aws.String(groupId),
 	}
 
 	// Call DeleteSecurityGroup API
-	_, err := svc.DeleteSecurityGroup(context.TODO(), input)
+	_, err := svc.DeleteSecurityGroup(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to delete security group %s: %v", groupId, err)
 	}
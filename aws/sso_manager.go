@@ -0,0 +1,171 @@
+// aws/sso_manager.go
+// This file drives the IAM Identity Center (SSO) device authorization flow used by
+// awsmpirun login: it registers a public client, starts a device authorization the
+// user approves in a browser, polls for the access token, and lists the accounts and
+// roles the token may use. None of these calls needs AWS credentials, so the clients
+// are created from the SSO region alone.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sso"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	oidcTypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+)
+
+// deviceCodeGrant is the OAuth grant type of the device authorization flow
+const deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+// SSODevice is a device authorization waiting for the user's approval
+type SSODevice struct {
+	VerificationURI string // Opens the approval page with the code filled in
+	UserCode        string // Shown on the page for the user to compare
+	ExpiresAt       time.Time
+
+	client       *ssooidc.Client
+	region       string
+	startURL     string
+	clientID     string
+	clientSecret string
+	clientExpiry time.Time
+	deviceCode   string
+	interval     time.Duration
+}
+
+// SSOToken is an access token for the SSO portal, as the AWS CLI caches it
+type SSOToken struct {
+	StartURL              string    `json:"startUrl"`
+	Region                string    `json:"region"`
+	AccessToken           string    `json:"accessToken"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	ClientID              string    `json:"clientId,omitempty"`
+	ClientSecret          string    `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt time.Time `json:"registrationExpiresAt,omitempty"`
+}
+
+// SSOAccount is an account the signed-in user has access to
+type SSOAccount struct {
+	ID    string
+	Name  string
+	Email string
+}
+
+// StartSSOLogin registers awsmpirun with the identity provider of startURL in region
+// and starts a device authorization
+func StartSSOLogin(ctx context.Context, region, startURL string) (*SSODevice, error) {
+	client := ssooidc.New(ssooidc.Options{Region: region})
+	registration, err := client.RegisterClient(ctx, &ssooidc.RegisterClientInput{
+		ClientName: aws.String("awsmpirun"),
+		ClientType: aws.String("public"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register with IAM Identity Center: %w", err)
+	}
+	device := &SSODevice{
+		client:       client,
+		region:       region,
+		startURL:     startURL,
+		clientID:     aws.ToString(registration.ClientId),
+		clientSecret: aws.ToString(registration.ClientSecret),
+		clientExpiry: time.Unix(registration.ClientSecretExpiresAt, 0).UTC(),
+	}
+	authorization, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     aws.String(startURL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the device authorization: %w", err)
+	}
+	device.VerificationURI = aws.ToString(authorization.VerificationUriComplete)
+	device.UserCode = aws.ToString(authorization.UserCode)
+	device.ExpiresAt = time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	device.deviceCode = aws.ToString(authorization.DeviceCode)
+	device.interval = time.Duration(max(authorization.Interval, 1)) * time.Second
+	return device, nil
+}
+
+// WaitForToken polls until the user approves the authorization, it expires, or ctx is done
+func (d *SSODevice) WaitForToken(ctx context.Context) (SSOToken, error) {
+	for {
+		if err := SleepContext(ctx, d.interval); err != nil {
+			return SSOToken{}, err
+		}
+		result, err := d.client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     aws.String(d.clientID),
+			ClientSecret: aws.String(d.clientSecret),
+			GrantType:    aws.String(deviceCodeGrant),
+			DeviceCode:   aws.String(d.deviceCode),
+		})
+		var pending *oidcTypes.AuthorizationPendingException
+		var slowDown *oidcTypes.SlowDownException
+		var expired *oidcTypes.ExpiredTokenException
+		switch {
+		case errors.As(err, &pending):
+			continue
+		case errors.As(err, &slowDown):
+			d.interval += 5 * time.Second
+			continue
+		case errors.As(err, &expired):
+			return SSOToken{}, fmt.Errorf("the authorization expired before it was approved; run login again")
+		case err != nil:
+			return SSOToken{}, fmt.Errorf("failed to get the access token: %w", err)
+		}
+		return SSOToken{
+			StartURL:              d.startURL,
+			Region:                d.region,
+			AccessToken:           aws.ToString(result.AccessToken),
+			ExpiresAt:             time.Now().Add(time.Duration(result.ExpiresIn) * time.Second).UTC().Truncate(time.Second),
+			ClientID:              d.clientID,
+			ClientSecret:          d.clientSecret,
+			RegistrationExpiresAt: d.clientExpiry,
+		}, nil
+	}
+}
+
+// ListSSOAccounts returns the accounts token gives access to
+func ListSSOAccounts(ctx context.Context, token SSOToken) ([]SSOAccount, error) {
+	client := sso.New(sso.Options{Region: token.Region})
+	var accounts []SSOAccount
+	paginator := sso.NewListAccountsPaginator(client, &sso.ListAccountsInput{AccessToken: aws.String(token.AccessToken)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list accounts: %w", err)
+		}
+		for _, account := range page.AccountList {
+			accounts = append(accounts, SSOAccount{
+				ID:    aws.ToString(account.AccountId),
+				Name:  aws.ToString(account.AccountName),
+				Email: aws.ToString(account.EmailAddress),
+			})
+		}
+	}
+	return accounts, nil
+}
+
+// ListSSORoles returns the names of the roles token may assume in an account
+func ListSSORoles(ctx context.Context, token SSOToken, accountID string) ([]string, error) {
+	client := sso.New(sso.Options{Region: token.Region})
+	var roles []string
+	paginator := sso.NewListAccountRolesPaginator(client, &sso.ListAccountRolesInput{
+		AccessToken: aws.String(token.AccessToken),
+		AccountId:   aws.String(accountID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the roles of account %s: %w", accountID, err)
+		}
+		for _, role := range page.RoleList {
+			roles = append(roles, aws.ToString(role.RoleName))
+		}
+	}
+	return roles, nil
+}
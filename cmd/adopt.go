@@ -0,0 +1,224 @@
+// cmd/adopt.go
+// This file implements cluster adopt, which brings instances awsmpirun did not launch
+// into a project. Discovery finds a project's instances by their awsmpirun:project tag,
+// so tagging an instance is what registers it; from then on every command treats it
+// like one of its own. The instances are checked first and none is tagged unless all of
+// them pass: each must be running in the VPC with a private address, have an instance
+// profile (the one given with --instance-profile, if any), be online in SSM, and not
+// belong to another project.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/spf13/cobra"
+)
+
+// clusterAdoptOptions are the flags of cluster adopt
+type clusterAdoptOptions struct {
+	project         string
+	vpc             string
+	instances       []string
+	instanceProfile string
+	dryRun          bool
+}
+
+// newClusterAdoptCmd returns cluster adopt
+func newClusterAdoptCmd() *cobra.Command {
+	o := &clusterAdoptOptions{}
+	cmd := &cobra.Command{
+		Use:   "adopt --instances i-a,i-b,... --vpc VPC",
+		Short: "Add existing instances to the project's cluster",
+		Long: `adopt tags instances that were launched outside awsmpirun with the project's
+awsmpirun:project tag, so that runs, snapshots, and every other command find them.
+Every instance must be running in --vpc with a private IP, have an instance profile,
+be online in SSM, and not belong to another project; with --instance-profile it must
+have that profile. If any instance fails a check, the problems are listed and no
+instance is tagged. Instances already in the project are left as they are.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClusterAdopt(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project to add the instances to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC the instances must be in (required)")
+	cmd.Flags().StringSliceVar(&o.instances, "instances", nil, "IDs of the instances to adopt, comma-separated (required)")
+	cmd.Flags().StringVar(&o.instanceProfile, "instance-profile", "", "Instance profile every instance must have, so the ranks get the role's permissions")
+	cmd.Flags().BoolVar(&o.dryRun, "dry-run", false, "Check the instances without tagging them")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("instances")
+	return cmd
+}
+
+func init() {
+	clusterCmd.AddCommand(newClusterAdoptCmd())
+}
+
+func runClusterAdopt(ctx context.Context, o *clusterAdoptOptions) {
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error: failed to create EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	adopt, err := checkAdoption(ctx, ec2Client, project, o)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(adopt) == 0 {
+		fmt.Printf("All %d instances already belong to project %s\n", len(o.instances), project)
+		return
+	}
+	if o.dryRun {
+		fmt.Printf("All instances passed the checks; %d would be added to project %s: %s\n", len(adopt), project, strings.Join(adopt, ", "))
+		return
+	}
+	if err := tagProject(ctx, ec2Client, adopt, project); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Added %d instances to project %s: %s\n", len(adopt), project, strings.Join(adopt, ", "))
+}
+
+// checkAdoption checks every --instances instance and returns the ones to tag, or an
+// error listing every problem found
+func checkAdoption(ctx context.Context, ec2Client *ec2.Client, project string, o *clusterAdoptOptions) ([]string, error) {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSM client: %v", err)
+	}
+
+	result, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: o.instances})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %v", err)
+	}
+	found := make(map[string]ec2Types.Instance)
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			found[aws.ToString(instance.InstanceId)] = instance
+		}
+	}
+	online, err := awsManager.SSMOnline(ctx, ssmClient, o.instances)
+	if err != nil {
+		return nil, err
+	}
+
+	var adopt, problems []string
+	policy, err := loadCompliancePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		var instances []ec2Types.Instance
+		for _, id := range o.instances {
+			if instance, ok := found[id]; ok {
+				instances = append(instances, instance)
+			}
+		}
+		violations, err := instanceComplianceViolations(ctx, ec2Client, policy, instances)
+		if err != nil {
+			return nil, err
+		}
+		for _, violation := range violations {
+			problems = append(problems, violation.String())
+		}
+	}
+	for _, id := range o.instances {
+		instance, ok := found[id]
+		if !ok {
+			problems = append(problems, id+": not found")
+			continue
+		}
+		for _, problem := range adoptionProblems(instance, o.vpc, project, o.instanceProfile, online[id]) {
+			problems = append(problems, id+": "+problem)
+		}
+		if instanceProject(instance) != project {
+			adopt = append(adopt, id)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%d problems found, no instance was adopted:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return adopt, nil
+}
+
+// adoptionProblems returns why instance cannot join project in vpc. profile, when not
+// empty, is the name of the instance profile it must have.
+func adoptionProblems(instance ec2Types.Instance, vpc, project, profile string, online bool) []string {
+	var problems []string
+	if instance.State == nil || instance.State.Name != ec2Types.InstanceStateNameRunning {
+		state := "unknown"
+		if instance.State != nil {
+			state = string(instance.State.Name)
+		}
+		problems = append(problems, fmt.Sprintf("is %s, not running", state))
+	}
+	if got := aws.ToString(instance.VpcId); got == "" {
+		problems = append(problems, fmt.Sprintf("is in no VPC, not %s", vpc))
+	} else if got != vpc {
+		problems = append(problems, fmt.Sprintf("is in %s, not %s", got, vpc))
+	}
+	if aws.ToString(instance.PrivateIpAddress) == "" {
+		problems = append(problems, "has no private IP")
+	}
+	if instance.IamInstanceProfile == nil {
+		problems = append(problems, "has no instance profile, so the SSM agent and the ranks have no credentials")
+	} else if name := instanceProfileName(instance); profile != "" && name != profile {
+		problems = append(problems, fmt.Sprintf("has instance profile %s, not %s", name, profile))
+	}
+	if !online {
+		problems = append(problems, "is not online in SSM; check the SSM agent and the role's AmazonSSMManagedInstanceCore policy")
+	}
+	if owner := instanceProject(instance); owner != "" && owner != project {
+		problems = append(problems, fmt.Sprintf("belongs to project %s", owner))
+	}
+	return problems
+}
+
+// instanceProfileName returns the name of the instance's profile from its ARN,
+// arn:aws:iam::ACCOUNT:instance-profile/PATH/NAME
+func instanceProfileName(instance ec2Types.Instance) string {
+	arn := aws.ToString(instance.IamInstanceProfile.Arn)
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// instanceProject returns the project the instance's tag assigns it to, or ""
+func instanceProject(instance ec2Types.Instance) string {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == projectTagKey {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// tagProject tags the instances as belonging to project
+func tagProject(ctx context.Context, ec2Client *ec2.Client, ids []string, project string) error {
+	for start := 0; start < len(ids); start += maxTagResources {
+		end := min(start+maxTagResources, len(ids))
+		_, err := ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: ids[start:end],
+			Tags:      []ec2Types.Tag{{Key: aws.String(projectTagKey), Value: aws.String(project)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag the instances with %s: %v", projectTagKey, err)
+		}
+	}
+	return nil
+}
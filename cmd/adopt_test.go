@@ -0,0 +1,63 @@
+// cmd/adopt_test.go
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestAdoptionProblems(t *testing.T) {
+	healthy := func() ec2Types.Instance {
+		return ec2Types.Instance{
+			InstanceId:         aws.String("i-1"),
+			State:              &ec2Types.InstanceState{Name: ec2Types.InstanceStateNameRunning},
+			VpcId:              aws.String("vpc-1"),
+			PrivateIpAddress:   aws.String("10.0.0.5"),
+			IamInstanceProfile: &ec2Types.IamInstanceProfile{Arn: aws.String("arn:aws:iam::123456789012:instance-profile/hpc/mpi-ranks")},
+		}
+	}
+	tests := []struct {
+		name    string
+		change  func(i *ec2Types.Instance)
+		profile string
+		offline bool
+		want    []string
+	}{
+		{name: "healthy", change: func(*ec2Types.Instance) {}},
+		{name: "required profile", change: func(*ec2Types.Instance) {}, profile: "mpi-ranks"},
+		{name: "already in the project", change: func(i *ec2Types.Instance) {
+			i.Tags = []ec2Types.Tag{{Key: aws.String(projectTagKey), Value: aws.String("team-a")}}
+		}},
+		{name: "stopped", change: func(i *ec2Types.Instance) { i.State.Name = ec2Types.InstanceStateNameStopped }, want: []string{"is stopped, not running"}},
+		{name: "other VPC", change: func(i *ec2Types.Instance) { i.VpcId = aws.String("vpc-2") }, want: []string{"is in vpc-2, not vpc-1"}},
+		{name: "EC2-Classic", change: func(i *ec2Types.Instance) { i.VpcId = nil }, want: []string{"is in no VPC, not vpc-1"}},
+		{name: "no private IP", change: func(i *ec2Types.Instance) { i.PrivateIpAddress = nil }, want: []string{"has no private IP"}},
+		{name: "no profile", change: func(i *ec2Types.Instance) { i.IamInstanceProfile = nil },
+			want: []string{"has no instance profile, so the SSM agent and the ranks have no credentials"}},
+		{name: "wrong profile", change: func(*ec2Types.Instance) {}, profile: "other", want: []string{"has instance profile mpi-ranks, not other"}},
+		{name: "offline", change: func(*ec2Types.Instance) {}, offline: true,
+			want: []string{"is not online in SSM; check the SSM agent and the role's AmazonSSMManagedInstanceCore policy"}},
+		{name: "other project", change: func(i *ec2Types.Instance) {
+			i.Tags = []ec2Types.Tag{{Key: aws.String(projectTagKey), Value: aws.String("team-b")}}
+		}, want: []string{"belongs to project team-b"}},
+		{name: "several", change: func(i *ec2Types.Instance) {
+			i.State, i.PrivateIpAddress = nil, nil
+		}, offline: true, want: []string{
+			"is unknown, not running",
+			"has no private IP",
+			"is not online in SSM; check the SSM agent and the role's AmazonSSMManagedInstanceCore policy",
+		}},
+	}
+	for _, tt := range tests {
+		instance := healthy()
+		tt.change(&instance)
+		got := adoptionProblems(instance, "vpc-1", "team-a", tt.profile, !tt.offline)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
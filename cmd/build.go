@@ -0,0 +1,408 @@
+// cmd/build.go
+// This file implements the build command, which compiles a Go program on the instances
+// themselves, so every rank runs a binary built for its own architecture. The local
+// source tree is staged in the job's S3 prefix, and every instance downloads it and runs
+// go build. The Go build cache is kept in the bucket per GOOS, GOARCH, and Go version:
+// each instance restores it before building, and the first rank of every instance type
+// saves it back afterwards, so a rebuild after a small change only recompiles the
+// packages that changed instead of the whole program on every instance. The build
+// runs on a canary instance first, so a compile error stops it after one invocation
+// rather than failing N of them, and the canary's saved cache warms the other builds.
+// With --git the instances check out a commit of a repository instead, see gitsource.go.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/spf13/cobra"
+)
+
+// Where builds happen on the instances. The source directory is the same for every
+// build of a project, so the cached compile results of unchanged packages apply.
+const (
+	buildCacheDir  = "/var/cache/awsmpirun/go-build"
+	buildSourceDir = "/var/lib/awsmpirun/build"
+)
+
+// buildOptions are the flags of the build command
+type buildOptions struct {
+	project   string
+	vpc       string
+	instances int
+	bucket    string
+	source    string
+	pkg       string
+	output    string
+	noCache   bool
+	canary    bool
+	vet       bool
+	timeout   time.Duration
+	git       gitSource
+}
+
+// newBuildCmd returns the build command
+func newBuildCmd() *cobra.Command {
+	o := &buildOptions{}
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build a Go program on every instance, reusing a build cache kept in S3",
+		Long: `build stages the source tree given with --src in the bucket and runs go build on
+every instance, writing the binary to --output for a later run to start. Go must be
+installed on the instances. The Go build cache is restored from the bucket before the
+build and saved back after it, one cache per GOOS, GOARCH, and Go version, so only the
+packages that changed since the last build are compiled again. --no-cache builds from
+scratch and leaves the saved cache alone. The build runs on rank 0 first and only
+fans out to the other instances once it has succeeded; --canary=false builds on all of
+them at once. Before anything is staged the package is checked as by awsmpirun vet,
+and the build stops on what it finds; --vet=false skips the check.
+
+With --git, every instance checks out --ref of the repository with a shallow fetch
+instead, and --package is relative to the repository's root. The ref is resolved to a
+commit once, on rank 0, so every instance builds the same code; --git-secret names a
+Secrets Manager secret holding the token of a private repository. Nothing is staged
+from this machine and the package is not vetted beforehand.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runBuild(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 1, "Number of EC2 instances")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "S3 bucket the source and the build cache are staged in (required)")
+	cmd.Flags().StringVar(&o.source, "src", ".", "Local directory with the module to build")
+	cmd.Flags().StringVar(&o.pkg, "package", ".", "Package to build, relative to --src")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "Absolute path the binary is written to on the instances (required)")
+	cmd.Flags().BoolVar(&o.noCache, "no-cache", false, "Build without restoring or saving the build cache")
+	cmd.Flags().BoolVar(&o.canary, "canary", true, "Build on rank 0 first and stop with its compiler output if that fails")
+	cmd.Flags().DurationVar(&o.timeout, "build-timeout", 3*time.Hour, "How long the build on each instance may take before SSM stops it, cache included (0: as long as SSM allows)")
+	cmd.Flags().BoolVar(&o.vet, "vet", true, "Check the package for misuse of the mpi package before staging it, as awsmpirun vet does")
+	o.git.bindFlags(cmd.Flags(), "on every instance and build")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("bucket")
+	cmd.MarkFlagRequired("output")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newBuildCmd())
+}
+
+func runBuild(ctx context.Context, o *buildOptions) {
+	if err := o.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.vet && !o.git.enabled() && !vetBeforeBuild(o.source, o.pkg) {
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	jobID, err := newJobID()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Job ID: %s\n", jobID)
+
+	// Step 1: Stage the source tree, unless the instances check it out themselves
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	if !o.git.enabled() {
+		archive, err := archiveSource(o.source)
+		if err != nil {
+			fmt.Printf("Error packing %s: %v\n", o.source, err)
+			os.Exit(1)
+		}
+		if err := s3Client.UploadBytes(ctx, archive, buildSourceKey(project, jobID)); err != nil {
+			fmt.Printf("Error staging source: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Staged %s (%d bytes)\n", o.source, len(archive))
+	}
+
+	// Step 2: Build on every instance
+	instances, err := discoverInstances(ctx, o.vpc, project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) < o.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", o.instances, len(instances))
+		os.Exit(1)
+	}
+	instances = instances[:o.instances]
+	assignRanks(instances)
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	if o.git.enabled() {
+		if err := o.git.resolve(ctx, ssmClient, instances[0], s3Client.Client.Options().Region); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Building %s at %s\n", o.git.url, o.git.commit)
+	}
+	b := &remoteBuild{
+		bucket:  o.bucket,
+		region:  s3Client.Client.Options().Region,
+		project: project,
+		jobID:   jobID,
+		pkg:     o.pkg,
+		output:  o.output,
+		cache:   !o.noCache,
+		canary:  o.canary,
+		writers: cacheWriters(instances),
+		timeout: executionTimeoutOf(o.timeout),
+	}
+	if o.git.enabled() {
+		b.git = &o.git
+	}
+	if err := b.run(ctx, ssmClient, instances); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Built %s on %d instances\n", o.output, len(instances))
+}
+
+// validate rejects flag values the build script cannot use
+func (o *buildOptions) validate() error {
+	if o.instances < 1 {
+		return fmt.Errorf("--num-instances must be at least 1")
+	}
+	if err := validateBucketName(o.bucket); err != nil {
+		return err
+	}
+	if o.timeout < 0 {
+		return fmt.Errorf("--build-timeout must not be negative, got %v", o.timeout)
+	}
+	if !path.IsAbs(o.output) {
+		return fmt.Errorf("--output must be an absolute path on the instances, got %q", o.output)
+	}
+	if err := o.git.validate(); err != nil {
+		return err
+	}
+	if o.git.enabled() {
+		if o.source != "." {
+			return fmt.Errorf("--src and --git are mutually exclusive")
+		}
+		return nil
+	}
+	if info, err := os.Stat(o.source); err != nil || !info.IsDir() {
+		return fmt.Errorf("--src %s is not a directory", o.source)
+	}
+	return nil
+}
+
+// buildSourceKey is the S3 key a build's source archive is staged under
+func buildSourceKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/build/source.tar.gz"
+}
+
+// buildCachePrefix is the S3 prefix the build caches of a project are kept under. The
+// caches outlive jobs, so they sit next to the jobs rather than in one.
+func buildCachePrefix(project string) string {
+	return strings.TrimSuffix(mpi.JobPrefix(project, ""), "jobs/") + "cache/go-build"
+}
+
+// archiveSource packs the regular files under dir into a gzipped tar, leaving out
+// version control directories
+func archiveSource(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); file != dir && (name == ".git" || name == ".hg" || name == ".svn") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cacheWriters picks the instances that save the build cache back: the first rank of
+// each instance type. Instances of one type share an architecture, so one upload per
+// type keeps every cache current without every rank writing the same object.
+func cacheWriters(instances []awsManager.InstanceInfo) map[string]bool {
+	writers := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		if !seen[instance.InstanceType] {
+			seen[instance.InstanceType] = true
+			writers[instance.InstanceID] = true
+		}
+	}
+	return writers
+}
+
+// remoteBuild is one build of a staged source tree on the instances
+type remoteBuild struct {
+	bucket    string
+	region    string
+	project   string
+	jobID     string
+	pkg       string
+	output    string
+	cache     bool
+	canary    bool            // Build on the first instance before the others
+	toolchain string          // GOTOOLCHAIN to build with, e.g. go1.22.5; empty uses the installed Go
+	tags      string          // Comma-separated build tags
+	git       *gitSource      // Repository to check out instead of the staged source; nil uses the staged source
+	writers   map[string]bool // Instances that save the build cache
+	timeout   int             // Seconds SSM lets the build script run
+}
+
+// splitCanary returns the instance a build is tried on first, and the rest. The canary
+// is the first rank, which is also the first of its type and so saves the cache the
+// builds on other instances of that type then restore.
+func splitCanary(instances []awsManager.InstanceInfo) ([]awsManager.InstanceInfo, []awsManager.InstanceInfo) {
+	if len(instances) < 2 {
+		return nil, instances
+	}
+	return instances[:1], instances[1:]
+}
+
+// run builds on the canary instance, then on all others once it has succeeded
+func (b *remoteBuild) run(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) error {
+	rest := instances
+	if b.canary {
+		var canary []awsManager.InstanceInfo
+		canary, rest = splitCanary(instances)
+		if len(canary) > 0 {
+			fmt.Printf("Building on canary rank %d (%s) first\n", canary[0].InstanceRank, canary[0].InstanceID)
+			if err := b.buildOn(ctx, ssmClient, canary); err != nil {
+				return fmt.Errorf("canary rank %d failed, not building on the other %d instances: %v", canary[0].InstanceRank, len(rest), err)
+			}
+		}
+	}
+	return b.buildOn(ctx, ssmClient, rest)
+}
+
+// buildOn builds on the instances at once and prints what each one reported
+func (b *remoteBuild) buildOn(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) error {
+	outputs, err := runLongScriptOnInstances(ctx, ssmClient, instances, b.timeout, func(instance awsManager.InstanceInfo) string {
+		return b.script(b.writers[instance.InstanceID])
+	})
+	for _, instance := range instances {
+		if output, ok := outputs[instance.InstanceID]; ok {
+			fmt.Printf("Rank %d (%s): %s\n", instance.InstanceRank, instance.InstanceID, strings.ReplaceAll(strings.TrimSpace(output), "\n", "; "))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("build failed: %v", err)
+	}
+	return nil
+}
+
+// script returns the build script of one instance; saveCache uploads the build cache
+// when the build succeeds
+func (b *remoteBuild) script(saveCache bool) string {
+	project := b.project
+	if project == "" {
+		project = "default"
+	}
+	src := buildSourceDir + "/" + project
+
+	script := newShellScript()
+	script.Raw("set -eo pipefail")
+	script.Raw(`export HOME=${HOME:-/root}`)
+	script.Export("GOCACHE", buildCacheDir)
+	if b.toolchain != "" {
+		// go downloads the toolchain on first use, and GOVERSION below names it
+		script.Export("GOTOOLCHAIN", b.toolchain)
+	}
+	script.Linef(`export CACHE_KEY=%s/"$(go env GOOS)-$(go env GOARCH)-$(go env GOVERSION)".tar.gz`, buildCachePrefix(b.project))
+	script.Linef(`mkdir -p "$GOCACHE" %s`, path.Dir(b.output))
+	if b.cache {
+		script.Linef(`if aws s3 cp s3://%[1]s/"$CACHE_KEY" - --region %[2]s --only-show-errors 2> /dev/null | tar -xzf - -C "$GOCACHE" 2> /dev/null; then
+  echo "restored build cache $CACHE_KEY"
+else
+  echo "no build cache for $CACHE_KEY yet"
+fi`, b.bucket, b.region)
+	}
+	if b.git != nil {
+		b.git.writeCheckout(script, src, b.region)
+	} else {
+		script.Linef(`rm -rf %[1]s && mkdir -p %[1]s`, src)
+		script.Linef(`aws s3 cp s3://%s/%s - --region %s --only-show-errors | tar -xzf - -C %s`, b.bucket, buildSourceKey(b.project, b.jobID), b.region, src)
+	}
+	script.Linef(`cd %s`, src)
+	script.Raw(`START=$(date +%s)`)
+	if b.tags != "" {
+		script.Linef(`go build -trimpath -tags %s -o %s %s`, b.tags, b.output, b.pkg)
+	} else {
+		script.Linef(`go build -trimpath -o %s %s`, b.output, b.pkg)
+	}
+	script.Linef(`echo built %s in "$(( $(date +%%s) - START ))s"`, b.output)
+	if b.cache && saveCache {
+		script.Linef(`tar -czf - -C "$GOCACHE" . | aws s3 cp - s3://%s/"$CACHE_KEY" --region %s --only-show-errors
+echo "saved build cache $CACHE_KEY"`, b.bucket, b.region)
+	}
+	return script.String()
+}
@@ -0,0 +1,212 @@
+// cmd/build_test.go
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestArchiveSource(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":             "module solver\n",
+		"main.go":            "package main\n",
+		"internal/grid.go":   "package internal\n",
+		".git/HEAD":          "ref: refs/heads/main\n",
+		"vendor/.git/config": "",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive, err := archiveSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"go.mod", "internal/grid.go", "main.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+	if files["go.mod"] != "module solver\n" {
+		t.Errorf("go.mod = %q", files["go.mod"])
+	}
+}
+
+func TestCacheWriters(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []awsManager.InstanceInfo
+		want      map[string]bool
+	}{
+		{"one type", testInstances(), map[string]bool{"i-0": true}},
+		{"two types", []awsManager.InstanceInfo{
+			{InstanceID: "i-0", InstanceType: "c7g.large"},
+			{InstanceID: "i-1", InstanceType: "c7i.large"},
+			{InstanceID: "i-2", InstanceType: "c7g.large"},
+			{InstanceID: "i-3", InstanceType: "c7i.large"},
+		}, map[string]bool{"i-0": true, "i-1": true}},
+		{"none", nil, map[string]bool{}},
+	}
+	for _, tt := range tests {
+		if got := cacheWriters(tt.instances); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: writers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCanary(t *testing.T) {
+	three := append(testInstances(), awsManager.InstanceInfo{InstanceID: "i-2", InstanceRank: 2})
+	tests := []struct {
+		name       string
+		instances  []awsManager.InstanceInfo
+		wantCanary []string
+		wantRest   []string
+	}{
+		{"none", nil, nil, nil},
+		{"one instance has no canary", testInstances()[:1], nil, []string{"i-0"}},
+		{"two", testInstances(), []string{"i-0"}, []string{"i-1"}},
+		{"three", three, []string{"i-0"}, []string{"i-1", "i-2"}},
+	}
+	ids := func(instances []awsManager.InstanceInfo) []string {
+		var ids []string
+		for _, instance := range instances {
+			ids = append(ids, instance.InstanceID)
+		}
+		return ids
+	}
+	for _, tt := range tests {
+		canary, rest := splitCanary(tt.instances)
+		if got := ids(canary); !reflect.DeepEqual(got, tt.wantCanary) {
+			t.Errorf("%s: canary = %v, want %v", tt.name, got, tt.wantCanary)
+		}
+		if got := ids(rest); !reflect.DeepEqual(got, tt.wantRest) {
+			t.Errorf("%s: rest = %v, want %v", tt.name, got, tt.wantRest)
+		}
+	}
+	// The canary saves the cache the rest of its type restores
+	if canary, _ := splitCanary(testInstances()); !cacheWriters(testInstances())[canary[0].InstanceID] {
+		t.Error("the canary does not save the build cache")
+	}
+}
+
+func TestBuildCachePrefix(t *testing.T) {
+	if got := buildCachePrefix(""); got != "cache/go-build" {
+		t.Errorf("without a project: %q", got)
+	}
+	if got := buildCachePrefix("team-a"); got != "projects/team-a/cache/go-build" {
+		t.Errorf("with a project: %q", got)
+	}
+}
+
+func TestBuildScript(t *testing.T) {
+	b := &remoteBuild{bucket: "staging", region: "us-east-2", project: "team-a", jobID: "job-1", pkg: "./cmd/solver", output: "/opt/bin/solver", cache: true}
+	tests := []struct {
+		name      string
+		build     remoteBuild
+		saveCache bool
+		want      []string
+		wantNot   []string
+	}{
+		{"cache writer", *b, true,
+			[]string{
+				"export GOCACHE='/var/cache/awsmpirun/go-build'",
+				`export CACHE_KEY='projects/team-a/cache/go-build'/"$(go env GOOS)-$(go env GOARCH)-$(go env GOVERSION)".tar.gz`,
+				`aws s3 cp s3://'staging'/"$CACHE_KEY" -`,
+				"aws s3 cp s3://'staging'/'projects/team-a/jobs/job-1/build/source.tar.gz' -",
+				"cd '/var/lib/awsmpirun/build/team-a'",
+				"go build -trimpath -o '/opt/bin/solver' './cmd/solver'",
+				`aws s3 cp - s3://'staging'/"$CACHE_KEY"`,
+			}, nil},
+		{"reader", *b, false,
+			[]string{`aws s3 cp s3://'staging'/"$CACHE_KEY" -`},
+			[]string{`aws s3 cp - s3://`}},
+		{"no cache", func() remoteBuild { c := *b; c.cache = false; return c }(), true,
+			[]string{"go build"},
+			[]string{`"$CACHE_KEY"`}},
+		{"toolchain and tags", func() remoteBuild { c := *b; c.toolchain, c.tags = "go1.22.5", "netgo,osusergo"; return c }(), true,
+			[]string{"export GOTOOLCHAIN='go1.22.5'", "go build -trimpath -tags 'netgo,osusergo' -o '/opt/bin/solver' './cmd/solver'"},
+			nil},
+		{"git source", func() remoteBuild {
+			c := *b
+			c.git = &gitSource{url: "https://github.com/example/solver", commit: "0123456789abcdef0123456789abcdef01234567"}
+			return c
+		}(), true,
+			[]string{
+				"git init -q '/var/lib/awsmpirun/build/team-a'",
+				"fetch -q --depth 1 -- 'https://github.com/example/solver' '0123456789abcdef0123456789abcdef01234567'",
+				"cd '/var/lib/awsmpirun/build/team-a'",
+			},
+			[]string{"source.tar.gz"}},
+		{"installed Go", *b, true,
+			nil,
+			[]string{"GOTOOLCHAIN", "-tags"}},
+	}
+	for _, tt := range tests {
+		script := tt.build.script(tt.saveCache)
+		for _, want := range tt.want {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: script lacks %q:\n%s", tt.name, want, script)
+			}
+		}
+		for _, unwanted := range tt.wantNot {
+			if strings.Contains(script, unwanted) {
+				t.Errorf("%s: script contains %q:\n%s", tt.name, unwanted, script)
+			}
+		}
+	}
+}
+
+func TestBuildOnExecutionTimeout(t *testing.T) {
+	f := &fakeSSM{}
+	b := &remoteBuild{bucket: "staging", region: "us-east-2", jobID: "job-1", pkg: ".", output: "/opt/bin/solver", timeout: 7200}
+	instances := []awsManager.InstanceInfo{{InstanceID: "i-1"}, {InstanceID: "i-2", InstanceRank: 1}}
+	if err := b.buildOn(context.Background(), newFakeSSM(t, f), instances); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range f.sent() {
+		if command.executionTimeout != "7200" {
+			t.Errorf("build ran with executionTimeout %q, want 7200", command.executionTimeout)
+		}
+	}
+	if len(f.sent()) != len(instances) {
+		t.Errorf("sent %d commands, want %d", len(f.sent()), len(instances))
+	}
+}
@@ -0,0 +1,458 @@
+// cmd/canary.go
+// This file implements the canary command, a health check of a cluster that takes under
+// a minute. It runs the canary program built into awsmpirun (see examples/canary.go) on
+// the instances the way examples run does, so one run exercises SSM delivery, staging
+// the binary from S3, the connections between every pair of ranks, and a collective.
+// Every rank reports pass or fail with the check it failed, and the command exits
+// non-zero when any rank failed, so it can gate a deployment or run on a schedule:
+// schedule create --canary-vpc repeats it from CodeBuild with --metrics. The ranks also
+// report their clock offsets from rank 0; when the clocks are further apart than
+// --max-clock-skew, the command warns and asks chrony on the instances out of line how
+// it is synchronized, or with --sync-clocks steps their clocks first.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/examples"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/spf13/cobra"
+)
+
+// The checks the command itself attributes a failure to, before the program reports
+const (
+	canarySSM    = "ssm"
+	canaryBinary = "binary"
+)
+
+// canaryOptions are the flags of the canary command
+type canaryOptions struct {
+	project    string
+	vpc        string
+	instances  int
+	bucket     string
+	binary     string
+	rounds     int
+	timeout    time.Duration
+	publish    bool
+	maxSkew    time.Duration
+	syncClocks bool
+}
+
+// newCanaryCmd returns the canary command and canary exec
+func newCanaryCmd() *cobra.Command {
+	o := &canaryOptions{}
+	cmd := &cobra.Command{
+		Use:   "canary --vpc VPC --bucket BUCKET",
+		Short: "Check the health of a cluster with a short built-in job",
+		Long: `canary runs a small all-to-all job on the instances of a VPC and reports pass or
+fail for every rank, with the check a failed rank stopped at:
+
+    ssm         the command was not delivered to the instance or did not finish
+    binary      the awsmpirun binary could not be fetched from the bucket or started
+    connect     the rank could not connect to its peers
+    all-to-all  a token exchanged with another rank was lost or wrong
+    clock       the rank's clock could not be measured against rank 0's
+    collective  the sum of the ranks through rank 0 was lost or wrong
+    finalize    the rank could not leave the job cleanly
+
+The ranks give up at three quarters of --timeout, so the command ends within it. The
+binary is staged as for examples run; pass --binary when awsmpirun does not run on
+Linux. With --metrics the number of failed ranks and the duration are published as the
+CanaryFailedRanks and CanaryDuration metrics, for an alarm on a scheduled canary.
+
+Clocks further apart than --max-clock-skew scramble the order of timestamps across
+ranks. The canary warns about them without failing, and shows chrony's tracking status
+on the instances whose clocks are out of line; --sync-clocks has chrony step those
+clocks to its time sources first.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runCanaryCheck(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 0, "Number of instances to check (0 checks all of them)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "S3 bucket to stage the binary and the job manifest in (required)")
+	cmd.Flags().StringVar(&o.binary, "binary", "", "awsmpirun build to run on the instances (default: this binary, on Linux only)")
+	cmd.Flags().IntVar(&o.rounds, "rounds", 3, "Rounds of the all-to-all exchange")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", time.Minute, "How long the check may take")
+	cmd.Flags().BoolVar(&o.publish, "metrics", false, "Publish the result as CloudWatch metrics")
+	cmd.Flags().DurationVar(&o.maxSkew, "max-clock-skew", 50*time.Millisecond, "Warn when the ranks' clocks are further apart than this")
+	cmd.Flags().BoolVar(&o.syncClocks, "sync-clocks", false, "Step the clocks out of line to chrony's time sources")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("bucket")
+	cmd.AddCommand(newCanaryExecCmd())
+	return cmd
+}
+
+// canaryExecOptions are the flags of canary exec
+type canaryExecOptions struct {
+	rounds   int
+	deadline time.Duration
+}
+
+// newCanaryExecCmd returns canary exec, which the ranks of a canary run
+func newCanaryExecCmd() *cobra.Command {
+	o := &canaryExecOptions{}
+	cmd := &cobra.Command{
+		Use:    "exec",
+		Short:  "Run the canary as one rank of a job",
+		Hidden: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := examples.RunCanary(o.rounds, o.deadline, os.Stdout); err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().IntVar(&o.rounds, "rounds", 3, "Rounds of the all-to-all exchange")
+	cmd.Flags().DurationVar(&o.deadline, "deadline", time.Minute, "When the rank gives up")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newCanaryCmd())
+}
+
+func runCanaryCheck(ctx context.Context, c *canaryOptions) {
+	if c.rounds < 1 {
+		fmt.Println("Error: --rounds must be at least 1")
+		os.Exit(1)
+	}
+	if c.timeout < 10*time.Second {
+		fmt.Println("Error: --timeout must be at least 10s")
+		os.Exit(1)
+	}
+	if c.maxSkew <= 0 {
+		fmt.Println("Error: --max-clock-skew must be positive")
+		os.Exit(1)
+	}
+	if c.instances < 0 {
+		fmt.Println("Error: --num-instances must not be negative")
+		os.Exit(1)
+	}
+	if err := validateBucketName(c.bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	binary, err := exampleBinary(c.binary, runtime.GOOS)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(c.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	deadline := c.timeout * 3 / 4
+	o := newRunOptions()
+	o.project = project
+	if o.jobID, err = newJobID(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	o.bucket = c.bucket
+	o.workDir = "/tmp/awsmpirun/{job_id}"
+	o.connectTimeout = deadline / 2
+	fmt.Printf("Job ID: %s\n", o.jobID)
+
+	// Step 1: Stage the binary next to the job manifest
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := s3Client.UploadFile(ctx, binary, exampleBinaryKey(o.project, o.jobID)); err != nil {
+		fmt.Printf("Error staging binary: %v\n", err)
+		os.Exit(1)
+	}
+	o.executablePath = canaryCommand(o.project, o.jobID, o.bucket, s3Client.Client.Options().Region, c.rounds, deadline)
+
+	// Step 2: Start the canary on the instances
+	instances, err := discoverInstances(ctx, c.vpc, o.project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) == 0 || len(instances) < c.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", max(c.instances, 1), len(instances))
+		os.Exit(1)
+	}
+	selected := instances
+	if c.instances > 0 {
+		selected = instances[:c.instances]
+	}
+	assignRanks(selected)
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	commandIDs, err := o.sendManifestCommands(ctx, ssmClient, selected)
+	if err != nil {
+		fmt.Printf("Error starting the canary: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 3: Collect every rank's report, giving up on ranks still running at --timeout
+	waitCtx, cancel := context.WithTimeout(ctx, c.timeout-time.Since(start))
+	failures := waitForCanary(waitCtx, ssmClient, selected, commandIDs)
+	cancel()
+	var readable []awsManager.InstanceInfo
+	for _, instance := range selected {
+		if failure, ok := failures[instance.InstanceID]; !ok || canaryCheckOf(failure) != canarySSM {
+			readable = append(readable, instance)
+		}
+	}
+	outputs, _ := runScriptOnInstances(ctx, ssmClient, readable, func(awsManager.InstanceInfo) string {
+		return o.rankOutputScript()
+	})
+
+	var results []canaryResult
+	for _, instance := range selected {
+		var failure *rankFailure
+		if f, ok := failures[instance.InstanceID]; ok {
+			failure = &f
+		}
+		results = append(results, newCanaryResult(instance, failure, outputs[instance.InstanceID]))
+	}
+	elapsed := time.Since(start)
+	failed := writeCanaryResults(os.Stdout, results, elapsed)
+	checkCanaryClocks(ctx, ssmClient, selected, results, c)
+	if c.publish {
+		publishCanaryMetrics(ctx, project, failed, elapsed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// canaryCommand returns the run command that fetches the staged binary and runs the
+// canary as the local rank
+func canaryCommand(project, jobID, bucket, bucketRegion string, rounds int, deadline time.Duration) string {
+	return stagedBinaryCommand(project, jobID, bucket, bucketRegion, shellf("canary exec --rounds %d --deadline %s", rounds, deadline.String()))
+}
+
+// waitForCanary waits for the canary on every instance and returns the failure of each
+// rank that did not succeed, counting the ranks still running when ctx is done as timed out
+func waitForCanary(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, commandIDs map[string]string) map[string]rankFailure {
+	failures := make(map[string]rankFailure)
+	for _, instance := range instances {
+		output, err := waitForCommandInvocation(ctx, ssmClient, commandIDs[instance.InstanceID], instance.InstanceID)
+		if err != nil {
+			failures[instance.InstanceID] = rankFailure{Rank: instance.InstanceRank, InstanceID: instance.InstanceID, Status: "TimedOut", ExitCode: -1, Stderr: err.Error()}
+			continue
+		}
+		if output.Status != ssmTypes.CommandInvocationStatusSuccess {
+			failures[instance.InstanceID] = rankFailure{
+				Rank:       instance.InstanceRank,
+				InstanceID: instance.InstanceID,
+				Status:     string(output.Status),
+				ExitCode:   int(output.ResponseCode),
+				Stderr:     aws.ToString(output.StandardErrorContent),
+			}
+		}
+	}
+	return failures
+}
+
+// canaryResult is the outcome of the canary on one rank
+type canaryResult struct {
+	Rank       int
+	InstanceID string
+	Passed     bool
+	Check      string // The check the rank failed
+	Detail     string
+	Clock      *mpi.ClockOffset // The rank's clock against rank 0's, when it passed
+}
+
+// canaryCheckOf returns the check a rank that left no report failed, from the way its
+// command ended
+func canaryCheckOf(failure rankFailure) string {
+	switch class, _ := failure.classify(); class {
+	case failureInfrastructure, failureTimeout, failureCancelled:
+		return canarySSM
+	}
+	return canaryBinary
+}
+
+// newCanaryResult returns the outcome on instance from its report, or when it left
+// none, from how its command ended
+func newCanaryResult(instance awsManager.InstanceInfo, failure *rankFailure, output string) canaryResult {
+	result := canaryResult{Rank: instance.InstanceRank, InstanceID: instance.InstanceID}
+	if report, ok := examples.ParseCanaryReport(output); ok {
+		result.Passed, result.Check, result.Detail = report.Passed, report.Check, report.Detail
+		if report.Clock != nil {
+			clock := *report.Clock
+			clock.Rank = result.Rank
+			result.Clock = &clock
+		}
+		return result
+	}
+	if failure == nil {
+		result.Check = canaryBinary
+		result.Detail = "the rank succeeded without a canary report"
+		return result
+	}
+	_, reason := failure.classify()
+	result.Check = canaryCheckOf(*failure)
+	result.Detail = fmt.Sprintf("%s, exit code %d, %s", failure.Status, failure.ExitCode, reason)
+	if last := lastLine(failure.Stderr); last != "" {
+		result.Detail += ": " + last
+	}
+	return result
+}
+
+// writeCanaryResults prints a table of the results and a summary line, and returns how
+// many ranks failed
+func writeCanaryResults(w io.Writer, results []canaryResult, elapsed time.Duration) int {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RANK\tINSTANCE\tRESULT\tDETAIL")
+	failed := 0
+	for _, r := range results {
+		result := "pass"
+		if !r.Passed {
+			result = "FAIL " + r.Check
+			failed++
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\n", r.Rank, r.InstanceID, result, r.Detail)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "%d/%d ranks passed in %v\n", len(results)-failed, len(results), elapsed.Round(time.Second))
+	return failed
+}
+
+// canaryClockSkew returns the skew across the clocks the ranks reported and the ranks
+// out of line, which are none unless the skew is above limit
+func canaryClockSkew(results []canaryResult, limit time.Duration) (time.Duration, []mpi.ClockOffset) {
+	var offsets []mpi.ClockOffset
+	for _, r := range results {
+		if r.Clock != nil {
+			offsets = append(offsets, *r.Clock)
+		}
+	}
+	skew := mpi.ClockSkew(offsets)
+	if skew <= limit {
+		return skew, nil
+	}
+	return skew, mpi.ClockOutliers(offsets, limit)
+}
+
+// chronyScript prints chrony's tracking status, after stepping the clock with sync
+func chronyScript(sync bool) string {
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Raw(`if ! command -v chronyc > /dev/null; then
+  echo "chronyc not found, the instance does not run chrony" >&2
+  exit 1
+fi`)
+	if sync {
+		script.Raw("chronyc -a makestep > /dev/null")
+	}
+	script.Raw("chronyc tracking")
+	return script.String()
+}
+
+// chronyStatus summarizes the output of chronyc tracking as its leap status and how
+// far the system time is from the time sources
+func chronyStatus(tracking string) string {
+	var leap, offset string
+	for _, line := range strings.Split(tracking, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "Leap status":
+			leap = strings.TrimSpace(value)
+		case "System time":
+			offset = strings.TrimSpace(value)
+		}
+	}
+	if leap == "" {
+		return "no tracking status from chrony"
+	}
+	status := "leap status " + leap
+	if offset != "" {
+		status += ", system time " + offset
+	}
+	return status
+}
+
+// checkCanaryClocks warns when the ranks' clocks are further apart than --max-clock-skew,
+// with chrony's status on the instances out of line, stepping their clocks first with
+// --sync-clocks
+func checkCanaryClocks(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, results []canaryResult, c *canaryOptions) {
+	skew, outliers := canaryClockSkew(results, c.maxSkew)
+	if skew <= c.maxSkew {
+		return
+	}
+	fmt.Printf("Warning: the ranks' clocks are %v apart, more than --max-clock-skew %v\n", skew.Round(time.Microsecond), c.maxSkew)
+	if len(outliers) == 0 {
+		return
+	}
+	byRank := make(map[int]awsManager.InstanceInfo)
+	for _, instance := range instances {
+		byRank[instance.InstanceRank] = instance
+	}
+	var late []awsManager.InstanceInfo
+	for _, o := range outliers {
+		late = append(late, byRank[o.Rank])
+	}
+	outputs, err := runScriptOnInstances(ctx, ssmClient, late, func(awsManager.InstanceInfo) string {
+		return chronyScript(c.syncClocks)
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to read chrony's status: %v\n", err)
+	}
+	for _, o := range outliers {
+		instance := byRank[o.Rank]
+		status := "unknown"
+		if output, ok := outputs[instance.InstanceID]; ok {
+			status = chronyStatus(output)
+			if c.syncClocks {
+				status = "stepped, " + status
+			}
+		}
+		fmt.Printf("  rank %d (%s): %v from rank 0, %s\n", o.Rank, instance.InstanceID, o, status)
+	}
+}
+
+// canaryMetrics returns the metric values of a canary of project
+func canaryMetrics(project string, failed int, elapsed time.Duration, at time.Time) []awsManager.MetricDatum {
+	dimensions := map[string]string{"Project": project}
+	return []awsManager.MetricDatum{
+		{Name: "CanaryFailedRanks", Value: float64(failed), Unit: "Count", Dimensions: dimensions, Timestamp: at},
+		{Name: "CanaryDuration", Value: elapsed.Seconds(), Unit: "Seconds", Dimensions: dimensions, Timestamp: at},
+	}
+}
+
+// publishCanaryMetrics sends the metrics of a canary, with --metrics
+func publishCanaryMetrics(ctx context.Context, project string, failed int, elapsed time.Duration) {
+	client, err := awsManager.NewMetricsClient(ctx)
+	if err == nil {
+		err = client.PutMetricData(ctx, metricsNamespace, canaryMetrics(project, failed, elapsed, time.Now()))
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to publish the canary metrics: %v\n", err)
+		return
+	}
+	fmt.Printf("Published the canary metrics to CloudWatch namespace %s\n", metricsNamespace)
+}
@@ -0,0 +1,187 @@
+// cmd/canary_test.go
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestNewCanaryResult(t *testing.T) {
+	instance := awsManager.InstanceInfo{InstanceID: "i-3", InstanceRank: 3}
+	tests := []struct {
+		name       string
+		failure    *rankFailure
+		output     string
+		wantPassed bool
+		wantCheck  string
+		wantDetail string // Substring of the detail
+	}{
+		{
+			name:       "passed",
+			output:     "canary: pass 7 peers, 3 rounds, slowest round 1.2ms, sum 300µs\n",
+			wantPassed: true,
+			wantDetail: "7 peers, 3 rounds",
+		},
+		{
+			name:       "program reported the failed check",
+			failure:    &rankFailure{Rank: 3, Status: "Failed", ExitCode: 1},
+			output:     "canary: fail all-to-all: receive from rank 5: connection reset by peer\n",
+			wantCheck:  "all-to-all",
+			wantDetail: "receive from rank 5",
+		},
+		{
+			name:       "command never delivered",
+			failure:    &rankFailure{Rank: 3, Status: "Undeliverable", ExitCode: -1},
+			wantCheck:  canarySSM,
+			wantDetail: "Undeliverable, exit code -1",
+		},
+		{
+			name:       "still running at the timeout",
+			failure:    &rankFailure{Rank: 3, Status: "TimedOut", ExitCode: -1, Stderr: "context deadline exceeded"},
+			wantCheck:  canarySSM,
+			wantDetail: ": context deadline exceeded",
+		},
+		{
+			name:       "binary could not be fetched",
+			failure:    &rankFailure{Rank: 3, Status: "Failed", ExitCode: 1, Stderr: "download: starting\nfatal error: (403) Forbidden\n"},
+			wantCheck:  canaryBinary,
+			wantDetail: ": fatal error: (403) Forbidden",
+		},
+		{
+			name:       "succeeded without a report",
+			wantCheck:  canaryBinary,
+			wantDetail: "without a canary report",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newCanaryResult(instance, tt.failure, tt.output)
+			if got.Rank != 3 || got.InstanceID != "i-3" || got.Passed != tt.wantPassed || got.Check != tt.wantCheck || !strings.Contains(got.Detail, tt.wantDetail) {
+				t.Errorf("newCanaryResult() = %+v, want passed %v, check %q, detail with %q", got, tt.wantPassed, tt.wantCheck, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestWriteCanaryResults(t *testing.T) {
+	results := []canaryResult{
+		{Rank: 0, InstanceID: "i-0", Passed: true, Detail: "1 peers, 3 rounds"},
+		{Rank: 1, InstanceID: "i-1", Check: "connect", Detail: "dial tcp 10.0.0.1:50051: i/o timeout"},
+	}
+	var out strings.Builder
+	if failed := writeCanaryResults(&out, results, 14*time.Second+300*time.Millisecond); failed != 1 {
+		t.Errorf("writeCanaryResults() = %d failed, want 1", failed)
+	}
+	want := `RANK  INSTANCE  RESULT        DETAIL
+0     i-0       pass          1 peers, 3 rounds
+1     i-1       FAIL connect  dial tcp 10.0.0.1:50051: i/o timeout
+1/2 ranks passed in 14s
+`
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCanaryCommand(t *testing.T) {
+	got := canaryCommand("team-a", "job-1", "staging", "us-east-1", 3, 45*time.Second)
+	for _, want := range []string{
+		"aws s3 cp s3://'staging'/'projects/team-a/jobs/job-1/bin/awsmpirun'",
+		"canary exec --rounds 3 --deadline '45s'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("canaryCommand() = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestCanaryMetrics(t *testing.T) {
+	at := time.Date(2026, 10, 14, 2, 0, 0, 0, time.UTC)
+	data := canaryMetrics("cfd", 2, 40*time.Second, at)
+	want := map[string]float64{"CanaryFailedRanks": 2, "CanaryDuration": 40}
+	if len(data) != len(want) {
+		t.Fatalf("canaryMetrics() = %+v", data)
+	}
+	for _, datum := range data {
+		if value, ok := want[datum.Name]; !ok || datum.Value != value || datum.Dimensions["Project"] != "cfd" || !datum.Timestamp.Equal(at) {
+			t.Errorf("unexpected metric %+v", datum)
+		}
+	}
+}
+
+func TestCanaryClockSkew(t *testing.T) {
+	result := func(rank int, offset time.Duration) canaryResult {
+		return canaryResult{Rank: rank, Passed: true, Clock: &mpi.ClockOffset{Rank: rank, Offset: offset}}
+	}
+	tests := []struct {
+		name     string
+		results  []canaryResult
+		skew     time.Duration
+		outliers []int
+	}{
+		{name: "no clocks", results: []canaryResult{{Rank: 0, Check: "connect"}}},
+		{name: "within the limit", results: []canaryResult{result(0, 0), result(1, 20*time.Millisecond)}, skew: 20 * time.Millisecond},
+		{
+			name:     "one out of line",
+			results:  []canaryResult{result(0, 0), result(1, time.Millisecond), result(2, 400*time.Millisecond), {Rank: 3, Check: "connect"}},
+			skew:     400 * time.Millisecond,
+			outliers: []int{2},
+		},
+	}
+	for _, tt := range tests {
+		skew, outliers := canaryClockSkew(tt.results, 50*time.Millisecond)
+		var ranks []int
+		for _, o := range outliers {
+			ranks = append(ranks, o.Rank)
+		}
+		if skew != tt.skew || !reflect.DeepEqual(ranks, tt.outliers) {
+			t.Errorf("%s: canaryClockSkew() = %v, %v; want %v, %v", tt.name, skew, ranks, tt.skew, tt.outliers)
+		}
+	}
+}
+
+func TestNewCanaryResultClock(t *testing.T) {
+	instance := awsManager.InstanceInfo{InstanceID: "i-2", InstanceRank: 2}
+	got := newCanaryResult(instance, nil, "canary: pass 3 peers, 3 rounds, slowest round 1ms, sum 1ms, clock +250ms ±100µs\n")
+	want := &mpi.ClockOffset{Rank: 2, Offset: 250 * time.Millisecond, RTT: 200 * time.Microsecond}
+	if !reflect.DeepEqual(got.Clock, want) {
+		t.Errorf("newCanaryResult() clock = %+v, want %+v", got.Clock, want)
+	}
+}
+
+func TestChronyScript(t *testing.T) {
+	if script := chronyScript(false); strings.Contains(script, "makestep") || !strings.Contains(script, "chronyc tracking") {
+		t.Errorf("status script:\n%s", script)
+	}
+	if script := chronyScript(true); !strings.Contains(script, "chronyc -a makestep") {
+		t.Errorf("sync script does not step the clock:\n%s", script)
+	}
+}
+
+func TestChronyStatus(t *testing.T) {
+	tracking := `Reference ID    : A9FEA97B (169.254.169.123)
+Stratum         : 4
+Ref time (UTC)  : Wed Oct 14 02:00:00 2026
+System time     : 0.250112000 seconds fast of NTP time
+Last offset     : +0.000012000 seconds
+Leap status     : Normal
+`
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{output: tracking, want: "leap status Normal, system time 0.250112000 seconds fast of NTP time"},
+		{output: "Leap status     : Not synchronised\n", want: "leap status Not synchronised"},
+		{output: "506 Cannot talk to daemon\n", want: "no tracking status from chrony"},
+	}
+	for _, tt := range tests {
+		if got := chronyStatus(tt.output); got != tt.want {
+			t.Errorf("chronyStatus(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// cmd/chaos.go
+// This file implements --chaos, which injects failures into a running job so
+// users can check that their checkpoint/restart and abort handling works.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Fault kinds accepted by --chaos
+const (
+	faultKillRank  = "kill-rank"
+	faultPartition = "partition"
+	faultStopRank  = "stop-rank"
+)
+
+// chaosFault is a single failure to inject after a delay
+type chaosFault struct {
+	Kind  string
+	Ranks []int
+	After time.Duration
+}
+
+// parseChaosSpec parses specs like "kill-rank=3@60s,partition=2-5@120s,stop-rank=1@90s".
+// A partition target is a rank or an inclusive range of ranks that is cut off from
+// every rank outside it.
+func parseChaosSpec(spec string, size int) ([]chaosFault, error) {
+	var faults []chaosFault
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kind, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos fault %q: expected kind=target@delay", entry)
+		}
+		target, delay, ok := strings.Cut(rest, "@")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos fault %q: missing @delay", entry)
+		}
+
+		after, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay in chaos fault %q: %v", entry, err)
+		}
+
+		var ranks []int
+		switch kind {
+		case faultKillRank, faultStopRank:
+			rank, err := strconv.Atoi(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rank in chaos fault %q: %v", entry, err)
+			}
+			ranks = []int{rank}
+		case faultPartition:
+			first, last, isRange := strings.Cut(target, "-")
+			if !isRange {
+				last = first
+			}
+			a, errA := strconv.Atoi(first)
+			b, errB := strconv.Atoi(last)
+			if errA != nil || errB != nil || a > b {
+				return nil, fmt.Errorf("invalid partition in chaos fault %q: expected a rank or a range like 2-5", entry)
+			}
+			if a == 0 && b >= size-1 {
+				return nil, fmt.Errorf("partition in chaos fault %q leaves no ranks on the other side", entry)
+			}
+			for rank := a; rank <= b; rank++ {
+				ranks = append(ranks, rank)
+			}
+		default:
+			return nil, fmt.Errorf("unknown chaos fault kind %q", kind)
+		}
+
+		for _, rank := range ranks {
+			if rank < 0 || rank >= size {
+				return nil, fmt.Errorf("rank %d in chaos fault %q is outside the job (size %d)", rank, entry, size)
+			}
+		}
+
+		faults = append(faults, chaosFault{Kind: kind, Ranks: ranks, After: after})
+	}
+	return faults, nil
+}
+
+// chaosMonkey injects the scheduled faults into a running job
+type chaosMonkey struct {
+	ssmClient *ssm.Client
+	ec2Client *ec2.Client
+	instances []awsManager.InstanceInfo
+	jobID     string
+
+	mu       sync.Mutex
+	timers   []*time.Timer
+	stopped  bool
+	inflight sync.WaitGroup
+	blocked  map[string][]string // Peer IPs dropped by each partitioned instance, by instance ID
+}
+
+func newChaosMonkey(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, jobID string) (*chaosMonkey, error) {
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create EC2 client: %v", err)
+	}
+	return &chaosMonkey{
+		ssmClient: ssmClient,
+		ec2Client: ec2Client,
+		instances: instances,
+		jobID:     jobID,
+		blocked:   make(map[string][]string),
+	}, nil
+}
+
+// Start schedules every fault relative to now
+func (c *chaosMonkey) Start(ctx context.Context, faults []chaosFault) {
+	for _, fault := range faults {
+		fault := fault
+		timer := time.AfterFunc(fault.After, func() {
+			c.mu.Lock()
+			if c.stopped {
+				c.mu.Unlock()
+				return
+			}
+			c.inflight.Add(1)
+			c.mu.Unlock()
+			defer c.inflight.Done()
+
+			if err := c.inject(ctx, fault); err != nil {
+				fmt.Printf("Chaos: failed to inject %s: %v\n", fault.Kind, err)
+			}
+		})
+		c.mu.Lock()
+		c.timers = append(c.timers, timer)
+		c.mu.Unlock()
+	}
+}
+
+// Stop cancels faults that have not fired yet, waits for faults being injected,
+// and heals every partition, even when ctx has been cancelled
+func (c *chaosMonkey) Stop(ctx context.Context) {
+	c.mu.Lock()
+	c.stopped = true
+	for _, timer := range c.timers {
+		timer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.inflight.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.blocked) == 0 {
+		return
+	}
+
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	var partitioned []awsManager.InstanceInfo
+	for _, instance := range c.instances {
+		if _, ok := c.blocked[instance.InstanceID]; ok {
+			partitioned = append(partitioned, instance)
+		}
+	}
+	_, err := runScriptOnInstances(ctx, c.ssmClient, partitioned, func(instance awsManager.InstanceInfo) string {
+		return partitionScript("-D", c.blocked[instance.InstanceID])
+	})
+	if err != nil {
+		fmt.Printf("Chaos: failed to heal partitions: %v\n", err)
+	}
+	c.blocked = make(map[string][]string)
+}
+
+func (c *chaosMonkey) inject(ctx context.Context, fault chaosFault) error {
+	switch fault.Kind {
+	case faultKillRank:
+		instance := c.instanceForRank(fault.Ranks[0])
+		fmt.Printf("Chaos: killing rank %d on %s\n", instance.InstanceRank, instance.InstanceID)
+		_, err := runScriptOnInstances(ctx, c.ssmClient, []awsManager.InstanceInfo{instance}, func(awsManager.InstanceInfo) string {
+			return killRankScript(c.jobID)
+		})
+		return err
+	case faultStopRank:
+		instance := c.instanceForRank(fault.Ranks[0])
+		fmt.Printf("Chaos: stopping instance %s (rank %d)\n", instance.InstanceID, instance.InstanceRank)
+		_, err := c.ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{
+			InstanceIds: []string{instance.InstanceID},
+		})
+		return err
+	case faultPartition:
+		inside := make(map[int]bool)
+		for _, rank := range fault.Ranks {
+			inside[rank] = true
+		}
+
+		// Every instance drops traffic to and from the instances on the other side
+		peers := make(map[string][]string)
+		for _, instance := range c.instances {
+			for _, other := range c.instances {
+				if inside[instance.InstanceRank] != inside[other.InstanceRank] {
+					peers[instance.InstanceID] = append(peers[instance.InstanceID], other.PrivateIP)
+				}
+			}
+		}
+
+		fmt.Printf("Chaos: partitioning ranks %d-%d from the rest of the job\n", fault.Ranks[0], fault.Ranks[len(fault.Ranks)-1])
+
+		// Record the rules before inserting them so Stop heals partial injections too
+		c.mu.Lock()
+		for id, ips := range peers {
+			c.blocked[id] = append(c.blocked[id], ips...)
+		}
+		c.mu.Unlock()
+
+		_, err := runScriptOnInstances(ctx, c.ssmClient, c.instances, func(instance awsManager.InstanceInfo) string {
+			return partitionScript("-I", peers[instance.InstanceID])
+		})
+		return err
+	}
+	return fmt.Errorf("unknown chaos fault kind %q", fault.Kind)
+}
+
+func (c *chaosMonkey) instanceForRank(rank int) awsManager.InstanceInfo {
+	for _, instance := range c.instances {
+		if instance.InstanceRank == rank {
+			return instance
+		}
+	}
+	return awsManager.InstanceInfo{}
+}
+
+// killRankScript kills the process group the rank script recorded. It fails if the
+// rank is not running, so a kill that hit nothing is reported instead of ignored.
+func killRankScript(jobID string) string {
+	script := newShellScript()
+	script.Linef("PIDFILE=%s", rankPIDFile(jobID))
+	script.Raw(`if [ ! -s "$PIDFILE" ]; then
+  echo "rank is not running (no $PIDFILE)" >&2
+  exit 1
+fi
+kill -KILL -- "-$(cat "$PIDFILE")"`)
+	return script.String()
+}
+
+// partitionScript inserts (-I) or deletes (-D) rules dropping all traffic to and from peerIPs.
+// Deleting repeats until no copy of a rule is left, so overlapping partitions heal fully.
+func partitionScript(action string, peerIPs []string) string {
+	script := newShellScript()
+	script.Raw("set -e")
+	for _, ip := range peerIPs {
+		if action == "-D" {
+			script.Linef("while iptables -D INPUT -s %s -j DROP 2> /dev/null; do :; done", ip)
+			script.Linef("while iptables -D OUTPUT -d %s -j DROP 2> /dev/null; do :; done", ip)
+		} else {
+			script.Linef("iptables %[1]s INPUT -s %[2]s -j DROP", shellExpr(action), ip)
+			script.Linef("iptables %[1]s OUTPUT -d %[2]s -j DROP", shellExpr(action), ip)
+		}
+	}
+	return script.String()
+}
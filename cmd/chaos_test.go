@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaosSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		size    int
+		want    []chaosFault
+		wantErr string
+	}{
+		{spec: "", size: 4, want: nil},
+		{
+			spec: "kill-rank=3@60s, stop-rank=1@90s",
+			size: 4,
+			want: []chaosFault{
+				{Kind: faultKillRank, Ranks: []int{3}, After: 60 * time.Second},
+				{Kind: faultStopRank, Ranks: []int{1}, After: 90 * time.Second},
+			},
+		},
+		{
+			spec: "partition=2-5@2m",
+			size: 8,
+			want: []chaosFault{{Kind: faultPartition, Ranks: []int{2, 3, 4, 5}, After: 2 * time.Minute}},
+		},
+		{
+			spec: "partition=1@1s",
+			size: 2,
+			want: []chaosFault{{Kind: faultPartition, Ranks: []int{1}, After: time.Second}},
+		},
+		{spec: "kill-rank", size: 4, wantErr: "expected kind=target@delay"},
+		{spec: "kill-rank=1", size: 4, wantErr: "missing @delay"},
+		{spec: "kill-rank=1@soon", size: 4, wantErr: "invalid delay"},
+		{spec: "kill-rank=x@1s", size: 4, wantErr: "invalid rank"},
+		{spec: "kill-rank=4@1s", size: 4, wantErr: "outside the job"},
+		{spec: "kill-rank=-1@1s", size: 4, wantErr: "outside the job"},
+		{spec: "partition=5-2@1s", size: 8, wantErr: "expected a rank or a range"},
+		{spec: "partition=a-b@1s", size: 8, wantErr: "expected a rank or a range"},
+		{spec: "partition=0-3@1s", size: 4, wantErr: "no ranks on the other side"},
+		{spec: "partition=6-9@1s", size: 8, wantErr: "outside the job"},
+		{spec: "reboot=1@1s", size: 4, wantErr: "unknown chaos fault kind"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseChaosSpec(tt.spec, tt.size)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseChaosSpec(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseChaosSpec(%q) unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseChaosSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionScript(t *testing.T) {
+	insert := partitionScript("-I", []string{"10.0.0.1", "10.0.0.2"})
+	for _, rule := range []string{"iptables -I INPUT -s '10.0.0.1' -j DROP", "iptables -I OUTPUT -d '10.0.0.2' -j DROP"} {
+		if !strings.Contains(insert, rule) {
+			t.Errorf("insert script missing %q:\n%s", rule, insert)
+		}
+	}
+
+	heal := partitionScript("-D", []string{"10.0.0.1"})
+	if !strings.Contains(heal, "while iptables -D INPUT -s '10.0.0.1' -j DROP") {
+		t.Errorf("heal script does not remove every copy of the rule:\n%s", heal)
+	}
+}
@@ -0,0 +1,693 @@
+// cmd/cluster.go
+// This file implements cluster snapshot and cluster restore. A snapshot records what it
+// takes to bring the project's cluster in a VPC back: the AMI, type, placement, tags,
+// instance profile, and security groups of every instance, the rules of those groups,
+// and the network filesystems the instances have mounted. Restore recreates the
+// security groups and placement groups in a target VPC, which may be in another region
+// or account, launches an instance for every recorded one, and mounts the filesystems
+// again at first boot, for disaster recovery or promoting an environment.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// clusterSnapshotVersion is the format version of a cluster snapshot
+const clusterSnapshotVersion = 1
+
+// clusterRestoreTimeout is how long restore waits for the instances to run
+const clusterRestoreTimeout = 15 * time.Minute
+
+// networkFilesystems are the filesystem types a snapshot records for restore; they
+// live outside the instances, so a new instance can mount the same source
+var networkFilesystems = []string{"nfs", "nfs4", "lustre", "efs"}
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Snapshot a cluster's configuration and restore it",
+}
+
+// clusterSnapshotOptions are the flags of cluster snapshot
+type clusterSnapshotOptions struct {
+	project     string
+	vpc         string
+	output      string
+	filesystems bool
+}
+
+// newClusterSnapshotCmd returns cluster snapshot
+func newClusterSnapshotCmd() *cobra.Command {
+	o := &clusterSnapshotOptions{}
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Record the configuration of the project's cluster in a VPC",
+		Long: `snapshot writes a YAML description of the project's running instances in the VPC:
+AMI, instance type, availability zone, placement group, spot or on-demand, tags,
+instance profile, key pair, and security groups with their rules. The network
+filesystems (NFS, EFS, FSx for Lustre) mounted on the instances are read through SSM
+and recorded too, unless --filesystems=false.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClusterSnapshot(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "File to write the snapshot to (default: standard output)")
+	cmd.Flags().BoolVar(&o.filesystems, "filesystems", true, "Record the network filesystems mounted on the instances, read through SSM")
+	cmd.MarkFlagRequired("vpc")
+	return cmd
+}
+
+// clusterRestoreOptions are the flags of cluster restore
+type clusterRestoreOptions struct {
+	snapshot        string
+	project         string
+	vpc             string
+	subnet          string
+	region          string
+	imageMap        map[string]string
+	keyName         string
+	instanceProfile string
+}
+
+// newClusterRestoreCmd returns cluster restore
+func newClusterRestoreCmd() *cobra.Command {
+	o := &clusterRestoreOptions{}
+	cmd := &cobra.Command{
+		Use:   "restore --snapshot cluster.yaml --vpc VPC --subnet SUBNET",
+		Short: "Recreate a snapshotted cluster in a VPC",
+		Long: `restore creates the snapshot's security groups and placement groups in --vpc,
+launches one instance per recorded instance into --subnet, and mounts the recorded
+network filesystems on them at first boot. When restoring into another region, map
+every AMI to its copy there with --image-map, e.g. after aws ec2 copy-image. Rules that
+refer to security groups outside the snapshot cannot be restored and are reported.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClusterRestore(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.snapshot, "snapshot", "", "Snapshot file to restore (required)")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project to restore the cluster into (default: the snapshot's project)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC to create the security groups in (required)")
+	cmd.Flags().StringVar(&o.subnet, "subnet", "", "Subnet of --vpc to launch the instances into (required)")
+	cmd.Flags().StringVar(&o.region, "region", "", "Region to restore into (default: AWS_REGION)")
+	cmd.Flags().StringToStringVar(&o.imageMap, "image-map", nil, "AMIs to launch instead of the recorded ones, as OLD=NEW")
+	cmd.Flags().StringVar(&o.keyName, "key-name", "", "Key pair to launch with instead of the recorded one")
+	cmd.Flags().StringVar(&o.instanceProfile, "instance-profile", "", "Instance profile to launch with instead of the recorded one")
+	cmd.MarkFlagRequired("snapshot")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("subnet")
+	return cmd
+}
+
+func init() {
+	clusterCmd.AddCommand(newClusterSnapshotCmd(), newClusterRestoreCmd())
+	rootCmd.AddCommand(clusterCmd)
+}
+
+// clusterSnapshot is the content of a snapshot file
+type clusterSnapshot struct {
+	Version        int                     `yaml:"version"`
+	Project        string                  `yaml:"project"`
+	Created        string                  `yaml:"created"`
+	Region         string                  `yaml:"region"`
+	VPC            string                  `yaml:"vpc"`
+	SecurityGroups []securityGroupSnapshot `yaml:"security_groups"`
+	PlacementGrps  []placementGroupRecord  `yaml:"placement_groups,omitempty"`
+	Instances      []instanceSnapshot      `yaml:"instances"`
+}
+
+type securityGroupSnapshot struct {
+	ID          string            `yaml:"id"`
+	Name        string            `yaml:"name"`
+	Description string            `yaml:"description"`
+	Tags        map[string]string `yaml:"tags,omitempty"`
+	Ingress     []ruleSnapshot    `yaml:"ingress,omitempty"`
+	Egress      []ruleSnapshot    `yaml:"egress,omitempty"`
+}
+
+// ruleSnapshot is one permission of a security group; protocol "-1" is all traffic
+type ruleSnapshot struct {
+	Protocol    string   `yaml:"protocol"`
+	FromPort    int32    `yaml:"from_port,omitempty"`
+	ToPort      int32    `yaml:"to_port,omitempty"`
+	CIDRs       []string `yaml:"cidrs,omitempty"`
+	IPv6CIDRs   []string `yaml:"ipv6_cidrs,omitempty"`
+	Groups      []string `yaml:"groups,omitempty"`
+	PrefixLists []string `yaml:"prefix_lists,omitempty"`
+}
+
+type placementGroupRecord struct {
+	Name     string `yaml:"name"`
+	Strategy string `yaml:"strategy"`
+}
+
+type instanceSnapshot struct {
+	Rank             int                  `yaml:"rank"`
+	InstanceID       string               `yaml:"instance_id"`
+	InstanceType     string               `yaml:"instance_type"`
+	ImageID          string               `yaml:"ami"`
+	AvailabilityZone string               `yaml:"az"`
+	Subnet           string               `yaml:"subnet"`
+	PlacementGroup   string               `yaml:"placement_group,omitempty"`
+	Lifecycle        string               `yaml:"lifecycle"`
+	KeyName          string               `yaml:"key_name,omitempty"`
+	InstanceProfile  string               `yaml:"instance_profile,omitempty"`
+	SecurityGroups   []string             `yaml:"security_groups"`
+	Tags             map[string]string    `yaml:"tags"`
+	Filesystems      []filesystemSnapshot `yaml:"filesystems,omitempty"`
+}
+
+type filesystemSnapshot struct {
+	Source  string `yaml:"source"`
+	Target  string `yaml:"target"`
+	Type    string `yaml:"type"`
+	Options string `yaml:"options,omitempty"`
+}
+
+func runClusterSnapshot(ctx context.Context, o *clusterSnapshotOptions) {
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	snapshot, err := takeClusterSnapshot(ctx, ec2Client, o.vpc, project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.filesystems {
+		if err := recordFilesystems(ctx, snapshot); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	out, err := yaml.Marshal(snapshot)
+	if err != nil {
+		fmt.Printf("Error encoding snapshot: %v\n", err)
+		os.Exit(1)
+	}
+	if o.output == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if err := os.WriteFile(o.output, out, 0o644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", o.output, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote a snapshot of %d instances and %d security groups to %s\n", len(snapshot.Instances), len(snapshot.SecurityGroups), o.output)
+}
+
+// takeClusterSnapshot describes the running instances of project in the VPC, their
+// security groups, and their placement groups
+func takeClusterSnapshot(ctx context.Context, ec2Client *ec2.Client, vpcID, project string) (*clusterSnapshot, error) {
+	result, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []ec2Types.Filter{
+			{Name: aws.String("vpc-id"), Values: []string{vpcID}},
+			{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+			{Name: aws.String("tag:" + projectTagKey), Values: []string{project}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %v", err)
+	}
+
+	snapshot := &clusterSnapshot{
+		Version: clusterSnapshotVersion,
+		Project: project,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Region:  ec2Client.Options().Region,
+		VPC:     vpcID,
+	}
+	groupIDs := make(map[string]bool)
+	placementGroups := make(map[string]bool)
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			record := instanceRecordOf(instance)
+			record.Rank = len(snapshot.Instances)
+			for _, id := range record.SecurityGroups {
+				groupIDs[id] = true
+			}
+			if record.PlacementGroup != "" {
+				placementGroups[record.PlacementGroup] = true
+			}
+			snapshot.Instances = append(snapshot.Instances, record)
+		}
+	}
+	if len(snapshot.Instances) == 0 {
+		return nil, fmt.Errorf("no running instances of project %s in %s", project, vpcID)
+	}
+
+	if len(groupIDs) > 0 {
+		groups, err := ec2Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: sortedKeys(groupIDs)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %v", err)
+		}
+		for _, group := range groups.SecurityGroups {
+			snapshot.SecurityGroups = append(snapshot.SecurityGroups, securityGroupOf(group))
+		}
+	}
+	if len(placementGroups) > 0 {
+		groups, err := ec2Client.DescribePlacementGroups(ctx, &ec2.DescribePlacementGroupsInput{GroupNames: sortedKeys(placementGroups)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe placement groups: %v", err)
+		}
+		for _, group := range groups.PlacementGroups {
+			snapshot.PlacementGrps = append(snapshot.PlacementGrps, placementGroupRecord{Name: aws.ToString(group.GroupName), Strategy: string(group.Strategy)})
+		}
+	}
+	return snapshot, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instanceRecordOf records the launch configuration of an instance
+func instanceRecordOf(instance ec2Types.Instance) instanceSnapshot {
+	record := instanceSnapshot{
+		InstanceID:       aws.ToString(instance.InstanceId),
+		InstanceType:     string(instance.InstanceType),
+		ImageID:          aws.ToString(instance.ImageId),
+		AvailabilityZone: awsManager.PlacementZone(instance),
+		Subnet:           aws.ToString(instance.SubnetId),
+		PlacementGroup:   awsManager.PlacementGroup(instance),
+		Lifecycle:        awsManager.Lifecycle(instance),
+		KeyName:          aws.ToString(instance.KeyName),
+		Tags:             make(map[string]string),
+	}
+	if instance.IamInstanceProfile != nil {
+		// Launches take the name of the profile, not its ARN
+		record.InstanceProfile = instanceProfileName(instance)
+	}
+	for _, group := range instance.SecurityGroups {
+		record.SecurityGroups = append(record.SecurityGroups, aws.ToString(group.GroupId))
+	}
+	for _, tag := range instance.Tags {
+		record.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return record
+}
+
+// securityGroupOf records a security group and its rules
+func securityGroupOf(group ec2Types.SecurityGroup) securityGroupSnapshot {
+	record := securityGroupSnapshot{
+		ID:          aws.ToString(group.GroupId),
+		Name:        aws.ToString(group.GroupName),
+		Description: aws.ToString(group.Description),
+	}
+	for _, tag := range group.Tags {
+		if record.Tags == nil {
+			record.Tags = make(map[string]string)
+		}
+		record.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	for _, permission := range group.IpPermissions {
+		record.Ingress = append(record.Ingress, ruleOf(permission))
+	}
+	for _, permission := range group.IpPermissionsEgress {
+		record.Egress = append(record.Egress, ruleOf(permission))
+	}
+	return record
+}
+
+func ruleOf(permission ec2Types.IpPermission) ruleSnapshot {
+	rule := ruleSnapshot{
+		Protocol: aws.ToString(permission.IpProtocol),
+		FromPort: aws.ToInt32(permission.FromPort),
+		ToPort:   aws.ToInt32(permission.ToPort),
+	}
+	for _, r := range permission.IpRanges {
+		rule.CIDRs = append(rule.CIDRs, aws.ToString(r.CidrIp))
+	}
+	for _, r := range permission.Ipv6Ranges {
+		rule.IPv6CIDRs = append(rule.IPv6CIDRs, aws.ToString(r.CidrIpv6))
+	}
+	for _, pair := range permission.UserIdGroupPairs {
+		rule.Groups = append(rule.Groups, aws.ToString(pair.GroupId))
+	}
+	for _, list := range permission.PrefixListIds {
+		rule.PrefixLists = append(rule.PrefixLists, aws.ToString(list.PrefixListId))
+	}
+	return rule
+}
+
+// recordFilesystems reads the network filesystems mounted on every instance
+func recordFilesystems(ctx context.Context, snapshot *clusterSnapshot) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	var instances []awsManager.InstanceInfo
+	for _, record := range snapshot.Instances {
+		instances = append(instances, awsManager.InstanceInfo{InstanceID: record.InstanceID, InstanceRank: record.Rank})
+	}
+	script := newShellScript()
+	script.Linef("findmnt -rn -o SOURCE,TARGET,FSTYPE,OPTIONS -t %s || true", strings.Join(networkFilesystems, ","))
+	outputs, err := runScriptOnInstances(ctx, ssmClient, instances, func(awsManager.InstanceInfo) string {
+		return script.String()
+	})
+	for i, record := range snapshot.Instances {
+		if output, ok := outputs[record.InstanceID]; ok {
+			snapshot.Instances[i].Filesystems = parseMounts(output)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("filesystems were not recorded on every instance: %v", err)
+	}
+	return nil
+}
+
+// parseMounts parses the "findmnt -rn -o SOURCE,TARGET,FSTYPE,OPTIONS" lines of an
+// instance. findmnt escapes spaces in its raw output, so the fields split on spaces.
+func parseMounts(output string) []filesystemSnapshot {
+	var mounts []filesystemSnapshot
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mount := filesystemSnapshot{Source: fields[0], Target: fields[1], Type: fields[2]}
+		if len(fields) > 3 {
+			mount.Options = fields[3]
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
+// loadClusterSnapshot reads a snapshot file
+func loadClusterSnapshot(path string) (*clusterSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot clusterSnapshot
+	if err := yaml.UnmarshalStrict(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", path, err)
+	}
+	if snapshot.Version != clusterSnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	if len(snapshot.Instances) == 0 {
+		return nil, fmt.Errorf("snapshot %s has no instances", path)
+	}
+	return &snapshot, nil
+}
+
+func runClusterRestore(ctx context.Context, o *clusterRestoreOptions) {
+	snapshot, err := loadClusterSnapshot(o.snapshot)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project := o.project
+	if project == "" {
+		project = snapshot.Project
+	}
+	if err := validateProjectName(project); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.region != "" {
+		os.Setenv("AWS_REGION", o.region)
+	}
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	images, err := restoreImages(snapshot, ec2Client.Options().Region, o.imageMap)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := checkRestoreCompliance(ctx, ec2Client, snapshot, images, project, o); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 1: Security groups and placement groups
+	groupIDs, skipped, err := restoreSecurityGroups(ctx, ec2Client, snapshot, o.vpc, project)
+	for _, rule := range skipped {
+		fmt.Printf("Warning: not restored: %s\n", rule)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, group := range snapshot.PlacementGrps {
+		_, err := ec2Client.CreatePlacementGroup(ctx, &ec2.CreatePlacementGroupInput{
+			GroupName: aws.String(group.Name),
+			Strategy:  ec2Types.PlacementStrategy(group.Strategy),
+		})
+		if err != nil && !strings.Contains(err.Error(), "InvalidPlacementGroup.Duplicate") {
+			fmt.Printf("Error creating placement group %s: %v\n", group.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	// Step 2: Launch an instance for every recorded one
+	var launched []string
+	for _, record := range snapshot.Instances {
+		spec := restoreLaunchSpec(record, images, groupIDs, project, o)
+		ids, err := awsManager.LaunchInstances(ctx, ec2Client, spec)
+		if err != nil {
+			fmt.Printf("Error restoring rank %d: %v\n", record.Rank, err)
+			os.Exit(1)
+		}
+		launched = append(launched, ids...)
+	}
+	instances, err := awsManager.WaitForInstancesRunning(ctx, ec2Client, launched, clusterRestoreTimeout)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	for i, instance := range instances {
+		fmt.Printf("Rank %d: %s restored as %s (%s)\n", snapshot.Instances[i].Rank, snapshot.Instances[i].InstanceID, instance.InstanceID, instance.PrivateIP)
+	}
+	fmt.Printf("Restored %d instances of project %s in %s\n", len(instances), project, o.vpc)
+}
+
+// checkRestoreCompliance checks the security groups and launches of a restore against
+// the policy in force before anything is created
+func checkRestoreCompliance(ctx context.Context, ec2Client *ec2.Client, snapshot *clusterSnapshot, images map[string]string, project string, o *clusterRestoreOptions) error {
+	policy, err := loadCompliancePolicy()
+	if err != nil || policy == nil {
+		return err
+	}
+	var violations []policyViolation
+	for _, group := range snapshot.SecurityGroups {
+		for _, rule := range group.Ingress {
+			violations = append(violations, policy.ingressViolations(group.Name, slices.Concat(rule.CIDRs, rule.IPv6CIDRs))...)
+		}
+	}
+	specs := make(map[string]awsManager.LaunchSpec)
+	for _, record := range snapshot.Instances {
+		specs[fmt.Sprintf("rank %d", record.Rank)] = restoreLaunchSpec(record, images, nil, project, o)
+	}
+	launches, err := launchComplianceViolations(ctx, ec2Client, policy, specs)
+	if err != nil {
+		return err
+	}
+	return policy.enforce(append(violations, launches...))
+}
+
+// restoreImages returns the AMI every recorded one is launched as. AMIs are regional,
+// so restoring into another region needs all of them mapped.
+func restoreImages(snapshot *clusterSnapshot, region string, imageMap map[string]string) (map[string]string, error) {
+	images := make(map[string]string)
+	var unmapped []string
+	for _, record := range snapshot.Instances {
+		if image, ok := imageMap[record.ImageID]; ok {
+			images[record.ImageID] = image
+			continue
+		}
+		if region != snapshot.Region {
+			if _, seen := images[record.ImageID]; !seen {
+				unmapped = append(unmapped, record.ImageID)
+			}
+		}
+		images[record.ImageID] = record.ImageID
+	}
+	if len(unmapped) > 0 {
+		return nil, fmt.Errorf("the snapshot is from %s; copy %s to %s with aws ec2 copy-image and pass --image-map OLD=NEW for each",
+			snapshot.Region, strings.Join(unmapped, ", "), region)
+	}
+	return images, nil
+}
+
+// restoreSecurityGroups creates the snapshot's security groups in the VPC and returns
+// the ID each recorded group got, and the rules that could not be restored
+func restoreSecurityGroups(ctx context.Context, ec2Client *ec2.Client, snapshot *clusterSnapshot, vpcID, project string) (map[string]string, []string, error) {
+	ids := make(map[string]string)
+	for _, group := range snapshot.SecurityGroups {
+		tags := restoreTags(group.Tags, project)
+		result, err := ec2Client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+			GroupName:   aws.String(group.Name),
+			Description: aws.String(group.Description),
+			VpcId:       aws.String(vpcID),
+			TagSpecifications: []ec2Types.TagSpecification{
+				{ResourceType: ec2Types.ResourceTypeSecurityGroup, Tags: ec2Tags(tags)},
+			},
+		})
+		if err != nil {
+			return ids, nil, fmt.Errorf("failed to create security group %s: %v", group.Name, err)
+		}
+		ids[group.ID] = aws.ToString(result.GroupId)
+	}
+
+	var skipped []string
+	for _, group := range snapshot.SecurityGroups {
+		ingress, skippedIngress := translateRules(group.Ingress, ids)
+		egress, skippedEgress := translateRules(group.Egress, ids)
+		for _, rule := range append(skippedIngress, skippedEgress...) {
+			skipped = append(skipped, fmt.Sprintf("rule of %s referring to %s", group.Name, rule))
+		}
+		if len(ingress) > 0 {
+			_, err := ec2Client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{GroupId: aws.String(ids[group.ID]), IpPermissions: ingress})
+			if err != nil {
+				return ids, skipped, fmt.Errorf("failed to restore the inbound rules of %s: %v", group.Name, err)
+			}
+		}
+		for _, permission := range egress {
+			// New groups already allow all outbound traffic, which is the usual rule
+			_, err := ec2Client.AuthorizeSecurityGroupEgress(ctx, &ec2.AuthorizeSecurityGroupEgressInput{GroupId: aws.String(ids[group.ID]), IpPermissions: []ec2Types.IpPermission{permission}})
+			if err != nil && !strings.Contains(err.Error(), "InvalidPermission.Duplicate") {
+				return ids, skipped, fmt.Errorf("failed to restore the outbound rules of %s: %v", group.Name, err)
+			}
+		}
+	}
+	return ids, skipped, nil
+}
+
+// translateRules returns the rules as EC2 permissions with the security groups they
+// refer to replaced by the restored ones. References to groups outside the snapshot
+// are dropped and returned; a rule left with no source is dropped entirely.
+func translateRules(rules []ruleSnapshot, ids map[string]string) ([]ec2Types.IpPermission, []string) {
+	var permissions []ec2Types.IpPermission
+	var skipped []string
+	for _, rule := range rules {
+		permission := ec2Types.IpPermission{IpProtocol: aws.String(rule.Protocol)}
+		if rule.Protocol != "-1" {
+			permission.FromPort, permission.ToPort = aws.Int32(rule.FromPort), aws.Int32(rule.ToPort)
+		}
+		for _, cidr := range rule.CIDRs {
+			permission.IpRanges = append(permission.IpRanges, ec2Types.IpRange{CidrIp: aws.String(cidr)})
+		}
+		for _, cidr := range rule.IPv6CIDRs {
+			permission.Ipv6Ranges = append(permission.Ipv6Ranges, ec2Types.Ipv6Range{CidrIpv6: aws.String(cidr)})
+		}
+		for _, group := range rule.Groups {
+			if id, ok := ids[group]; ok {
+				permission.UserIdGroupPairs = append(permission.UserIdGroupPairs, ec2Types.UserIdGroupPair{GroupId: aws.String(id)})
+			} else {
+				skipped = append(skipped, group)
+			}
+		}
+		// Prefix lists are regional and per account, so they are not carried over
+		skipped = append(skipped, rule.PrefixLists...)
+		if len(permission.IpRanges)+len(permission.Ipv6Ranges)+len(permission.UserIdGroupPairs) > 0 {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions, skipped
+}
+
+// restoreLaunchSpec describes the launch of the instance replacing record
+func restoreLaunchSpec(record instanceSnapshot, images, groupIDs map[string]string, project string, o *clusterRestoreOptions) awsManager.LaunchSpec {
+	spec := awsManager.LaunchSpec{
+		ImageID:         images[record.ImageID],
+		InstanceType:    record.InstanceType,
+		SubnetID:        o.subnet,
+		InstanceProfile: record.InstanceProfile,
+		KeyName:         record.KeyName,
+		Count:           1,
+		Tags:            restoreTags(record.Tags, project),
+		PlacementGroup:  record.PlacementGroup,
+		Spot:            record.Lifecycle == awsManager.LifecycleSpot,
+		UserData:        mountUserData(record.Filesystems),
+	}
+	if o.instanceProfile != "" {
+		spec.InstanceProfile = o.instanceProfile
+	}
+	if o.keyName != "" {
+		spec.KeyName = o.keyName
+	}
+	for _, id := range record.SecurityGroups {
+		if restored, ok := groupIDs[id]; ok {
+			spec.SecurityGroupIDs = append(spec.SecurityGroupIDs, restored)
+		}
+	}
+	return spec
+}
+
+// restoreTags returns the recorded tags without the ones AWS reserves, in project
+func restoreTags(tags map[string]string, project string) map[string]string {
+	restored := make(map[string]string)
+	for key, value := range tags {
+		if !strings.HasPrefix(key, "aws:") {
+			restored[key] = value
+		}
+	}
+	restored[projectTagKey] = project
+	return restored
+}
+
+func ec2Tags(tags map[string]string) []ec2Types.Tag {
+	var list []ec2Types.Tag
+	for _, key := range sortedKeys(tags) {
+		list = append(list, ec2Types.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return list
+}
+
+// mountUserData returns the first boot script that mounts the recorded filesystems
+// again, or "" when there are none
+func mountUserData(filesystems []filesystemSnapshot) string {
+	if len(filesystems) == 0 {
+		return ""
+	}
+	script := newShellScript()
+	for _, fs := range filesystems {
+		options := fs.Options
+		if options == "" {
+			options = "defaults"
+		}
+		script.Linef("mkdir -p %s", fs.Target)
+		script.Linef("echo %s >> /etc/fstab", strings.Join([]string{fs.Source, fs.Target, fs.Type, options + ",_netdev", "0", "0"}, " "))
+	}
+	script.Raw("mount -a")
+	return script.String()
+}
@@ -0,0 +1,214 @@
+// cmd/cluster_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestParseMounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []filesystemSnapshot
+	}{
+		{name: "none", output: ""},
+		{
+			name:   "efs and lustre",
+			output: "fs-1.efs.us-east-1.amazonaws.com:/ /mnt/efs nfs4 rw,relatime,vers=4.1\n172.31.0.5@tcp:/abc /fsx lustre rw\n",
+			want: []filesystemSnapshot{
+				{Source: "fs-1.efs.us-east-1.amazonaws.com:/", Target: "/mnt/efs", Type: "nfs4", Options: "rw,relatime,vers=4.1"},
+				{Source: "172.31.0.5@tcp:/abc", Target: "/fsx", Type: "lustre", Options: "rw"},
+			},
+		},
+		{name: "no options", output: "10.0.0.9:/export /data nfs", want: []filesystemSnapshot{{Source: "10.0.0.9:/export", Target: "/data", Type: "nfs"}}},
+		{name: "short line skipped", output: "garbage\n10.0.0.9:/export /data nfs rw", want: []filesystemSnapshot{{Source: "10.0.0.9:/export", Target: "/data", Type: "nfs", Options: "rw"}}},
+	}
+
+	for _, tt := range tests {
+		if got := parseMounts(tt.output); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseMounts = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuleOfRoundTrips(t *testing.T) {
+	permission := ec2Types.IpPermission{
+		IpProtocol:       aws.String("tcp"),
+		FromPort:         aws.Int32(22),
+		ToPort:           aws.Int32(22),
+		IpRanges:         []ec2Types.IpRange{{CidrIp: aws.String("10.0.0.0/16")}},
+		UserIdGroupPairs: []ec2Types.UserIdGroupPair{{GroupId: aws.String("sg-old")}},
+	}
+	rule := ruleOf(permission)
+	want := ruleSnapshot{Protocol: "tcp", FromPort: 22, ToPort: 22, CIDRs: []string{"10.0.0.0/16"}, Groups: []string{"sg-old"}}
+	if !reflect.DeepEqual(rule, want) {
+		t.Fatalf("ruleOf = %+v, want %+v", rule, want)
+	}
+
+	permissions, skipped := translateRules([]ruleSnapshot{rule}, map[string]string{"sg-old": "sg-new"})
+	if len(skipped) != 0 || len(permissions) != 1 {
+		t.Fatalf("translateRules = %+v, skipped %v", permissions, skipped)
+	}
+	if got := aws.ToString(permissions[0].UserIdGroupPairs[0].GroupId); got != "sg-new" {
+		t.Errorf("group reference = %s, want sg-new", got)
+	}
+	if aws.ToInt32(permissions[0].FromPort) != 22 || aws.ToString(permissions[0].IpRanges[0].CidrIp) != "10.0.0.0/16" {
+		t.Errorf("translated permission = %+v", permissions[0])
+	}
+}
+
+func TestTranslateRules(t *testing.T) {
+	ids := map[string]string{"sg-a": "sg-1"}
+	tests := []struct {
+		name        string
+		rule        ruleSnapshot
+		wantRules   int
+		wantSkipped []string
+		wantPorts   bool
+	}{
+		{name: "cidr", rule: ruleSnapshot{Protocol: "tcp", FromPort: 443, ToPort: 443, CIDRs: []string{"0.0.0.0/0"}}, wantRules: 1, wantPorts: true},
+		{name: "all traffic has no ports", rule: ruleSnapshot{Protocol: "-1", CIDRs: []string{"0.0.0.0/0"}}, wantRules: 1},
+		{name: "known group", rule: ruleSnapshot{Protocol: "-1", Groups: []string{"sg-a"}}, wantRules: 1},
+		{name: "unknown group only", rule: ruleSnapshot{Protocol: "-1", Groups: []string{"sg-z"}}, wantSkipped: []string{"sg-z"}},
+		{name: "unknown group with a cidr", rule: ruleSnapshot{Protocol: "tcp", FromPort: 1, ToPort: 2, CIDRs: []string{"10.0.0.0/8"}, Groups: []string{"sg-z"}}, wantRules: 1, wantSkipped: []string{"sg-z"}, wantPorts: true},
+		{name: "prefix list", rule: ruleSnapshot{Protocol: "tcp", FromPort: 443, ToPort: 443, PrefixLists: []string{"pl-1"}}, wantSkipped: []string{"pl-1"}},
+	}
+
+	for _, tt := range tests {
+		permissions, skipped := translateRules([]ruleSnapshot{tt.rule}, ids)
+		if len(permissions) != tt.wantRules {
+			t.Errorf("%s: %d rules, want %d", tt.name, len(permissions), tt.wantRules)
+		}
+		if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+			t.Errorf("%s: skipped %v, want %v", tt.name, skipped, tt.wantSkipped)
+		}
+		if len(permissions) == 1 && (permissions[0].FromPort != nil) != tt.wantPorts {
+			t.Errorf("%s: ports set = %v, want %v", tt.name, permissions[0].FromPort != nil, tt.wantPorts)
+		}
+	}
+}
+
+func TestRestoreImages(t *testing.T) {
+	snapshot := &clusterSnapshot{
+		Region: "us-east-1",
+		Instances: []instanceSnapshot{
+			{Rank: 0, ImageID: "ami-a"},
+			{Rank: 1, ImageID: "ami-a"},
+			{Rank: 2, ImageID: "ami-b"},
+		},
+	}
+	tests := []struct {
+		name     string
+		region   string
+		imageMap map[string]string
+		want     map[string]string
+		wantErr  string
+	}{
+		{name: "same region", region: "us-east-1", want: map[string]string{"ami-a": "ami-a", "ami-b": "ami-b"}},
+		{name: "same region remapped", region: "us-east-1", imageMap: map[string]string{"ami-b": "ami-c"}, want: map[string]string{"ami-a": "ami-a", "ami-b": "ami-c"}},
+		{name: "other region unmapped", region: "eu-west-1", imageMap: map[string]string{"ami-b": "ami-c"}, wantErr: "copy ami-a to eu-west-1"},
+		{name: "other region mapped", region: "eu-west-1", imageMap: map[string]string{"ami-a": "ami-x", "ami-b": "ami-y"}, want: map[string]string{"ami-a": "ami-x", "ami-b": "ami-y"}},
+	}
+
+	for _, tt := range tests {
+		got, err := restoreImages(snapshot, tt.region, tt.imageMap)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: images = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRestoreLaunchSpec(t *testing.T) {
+	record := instanceSnapshot{
+		ImageID:         "ami-a",
+		InstanceType:    "c7g.large",
+		PlacementGroup:  "hpc",
+		Lifecycle:       "spot",
+		InstanceProfile: "awsmpirun-instance",
+		SecurityGroups:  []string{"sg-a", "sg-gone"},
+		Tags:            map[string]string{"Name": "rank-0", "aws:cloudformation:stack-name": "s", projectTagKey: "old"},
+	}
+	spec := restoreLaunchSpec(record, map[string]string{"ami-a": "ami-x"}, map[string]string{"sg-a": "sg-1"}, "new", &clusterRestoreOptions{})
+
+	if spec.ImageID != "ami-x" || spec.InstanceType != "c7g.large" || spec.PlacementGroup != "hpc" || !spec.Spot || spec.Count != 1 {
+		t.Errorf("spec = %+v", spec)
+	}
+	if !reflect.DeepEqual(spec.SecurityGroupIDs, []string{"sg-1"}) {
+		t.Errorf("security groups = %v, want [sg-1]", spec.SecurityGroupIDs)
+	}
+	wantTags := map[string]string{"Name": "rank-0", projectTagKey: "new"}
+	if !reflect.DeepEqual(spec.Tags, wantTags) {
+		t.Errorf("tags = %v, want %v", spec.Tags, wantTags)
+	}
+	if spec.UserData != "" {
+		t.Errorf("user data without filesystems = %q", spec.UserData)
+	}
+}
+
+func TestMountUserData(t *testing.T) {
+	script := mountUserData([]filesystemSnapshot{
+		{Source: "fs-1.efs.us-east-1.amazonaws.com:/", Target: "/mnt/efs", Type: "nfs4", Options: "rw,vers=4.1"},
+		{Source: "10.0.0.9:/export", Target: "/data", Type: "nfs"},
+	})
+	for _, want := range []string{
+		"mkdir -p '/mnt/efs'",
+		"echo 'fs-1.efs.us-east-1.amazonaws.com:/ /mnt/efs nfs4 rw,vers=4.1,_netdev 0 0' >> /etc/fstab",
+		"echo '10.0.0.9:/export /data nfs defaults,_netdev 0 0' >> /etc/fstab",
+		"mount -a",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("user data missing %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestLoadClusterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "valid", content: "version: 1\nproject: default\nregion: us-east-1\nvpc: vpc-1\ninstances:\n- rank: 0\n  instance_id: i-0\n  instance_type: c7g.large\n  ami: ami-1\n"},
+		{name: "unknown field", content: "version: 1\nsubnets: []\ninstances:\n- rank: 0\n", wantErr: "invalid snapshot"},
+		{name: "other version", content: "version: 2\ninstances:\n- rank: 0\n", wantErr: "unsupported snapshot version 2"},
+		{name: "no instances", content: "version: 1\n", wantErr: "has no instances"},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i))+".yaml")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := loadClusterSnapshot(path)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			} else if snapshot.Instances[0].ImageID != "ami-1" {
+				t.Errorf("%s: instances = %+v", tt.name, snapshot.Instances)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
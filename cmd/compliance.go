@@ -0,0 +1,360 @@
+// cmd/compliance.go
+// This file implements compliance policies: organizational constraints a platform team
+// sets once, in a YAML file named by compliance_policy in config.yaml or by
+// AWSMPIRUN_COMPLIANCE_POLICY, and that every command checks before it changes
+// anything. Launches are checked for unencrypted EBS volumes, subnets that assign
+// public IPs, missing tags, and instance types outside the allowed list; security
+// groups for inbound rules open to the internet; and the existing instances a run or
+// cluster adopt acts on for the same. Any violation fails the command with a report
+// of all of them, before the first mutation.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envCompliancePolicy names the policy file, overriding compliance_policy in config.yaml
+const envCompliancePolicy = "AWSMPIRUN_COMPLIANCE_POLICY"
+
+// Rules of a compliance policy, named as in the file
+const (
+	ruleEBSEncryption = "require_ebs_encryption"
+	rulePublicIP      = "no_public_ip"
+	ruleOpenIngress   = "no_open_ingress"
+	ruleRequiredTags  = "required_tags"
+	ruleInstanceTypes = "allowed_instance_types"
+)
+
+// compliancePolicy is the content of a compliance policy file
+type compliancePolicy struct {
+	RequireEBSEncryption bool          `yaml:"require_ebs_encryption"`
+	NoPublicIP           bool          `yaml:"no_public_ip"`
+	NoOpenIngress        bool          `yaml:"no_open_ingress"` // No inbound rule from 0.0.0.0/0 or ::/0
+	RequiredTags         []requiredTag `yaml:"required_tags,omitempty"`
+	InstanceTypes        []string      `yaml:"allowed_instance_types,omitempty"` // Patterns such as c5n.*
+
+	path string
+}
+
+// requiredTag is a tag every instance must carry, with one of Values if there are any
+type requiredTag struct {
+	Key    string   `yaml:"key"`
+	Values []string `yaml:"values,omitempty"`
+}
+
+// policyViolation is one way a resource breaks a rule
+type policyViolation struct {
+	resource string // Such as "instance i-0abc" or "rank 3"
+	rule     string
+	detail   string
+}
+
+func (v policyViolation) String() string {
+	return fmt.Sprintf("%s %s (%s)", v.resource, v.detail, v.rule)
+}
+
+// policyViolationError reports every violation found before a mutation
+type policyViolationError struct {
+	policy     string
+	violations []policyViolation
+}
+
+func (e *policyViolationError) Error() string {
+	lines := make([]string, len(e.violations))
+	for i, v := range e.violations {
+		lines[i] = v.String()
+	}
+	return fmt.Sprintf("%d violations of compliance policy %s, nothing was changed:\n  %s", len(e.violations), e.policy, strings.Join(lines, "\n  "))
+}
+
+// loadCompliancePolicy reads the policy in force, or returns nil when there is none
+func loadCompliancePolicy() (*compliancePolicy, error) {
+	file := os.Getenv(envCompliancePolicy)
+	if file == "" {
+		configPath, err := userConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		config, err := loadUserConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		file = config.CompliancePolicy
+	}
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compliance policy: %v", err)
+	}
+	policy, err := parseCompliancePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compliance policy %s: %v", file, err)
+	}
+	policy.path = file
+	return policy, nil
+}
+
+// parseCompliancePolicy parses and checks the content of a policy file
+func parseCompliancePolicy(data []byte) (*compliancePolicy, error) {
+	var policy compliancePolicy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, err
+	}
+	for _, tag := range policy.RequiredTags {
+		if tag.Key == "" {
+			return nil, fmt.Errorf("a required tag has no key")
+		}
+	}
+	for _, pattern := range policy.InstanceTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid instance type pattern %q", pattern)
+		}
+	}
+	return &policy, nil
+}
+
+// enforce returns an error listing the violations, or nil if there are none
+func (p *compliancePolicy) enforce(violations []policyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &policyViolationError{policy: p.path, violations: violations}
+}
+
+// tagViolations checks tags against the required tags
+func (p *compliancePolicy) tagViolations(resource string, tags map[string]string) []policyViolation {
+	var violations []policyViolation
+	for _, tag := range p.RequiredTags {
+		value, ok := tags[tag.Key]
+		switch {
+		case !ok || value == "":
+			violations = append(violations, policyViolation{resource, ruleRequiredTags, fmt.Sprintf("is missing tag %s", tag.Key)})
+		case len(tag.Values) > 0 && !slices.Contains(tag.Values, value):
+			violations = append(violations, policyViolation{resource, ruleRequiredTags,
+				fmt.Sprintf("has %s=%s, expected one of %s", tag.Key, value, strings.Join(tag.Values, ", "))})
+		}
+	}
+	return violations
+}
+
+// instanceTypeViolations checks an instance type against the allowed ones
+func (p *compliancePolicy) instanceTypeViolations(resource, instanceType string) []policyViolation {
+	if len(p.InstanceTypes) == 0 {
+		return nil
+	}
+	for _, pattern := range p.InstanceTypes {
+		if ok, _ := path.Match(pattern, instanceType); ok {
+			return nil
+		}
+	}
+	return []policyViolation{{resource, ruleInstanceTypes,
+		fmt.Sprintf("has instance type %s, allowed are %s", instanceType, strings.Join(p.InstanceTypes, ", "))}}
+}
+
+// ingressViolations checks the inbound rules of a security group for sources open to
+// the whole internet
+func (p *compliancePolicy) ingressViolations(group string, cidrs []string) []policyViolation {
+	if !p.NoOpenIngress {
+		return nil
+	}
+	var violations []policyViolation
+	for _, cidr := range cidrs {
+		if cidr == "0.0.0.0/0" || cidr == "::/0" {
+			violations = append(violations, policyViolation{"security group " + group, ruleOpenIngress, "allows inbound traffic from " + cidr})
+		}
+	}
+	return violations
+}
+
+// launchEnvironment is what the account and VPC decide about a launch
+type launchEnvironment struct {
+	encryptedByDefault bool            // EBS encryption by default is on in the region
+	unencryptedImages  map[string]bool // AMIs with an unencrypted EBS snapshot
+	publicSubnets      map[string]bool // Subnets that assign public IPs at launch
+}
+
+// launchViolations checks a launch described by spec
+func (p *compliancePolicy) launchViolations(resource string, spec awsManager.LaunchSpec, env launchEnvironment) []policyViolation {
+	var violations []policyViolation
+	if p.RequireEBSEncryption && !env.encryptedByDefault && env.unencryptedImages[spec.ImageID] {
+		violations = append(violations, policyViolation{resource, ruleEBSEncryption,
+			fmt.Sprintf("would get unencrypted volumes: image %s has unencrypted snapshots and EBS encryption by default is off", spec.ImageID)})
+	}
+	if p.NoPublicIP {
+		switch {
+		case spec.SubnetID == "":
+			violations = append(violations, policyViolation{resource, rulePublicIP, "would launch into the default subnet, which assigns public IPs"})
+		case env.publicSubnets[spec.SubnetID]:
+			violations = append(violations, policyViolation{resource, rulePublicIP, fmt.Sprintf("would get a public IP from subnet %s", spec.SubnetID)})
+		}
+	}
+	violations = append(violations, p.instanceTypeViolations(resource, spec.InstanceType)...)
+	return append(violations, p.tagViolations(resource, spec.Tags)...)
+}
+
+// instanceViolations checks an existing instance; encrypted tells whether each of its
+// volumes is encrypted
+func (p *compliancePolicy) instanceViolations(instance ec2Types.Instance, encrypted map[string]bool) []policyViolation {
+	resource := "instance " + aws.ToString(instance.InstanceId)
+	var violations []policyViolation
+	if p.RequireEBSEncryption {
+		for _, mapping := range instance.BlockDeviceMappings {
+			if mapping.Ebs == nil {
+				continue
+			}
+			if volume := aws.ToString(mapping.Ebs.VolumeId); !encrypted[volume] {
+				violations = append(violations, policyViolation{resource, ruleEBSEncryption, fmt.Sprintf("has unencrypted volume %s", volume)})
+			}
+		}
+	}
+	if ip := aws.ToString(instance.PublicIpAddress); p.NoPublicIP && ip != "" {
+		violations = append(violations, policyViolation{resource, rulePublicIP, "has public IP " + ip})
+	}
+	violations = append(violations, p.instanceTypeViolations(resource, string(instance.InstanceType))...)
+	tags := make(map[string]string)
+	for _, tag := range instance.Tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return append(violations, p.tagViolations(resource, tags)...)
+}
+
+// checkLaunchCompliance checks the launches of specs, keyed by what they launch,
+// against the policy in force
+func checkLaunchCompliance(ctx context.Context, ec2Client *ec2.Client, specs map[string]awsManager.LaunchSpec) error {
+	policy, err := loadCompliancePolicy()
+	if err != nil || policy == nil {
+		return err
+	}
+	violations, err := launchComplianceViolations(ctx, ec2Client, policy, specs)
+	if err != nil {
+		return err
+	}
+	return policy.enforce(violations)
+}
+
+// launchComplianceViolations checks the launches of specs against policy, looking up
+// the account's EBS default, the images, and the subnets the rules depend on
+func launchComplianceViolations(ctx context.Context, ec2Client *ec2.Client, policy *compliancePolicy, specs map[string]awsManager.LaunchSpec) ([]policyViolation, error) {
+	env := launchEnvironment{unencryptedImages: make(map[string]bool), publicSubnets: make(map[string]bool)}
+	var images, subnets []string
+	for _, spec := range specs {
+		if !slices.Contains(images, spec.ImageID) {
+			images = append(images, spec.ImageID)
+		}
+		if spec.SubnetID != "" && !slices.Contains(subnets, spec.SubnetID) {
+			subnets = append(subnets, spec.SubnetID)
+		}
+	}
+	if policy.RequireEBSEncryption {
+		result, err := ec2Client.GetEbsEncryptionByDefault(ctx, &ec2.GetEbsEncryptionByDefaultInput{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check EBS encryption by default: %v", err)
+		}
+		env.encryptedByDefault = aws.ToBool(result.EbsEncryptionByDefault)
+		if !env.encryptedByDefault {
+			described, err := ec2Client.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: images})
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe images: %v", err)
+			}
+			for _, image := range described.Images {
+				for _, mapping := range image.BlockDeviceMappings {
+					if mapping.Ebs != nil && !aws.ToBool(mapping.Ebs.Encrypted) {
+						env.unencryptedImages[aws.ToString(image.ImageId)] = true
+					}
+				}
+			}
+		}
+	}
+	if policy.NoPublicIP && len(subnets) > 0 {
+		described, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{SubnetIds: subnets})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe subnets: %v", err)
+		}
+		for _, subnet := range described.Subnets {
+			env.publicSubnets[aws.ToString(subnet.SubnetId)] = aws.ToBool(subnet.MapPublicIpOnLaunch)
+		}
+	}
+
+	var violations []policyViolation
+	for _, resource := range sortedKeys(specs) {
+		violations = append(violations, policy.launchViolations(resource, specs[resource], env)...)
+	}
+	return violations, nil
+}
+
+// instanceComplianceViolations checks existing instances against policy
+func instanceComplianceViolations(ctx context.Context, ec2Client *ec2.Client, policy *compliancePolicy, instances []ec2Types.Instance) ([]policyViolation, error) {
+	encrypted := make(map[string]bool)
+	if policy.RequireEBSEncryption {
+		var volumes []string
+		for _, instance := range instances {
+			for _, mapping := range instance.BlockDeviceMappings {
+				if mapping.Ebs != nil {
+					volumes = append(volumes, aws.ToString(mapping.Ebs.VolumeId))
+				}
+			}
+		}
+		if len(volumes) > 0 {
+			paginator := ec2.NewDescribeVolumesPaginator(ec2Client, &ec2.DescribeVolumesInput{VolumeIds: volumes})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("failed to describe volumes: %v", err)
+				}
+				for _, volume := range page.Volumes {
+					encrypted[aws.ToString(volume.VolumeId)] = aws.ToBool(volume.Encrypted)
+				}
+			}
+		}
+	}
+	var violations []policyViolation
+	for _, instance := range instances {
+		violations = append(violations, policy.instanceViolations(instance, encrypted)...)
+	}
+	return violations, nil
+}
+
+// checkInstanceCompliance checks the instances with ids against the policy in force
+func checkInstanceCompliance(ctx context.Context, ids []string) error {
+	policy, err := loadCompliancePolicy()
+	if err != nil || policy == nil {
+		return err
+	}
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create EC2 client: %v", err)
+	}
+	var instances []ec2Types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to describe instances: %v", err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	violations, err := instanceComplianceViolations(ctx, ec2Client, policy, instances)
+	if err != nil {
+		return err
+	}
+	return policy.enforce(violations)
+}
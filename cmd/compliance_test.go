@@ -0,0 +1,187 @@
+// cmd/compliance_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const testCompliancePolicy = `
+require_ebs_encryption: true
+no_public_ip: true
+no_open_ingress: true
+required_tags:
+  - key: CostCenter
+  - key: Environment
+    values: [research, staging]
+allowed_instance_types: [c5n.*, hpc6a.48xlarge]
+`
+
+func TestParseCompliancePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "full", data: testCompliancePolicy},
+		{name: "empty", data: ""},
+		{name: "unknown rule", data: "require_imdsv2: true\n", wantErr: "require_imdsv2"},
+		{name: "tag without key", data: "required_tags:\n  - values: [a]\n", wantErr: "no key"},
+		{name: "bad pattern", data: "allowed_instance_types: ['c5[']\n", wantErr: "invalid instance type pattern"},
+	}
+	for _, tt := range tests {
+		_, err := parseCompliancePolicy([]byte(tt.data))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadCompliancePolicy(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv(envCompliancePolicy, "")
+	if policy, err := loadCompliancePolicy(); policy != nil || err != nil {
+		t.Fatalf("no policy configured: got %+v, %v", policy, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "compliance.yaml")
+	if err := os.WriteFile(file, []byte(testCompliancePolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath, _ := userConfigPath()
+	os.MkdirAll(filepath.Dir(configPath), 0o755)
+	if err := os.WriteFile(configPath, []byte("compliance_policy: "+file+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadCompliancePolicy()
+	if err != nil || policy == nil || !policy.NoPublicIP || policy.path != file {
+		t.Fatalf("policy from config.yaml: got %+v, %v", policy, err)
+	}
+
+	t.Setenv(envCompliancePolicy, filepath.Join(home, "missing.yaml"))
+	if _, err := loadCompliancePolicy(); err == nil {
+		t.Error("a missing policy named by the environment was ignored")
+	}
+}
+
+func TestLaunchViolations(t *testing.T) {
+	policy, err := parseCompliancePolicy([]byte(testCompliancePolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compliant := func() awsManager.LaunchSpec {
+		return awsManager.LaunchSpec{
+			ImageID:      "ami-1",
+			InstanceType: "c5n.18xlarge",
+			SubnetID:     "subnet-private",
+			Tags:         map[string]string{"CostCenter": "42", "Environment": "research"},
+		}
+	}
+	env := launchEnvironment{
+		unencryptedImages: map[string]bool{"ami-plain": true},
+		publicSubnets:     map[string]bool{"subnet-public": true},
+	}
+	tests := []struct {
+		name   string
+		change func(*awsManager.LaunchSpec)
+		env    *launchEnvironment
+		want   []string
+	}{
+		{name: "compliant", change: func(*awsManager.LaunchSpec) {}},
+		{name: "exact type", change: func(s *awsManager.LaunchSpec) { s.InstanceType = "hpc6a.48xlarge" }},
+		{name: "unencrypted image", change: func(s *awsManager.LaunchSpec) { s.ImageID = "ami-plain" },
+			want: []string{"rank 0 would get unencrypted volumes: image ami-plain has unencrypted snapshots and EBS encryption by default is off (require_ebs_encryption)"}},
+		{name: "encrypted by default", change: func(s *awsManager.LaunchSpec) { s.ImageID = "ami-plain" },
+			env: &launchEnvironment{encryptedByDefault: true, unencryptedImages: env.unencryptedImages}},
+		{name: "public subnet", change: func(s *awsManager.LaunchSpec) { s.SubnetID = "subnet-public" },
+			want: []string{"rank 0 would get a public IP from subnet subnet-public (no_public_ip)"}},
+		{name: "default subnet", change: func(s *awsManager.LaunchSpec) { s.SubnetID = "" },
+			want: []string{"rank 0 would launch into the default subnet, which assigns public IPs (no_public_ip)"}},
+		{name: "type not allowed", change: func(s *awsManager.LaunchSpec) { s.InstanceType = "p4d.24xlarge" },
+			want: []string{"rank 0 has instance type p4d.24xlarge, allowed are c5n.*, hpc6a.48xlarge (allowed_instance_types)"}},
+		{name: "tags", change: func(s *awsManager.LaunchSpec) { s.Tags = map[string]string{"CostCenter": "", "Environment": "prod"} },
+			want: []string{
+				"rank 0 is missing tag CostCenter (required_tags)",
+				"rank 0 has Environment=prod, expected one of research, staging (required_tags)",
+			}},
+	}
+	for _, tt := range tests {
+		spec := compliant()
+		tt.change(&spec)
+		e := env
+		if tt.env != nil {
+			e = *tt.env
+		}
+		var got []string
+		for _, v := range policy.launchViolations("rank 0", spec, e) {
+			got = append(got, v.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if got := (&compliancePolicy{}).launchViolations("rank 0", awsManager.LaunchSpec{ImageID: "ami-plain"}, env); got != nil {
+		t.Errorf("an empty policy found %v", got)
+	}
+}
+
+func TestInstanceViolations(t *testing.T) {
+	policy, err := parseCompliancePolicy([]byte("require_ebs_encryption: true\nno_public_ip: true\nrequired_tags: [{key: CostCenter}]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := func(id string) ec2Types.InstanceBlockDeviceMapping {
+		return ec2Types.InstanceBlockDeviceMapping{Ebs: &ec2Types.EbsInstanceBlockDevice{VolumeId: aws.String(id)}}
+	}
+	instance := ec2Types.Instance{
+		InstanceId:          aws.String("i-1"),
+		InstanceType:        ec2Types.InstanceTypeC5n18xlarge,
+		PublicIpAddress:     aws.String("3.3.3.3"),
+		BlockDeviceMappings: []ec2Types.InstanceBlockDeviceMapping{volume("vol-root"), volume("vol-data"), {DeviceName: aws.String("/dev/sdb")}},
+		Tags:                []ec2Types.Tag{{Key: aws.String("Name"), Value: aws.String("rank")}},
+	}
+	want := []string{
+		"instance i-1 has unencrypted volume vol-data (require_ebs_encryption)",
+		"instance i-1 has public IP 3.3.3.3 (no_public_ip)",
+		"instance i-1 is missing tag CostCenter (required_tags)",
+	}
+	var got []string
+	for _, v := range policy.instanceViolations(instance, map[string]bool{"vol-root": true}) {
+		got = append(got, v.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIngressViolations(t *testing.T) {
+	policy := &compliancePolicy{NoOpenIngress: true, path: "/etc/awsmpirun/compliance.yaml"}
+	violations := policy.ingressViolations("mpi", []string{"10.0.0.0/16", "0.0.0.0/0", "::/0"})
+	if len(violations) != 2 || violations[1].String() != "security group mpi allows inbound traffic from ::/0 (no_open_ingress)" {
+		t.Errorf("violations %v", violations)
+	}
+	if (&compliancePolicy{}).ingressViolations("mpi", []string{"0.0.0.0/0"}) != nil {
+		t.Error("open ingress reported without no_open_ingress")
+	}
+	if policy.enforce(nil) != nil {
+		t.Error("no violations is an error")
+	}
+	err := policy.enforce(violations)
+	want := "2 violations of compliance policy /etc/awsmpirun/compliance.yaml, nothing was changed:\n" +
+		"  security group mpi allows inbound traffic from 0.0.0.0/0 (no_open_ingress)\n" +
+		"  security group mpi allows inbound traffic from ::/0 (no_open_ingress)"
+	if err == nil || err.Error() != want {
+		t.Errorf("error:\n%v\nwant:\n%s", err, want)
+	}
+}
@@ -0,0 +1,65 @@
+// cmd/context.go
+// This file sets up the context every command runs in. The first Ctrl-C or SIGTERM
+// cancels it, and so does --timeout once the command has run that long. Every AWS call
+// and polling loop of a command takes its context from here, so both stop a command at
+// once instead of leaving it waiting on SSM or EC2. Clean-up that must still happen
+// after a cancellation, such as terminating instances, runs on cleanupContext. A second
+// Ctrl-C exits without waiting.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// cleanupTimeout bounds the clean-up a cancelled command still does
+const cleanupTimeout = 2 * time.Minute
+
+// commandTimeout is the --timeout of every command; 0 leaves them unlimited
+var commandTimeout time.Duration
+
+// cancelTimeout releases the timer of --timeout
+var cancelTimeout context.CancelFunc = func() {}
+
+func init() {
+	rootCmd.PersistentFlags().DurationVar(&commandTimeout, "timeout", 0, `Cancel the command and its AWS calls if it is still running after this long, e.g. "30m" (default: no limit)`)
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		useLoginProfile()
+		if commandTimeout > 0 {
+			var ctx context.Context
+			ctx, cancelTimeout = context.WithTimeout(cmd.Context(), commandTimeout)
+			cmd.SetContext(ctx)
+		}
+	}
+}
+
+// interruptContext returns a context cancelled by the first SIGINT or SIGTERM. After
+// that the signals are no longer caught, so a second one ends the process.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			fmt.Println("\nInterrupted, cancelling the AWS calls in flight. Interrupt again to exit at once.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cleanupContext returns a context for work that must finish even when ctx has been
+// cancelled, bounded by cleanupTimeout
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
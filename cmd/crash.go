@@ -0,0 +1,88 @@
+// cmd/crash.go
+// This file collects crash reports from ranks that exit abnormally. Ranks run with
+// GOTRACEBACK=crash and an unlimited core size, so a Go panic prints every goroutine's
+// stack and then aborts with a core dump. When the rank dies from a panic or a signal,
+// its script uploads output.txt, which holds the traceback, and any core file it left
+// in the work directory to crash/rank-<rank>/ under the job's prefix in the staging bucket,
+// stamped with the rank's provenance metadata (see mpi.Provenance), and
+// reports the first panic line on stderr for the CLI's failure summary. Cores only land
+// in the work directory when the kernel's core_pattern is a plain file name; with
+// systemd-coredump they stay available through coredumpctl on the instance.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Prefixes of the stderr lines a crashed rank's script reports to the CLI
+const (
+	crashMarker       = "awsmpirun-crash: "
+	crashReportMarker = "awsmpirun-crash-report: "
+)
+
+// crashKeyPrefix is the S3 prefix a rank's crash report is uploaded under
+func crashKeyPrefix(project, jobID string, rank int) string {
+	return fmt.Sprintf("%s/crash/rank-%d/", mpi.JobPrefix(project, jobID), rank)
+}
+
+// rankStartMarker is touched just before the rank of jobID starts, so only cores
+// written by this run are collected
+func rankStartMarker(jobID string) string {
+	return fmt.Sprintf("/tmp/awsmpirun/%s/rank.started", jobID)
+}
+
+// crashCollection returns the script lines that run after the rank exits with
+// RANK_STATUS, in its work directory, and collect a report if it crashed
+func crashCollection(jobID string) string {
+	return shellf(`if [ $RANK_STATUS -ne 0 ]; then
+  CRASH=$(grep -m 1 -E '^(panic: |fatal error: |SIG[A-Z]+: |unexpected fault address)' output.txt)
+  if [ -z "$CRASH" ] && [ $RANK_STATUS -gt 128 ]; then
+    CRASH="killed by signal $((RANK_STATUS - 128))"
+  fi
+  if [ -n "$CRASH" ]; then
+    echo "%[1]s$CRASH" >&2
+    if [ -n "$MPI_BUCKET" ]; then
+      # The job prefix of mpi.JobPrefix
+      JOB_PREFIX="jobs/$MPI_JOB_ID"
+      if [ -n "$MPI_PROJECT" ]; then
+        JOB_PREFIX="projects/$MPI_PROJECT/$JOB_PREFIX"
+      fi
+      CRASH_PREFIX="s3://$MPI_BUCKET/$JOB_PREFIX/crash/rank-$MPI_RANK/"
+      PROVENANCE="%[4]s=$MPI_JOB_ID,%[5]s=$MPI_RANK,%[7]s=s3://$MPI_BUCKET/$JOB_PREFIX/job.yaml"
+      if [ -n "$MPI_PROJECT" ]; then
+        PROVENANCE="$PROVENANCE,%[8]s=$MPI_PROJECT"
+      fi
+      if [ -n "$MPI_PROGRAM_SHA256" ]; then
+        PROVENANCE="$PROVENANCE,%[6]s=$MPI_PROGRAM_SHA256"
+      fi
+      if aws s3 cp output.txt "${CRASH_PREFIX}output.txt" --only-show-errors --metadata "$PROVENANCE"; then
+        for CORE in $(find . -maxdepth 1 -type f -name 'core*' -newer %[3]s); do
+          aws s3 cp "$CORE" "$CRASH_PREFIX${CORE#./}" --only-show-errors --metadata "$PROVENANCE"
+        done
+        echo "%[2]s$CRASH_PREFIX" >&2
+      fi
+    fi
+  fi
+fi`, shellExpr(crashMarker), shellExpr(crashReportMarker), rankStartMarker(jobID),
+		shellExpr(mpi.MetaJobID), shellExpr(mpi.MetaRank), shellExpr(mpi.MetaProgramSHA256), shellExpr(mpi.MetaManifest),
+		shellExpr(mpi.MetaProject))
+}
+
+// parseCrashReport returns the first panic line and the S3 location of the crash
+// report that a rank's script wrote to stderr, if any
+func parseCrashReport(stderr string) (crash, report string) {
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, crashMarker); ok && crash == "" {
+			crash = value
+		}
+		if value, ok := strings.CutPrefix(line, crashReportMarker); ok && report == "" {
+			report = value
+		}
+	}
+	return crash, report
+}
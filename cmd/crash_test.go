@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCrashReport(t *testing.T) {
+	tests := []struct {
+		stderr     string
+		wantCrash  string
+		wantReport string
+	}{
+		{stderr: ""},
+		{stderr: "upload failed: throttled\n"},
+		{
+			stderr:    crashMarker + "panic: runtime error: index out of range [5] with length 3\n",
+			wantCrash: "panic: runtime error: index out of range [5] with length 3",
+		},
+		{
+			stderr:     "noise\n" + crashMarker + "fatal error: concurrent map writes\n" + crashReportMarker + "s3://b/jobs/j/crash/rank-2/\n",
+			wantCrash:  "fatal error: concurrent map writes",
+			wantReport: "s3://b/jobs/j/crash/rank-2/",
+		},
+		{
+			stderr:    crashMarker + "killed by signal 9\n" + crashMarker + "panic: later\n",
+			wantCrash: "killed by signal 9",
+		},
+	}
+
+	for _, tt := range tests {
+		crash, report := parseCrashReport(tt.stderr)
+		if crash != tt.wantCrash || report != tt.wantReport {
+			t.Errorf("parseCrashReport(%q) = %q, %q, want %q, %q", tt.stderr, crash, report, tt.wantCrash, tt.wantReport)
+		}
+	}
+}
+
+// TestRankLaunchCollectsCrash crashes a rank the way a Go panic with GOTRACEBACK=crash
+// does and checks that the script uploads the output and the new core, but no older one
+func TestRankLaunchCollectsCrash(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID = "test-" + filepath.Base(t.TempDir())
+	defer os.RemoveAll(filepath.Dir(rankPIDFile(o.jobID)))
+
+	dir := t.TempDir()
+	old := filepath.Join(dir, "core.1")
+	if err := os.WriteFile(old, []byte("old core"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := t.TempDir()
+	uploads := filepath.Join(bin, "uploads")
+	fakeAWS := "#!/bin/bash\necho \"$3 $4\" >> " + shellQuote(uploads) + "\n"
+	if err := os.WriteFile(filepath.Join(bin, "aws"), []byte(fakeAWS), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	crash := `bash -c 'echo "$GOTRACEBACK" > traceback; echo core > core.2; echo "goroutine 1 [running]:"; echo "panic: boom" >&2; kill -ABRT $$'`
+	cmd := exec.Command("bash", "-c", o.rankLaunch(crash))
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"MPI_BUCKET=staging", "MPI_PROJECT=team-a", "MPI_JOB_ID="+o.jobID, "MPI_RANK=3")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("rank script succeeded after the rank crashed")
+	}
+
+	crashLine, report := parseCrashReport(stderr.String())
+	prefix := "s3://staging/projects/team-a/jobs/" + o.jobID + "/crash/rank-3/"
+	if crashLine != "panic: boom" || report != prefix {
+		t.Errorf("crash report = %q, %q, want %q, %q\nstderr: %s", crashLine, report, "panic: boom", prefix, stderr.String())
+	}
+	data, err := os.ReadFile(uploads)
+	if err != nil {
+		t.Fatalf("nothing was uploaded: %v", err)
+	}
+	// The kernel may add a real core of the crashed shell next to the fake one
+	uploaded := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(uploaded) < 2 || uploaded[0] != "output.txt "+prefix+"output.txt" || !strings.Contains(string(data), "./core.2 "+prefix+"core.2\n") {
+		t.Errorf("uploads =\n%s\nwant output.txt and core.2", data)
+	}
+	if strings.Contains(string(data), "core.1") {
+		t.Errorf("a core from before the run was uploaded:\n%s", data)
+	}
+	if traceback, _ := os.ReadFile(filepath.Join(dir, "traceback")); strings.TrimSpace(string(traceback)) != "crash" {
+		t.Errorf("GOTRACEBACK = %q, want crash", traceback)
+	}
+}
@@ -0,0 +1,520 @@
+// cmd/cron.go
+// This file implements recurring runs. schedule create installs an EventBridge rule
+// that, on a cron schedule, starts a build of a CodeBuild project running awsmpirun
+// --from-manifest with the manifest it was given, which is kept in the staging bucket
+// so the rule only carries a short buildspec. Each run gets the job ID
+// NAME-YYYYMMDD-HHMMSS and keeps its journal in the bucket, which is how jobs list
+// --schedule NAME shows the history. The schedule is written in the five fields of
+// Unix cron and converted to the six-field form EventBridge expects; times are UTC.
+// With --canary-vpc the build runs awsmpirun canary on the VPC instead, publishing its
+// result as CloudWatch metrics rather than keeping a journal.
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// scheduleRulePrefix starts the names of the EventBridge rules schedule create installs
+const scheduleRulePrefix = "awsmpirun-"
+
+// maxRuleName is the longest name EventBridge accepts for a rule
+const maxRuleName = 64
+
+// scheduleTargetID is the ID of the CodeBuild target of a schedule's rule
+const scheduleTargetID = "awsmpirun-run"
+
+var scheduleNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Repeat a run on a cron schedule",
+}
+
+// scheduleOptions are the flags of the schedule commands
+type scheduleOptions struct {
+	name      string
+	cron      string
+	manifest  string
+	codeBuild string
+	roleARN   string
+	bucket    string
+	project   string
+	disabled  bool
+	canaryVPC string
+}
+
+// newScheduleCreateCmd returns schedule create
+func newScheduleCreateCmd() *cobra.Command {
+	o := &scheduleOptions{}
+	cmd := &cobra.Command{
+		Use:   `create --name NAME --cron "0 2 * * *" --manifest job.yaml --codebuild-project NAME --role-arn ARN`,
+		Short: "Install an EventBridge rule that repeats a run on a schedule",
+		Long: `create uploads the manifest to the staging bucket and installs an EventBridge rule
+that starts a build of the CodeBuild project every time the cron expression matches.
+The build downloads the manifest and runs awsmpirun --from-manifest with it, so the
+project's image must have awsmpirun and the AWS CLI on its PATH, and its role needs
+the policies of awsmpirun iam print-policy --for run. --role-arn is the role
+EventBridge starts the builds with; it needs codebuild:StartBuild on the project.
+
+--cron takes the five fields of Unix cron (minute, hour, day of month, month, day of
+week) or @hourly, @daily, @weekly, @monthly, or @yearly, in UTC. EventBridge cannot
+restrict the day of the month and the day of the week at once, so one of them must be
+*. Every run gets the job ID NAME-YYYYMMDD-HHMMSS; jobs list --schedule NAME shows
+them. Creating a schedule that exists replaces it.
+
+With --canary-vpc VPC instead of --manifest the builds run awsmpirun canary on the
+instances of VPC with --metrics, so an alarm on the CanaryFailedRanks metric reports an
+unhealthy cluster; --bucket is then required, and the project's role needs the
+policies of awsmpirun iam print-policy --for run --metrics.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runScheduleCreate(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.name, "name", "", "Name of the schedule, which starts the job IDs of its runs (required)")
+	cmd.Flags().StringVar(&o.cron, "cron", "", "When to run, as a Unix cron expression in UTC (required)")
+	cmd.Flags().StringVar(&o.manifest, "manifest", "", "Run manifest (job.yaml) to repeat")
+	cmd.Flags().StringVar(&o.canaryVPC, "canary-vpc", "", "Repeat awsmpirun canary on this VPC instead of a manifest")
+	cmd.Flags().StringVar(&o.codeBuild, "codebuild-project", "", "Name or ARN of the CodeBuild project the runs start from (required)")
+	cmd.Flags().StringVar(&o.roleARN, "role-arn", "", "Role EventBridge assumes to start the builds (required)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Bucket the manifest and the runs' journals are kept in (default: the manifest's --bucket)")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the runs (default: the manifest's project)")
+	cmd.Flags().BoolVar(&o.disabled, "disabled", false, "Install the rule disabled, to be enabled later")
+	for _, flag := range []string{"name", "cron", "codebuild-project", "role-arn"} {
+		cmd.MarkFlagRequired(flag)
+	}
+	return cmd
+}
+
+// newScheduleListCmd returns schedule list
+func newScheduleListCmd() *cobra.Command {
+	o := &scheduleOptions{}
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the schedules of the project",
+		Run: func(cmd *cobra.Command, args []string) {
+			runScheduleList(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the schedules (default: project in config.yaml)")
+	return cmd
+}
+
+// newScheduleDeleteCmd returns schedule delete
+func newScheduleDeleteCmd() *cobra.Command {
+	o := &scheduleOptions{}
+	cmd := &cobra.Command{
+		Use:   "delete --name NAME",
+		Short: "Delete a schedule; runs already started are left alone",
+		Run: func(cmd *cobra.Command, args []string) {
+			runScheduleDelete(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.name, "name", "", "Name of the schedule (required)")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the schedule (default: project in config.yaml)")
+	cmd.MarkFlagRequired("name")
+	return cmd
+}
+
+func init() {
+	scheduleCmd.AddCommand(newScheduleCreateCmd(), newScheduleListCmd(), newScheduleDeleteCmd())
+	rootCmd.AddCommand(scheduleCmd)
+}
+
+func runScheduleCreate(ctx context.Context, o *scheduleOptions) {
+	if (o.manifest == "") == (o.canaryVPC == "") {
+		fmt.Println("Error: pass one of --manifest and --canary-vpc")
+		os.Exit(1)
+	}
+	// A canary has no manifest to upload; its builds only need the VPC and the bucket
+	var data []byte
+	projectName, bucket := o.project, o.bucket
+	description := fmt.Sprintf("awsmpirun canary of %s", o.canaryVPC)
+	if o.manifest != "" {
+		var err error
+		data, err = os.ReadFile(o.manifest)
+		if err != nil {
+			fmt.Printf("Error reading manifest: %v\n", err)
+			os.Exit(1)
+		}
+		d, err := parseRunDescriptor(data)
+		if err != nil {
+			fmt.Printf("Error parsing manifest %s: %v\n", o.manifest, err)
+			os.Exit(1)
+		}
+		projectName = cmp.Or(o.project, d.Project)
+		bucket = cmp.Or(o.bucket, d.Options.Bucket)
+		description = fmt.Sprintf("awsmpirun run of %q on %d instances", d.Program.Command, len(d.Cluster.Instances))
+	}
+	project, err := resolveProject(projectName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	rule, err := scheduleRuleName(project, o.name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	expression, err := eventBridgeCron(o.cron)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if bucket == "" && data == nil {
+		fmt.Println("Error: --canary-vpc needs --bucket to stage the canary in")
+		os.Exit(1)
+	}
+	if bucket == "" {
+		fmt.Println("Error: the manifest has no bucket; pass --bucket for the manifest and the runs' journals")
+		os.Exit(1)
+	}
+	if err := validateBucketName(bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	events, err := awsManager.NewEventsClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EventBridge client: %v\n", err)
+		os.Exit(1)
+	}
+	projectARN, err := codeBuildProjectARN(o.codeBuild, o.roleARN, events.Region())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	key := scheduleManifestKey(project, o.name)
+	var spec string
+	if data != nil {
+		spec, err = scheduleBuildspec(bucket, key, project, o.name)
+	} else {
+		spec, err = scheduleCanaryBuildspec(bucket, project, o.canaryVPC)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	input, err := json.Marshal(map[string]string{"buildspecOverride": spec})
+	if err != nil {
+		fmt.Printf("Error encoding the target input: %v\n", err)
+		os.Exit(1)
+	}
+
+	if data != nil {
+		s3Client, err := awsManager.NewS3Client(ctx, bucket)
+		if err != nil {
+			fmt.Printf("Error creating S3 client: %v\n", err)
+			os.Exit(1)
+		}
+		if err := s3Client.UploadBytes(ctx, data, key); err != nil {
+			fmt.Printf("Error uploading the manifest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	state := "ENABLED"
+	if o.disabled {
+		state = "DISABLED"
+	}
+	if len(description) > 512 {
+		description = description[:512]
+	}
+	if _, err := events.PutRule(ctx, awsManager.EventRule{
+		Name:               rule,
+		ScheduleExpression: expression,
+		State:              state,
+		Description:        description,
+	}, map[string]string{projectTagKey: project}); err != nil {
+		fmt.Printf("Error creating rule %s: %v\n", rule, err)
+		os.Exit(1)
+	}
+	if err := events.PutTargets(ctx, rule, []awsManager.EventTarget{{
+		ID:      scheduleTargetID,
+		Arn:     projectARN,
+		RoleArn: o.roleARN,
+		Input:   string(input),
+	}}); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Scheduled %s at %s (UTC) in rule %s\n", o.name, expression, rule)
+	if data == nil {
+		fmt.Printf("Its results are published as the CanaryFailedRanks metric in CloudWatch namespace %s\n", metricsNamespace)
+		return
+	}
+	fmt.Printf("Show its runs with: awsmpirun jobs list --bucket %s --project %s --schedule %s\n", bucket, project, o.name)
+}
+
+func runScheduleList(ctx context.Context, o *scheduleOptions) {
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	events, err := awsManager.NewEventsClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EventBridge client: %v\n", err)
+		os.Exit(1)
+	}
+	prefix := scheduleRulePrefix + project + "-"
+	rules, err := events.ListRules(ctx, prefix)
+	if err != nil {
+		fmt.Printf("Error listing schedules: %v\n", err)
+		os.Exit(1)
+	}
+	if len(rules) == 0 {
+		fmt.Printf("Project %s has no schedules\n", project)
+		return
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tSCHEDULE\tSTATE\tDESCRIPTION")
+	for _, rule := range rules {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", strings.TrimPrefix(rule.Name, prefix), rule.ScheduleExpression, rule.State, rule.Description)
+	}
+	table.Flush()
+}
+
+func runScheduleDelete(ctx context.Context, o *scheduleOptions) {
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	rule, err := scheduleRuleName(project, o.name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	events, err := awsManager.NewEventsClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EventBridge client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := events.DeleteRule(ctx, rule); err != nil {
+		fmt.Printf("Error deleting schedule %s: %v\n", o.name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Deleted schedule %s\n", o.name)
+}
+
+// scheduleRuleName returns the name of the rule of schedule name in project
+func scheduleRuleName(project, name string) (string, error) {
+	if !scheduleNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid schedule name %q: use lower case letters, digits, and '-'", name)
+	}
+	rule := scheduleRulePrefix + project + "-" + name
+	if len(rule) > maxRuleName {
+		return "", fmt.Errorf("schedule name %q is too long: the rule name %s must be at most %d characters", name, rule, maxRuleName)
+	}
+	return rule, nil
+}
+
+// scheduleManifestKey is the S3 key the manifest of a schedule is kept at
+func scheduleManifestKey(project, name string) string {
+	return fmt.Sprintf("projects/%s/schedules/%s/job.yaml", project, name)
+}
+
+// codeBuildProjectARN returns the ARN of project, which may already be one. A name is
+// looked up in the account and partition of role, the role the rule starts it with.
+func codeBuildProjectARN(project, role, region string) (string, error) {
+	if strings.HasPrefix(project, "arn:") {
+		return project, nil
+	}
+	// arn:PARTITION:iam::ACCOUNT:role/NAME
+	parts := strings.SplitN(role, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || parts[4] == "" || !strings.HasPrefix(parts[5], "role/") {
+		return "", fmt.Errorf("invalid --role-arn %q: expected arn:aws:iam::ACCOUNT:role/NAME", role)
+	}
+	return fmt.Sprintf("arn:%s:codebuild:%s:%s:project/%s", parts[1], region, parts[4], project), nil
+}
+
+// scheduleBuildspec returns the buildspec of a scheduled run: it downloads the manifest
+// from bucket and repeats it under a job ID made of the schedule name and the start time
+func scheduleBuildspec(bucket, key, project, name string) (string, error) {
+	var spec codeBuildSpec
+	spec.Version = "0.2"
+	spec.Env.Variables = map[string]string{
+		"XDG_CONFIG_HOME": sfnConfigHome,
+		"MANIFEST_URI":    fmt.Sprintf("s3://%s/%s", bucket, key),
+		"SCHEDULE":        name,
+	}
+	spec.Phases.Build.Commands = []string{
+		`aws s3 cp "$MANIFEST_URI" job.yaml --only-show-errors`,
+		shellf(`awsmpirun --from-manifest job.yaml --bucket %s --project %s --job-id "$SCHEDULE-$(date -u +%%Y%%m%%d-%%H%%M%%S)"`, bucket, project),
+	}
+	out, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to render buildspec: %v", err)
+	}
+	return string(out), nil
+}
+
+// scheduleCanaryBuildspec returns the buildspec of a scheduled canary of vpc, which
+// publishes its result as CloudWatch metrics
+func scheduleCanaryBuildspec(bucket, project, vpc string) (string, error) {
+	var spec codeBuildSpec
+	spec.Version = "0.2"
+	spec.Env.Variables = map[string]string{"XDG_CONFIG_HOME": sfnConfigHome}
+	spec.Phases.Build.Commands = []string{
+		shellf("awsmpirun canary --vpc %s --bucket %s --project %s --metrics", vpc, bucket, project),
+	}
+	out, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to render buildspec: %v", err)
+	}
+	return string(out), nil
+}
+
+// scheduledJobPattern matches the job IDs of the runs of schedule name
+func scheduledJobPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `-[0-9]{8}-[0-9]{6}$`)
+}
+
+// cronMacros are the shorthands of Unix cron
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronField is one field of a Unix cron expression
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // Names of the values from min, if the field has any
+}
+
+var (
+	cronMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	cronDays   = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	cronFields = [5]cronField{
+		{"minute", 0, 59, nil},
+		{"hour", 0, 23, nil},
+		{"day of month", 1, 31, nil},
+		{"month", 1, 12, cronMonths},
+		{"day of week", 0, 7, cronDays}, // 0 and 7 are both Sunday
+	}
+)
+
+// eventBridgeCron converts a Unix cron expression to an EventBridge schedule
+// expression, cron(MIN HOUR DOM MONTH DOW YEAR). EventBridge numbers the days of the
+// week from 1, Sunday, so they are converted to names, and wants ? in whichever of
+// the two day fields is not restricted.
+func eventBridgeCron(expr string) (string, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		macro, ok := cronMacros[fields[0]]
+		if !ok {
+			return "", fmt.Errorf("invalid cron expression %q: unknown shorthand", expr)
+		}
+		fields = strings.Fields(macro)
+	}
+	if len(fields) != 5 {
+		return "", fmt.Errorf("invalid cron expression %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", expr, len(fields))
+	}
+	out := make([]string, 5)
+	for i, field := range cronFields {
+		values, text, err := field.parse(fields[i])
+		if err != nil {
+			return "", fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+		out[i] = text
+		if i == 4 && fields[i] != "*" {
+			out[i] = dayNames(values)
+		}
+	}
+	switch {
+	case fields[2] != "*" && fields[4] != "*":
+		return "", fmt.Errorf("invalid cron expression %q: EventBridge cannot restrict both the day of the month and the day of the week; set one of them to *", expr)
+	case fields[4] == "*":
+		out[4] = "?"
+	default:
+		out[2] = "?"
+	}
+	return fmt.Sprintf("cron(%s *)", strings.Join(out, " ")), nil
+}
+
+// parse returns the values the field text selects, and the text in the form
+// EventBridge accepts, which writes */N as MIN/N
+func (f cronField) parse(text string) (map[int]bool, string, error) {
+	values := make(map[int]bool)
+	items := strings.Split(text, ",")
+	for i, item := range items {
+		span, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return nil, "", fmt.Errorf("invalid step %q in the %s field", stepText, f.name)
+			}
+			step = n
+		}
+		low, high := f.min, f.max
+		if span != "*" {
+			lowText, highText, isRange := strings.Cut(span, "-")
+			var err error
+			if low, err = f.value(lowText); err != nil {
+				return nil, "", err
+			}
+			high = low
+			if isRange {
+				if high, err = f.value(highText); err != nil {
+					return nil, "", err
+				}
+				if high < low {
+					return nil, "", fmt.Errorf("range %q runs backwards in the %s field", span, f.name)
+				}
+			} else if hasStep {
+				high = f.max
+			}
+		} else if hasStep {
+			items[i] = strconv.Itoa(f.min) + "/" + stepText
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, strings.ToUpper(strings.Join(items, ",")), nil
+}
+
+// value parses one number or name of the field
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value %q in the %s field: expected %d-%d", text, f.name, f.min, f.max)
+	}
+	return n, nil
+}
+
+// dayNames lists the days of week, numbered from Sunday as 0 or 7, by name
+func dayNames(days map[int]bool) string {
+	var names []string
+	for i, name := range cronDays {
+		if days[i] || i == 0 && days[7] {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
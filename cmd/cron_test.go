@@ -0,0 +1,155 @@
+// cmd/cron_test.go
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestEventBridgeCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr string
+	}{
+		{expr: "0 2 * * *", want: "cron(0 2 * * ? *)"},
+		{expr: "*/15 * * * *", want: "cron(0/15 * * * ? *)"},
+		{expr: "30 6 1,15 * *", want: "cron(30 6 1,15 * ? *)"},
+		{expr: "0 0 */2 jan-mar *", want: "cron(0 0 1/2 JAN-MAR ? *)"},
+		{expr: "0 22 * * 1-5", want: "cron(0 22 ? * MON,TUE,WED,THU,FRI *)"},
+		{expr: "0 3 * * 0", want: "cron(0 3 ? * SUN *)"},
+		{expr: "0 3 * * 5-7", want: "cron(0 3 ? * SUN,FRI,SAT *)"},
+		{expr: "0 3 * * sat,SUN", want: "cron(0 3 ? * SUN,SAT *)"},
+		{expr: "0 3 * * */2", want: "cron(0 3 ? * SUN,TUE,THU,SAT *)"},
+		{expr: "@daily", want: "cron(0 0 * * ? *)"},
+		{expr: "@weekly", want: "cron(0 0 ? * SUN *)"},
+		{expr: "  0   2 * *   * ", want: "cron(0 2 * * ? *)"},
+		{expr: "0 2 * *", wantErr: "expected 5 fields"},
+		{expr: "@often", wantErr: "unknown shorthand"},
+		{expr: "60 2 * * *", wantErr: `invalid value "60" in the minute field`},
+		{expr: "0 2 0 * *", wantErr: "day of month field: expected 1-31"},
+		{expr: "0 2 * * 8", wantErr: "day of week field"},
+		{expr: "0 2 * foo *", wantErr: `invalid value "foo" in the month field`},
+		{expr: "0 5-2 * * *", wantErr: "runs backwards"},
+		{expr: "*/0 * * * *", wantErr: "invalid step"},
+		{expr: "0 2 1 * 1", wantErr: "cannot restrict both"},
+	}
+	for _, tt := range tests {
+		got, err := eventBridgeCron(tt.expr)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got %q, %v; want error containing %q", tt.expr, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleRuleName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "nightly", want: "awsmpirun-team-a-nightly"},
+		{name: "weekly-2", want: "awsmpirun-team-a-weekly-2"},
+		{name: "Nightly", wantErr: true},
+		{name: "-x", wantErr: true},
+		{name: "", wantErr: true},
+		{name: strings.Repeat("a", 48), want: "awsmpirun-team-a-" + strings.Repeat("a", 47), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := scheduleRuleName("team-a", tt.name)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("%q: got %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCodeBuildProjectARN(t *testing.T) {
+	tests := []struct {
+		project string
+		role    string
+		want    string
+		wantErr bool
+	}{
+		{project: "runner", role: "arn:aws:iam::123456789012:role/events-runner", want: "arn:aws:codebuild:us-west-2:123456789012:project/runner"},
+		{project: "runner", role: "arn:aws-cn:iam::123456789012:role/ci/runner", want: "arn:aws-cn:codebuild:us-west-2:123456789012:project/runner"},
+		{project: "arn:aws:codebuild:eu-west-1:1:project/x", role: "anything", want: "arn:aws:codebuild:eu-west-1:1:project/x"},
+		{project: "runner", role: "events-runner", wantErr: true},
+		{project: "runner", role: "arn:aws:iam::123456789012:user/me", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := codeBuildProjectARN(tt.project, tt.role, "us-west-2")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s with %s: got %q, %v; want %q", tt.project, tt.role, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleBuildspec(t *testing.T) {
+	out, err := scheduleBuildspec("my-bucket", scheduleManifestKey("team-a", "nightly"), "team-a", "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec codeBuildSpec
+	if err := yaml.Unmarshal([]byte(out), &spec); err != nil {
+		t.Fatalf("invalid buildspec: %v\n%s", err, out)
+	}
+	if got := spec.Env.Variables["MANIFEST_URI"]; got != "s3://my-bucket/projects/team-a/schedules/nightly/job.yaml" {
+		t.Errorf("MANIFEST_URI = %q", got)
+	}
+	want := []string{
+		`aws s3 cp "$MANIFEST_URI" job.yaml --only-show-errors`,
+		`awsmpirun --from-manifest job.yaml --bucket 'my-bucket' --project 'team-a' --job-id "$SCHEDULE-$(date -u +%Y%m%d-%H%M%S)"`,
+	}
+	if strings.Join(spec.Phases.Build.Commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(spec.Phases.Build.Commands, "\n"), strings.Join(want, "\n"))
+	}
+	if strings.Contains(out, "finally") {
+		t.Errorf("buildspec has an empty finally:\n%s", out)
+	}
+}
+
+func TestScheduledJobPattern(t *testing.T) {
+	pattern := scheduledJobPattern("nightly")
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"nightly-20261014-020000", true},
+		{"nightly-b-20261014-020000", false},
+		{"nightly-20261014", false},
+		{"job-20261014-020000-abcdef", false},
+		{"xnightly-20261014-020000", false},
+	}
+	for _, tt := range tests {
+		if got := pattern.MatchString(tt.id); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleCanaryBuildspec(t *testing.T) {
+	out, err := scheduleCanaryBuildspec("my-bucket", "team-a", "vpc-0abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec codeBuildSpec
+	if err := yaml.Unmarshal([]byte(out), &spec); err != nil {
+		t.Fatalf("invalid buildspec: %v\n%s", err, out)
+	}
+	want := []string{`awsmpirun canary --vpc 'vpc-0abc' --bucket 'my-bucket' --project 'team-a' --metrics`}
+	if strings.Join(spec.Phases.Build.Commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(spec.Phases.Build.Commands, "\n"), strings.Join(want, "\n"))
+	}
+	if spec.Env.Variables["XDG_CONFIG_HOME"] != sfnConfigHome {
+		t.Errorf("XDG_CONFIG_HOME = %q", spec.Env.Variables["XDG_CONFIG_HOME"])
+	}
+}
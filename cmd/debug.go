@@ -0,0 +1,106 @@
+// cmd/debug.go
+// This file implements --debug-rank, which runs one rank under Delve in headless mode.
+// Delve holds the program before main until a client connects and continues it, so the
+// other ranks wait in mpi.Init, whose connect timeout is raised to --debug-wait. As soon
+// as the job is started, awsmpirun opens an SSM tunnel to the Delve port on that rank's
+// instance and prints the address to connect a debugger to. The program should be built
+// with -gcflags=all="-N -l", and dlv must be on the PATH of the SSM agent on the instances.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// defaultDebugPort is the port Delve listens on, on the instance's loopback interface
+const defaultDebugPort = 2345
+
+// debugUnsafeChars are shell syntax that --exec must not use with --debug-rank, because
+// the command is split into a program and its arguments for dlv exec
+const debugUnsafeChars = ";|&<>()`'\"\\*?[#~"
+
+// validateDebugOptions checks --debug-rank and its command against the job size
+func (o *runOptions) validateDebugOptions(command string, size int) error {
+	if o.debugRank < 0 {
+		return nil
+	}
+	if o.debugRank >= size {
+		return fmt.Errorf("--debug-rank %d is not part of a job of %d ranks", o.debugRank, size)
+	}
+	if o.debugWait <= 0 {
+		return fmt.Errorf("--debug-wait must be positive")
+	}
+	if o.debugPort <= 0 || o.debugPort > 65535 {
+		return fmt.Errorf("--debug-port must be a port number, got %d", o.debugPort)
+	}
+	_, _, err := splitDebugCommand(command)
+	return err
+}
+
+// splitDebugCommand splits a plain "program arg..." command into the program and its
+// arguments. Placeholders and $VARIABLES are kept for the shell to expand.
+func splitDebugCommand(command string) (string, []string, error) {
+	if i := strings.IndexAny(command, debugUnsafeChars); i >= 0 {
+		return "", nil, fmt.Errorf("--debug-rank needs --exec to be a program and its arguments, without shell syntax such as %q", command[i])
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("--debug-rank needs a program to run")
+	}
+	return fields[0], fields[1:], nil
+}
+
+// debugLaunch returns the command every rank runs: the debugged rank starts the program
+// under dlv exec, the others start it as usual
+func (o *runOptions) debugLaunch(command string) string {
+	if o.debugRank < 0 {
+		return command
+	}
+	program, args, err := splitDebugCommand(command)
+	if err != nil {
+		// validateDebugOptions rejected this command before any script was built
+		panic(err)
+	}
+	dlv := fmt.Sprintf("dlv exec --headless --listen=127.0.0.1:%d --api-version=2 --accept-multiclient %s", o.debugPort, program)
+	if len(args) > 0 {
+		dlv += " -- " + strings.Join(args, " ")
+	}
+	return fmt.Sprintf(`if [ "$MPI_RANK" = %d ]; then
+%s
+else
+%s
+fi`, o.debugRank, dlv, command)
+}
+
+// debugConnectTimeout returns how long Init waits for peers, which with --debug-rank
+// includes the time until the debugger continues the program
+func (o *runOptions) debugConnectTimeout() time.Duration {
+	if o.debugRank < 0 {
+		return o.connectTimeout
+	}
+	return max(o.connectTimeout, o.debugWait)
+}
+
+// openDebugTunnel forwards a local port to Delve on the debugged rank's instance
+func (o *runOptions) openDebugTunnel(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) (*portForward, error) {
+	for _, instance := range instances {
+		if instance.InstanceRank != o.debugRank {
+			continue
+		}
+		tunnel, err := startPortForward(ctx, ssmClient, instance.InstanceID, o.debugPort, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open a tunnel to the debugger of rank %d: %v", o.debugRank, err)
+		}
+		fmt.Printf("Rank %d on %s is waiting for a debugger; the other ranks wait in mpi.Init for up to %v.\n", o.debugRank, instance.InstanceID, o.debugWait)
+		fmt.Printf("Connect with: dlv connect %s\n", tunnel.LocalAddress())
+		return tunnel, nil
+	}
+	return nil, fmt.Errorf("rank %d has no instance", o.debugRank)
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitDebugCommand(t *testing.T) {
+	tests := []struct {
+		command     string
+		wantProgram string
+		wantArgs    []string
+		wantErr     bool
+	}{
+		{command: "./solver", wantProgram: "./solver", wantArgs: []string{}},
+		{command: "  ./solver  --rank {rank} --out $MPI_WORK_DIR/out ", wantProgram: "./solver", wantArgs: []string{"--rank", "{rank}", "--out", "$MPI_WORK_DIR/out"}},
+		{command: "", wantErr: true},
+		{command: "cd /data && ./solver", wantErr: true},
+		{command: "./solver > log", wantErr: true},
+		{command: "./solver 'two words'", wantErr: true},
+		{command: "./solver $(hostname)", wantErr: true},
+		{command: "./solver *.dat", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		program, args, err := splitDebugCommand(tt.command)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitDebugCommand(%q) error = %v, wantErr %v", tt.command, err, tt.wantErr)
+			continue
+		}
+		if program != tt.wantProgram || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("splitDebugCommand(%q) = %q, %q, want %q, %q", tt.command, program, args, tt.wantProgram, tt.wantArgs)
+		}
+	}
+}
+
+func TestValidateDebugOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		rank    int
+		port    int
+		wait    time.Duration
+		command string
+		wantErr string
+	}{
+		{name: "off", rank: -1, port: defaultDebugPort, wait: time.Minute, command: "cd x && ./a"},
+		{name: "rank 0", rank: 0, port: defaultDebugPort, wait: time.Minute, command: "./a"},
+		{name: "last rank", rank: 3, port: 40000, wait: time.Minute, command: "./a -n {size}"},
+		{name: "outside the job", rank: 4, port: defaultDebugPort, wait: time.Minute, command: "./a", wantErr: "not part of a job of 4"},
+		{name: "no wait", rank: 1, port: defaultDebugPort, command: "./a", wantErr: "--debug-wait"},
+		{name: "bad port", rank: 1, port: 0, wait: time.Minute, command: "./a", wantErr: "--debug-port"},
+		{name: "shell command", rank: 1, port: defaultDebugPort, wait: time.Minute, command: "./a | tee log", wantErr: "shell syntax"},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.debugRank, o.debugPort, o.debugWait = tt.rank, tt.port, tt.wait
+		err := o.validateDebugOptions(tt.command, 4)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDebugConnectTimeout(t *testing.T) {
+	tests := []struct {
+		rank    int
+		wait    time.Duration
+		connect time.Duration
+		want    time.Duration
+	}{
+		{rank: -1, wait: time.Hour, want: 0},
+		{rank: -1, wait: time.Hour, connect: time.Minute, want: time.Minute},
+		{rank: 2, wait: time.Hour, want: time.Hour},
+		{rank: 2, wait: time.Hour, connect: 2 * time.Hour, want: 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.debugRank, o.debugWait, o.connectTimeout = tt.rank, tt.wait, tt.connect
+		if got := o.debugConnectTimeout(); got != tt.want {
+			t.Errorf("rank %d, wait %v, connect %v: timeout = %v, want %v", tt.rank, tt.wait, tt.connect, got, tt.want)
+		}
+	}
+}
+
+// TestDebugLaunch runs the launch command on both sides of the rank check, with a fake
+// dlv that prints how it was called
+func TestDebugLaunch(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.debugRank, o.debugPort = 1, 2345
+
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "dlv"), []byte("#!/bin/bash\necho dlv \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "solver"), []byte("#!/bin/bash\necho solver \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	command := expandCommand(o.debugLaunch("solver --rank {rank} --of {size}"))
+
+	tests := []struct {
+		rank string
+		want string
+	}{
+		{rank: "0", want: "solver --rank 0 --of 3"},
+		{rank: "1", want: "dlv exec --headless --listen=127.0.0.1:2345 --api-version=2 --accept-multiclient solver -- --rank 1 --of 3"},
+		{rank: "2", want: "solver --rank 2 --of 3"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("bash", "-c", command)
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "MPI_RANK="+tt.rank, "MPI_SIZE=3")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("rank %s: %v\n%s", tt.rank, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("rank %s ran %q, want %q", tt.rank, got, tt.want)
+		}
+	}
+
+	o.debugRank = -1
+	if got := o.debugLaunch("cd /data && ./solver"); got != "cd /data && ./solver" {
+		t.Errorf("debugLaunch without --debug-rank = %q", got)
+	}
+}
@@ -0,0 +1,539 @@
+// cmd/descriptor.go
+// This file implements run manifests: a job.yaml written for every run that records
+// everything needed to repeat it, namely the command and the sha256 of the program it
+// starts, the run options and extra environment, the seed, the instances with their
+// type and AMI, the region, and the awsmpirun version. It is saved under the local
+// configuration directory and, with --bucket, next to the job's other files in S3.
+//
+//	awsmpirun --from-manifest job.yaml
+//
+// repeats the run on the same instances with the same options and seed, and every rank
+// refuses to start a program whose sha256 differs from the recorded one. Flags given as
+// well override the manifest.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// programHashMarker prefixes the stdout line in which a rank's script reports the
+// sha256 of the program it starts
+const programHashMarker = "awsmpirun-program-sha256: "
+
+// runDescriptorVersion is the format version of job.yaml
+const runDescriptorVersion = 1
+
+// runDescriptor is the content of job.yaml
+type runDescriptor struct {
+	Version int            `yaml:"version"`
+	JobID   string         `yaml:"job_id"`
+	Project string         `yaml:"project,omitempty"`
+	Created string         `yaml:"created"`
+	Tool    toolInfo       `yaml:"tool"`
+	Region  string         `yaml:"region"`
+	Cluster clusterSpec    `yaml:"cluster"`
+	Program programSpec    `yaml:"program"`
+	Options runOptionsSpec `yaml:"options"`
+}
+
+type toolInfo struct {
+	Version   string `yaml:"version"`
+	Revision  string `yaml:"revision,omitempty"`
+	GoVersion string `yaml:"go_version"`
+}
+
+type clusterSpec struct {
+	VPC       string            `yaml:"vpc"`
+	Instances []instanceRecord  `yaml:"instances"`
+	Zones     map[string]string `yaml:"zones,omitempty"` // The ranks in each availability zone, as "0-3,8"
+}
+
+type instanceRecord struct {
+	Rank         int    `yaml:"rank"`
+	InstanceID   string `yaml:"instance_id"`
+	PrivateIP    string `yaml:"private_ip"`
+	InstanceType string `yaml:"instance_type,omitempty"`
+	ImageID      string `yaml:"ami,omitempty"`
+
+	AvailabilityZone string `yaml:"az,omitempty"`
+	PlacementGroup   string `yaml:"placement_group,omitempty"`
+	Lifecycle        string `yaml:"lifecycle,omitempty"`
+}
+
+type programSpec struct {
+	Command      string `yaml:"command"`
+	SHA256       string `yaml:"sha256,omitempty"`
+	Launcher     string `yaml:"launcher"`
+	WorkDir      string `yaml:"work_dir,omitempty"`
+	SlotsPerNode int    `yaml:"slots_per_node,omitempty"`
+
+	Git *gitSourceSpec `yaml:"git,omitempty"`
+}
+
+// gitSourceSpec is the Git source a run checked out, see gitsource.go
+type gitSourceSpec struct {
+	URL    string `yaml:"url"`
+	Ref    string `yaml:"ref,omitempty"`
+	Commit string `yaml:"commit"` // What Ref resolved to when the run started
+	Secret string `yaml:"secret,omitempty"`
+}
+
+type runOptionsSpec struct {
+	Seed               uint64   `yaml:"seed"`
+	Env                []string `yaml:"env,omitempty"`
+	Bucket             string   `yaml:"bucket,omitempty"`
+	KVTable            string   `yaml:"kv_table,omitempty"`
+	Chaos              string   `yaml:"chaos,omitempty"`
+	MinRanks           int      `yaml:"min_ranks,omitempty"`
+	ConnectConcurrency int      `yaml:"connect_concurrency,omitempty"`
+	ConnectTimeout     string   `yaml:"connect_timeout,omitempty"`
+	ConnectStagger     string   `yaml:"connect_stagger,omitempty"`
+	Transport          string   `yaml:"transport,omitempty"`
+	EagerLimit         string   `yaml:"eager_limit,omitempty"`       // Empty for the runtime default
+	ReconnectTimeout   string   `yaml:"reconnect_timeout,omitempty"` // Empty for the runtime default
+	CollectiveTimeout  string   `yaml:"collective_timeout,omitempty"`
+	TimeoutPolicy      string   `yaml:"timeout_policy,omitempty"`
+	MaxBandwidth       string   `yaml:"max_bandwidth_per_rank,omitempty"`
+	Broadcast          string   `yaml:"broadcast,omitempty"`
+	MaxClockSkew       string   `yaml:"max_clock_skew,omitempty"`
+	EncryptPayloads    bool     `yaml:"encrypt_payloads,omitempty"`
+	CheckNetwork       bool     `yaml:"check_network,omitempty"`
+	JobSecurityGroup   bool     `yaml:"job_security_group,omitempty"`
+	Metrics            bool     `yaml:"metrics,omitempty"`
+	PprofPort          int      `yaml:"pprof_port,omitempty"`
+	LogLevel           string   `yaml:"log_level,omitempty"`
+	LogRate            string   `yaml:"log_rate,omitempty"`
+	GoMaxProcs         string   `yaml:"gomaxprocs,omitempty"` // Empty when derived per instance
+	GOGC               string   `yaml:"gogc,omitempty"`
+	GoMemLimit         string   `yaml:"gomemlimit,omitempty"`
+	Require            []string `yaml:"require,omitempty"`
+	MaxInstancesPerAZ  int      `yaml:"max_instances_per_az,omitempty"`
+	MaxSpawnRanks      int      `yaml:"max_spawn_ranks,omitempty"`
+}
+
+// runDescriptorKey is the S3 key of a job's run manifest
+func runDescriptorKey(project, jobID string) string {
+	return mpi.RunManifestKey(project, jobID)
+}
+
+// currentToolInfo describes this awsmpirun binary
+func currentToolInfo() toolInfo {
+	info := toolInfo{Version: "(devel)"}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Version = build.Main.Version
+	info.GoVersion = build.GoVersion
+	for _, setting := range build.Settings {
+		if setting.Key == "vcs.revision" {
+			info.Revision = setting.Value
+		}
+	}
+	return info
+}
+
+// newRunDescriptor records the current run on instances, whose program had sha256 programHash
+func (o *runOptions) newRunDescriptor(instances []awsManager.InstanceInfo, region, programHash string) *runDescriptor {
+	d := &runDescriptor{
+		Version: runDescriptorVersion,
+		JobID:   o.jobID,
+		Project: o.project,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Tool:    currentToolInfo(),
+		Region:  region,
+		Cluster: clusterSpec{VPC: o.vpcID},
+		Program: programSpec{
+			Command:  o.executablePath,
+			SHA256:   programHash,
+			Launcher: o.launcher,
+			WorkDir:  o.workDir,
+			Git:      o.git.spec(),
+		},
+		Options: runOptionsSpec{
+			Seed:               o.jobSeed,
+			Env:                o.extraEnv,
+			Bucket:             o.bucket,
+			KVTable:            o.kvTable,
+			Chaos:              o.chaosSpec,
+			MinRanks:           o.minRanks,
+			ConnectConcurrency: o.connectConcurrency,
+			Transport:          o.transport,
+			TimeoutPolicy:      o.timeoutPolicy,
+			MaxBandwidth:       o.maxBandwidth,
+			Broadcast:          o.broadcast,
+			EncryptPayloads:    o.encryptPayloads,
+			CheckNetwork:       o.checkNetwork,
+			JobSecurityGroup:   o.jobSecurityGroup,
+			Metrics:            o.metrics,
+			PprofPort:          o.pprofPort,
+			LogLevel:           o.logLevel,
+			LogRate:            o.logRate,
+			GoMaxProcs:         o.goMaxProcs,
+			GOGC:               o.goGC,
+			GoMemLimit:         o.goMemLimit,
+			Require:            o.requirements,
+			MaxInstancesPerAZ:  o.maxPerAZ,
+			MaxSpawnRanks:      o.maxSpawnRanks,
+		},
+	}
+	if o.launcher != launcherNative {
+		d.Program.SlotsPerNode = o.slotsPerNode
+	}
+	if o.connectTimeout > 0 {
+		d.Options.ConnectTimeout = o.connectTimeout.String()
+	}
+	if o.connectStagger > 0 {
+		d.Options.ConnectStagger = o.connectStagger.String()
+	}
+	if o.maxClockSkew > 0 {
+		d.Options.MaxClockSkew = o.maxClockSkew.String()
+	}
+	if o.collectiveTimeout > 0 {
+		d.Options.CollectiveTimeout = o.collectiveTimeout.String()
+	}
+	if o.eagerLimit >= 0 {
+		d.Options.EagerLimit = strconv.Itoa(o.eagerLimit)
+	}
+	if o.reconnectTimeout >= 0 {
+		d.Options.ReconnectTimeout = o.reconnectTimeout.String()
+	}
+	for _, instance := range instances {
+		d.Cluster.Instances = append(d.Cluster.Instances, instanceRecord{
+			Rank:         instance.InstanceRank,
+			InstanceID:   instance.InstanceID,
+			PrivateIP:    instance.PrivateIP,
+			InstanceType: instance.InstanceType,
+			ImageID:      instance.ImageID,
+
+			AvailabilityZone: instance.AvailabilityZone,
+			PlacementGroup:   instance.PlacementGroup,
+			Lifecycle:        instance.Lifecycle,
+		})
+	}
+	zoneRanks := make(map[string][]int)
+	for _, instance := range instances {
+		if instance.AvailabilityZone != "" {
+			zoneRanks[instance.AvailabilityZone] = append(zoneRanks[instance.AvailabilityZone], instance.InstanceRank)
+		}
+	}
+	for zone, ranks := range zoneRanks {
+		if d.Cluster.Zones == nil {
+			d.Cluster.Zones = make(map[string]string)
+		}
+		d.Cluster.Zones[zone] = rankRanges(ranks)
+	}
+	return d
+}
+
+func parseRunDescriptor(data []byte) (*runDescriptor, error) {
+	var d runDescriptor
+	if err := yaml.UnmarshalStrict(data, &d); err != nil {
+		return nil, err
+	}
+	if d.Version != runDescriptorVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", d.Version)
+	}
+	if d.Cluster.VPC == "" || d.Program.Command == "" {
+		return nil, fmt.Errorf("manifest has no VPC or command")
+	}
+	for i, instance := range d.Cluster.Instances {
+		if instance.Rank != i {
+			return nil, fmt.Errorf("instance %d of the manifest has rank %d", i, instance.Rank)
+		}
+	}
+	return &d, nil
+}
+
+// descriptorInstances returns the ranked instances a manifest records
+func descriptorInstances(d *runDescriptor) []awsManager.InstanceInfo {
+	var instances []awsManager.InstanceInfo
+	for _, instance := range d.Cluster.Instances {
+		instances = append(instances, awsManager.InstanceInfo{
+			InstanceID:   instance.InstanceID,
+			PrivateIP:    instance.PrivateIP,
+			InstanceType: instance.InstanceType,
+			ImageID:      instance.ImageID,
+			InstanceRank: instance.Rank,
+
+			AvailabilityZone: instance.AvailabilityZone,
+			PlacementGroup:   instance.PlacementGroup,
+			Lifecycle:        instance.Lifecycle,
+		})
+	}
+	return instances
+}
+
+// descriptorFlags returns the run flags a manifest sets, by flag name
+func descriptorFlags(d *runDescriptor) map[string]string {
+	flags := map[string]string{
+		"project":                d.Project,
+		"vpc":                    d.Cluster.VPC,
+		"exec":                   d.Program.Command,
+		"launcher":               d.Program.Launcher,
+		"work-dir":               d.Program.WorkDir,
+		"seed":                   strconv.FormatUint(d.Options.Seed, 10),
+		"bucket":                 d.Options.Bucket,
+		"kv-table":               d.Options.KVTable,
+		"chaos":                  d.Options.Chaos,
+		"min-ranks":              strconv.Itoa(d.Options.MinRanks),
+		"connect-concurrency":    strconv.Itoa(d.Options.ConnectConcurrency),
+		"transport":              d.Options.Transport,
+		"timeout-policy":         d.Options.TimeoutPolicy,
+		"max-bandwidth-per-rank": d.Options.MaxBandwidth,
+		"broadcast":              d.Options.Broadcast,
+		"encrypt-payloads":       strconv.FormatBool(d.Options.EncryptPayloads),
+		"check-network":          strconv.FormatBool(d.Options.CheckNetwork),
+		"job-security-group":     strconv.FormatBool(d.Options.JobSecurityGroup),
+		"metrics":                strconv.FormatBool(d.Options.Metrics),
+		"pprof-port":             strconv.Itoa(d.Options.PprofPort),
+		"log-level":              d.Options.LogLevel,
+		"log-rate":               d.Options.LogRate,
+		"gomaxprocs":             d.Options.GoMaxProcs,
+		"gogc":                   d.Options.GOGC,
+		"gomemlimit":             d.Options.GoMemLimit,
+		"max-instances-per-az":   strconv.Itoa(d.Options.MaxInstancesPerAZ),
+		"max-spawn-ranks":        strconv.Itoa(d.Options.MaxSpawnRanks),
+	}
+	if len(d.Cluster.Instances) > 0 {
+		flags["num-instances"] = strconv.Itoa(len(d.Cluster.Instances))
+	}
+	if d.Program.SlotsPerNode > 0 {
+		flags["slots-per-node"] = strconv.Itoa(d.Program.SlotsPerNode)
+	}
+	if d.Options.ConnectTimeout != "" {
+		flags["connect-timeout"] = d.Options.ConnectTimeout
+	}
+	if d.Options.ConnectStagger != "" {
+		flags["connect-stagger"] = d.Options.ConnectStagger
+	}
+	if d.Options.EagerLimit != "" {
+		flags["eager-limit"] = d.Options.EagerLimit
+	}
+	if d.Options.ReconnectTimeout != "" {
+		flags["reconnect-timeout"] = d.Options.ReconnectTimeout
+	}
+	if d.Options.MaxClockSkew != "" {
+		flags["max-clock-skew"] = d.Options.MaxClockSkew
+	}
+	if d.Options.CollectiveTimeout != "" {
+		flags["collective-timeout"] = d.Options.CollectiveTimeout
+	}
+	if len(d.Options.Require) > 0 {
+		flags["require"] = strings.Join(d.Options.Require, ",")
+	}
+	if d.Program.Git != nil {
+		flags["git"] = d.Program.Git.URL
+		flags["ref"] = d.Program.Git.Ref
+		flags["git-secret"] = d.Program.Git.Secret
+	}
+	return flags
+}
+
+// applyRunDescriptor sets every flag the manifest records that was not given on the
+// command line, pins the hosts to the recorded instances and the Git source to the
+// recorded commit, and adds the recorded environment
+func (o *runOptions) applyRunDescriptor(d *runDescriptor, flags *pflag.FlagSet) error {
+	sizeGiven := flags.Changed("num-instances")
+	sourceGiven := flags.Changed("git") || flags.Changed("ref")
+	for name, value := range descriptorFlags(d) {
+		if flags.Changed(name) {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("manifest value %q for --%s: %v", value, name, err)
+		}
+	}
+	if len(o.hostSelection) == 0 && !sizeGiven {
+		for _, instance := range d.Cluster.Instances {
+			o.hostSelection = append(o.hostSelection, instance.InstanceID)
+		}
+	}
+	if d.Program.Git != nil && !sourceGiven {
+		o.git.commit = d.Program.Git.Commit
+	}
+	o.extraEnv = append(d.Options.Env, o.extraEnv...)
+	o.pinnedManifest = d
+	return nil
+}
+
+// loadRunDescriptor applies the manifest given with --from-manifest, if any
+func (o *runOptions) loadRunDescriptor(flags *pflag.FlagSet) error {
+	if o.fromManifestPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(o.fromManifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+	d, err := parseRunDescriptor(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %v", o.fromManifestPath, err)
+	}
+	return o.applyRunDescriptor(d, flags)
+}
+
+// descriptorDrift lists how the instances and this binary differ from the manifest
+// being reproduced
+func descriptorDrift(d *runDescriptor, instances []awsManager.InstanceInfo) []string {
+	var drift []string
+	if tool := currentToolInfo(); tool.Version != d.Tool.Version || tool.Revision != d.Tool.Revision {
+		drift = append(drift, fmt.Sprintf("awsmpirun is %s, the manifest was written by %s", describeTool(tool), describeTool(d.Tool)))
+	}
+	byRank := make(map[int]instanceRecord)
+	for _, record := range d.Cluster.Instances {
+		byRank[record.Rank] = record
+	}
+	for _, instance := range instances {
+		record, ok := byRank[instance.InstanceRank]
+		if !ok {
+			continue
+		}
+		if record.InstanceType != "" && instance.InstanceType != record.InstanceType {
+			drift = append(drift, fmt.Sprintf("rank %d runs on a %s, the manifest recorded a %s", instance.InstanceRank, instance.InstanceType, record.InstanceType))
+		}
+		if record.ImageID != "" && instance.ImageID != record.ImageID {
+			drift = append(drift, fmt.Sprintf("rank %d runs AMI %s, the manifest recorded %s", instance.InstanceRank, instance.ImageID, record.ImageID))
+		}
+	}
+	return drift
+}
+
+func describeTool(tool toolInfo) string {
+	if tool.Revision == "" {
+		return tool.Version
+	}
+	return fmt.Sprintf("%s (%s)", tool.Version, tool.Revision)
+}
+
+// pinnedProgramHash is the sha256 every rank must find for its program, when reproducing a manifest
+func (o *runOptions) pinnedProgramHash() string {
+	if o.pinnedManifest == nil {
+		return ""
+	}
+	return o.pinnedManifest.Program.SHA256
+}
+
+// commandProgram returns the program a plain "program arg..." command starts, or ""
+// when the command is shell code whose program cannot be told without running it
+func commandProgram(command string) string {
+	if strings.ContainsAny(command, debugUnsafeChars+"${}") {
+		return ""
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 || strings.Contains(fields[0], "=") {
+		return ""
+	}
+	return fields[0]
+}
+
+// programCheck returns the script lines that report the sha256 of the program command
+// starts, export it as MPI_PROGRAM_SHA256 for provenance, and stop the rank if
+// MPI_EXPECT_SHA256 pins a different one
+func programCheck(command string) string {
+	program := commandProgram(command)
+	if program == "" {
+		return ""
+	}
+	return shellf(`PROGRAM=%[1]s
+PROGRAM_PATH=$(command -v "$PROGRAM" 2> /dev/null)
+if [ -f "$PROGRAM_PATH" ]; then
+  PROGRAM_SHA256=$(sha256sum "$PROGRAM_PATH" | cut -d " " -f 1)
+  echo "%[2]s$PROGRAM_SHA256"
+  export MPI_PROGRAM_SHA256="$PROGRAM_SHA256"
+  if [ -n "$MPI_EXPECT_SHA256" ] && [ "$PROGRAM_SHA256" != "$MPI_EXPECT_SHA256" ]; then
+    echo "$PROGRAM_PATH has sha256 $PROGRAM_SHA256, the manifest pins $MPI_EXPECT_SHA256" >&2
+    exit 1
+  fi
+elif [ -n "$MPI_EXPECT_SHA256" ]; then
+  echo "$PROGRAM not found, cannot check it against the manifest" >&2
+  exit 1
+fi`, program, shellExpr(programHashMarker))
+}
+
+// parseProgramHash returns the program sha256 a rank's script reported and its output
+// without the report
+func parseProgramHash(stdout string) (hash, rest string) {
+	var kept []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), programHashMarker); ok {
+			if hash == "" {
+				hash = value
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return hash, strings.Join(kept, "\n")
+}
+
+// agreedProgramHash returns the program sha256 all ranks reported, warning when they differ
+func agreedProgramHash(instances []awsManager.InstanceInfo, hashes map[string]string) string {
+	first := ""
+	for _, instance := range instances {
+		hash := hashes[instance.InstanceID]
+		if hash == "" {
+			continue
+		}
+		if first == "" {
+			first = hash
+		} else if hash != first {
+			fmt.Printf("Warning: rank %d ran a program with sha256 %s, other ranks ran %s\n", instance.InstanceRank, hash, first)
+		}
+	}
+	return first
+}
+
+// recordRunDescriptor writes job.yaml for the current run to the configuration
+// directory and, with --bucket, to the staging bucket
+func (o *runOptions) recordRunDescriptor(ctx context.Context, instances []awsManager.InstanceInfo, region, programHash string) {
+	data, err := yaml.Marshal(o.newRunDescriptor(instances, region, programHash))
+	if err != nil {
+		fmt.Printf("Warning: failed to render run manifest: %v\n", err)
+		return
+	}
+
+	dir, err := platform.Current().ConfigDir()
+	if err == nil {
+		dir = filepath.Join(dir, "jobs", o.jobID)
+		err = os.MkdirAll(dir, 0o700)
+	}
+	if err == nil {
+		path := filepath.Join(dir, "job.yaml")
+		err = os.WriteFile(path, data, 0o600)
+		if err == nil {
+			fmt.Printf("Run manifest: %s\n", path)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save run manifest: %v\n", err)
+	}
+
+	if o.bucket == "" {
+		return
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err == nil {
+		err = s3Client.UploadBytes(ctx, data, runDescriptorKey(o.project, o.jobID))
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to upload run manifest: %v\n", err)
+		return
+	}
+	fmt.Printf("Run manifest: s3://%s/%s\n", o.bucket, runDescriptorKey(o.project, o.jobID))
+}
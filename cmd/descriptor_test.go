@@ -0,0 +1,245 @@
+// cmd/descriptor_test.go
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+func testInstances() []awsManager.InstanceInfo {
+	return []awsManager.InstanceInfo{
+		{InstanceID: "i-0", PrivateIP: "10.0.0.1", InstanceType: "c7g.large", ImageID: "ami-1", InstanceRank: 0},
+		{InstanceID: "i-1", PrivateIP: "10.0.0.2", InstanceType: "c7g.large", ImageID: "ami-1", InstanceRank: 1},
+	}
+}
+
+func TestRunDescriptorRoundTrip(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath = "job-1", "vpc-1", "./solver --steps 10"
+	o.jobSeed, o.extraEnv, o.connectTimeout, o.transport = 42, []string{"OMP_NUM_THREADS=4"}, 90*time.Second, "tcp"
+	o.eagerLimit, o.maxBandwidth, o.checkNetwork, o.broadcast = 0, "100MB/s", true, "udp"
+	o.git = gitSource{url: "https://github.com/example/solver", ref: "v1.2.0", commit: "0123456789abcdef0123456789abcdef01234567"}
+
+	data, err := yaml.Marshal(o.newRunDescriptor(testInstances(), "us-east-2", "abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseRunDescriptor(data)
+	if err != nil {
+		t.Fatalf("parseRunDescriptor: %v\n%s", err, data)
+	}
+	if d.JobID != "job-1" || d.Region != "us-east-2" || d.Program.SHA256 != "abc123" || d.Options.Seed != 42 {
+		t.Errorf("descriptor = %+v", d)
+	}
+	if d.Options.ConnectTimeout != "1m30s" || d.Options.Transport != "tcp" || d.Options.EagerLimit != "0" || d.Options.MaxBandwidth != "100MB/s" || d.Options.Broadcast != "udp" || !d.Options.CheckNetwork || !reflect.DeepEqual(d.Options.Env, []string{"OMP_NUM_THREADS=4"}) {
+		t.Errorf("options = %+v", d.Options)
+	}
+	if d.Program.Git == nil || d.Program.Git.Ref != "v1.2.0" || d.Program.Git.Commit != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("git source = %+v", d.Program.Git)
+	}
+	if len(d.Cluster.Instances) != 2 || d.Cluster.Instances[1].ImageID != "ami-1" {
+		t.Errorf("instances = %+v", d.Cluster.Instances)
+	}
+}
+
+func TestRunDescriptorZones(t *testing.T) {
+	instances := append(testInstances(), awsManager.InstanceInfo{InstanceID: "i-2", InstanceRank: 2})
+	zones := []string{"us-east-2a", "us-east-2b", "us-east-2a"}
+	for i := range instances {
+		instances[i].AvailabilityZone = zones[i]
+	}
+	o := newRunOptions()
+	o.maxPerAZ = 2
+	d := o.newRunDescriptor(instances, "us-east-2", "")
+	if want := map[string]string{"us-east-2a": "0,2", "us-east-2b": "1"}; !reflect.DeepEqual(d.Cluster.Zones, want) {
+		t.Errorf("zones = %v, want %v", d.Cluster.Zones, want)
+	}
+	if got := descriptorFlags(d)["max-instances-per-az"]; got != "2" {
+		t.Errorf("--max-instances-per-az = %q, want 2", got)
+	}
+}
+
+func TestParseRunDescriptorErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown field", "version: 1\ncluster: {vpc: vpc-1}\nprogram: {command: ./a}\nextra: true\n"},
+		{"wrong version", "version: 2\ncluster: {vpc: vpc-1}\nprogram: {command: ./a}\n"},
+		{"no command", "version: 1\ncluster: {vpc: vpc-1}\n"},
+		{"ranks out of order", "version: 1\ncluster: {vpc: vpc-1, instances: [{rank: 1, instance_id: i-1}]}\nprogram: {command: ./a}\n"},
+	}
+	for _, test := range tests {
+		if _, err := parseRunDescriptor([]byte(test.data)); err == nil {
+			t.Errorf("%s: parseRunDescriptor succeeded", test.name)
+		}
+	}
+}
+
+func TestApplyRunDescriptor(t *testing.T) {
+	d := &runDescriptor{
+		Cluster: clusterSpec{VPC: "vpc-1", Instances: []instanceRecord{{Rank: 0, InstanceID: "i-0"}, {Rank: 1, InstanceID: "i-1"}}},
+		Program: programSpec{Command: "./solver", Launcher: launcherNative},
+		Options: runOptionsSpec{Seed: 7, Env: []string{"A=1"}, ConnectTimeout: "2m"},
+	}
+	tests := []struct {
+		name      string
+		given     map[string]string
+		wantFlags map[string]string
+		wantHosts []string
+	}{
+		{
+			name:      "manifest only",
+			wantFlags: map[string]string{"vpc": "vpc-1", "exec": "./solver", "seed": "7", "num-instances": "2", "connect-timeout": "2m"},
+			wantHosts: []string{"i-0", "i-1"},
+		},
+		{
+			name:      "flags override",
+			given:     map[string]string{"seed": "9", "exec": "./solver --fast"},
+			wantFlags: map[string]string{"seed": "9", "exec": "./solver --fast", "vpc": "vpc-1"},
+			wantHosts: []string{"i-0", "i-1"},
+		},
+		{
+			name:      "new size drops the pinned hosts",
+			given:     map[string]string{"num-instances": "4"},
+			wantFlags: map[string]string{"num-instances": "4"},
+		},
+	}
+	for _, test := range tests {
+		o := newRunOptions()
+		o.extraEnv = []string{"B=2"}
+		flags := pflag.NewFlagSet(test.name, pflag.ContinueOnError)
+		values := make(map[string]*string)
+		for name := range descriptorFlags(d) {
+			values[name] = flags.String(name, "", "")
+		}
+		values["slots-per-node"] = flags.String("slots-per-node", "", "")
+		values["connect-stagger"] = flags.String("connect-stagger", "", "")
+		for name, value := range test.given {
+			flags.Set(name, value)
+		}
+
+		if err := o.applyRunDescriptor(d, flags); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for name, want := range test.wantFlags {
+			if got := *values[name]; got != want {
+				t.Errorf("%s: --%s = %q, want %q", test.name, name, got, want)
+			}
+		}
+		if !reflect.DeepEqual(o.hostSelection, test.wantHosts) {
+			t.Errorf("%s: hosts = %v, want %v", test.name, o.hostSelection, test.wantHosts)
+		}
+		if !reflect.DeepEqual(o.extraEnv, []string{"A=1", "B=2"}) {
+			t.Errorf("%s: env = %v", test.name, o.extraEnv)
+		}
+		if o.pinnedManifest != d {
+			t.Errorf("%s: manifest not pinned", test.name)
+		}
+	}
+}
+
+func TestDescriptorDrift(t *testing.T) {
+	d := newRunOptions().newRunDescriptor(testInstances(), "us-east-2", "")
+	instances := testInstances()
+	if drift := descriptorDrift(d, instances); len(drift) != 0 {
+		t.Errorf("drift on the recorded instances: %v", drift)
+	}
+	instances[1].ImageID = "ami-2"
+	instances[0].InstanceType = "c7g.xlarge"
+	d.Tool.Version = "v0.0.1"
+	drift := descriptorDrift(d, instances)
+	if len(drift) != 3 {
+		t.Fatalf("drift = %v, want tool, type, and AMI", drift)
+	}
+	for _, want := range []string{"v0.0.1", "rank 0 runs on a c7g.xlarge", "rank 1 runs AMI ami-2"} {
+		if !strings.Contains(strings.Join(drift, "\n"), want) {
+			t.Errorf("drift %v does not mention %q", drift, want)
+		}
+	}
+}
+
+func TestCommandProgram(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"./solver --steps 10", "./solver"},
+		{"/usr/bin/python3 train.py", "/usr/bin/python3"},
+		{"./solver --rank {rank}", ""},
+		{"cd data && ./solver", ""},
+		{"OMP_NUM_THREADS=4 ./solver", ""},
+		{"$HOME/solver", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := commandProgram(test.command); got != test.want {
+			t.Errorf("commandProgram(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
+
+func TestParseProgramHash(t *testing.T) {
+	tests := []struct {
+		stdout, hash, rest string
+	}{
+		{"", "", ""},
+		{"awsmpirun-program-sha256: abc\nhello", "abc", "hello"},
+		{"hello\nawsmpirun-program-sha256: abc\nworld", "abc", "hello\nworld"},
+	}
+	for _, test := range tests {
+		hash, rest := parseProgramHash(test.stdout)
+		if hash != test.hash || rest != test.rest {
+			t.Errorf("parseProgramHash(%q) = %q, %q, want %q, %q", test.stdout, hash, rest, test.hash, test.rest)
+		}
+	}
+}
+
+// TestProgramCheck runs the check against a real file, with and without a pinned hash
+func TestProgramCheck(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("no sha256sum available")
+	}
+	dir := t.TempDir()
+	program := filepath.Join(dir, "solver")
+	content := []byte("#!/bin/sh\n")
+	if err := os.WriteFile(program, content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		expect  string
+		wantErr bool
+	}{
+		{"unpinned", "", false},
+		{"pinned match", hash, false},
+		{"pinned mismatch", strings.Repeat("0", 64), true},
+	}
+	for _, test := range tests {
+		cmd := exec.Command("bash", "-c", programCheck(program+" --steps 10"))
+		cmd.Env = append(os.Environ(), "MPI_EXPECT_SHA256="+test.expect)
+		out, err := cmd.Output()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %v", test.name, err, test.wantErr)
+		}
+		if got, _ := parseProgramHash(string(out)); got != hash {
+			t.Errorf("%s: reported hash %q, want %q", test.name, got, hash)
+		}
+	}
+}
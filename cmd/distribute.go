@@ -0,0 +1,346 @@
+// cmd/distribute.go
+// This file implements the distribute command, which copies a large S3 object to
+// every instance with peer assistance. A few seed ranks download the object from
+// S3, split it into chunks, and serve the chunks over HTTP inside the VPC. The
+// remaining ranks then join in waves: each wave pulls chunks round-robin from every
+// rank that already holds the file and starts serving itself, so the number of
+// sources roughly multiplies each wave and S3 egress stays at a few copies.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/spf13/cobra"
+)
+
+// distributeOptions are the flags of the distribute command
+type distributeOptions struct {
+	project   string
+	vpc       string
+	instances int
+	source    string
+	dest      string
+	seeds     int
+	fanout    int
+	port      int
+	chunkSize int64
+	timeout   time.Duration // How long each wave may take, 0 to size it to the object
+}
+
+const (
+	// minWaveRate is the slowest a wave is expected to move the object, in bytes per
+	// second, which sizes the waves of a run without --wave-timeout
+	minWaveRate = 5 << 20
+	// waveStartup is what a wave gets on top of moving the object, for starting the
+	// scripts, checksumming, and splitting
+	waveStartup = 10 * time.Minute
+)
+
+// newDistributeCmd returns the distribute command
+func newDistributeCmd() *cobra.Command {
+	o := &distributeOptions{}
+	cmd := &cobra.Command{
+		Use:   "distribute",
+		Short: "Copy a large S3 object to all instances with peer-to-peer assistance",
+		Long: `distribute downloads an S3 object onto a few seed instances and spreads it to the
+rest of the instances over the VPC network in chunks, instead of every instance
+downloading it from S3. The seed port must be open between the instances.
+
+Chunks are served over plain, unauthenticated HTTP on each instance's private IP
+until the copy finishes, so for that time the object is readable by anything that
+can reach the seed port. Restrict the port to the job's security group.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runDistribute(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 1, "Number of EC2 instances")
+	cmd.Flags().StringVar(&o.source, "source", "", "S3 object to distribute, as s3://bucket/key (required)")
+	cmd.Flags().StringVar(&o.dest, "dest", "", "Destination path on the instances (required)")
+	cmd.Flags().IntVar(&o.seeds, "seeds", 2, "Number of ranks that download directly from S3")
+	cmd.Flags().IntVar(&o.fanout, "fanout", 4, "New ranks admitted per source rank in each wave")
+	cmd.Flags().IntVar(&o.port, "seed-port", 50052, "Port the ranks serve chunks on")
+	cmd.Flags().Int64Var(&o.chunkSize, "chunk-size", 64<<20, "Chunk size in bytes")
+	cmd.Flags().DurationVar(&o.timeout, "wave-timeout", 0, "How long each wave may take before SSM stops it (default: sized to the object)")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("source")
+	cmd.MarkFlagRequired("dest")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newDistributeCmd())
+}
+
+func runDistribute(ctx context.Context, o *distributeOptions) {
+	sourceBucket, sourceKey, err := parseS3URI(o.source)
+	if err != nil {
+		fmt.Printf("Error parsing source: %v\n", err)
+		os.Exit(1)
+	}
+	if err := o.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	instances, err := discoverInstances(ctx, o.vpc, project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) < o.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", o.instances, len(instances))
+		os.Exit(1)
+	}
+	instances = instances[:o.instances]
+	assignRanks(instances)
+
+	s3Client, err := awsManager.NewS3Client(ctx, sourceBucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	size, err := s3Client.ObjectSize(ctx, sourceKey)
+	if err != nil {
+		fmt.Printf("Error reading source object: %v\n", err)
+		os.Exit(1)
+	}
+	if size == 0 {
+		fmt.Printf("Source object %s is empty, nothing to distribute\n", o.source)
+		os.Exit(1)
+	}
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+
+	jobID, err := newJobID()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	d := &distribution{
+		ssmClient:  ssmClient,
+		bucket:     sourceBucket,
+		key:        sourceKey,
+		region:     s3Client.Client.Options().Region,
+		chunks:     int((size + o.chunkSize - 1) / o.chunkSize),
+		workDir:    fmt.Sprintf("/tmp/awsmpirun/%s/chunks", jobID),
+		dest:       o.dest,
+		port:       o.port,
+		seeds:      o.seeds,
+		fanout:     o.fanout,
+		chunkSize:  o.chunkSize,
+		objectSize: size,
+		timeout:    o.waveExecutionTimeout(size),
+	}
+
+	err = d.run(ctx, instances)
+	d.cleanup(ctx, instances)
+	if err != nil {
+		fmt.Printf("Error distributing %s: %v\n", o.source, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Distributed %s (%d bytes) to %d instances at %s\n", o.source, size, len(instances), o.dest)
+}
+
+// validate rejects flag values the wave schedule cannot work with
+func (o *distributeOptions) validate() error {
+	if o.instances < 1 {
+		return fmt.Errorf("--num-instances must be at least 1, got %d", o.instances)
+	}
+	if o.seeds < 1 {
+		return fmt.Errorf("--seeds must be at least 1, got %d", o.seeds)
+	}
+	if o.fanout < 1 {
+		return fmt.Errorf("--fanout must be at least 1, got %d", o.fanout)
+	}
+	if o.chunkSize < 1 {
+		return fmt.Errorf("--chunk-size must be at least 1 byte, got %d", o.chunkSize)
+	}
+	if o.port < 1 || o.port > 65535 {
+		return fmt.Errorf("--seed-port must be a valid TCP port, got %d", o.port)
+	}
+	if o.timeout < 0 {
+		return fmt.Errorf("--wave-timeout must not be negative, got %s", o.timeout)
+	}
+	return nil
+}
+
+// waveExecutionTimeout returns how many seconds SSM lets the scripts of one wave run:
+// --wave-timeout, or long enough to move an object of size at minWaveRate
+func (o *distributeOptions) waveExecutionTimeout(size int64) int {
+	timeout := o.timeout
+	if timeout == 0 {
+		timeout = waveStartup + time.Duration(size/minWaveRate)*time.Second
+	}
+	return min(max(int(timeout.Seconds()), 1), maxExecutionTimeout)
+}
+
+// distribution tracks one peer-assisted copy of an S3 object
+type distribution struct {
+	ssmClient  *ssm.Client
+	bucket     string
+	key        string
+	region     string
+	chunks     int
+	chunkSize  int64
+	objectSize int64
+	workDir    string
+	dest       string
+	port       int
+	seeds      int // Ranks that download from S3
+	fanout     int // New ranks per holder in each wave
+	checksum   string
+	timeout    int // Seconds SSM lets the scripts of one wave run
+}
+
+func (d *distribution) run(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	seeds := d.seeds
+	if seeds > len(instances) {
+		seeds = len(instances)
+	}
+
+	// Wave 0: seeds fetch from S3 and report the checksum the other ranks verify against
+	holders := instances[:seeds]
+	remaining := instances[seeds:]
+	fmt.Printf("Wave 0: %d ranks downloading from S3\n", len(holders))
+
+	outputs, err := runLongScriptOnInstances(ctx, d.ssmClient, holders, d.timeout, func(instance awsManager.InstanceInfo) string {
+		return d.seedScript(instance.PrivateIP)
+	})
+	if err != nil {
+		return err
+	}
+	for _, instance := range holders {
+		checksum := strings.TrimSpace(outputs[instance.InstanceID])
+		if d.checksum == "" {
+			d.checksum = checksum
+		} else if checksum != d.checksum {
+			return fmt.Errorf("seed %s downloaded a different object (checksum %s, expected %s)", instance.InstanceID, checksum, d.checksum)
+		}
+	}
+
+	// Later waves pull from every current holder and then start serving themselves
+	for wave := 1; len(remaining) > 0; wave++ {
+		count := len(holders) * d.fanout
+		if count > len(remaining) {
+			count = len(remaining)
+		}
+		batch := remaining[:count]
+		remaining = remaining[count:]
+		fmt.Printf("Wave %d: %d ranks fetching from %d peers\n", wave, len(batch), len(holders))
+
+		var sources []string
+		for _, holder := range holders {
+			sources = append(sources, holder.PrivateIP)
+		}
+		_, err := runLongScriptOnInstances(ctx, d.ssmClient, batch, d.timeout, func(instance awsManager.InstanceInfo) string {
+			// Rotate the source order so ranks in a wave start on different peers
+			offset := instance.InstanceRank % len(sources)
+			rotated := append(append([]string{}, sources[offset:]...), sources[:offset]...)
+			return d.fetchScript(rotated, instance.PrivateIP)
+		})
+		if err != nil {
+			return err
+		}
+		holders = append(holders, batch...)
+	}
+	return nil
+}
+
+// cleanup stops the chunk servers and removes the chunk directories, even when ctx has
+// been cancelled
+func (d *distribution) cleanup(ctx context.Context, instances []awsManager.InstanceInfo) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	script := newShellScript()
+	script.Linef(`if [ -f %[1]s ]; then kill $(cat %[1]s) 2>/dev/null; fi`, d.workDir+"/server.pid")
+	script.Linef("rm -rf %s", d.workDir)
+	_, err := runScriptOnInstances(ctx, d.ssmClient, instances, func(awsManager.InstanceInfo) string { return script.String() })
+	if err != nil {
+		fmt.Printf("Warning: failed to clean up chunk servers: %v\n", err)
+	}
+}
+
+// seedScript downloads the object from S3, splits it into chunks, starts serving them, and prints its checksum
+func (d *distribution) seedScript(bindIP string) string {
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("mkdir -p %s %s", d.workDir, path.Dir(d.dest))
+	script.Linef("aws s3 cp s3://%s/%s %s --region %s --only-show-errors", d.bucket, d.key, d.dest, d.region)
+	script.Linef("split -b %d -d -a 6 %s %s/c", d.chunkSize, d.dest, d.workDir)
+	script.Raw(d.serveCommand(bindIP))
+	script.Linef("sha256sum %s | cut -d' ' -f1", d.dest)
+	return script.String()
+}
+
+// fetchScript pulls every chunk from the given peers, falling back to S3 if the copy is bad
+func (d *distribution) fetchScript(sources []string, bindIP string) string {
+	part := d.dest + ".part"
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("mkdir -p %s %s", d.workDir, path.Dir(d.dest))
+	script.Linef("CHUNKS=%s", d.workDir)
+	script.Linef("PART=%s", part)
+	script.Linef("SOURCES=(%s)", sources)
+	script.Linef(`for ((i = 0; i < %d; i++)); do
+  CHUNK=$(printf "c%%06d" $i)
+  SRC=${SOURCES[$((i %% ${#SOURCES[@]}))]}
+  curl -sf --retry 3 -o "$CHUNKS/$CHUNK" "http://$SRC:%d/$CHUNK" &
+  # Keep a bounded number of transfers in flight
+  if (( (i + 1) %% 8 == 0 )); then wait; fi
+done
+wait
+cat "$CHUNKS"/c* > "$PART"`, d.chunks, d.port)
+	script.Linef(`if [ "$(sha256sum "$PART" | cut -d' ' -f1)" != %s ] || [ "$(stat -c %%s "$PART")" != %d ]; then`, d.checksum, d.objectSize)
+	script.Raw(`  echo "peer copy failed verification, downloading from S3" >&2`)
+	script.Linef(`  aws s3 cp s3://%s/%s "$PART" --region %s --only-show-errors`, d.bucket, d.key, d.region)
+	script.Linef(`  rm -f "$CHUNKS"/c*
+  split -b %d -d -a 6 "$PART" "$CHUNKS/c"
+fi`, d.chunkSize)
+	script.Linef(`mv "$PART" %s`, d.dest)
+	script.Raw(d.serveCommand(bindIP))
+	return script.String()
+}
+
+// serveCommand starts a detached HTTP server for the chunk directory on the instance's private IP
+func (d *distribution) serveCommand(bindIP string) string {
+	return shellf(`cd %[1]s && setsid nohup python3 -m http.server %[2]d --bind %[3]s --directory %[1]s > /dev/null 2>&1 < /dev/null &
+echo $! > %[4]s`, d.workDir, d.port, bindIP, d.workDir+"/server.pid")
+}
+
+// parseS3URI splits s3://bucket/key into its bucket and key
+func parseS3URI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// URI", uri)
+	}
+	bucket, key, ok := strings.Cut(rest, "/")
+	if !ok || bucket == "" || key == "" || path.Clean("/"+key) == "/" {
+		return "", "", fmt.Errorf("%q must name a bucket and an object key", uri)
+	}
+	if err := validateBucketName(bucket); err != nil {
+		return "", "", err
+	}
+	return bucket, key, nil
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseS3URI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{uri: "s3://data/train.bin", wantBucket: "data", wantKey: "train.bin"},
+		{uri: "s3://data/sets/2024/train.bin", wantBucket: "data", wantKey: "sets/2024/train.bin"},
+		{uri: "https://data/train.bin", wantErr: true},
+		{uri: "s3://data", wantErr: true},
+		{uri: "s3://data/", wantErr: true},
+		{uri: "s3:///train.bin", wantErr: true},
+		{uri: "s3://data//", wantErr: true},
+		{uri: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		bucket, key, err := parseS3URI(tt.uri)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseS3URI(%q) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+			continue
+		}
+		if bucket != tt.wantBucket || key != tt.wantKey {
+			t.Errorf("parseS3URI(%q) = %q, %q, want %q, %q", tt.uri, bucket, key, tt.wantBucket, tt.wantKey)
+		}
+	}
+}
+
+func TestValidateDistributeOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *distributeOptions)
+		wantErr string
+	}{
+		{name: "defaults", modify: func(o *distributeOptions) {}},
+		{name: "zero fanout", modify: func(o *distributeOptions) { o.fanout = 0 }, wantErr: "--fanout"},
+		{name: "negative fanout", modify: func(o *distributeOptions) { o.fanout = -1 }, wantErr: "--fanout"},
+		{name: "zero chunk size", modify: func(o *distributeOptions) { o.chunkSize = 0 }, wantErr: "--chunk-size"},
+		{name: "zero seeds", modify: func(o *distributeOptions) { o.seeds = 0 }, wantErr: "--seeds"},
+		{name: "zero instances", modify: func(o *distributeOptions) { o.instances = 0 }, wantErr: "--num-instances"},
+		{name: "bad port", modify: func(o *distributeOptions) { o.port = 70000 }, wantErr: "--seed-port"},
+		{name: "negative wave timeout", modify: func(o *distributeOptions) { o.timeout = -time.Minute }, wantErr: "--wave-timeout"},
+	}
+
+	for _, tt := range tests {
+		o := &distributeOptions{instances: 4, seeds: 2, fanout: 4, chunkSize: 64 << 20, port: 50052}
+		tt.modify(o)
+		err := o.validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want mention of %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWaveExecutionTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		size    int64
+		want    int
+	}{
+		{name: "small object", size: 1 << 20, want: 600},
+		{name: "sized to the object", size: 100 << 30, want: 600 + 100<<30/minWaveRate},
+		{name: "capped at the SSM limit", size: 4 << 40, want: maxExecutionTimeout},
+		{name: "given", timeout: 3 * time.Hour, size: 100 << 30, want: 3 * 3600},
+		{name: "given under a second", timeout: time.Millisecond, size: 1, want: 1},
+	}
+	for _, tt := range tests {
+		o := &distributeOptions{timeout: tt.timeout}
+		if got := o.waveExecutionTimeout(tt.size); got != tt.want {
+			t.Errorf("%s: got %d seconds, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeCommandBindsPrivateIP(t *testing.T) {
+	d := &distribution{workDir: "/tmp/awsmpirun/job/chunks", port: 50052}
+	command := d.serveCommand("10.0.1.7")
+	if !strings.Contains(command, "--bind '10.0.1.7'") {
+		t.Errorf("chunk server is not bound to the private IP: %s", command)
+	}
+}
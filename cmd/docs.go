@@ -0,0 +1,392 @@
+// cmd/docs.go
+// This file implements docs serve, which serves the API documentation of the runtime
+// library on a local port, for writing programs on machines that cannot reach
+// pkg.go.dev. The mpi, mpi/sync, and examples packages embed their own source (see
+// mpi/source.go), which is parsed with go/doc when the server starts, so the pages
+// always match the library this awsmpirun was built with. Package pages show the
+// exported API with the godoc examples attached to it as complete programs, and every
+// built-in example has a page with its source.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/doc/comment"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"html/template"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/examples"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	mpisync "github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi/sync"
+
+	"github.com/spf13/cobra"
+)
+
+const modulePath = "github.com/Otter2022/cloud-native-mpi-for-aws-cli"
+
+var docsCmd = &cobra.Command{
+	Use:   "docs",
+	Short: "Browse the documentation of the runtime library",
+}
+
+// docsServeOptions are the flags of docs serve
+type docsServeOptions struct {
+	address string
+}
+
+// newDocsServeCmd returns docs serve
+func newDocsServeCmd() *cobra.Command {
+	o := &docsServeOptions{}
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the runtime library's API documentation and examples locally",
+		Long: `serve renders the documentation of the mpi and mpi/sync packages, with their
+examples, and the source of the built-in examples from the copy embedded in this
+binary, and serves it on --addr until interrupted:
+
+    awsmpirun docs serve --addr 127.0.0.1:6060
+
+Nothing is fetched from the network, so it works where pkg.go.dev is out of reach.
+Links to the standard library still point to pkg.go.dev.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runDocsServe(cmd.Context(), o.address)
+		},
+	}
+	cmd.Flags().StringVar(&o.address, "addr", "127.0.0.1:6060", "Address to serve the documentation on")
+	return cmd
+}
+
+func init() {
+	docsCmd.AddCommand(newDocsServeCmd())
+	rootCmd.AddCommand(docsCmd)
+}
+
+// docSource is a package whose documentation is served
+type docSource struct {
+	importPath string
+	files      fs.FS
+}
+
+// docSources returns the packages documented, in the order they are listed
+func docSources() []docSource {
+	return []docSource{
+		{importPath: modulePath + "/mpi", files: mpi.Source},
+		{importPath: modulePath + "/mpi/sync", files: mpisync.Source},
+	}
+}
+
+// runDocsServe serves the documentation on address until ctx is done
+func runDocsServe(ctx context.Context, address string) {
+	handler, err := newDocsHandler(docSources(), examples.Source)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	fmt.Printf("Serving the runtime documentation on http://%s. Press Ctrl-C to stop.\n", listener.Addr())
+
+	// Ctrl-C and --timeout both cancel ctx
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	case err := <-served:
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// docPackage is the documentation of one package, ready to render
+type docPackage struct {
+	*doc.Package
+	fset *token.FileSet
+}
+
+// loadDocPackage parses the Go files of src, examples from its test files included
+func loadDocPackage(src docSource) (*docPackage, error) {
+	names, err := fs.Glob(src.files, "*.go")
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		data, err := fs.ReadFile(src.files, name)
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(fset, name, data, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path.Join(src.importPath, name), err)
+		}
+		files = append(files, file)
+	}
+	pkg, err := doc.NewFromFiles(fset, files, src.importPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the documentation of %s: %v", src.importPath, err)
+	}
+	return &docPackage{Package: pkg, fset: fset}, nil
+}
+
+// docExample is a built-in example with its source
+type docExample struct {
+	examples.Example
+	File   string
+	Source string
+}
+
+// newDocsHandler renders the documentation of packages and the built-in examples in
+// exampleFiles and returns the handler serving it
+func newDocsHandler(packages []docSource, exampleFiles fs.FS) (http.Handler, error) {
+	var loaded []*docPackage
+	documented := make(map[string]bool)
+	for _, src := range packages {
+		pkg, err := loadDocPackage(src)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, pkg)
+		documented[src.importPath] = true
+	}
+	var programs []docExample
+	for _, example := range examples.All() {
+		file := example.Name + ".go"
+		source, err := fs.ReadFile(exampleFiles, file)
+		if err != nil {
+			return nil, fmt.Errorf("no source for example %s: %v", example.Name, err)
+		}
+		programs = append(programs, docExample{Example: example, File: file, Source: string(source)})
+	}
+
+	pages := make(map[string][]byte)
+	render := func(page string, name string, data any) error {
+		var buf bytes.Buffer
+		if err := docTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			return fmt.Errorf("failed to render %s: %v", page, err)
+		}
+		pages[page] = buf.Bytes()
+		return nil
+	}
+	if err := render("/", "index", struct {
+		Packages []*docPackage
+		Examples []docExample
+	}{loaded, programs}); err != nil {
+		return nil, err
+	}
+	for _, pkg := range loaded {
+		r := &docRenderer{pkg: pkg, documented: documented}
+		if err := render("/pkg/"+pkg.ImportPath, "package", r); err != nil {
+			return nil, err
+		}
+	}
+	for _, program := range programs {
+		if err := render("/examples/"+program.Name, "example", program); err != nil {
+			return nil, err
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[strings.TrimSuffix(r.URL.Path, "/")]
+		if r.URL.Path == "/" {
+			page, ok = pages["/"]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}), nil
+}
+
+// docRenderer renders the parts of a package page
+type docRenderer struct {
+	pkg        *docPackage
+	documented map[string]bool // Import paths with a page of their own
+}
+
+func (r *docRenderer) Package() *docPackage { return r.pkg }
+
+// HTML renders a doc comment, linking references to the documented packages to their
+// pages and the rest to pkg.go.dev
+func (r *docRenderer) HTML(text string) template.HTML {
+	printer := r.pkg.Printer()
+	printer.DocLinkURL = func(link *comment.DocLink) string {
+		importPath := link.ImportPath
+		if importPath == "" {
+			importPath = r.pkg.ImportPath
+		}
+		anchor := link.Name
+		if link.Recv != "" {
+			anchor = link.Recv + "." + link.Name
+		}
+		base := "https://pkg.go.dev/" + importPath
+		if r.documented[importPath] {
+			if importPath == r.pkg.ImportPath {
+				base = ""
+			} else {
+				base = "/pkg/" + importPath
+			}
+		}
+		if anchor == "" {
+			return base
+		}
+		return base + "#" + anchor
+	}
+	return template.HTML(printer.HTML(r.pkg.Parser().Parse(text)))
+}
+
+// Code prints a declaration or an example's code as Go source
+func (r *docRenderer) Code(node any) string {
+	var buf bytes.Buffer
+	config := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 4}
+	if err := config.Fprint(&buf, r.pkg.fset, node); err != nil {
+		return fmt.Sprintf("// %v", err)
+	}
+	return buf.String()
+}
+
+// ExampleCode prints an example as the complete program it is when it has one, and
+// as the body of its function otherwise
+func (r *docRenderer) ExampleCode(example *doc.Example) string {
+	if example.Play != nil {
+		return r.Code(example.Play)
+	}
+	body := r.Code(&printer.CommentedNode{Node: example.Code, Comments: example.Comments})
+	if block, ok := example.Code.(*ast.BlockStmt); ok && block != nil {
+		body = strings.TrimSuffix(strings.TrimPrefix(body, "{\n"), "}")
+		lines := strings.Split(body, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimPrefix(line, "    ")
+		}
+		body = strings.Join(lines, "\n")
+	}
+	return body
+}
+
+// ExampleName is the title of an example of the item called name
+func (r *docRenderer) ExampleName(name string, example *doc.Example) string {
+	if example.Suffix == "" {
+		return "Example " + name
+	}
+	return "Example " + name + " (" + example.Suffix + ")"
+}
+
+var docTemplates = template.Must(template.New("docs").Funcs(template.FuncMap{
+	"shortPath": func(importPath string) string { return strings.TrimPrefix(importPath, modulePath+"/") },
+	"synopsis":  func(pkg *docPackage) string { return pkg.Synopsis(pkg.Doc) },
+	"dict": func(pairs ...any) map[string]any {
+		m := make(map[string]any, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			m[pairs[i].(string)] = pairs[i+1]
+		}
+		return m
+	},
+}).Parse(docTemplateText))
+
+const docTemplateText = `
+{{define "head"}}<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><title>{{.}} - awsmpirun docs</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; max-width: 960px; margin: 2em auto; padding: 0 1em; line-height: 1.5; color: #202224; }
+pre { background: #f6f8fa; padding: 0.8em; overflow-x: auto; border-radius: 4px; line-height: 1.35; }
+code, pre { font-family: Menlo, Consolas, monospace; font-size: 0.9em; }
+h2 { border-bottom: 1px solid #ddd; padding-bottom: 0.2em; margin-top: 2em; }
+h3 { margin-top: 1.6em; }
+details { margin: 0.6em 0; }
+summary { cursor: pointer; color: #007d9c; }
+a { color: #007d9c; text-decoration: none; }
+nav { margin-bottom: 1.5em; }
+ul.index { columns: 2; }
+</style></head><body><nav><a href="/">awsmpirun runtime docs</a></nav>
+{{end}}
+
+{{define "foot"}}</body></html>
+{{end}}
+
+{{define "index"}}{{template "head" "Index"}}
+<h1>Runtime library</h1>
+<p>Programs started by awsmpirun use these packages to find their peers and exchange data.</p>
+<h2>Packages</h2>
+<dl>{{range .Packages}}
+<dt><a href="/pkg/{{.ImportPath}}">{{shortPath .ImportPath}}</a></dt><dd>{{synopsis .}}</dd>{{end}}
+</dl>
+<h2>Built-in examples</h2>
+<p>Complete programs using the library, which <code>awsmpirun examples run NAME</code> runs on a cluster.</p>
+<dl>{{range .Examples}}
+<dt><a href="/examples/{{.Name}}">{{.Name}}</a></dt><dd>{{.Summary}}</dd>{{end}}
+</dl>
+{{template "foot"}}{{end}}
+
+{{define "examples"}}{{$r := .R}}{{range .List}}
+<details><summary>{{$r.ExampleName $.Name .}}</summary>
+{{if .Doc}}{{$r.HTML .Doc}}{{end}}<pre>{{$r.ExampleCode .}}</pre>
+{{if .Output}}<p>Output:</p><pre>{{.Output}}</pre>{{end}}
+</details>{{end}}{{end}}
+
+{{define "values"}}{{$r := .R}}{{range .List}}
+<pre>{{$r.Code .Decl}}</pre>
+{{$r.HTML .Doc}}{{end}}{{end}}
+
+{{define "func"}}{{$r := .R}}{{with .Func}}
+<h3 id="{{if .Recv}}{{$.Type}}.{{end}}{{.Name}}">func {{if .Recv}}({{.Recv}}) {{end}}{{.Name}}</h3>
+<pre>{{$r.Code .Decl}}</pre>
+{{$r.HTML .Doc}}
+{{template "examples" (dict "R" $r "Name" (print $.Type (and .Recv ".") .Name) "List" .Examples)}}{{end}}{{end}}
+
+{{define "package"}}{{$r := .}}{{with .Package}}{{template "head" (shortPath .ImportPath)}}
+<h1>package {{.Name}}</h1>
+<pre>import "{{.ImportPath}}"</pre>
+{{$r.HTML .Doc}}
+{{template "examples" (dict "R" $r "Name" "package" "List" .Examples)}}
+
+<h2>Index</h2>
+<ul class="index">
+{{if .Consts}}<li><a href="#pkg-constants">Constants</a></li>{{end}}
+{{if .Vars}}<li><a href="#pkg-variables">Variables</a></li>{{end}}
+{{range .Funcs}}<li><a href="#{{.Name}}">func {{.Name}}</a></li>{{end}}
+{{range .Types}}<li><a href="#{{.Name}}">type {{.Name}}</a></li>{{$type := .Name}}{{range .Funcs}}<li>&nbsp;&nbsp;<a href="#{{.Name}}">func {{.Name}}</a></li>{{end}}{{range .Methods}}<li>&nbsp;&nbsp;<a href="#{{$type}}.{{.Name}}">func ({{.Recv}}) {{.Name}}</a></li>{{end}}{{end}}
+</ul>
+
+{{if .Consts}}<h2 id="pkg-constants">Constants</h2>{{template "values" (dict "R" $r "List" .Consts)}}{{end}}
+{{if .Vars}}<h2 id="pkg-variables">Variables</h2>{{template "values" (dict "R" $r "List" .Vars)}}{{end}}
+{{if .Funcs}}<h2 id="pkg-functions">Functions</h2>{{range .Funcs}}{{template "func" (dict "R" $r "Func" . "Type" "")}}{{end}}{{end}}
+{{if .Types}}<h2 id="pkg-types">Types</h2>{{range .Types}}{{$type := .Name}}
+<h3 id="{{.Name}}">type {{.Name}}</h3>
+<pre>{{$r.Code .Decl}}</pre>
+{{$r.HTML .Doc}}
+{{template "examples" (dict "R" $r "Name" .Name "List" .Examples)}}
+{{template "values" (dict "R" $r "List" .Consts)}}{{template "values" (dict "R" $r "List" .Vars)}}
+{{range .Funcs}}{{template "func" (dict "R" $r "Func" . "Type" "")}}{{end}}
+{{range .Methods}}{{template "func" (dict "R" $r "Func" . "Type" $type)}}{{end}}{{end}}{{end}}
+{{template "foot"}}{{end}}{{end}}
+
+{{define "example"}}{{template "head" .Name}}
+<h1>Example: {{.Name}}</h1>
+<p>{{.Summary}}. Run it with <code>awsmpirun examples run {{.Name}} --size N</code>, where N is the {{.SizeHelp}} (default {{.DefaultSize}}).</p>
+<h2>{{.File}}</h2>
+<pre>{{.Source}}</pre>
+{{template "foot"}}{{end}}
+`
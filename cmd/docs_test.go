@@ -0,0 +1,104 @@
+// cmd/docs_test.go
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/examples"
+)
+
+func TestDocsHandler(t *testing.T) {
+	handler, err := newDocsHandler(docSources(), examples.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path       string
+		wantStatus int
+		want       []string
+	}{
+		{"/", http.StatusOK, []string{
+			`<a href="/pkg/` + modulePath + `/mpi">mpi</a>`,
+			`<a href="/pkg/` + modulePath + `/mpi/sync">mpi/sync</a>`,
+			`<a href="/examples/ring">ring</a>`,
+		}},
+		{"/pkg/" + modulePath + "/mpi", http.StatusOK, []string{
+			"<h1>package mpi</h1>",
+			`<h3 id="Comm.Send">func (*Comm) Send</h3>`,
+			"func (c *Comm) Send(dest, tag int, data []byte) error",
+			"<summary>Example Comm.Send</summary>",
+			"package main",
+			"comm.Send(1, tag, []byte(&#34;hello&#34;))",
+			`<h3 id="Init">func Init</h3>`,
+		}},
+		{"/pkg/" + modulePath + "/mpi/sync/", http.StatusOK, []string{"<h1>package sync</h1>", `<h3 id="Barrier.Wait">`}},
+		{"/examples/matmul", http.StatusOK, []string{"awsmpirun examples run matmul --size N", "func runMatMul("}},
+		{"/examples/nope", http.StatusNotFound, nil},
+		{"/pkg/fmt", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("page lacks %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestDocsHandlerTestOnlyMembers(t *testing.T) {
+	handler, err := newDocsHandler(docSources(), examples.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pkg/"+modulePath+"/mpi", nil))
+	for _, unwanted := range []string{"TestSealOpen", "startLocalWorld", "func ExampleInit"} {
+		if strings.Contains(w.Body.String(), unwanted) {
+			t.Errorf("page documents %q from the test files", unwanted)
+		}
+	}
+}
+
+func TestDocsHandlerInvalidSource(t *testing.T) {
+	sources := []docSource{{importPath: "example.com/broken", files: fstest.MapFS{"a.go": {Data: []byte("package broken\nfunc {")}}}}
+	if _, err := newDocsHandler(sources, examples.Source); err == nil || !strings.Contains(err.Error(), "failed to parse example.com/broken/a.go") {
+		t.Errorf("newDocsHandler() error = %v", err)
+	}
+	if _, err := newDocsHandler(docSources(), fstest.MapFS{}); err == nil || !strings.Contains(err.Error(), "no source for example ring") {
+		t.Errorf("newDocsHandler() without example sources error = %v", err)
+	}
+}
+
+func TestDocLinks(t *testing.T) {
+	pkg, err := loadDocPackage(docSources()[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &docRenderer{pkg: pkg, documented: map[string]bool{modulePath + "/mpi": true, modulePath + "/mpi/sync": true}}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Wait for [Barrier].", `<a href="#Barrier">Barrier</a>`},
+		{"See [Barrier.Wait].", `<a href="#Barrier.Wait">Barrier.Wait</a>`},
+		{"Uses [mpi.KV].", `<a href="/pkg/` + modulePath + `/mpi#KV">mpi.KV</a>`},
+		{"Like [time.Duration].", `<a href="https://pkg.go.dev/time#Duration">time.Duration</a>`},
+	}
+	for _, tt := range tests {
+		if got := string(r.HTML(tt.text)); !strings.Contains(got, tt.want) {
+			t.Errorf("HTML(%q) = %q, want it to contain %q", tt.text, got, tt.want)
+		}
+	}
+}
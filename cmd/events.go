@@ -0,0 +1,357 @@
+// cmd/events.go
+// This file implements the event journal of a job and the events command that reads
+// it. Every significant step of a run is appended to events.jsonl in the job's
+// configuration directory as it happens, one JSON object per line: the run starting or
+// resuming, every phase starting, completing, or failing, the SSM command each rank was
+// started with, every rank finishing, the ranks the program spawned, optional features
+// turned off for lack of permissions, the deadline passing, and the run ending. With
+// --bucket the journal is also copied to the job's prefix after every phase, so it can
+// be read from another machine. awsmpirun events --follow prints new events as they
+// are appended until the run ends.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/spf13/cobra"
+)
+
+// Types of journal events
+const (
+	eventRunStarted      = "run-started"
+	eventRunResumed      = "run-resumed"
+	eventPhaseStarted    = "phase-started"
+	eventPhaseCompleted  = "phase-completed"
+	eventPhaseFailed     = "phase-failed"
+	eventCommandSent     = "command-sent"
+	eventRankSucceeded   = "rank-succeeded"
+	eventRankFailed      = "rank-failed"
+	eventDeadlinePassed  = "deadline-passed"
+	eventFeatureDisabled = "feature-disabled"
+	eventGroupOpened     = "security-group-opened"
+	eventGroupClosed     = "security-group-closed"
+	eventRanksSpawned    = "ranks-spawned"
+	eventSpawnRefused    = "spawn-refused"
+	eventRunStopped      = "run-stopped"
+	eventRunFinished     = "run-finished"
+	eventRunFailed       = "run-failed"
+)
+
+// eventsPollInterval is how often --follow looks for new events
+const eventsPollInterval = time.Second
+
+// eventsOptions are the flags of the events command
+type eventsOptions struct {
+	jobID   string
+	follow  bool
+	bucket  string
+	project string
+	json    bool
+}
+
+// newEventsCmd returns the events command
+func newEventsCmd() *cobra.Command {
+	o := &eventsOptions{}
+	cmd := &cobra.Command{
+		Use:   "events --job JOB_ID",
+		Short: "Show the event journal of a job",
+		Long: `events prints the journal awsmpirun keeps of a job: phase transitions, the SSM
+command of every rank, ranks finishing, resumes after a failure, and how the run ended. The journal is
+read from this machine, or with --bucket from the copy a run with --bucket keeps in the
+job's prefix. --follow keeps printing new events until the run ends.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runEvents(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.jobID, "job", "", "ID of the job (required)")
+	cmd.Flags().BoolVarP(&o.follow, "follow", "f", false, "Keep printing new events until the run ends")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Read the journal the run copied to this bucket instead of the local one")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the job, for --bucket (default: project in config.yaml)")
+	cmd.Flags().BoolVar(&o.json, "json", false, "Print the events as JSON lines")
+	cmd.MarkFlagRequired("job")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newEventsCmd())
+}
+
+// jobEvent is one entry of the journal
+type jobEvent struct {
+	Time       string `json:"time"`
+	Type       string `json:"type"`
+	Phase      string `json:"phase,omitempty"`
+	Rank       *int   `json:"rank,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	CommandID  string `json:"command_id,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// rankEvent returns an event about the rank of instance
+func rankEvent(eventType string, instance awsManager.InstanceInfo) jobEvent {
+	rank := instance.InstanceRank
+	return jobEvent{Type: eventType, Rank: &rank, InstanceID: instance.InstanceID}
+}
+
+// ends reports whether no more events follow e
+func (e jobEvent) ends() bool {
+	return e.Type == eventRunFinished || e.Type == eventRunFailed || e.Type == eventRunStopped
+}
+
+// eventsPath returns where the journal of a job is kept on this machine
+func eventsPath(jobID string) (string, error) {
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "jobs", jobID, "events.jsonl"), nil
+}
+
+// eventsKey is the S3 key the journal of a job is copied to
+func eventsKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/events.jsonl"
+}
+
+// eventJournal appends the events of one run to the job's journal. A nil journal
+// records nothing, and a journal that cannot be written warns once and carries on, so
+// the journal never fails a run.
+type eventJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	phase   string // Phase the events are recorded in
+	bucket  string
+	key     string
+	warned  bool
+	s3      *awsManager.S3Client
+	now     func() time.Time
+	pending bool // Events appended since the last copy to the bucket
+}
+
+// openEventJournal opens the journal of the run's job for appending
+func (o *runOptions) openEventJournal() *eventJournal {
+	j := &eventJournal{now: time.Now}
+	if o.bucket != "" {
+		j.bucket, j.key = o.bucket, eventsKey(o.project, o.jobID)
+	}
+	path, err := eventsPath(o.jobID)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		j.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	}
+	if err != nil {
+		j.warn(err)
+	}
+	return j
+}
+
+func (j *eventJournal) warn(err error) {
+	if !j.warned {
+		fmt.Printf("Warning: failed to write the event journal: %v\n", err)
+		j.warned = true
+	}
+}
+
+// enter sets the phase later events are recorded in
+func (j *eventJournal) enter(phase string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.phase = phase
+}
+
+// record appends an event, stamped with the time and the current phase
+func (j *eventJournal) record(event jobEvent) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	event.Time = j.now().UTC().Format(time.RFC3339Nano)
+	if event.Phase == "" {
+		event.Phase = j.phase
+	}
+	line, err := json.Marshal(event)
+	if err == nil {
+		_, err = j.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		j.warn(err)
+		return
+	}
+	j.pending = true
+}
+
+// recordf appends an event with a formatted message
+func (j *eventJournal) recordf(eventType, format string, args ...any) {
+	j.record(jobEvent{Type: eventType, Message: fmt.Sprintf(format, args...)})
+}
+
+// sync copies the journal to the bucket, if the run has one and there is anything new
+func (j *eventJournal) sync(ctx context.Context) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.bucket == "" || j.file == nil || !j.pending {
+		return
+	}
+	data, err := os.ReadFile(j.file.Name())
+	if err == nil && j.s3 == nil {
+		j.s3, err = awsManager.NewS3Client(ctx, j.bucket)
+	}
+	if err == nil {
+		err = j.s3.UploadBytes(ctx, data, j.key)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to copy the event journal to s3://%s/%s: %v\n", j.bucket, j.key, err)
+		return
+	}
+	j.pending = false
+}
+
+// close copies the journal to the bucket a last time and closes it
+func (j *eventJournal) close(ctx context.Context) {
+	if j == nil {
+		return
+	}
+	j.sync(ctx)
+	if j.file != nil {
+		j.file.Close()
+	}
+}
+
+// parseEvents parses journal lines. A last line without its newline is still being
+// written, so it is left for the next read; the number of bytes consumed is returned.
+func parseEvents(data []byte) ([]jobEvent, int, error) {
+	var events []jobEvent
+	consumed := 0
+	for {
+		end := bytes.IndexByte(data[consumed:], '\n')
+		if end < 0 {
+			return events, consumed, nil
+		}
+		line := bytes.TrimSpace(data[consumed : consumed+end])
+		consumed += end + 1
+		if len(line) == 0 {
+			continue
+		}
+		var event jobEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return events, consumed, fmt.Errorf("invalid journal line %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+}
+
+// writeEvents prints events as a table, or as JSON lines
+func writeEvents(w io.Writer, events []jobEvent, asJSON bool) {
+	if asJSON {
+		for _, event := range events {
+			line, _ := json.Marshal(event)
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		return
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, event := range events {
+		rank := ""
+		if event.Rank != nil {
+			rank = fmt.Sprintf("rank %d", *event.Rank)
+		}
+		detail := strings.TrimSpace(strings.Join([]string{event.InstanceID, event.CommandID, event.Message}, " "))
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", event.Time, event.Phase, event.Type, rank, strings.Join(strings.Fields(detail), " "))
+	}
+	table.Flush()
+}
+
+// eventSource reads the whole journal of a job as it is now
+type eventSource func(ctx context.Context) ([]byte, error)
+
+func runEvents(ctx context.Context, o *eventsOptions) {
+	if err := validateJobID(o.jobID); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	var read eventSource
+	if o.bucket != "" {
+		project, err := resolveProject(o.project)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+		if err != nil {
+			fmt.Printf("Error creating S3 client: %v\n", err)
+			os.Exit(1)
+		}
+		key := eventsKey(project, o.jobID)
+		read = func(ctx context.Context) ([]byte, error) { return s3Client.DownloadBytes(ctx, key) }
+	} else {
+		path, err := eventsPath(o.jobID)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		read = func(context.Context) ([]byte, error) { return os.ReadFile(path) }
+	}
+
+	if err := followEvents(ctx, os.Stdout, read, o.follow, o.json, eventsPollInterval); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// followEvents prints the journal read returns and, with follow, keeps reading and
+// printing what was appended until an event ends the run or ctx is done. A journal that
+// does not exist yet is waited for when following.
+func followEvents(ctx context.Context, w io.Writer, read eventSource, follow, asJSON bool, interval time.Duration) error {
+	offset := 0
+	for {
+		data, err := read(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !(follow && offset == 0) {
+			return fmt.Errorf("failed to read the journal: %v", err)
+		}
+		if err == nil && len(data) >= offset {
+			events, consumed, err := parseEvents(data[offset:])
+			writeEvents(w, events, asJSON)
+			offset += consumed
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				if event.ends() {
+					return nil
+				}
+			}
+		}
+		if !follow || awsManager.SleepContext(ctx, interval) != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// cmd/events_test.go
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantTypes    []string
+		wantConsumed int
+		wantErr      bool
+	}{
+		{name: "empty", data: "", wantConsumed: 0},
+		{name: "complete lines", data: `{"type":"run-started"}` + "\n" + `{"type":"phase-started","phase":"discover"}` + "\n", wantTypes: []string{eventRunStarted, eventPhaseStarted}, wantConsumed: 67},
+		{name: "partial last line", data: `{"type":"run-started"}` + "\n" + `{"type":"pha`, wantTypes: []string{eventRunStarted}, wantConsumed: 23},
+		{name: "blank lines", data: "\n" + `{"type":"run-finished"}` + "\n\n", wantTypes: []string{eventRunFinished}, wantConsumed: 26},
+		{name: "invalid line", data: `{"type":"run-started"}` + "\nnot json\n", wantTypes: []string{eventRunStarted}, wantConsumed: 32, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, consumed, err := parseEvents([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			var types []string
+			for _, event := range events {
+				types = append(types, event.Type)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) || consumed != tt.wantConsumed {
+				t.Errorf("got %v, %d; want %v, %d", types, consumed, tt.wantTypes, tt.wantConsumed)
+			}
+		})
+	}
+}
+
+func TestWriteEvents(t *testing.T) {
+	rank := 1
+	events := []jobEvent{
+		{Time: "t1", Type: eventPhaseStarted, Phase: phaseExecute},
+		{Time: "t2", Type: eventRankFailed, Phase: phaseExecute, Rank: &rank, InstanceID: "i-1", Message: "Failed, exit code 2"},
+	}
+	tests := []struct {
+		name   string
+		asJSON bool
+		want   string
+	}{
+		{name: "table", want: "t1  execute  phase-started\nt2  execute  rank-failed    rank 1  i-1 Failed, exit code 2\n"},
+		{name: "json", asJSON: true, want: `{"time":"t1","type":"phase-started","phase":"execute"}` + "\n" +
+			`{"time":"t2","type":"rank-failed","phase":"execute","rank":1,"instance_id":"i-1","message":"Failed, exit code 2"}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeEvents(&b, events, tt.asJSON)
+			got := b.String()
+			if !tt.asJSON {
+				// tabwriter pads the empty last columns of the first line
+				var lines []string
+				for _, line := range strings.Split(got, "\n") {
+					lines = append(lines, strings.TrimRight(line, " "))
+				}
+				got = strings.Join(lines, "\n")
+			}
+			if got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFollowEvents(t *testing.T) {
+	started := `{"type":"run-started"}` + "\n"
+	tests := []struct {
+		name      string
+		reads     []string // What each read returns; "" is a journal that does not exist yet
+		follow    bool
+		cancelled bool // The command was interrupted while following
+		wantTypes int
+		wantReads int
+		wantErr   bool
+	}{
+		{name: "no follow", reads: []string{started}, wantTypes: 1, wantReads: 1},
+		{name: "missing journal", reads: []string{""}, wantErr: true, wantReads: 1},
+		{name: "follow until finished", follow: true, reads: []string{"", started, started + `{"type":"phase-st`, started + `{"type":"phase-started"}` + "\n" + `{"type":"run-finished"}` + "\n"}, wantTypes: 3, wantReads: 4},
+		{name: "follow until stopped", follow: true, reads: []string{started + `{"type":"run-stopped"}` + "\n"}, wantTypes: 2, wantReads: 1},
+		{name: "follow until interrupted", follow: true, cancelled: true, reads: []string{started}, wantTypes: 0, wantReads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			read := func(context.Context) ([]byte, error) {
+				data := tt.reads[min(reads, len(tt.reads)-1)]
+				reads++
+				if data == "" {
+					return nil, errors.New("no such file")
+				}
+				return []byte(data), nil
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+			var b bytes.Buffer
+			err := followEvents(ctx, &b, read, tt.follow, true, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if lines := strings.Count(b.String(), "\n"); lines != tt.wantTypes || reads != tt.wantReads {
+				t.Errorf("printed %d events in %d reads, want %d in %d:\n%s", lines, reads, tt.wantTypes, tt.wantReads, b.String())
+			}
+		})
+	}
+}
+
+func TestNilEventJournal(t *testing.T) {
+	var j *eventJournal
+	j.enter(phaseExecute)
+	j.recordf(eventRunStarted, "%d", 1)
+	j.sync(context.Background())
+	j.close(context.Background())
+}
+
+// journalTypes returns the phase and type of every event in the job's journal
+func journalTypes(t *testing.T, jobID string) []string {
+	t.Helper()
+	path, err := eventsPath(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, err := parseEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		if event.Time == "" {
+			t.Errorf("event %+v has no time", event)
+		}
+		types = append(types, strings.TrimPrefix(event.Phase+" "+event.Type, " "))
+	}
+	return types
+}
+
+func TestRunPipelineJournal(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath, o.numInstances = "job-1", "vpc-1", "./solver", 2
+	s := o.newRunState()
+
+	var ran []string
+	o.runPipeline(context.Background(), s, fakePhases(&ran, map[string]bool{phaseExecute: true}))
+	want := []string{
+		eventRunStarted,
+		"discover phase-started", "discover phase-completed",
+		"setup phase-started", "setup phase-completed",
+		"distribute phase-started", "distribute phase-completed",
+		"execute phase-started", "execute phase-failed", "execute run-failed",
+	}
+	if got := journalTypes(t, "job-1"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal after failing\n%v\nwant\n%v", got, want)
+	}
+
+	saved, err := loadRunState("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.runPipeline(context.Background(), saved, fakePhases(&ran, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, eventRunResumed,
+		"execute phase-started", "execute phase-completed",
+		"collect phase-started", "collect phase-completed",
+		eventRunFinished)
+	if got := journalTypes(t, "job-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("journal after resuming\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRunPipelineJournalStopAfter(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath, o.stopAfter = "job-1", "vpc-1", "./solver", phaseDiscover
+
+	var ran []string
+	if err := o.runPipeline(context.Background(), o.newRunState(), fakePhases(&ran, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{eventRunStarted, "discover phase-started", "discover phase-completed", "discover run-stopped"}
+	if got := journalTypes(t, "job-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("journal\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+// cmd/examples.go
+// This file implements the examples command, which runs the programs built into the
+// awsmpirun binary (see the examples package) on a cluster without any user code. The
+// binary stages a copy of itself in the job's S3 prefix, every rank downloads it and runs
+// the hidden "examples exec" subcommand, and rank 0's report is printed when the job ends.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/examples"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/spf13/cobra"
+)
+
+var examplesCmd = &cobra.Command{
+	Use:   "examples",
+	Short: "List and run the example programs built into awsmpirun",
+}
+
+var examplesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the built-in examples",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, example := range examples.All() {
+			fmt.Printf("%-8s %s (--size: %s, default %d)\n", example.Name, example.Summary, example.SizeHelp, example.DefaultSize)
+		}
+	},
+}
+
+// examplesRunOptions are the flags of examples run
+type examplesRunOptions struct {
+	project   string
+	vpc       string
+	instances int
+	bucket    string
+	binary    string
+	size      int
+}
+
+// newExamplesRunCmd returns examples run
+func newExamplesRunCmd() *cobra.Command {
+	o := &examplesRunOptions{}
+	cmd := &cobra.Command{
+		Use:   "run NAME",
+		Short: "Run a built-in example on the instances of a VPC",
+		Long: `run deploys one of the built-in examples, for example "awsmpirun examples run ring",
+to validate a new cluster. The awsmpirun binary is staged in the bucket under the job's
+prefix and downloaded by every rank, so the instances need the AWS CLI and read access
+to the bucket, as for --bucket runs. When awsmpirun itself does not run on Linux, pass
+--binary with a Linux build for the instances' architecture.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runExample(cmd.Context(), args[0], o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 2, "Number of EC2 instances")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "S3 bucket to stage the binary and the job manifest in (required)")
+	cmd.Flags().StringVar(&o.binary, "binary", "", "awsmpirun build to run on the instances (default: this binary, on Linux only)")
+	cmd.Flags().IntVar(&o.size, "size", 0, "Problem size of the example (0 uses its default; see examples list)")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+// examplesExecOptions are the flags of examples exec
+type examplesExecOptions struct {
+	size int
+}
+
+// newExamplesExecCmd returns examples exec
+func newExamplesExecCmd() *cobra.Command {
+	o := &examplesExecOptions{}
+	cmd := &cobra.Command{
+		Use:    "exec NAME",
+		Short:  "Run a built-in example as one rank of a job",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := examples.Run(args[0], o.size, os.Stdout); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().IntVar(&o.size, "size", 0, "Problem size of the example")
+	return cmd
+}
+
+func init() {
+	examplesCmd.AddCommand(examplesListCmd, newExamplesRunCmd(), newExamplesExecCmd())
+	rootCmd.AddCommand(examplesCmd)
+}
+
+func runExample(ctx context.Context, name string, e *examplesRunOptions) {
+	if _, ok := examples.Lookup(name); !ok {
+		fmt.Printf("Error: unknown example %q, see awsmpirun examples list\n", name)
+		os.Exit(1)
+	}
+	if e.size < 0 {
+		fmt.Printf("Error: --size must not be negative\n")
+		os.Exit(1)
+	}
+	if err := validateBucketName(e.bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	binary, err := exampleBinary(e.binary, runtime.GOOS)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(e.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	o := newRunOptions()
+	o.project = project
+	if o.jobID, err = newJobID(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	o.bucket = e.bucket
+	fmt.Printf("Job ID: %s\n", o.jobID)
+
+	// Pick the instances and run the example on them
+	instances, err := discoverInstances(ctx, e.vpc, o.project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) < e.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", e.instances, len(instances))
+		os.Exit(1)
+	}
+	selected := instances[:e.instances]
+	assignRanks(selected)
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := o.runExampleOn(ctx, ssmClient, binary, name, e.size, selected); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runExampleOn runs example name as the job of o on instances, which have their ranks,
+// and prints the output of rank 0 and of any failed rank. binary is the awsmpirun
+// build staged for the instances.
+func (o *runOptions) runExampleOn(ctx context.Context, ssmClient *ssm.Client, binary, name string, size int, instances []awsManager.InstanceInfo) error {
+	o.workDir = "/tmp/awsmpirun/{job_id}"
+
+	// Step 1: Stage the binary next to the job manifest
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	err = s3Client.UploadFile(ctx, binary, exampleBinaryKey(o.project, o.jobID))
+	if err != nil {
+		return fmt.Errorf("failed to stage binary: %v", err)
+	}
+	o.executablePath = exampleCommand(o.project, o.jobID, o.bucket, s3Client.Client.Options().Region, name, size)
+
+	// Step 2: Start the example on every instance
+	commandIDs, err := o.sendManifestCommands(ctx, ssmClient, instances)
+	if err != nil {
+		return fmt.Errorf("failed to start example: %v", err)
+	}
+
+	// Step 3: Wait for every rank, then print the output of rank 0 and of any failed rank
+	_, failures, err := waitForRanks(ctx, ssmClient, instances, commandIDs, nil)
+	if err != nil {
+		return err
+	}
+	report := instances[:1]
+	for _, failure := range failures {
+		if failure.Rank != 0 {
+			report = append(report, instances[failure.Rank])
+		}
+	}
+	outputs, err := runScriptOnInstances(ctx, ssmClient, report, func(awsManager.InstanceInfo) string {
+		return o.rankOutputScript()
+	})
+	for _, instance := range report {
+		fmt.Printf("Output from rank %d:\n%s", instance.InstanceRank, outputs[instance.InstanceID])
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read rank output: %v", err)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", summarizeFailures(failures))
+	}
+	return nil
+}
+
+// exampleBinary returns the local awsmpirun build to stage for the instances: the one
+// given with --binary, or this executable when it is a Linux build
+func exampleBinary(flagValue, goos string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if goos != "linux" {
+		return "", fmt.Errorf("this awsmpirun is built for %s; pass --binary with a Linux build for the instances", goos)
+	}
+	return os.Executable()
+}
+
+// exampleBinaryKey is the S3 key a job's copy of the awsmpirun binary is staged under
+func exampleBinaryKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/bin/awsmpirun"
+}
+
+// exampleCommand returns the run command that fetches the staged binary and runs the
+// example as the local rank
+func exampleCommand(project, jobID, bucket, bucketRegion, name string, size int) string {
+	return stagedBinaryCommand(project, jobID, bucket, bucketRegion, shellf("examples exec %s --size %d", name, size))
+}
+
+// stagedBinaryCommand returns the run command that fetches the staged binary and runs
+// it with args, which are already quoted for the shell
+func stagedBinaryCommand(project, jobID, bucket, bucketRegion, args string) string {
+	local := fmt.Sprintf("/tmp/awsmpirun/%s/awsmpirun", jobID)
+	return shellf("aws s3 cp s3://%s/%s %s --region %s --only-show-errors && chmod +x %[3]s && %[3]s %[5]s",
+		bucket, exampleBinaryKey(project, jobID), local, bucketRegion, shellExpr(args))
+}
+
+// rankOutputScript prints the output the rank's program left in the job's work directory
+func (o *runOptions) rankOutputScript() string {
+	script := newShellScript()
+	script.Linef("cat %s/output.txt", o.workDirValue())
+	return script.String()
+}
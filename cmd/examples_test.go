@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExampleBinary(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flagValue string
+		goos      string
+		want      string
+		wantErr   bool
+	}{
+		{flagValue: "/builds/awsmpirun-linux-arm64", goos: "darwin", want: "/builds/awsmpirun-linux-arm64"},
+		{flagValue: "/builds/awsmpirun-linux-amd64", goos: "linux", want: "/builds/awsmpirun-linux-amd64"},
+		{goos: "linux", want: self},
+		{goos: "windows", wantErr: true},
+		{goos: "darwin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := exampleBinary(tt.flagValue, tt.goos)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("exampleBinary(%q, %q) error = %v, wantErr %v", tt.flagValue, tt.goos, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("exampleBinary(%q, %q) = %q, want %q", tt.flagValue, tt.goos, got, tt.want)
+		}
+	}
+}
+
+// TestExampleCommandRunsStagedBinary runs the example command against a fake aws CLI
+// whose s3 cp writes a stand-in binary that prints its arguments
+func TestExampleCommandRunsStagedBinary(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	jobID := "test-" + filepath.Base(t.TempDir())
+	local := filepath.Dir(rankPIDFile(jobID))
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+
+	bin := t.TempDir()
+	fakeAWS := `#!/bin/bash
+[ "$1 $2 $3" = "s3 cp s3://staging/projects/team-a/jobs/` + jobID + `/bin/awsmpirun" ] || { echo "unexpected: $*" >&2; exit 1; }
+printf '#!/bin/bash\necho "$@"\n' > "$4"
+`
+	if err := os.WriteFile(filepath.Join(bin, "aws"), []byte(fakeAWS), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("bash", "-c", exampleCommand("team-a", jobID, "staging", "us-east-1", "matmul", 64))
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("example command failed: %v\n%s", err, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), "examples exec matmul --size 64"; got != want {
+		t.Errorf("staged binary ran with %q, want %q", got, want)
+	}
+}
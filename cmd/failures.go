@@ -0,0 +1,158 @@
+// cmd/failures.go
+// This file classifies the ranks of a run that did not succeed, so the failure summary
+// says whether to fix the code or the infrastructure. Every failed rank is put in one
+// class from its SSM status, its exit code, and the messages its script left on
+// stderr: infrastructure (the command never ran or the instance, credentials, or
+// network failed it), build (the program is missing, not executable, or not the one
+// the manifest pins), program (it crashed or exited non-zero), timeout, or cancelled.
+// The summary shows a table of the failed ranks and a verdict for the whole job.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// failureClass is what a rank failed of
+type failureClass string
+
+// The failure classes, most fundamental first: the verdict of a job is the first class
+// any of its ranks failed of, since the failures of the other ranks tend to follow from it
+const (
+	failureInfrastructure failureClass = "infrastructure"
+	failureBuild          failureClass = "build"
+	failureProgram        failureClass = "program"
+	failureTimeout        failureClass = "timeout"
+	failureCancelled      failureClass = "cancelled"
+)
+
+var failureClasses = []failureClass{failureInfrastructure, failureBuild, failureProgram, failureTimeout, failureCancelled}
+
+// failureAdvice is what the verdict of a job tells the user to do
+var failureAdvice = map[failureClass]string{
+	failureInfrastructure: "the instances, SSM, credentials, or network failed the run; fix the infrastructure, the program never got a fair run",
+	failureBuild:          "the program could not be started as built; fix the binary or its build",
+	failureProgram:        "the program failed; fix the code",
+	failureTimeout:        "a rank ran out of time; look for a hang, or allow more time",
+	failureCancelled:      "the run was cancelled",
+}
+
+// Messages on stderr that show a rank failed for reasons outside the program
+var infrastructureMessages = []string{
+	"is not in the job manifest",
+	"Unable to locate credentials",
+	"AccessDenied",
+	"ExpiredToken",
+	"Could not connect to the endpoint URL",
+	"No space left on device",
+	"Cannot allocate memory",
+	"Read-only file system",
+}
+
+// Messages on stderr that show the program was not the one expected
+var buildMessages = []string{
+	"the manifest pins",
+	"cannot check it against the manifest",
+	"exec format error",
+	"cannot execute binary file",
+}
+
+// rankFailure is a rank whose command did not succeed
+type rankFailure struct {
+	Rank       int
+	InstanceID string
+	Status     string
+	ExitCode   int // The exit code of the rank script; negative when it did not run or finish
+	Stderr     string
+}
+
+// classify returns the class of the failure and the reason for it
+func (f rankFailure) classify() (failureClass, string) {
+	switch f.Status {
+	case "Cancelled", "Cancelling":
+		return failureCancelled, "cancelled"
+	case "TimedOut", "ExecutionTimedOut":
+		return failureTimeout, "ran past the command timeout"
+	case "DeliveryTimedOut", "Undeliverable", "Terminated", "NotSent", "InvalidPlatform", "AccessDenied":
+		return failureInfrastructure, "SSM status " + f.Status
+	}
+	if crash, _ := parseCrashReport(f.Stderr); crash != "" {
+		return failureProgram, crash
+	}
+	for _, message := range infrastructureMessages {
+		if strings.Contains(f.Stderr, message) {
+			return failureInfrastructure, lastLine(f.Stderr)
+		}
+	}
+	for _, message := range buildMessages {
+		if strings.Contains(f.Stderr, message) {
+			return failureBuild, lastLine(f.Stderr)
+		}
+	}
+	switch {
+	case f.ExitCode < 0:
+		return failureInfrastructure, "the script did not run to completion"
+	case f.ExitCode == 127:
+		return failureBuild, "command not found"
+	case f.ExitCode == 126:
+		return failureBuild, "command not executable"
+	case f.ExitCode == 124:
+		return failureTimeout, "stopped by timeout"
+	}
+	if detail := lastLine(f.Stderr); detail != "" {
+		return failureProgram, detail
+	}
+	return failureProgram, "exited with code " + strconv.Itoa(f.ExitCode)
+}
+
+// jobVerdict returns the class the job failed of: the most fundamental class among its
+// failed ranks
+func jobVerdict(failures []rankFailure) failureClass {
+	found := make(map[failureClass]bool)
+	for _, failure := range failures {
+		class, _ := failure.classify()
+		found[class] = true
+	}
+	for _, class := range failureClasses {
+		if found[class] {
+			return class
+		}
+	}
+	return failureProgram
+}
+
+// summarizeFailures renders the verdict of the job, a table with the class of every
+// failed rank, and the crash reports the ranks uploaded
+func summarizeFailures(failures []rankFailure) string {
+	var b strings.Builder
+	verdict := jobVerdict(failures)
+	fmt.Fprintf(&b, "%d of the ranks failed. Verdict: %s: %s\n", len(failures), verdict, failureAdvice[verdict])
+
+	table := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  RANK\tINSTANCE\tCLASS\tSTATUS\tEXIT\tDETAIL")
+	var reports []string
+	for _, failure := range failures {
+		class, reason := failure.classify()
+		exit := "-"
+		if failure.ExitCode >= 0 {
+			exit = strconv.Itoa(failure.ExitCode)
+		}
+		fmt.Fprintf(table, "  %d\t%s\t%s\t%s\t%s\t%s\n", failure.Rank, failure.InstanceID, class, failure.Status, exit, reason)
+		if _, report := parseCrashReport(failure.Stderr); report != "" {
+			reports = append(reports, fmt.Sprintf("  crash report of rank %d: %s\n", failure.Rank, report))
+		}
+	}
+	table.Flush()
+	for _, report := range reports {
+		b.WriteString(report)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
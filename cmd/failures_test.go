@@ -0,0 +1,83 @@
+// cmd/failures_test.go
+
+package cmd
+
+import (
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		failure    rankFailure
+		wantClass  failureClass
+		wantReason string
+	}{
+		{name: "panic", failure: rankFailure{Status: "Failed", ExitCode: 2, Stderr: crashMarker + "panic: boom\n"}, wantClass: failureProgram, wantReason: "panic: boom"},
+		{name: "signal", failure: rankFailure{Status: "Failed", ExitCode: 137, Stderr: crashMarker + "killed by signal 9\n"}, wantClass: failureProgram, wantReason: "killed by signal 9"},
+		{name: "plain exit", failure: rankFailure{Status: "Failed", ExitCode: 3}, wantClass: failureProgram, wantReason: "exited with code 3"},
+		{name: "exit with message", failure: rankFailure{Status: "Failed", ExitCode: 1, Stderr: "warming up\nbad input\n"}, wantClass: failureProgram, wantReason: "bad input"},
+		{name: "not found", failure: rankFailure{Status: "Failed", ExitCode: 127}, wantClass: failureBuild, wantReason: "command not found"},
+		{name: "not executable", failure: rankFailure{Status: "Failed", ExitCode: 126}, wantClass: failureBuild, wantReason: "command not executable"},
+		{name: "pinned hash", failure: rankFailure{Status: "Failed", ExitCode: 1, Stderr: "./a.out has sha256 ab, the manifest pins cd\n"}, wantClass: failureBuild, wantReason: "./a.out has sha256 ab, the manifest pins cd"},
+		{name: "credentials", failure: rankFailure{Status: "Failed", ExitCode: 1, Stderr: "fatal error: Unable to locate credentials\n"}, wantClass: failureInfrastructure, wantReason: "fatal error: Unable to locate credentials"},
+		{name: "not in manifest", failure: rankFailure{Status: "Failed", ExitCode: 1, Stderr: "instance i-9 is not in the job manifest\n"}, wantClass: failureInfrastructure, wantReason: "instance i-9 is not in the job manifest"},
+		{name: "did not finish", failure: rankFailure{Status: "Failed", ExitCode: -1}, wantClass: failureInfrastructure, wantReason: "the script did not run to completion"},
+		{name: "undeliverable", failure: rankFailure{Status: "Undeliverable", ExitCode: -1}, wantClass: failureInfrastructure, wantReason: "SSM status Undeliverable"},
+		{name: "not sent", failure: rankFailure{Status: "NotSent", ExitCode: -1}, wantClass: failureInfrastructure, wantReason: "SSM status NotSent"},
+		{name: "timed out", failure: rankFailure{Status: "TimedOut", ExitCode: -1}, wantClass: failureTimeout, wantReason: "ran past the command timeout"},
+		{name: "timeout command", failure: rankFailure{Status: "Failed", ExitCode: 124}, wantClass: failureTimeout, wantReason: "stopped by timeout"},
+		{name: "cancelled", failure: rankFailure{Status: "Cancelled", ExitCode: -1, Stderr: crashMarker + "killed by signal 15\n"}, wantClass: failureCancelled, wantReason: "cancelled"},
+	}
+
+	for _, tt := range tests {
+		class, reason := tt.failure.classify()
+		if class != tt.wantClass || reason != tt.wantReason {
+			t.Errorf("%s: classify = %s, %q, want %s, %q", tt.name, class, reason, tt.wantClass, tt.wantReason)
+		}
+	}
+}
+
+func TestJobVerdict(t *testing.T) {
+	program := rankFailure{Status: "Failed", ExitCode: 1}
+	build := rankFailure{Status: "Failed", ExitCode: 127}
+	infrastructure := rankFailure{Status: "Undeliverable", ExitCode: -1}
+	timeout := rankFailure{Status: "TimedOut", ExitCode: -1}
+	cancelled := rankFailure{Status: "Cancelled", ExitCode: -1}
+	tests := []struct {
+		name     string
+		failures []rankFailure
+		want     failureClass
+	}{
+		{"program only", []rankFailure{program, program}, failureProgram},
+		{"one rank crashed, the others timed out waiting", []rankFailure{timeout, program, timeout}, failureProgram},
+		{"missing binary on one instance", []rankFailure{program, build}, failureBuild},
+		{"lost instance", []rankFailure{program, infrastructure, build}, failureInfrastructure},
+		{"cancelled", []rankFailure{cancelled, cancelled}, failureCancelled},
+		{"timeout over cancel", []rankFailure{cancelled, timeout}, failureTimeout},
+	}
+	for _, tt := range tests {
+		if got := jobVerdict(tt.failures); got != tt.want {
+			t.Errorf("%s: verdict = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeFailures(t *testing.T) {
+	failures := []rankFailure{
+		{Rank: 1, InstanceID: "i-1", Status: "Failed", ExitCode: 2, Stderr: crashMarker + "panic: boom\n" + crashReportMarker + "s3://b/jobs/j/crash/rank-1/\n"},
+		{Rank: 2, InstanceID: "i-2", Status: "Failed", ExitCode: 137, Stderr: crashMarker + "killed by signal 9\n"},
+		{Rank: 3, InstanceID: "i-3", Status: "TimedOut", ExitCode: -1, Stderr: "first\nlast line\n"},
+		{Rank: 4, InstanceID: "i-4", Status: "Cancelled", ExitCode: -1},
+	}
+	want := `4 of the ranks failed. Verdict: program: the program failed; fix the code
+  RANK  INSTANCE  CLASS      STATUS     EXIT  DETAIL
+  1     i-1       program    Failed     2     panic: boom
+  2     i-2       program    Failed     137   killed by signal 9
+  3     i-3       timeout    TimedOut   -     ran past the command timeout
+  4     i-4       cancelled  Cancelled  -     cancelled
+  crash report of rank 1: s3://b/jobs/j/crash/rank-1/`
+	if got := summarizeFailures(failures); got != want {
+		t.Errorf("summarizeFailures() =\n%s\nwant\n%s", got, want)
+	}
+}
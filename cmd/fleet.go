@@ -0,0 +1,262 @@
+// cmd/fleet.go
+// This file lets administrators who look after many teams' clusters work on all of them
+// from one place. A cluster is a project's instances in one VPC, the unit every other
+// command discovers; with --all-clusters, a cluster command finds every project-tagged
+// instance in the region instead of one project's, groups them into clusters, works on
+// the clusters concurrently (at most --parallel at a time), and ends with one line per
+// cluster. A cluster that fails does not stop the others, and the command exits
+// non-zero when any failed.
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/spf13/cobra"
+)
+
+// defaultClusterParallelism is how many clusters --all-clusters works on at once
+const defaultClusterParallelism = 8
+
+// clusterStatusOptions are the flags of cluster status
+type clusterStatusOptions struct {
+	project     string
+	vpc         string
+	allClusters bool
+	parallel    int
+}
+
+// newClusterStatusCmd returns cluster status
+func newClusterStatusCmd() *cobra.Command {
+	o := &clusterStatusOptions{}
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the instances of a cluster, or of every cluster with --all-clusters",
+		Long: `status counts the project's instances in the VPC by state and how many of the
+running ones are online in SSM, which is what a run needs. --all-clusters does this for
+every project and VPC in the region with awsmpirun:project tagged instances, checking
+--parallel clusters at a time, and prints one line per cluster.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runClusterStatus(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the cluster (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC of the cluster (required unless --all-clusters)")
+	cmd.Flags().BoolVar(&o.allClusters, "all-clusters", false, "Show every cluster in the region instead of one")
+	cmd.Flags().IntVar(&o.parallel, "parallel", defaultClusterParallelism, "Clusters to check at once with --all-clusters")
+	return cmd
+}
+
+func init() {
+	clusterCmd.AddCommand(newClusterStatusCmd())
+}
+
+// fleetCluster is a project's instances in one VPC
+type fleetCluster struct {
+	Project   string
+	VPC       string
+	Instances []ec2Types.Instance
+}
+
+// clusterResult is how an operation went on one cluster
+type clusterResult struct {
+	Cluster fleetCluster
+	Summary string
+	Err     error
+}
+
+// clusterOperation does one command's work on a cluster and summarizes the outcome
+type clusterOperation func(ctx context.Context, cluster fleetCluster) (string, error)
+
+// describeClusters returns the clusters of the instances that are not terminated,
+// either every project's (project and vpc empty) or the one cluster named
+func describeClusters(ctx context.Context, ec2Client *ec2.Client, project, vpc string) ([]fleetCluster, error) {
+	filters := []ec2Types.Filter{
+		{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		{Name: aws.String("tag-key"), Values: []string{projectTagKey}},
+	}
+	if project != "" {
+		filters = append(filters, ec2Types.Filter{Name: aws.String("tag:" + projectTagKey), Values: []string{project}})
+	}
+	if vpc != "" {
+		filters = append(filters, ec2Types.Filter{Name: aws.String("vpc-id"), Values: []string{vpc}})
+	}
+	var instances []ec2Types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{Filters: filters})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %v", err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	return groupClusters(instances), nil
+}
+
+// groupClusters groups instances by project and VPC, sorted by project and then VPC
+func groupClusters(instances []ec2Types.Instance) []fleetCluster {
+	index := make(map[[2]string]int)
+	var clusters []fleetCluster
+	for _, instance := range instances {
+		key := [2]string{instanceProject(instance), aws.ToString(instance.VpcId)}
+		i, ok := index[key]
+		if !ok {
+			i = len(clusters)
+			index[key] = i
+			clusters = append(clusters, fleetCluster{Project: key[0], VPC: key[1]})
+		}
+		clusters[i].Instances = append(clusters[i].Instances, instance)
+	}
+	slices.SortFunc(clusters, func(a, b fleetCluster) int {
+		return cmp.Or(cmp.Compare(a.Project, b.Project), cmp.Compare(a.VPC, b.VPC))
+	})
+	return clusters
+}
+
+// forEachCluster runs op on the clusters, at most parallel at a time, and returns the
+// results in the order of clusters
+func forEachCluster(ctx context.Context, clusters []fleetCluster, parallel int, op clusterOperation) []clusterResult {
+	results := make([]clusterResult, len(clusters))
+	slots := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		wg.Add(1)
+		go func(i int, cluster fleetCluster) {
+			defer wg.Done()
+			results[i].Cluster = cluster
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+			if err := ctx.Err(); err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Summary, results[i].Err = op(ctx, cluster)
+		}(i, cluster)
+	}
+	wg.Wait()
+	return results
+}
+
+// writeClusterResults prints one line per cluster and a total, and returns how many
+// clusters failed
+func writeClusterResults(w io.Writer, results []clusterResult) int {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PROJECT\tVPC\tINSTANCES\tRESULT")
+	failed := 0
+	for _, result := range results {
+		outcome := result.Summary
+		if result.Err != nil {
+			outcome = "FAILED: " + result.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\n", result.Cluster.Project, result.Cluster.VPC, len(result.Cluster.Instances), outcome)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "%d clusters, %d failed\n", len(results), failed)
+	return failed
+}
+
+func runClusterStatus(ctx context.Context, o *clusterStatusOptions) {
+	project, vpc := "", ""
+	if !o.allClusters {
+		if o.vpc == "" {
+			fmt.Println("Error: --vpc is required unless --all-clusters is given")
+			os.Exit(1)
+		}
+		var err error
+		if project, err = resolveProject(o.project); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		vpc = o.vpc
+	} else if o.vpc != "" || o.project != "" {
+		fmt.Println("Error: --all-clusters covers every project and VPC; drop --project and --vpc")
+		os.Exit(1)
+	}
+
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	clusters, err := describeClusters(ctx, ec2Client, project, vpc)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(clusters) == 0 {
+		fmt.Println("No clusters found")
+		return
+	}
+
+	results := forEachCluster(ctx, clusters, o.parallel, func(ctx context.Context, cluster fleetCluster) (string, error) {
+		var running []string
+		for _, instance := range cluster.Instances {
+			if instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameRunning {
+				running = append(running, aws.ToString(instance.InstanceId))
+			}
+		}
+		if len(running) == 0 {
+			return clusterStatusSummary(cluster.Instances, nil), nil
+		}
+		online, err := awsManager.SSMOnline(ctx, ssmClient, running)
+		if err != nil {
+			return "", err
+		}
+		return clusterStatusSummary(cluster.Instances, online), nil
+	})
+	if writeClusterResults(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// clusterStatusSummary counts instances by state, and the running ones online in SSM
+func clusterStatusSummary(instances []ec2Types.Instance, online map[string]bool) string {
+	states := make(map[string]int)
+	running, reachable := 0, 0
+	for _, instance := range instances {
+		state := "unknown"
+		if instance.State != nil {
+			state = string(instance.State.Name)
+		}
+		states[state]++
+		if state == string(ec2Types.InstanceStateNameRunning) {
+			running++
+			if online[aws.ToString(instance.InstanceId)] {
+				reachable++
+			}
+		}
+	}
+	var parts []string
+	for _, state := range sortedKeys(states) {
+		parts = append(parts, fmt.Sprintf("%d %s", states[state], state))
+	}
+	return fmt.Sprintf("%s; %d/%d online in SSM", strings.Join(parts, ", "), reachable, running)
+}
@@ -0,0 +1,199 @@
+// cmd/fleet_test.go
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fleetInstance returns an instance of project in vpc
+func fleetInstance(id, project, vpc string, state ec2Types.InstanceStateName) ec2Types.Instance {
+	return ec2Types.Instance{
+		InstanceId: aws.String(id),
+		VpcId:      aws.String(vpc),
+		State:      &ec2Types.InstanceState{Name: state},
+		Tags:       []ec2Types.Tag{{Key: aws.String(projectTagKey), Value: aws.String(project)}},
+	}
+}
+
+func TestGroupClusters(t *testing.T) {
+	running := ec2Types.InstanceStateNameRunning
+	instances := []ec2Types.Instance{
+		fleetInstance("i-1", "team-b", "vpc-1", running),
+		fleetInstance("i-2", "team-a", "vpc-2", running),
+		fleetInstance("i-3", "team-a", "vpc-1", running),
+		fleetInstance("i-4", "team-b", "vpc-1", ec2Types.InstanceStateNameStopped),
+	}
+	type cluster struct {
+		project, vpc string
+		ids          []string
+	}
+	want := []cluster{
+		{"team-a", "vpc-1", []string{"i-3"}},
+		{"team-a", "vpc-2", []string{"i-2"}},
+		{"team-b", "vpc-1", []string{"i-1", "i-4"}},
+	}
+	var got []cluster
+	for _, c := range groupClusters(instances) {
+		var ids []string
+		for _, instance := range c.Instances {
+			ids = append(ids, aws.ToString(instance.InstanceId))
+		}
+		got = append(got, cluster{c.Project, c.VPC, ids})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupClusters() = %v, want %v", got, want)
+	}
+	if got := groupClusters(nil); len(got) != 0 {
+		t.Errorf("groupClusters(nil) = %v", got)
+	}
+}
+
+func TestForEachCluster(t *testing.T) {
+	var clusters []fleetCluster
+	for i := range 10 {
+		clusters = append(clusters, fleetCluster{Project: fmt.Sprintf("p%d", i), VPC: "vpc-1"})
+	}
+	tests := []struct {
+		name     string
+		parallel int
+	}{
+		{name: "one at a time", parallel: 1},
+		{name: "three at a time", parallel: 3},
+		{name: "all at once", parallel: 20},
+		{name: "zero means one", parallel: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var active, peak atomic.Int32
+			results := forEachCluster(context.Background(), clusters, tt.parallel, func(ctx context.Context, cluster fleetCluster) (string, error) {
+				n := active.Add(1)
+				defer active.Add(-1)
+				for {
+					old := peak.Load()
+					if n <= old || peak.CompareAndSwap(old, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				if cluster.Project == "p4" {
+					return "", errors.New("boom")
+				}
+				return "ok " + cluster.Project, nil
+			})
+			if limit := int32(max(tt.parallel, 1)); peak.Load() > limit {
+				t.Errorf("%d clusters ran at once, want at most %d", peak.Load(), limit)
+			}
+			for i, result := range results {
+				if result.Cluster.Project != clusters[i].Project {
+					t.Fatalf("result %d is for %s, want %s", i, result.Cluster.Project, clusters[i].Project)
+				}
+				if i == 4 {
+					if result.Err == nil {
+						t.Errorf("failed cluster has no error")
+					}
+					continue
+				}
+				if result.Err != nil || result.Summary != "ok "+clusters[i].Project {
+					t.Errorf("result %d = %q, %v", i, result.Summary, result.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestForEachClusterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	clusters := []fleetCluster{{Project: "a"}, {Project: "b"}}
+	var calls atomic.Int32
+	results := forEachCluster(ctx, clusters, 1, func(ctx context.Context, cluster fleetCluster) (string, error) {
+		calls.Add(1)
+		return "", ctx.Err()
+	})
+	for _, result := range results {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("%s: error = %v, want context.Canceled", result.Cluster.Project, result.Err)
+		}
+	}
+	if calls.Load() > 0 {
+		t.Errorf("%d operations started after cancellation", calls.Load())
+	}
+}
+
+func TestWriteClusterResults(t *testing.T) {
+	running := ec2Types.InstanceStateNameRunning
+	results := []clusterResult{
+		{Cluster: fleetCluster{Project: "team-a", VPC: "vpc-1", Instances: []ec2Types.Instance{fleetInstance("i-1", "team-a", "vpc-1", running)}}, Summary: "1 running"},
+		{Cluster: fleetCluster{Project: "team-b", VPC: "vpc-2"}, Err: errors.New("AccessDenied")},
+	}
+	var out bytes.Buffer
+	if failed := writeClusterResults(&out, results); failed != 1 {
+		t.Errorf("writeClusterResults() = %d failed, want 1", failed)
+	}
+	want := `PROJECT  VPC    INSTANCES  RESULT
+team-a   vpc-1  1          1 running
+team-b   vpc-2  0          FAILED: AccessDenied
+2 clusters, 1 failed
+`
+	if out.String() != want {
+		t.Errorf("writeClusterResults() printed\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestClusterStatusSummary(t *testing.T) {
+	running := ec2Types.InstanceStateNameRunning
+	tests := []struct {
+		name      string
+		instances []ec2Types.Instance
+		online    map[string]bool
+		want      string
+	}{
+		{
+			name: "mixed",
+			instances: []ec2Types.Instance{
+				fleetInstance("i-1", "p", "v", running),
+				fleetInstance("i-2", "p", "v", running),
+				fleetInstance("i-3", "p", "v", ec2Types.InstanceStateNameStopped),
+				fleetInstance("i-4", "p", "v", ec2Types.InstanceStateNamePending),
+			},
+			online: map[string]bool{"i-1": true, "i-3": true},
+			want:   "1 pending, 2 running, 1 stopped; 1/2 online in SSM",
+		},
+		{
+			name:      "nothing running",
+			instances: []ec2Types.Instance{fleetInstance("i-1", "p", "v", ec2Types.InstanceStateNameStopped)},
+			want:      "1 stopped; 0/0 online in SSM",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterStatusSummary(tt.instances, tt.online); got != tt.want {
+				t.Errorf("clusterStatusSummary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkGroupClusters(b *testing.B) {
+	var instances []ec2Types.Instance
+	for i := range 5000 {
+		instances = append(instances, fleetInstance(fmt.Sprintf("i-%d", i), fmt.Sprintf("team-%d", i%50), fmt.Sprintf("vpc-%d", i%7), ec2Types.InstanceStateNameRunning))
+	}
+	b.ResetTimer()
+	for range b.N {
+		if len(groupClusters(instances)) == 0 {
+			b.Fatal("no clusters")
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// cmd/gitsource.go
+// This file implements Git sources: with --git and --ref, build and run check out a
+// commit of a Git repository on the instances instead of staging local files. The ref,
+// a branch, tag, or commit, is resolved to a commit once, on the first instance, and
+// every instance then fetches only that commit, with a shallow fetch, so the ranks
+// agree on the code even if a branch moves meanwhile. A run records the commit in its
+// manifest, so --from-manifest and resume-phase check out the same one.
+//
+// Private repositories are reached over HTTPS with a token kept in a Secrets Manager
+// secret named by --git-secret. The instances read it themselves and hand it to git in
+// an HTTP header through the environment of the checkout alone, so the token is never
+// written to disk, put on a command line, or seen by the program.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/spf13/pflag"
+)
+
+// gitSourceDir is the directory under the work directory a run checks its Git source
+// out in
+const gitSourceDir = "source"
+
+var (
+	commitPattern     = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	gitRefPattern     = regexp.MustCompile(`^[A-Za-z0-9._/+@-]+$`)
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9/_+=.@-]{1,512}$`)
+)
+
+// gitSource is a commit of a Git repository to check out on the instances
+type gitSource struct {
+	url    string
+	ref    string // Branch, tag, or commit; empty for the default branch
+	secret string // Secrets Manager secret with an access token; empty for a public repository
+	commit string // What ref resolved to, once resolve has run
+}
+
+// bindFlags binds --git, --ref, and --git-secret to g
+func (g *gitSource) bindFlags(flags *pflag.FlagSet, checkout string) {
+	flags.StringVar(&g.url, "git", g.url, "HTTPS URL of a Git repository to check out "+checkout+" instead of using local files")
+	flags.StringVar(&g.ref, "ref", g.ref, "Branch, tag, or commit of --git to check out (default: the repository's default branch)")
+	flags.StringVar(&g.secret, "git-secret", g.secret, `Secrets Manager secret the instances read an access token for --git from, as "TOKEN" or "USER:TOKEN"`)
+}
+
+// enabled reports whether a repository was given
+func (g *gitSource) enabled() bool {
+	return g.url != ""
+}
+
+// validate rejects a repository, ref, or secret the checkout script cannot use
+func (g *gitSource) validate() error {
+	if !g.enabled() {
+		if g.ref != "" || g.secret != "" {
+			return fmt.Errorf("--ref and --git-secret need --git")
+		}
+		return nil
+	}
+	u, err := url.Parse(g.url)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("--git must be an https:// repository URL, got %q", g.url)
+	}
+	if u.User != nil {
+		return fmt.Errorf("--git must not carry credentials, keep them in the secret named by --git-secret")
+	}
+	if g.ref != "" && (!gitRefPattern.MatchString(g.ref) || strings.HasPrefix(g.ref, "-") || strings.Contains(g.ref, "..")) {
+		return fmt.Errorf("invalid --ref %q", g.ref)
+	}
+	if g.secret != "" && !secretNamePattern.MatchString(g.secret) {
+		return fmt.Errorf("invalid --git-secret %q", g.secret)
+	}
+	if g.commit != "" && !commitPattern.MatchString(g.commit) {
+		return fmt.Errorf("invalid Git commit %q", g.commit)
+	}
+	return nil
+}
+
+// pinned returns the commit to check out: the resolved one, or the ref itself when it
+// names a full commit. It is empty until a branch or tag has been resolved.
+func (g *gitSource) pinned() string {
+	if g.commit != "" {
+		return g.commit
+	}
+	if commitPattern.MatchString(g.ref) {
+		return g.ref
+	}
+	return ""
+}
+
+// spec records g in a run manifest
+func (g *gitSource) spec() *gitSourceSpec {
+	if !g.enabled() {
+		return nil
+	}
+	return &gitSourceSpec{URL: g.url, Ref: g.ref, Commit: g.pinned(), Secret: g.secret}
+}
+
+// resolve finds the commit g's ref names, asking the repository from instance so a
+// private one is read with the instances' access to the secret
+func (g *gitSource) resolve(ctx context.Context, ssmClient *ssm.Client, instance awsManager.InstanceInfo, region string) error {
+	if g.pinned() != "" {
+		g.commit = g.pinned()
+		return nil
+	}
+	outputs, err := runScriptOnInstances(ctx, ssmClient, []awsManager.InstanceInfo{instance}, func(awsManager.InstanceInfo) string {
+		return g.resolveScript(region)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the refs of %s: %v", g.url, err)
+	}
+	commit, err := parseLsRemote(outputs[instance.InstanceID], g.ref)
+	if err != nil {
+		return fmt.Errorf("%s: %v", g.url, err)
+	}
+	g.commit = commit
+	return nil
+}
+
+// writeCredentials appends the lines that let git reach the repository: a token from
+// the secret, sent as basic authentication, and no prompt for a password git would
+// wait on forever
+func (g *gitSource) writeCredentials(script *shellScript, region string) {
+	script.Export("GIT_TERMINAL_PROMPT", 0)
+	if g.secret == "" {
+		return
+	}
+	script.Linef(`GIT_TOKEN=$(aws secretsmanager get-secret-value --secret-id %s --region %s --query SecretString --output text)`, g.secret, region)
+	script.Raw(`case "$GIT_TOKEN" in
+  *:*) ;;
+  *) GIT_TOKEN="x-access-token:$GIT_TOKEN" ;;
+esac
+export GIT_CONFIG_COUNT=1 GIT_CONFIG_KEY_0=http.extraHeader
+export GIT_CONFIG_VALUE_0="Authorization: Basic $(printf '%s' "$GIT_TOKEN" | base64 -w 0)"
+unset GIT_TOKEN`)
+}
+
+// resolveScript lists the refs that may be g's ref, for parseLsRemote
+func (g *gitSource) resolveScript(region string) string {
+	script := newShellScript()
+	script.Raw("set -eo pipefail")
+	g.writeCredentials(script, region)
+	if g.ref == "" {
+		script.Linef("git ls-remote -- %s HEAD", g.url)
+	} else {
+		script.Linef("git ls-remote -- %s %s %s", g.url, g.ref, g.ref+"^{}")
+	}
+	return script.String()
+}
+
+// parseLsRemote picks the commit ref names from git ls-remote output. A tag is
+// followed to the commit it points to, and a tag wins over a branch of the same name,
+// as it does for git checkout.
+func parseLsRemote(output, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		commit, name, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if ok && commitPattern.MatchString(commit) {
+			refs[name] = commit
+		}
+	}
+	for _, name := range []string{ref, "refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref} {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+	if len(ref) < 40 && strings.Trim(ref, "0123456789abcdef") == "" {
+		return "", fmt.Errorf("no branch or tag %q; give commits as all 40 hex digits", ref)
+	}
+	return "", fmt.Errorf("no branch or tag %q", ref)
+}
+
+// writeCheckout appends the lines that check g's commit out in dir with a shallow
+// fetch, and stop the script if that fails. The credentials only live in the subshell
+// that fetches.
+func (g *gitSource) writeCheckout(script *shellScript, dir, region string) {
+	commit := g.pinned()
+	script.Raw("(")
+	script.Raw("set -eo pipefail")
+	g.writeCredentials(script, region)
+	script.Linef("rm -rf %[1]s && git init -q %[1]s", dir)
+	script.Linef("git -C %s fetch -q --depth 1 -- %s %s", dir, g.url, commit)
+	script.Linef("git -C %s -c advice.detachedHead=false checkout -q FETCH_HEAD", dir)
+	script.Linef(") || { echo %s >&2; exit 1; }", fmt.Sprintf("failed to check out %s of %s", commit, g.url))
+	script.Linef("echo %s", fmt.Sprintf("checked out %s of %s", commit, g.url))
+}
+
+// writeSourceCheckout appends the lines that check out the run's Git source in the
+// work directory and export its path, if the run has one
+func (o *runOptions) writeSourceCheckout(script *shellScript, region string) {
+	if !o.git.enabled() {
+		return
+	}
+	o.git.writeCheckout(script, gitSourceDir, region)
+	script.Raw(`export MPI_SOURCE_DIR="$MPI_WORK_DIR/` + gitSourceDir + `"`)
+}
+
+// resolveGitSource resolves the run's Git source on rank 0 and records the commit in
+// the run's manifest
+func (o *runOptions) resolveGitSource(ctx context.Context, s *runState) error {
+	if o.git.pinned() == "" {
+		ssmClientCreator := awsManager.SSMClientCreator{}
+		ssmClient, err := ssmClientCreator.CreateClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create SSM client: %v", err)
+		}
+		if err := o.git.resolve(ctx, ssmClient, s.instances[0], ssmClient.Options().Region); err != nil {
+			return err
+		}
+	}
+	o.git.commit = o.git.pinned()
+	fmt.Printf("Checking out %s at %s\n", o.git.url, o.git.commit)
+	s.Run.Program.Git = o.git.spec()
+	return nil
+}
@@ -0,0 +1,99 @@
+// cmd/goruntime.go
+// This file tunes the Go runtime of the ranks to the instance they run on. Go sizes
+// GOMAXPROCS to every CPU and collects the heap with no memory limit, which is right
+// for one process per machine but not for several ranks sharing an instance, where
+// the ranks overrun each other's CPUs and memory. The launch script works out on each
+// instance, from its vCPUs, its memory, and the ranks per instance, a GOMAXPROCS, a
+// GOMEMLIMIT, and a GOGC for the rank, unless the instance's environment, --env, or
+// the --gomaxprocs, --gogc, and --gomemlimit flags set them; "default" leaves a
+// variable to Go.
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// goRuntimeDefault is the flag value that leaves a runtime variable unset
+const goRuntimeDefault = "default"
+
+// goMemoryReserveMiB is the least memory of an instance left for the OS, the SSM
+// agent, and memory outside the Go heap; the reserve is a tenth of larger instances
+const goMemoryReserveMiB = 256
+
+// goLargeHeapMiB is the memory limit from which a rank collects at GOGC=200, trading
+// memory the limit still bounds for fewer collections
+const goLargeHeapMiB = 2048
+
+var goMemLimitPattern = regexp.MustCompile(`^[0-9]+(B|KiB|MiB|GiB|TiB)?$`)
+
+// validateGoRuntime rejects values of the runtime flags Go would ignore
+func (o *runOptions) validateGoRuntime() error {
+	if v := o.goMaxProcs; v != "" && v != goRuntimeDefault {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return fmt.Errorf("--gomaxprocs must be a positive number or %q, got %q", goRuntimeDefault, v)
+		}
+	}
+	if v := o.goGC; v != "" && v != goRuntimeDefault && v != "off" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			return fmt.Errorf("--gogc must be a percentage, \"off\", or %q, got %q", goRuntimeDefault, v)
+		}
+	}
+	if v := o.goMemLimit; v != "" && v != goRuntimeDefault && v != "off" && !goMemLimitPattern.MatchString(v) {
+		return fmt.Errorf("--gomemlimit must be a size such as 3GiB, \"off\", or %q, got %q", goRuntimeDefault, v)
+	}
+	return nil
+}
+
+// ranksPerNode is how many ranks of the job share each instance
+func (o *runOptions) ranksPerNode() int {
+	if o.launcher != launcherNative {
+		return max(o.slotsPerNode, 1)
+	}
+	return 1
+}
+
+// goRuntimeVariables returns the runtime variables the job sets, to forward to the
+// processes mpirun starts
+func (o *runOptions) goRuntimeVariables() []string {
+	var names []string
+	for _, v := range []struct{ name, value string }{{"GOMAXPROCS", o.goMaxProcs}, {"GOGC", o.goGC}, {"GOMEMLIMIT", o.goMemLimit}} {
+		if v.value != goRuntimeDefault {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// writeGoRuntimeEnv exports the rank's runtime variables: the flag values as given,
+// and the rest derived on the instance where nothing set them before. GOMAXPROCS is
+// the rank's share of the vCPUs, GOMEMLIMIT its share of the memory left after the
+// reserve, or off on an instance too small to leave any, and GOGC 200 from
+// goLargeHeapMiB up and 100 below. With Open MPI the script runs on the first
+// instance only and mpirun forwards its values to every rank.
+func (o *runOptions) writeGoRuntimeEnv(script *shellScript) {
+	perNode := o.ranksPerNode()
+	for _, v := range []struct{ name, value string }{{"GOMAXPROCS", o.goMaxProcs}, {"GOGC", o.goGC}, {"GOMEMLIMIT", o.goMemLimit}} {
+		if v.value != "" && v.value != goRuntimeDefault {
+			script.Export(v.name, v.value)
+		}
+	}
+	if o.goMaxProcs == "" {
+		script.Linef(`GO_VCPUS=$(nproc)`)
+		script.Linef(`export GOMAXPROCS="${GOMAXPROCS:-$(( GO_VCPUS / %d > 1 ? GO_VCPUS / %[1]d : 1 ))}"`, perNode)
+	}
+	if o.goMemLimit != "" && o.goGC != "" {
+		return
+	}
+	script.Linef(`GO_MEM_MIB=$(( $(awk '/^MemTotal:/ {print $2}' /proc/meminfo) / 1024 ))`)
+	script.Linef(`GO_RANK_MIB=$(( (GO_MEM_MIB - (GO_MEM_MIB / 10 > %d ? GO_MEM_MIB / 10 : %[1]d)) / %d ))`, goMemoryReserveMiB, perNode)
+	if o.goMemLimit == "" {
+		script.Raw(`if [ "$GO_RANK_MIB" -gt 0 ]; then GO_LIMIT="${GO_RANK_MIB}MiB"; else GO_LIMIT=off; fi
+export GOMEMLIMIT="${GOMEMLIMIT:-$GO_LIMIT}"`)
+	}
+	if o.goGC == "" {
+		script.Linef(`export GOGC="${GOGC:-$(( GO_RANK_MIB >= %d ? 200 : 100 ))}"`, goLargeHeapMiB)
+	}
+}
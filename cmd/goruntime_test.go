@@ -0,0 +1,169 @@
+// cmd/goruntime_test.go
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateGoRuntime(t *testing.T) {
+	tests := []struct {
+		maxProcs, gc, memLimit string
+		wantErr                string
+	}{
+		{},
+		{maxProcs: "4", gc: "50", memLimit: "3GiB"},
+		{maxProcs: "default", gc: "default", memLimit: "default"},
+		{gc: "off", memLimit: "off"},
+		{gc: "0", memLimit: "1073741824"},
+		{maxProcs: "0", wantErr: "--gomaxprocs"},
+		{maxProcs: "four", wantErr: "--gomaxprocs"},
+		{gc: "-1", wantErr: "--gogc"},
+		{memLimit: "3GB", wantErr: "--gomemlimit"},
+		{memLimit: "-1", wantErr: "--gomemlimit"},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.goMaxProcs, o.goGC, o.goMemLimit = tt.maxProcs, tt.gc, tt.memLimit
+		err := o.validateGoRuntime()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %v", tt, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: error = %v, want %q", tt, err, tt.wantErr)
+		}
+	}
+}
+
+// instanceSize returns the vCPUs and MiB of memory of the machine the tests run on, as
+// the launch script reads them
+func instanceSize(t *testing.T) (int, int) {
+	t.Helper()
+	if _, err := exec.LookPath("nproc"); err != nil {
+		t.Skip("no nproc available")
+	}
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		t.Skip("no /proc/meminfo available")
+	}
+	out, err := exec.Command("nproc").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcpus, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	var kib int
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "MemTotal:" {
+			kib, _ = strconv.Atoi(fields[1])
+		}
+	}
+	return vcpus, kib / 1024
+}
+
+func TestWriteGoRuntimeEnv(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	vcpus, memMiB := instanceSize(t)
+	derived := func(perNode int) map[string]string {
+		limit := (memMiB - max(memMiB/10, goMemoryReserveMiB)) / perNode
+		env := map[string]string{"GOMAXPROCS": strconv.Itoa(max(vcpus/perNode, 1)), "GOMEMLIMIT": "off", "GOGC": "100"}
+		if limit > 0 {
+			env["GOMEMLIMIT"] = fmt.Sprintf("%dMiB", limit)
+		}
+		if limit >= goLargeHeapMiB {
+			env["GOGC"] = "200"
+		}
+		return env
+	}
+
+	tests := []struct {
+		name                   string
+		openMPI                bool
+		slots                  int
+		maxProcs, gc, memLimit string
+		env                    []string // Environment the instance already has
+		want                   map[string]string
+	}{
+		{name: "derived", want: derived(1)},
+		{name: "shared instance", openMPI: true, slots: 4, want: derived(4)},
+		{name: "more ranks than vCPUs", openMPI: true, slots: 4 * vcpus, want: derived(4 * vcpus)},
+		{
+			name:     "flags",
+			maxProcs: "3", gc: "off", memLimit: "5GiB",
+			want: map[string]string{"GOMAXPROCS": "3", "GOGC": "off", "GOMEMLIMIT": "5GiB"},
+		},
+		{
+			name: "set on the instance",
+			env:  []string{"GOMAXPROCS=7", "GOGC=30", "GOMEMLIMIT=1GiB"},
+			want: map[string]string{"GOMAXPROCS": "7", "GOGC": "30", "GOMEMLIMIT": "1GiB"},
+		},
+		{
+			name:     "flags over the instance",
+			maxProcs: "2",
+			env:      []string{"GOMAXPROCS=7"},
+			want:     map[string]string{"GOMAXPROCS": "2", "GOGC": derived(1)["GOGC"], "GOMEMLIMIT": derived(1)["GOMEMLIMIT"]},
+		},
+		{
+			name:     "go defaults",
+			maxProcs: "default", gc: "default", memLimit: "default",
+			want: map[string]string{"GOMAXPROCS": "", "GOGC": "", "GOMEMLIMIT": ""},
+		},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		if tt.openMPI {
+			o.launcher, o.slotsPerNode = launcherOpenMPI, tt.slots
+		}
+		o.goMaxProcs, o.goGC, o.goMemLimit = tt.maxProcs, tt.gc, tt.memLimit
+		script := newShellScript()
+		o.writeGoRuntimeEnv(script)
+		script.Raw(`echo "$GOMAXPROCS,$GOGC,$GOMEMLIMIT"`)
+
+		cmd := exec.Command("bash", "-c", script.String())
+		cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, tt.env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: script failed: %v\n%s", tt.name, err, out)
+		}
+		values := strings.Split(strings.TrimSpace(string(out)), ",")
+		got := map[string]string{"GOMAXPROCS": values[0], "GOGC": values[1], "GOMEMLIMIT": values[2]}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMpirunScriptForwardsGoRuntime(t *testing.T) {
+	tests := []struct {
+		maxProcs, gc, memLimit string
+		want                   []string
+	}{
+		{want: []string{"GOMAXPROCS", "GOGC", "GOMEMLIMIT"}},
+		{maxProcs: "8", gc: "default", want: []string{"GOMAXPROCS", "GOMEMLIMIT"}},
+		{maxProcs: "default", gc: "default", memLimit: "default"},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.launcher, o.jobID, o.executablePath = launcherOpenMPI, "job-test", "./a.out"
+		o.goMaxProcs, o.goGC, o.goMemLimit = tt.maxProcs, tt.gc, tt.memLimit
+		if got := o.goRuntimeVariables(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: forwarded %v, want %v", tt, got, tt.want)
+		}
+		script := o.mpirunScript(nil, "us-west-2")
+		for _, name := range tt.want {
+			if !strings.Contains(script, "'-x' '"+name+"'") {
+				t.Errorf("%+v: mpirun does not forward %s:\n%s", tt, name, script)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// cmd/hosts.go
+// This file implements the export-hosts command, which writes an inventory of the
+// instances awsmpirun manages in a format other tools read: a machinefile for mpirun
+// and awsmpirun mpirun -hostfile, an Ansible INI inventory, or an ssh_config. The hosts
+// are the instances of the project in a VPC, ranked the way a run would rank them, or
+// the instances of a past job as its run manifest recorded them.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/spf13/cobra"
+)
+
+// Formats export-hosts can write
+const (
+	hostsMachinefile = "machinefile"
+	hostsAnsible     = "ansible"
+	hostsSSHConfig   = "ssh-config"
+)
+
+// exportHostsOptions are the flags of export-hosts
+type exportHostsOptions struct {
+	project   string
+	vpc       string
+	jobID     string
+	instances int
+	format    string
+	slots     int
+	user      string
+	viaSSM    bool
+	output    string
+}
+
+// newExportHostsCmd returns export-hosts
+func newExportHostsCmd() *cobra.Command {
+	o := &exportHostsOptions{}
+	cmd := &cobra.Command{
+		Use:   "export-hosts",
+		Short: "Write the cluster's hosts as a machinefile, Ansible inventory, or ssh_config",
+		Long: `export-hosts lists the instances of the cluster with their ranks, instance IDs, and
+private IPs, so Ansible playbooks or plain ssh loops can run against the same machines
+awsmpirun uses. With --vpc the running instances of the project are ranked as a run
+would rank them; with --job the instances come from the job's run manifest on this
+machine. With --via-ssm the ssh_config reaches every host through an SSM session
+instead of its IP, so no inbound SSH rule is needed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runExportHosts(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID to list the instances of")
+	cmd.Flags().StringVar(&o.jobID, "job", "", "List the instances of this job instead, from its run manifest")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 0, "List only the first N instances, like a run with -n N (0 lists all)")
+	cmd.Flags().StringVar(&o.format, "format", hostsMachinefile, "Output format: machinefile, ansible, or ssh-config")
+	cmd.Flags().IntVar(&o.slots, "slots", 0, "Slots per host written to the machinefile (0 leaves them out)")
+	cmd.Flags().StringVar(&o.user, "user", "", "Login user for the ansible and ssh-config formats")
+	cmd.Flags().BoolVar(&o.viaSSM, "via-ssm", false, "Reach the hosts through SSM sessions in the ssh-config and ansible formats")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "File to write the inventory to (default: standard output)")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newExportHostsCmd())
+}
+
+func runExportHosts(ctx context.Context, o *exportHostsOptions) {
+	if (o.vpc == "") == (o.jobID == "") {
+		fmt.Printf("Error: pass either --vpc or --job\n")
+		os.Exit(1)
+	}
+	if o.instances < 0 || o.slots < 0 {
+		fmt.Printf("Error: --num-instances and --slots must not be negative\n")
+		os.Exit(1)
+	}
+
+	var instances []awsManager.InstanceInfo
+	var err error
+	if o.jobID != "" {
+		instances, err = jobHosts(o.jobID)
+	} else {
+		instances, err = clusterHosts(ctx, o.vpc, o.project)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.instances > 0 {
+		if len(instances) < o.instances {
+			fmt.Printf("Error: only %d instances available, %d requested\n", len(instances), o.instances)
+			os.Exit(1)
+		}
+		instances = instances[:o.instances]
+	}
+
+	inventory, err := renderHosts(o.format, instances, hostExport{slots: o.slots, user: o.user, viaSSM: o.viaSSM})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.output == "" {
+		fmt.Print(inventory)
+		return
+	}
+	if err := os.WriteFile(o.output, []byte(inventory), 0o644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", o.output, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d hosts to %s\n", len(instances), o.output)
+}
+
+// clusterHosts returns the running instances of project in the VPC, in rank order
+func clusterHosts(ctx context.Context, vpcID, project string) ([]awsManager.InstanceInfo, error) {
+	project, err := resolveProject(project)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := discoverInstances(ctx, vpcID, project)
+	if err != nil {
+		return nil, err
+	}
+	assignRanks(instances)
+	return instances, nil
+}
+
+// jobHosts returns the instances of a job as its local run manifest records them
+func jobHosts(jobID string) ([]awsManager.InstanceInfo, error) {
+	if err := validateJobID(jobID); err != nil {
+		return nil, err
+	}
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "jobs", jobID, "job.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("no run manifest for job %s: %v", jobID, err)
+	}
+	d, err := parseRunDescriptor(data)
+	if err != nil {
+		return nil, err
+	}
+	return descriptorInstances(d), nil
+}
+
+// hostExport holds the format options of an inventory
+type hostExport struct {
+	slots  int    // Slots per machinefile line; 0 leaves them out
+	user   string // Login user
+	viaSSM bool   // Connect through SSM sessions instead of the private IPs
+}
+
+// renderHosts writes instances in format. Hosts are named rank<N> wherever the format
+// has names, so "ssh rank0" and "ansible rank0" reach the same machine.
+func renderHosts(format string, instances []awsManager.InstanceInfo, options hostExport) (string, error) {
+	var b strings.Builder
+	switch format {
+	case hostsMachinefile:
+		for _, instance := range instances {
+			line := instance.PrivateIP
+			if options.slots > 0 {
+				line += fmt.Sprintf(" slots=%d", options.slots)
+			}
+			fmt.Fprintf(&b, "%s # rank %d, %s\n", line, instance.InstanceRank, instance.InstanceID)
+		}
+	case hostsAnsible:
+		b.WriteString("[awsmpirun]\n")
+		for _, instance := range instances {
+			host := instance.PrivateIP
+			if options.viaSSM {
+				host = instance.InstanceID
+			}
+			fmt.Fprintf(&b, "rank%d ansible_host=%s instance_id=%s private_ip=%s mpi_rank=%d\n",
+				instance.InstanceRank, host, instance.InstanceID, instance.PrivateIP, instance.InstanceRank)
+		}
+		if options.user != "" || options.viaSSM {
+			b.WriteString("\n[awsmpirun:vars]\n")
+		}
+		if options.user != "" {
+			fmt.Fprintf(&b, "ansible_user=%s\n", options.user)
+		}
+		if options.viaSSM {
+			fmt.Fprintf(&b, "ansible_ssh_common_args='-o ProxyCommand=\"%s\"'\n", ssmProxyCommand("%h"))
+		}
+	case hostsSSHConfig:
+		for i, instance := range instances {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "# rank %d, %s\nHost rank%d\n", instance.InstanceRank, instance.InstanceID, instance.InstanceRank)
+			if options.viaSSM {
+				fmt.Fprintf(&b, "  HostName %s\n  ProxyCommand %s\n", instance.InstanceID, ssmProxyCommand("%h"))
+			} else {
+				fmt.Fprintf(&b, "  HostName %s\n", instance.PrivateIP)
+			}
+			if options.user != "" {
+				fmt.Fprintf(&b, "  User %s\n", options.user)
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown format %q, expected machinefile, ansible, or ssh-config", format)
+	}
+	return b.String(), nil
+}
+
+// ssmProxyCommand is the ssh ProxyCommand that opens an SSH session to target over SSM
+func ssmProxyCommand(target string) string {
+	return "aws ssm start-session --target " + target + " --document-name AWS-StartSSHSession --parameters portNumber=%p"
+}
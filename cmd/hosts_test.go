@@ -0,0 +1,73 @@
+// cmd/hosts_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenderHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		options hostExport
+		want    string
+	}{
+		{"machinefile", hostsMachinefile, hostExport{},
+			"10.0.0.1 # rank 0, i-0\n10.0.0.2 # rank 1, i-1\n"},
+		{"machinefile with slots", hostsMachinefile, hostExport{slots: 4},
+			"10.0.0.1 slots=4 # rank 0, i-0\n10.0.0.2 slots=4 # rank 1, i-1\n"},
+		{"ansible", hostsAnsible, hostExport{user: "ec2-user"},
+			"[awsmpirun]\n" +
+				"rank0 ansible_host=10.0.0.1 instance_id=i-0 private_ip=10.0.0.1 mpi_rank=0\n" +
+				"rank1 ansible_host=10.0.0.2 instance_id=i-1 private_ip=10.0.0.2 mpi_rank=1\n" +
+				"\n[awsmpirun:vars]\nansible_user=ec2-user\n"},
+		{"ansible via ssm", hostsAnsible, hostExport{viaSSM: true},
+			"[awsmpirun]\n" +
+				"rank0 ansible_host=i-0 instance_id=i-0 private_ip=10.0.0.1 mpi_rank=0\n" +
+				"rank1 ansible_host=i-1 instance_id=i-1 private_ip=10.0.0.2 mpi_rank=1\n" +
+				"\n[awsmpirun:vars]\n" +
+				"ansible_ssh_common_args='-o ProxyCommand=\"aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p\"'\n"},
+		{"ssh-config", hostsSSHConfig, hostExport{user: "ec2-user"},
+			"# rank 0, i-0\nHost rank0\n  HostName 10.0.0.1\n  User ec2-user\n" +
+				"\n# rank 1, i-1\nHost rank1\n  HostName 10.0.0.2\n  User ec2-user\n"},
+		{"ssh-config via ssm", hostsSSHConfig, hostExport{viaSSM: true},
+			"# rank 0, i-0\nHost rank0\n  HostName i-0\n" +
+				"  ProxyCommand aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p\n" +
+				"\n# rank 1, i-1\nHost rank1\n  HostName i-1\n" +
+				"  ProxyCommand aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p\n"},
+	}
+	for _, tt := range tests {
+		got, err := renderHosts(tt.format, testInstances(), tt.options)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := renderHosts("csv", testInstances(), hostExport{}); err == nil {
+		t.Error("renderHosts accepted an unknown format")
+	}
+}
+
+func TestMachinefileReadsBack(t *testing.T) {
+	inventory, err := renderHosts(hostsMachinefile, testInstances(), hostExport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(inventory), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := readHostfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("hosts = %v", hosts)
+	}
+}
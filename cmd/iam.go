@@ -0,0 +1,716 @@
+// cmd/iam.go
+// This file implements the iam print-policy command, which prints the IAM policies a
+// command needs so they can be reviewed and applied up front. Each policy lists only
+// the API calls awsmpirun and the runtime library actually make, scoped to the bucket,
+// table, VPC, and tags given on the command line where the services allow it.
+
+package cmd
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/spf13/cobra"
+)
+
+// Commands print-policy can describe. provision and teardown are the launch and
+// terminate halves of stress.
+const (
+	policyForRun        = "run"
+	policyForProvision  = "provision"
+	policyForTeardown   = "teardown"
+	policyForProfile    = "profile"
+	policyForTunnel     = "tunnel"
+	policyForProvenance = "provenance"
+	policyForStepFuncs  = "stepfunctions"
+	policyForAdopt      = "adopt"
+	policyForSchedule   = "schedule"
+	policyForResults    = "results"
+	policyForReport     = "report"
+	policyForQuickstart = "quickstart"
+	policyForTransfer   = "transfer"
+)
+
+var iamCmd = &cobra.Command{
+	Use:   "iam",
+	Short: "Inspect the IAM permissions awsmpirun needs",
+}
+
+// printPolicyOptions are the flags of iam print-policy
+type printPolicyOptions struct {
+	command      string
+	region       string
+	account      string
+	project      string
+	vpc          string
+	bucket       string
+	kvTable      string
+	tag          string
+	instanceRole string
+	chaos        bool
+	encrypt      bool
+	targetByTag  bool
+	checkNetwork bool
+	jobGroup     bool
+	compliance   bool
+	metrics      bool
+	deadline     string
+	codeBuild    string
+	scheduleRole string
+	gitSecret    string
+}
+
+// newIAMPrintPolicyCmd returns iam print-policy
+func newIAMPrintPolicyCmd() *cobra.Command {
+	o := &printPolicyOptions{}
+	cmd := &cobra.Command{
+		Use:   "print-policy",
+		Short: "Print the IAM policies required for a command",
+		Long: `print-policy prints a JSON object with two IAM policy documents: "operator", for
+the credentials awsmpirun runs with, and "instance", for the instance profile of the
+instances the ranks run on. Pass the same bucket, table, and VPC the command will use
+so the policies are scoped to them; anything left out is matched with a wildcard.
+
+--for run covers the root command, mpirun, and migrate. --for provision and --for
+teardown cover launching and terminating instances in stress, and are scoped to
+instances carrying the --tag key (awsmpirun:stress by default). --for profile and
+--for tunnel cover the port-forwarding sessions of those commands, which --debug-rank
+also opens. --for provenance covers reading object metadata and run manifests from
+--bucket. --for stepfunctions covers the role of a state machine from export-sfn,
+scoped to --codebuild-project. --for adopt covers checking instances and tagging them
+with --project in cluster adopt. --for schedule covers installing, listing, and
+deleting the EventBridge rules of schedule, passing them --schedule-role, and reading
+the history jobs list shows from --bucket. --for results covers reading the result
+manifests and results of jobs in --bucket in results ls and merge. --for report covers
+reading the usage records of --project, or of every project, from --bucket. --for
+quickstart covers quickstart and its teardown: the VPC, subnet, internet gateway,
+security group, instances, and bucket it creates, all tagged awsmpirun:quickstart;
+pass --bucket when it stages the job in an existing bucket. --for transfer covers cp
+and sync: staging files in --bucket, removing those a sync no longer needs, and the
+scripts that copy them on the instances. --deadline-action adds what a run with --deadline
+does when the deadline passes, --encrypt-payloads storing the payload key of a run and
+the ranks reading it, --target-by-tag tagging the instances of a run and
+tracking the command sent to the tag, --check-network reading the security groups and
+network ACLs that explain blocked rank pairs, --git-secret the instances reading the
+token of a private --git repository, --job-security-group creating the
+security group of a job, adding it to the instances, and deleting it, --metrics publishing the job statistics
+of a run to CloudWatch, and --compliance, for run, provision, and adopt, reading what a
+compliance policy checks. --project scopes the instances to
+the project's awsmpirun:project tag, unless --tag is given, and the staged objects to
+the project's prefix in the bucket.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runPrintPolicy(o)
+		},
+	}
+	cmd.Flags().StringVar(&o.command, "for", "", "Command to print the policies for: run, provision, teardown, profile, tunnel, provenance, stepfunctions, adopt, schedule, results, report, quickstart, or transfer (required)")
+	cmd.Flags().StringVar(&o.region, "region", os.Getenv("AWS_REGION"), "Region the command runs in (default: AWS_REGION, or any region)")
+	cmd.Flags().StringVar(&o.account, "account", "*", "Account ID the resources belong to")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the command runs in")
+	cmd.Flags().StringVar(&o.vpc, "vpc", "", "VPC ID instances are launched into")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Staging bucket passed as --bucket")
+	cmd.Flags().StringVar(&o.kvTable, "kv-table", "", "Table passed as --kv-table")
+	cmd.Flags().StringVar(&o.tag, "tag", "", "Only allow acting on instances with this tag, as KEY or KEY=VALUE")
+	cmd.Flags().StringVar(&o.instanceRole, "instance-role", "*", "Name of the role behind the instance profile, for iam:PassRole")
+	cmd.Flags().BoolVar(&o.chaos, "chaos", false, "Include the permissions --chaos faults need")
+	cmd.Flags().BoolVar(&o.encrypt, "encrypt-payloads", false, "Include the permissions --encrypt-payloads needs to store the job's payload key and the ranks to read it")
+	cmd.Flags().BoolVar(&o.targetByTag, "target-by-tag", false, "Include the permissions --target-by-tag needs")
+	cmd.Flags().BoolVar(&o.checkNetwork, "check-network", false, "Include the permissions --check-network needs to explain blocked rank pairs")
+	cmd.Flags().BoolVar(&o.jobGroup, "job-security-group", false, "Include the permissions --job-security-group needs to create, attach, and delete the job's security group")
+	cmd.Flags().BoolVar(&o.compliance, "compliance", false, "Include the permissions checking a compliance policy needs")
+	cmd.Flags().BoolVar(&o.metrics, "metrics", false, "Include the permissions --metrics needs to publish job statistics")
+	cmd.Flags().StringVar(&o.codeBuild, "codebuild-project", "*", "CodeBuild project the steps of an export-sfn state machine run in")
+	cmd.Flags().StringVar(&o.scheduleRole, "schedule-role", "*", "Name of the role schedule rules start their builds with, for iam:PassRole")
+	cmd.Flags().StringVar(&o.gitSecret, "git-secret", "", "Include the permissions the instances need to read the --git-secret of build or run")
+	cmd.Flags().StringVar(&o.deadline, "deadline-action", "", "Include the permissions --deadline needs with this --deadline-action: cancel, stop, or terminate")
+	cmd.MarkFlagRequired("for")
+	return cmd
+}
+
+func init() {
+	iamCmd.AddCommand(newIAMPrintPolicyCmd())
+	rootCmd.AddCommand(iamCmd)
+}
+
+func runPrintPolicy(o *printPolicyOptions) {
+	scope := policyScope{
+		Region:       o.region,
+		Account:      o.account,
+		VPC:          o.vpc,
+		Bucket:       o.bucket,
+		KVTable:      o.kvTable,
+		InstanceRole: o.instanceRole,
+		Chaos:        o.chaos,
+		Encrypt:      o.encrypt,
+		TargetByTag:  o.targetByTag,
+		CheckNetwork: o.checkNetwork,
+		JobGroup:     o.jobGroup,
+		Compliance:   o.compliance,
+		Metrics:      o.metrics,
+
+		DeadlineAction:   o.deadline,
+		CodeBuildProject: o.codeBuild,
+		ScheduleRole:     o.scheduleRole,
+		GitSecret:        o.gitSecret,
+	}
+	if scope.Region == "" {
+		scope.Region = "*"
+	}
+	switch scope.DeadlineAction {
+	case "", deadlineCancel, deadlineStop, deadlineTerminate:
+	default:
+		fmt.Printf("Error: --deadline-action must be cancel, stop, or terminate, got %q\n", scope.DeadlineAction)
+		os.Exit(1)
+	}
+	if o.tag != "" {
+		scope.TagKey, scope.TagValue, _ = strings.Cut(o.tag, "=")
+		if scope.TagKey == "" {
+			fmt.Printf("Error: --tag needs a key, got %q\n", o.tag)
+			os.Exit(1)
+		}
+	}
+	if o.project != "" {
+		if err := validateProjectName(o.project); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		scope.Project = o.project
+		if o.tag == "" {
+			scope.TagKey, scope.TagValue = projectTagKey, o.project
+		}
+	}
+
+	policies, err := buildPolicies(o.command, scope)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding policies: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
+
+// policyScope is what the printed policies are restricted to
+type policyScope struct {
+	Region       string
+	Account      string
+	Project      string
+	VPC          string
+	Bucket       string
+	KVTable      string
+	TagKey       string
+	TagValue     string // Empty allows any value of TagKey
+	InstanceRole string
+	Chaos        bool
+	Encrypt      bool // Runs use --encrypt-payloads
+	TargetByTag  bool
+	CheckNetwork bool
+	JobGroup     bool // Runs use --job-security-group
+	Compliance   bool // A compliance policy is in force
+	Metrics      bool
+
+	DeadlineAction   string // Empty when runs have no deadline
+	CodeBuildProject string
+	ScheduleRole     string
+	GitSecret        string // Secret with the token of a private --git repository
+}
+
+// policySet holds the policies for both sides of a command
+type policySet struct {
+	Operator *policyDocument `json:"operator"`
+	Instance *policyDocument `json:"instance,omitempty"`
+}
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+func newPolicy(statements ...policyStatement) *policyDocument {
+	return &policyDocument{Version: "2012-10-17", Statement: statements}
+}
+
+func allow(sid string, actions, resources []string, condition map[string]map[string]string) policyStatement {
+	return policyStatement{Sid: sid, Effect: "Allow", Action: actions, Resource: resources, Condition: condition}
+}
+
+// buildPolicies returns the operator and instance policies needed by command
+func buildPolicies(command string, scope policyScope) (policySet, error) {
+	switch command {
+	case policyForRun:
+		return policySet{Operator: runOperatorPolicy(scope), Instance: instancePolicy(scope)}, nil
+	case policyForProvision:
+		if scope.TagKey == "" {
+			scope.TagKey = stressTagKey
+		}
+		return policySet{Operator: provisionOperatorPolicy(scope), Instance: instancePolicy(scope)}, nil
+	case policyForTeardown:
+		if scope.TagKey == "" {
+			scope.TagKey = stressTagKey
+		}
+		return policySet{Operator: teardownOperatorPolicy(scope)}, nil
+	case policyForProfile, policyForTunnel:
+		return policySet{Operator: portForwardOperatorPolicy(scope)}, nil
+	case policyForProvenance:
+		return policySet{Operator: provenanceOperatorPolicy(scope)}, nil
+	case policyForStepFuncs:
+		return policySet{Operator: stepFunctionsPolicy(scope)}, nil
+	case policyForAdopt:
+		return policySet{Operator: adoptOperatorPolicy(scope)}, nil
+	case policyForSchedule:
+		return policySet{Operator: scheduleOperatorPolicy(scope)}, nil
+	case policyForResults:
+		return policySet{Operator: newPolicy(allow("ReadResults", []string{"s3:GetObject"}, scope.jobObjects(), nil))}, nil
+	case policyForReport:
+		return policySet{Operator: reportOperatorPolicy(scope)}, nil
+	case policyForQuickstart:
+		if scope.TagKey == "" {
+			scope.TagKey = quickstartTagKey
+		}
+		ownBucket := scope.Bucket == ""
+		if ownBucket {
+			scope.Bucket = "awsmpirun-qs-*"
+		}
+		return policySet{Operator: quickstartOperatorPolicy(scope, ownBucket), Instance: instancePolicy(scope)}, nil
+	case policyForTransfer:
+		return policySet{Operator: transferOperatorPolicy(scope), Instance: instancePolicy(scope)}, nil
+	}
+	return policySet{}, fmt.Errorf("unknown command %q, expected run, provision, teardown, profile, tunnel, provenance, stepfunctions, adopt, schedule, results, report, quickstart, or transfer", command)
+}
+
+func (s policyScope) ec2ARN(resource string) string {
+	return fmt.Sprintf("arn:aws:ec2:%s:%s:%s", s.Region, s.Account, resource)
+}
+
+// tagCondition restricts a statement to resources carrying the scope's tag, using
+// the condition key prefix of the service evaluating it
+func (s policyScope) tagCondition(prefix string) map[string]map[string]string {
+	if s.TagKey == "" {
+		return nil
+	}
+	key := prefix + "/" + s.TagKey
+	if s.TagValue == "" {
+		return map[string]map[string]string{"Null": {key: "false"}}
+	}
+	return map[string]map[string]string{"StringEquals": {key: s.TagValue}}
+}
+
+// jobsPrefix is the S3 prefix the jobs of the scope's project live under
+func (s policyScope) jobsPrefix() string {
+	return strings.TrimSuffix(mpi.JobPrefix(s.Project, ""), "/")
+}
+
+// jobObjects are the staging objects the manifest, launch script, and checkpoints live in
+func (s policyScope) jobObjects() []string {
+	return []string{fmt.Sprintf("arn:aws:s3:::%s/%s/*", s.Bucket, s.jobsPrefix())}
+}
+
+// buildCacheObjects are the Go build caches awsmpirun build restores and saves
+func (s policyScope) buildCacheObjects() []string {
+	return []string{fmt.Sprintf("arn:aws:s3:::%s/%s/*", s.Bucket, buildCachePrefix(s.Project))}
+}
+
+// payloadKeyParameters are the SSM parameters the payload keys of the jobs are kept in
+func (s policyScope) payloadKeyParameters() []string {
+	return []string{fmt.Sprintf("arn:aws:ssm:%s:%s:parameter/awsmpirun/%s/*", s.Region, s.Account, s.jobsPrefix())}
+}
+
+// usageObjects are the usage records of the scope's project, or of every project
+// when the scope has none
+func (s policyScope) usageObjects() []string {
+	if s.Project == "" {
+		return []string{
+			fmt.Sprintf("arn:aws:s3:::%s/%s*", s.Bucket, usageRoot("")),
+			fmt.Sprintf("arn:aws:s3:::%s/projects/*/usage/*", s.Bucket),
+		}
+	}
+	return []string{fmt.Sprintf("arn:aws:s3:::%s/%s*", s.Bucket, usageRoot(s.Project))}
+}
+
+func (s policyScope) kvTableARN() []string {
+	return []string{fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s", s.Region, s.Account, s.KVTable)}
+}
+
+func runOperatorPolicy(scope policyScope) *policyDocument {
+	policy := newPolicy(
+		allow("DiscoverInstances", []string{"ec2:DescribeInstances"}, []string{"*"}, nil),
+		allow("RunShellScript", []string{"ssm:SendCommand"},
+			[]string{fmt.Sprintf("arn:aws:ssm:%s::document/AWS-RunShellScript", scope.Region)}, nil),
+		allow("RunOnInstances", []string{"ssm:SendCommand"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("ssm:resourceTag")),
+		allow("ReadCommandOutput", []string{"ssm:GetCommandInvocation"}, []string{"*"}, nil),
+	)
+	if scope.Bucket != "" {
+		policy.Statement = append(policy.Statement,
+			allow("StageJob", []string{"s3:PutObject", "s3:GetObject"}, scope.jobObjects(), nil),
+			allow("IndexResults", []string{"s3:ListBucket"}, []string{"arn:aws:s3:::" + scope.Bucket},
+				map[string]map[string]string{"StringLike": {"s3:prefix": scope.jobsPrefix() + "/*"}}),
+			allow("RecordUsage", []string{"s3:PutObject"}, scope.usageObjects(), nil))
+	}
+	if scope.KVTable != "" {
+		policy.Statement = append(policy.Statement,
+			allow("PrepareKVTable", []string{"dynamodb:DescribeTable", "dynamodb:CreateTable"}, scope.kvTableARN(), nil))
+	}
+	if scope.Encrypt {
+		policy.Statement = append(policy.Statement,
+			allow("StorePayloadKey", []string{"ssm:PutParameter", "ssm:DeleteParameter"}, scope.payloadKeyParameters(), nil))
+	}
+	if scope.Chaos {
+		policy.Statement = append(policy.Statement,
+			allow("ChaosStopRank", []string{"ec2:StopInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:ResourceTag")))
+	}
+	if scope.TargetByTag {
+		// Only the cluster tag may be set, on instances the rest of the policy covers
+		tagging := scope.tagCondition("aws:ResourceTag")
+		if tagging == nil {
+			tagging = make(map[string]map[string]string)
+		}
+		tagging["ForAllValues:StringEquals"] = map[string]string{"aws:TagKeys": clusterTagKey}
+		policy.Statement = append(policy.Statement,
+			allow("TagCluster", []string{"ec2:CreateTags"}, []string{scope.ec2ARN("instance/*")}, tagging),
+			allow("TrackTargetedCommands", []string{"ssm:ListCommands", "ssm:ListCommandInvocations"}, []string{"*"}, nil))
+	}
+	if scope.CheckNetwork {
+		policy.Statement = append(policy.Statement,
+			allow("ExplainBlockedPairs", []string{"ec2:DescribeSecurityGroups", "ec2:DescribeNetworkAcls"}, []string{"*"}, nil))
+	}
+	if scope.JobGroup {
+		policy.Statement = append(policy.Statement, jobSecurityGroupStatements(scope)...)
+	}
+	if scope.Compliance {
+		policy.Statement = append(policy.Statement, complianceStatement())
+	}
+	if scope.Metrics {
+		// PutMetricData has no resources; the namespace is the only thing to scope
+		policy.Statement = append(policy.Statement,
+			allow("PublishJobMetrics", []string{"cloudwatch:PutMetricData"}, []string{"*"},
+				map[string]map[string]string{"StringEquals": {"cloudwatch:namespace": metricsNamespace}}))
+	}
+	if scope.DeadlineAction != "" {
+		policy.Statement = append(policy.Statement,
+			allow("CancelAtDeadline", []string{"ssm:CancelCommand"}, []string{"*"}, nil))
+	}
+	switch scope.DeadlineAction {
+	case deadlineStop:
+		policy.Statement = append(policy.Statement,
+			allow("StopAtDeadline", []string{"ec2:StopInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:ResourceTag")))
+	case deadlineTerminate:
+		policy.Statement = append(policy.Statement,
+			allow("TerminateAtDeadline", []string{"ec2:TerminateInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:ResourceTag")))
+	}
+	return policy
+}
+
+// jobSecurityGroupStatements let a run create its job's security group, tagged with
+// the job, and change and delete only groups tagged that way
+func jobSecurityGroupStatements(scope policyScope) []policyStatement {
+	var network map[string]map[string]string
+	if scope.VPC != "" {
+		network = map[string]map[string]string{"StringEquals": {"ec2:Vpc": scope.ec2ARN("vpc/" + scope.VPC)}}
+	}
+	tagged := map[string]map[string]string{"Null": {"aws:ResourceTag/" + jobTagKey: "false"}}
+	return []policyStatement{
+		allow("CreateJobSecurityGroup", []string{"ec2:CreateSecurityGroup"}, []string{scope.ec2ARN("security-group/*")},
+			map[string]map[string]string{"Null": {"aws:RequestTag/" + jobTagKey: "false"}}),
+		allow("CreateJobSecurityGroupInVPC", []string{"ec2:CreateSecurityGroup"}, []string{scope.ec2ARN("vpc/*")}, network),
+		allow("TagJobSecurityGroup", []string{"ec2:CreateTags"}, []string{scope.ec2ARN("security-group/*")},
+			map[string]map[string]string{"StringEquals": {"ec2:CreateAction": "CreateSecurityGroup"}}),
+		allow("ManageJobSecurityGroup", []string{
+			"ec2:AuthorizeSecurityGroupIngress",
+			"ec2:AuthorizeSecurityGroupEgress",
+			"ec2:RevokeSecurityGroupEgress",
+			"ec2:DeleteSecurityGroup",
+		}, []string{scope.ec2ARN("security-group/*")}, tagged),
+		// Changing an interface's groups is checked against the interface and every group
+		allow("AttachJobSecurityGroup", []string{"ec2:ModifyNetworkInterfaceAttribute"},
+			[]string{scope.ec2ARN("network-interface/*"), scope.ec2ARN("security-group/*")}, nil),
+		allow("FindJobSecurityGroup", []string{"ec2:DescribeSecurityGroups", "ec2:DescribeNetworkInterfaces"}, []string{"*"}, nil),
+	}
+}
+
+// reportOperatorPolicy lists and reads the usage records report rolls up, and with no
+// project lists the projects too
+func reportOperatorPolicy(scope policyScope) *policyDocument {
+	list := func(sid, prefix string) policyStatement {
+		return allow(sid, []string{"s3:ListBucket"}, []string{"arn:aws:s3:::" + scope.Bucket},
+			map[string]map[string]string{"StringLike": {"s3:prefix": prefix}})
+	}
+	policy := newPolicy(
+		list("ListUsage", usageRoot(scope.Project)+"*"),
+		allow("ReadUsage", []string{"s3:GetObject"}, scope.usageObjects(), nil))
+	if scope.Project == "" {
+		policy.Statement = append(policy.Statement,
+			list("ListProjects", "projects/"),
+			list("ListProjectUsage", "projects/*/usage/*"))
+	}
+	return policy
+}
+
+// quickstartOperatorPolicy covers what quickstart does: launching instances like
+// provision, running the example like run, and creating, changing, and deleting only the
+// network resources and bucket tagged for a quickstart. ownBucket adds creating and
+// deleting the buckets quickstart names for itself.
+func quickstartOperatorPolicy(scope policyScope, ownBucket bool) *policyDocument {
+	network := []string{
+		scope.ec2ARN("vpc/*"),
+		scope.ec2ARN("subnet/*"),
+		scope.ec2ARN("internet-gateway/*"),
+		scope.ec2ARN("security-group/*"),
+	}
+	var inVPC map[string]map[string]string
+	if scope.VPC != "" {
+		inVPC = map[string]map[string]string{"StringEquals": {"ec2:Vpc": scope.ec2ARN("vpc/" + scope.VPC)}}
+	}
+
+	policy := runOperatorPolicy(scope)
+	policy.Statement = append(policy.Statement, provisionOperatorPolicy(scope).Statement...)
+	policy.Statement = append(policy.Statement, teardownOperatorPolicy(scope).Statement...)
+	policy.Statement = append(policy.Statement,
+		allow("FindAmazonLinux", []string{"ssm:GetParameter"},
+			[]string{fmt.Sprintf("arn:aws:ssm:%s::parameter/aws/service/ami-amazon-linux-latest/*", scope.Region)}, nil),
+		allow("ChooseNetwork", []string{
+			"ec2:DescribeVpcs",
+			"ec2:DescribeSubnets",
+			"ec2:DescribeRouteTables",
+			"ec2:DescribeInstanceTypes",
+			"ec2:DescribeInstanceTypeOfferings",
+			"ec2:DescribeNetworkInterfaces",
+		}, []string{"*"}, nil),
+		allow("CreateNetwork", []string{"ec2:CreateVpc", "ec2:CreateSubnet", "ec2:CreateInternetGateway", "ec2:CreateSecurityGroup"},
+			network, scope.tagCondition("aws:RequestTag")),
+		// A subnet and a group are created in a VPC, which the request does not tag
+		allow("CreateInVPC", []string{"ec2:CreateSubnet", "ec2:CreateSecurityGroup"}, []string{scope.ec2ARN("vpc/*")}, inVPC),
+		allow("TagNetwork", []string{"ec2:CreateTags"}, network,
+			map[string]map[string]string{"StringLike": {"ec2:CreateAction": "Create*"}}),
+		allow("ManageNetwork", []string{
+			"ec2:ModifyVpcAttribute",
+			"ec2:ModifySubnetAttribute",
+			"ec2:AttachInternetGateway",
+			"ec2:DetachInternetGateway",
+			"ec2:CreateRoute",
+			"ec2:AuthorizeSecurityGroupIngress",
+			"ec2:DeleteSecurityGroup",
+			"ec2:DeleteInternetGateway",
+			"ec2:DeleteSubnet",
+			"ec2:DeleteVpc",
+		}, network, scope.tagCondition("aws:ResourceTag")),
+		// The default route goes in the new VPC's main route table, which is not
+		// tagged; ManageNetwork lets it lead only to a quickstart's gateway
+		allow("RouteToInternet", []string{"ec2:CreateRoute"}, []string{scope.ec2ARN("route-table/*")}, nil),
+	)
+	if ownBucket {
+		policy.Statement = append(policy.Statement,
+			allow("ManageBucket", []string{"s3:CreateBucket", "s3:PutBucketTagging", "s3:ListBucket", "s3:DeleteBucket"},
+				[]string{"arn:aws:s3:::" + scope.Bucket}, nil),
+			allow("EmptyBucket", []string{"s3:DeleteObject"}, []string{fmt.Sprintf("arn:aws:s3:::%s/*", scope.Bucket)}, nil))
+	}
+	return policy
+}
+
+func provisionOperatorPolicy(scope policyScope) *policyDocument {
+	// RunInstances checks the network resources it touches separately from the
+	// instance, which is where the VPC can be pinned
+	var network map[string]map[string]string
+	if scope.VPC != "" {
+		network = map[string]map[string]string{"StringEquals": {"ec2:Vpc": scope.ec2ARN("vpc/" + scope.VPC)}}
+	}
+
+	policy := newPolicy(
+		allow("LaunchTaggedInstances", []string{"ec2:RunInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:RequestTag")),
+		allow("LaunchIntoVPC", []string{"ec2:RunInstances"},
+			[]string{scope.ec2ARN("subnet/*"), scope.ec2ARN("security-group/*")}, network),
+		allow("LaunchResources", []string{"ec2:RunInstances"}, []string{
+			scope.ec2ARN("network-interface/*"),
+			scope.ec2ARN("volume/*"),
+			scope.ec2ARN("key-pair/*"),
+			fmt.Sprintf("arn:aws:ec2:%s::image/*", scope.Region),
+		}, nil),
+		allow("TagOnLaunch", []string{"ec2:CreateTags"}, []string{scope.ec2ARN("instance/*")},
+			map[string]map[string]string{"StringEquals": {"ec2:CreateAction": "RunInstances"}}),
+		allow("PassInstanceRole", []string{"iam:PassRole"},
+			[]string{fmt.Sprintf("arn:aws:iam::%s:role/%s", scope.Account, scope.InstanceRole)},
+			map[string]map[string]string{"StringEquals": {"iam:PassedToService": "ec2.amazonaws.com"}}),
+		allow("WaitForInstances", []string{"ec2:DescribeInstances", "ssm:DescribeInstanceInformation"}, []string{"*"}, nil),
+	)
+	if scope.Compliance {
+		policy.Statement = append(policy.Statement, complianceStatement())
+	}
+	return policy
+}
+
+// complianceStatement covers what checking a compliance policy reads: the EBS default,
+// images, subnets, and volumes
+func complianceStatement() policyStatement {
+	return allow("CheckCompliance", []string{
+		"ec2:GetEbsEncryptionByDefault",
+		"ec2:DescribeImages",
+		"ec2:DescribeSubnets",
+		"ec2:DescribeVolumes",
+	}, []string{"*"}, nil)
+}
+
+func teardownOperatorPolicy(scope policyScope) *policyDocument {
+	return newPolicy(
+		allow("TerminateTaggedInstances", []string{"ec2:TerminateInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:ResourceTag")),
+		allow("WaitForTermination", []string{"ec2:DescribeInstances"}, []string{"*"}, nil),
+	)
+}
+
+// portForwardOperatorPolicy covers opening and closing port-forwarding sessions to the
+// instances, and finding a rank's instance in the job manifest
+func portForwardOperatorPolicy(scope policyScope) *policyDocument {
+	policy := newPolicy(
+		allow("PortForwardingDocument", []string{"ssm:StartSession"},
+			[]string{fmt.Sprintf("arn:aws:ssm:%s::document/%s", scope.Region, portForwardDocument)}, nil),
+		allow("PortForwardToInstances", []string{"ssm:StartSession"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("ssm:resourceTag")),
+		allow("EndSessions", []string{"ssm:TerminateSession"},
+			[]string{fmt.Sprintf("arn:aws:ssm:%s:%s:session/*", scope.Region, scope.Account)}, nil),
+	)
+	if scope.Bucket != "" {
+		policy.Statement = append(policy.Statement,
+			allow("ReadJobManifest", []string{"s3:GetObject"}, scope.jobObjects(), nil))
+	}
+	return policy
+}
+
+// provenanceOperatorPolicy reads the metadata of any object in the bucket, since results
+// may have been copied anywhere in it, and the run manifests under jobs/
+func provenanceOperatorPolicy(scope policyScope) *policyDocument {
+	return newPolicy(
+		allow("ReadObjectProvenance", []string{"s3:GetObject"}, []string{fmt.Sprintf("arn:aws:s3:::%s/*", scope.Bucket)}, nil),
+	)
+}
+
+func adoptOperatorPolicy(scope policyScope) *policyDocument {
+	// Only the project tag may be set, and only to the scope's project when it has one
+	tagging := map[string]map[string]string{"ForAllValues:StringEquals": {"aws:TagKeys": projectTagKey}}
+	if scope.Project != "" {
+		tagging["StringEquals"] = map[string]string{"aws:RequestTag/" + projectTagKey: scope.Project}
+	}
+	policy := newPolicy(
+		allow("CheckInstances", []string{"ec2:DescribeInstances", "ssm:DescribeInstanceInformation"}, []string{"*"}, nil),
+		allow("TagProject", []string{"ec2:CreateTags"}, []string{scope.ec2ARN("instance/*")}, tagging),
+	)
+	if scope.Compliance {
+		policy.Statement = append(policy.Statement, complianceStatement())
+	}
+	return policy
+}
+
+// scheduleOperatorPolicy covers the rules of the scope's project, the manifests they
+// repeat, and the journals their runs leave in the bucket
+func scheduleOperatorPolicy(scope policyScope) *policyDocument {
+	project := cmp.Or(scope.Project, "*")
+	return newPolicy(
+		allow("ManageRules", []string{
+			"events:PutRule",
+			"events:PutTargets",
+			"events:TagResource",
+			"events:ListTargetsByRule",
+			"events:RemoveTargets",
+			"events:DeleteRule",
+		}, []string{fmt.Sprintf("arn:aws:events:%s:%s:rule/%s%s-*", scope.Region, scope.Account, scheduleRulePrefix, project)}, nil),
+		allow("ListRules", []string{"events:ListRules"}, []string{"*"}, nil),
+		allow("PassScheduleRole", []string{"iam:PassRole"},
+			[]string{fmt.Sprintf("arn:aws:iam::%s:role/%s", scope.Account, scope.ScheduleRole)},
+			map[string]map[string]string{"StringEquals": {"iam:PassedToService": "events.amazonaws.com"}}),
+		allow("UploadManifests", []string{"s3:PutObject"},
+			[]string{fmt.Sprintf("arn:aws:s3:::%s/%s", scope.Bucket, scheduleManifestKey(project, "*"))}, nil),
+		allow("ReadJournals", []string{"s3:GetObject"}, scope.jobObjects(), nil),
+		allow("ListJobs", []string{"s3:ListBucket"}, []string{"arn:aws:s3:::" + scope.Bucket},
+			map[string]map[string]string{"StringLike": {"s3:prefix": scope.jobsPrefix() + "/*"}}),
+	)
+}
+
+// transferOperatorPolicy covers cp and sync, which stage files under the jobs prefix
+// and run the scripts that copy them on the instances. sync deletes the staged files
+// the source no longer has, so the staging prefix mirrors it.
+func transferOperatorPolicy(scope policyScope) *policyDocument {
+	return newPolicy(
+		allow("DiscoverInstances", []string{"ec2:DescribeInstances"}, []string{"*"}, nil),
+		allow("RunShellScript", []string{"ssm:SendCommand"},
+			[]string{fmt.Sprintf("arn:aws:ssm:%s::document/AWS-RunShellScript", scope.Region)}, nil),
+		allow("RunOnInstances", []string{"ssm:SendCommand"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("ssm:resourceTag")),
+		allow("ReadCommandOutput", []string{"ssm:GetCommandInvocation"}, []string{"*"}, nil),
+		allow("StageFiles", []string{"s3:PutObject", "s3:GetObject", "s3:DeleteObject"}, scope.jobObjects(), nil),
+		allow("ListStagedFiles", []string{"s3:ListBucket"}, []string{"arn:aws:s3:::" + scope.Bucket},
+			map[string]map[string]string{"StringLike": {"s3:prefix": scope.jobsPrefix() + "/*"}}),
+	)
+}
+
+// instancePolicy covers the SSM agent and what the runtime library and awsmpirun build
+// call from the ranks
+func instancePolicy(scope policyScope) *policyDocument {
+	policy := newPolicy(
+		allow("SSMAgent", []string{
+			"ssm:UpdateInstanceInformation",
+			"ssmmessages:CreateControlChannel",
+			"ssmmessages:CreateDataChannel",
+			"ssmmessages:OpenControlChannel",
+			"ssmmessages:OpenDataChannel",
+			"ec2messages:AcknowledgeMessage",
+			"ec2messages:DeleteMessage",
+			"ec2messages:FailMessage",
+			"ec2messages:GetEndpoint",
+			"ec2messages:GetMessages",
+			"ec2messages:SendReply",
+		}, []string{"*"}, nil),
+	)
+	if scope.Bucket != "" {
+		// Without ListBucket S3 answers a read of a missing checkpoint with AccessDenied
+		// instead of NoSuchKey, and LoadCheckpoint could not tell a first start apart.
+		// GatherToS3 aborts its multipart upload when the gather fails.
+		policy.Statement = append(policy.Statement,
+			allow("ManifestCheckpointsAndCrashes", []string{"s3:GetObject", "s3:PutObject", "s3:AbortMultipartUpload"}, scope.jobObjects(), nil),
+			allow("BuildCache", []string{"s3:GetObject", "s3:PutObject"}, scope.buildCacheObjects(), nil),
+			allow("FindCheckpoints", []string{"s3:ListBucket"}, []string{"arn:aws:s3:::" + scope.Bucket},
+				map[string]map[string]string{"StringLike": {"s3:prefix": scope.jobsPrefix() + "/*"}}))
+	}
+	if scope.KVTable != "" {
+		policy.Statement = append(policy.Statement,
+			allow("KeyValueStore", []string{"dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:UpdateItem", "dynamodb:DeleteItem"}, scope.kvTableARN(), nil))
+	}
+	if scope.Encrypt {
+		// The aws/ssm key decrypts for any caller SSM lets read the parameter
+		policy.Statement = append(policy.Statement,
+			allow("ReadPayloadKey", []string{"ssm:GetParameter"}, scope.payloadKeyParameters(), nil))
+	}
+	if scope.GitSecret != "" {
+		// Secrets Manager appends six random characters to the name in the ARN
+		policy.Statement = append(policy.Statement,
+			allow("ReadGitToken", []string{"secretsmanager:GetSecretValue"},
+				[]string{fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s-??????", scope.Region, scope.Account, scope.GitSecret)}, nil))
+	}
+	return policy
+}
+
+// stepFunctionsPolicy is the role of an export-sfn state machine: it runs the phase
+// builds, which need the EventBridge rule Step Functions tracks .sync builds with, and
+// stops or terminates the instances in Teardown
+func stepFunctionsPolicy(scope policyScope) *policyDocument {
+	project := scope.CodeBuildProject
+	if project == "" {
+		project = "*"
+	}
+	return newPolicy(
+		allow("RunPhaseBuilds", []string{"codebuild:StartBuild", "codebuild:StopBuild", "codebuild:BatchGetBuilds"},
+			[]string{fmt.Sprintf("arn:aws:codebuild:%s:%s:project/%s", scope.Region, scope.Account, project)}, nil),
+		allow("TrackBuilds", []string{"events:PutTargets", "events:PutRule", "events:DescribeRule"},
+			[]string{fmt.Sprintf("arn:aws:events:%s:%s:rule/StepFunctionsGetEventForCodeBuildStartBuildRule", scope.Region, scope.Account)}, nil),
+		allow("TeardownInstances", []string{"ec2:StopInstances", "ec2:TerminateInstances"}, []string{scope.ec2ARN("instance/*")}, scope.tagCondition("aws:ResourceTag")),
+	)
+}
@@ -0,0 +1,552 @@
+package cmd
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// statementsByID indexes a policy's statements for lookups in tests
+func statementsByID(policy *policyDocument) map[string]policyStatement {
+	statements := make(map[string]policyStatement)
+	for _, statement := range policy.Statement {
+		statements[statement.Sid] = statement
+	}
+	return statements
+}
+
+func TestBuildPoliciesRun(t *testing.T) {
+	scope := policyScope{Region: "us-west-2", Account: "123456789012"}
+	policies, err := buildPolicies(policyForRun, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := statementsByID(policies.Operator)
+	if _, ok := operator["RunOnInstances"]; !ok {
+		t.Fatalf("run policy lacks SendCommand on instances: %+v", policies.Operator)
+	}
+	for _, sid := range []string{"StageJob", "IndexResults", "PrepareKVTable", "ChaosStopRank", "ExplainBlockedPairs"} {
+		if _, ok := operator[sid]; ok {
+			t.Errorf("run policy without options includes %s", sid)
+		}
+	}
+	if operator["RunOnInstances"].Condition != nil {
+		t.Errorf("run policy without --tag has a condition: %+v", operator["RunOnInstances"].Condition)
+	}
+	if policies.Instance == nil {
+		t.Fatal("run policy has no instance policy")
+	}
+
+	scope.Bucket, scope.KVTable, scope.Chaos, scope.CheckNetwork = "staging", "kv", true, true
+	scope.TagKey, scope.TagValue = "team", "hpc"
+	policies, err = buildPolicies(policyForRun, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator = statementsByID(policies.Operator)
+	if got := operator["StageJob"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:s3:::staging/jobs/*"}) {
+		t.Errorf("StageJob resources = %v", got)
+	}
+	if got := operator["PrepareKVTable"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:dynamodb:us-west-2:123456789012:table/kv"}) {
+		t.Errorf("PrepareKVTable resources = %v", got)
+	}
+	if got := operator["ExplainBlockedPairs"].Action; !reflect.DeepEqual(got, []string{"ec2:DescribeSecurityGroups", "ec2:DescribeNetworkAcls"}) {
+		t.Errorf("ExplainBlockedPairs actions = %v", got)
+	}
+	want := map[string]map[string]string{"StringEquals": {"ssm:resourceTag/team": "hpc"}}
+	if got := operator["RunOnInstances"].Condition; !reflect.DeepEqual(got, want) {
+		t.Errorf("RunOnInstances condition = %v, want %v", got, want)
+	}
+	instance := statementsByID(policies.Instance)
+	for _, sid := range []string{"SSMAgent", "ManifestCheckpointsAndCrashes", "FindCheckpoints", "KeyValueStore"} {
+		if _, ok := instance[sid]; !ok {
+			t.Errorf("instance policy lacks %s", sid)
+		}
+	}
+}
+
+func TestBuildPoliciesProvisionAndTeardown(t *testing.T) {
+	scope := policyScope{Region: "*", Account: "*", VPC: "vpc-1", InstanceRole: "mpi-role"}
+
+	policies, err := buildPolicies(policyForProvision, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := statementsByID(policies.Operator)
+	tagged := map[string]map[string]string{"Null": {"aws:RequestTag/" + stressTagKey: "false"}}
+	if got := operator["LaunchTaggedInstances"].Condition; !reflect.DeepEqual(got, tagged) {
+		t.Errorf("launch condition = %v, want %v", got, tagged)
+	}
+	if got := operator["LaunchIntoVPC"].Condition["StringEquals"]["ec2:Vpc"]; got != "arn:aws:ec2:*:*:vpc/vpc-1" {
+		t.Errorf("launch VPC condition = %q", got)
+	}
+	if got := operator["PassInstanceRole"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:iam::*:role/mpi-role"}) {
+		t.Errorf("PassRole resources = %v", got)
+	}
+
+	policies, err = buildPolicies(policyForTeardown, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Instance != nil {
+		t.Error("teardown has an instance policy")
+	}
+	terminate := statementsByID(policies.Operator)["TerminateTaggedInstances"]
+	if got := terminate.Condition; !reflect.DeepEqual(got, map[string]map[string]string{"Null": {"aws:ResourceTag/" + stressTagKey: "false"}}) {
+		t.Errorf("terminate condition = %v", got)
+	}
+
+	if _, err := buildPolicies("deploy", scope); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("unknown command error = %v", err)
+	}
+}
+
+func TestBuildPoliciesProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		scope    policyScope
+		wantSIDs []string
+	}{
+		{
+			name:     "instance given",
+			scope:    policyScope{Region: "us-west-2", Account: "123456789012"},
+			wantSIDs: []string{"PortForwardingDocument", "PortForwardToInstances", "EndSessions"},
+		},
+		{
+			name:     "rank looked up in the manifest",
+			scope:    policyScope{Region: "us-west-2", Account: "123456789012", Bucket: "staging", TagKey: "team", TagValue: "hpc"},
+			wantSIDs: []string{"PortForwardingDocument", "PortForwardToInstances", "EndSessions", "ReadJobManifest"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := buildPolicies(policyForProfile, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policies.Instance != nil {
+				t.Error("profile has an instance policy")
+			}
+			var sids []string
+			for _, statement := range policies.Operator.Statement {
+				sids = append(sids, statement.Sid)
+			}
+			if !reflect.DeepEqual(sids, tt.wantSIDs) {
+				t.Errorf("statements = %v, want %v", sids, tt.wantSIDs)
+			}
+			operator := statementsByID(policies.Operator)
+			if got := operator["PortForwardingDocument"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:ssm:us-west-2::document/AWS-StartPortForwardingSession"}) {
+				t.Errorf("document resources = %v", got)
+			}
+			if got := operator["PortForwardToInstances"].Condition; !reflect.DeepEqual(got, tt.scope.tagCondition("ssm:resourceTag")) {
+				t.Errorf("instance condition = %v", got)
+			}
+		})
+	}
+}
+
+func TestBuildPoliciesProvenance(t *testing.T) {
+	policies, err := buildPolicies(policyForProvenance, policyScope{Bucket: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Instance != nil {
+		t.Error("provenance has an instance policy")
+	}
+	operator := statementsByID(policies.Operator)
+	if got := operator["ReadObjectProvenance"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:s3:::staging/*"}) {
+		t.Errorf("object resources = %v", got)
+	}
+}
+
+func TestPolicyJSON(t *testing.T) {
+	policies, err := buildPolicies(policyForTeardown, policyScope{Region: "*", Account: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]json.RawMessage
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded["instance"]; ok {
+		t.Errorf("teardown output includes an instance policy: %s", out)
+	}
+	if !strings.Contains(string(decoded["operator"]), `"Version":"2012-10-17"`) {
+		t.Errorf("operator policy lacks a version: %s", decoded["operator"])
+	}
+}
+
+func TestBuildPoliciesProject(t *testing.T) {
+	scope := policyScope{Region: "us-west-2", Account: "123456789012", Project: "team-a", Bucket: "staging"}
+	policies, err := buildPolicies(policyForRun, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := statementsByID(policies.Operator)
+	if got := operator["StageJob"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:s3:::staging/projects/team-a/jobs/*"}) {
+		t.Errorf("StageJob resources = %v", got)
+	}
+	wantIndex := map[string]map[string]string{"StringLike": {"s3:prefix": "projects/team-a/jobs/*"}}
+	if got := operator["IndexResults"].Condition; !reflect.DeepEqual(got, wantIndex) {
+		t.Errorf("IndexResults condition = %v, want %v", got, wantIndex)
+	}
+	instance := statementsByID(policies.Instance)
+	want := map[string]map[string]string{"StringLike": {"s3:prefix": "projects/team-a/jobs/*"}}
+	if got := instance["FindCheckpoints"].Condition; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindCheckpoints condition = %v, want %v", got, want)
+	}
+	if got := instance["BuildCache"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:s3:::staging/projects/team-a/cache/go-build/*"}) {
+		t.Errorf("BuildCache resources = %v", got)
+	}
+}
+
+func TestBuildPoliciesDeadline(t *testing.T) {
+	tests := []struct {
+		action  string
+		want    []string
+		wantNot []string
+	}{
+		{"", nil, []string{"CancelAtDeadline", "StopAtDeadline", "TerminateAtDeadline"}},
+		{deadlineCancel, []string{"CancelAtDeadline"}, []string{"StopAtDeadline", "TerminateAtDeadline"}},
+		{deadlineStop, []string{"CancelAtDeadline", "StopAtDeadline"}, []string{"TerminateAtDeadline"}},
+		{deadlineTerminate, []string{"CancelAtDeadline", "TerminateAtDeadline"}, []string{"StopAtDeadline"}},
+	}
+	for _, tt := range tests {
+		scope := policyScope{Region: "*", Account: "*", DeadlineAction: tt.action, TagKey: projectTagKey, TagValue: "team-a"}
+		policies, err := buildPolicies(policyForRun, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		operator := statementsByID(policies.Operator)
+		for _, sid := range tt.want {
+			if _, ok := operator[sid]; !ok {
+				t.Errorf("%q: operator policy lacks %s", tt.action, sid)
+			}
+		}
+		for _, sid := range tt.wantNot {
+			if _, ok := operator[sid]; ok {
+				t.Errorf("%q: operator policy has %s", tt.action, sid)
+			}
+		}
+	}
+}
+
+func TestBuildPoliciesStepFunctions(t *testing.T) {
+	scope := policyScope{Region: "us-west-2", Account: "123456789012", CodeBuildProject: "awsmpirun", TagKey: projectTagKey, TagValue: "team-a"}
+	policies, err := buildPolicies(policyForStepFuncs, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Instance != nil {
+		t.Error("stepfunctions has an instance policy")
+	}
+	operator := statementsByID(policies.Operator)
+	if got := operator["RunPhaseBuilds"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:codebuild:us-west-2:123456789012:project/awsmpirun"}) {
+		t.Errorf("RunPhaseBuilds resources = %v", got)
+	}
+	want := map[string]map[string]string{"StringEquals": {"aws:ResourceTag/" + projectTagKey: "team-a"}}
+	if got := operator["TeardownInstances"].Condition; !reflect.DeepEqual(got, want) {
+		t.Errorf("TeardownInstances condition = %v, want %v", got, want)
+	}
+}
+
+func TestBuildPoliciesTargetByTag(t *testing.T) {
+	for _, targetByTag := range []bool{false, true} {
+		scope := policyScope{Region: "*", Account: "*", TargetByTag: targetByTag, TagKey: projectTagKey, TagValue: "team-a"}
+		policies, err := buildPolicies(policyForRun, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		operator := statementsByID(policies.Operator)
+		tagging, ok := operator["TagCluster"]
+		if _, tracking := operator["TrackTargetedCommands"]; ok != targetByTag || tracking != targetByTag {
+			t.Errorf("target-by-tag %v: TagCluster %v, TrackTargetedCommands %v", targetByTag, ok, tracking)
+		}
+		if !ok {
+			continue
+		}
+		if tagging.Condition["ForAllValues:StringEquals"]["aws:TagKeys"] != clusterTagKey {
+			t.Errorf("TagCluster may set other tags: %v", tagging.Condition)
+		}
+		if tagging.Condition["StringEquals"]["aws:ResourceTag/"+projectTagKey] != "team-a" {
+			t.Errorf("TagCluster is not scoped to the project: %v", tagging.Condition)
+		}
+	}
+}
+
+func TestBuildPoliciesAdopt(t *testing.T) {
+	for _, project := range []string{"", "team-a"} {
+		policies, err := buildPolicies(policyForAdopt, policyScope{Region: "*", Account: "*", Project: project})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policies.Instance != nil {
+			t.Error("adopt has an instance policy")
+		}
+		tagging := statementsByID(policies.Operator)["TagProject"]
+		if tagging.Condition["ForAllValues:StringEquals"]["aws:TagKeys"] != projectTagKey {
+			t.Errorf("project %q: TagProject may set other tags: %v", project, tagging.Condition)
+		}
+		if got := tagging.Condition["StringEquals"]["aws:RequestTag/"+projectTagKey]; got != project {
+			t.Errorf("project %q: TagProject is scoped to %q", project, got)
+		}
+	}
+}
+
+func TestBuildPoliciesTransfer(t *testing.T) {
+	policies, err := buildPolicies(policyForTransfer, policyScope{Region: "*", Account: "*", Bucket: "staging", Project: "team-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Instance == nil {
+		t.Fatal("transfer has no instance policy")
+	}
+	staging := statementsByID(policies.Operator)["StageFiles"]
+	if !reflect.DeepEqual(staging.Action, []string{"s3:PutObject", "s3:GetObject", "s3:DeleteObject"}) {
+		t.Errorf("StageFiles actions = %v", staging.Action)
+	}
+	if !reflect.DeepEqual(staging.Resource, []string{"arn:aws:s3:::staging/projects/team-a/jobs/*"}) {
+		t.Errorf("StageFiles resources = %v", staging.Resource)
+	}
+}
+
+func TestBuildPoliciesSchedule(t *testing.T) {
+	scope := policyScope{Region: "us-west-2", Account: "123456789012", Project: "team-a", Bucket: "my-bucket", ScheduleRole: "events-runner"}
+	policies, err := buildPolicies(policyForSchedule, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := statementsByID(policies.Operator)
+	if got := statements["ManageRules"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:events:us-west-2:123456789012:rule/awsmpirun-team-a-*"}) {
+		t.Errorf("ManageRules resources %q", got)
+	}
+	pass := statements["PassScheduleRole"]
+	if pass.Resource[0] != "arn:aws:iam::123456789012:role/events-runner" || pass.Condition["StringEquals"]["iam:PassedToService"] != "events.amazonaws.com" {
+		t.Errorf("PassScheduleRole = %+v", pass)
+	}
+	if got := statements["UploadManifests"].Resource[0]; got != "arn:aws:s3:::my-bucket/projects/team-a/schedules/*/job.yaml" {
+		t.Errorf("UploadManifests resource %q", got)
+	}
+	if got := statements["ListJobs"].Condition["StringLike"]["s3:prefix"]; got != "projects/team-a/jobs/*" {
+		t.Errorf("ListJobs prefix %q", got)
+	}
+}
+
+func TestBuildPoliciesCompliance(t *testing.T) {
+	for _, command := range []string{policyForRun, policyForProvision, policyForAdopt} {
+		for _, compliance := range []bool{false, true} {
+			policies, err := buildPolicies(command, policyScope{Region: "*", Account: "*", Compliance: compliance})
+			if err != nil {
+				t.Fatal(err)
+			}
+			statement, ok := statementsByID(policies.Operator)["CheckCompliance"]
+			if ok != compliance {
+				t.Errorf("%s with compliance %v: CheckCompliance present %v", command, compliance, ok)
+			}
+			if ok && !reflect.DeepEqual(statement.Action, []string{"ec2:GetEbsEncryptionByDefault", "ec2:DescribeImages", "ec2:DescribeSubnets", "ec2:DescribeVolumes"}) {
+				t.Errorf("%s: CheckCompliance actions %q", command, statement.Action)
+			}
+		}
+	}
+}
+
+func TestBuildPoliciesMetrics(t *testing.T) {
+	for _, metrics := range []bool{false, true} {
+		policies, err := buildPolicies(policyForRun, policyScope{Region: "*", Account: "*", Metrics: metrics})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statement, ok := statementsByID(policies.Operator)["PublishJobMetrics"]
+		if ok != metrics {
+			t.Fatalf("metrics %v: PublishJobMetrics present %v", metrics, ok)
+		}
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(statement.Action, []string{"cloudwatch:PutMetricData"}) {
+			t.Errorf("PublishJobMetrics actions %q", statement.Action)
+		}
+		if got := statement.Condition["StringEquals"]["cloudwatch:namespace"]; got != metricsNamespace {
+			t.Errorf("PublishJobMetrics namespace condition %q, want %q", got, metricsNamespace)
+		}
+	}
+}
+
+func TestBuildPoliciesResults(t *testing.T) {
+	policies, err := buildPolicies(policyForResults, policyScope{Project: "team-a", Bucket: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Instance != nil {
+		t.Error("results has an instance policy")
+	}
+	operator := statementsByID(policies.Operator)
+	if got := operator["ReadResults"].Resource; !reflect.DeepEqual(got, []string{"arn:aws:s3:::staging/projects/team-a/jobs/*"}) {
+		t.Errorf("ReadResults resources = %v", got)
+	}
+	if len(operator) != 1 {
+		t.Errorf("results policy has %d statements, want 1", len(operator))
+	}
+}
+
+func TestBuildPoliciesEncryptPayloads(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		policies, err := buildPolicies(policyForRun, policyScope{Region: "us-east-1", Account: "123456789012", Project: "team-a", Encrypt: encrypt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, stored := statementsByID(policies.Operator)["StorePayloadKey"]
+		read, readable := statementsByID(policies.Instance)["ReadPayloadKey"]
+		if stored != encrypt || readable != encrypt {
+			t.Fatalf("encrypt %v: StorePayloadKey present %v, ReadPayloadKey present %v", encrypt, stored, readable)
+		}
+		if !encrypt {
+			continue
+		}
+		want := []string{"arn:aws:ssm:us-east-1:123456789012:parameter/awsmpirun/projects/team-a/jobs/*"}
+		if !reflect.DeepEqual(store.Resource, want) || !reflect.DeepEqual(read.Resource, want) {
+			t.Errorf("payload key resources = %v and %v, want %v", store.Resource, read.Resource, want)
+		}
+		if !reflect.DeepEqual(store.Action, []string{"ssm:PutParameter", "ssm:DeleteParameter"}) || !reflect.DeepEqual(read.Action, []string{"ssm:GetParameter"}) {
+			t.Errorf("payload key actions = %v and %v", store.Action, read.Action)
+		}
+		// The parameter of a job is covered by the statements' wildcard
+		name := mpi.PayloadKeyParameter("team-a", "job-1")
+		if !strings.HasPrefix("arn:aws:ssm:us-east-1:123456789012:parameter"+name, strings.TrimSuffix(want[0], "*")) {
+			t.Errorf("parameter %s is outside %s", name, want[0])
+		}
+	}
+}
+
+func TestBuildPoliciesGitSecret(t *testing.T) {
+	for _, secret := range []string{"", "ci/github-token"} {
+		policies, err := buildPolicies(policyForRun, policyScope{Region: "us-east-1", Account: "123456789012", GitSecret: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, ok := statementsByID(policies.Instance)["ReadGitToken"]
+		if ok != (secret != "") {
+			t.Fatalf("secret %q: ReadGitToken present %v", secret, ok)
+		}
+		if !ok {
+			continue
+		}
+		want := []string{"arn:aws:secretsmanager:us-east-1:123456789012:secret:ci/github-token-??????"}
+		if !reflect.DeepEqual(read.Resource, want) || !reflect.DeepEqual(read.Action, []string{"secretsmanager:GetSecretValue"}) {
+			t.Errorf("ReadGitToken = %v on %v", read.Action, read.Resource)
+		}
+	}
+}
+
+func TestBuildPoliciesReport(t *testing.T) {
+	tests := []struct {
+		project  string
+		sids     []string
+		prefixes []string
+		objects  []string
+	}{
+		{
+			project:  "team-a",
+			sids:     []string{"ListUsage", "ReadUsage"},
+			prefixes: []string{"projects/team-a/usage/*"},
+			objects:  []string{"arn:aws:s3:::staging/projects/team-a/usage/*"},
+		},
+		{
+			project:  "",
+			sids:     []string{"ListUsage", "ReadUsage", "ListProjects", "ListProjectUsage"},
+			prefixes: []string{"usage/*", "projects/", "projects/*/usage/*"},
+			objects:  []string{"arn:aws:s3:::staging/usage/*", "arn:aws:s3:::staging/projects/*/usage/*"},
+		},
+	}
+	for _, tt := range tests {
+		policies, err := buildPolicies(policyForReport, policyScope{Project: tt.project, Bucket: "staging"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sids, prefixes []string
+		for _, statement := range policies.Operator.Statement {
+			sids = append(sids, statement.Sid)
+			if prefix, ok := statement.Condition["StringLike"]["s3:prefix"]; ok {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if !reflect.DeepEqual(sids, tt.sids) || !reflect.DeepEqual(prefixes, tt.prefixes) {
+			t.Errorf("project %q: statements %v listing %v, want %v listing %v", tt.project, sids, prefixes, tt.sids, tt.prefixes)
+		}
+		if got := statementsByID(policies.Operator)["ReadUsage"].Resource; !reflect.DeepEqual(got, tt.objects) {
+			t.Errorf("project %q: ReadUsage resources = %v, want %v", tt.project, got, tt.objects)
+		}
+	}
+
+	// A run records its usage where report reads it
+	policies, err := buildPolicies(policyForRun, policyScope{Project: "team-a", Bucket: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := statementsByID(policies.Operator)["RecordUsage"]
+	key := usageKey(usageRecord{JobID: "job-1", Project: "team-a", Started: time.Now()})
+	if len(record.Resource) != 1 || !strings.HasPrefix("arn:aws:s3:::staging/"+key, strings.TrimSuffix(record.Resource[0], "*")) {
+		t.Errorf("RecordUsage resources %v do not cover %s", record.Resource, key)
+	}
+}
+
+func TestBuildPoliciesQuickstart(t *testing.T) {
+	tests := []struct {
+		name      string
+		scope     policyScope
+		ownBucket bool
+		tagged    map[string]map[string]string
+	}{
+		{
+			name:      "default",
+			scope:     policyScope{Region: "us-west-2", Account: "*"},
+			ownBucket: true,
+			tagged:    map[string]map[string]string{"Null": {"aws:ResourceTag/" + quickstartTagKey: "false"}},
+		},
+		{
+			name:   "existing bucket in a project",
+			scope:  policyScope{Region: "us-west-2", Account: "*", Bucket: "staging", TagKey: projectTagKey, TagValue: "quickstart"},
+			tagged: map[string]map[string]string{"StringEquals": {"aws:ResourceTag/" + projectTagKey: "quickstart"}},
+		},
+	}
+	for _, tt := range tests {
+		policies, err := buildPolicies(policyForQuickstart, tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statements := statementsByID(policies.Operator)
+		for _, sid := range []string{"LaunchTaggedInstances", "RunOnInstances", "TerminateTaggedInstances", "StageJob", "FindAmazonLinux", "CreateNetwork", "ManageNetwork"} {
+			if _, ok := statements[sid]; !ok {
+				t.Errorf("%s: no %s statement", tt.name, sid)
+			}
+		}
+		if got := statements["ManageNetwork"].Condition; !reflect.DeepEqual(got, tt.tagged) {
+			t.Errorf("%s: ManageNetwork condition = %v, want %v", tt.name, got, tt.tagged)
+		}
+		manage, ok := statements["ManageBucket"]
+		if ok != tt.ownBucket {
+			t.Fatalf("%s: ManageBucket present %v, want %v", tt.name, ok, tt.ownBucket)
+		}
+		if !ok {
+			continue
+		}
+		// The buckets quickstart creates are the ones the policy lets it delete
+		bucket := "arn:aws:s3:::awsmpirun-" + newQuickstartID()
+		if matched, _ := path.Match(manage.Resource[0], bucket); !matched {
+			t.Errorf("%s: ManageBucket resource %v does not cover %s", tt.name, manage.Resource, bucket)
+		}
+		if staged := statementsByID(policies.Instance)["ManifestCheckpointsAndCrashes"]; len(staged.Resource) == 0 {
+			t.Errorf("%s: the instances cannot read the staged binary", tt.name)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// cmd/jobs.go
+// This file implements jobs list, which shows the jobs run from this machine, or with
+// --bucket the jobs whose journals runs copied to the project's prefix, with when each
+// started and how it ended. The status comes from the last event of the journal: a run
+// that finished, failed, or was stopped ended, and any other run is still going or was
+// interrupted before it could record its end. --schedule keeps the runs of one
+// schedule, whose job IDs are the schedule name and the start time.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/spf13/cobra"
+)
+
+// Statuses of a job in jobs list
+const (
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobStopped   = "stopped"
+	jobRunning   = "running"
+	jobUnknown   = "unknown" // No journal
+)
+
+var jobsCmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "Inspect the jobs awsmpirun has run",
+}
+
+// jobsListOptions are the flags of jobs list
+type jobsListOptions struct {
+	bucket   string
+	project  string
+	schedule string
+	json     bool
+}
+
+// newJobsListCmd returns jobs list
+func newJobsListCmd() *cobra.Command {
+	o := &jobsListOptions{}
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List jobs with when they started and how they ended",
+		Long: `list prints every job with a journal on this machine, or with --bucket every job of
+the project in the bucket, oldest first: when it started, its status (succeeded,
+failed, stopped, or running if the journal has not recorded an end), the phase of its
+last event, and when it ended. --schedule NAME lists the runs a schedule from
+awsmpirun schedule create started.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runJobsList(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "List the jobs whose journals runs copied to this bucket instead of the local ones")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the jobs, for --bucket (default: project in config.yaml)")
+	cmd.Flags().StringVar(&o.schedule, "schedule", "", "Only list the runs of this schedule")
+	cmd.Flags().BoolVar(&o.json, "json", false, "Print the jobs as JSON lines")
+	return cmd
+}
+
+func init() {
+	jobsCmd.AddCommand(newJobsListCmd())
+	rootCmd.AddCommand(jobsCmd)
+}
+
+// jobSummary is one line of jobs list
+type jobSummary struct {
+	JobID   string `json:"job_id"`
+	Started string `json:"started,omitempty"`
+	Status  string `json:"status"`
+	Phase   string `json:"phase,omitempty"`
+	Ended   string `json:"ended,omitempty"`
+}
+
+// summarizeJob returns the summary of a job from the events of its journal
+func summarizeJob(jobID string, events []jobEvent) jobSummary {
+	summary := jobSummary{JobID: jobID, Status: jobUnknown}
+	if len(events) == 0 {
+		return summary
+	}
+	summary.Started = events[0].Time
+	for _, event := range events {
+		if event.Type == eventRunStarted {
+			summary.Started = event.Time
+			break
+		}
+	}
+	last := events[len(events)-1]
+	summary.Phase = last.Phase
+	switch last.Type {
+	case eventRunFinished:
+		summary.Status = jobSucceeded
+	case eventRunFailed:
+		summary.Status = jobFailed
+	case eventRunStopped:
+		summary.Status = jobStopped
+	default:
+		summary.Status = jobRunning
+	}
+	if last.ends() {
+		summary.Ended = last.Time
+	}
+	return summary
+}
+
+// journalReader returns the journal of a job, or nil if it has none
+type journalReader func(ctx context.Context, jobID string) ([]byte, error)
+
+func runJobsList(ctx context.Context, o *jobsListOptions) {
+	var ids []string
+	var read journalReader
+	if o.bucket != "" {
+		project, err := resolveProject(o.project)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+		if err != nil {
+			fmt.Printf("Error creating S3 client: %v\n", err)
+			os.Exit(1)
+		}
+		prefix := mpi.JobPrefix(project, "")
+		prefixes, err := s3Client.ListPrefixes(ctx, prefix)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, p := range prefixes {
+			ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
+		}
+		read = func(ctx context.Context, jobID string) ([]byte, error) {
+			data, err := s3Client.DownloadBytes(ctx, eventsKey(project, jobID))
+			var noSuchKey *types.NoSuchKey
+			if errors.As(err, &noSuchKey) {
+				return nil, nil
+			}
+			return data, err
+		}
+	} else {
+		dir, err := platform.Current().ConfigDir()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, "jobs"))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				ids = append(ids, entry.Name())
+			}
+		}
+		read = func(_ context.Context, jobID string) ([]byte, error) {
+			data, err := os.ReadFile(filepath.Join(dir, "jobs", jobID, "events.jsonl"))
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return data, err
+		}
+	}
+
+	jobs, err := listJobs(ctx, ids, read, o.schedule)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(jobs) == 0 && !o.json {
+		fmt.Println("No jobs found")
+		return
+	}
+	writeJobs(os.Stdout, jobs, o.json)
+}
+
+// listJobs summarizes the jobs with ids, keeping only the runs of schedule if it is not
+// empty, and sorts them by start time
+func listJobs(ctx context.Context, ids []string, read journalReader, schedule string) ([]jobSummary, error) {
+	var jobs []jobSummary
+	for _, id := range ids {
+		if schedule != "" && !scheduledJobPattern(schedule).MatchString(id) {
+			continue
+		}
+		data, err := read(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the journal of job %s: %v", id, err)
+		}
+		events, _, err := parseEvents(data)
+		if err != nil {
+			return nil, fmt.Errorf("journal of job %s: %v", id, err)
+		}
+		jobs = append(jobs, summarizeJob(id, events))
+	}
+	started := func(job jobSummary) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, job.Started)
+		return t
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if a, b := started(jobs[i]), started(jobs[j]); !a.Equal(b) {
+			return a.Before(b)
+		}
+		return jobs[i].JobID < jobs[j].JobID
+	})
+	return jobs, nil
+}
+
+// writeJobs prints jobs as a table, or as JSON lines
+func writeJobs(w io.Writer, jobs []jobSummary, asJSON bool) {
+	if asJSON {
+		for _, job := range jobs {
+			line, _ := json.Marshal(job)
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		return
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "JOB ID\tSTARTED\tSTATUS\tPHASE\tENDED")
+	for _, job := range jobs {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", job.JobID, job.Started, job.Status, job.Phase, job.Ended)
+	}
+	table.Flush()
+}
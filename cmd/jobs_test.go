@@ -0,0 +1,109 @@
+// cmd/jobs_test.go
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSummarizeJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []jobEvent
+		want   jobSummary
+	}{
+		{name: "no journal", want: jobSummary{JobID: "j", Status: jobUnknown}},
+		{
+			name: "finished",
+			events: []jobEvent{
+				{Time: "2026-10-14T02:00:00Z", Type: eventRunStarted},
+				{Time: "2026-10-14T02:00:01Z", Type: eventPhaseStarted, Phase: phaseSetup},
+				{Time: "2026-10-14T02:30:00Z", Type: eventRunFinished, Phase: phaseCollect},
+			},
+			want: jobSummary{JobID: "j", Started: "2026-10-14T02:00:00Z", Status: jobSucceeded, Phase: phaseCollect, Ended: "2026-10-14T02:30:00Z"},
+		},
+		{
+			name: "failed then resumed",
+			events: []jobEvent{
+				{Time: "2026-10-14T02:00:00Z", Type: eventRunStarted},
+				{Time: "2026-10-14T02:10:00Z", Type: eventRunFailed, Phase: phaseExecute},
+				{Time: "2026-10-14T03:00:00Z", Type: eventRunResumed, Phase: phaseExecute},
+			},
+			want: jobSummary{JobID: "j", Started: "2026-10-14T02:00:00Z", Status: jobRunning, Phase: phaseExecute},
+		},
+		{
+			name:   "stopped",
+			events: []jobEvent{{Time: "2026-10-14T02:00:00Z", Type: eventRunStarted}, {Time: "2026-10-14T04:00:00Z", Type: eventRunStopped, Phase: phaseExecute}},
+			want:   jobSummary{JobID: "j", Started: "2026-10-14T02:00:00Z", Status: jobStopped, Phase: phaseExecute, Ended: "2026-10-14T04:00:00Z"},
+		},
+		{
+			name:   "journal without its start",
+			events: []jobEvent{{Time: "2026-10-14T02:05:00Z", Type: eventRunFailed, Phase: phaseSetup}},
+			want:   jobSummary{JobID: "j", Started: "2026-10-14T02:05:00Z", Status: jobFailed, Phase: phaseSetup, Ended: "2026-10-14T02:05:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		if got := summarizeJob("j", tt.events); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	journals := map[string]string{
+		"nightly-20261014-020000":    `{"time":"2026-10-14T02:00:00Z","type":"run-started"}` + "\n" + `{"time":"2026-10-14T02:30:00Z","type":"run-finished","phase":"collect"}` + "\n",
+		"nightly-20261013-020000":    `{"time":"2026-10-13T02:00:00.5Z","type":"run-started"}` + "\n" + `{"time":"2026-10-13T02:10:00Z","type":"run-failed","phase":"execute"}` + "\n",
+		"job-20261013-120000-abcdef": `{"time":"2026-10-13T12:00:00Z","type":"run-started"}` + "\n",
+	}
+	read := func(_ context.Context, id string) ([]byte, error) {
+		data, ok := journals[id]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(data), nil
+	}
+	ids := []string{"nightly-20261014-020000", "nightly-20261013-020000", "job-20261013-120000-abcdef", "nightly-20261012-020000"}
+
+	ctx := context.Background()
+	all, err := listJobs(ctx, ids, read, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, job := range all {
+		order = append(order, job.JobID+" "+job.Status)
+	}
+	want := []string{"nightly-20261012-020000 unknown", "nightly-20261013-020000 failed", "job-20261013-120000-abcdef running", "nightly-20261014-020000 succeeded"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("jobs %q, want %q", order, want)
+	}
+
+	scheduled, err := listJobs(ctx, ids, read, "nightly")
+	if err != nil || len(scheduled) != 3 {
+		t.Errorf("runs of nightly = %+v, %v", scheduled, err)
+	}
+
+	failing := func(context.Context, string) ([]byte, error) { return nil, errors.New("access denied") }
+	if _, err := listJobs(ctx, ids, failing, ""); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("read error = %v", err)
+	}
+}
+
+func TestWriteJobs(t *testing.T) {
+	jobs := []jobSummary{{JobID: "nightly-20261014-020000", Started: "2026-10-14T02:00:00Z", Status: jobSucceeded, Phase: phaseCollect, Ended: "2026-10-14T02:30:00Z"}}
+	var table, lines bytes.Buffer
+	writeJobs(&table, jobs, false)
+	writeJobs(&lines, jobs, true)
+	if !strings.HasPrefix(table.String(), "JOB ID  ") || !strings.Contains(table.String(), "nightly-20261014-020000  2026-10-14T02:00:00Z  succeeded") {
+		t.Errorf("table:\n%s", table.String())
+	}
+	want := `{"job_id":"nightly-20261014-020000","started":"2026-10-14T02:00:00Z","status":"succeeded","phase":"collect","ended":"2026-10-14T02:30:00Z"}` + "\n"
+	if lines.String() != want {
+		t.Errorf("JSON lines %q, want %q", lines.String(), want)
+	}
+}
@@ -0,0 +1,355 @@
+// cmd/login.go
+// This file implements login, which signs in with AWS IAM Identity Center (SSO) so
+// operators without long-lived access keys can use awsmpirun without setting up the
+// AWS CLI first. It runs the device authorization flow, writes the access token to the
+// SSO token cache the SDK and the AWS CLI share, lets the operator pick the account and
+// role, and writes them as an SSO profile to the AWS config file. The profile is
+// recorded as aws_profile in config.yaml, and every command then uses it unless
+// AWS_PROFILE is set. When the session expires, running login again renews it.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/spf13/cobra"
+)
+
+// loginOptions are the flags of the login command
+type loginOptions struct {
+	startURL  string
+	ssoRegion string
+	account   string
+	role      string
+	profile   string
+	region    string
+}
+
+// newLoginCmd returns the login command
+func newLoginCmd() *cobra.Command {
+	o := &loginOptions{}
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "Sign in with AWS IAM Identity Center and use its credentials",
+		Long: `login signs in to the IAM Identity Center portal at --start-url. It prints a link
+to open in a browser, waits until the sign-in is approved there, and then asks which
+account and role to use; --account (ID or name) and --role choose them without asking.
+The choice is written as an SSO profile, "awsmpirun" unless --profile names another, to
+the AWS config file and the access token to ~/.aws/sso/cache, where the AWS CLI finds
+them too. Later commands use the profile unless AWS_PROFILE is set.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runLogin(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.startURL, "start-url", "", "URL of the IAM Identity Center portal, e.g. https://my-org.awsapps.com/start")
+	cmd.Flags().StringVar(&o.ssoRegion, "sso-region", "", "Region IAM Identity Center is set up in")
+	cmd.Flags().StringVar(&o.account, "account", "", "ID or name of the account to use (default: ask)")
+	cmd.Flags().StringVar(&o.role, "role", "", "Permission set role to use (default: ask)")
+	cmd.Flags().StringVar(&o.profile, "profile", "awsmpirun", "Name of the profile to write to the AWS config file")
+	cmd.Flags().StringVar(&o.region, "region", "", "Region of the profile, where clusters are launched (default: --sso-region)")
+	cmd.MarkFlagRequired("start-url")
+	cmd.MarkFlagRequired("sso-region")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newLoginCmd())
+}
+
+func runLogin(ctx context.Context, o *loginOptions) {
+	device, err := awsManager.StartSSOLogin(ctx, o.ssoRegion, o.startURL)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Open this link to sign in, and check that the page shows the code %s:\n\n    %s\n\n", device.UserCode, device.VerificationURI)
+	fmt.Println("Waiting for the sign-in to be approved...")
+	token, err := device.WaitForToken(ctx)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeSSOToken(filepath.Join(home, ".aws", "sso", "cache"), token); err != nil {
+		fmt.Printf("Error saving the access token: %v\n", err)
+		os.Exit(1)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	interactive := stdinIsTerminal()
+	accounts, err := awsManager.ListSSOAccounts(ctx, token)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	account, err := chooseAccount(in, os.Stdout, interactive, accounts, o.account)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	roles, err := awsManager.ListSSORoles(ctx, token, account.ID)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	role, err := chooseRole(in, os.Stdout, interactive, roles, o.role)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	region := o.region
+	if region == "" {
+		region = o.ssoRegion
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	data = upsertINISection(data, profileSection(o.profile), []iniSetting{
+		{"sso_start_url", o.startURL},
+		{"sso_region", o.ssoRegion},
+		{"sso_account_id", account.ID},
+		{"sso_role_name", role},
+		{"region", region},
+	})
+	if err := os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		fmt.Printf("Error writing %s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+
+	path, err := userConfigPath()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	config, err := loadUserConfig(path)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.AWSProfile = o.profile
+	if err := saveUserConfig(path, config); err != nil {
+		fmt.Printf("Error writing %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signed in as %s in account %s (%s) until %s\n", role, account.ID, account.Name, token.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("Profile %s was written to %s; awsmpirun commands now use it unless AWS_PROFILE is set\n", o.profile, configFile)
+}
+
+// useLoginProfile sets AWS_PROFILE to the profile login recorded in config.yaml, unless
+// it is already set, so the AWS clients of every command load that profile
+func useLoginProfile() {
+	if os.Getenv("AWS_PROFILE") != "" {
+		return
+	}
+	path, err := userConfigPath()
+	if err != nil {
+		return
+	}
+	config, err := loadUserConfig(path)
+	if err != nil || config.AWSProfile == "" {
+		return
+	}
+	os.Setenv("AWS_PROFILE", config.AWSProfile)
+}
+
+// ssoCacheFile returns the name of the token cache file of a legacy SSO profile, which
+// the SDK and the AWS CLI derive from the start URL
+func ssoCacheFile(startURL string) string {
+	sum := sha1.Sum([]byte(startURL))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// writeSSOToken caches token in dir, readable only by the operator
+func writeSSOToken(dir string, token awsManager.SSOToken) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return platform.Current().WritePrivateFile(filepath.Join(dir, ssoCacheFile(token.StartURL)), data)
+}
+
+// stdinIsTerminal reports whether login can ask the operator to choose
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// chooseAccount returns the account named by want (ID or name), the only account, or the
+// one the operator picks
+func chooseAccount(in *bufio.Reader, out io.Writer, interactive bool, accounts []awsManager.SSOAccount, want string) (awsManager.SSOAccount, error) {
+	if len(accounts) == 0 {
+		return awsManager.SSOAccount{}, fmt.Errorf("the sign-in gives access to no accounts")
+	}
+	if want != "" {
+		for _, account := range accounts {
+			if account.ID == want || account.Name == want {
+				return account, nil
+			}
+		}
+		return awsManager.SSOAccount{}, fmt.Errorf("the sign-in gives no access to account %s", want)
+	}
+	labels := make([]string, len(accounts))
+	for i, account := range accounts {
+		labels[i] = fmt.Sprintf("%s (%s)", account.ID, account.Name)
+	}
+	i, err := chooseOption(in, out, interactive, "account", "--account", labels)
+	if err != nil {
+		return awsManager.SSOAccount{}, err
+	}
+	return accounts[i], nil
+}
+
+// chooseRole returns want if the account has it, the only role, or the one the
+// operator picks
+func chooseRole(in *bufio.Reader, out io.Writer, interactive bool, roles []string, want string) (string, error) {
+	if len(roles) == 0 {
+		return "", fmt.Errorf("the sign-in gives access to no roles in this account")
+	}
+	if want != "" {
+		for _, role := range roles {
+			if role == want {
+				return role, nil
+			}
+		}
+		return "", fmt.Errorf("role %s is not available in this account; choose one of %s", want, strings.Join(roles, ", "))
+	}
+	i, err := chooseOption(in, out, interactive, "role", "--role", roles)
+	if err != nil {
+		return "", err
+	}
+	return roles[i], nil
+}
+
+// chooseOption returns the index of the option the operator picks from a numbered list.
+// A single option is picked without asking; several fail without a terminal to ask on,
+// naming the flag that chooses instead.
+func chooseOption(in *bufio.Reader, out io.Writer, interactive bool, what, flag string, options []string) (int, error) {
+	if len(options) == 1 {
+		fmt.Fprintf(out, "Using %s %s\n", what, options[0])
+		return 0, nil
+	}
+	if !interactive {
+		return 0, fmt.Errorf("the sign-in gives access to %d %ss; choose one with %s", len(options), what, flag)
+	}
+	for i, option := range options {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, option)
+	}
+	for {
+		fmt.Fprintf(out, "Which %s? [1-%d]: ", what, len(options))
+		line, err := in.ReadString('\n')
+		if n, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && n >= 1 && n <= len(options) {
+			return n - 1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("no %s was chosen", what)
+		}
+		fmt.Fprintf(out, "Enter a number from 1 to %d\n", len(options))
+	}
+}
+
+// iniSetting is a key and value of an AWS config file section
+type iniSetting struct {
+	key, value string
+}
+
+// profileSection returns the AWS config file section of a profile
+func profileSection(profile string) string {
+	if profile == "default" {
+		return "default"
+	}
+	return "profile " + profile
+}
+
+// upsertINISection sets settings in section of an AWS config file, adding the section
+// if it is missing. Other sections, other keys of the section, and comments are kept.
+func upsertINISection(data []byte, section string, settings []iniSetting) []byte {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	sectionName := func(line string) (string, bool) {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+			return "", false
+		}
+		return strings.Join(strings.Fields(line[1:len(line)-1]), " "), true
+	}
+
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		name, ok := sectionName(line)
+		if !ok {
+			continue
+		}
+		if start >= 0 {
+			end = i
+			break
+		}
+		if name == section {
+			start = i
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+section+"]")
+		start, end = len(lines)-1, len(lines)
+	}
+
+	body := append([]string(nil), lines[start+1:end]...)
+	for _, setting := range settings {
+		line := setting.key + " = " + setting.value
+		found := false
+		for i, existing := range body {
+			if key, _, ok := strings.Cut(existing, "="); ok && strings.TrimSpace(key) == setting.key {
+				body[i] = line
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		// New keys go after the last setting, before the blank lines separating sections
+		last := len(body)
+		for last > 0 && strings.TrimSpace(body[last-1]) == "" {
+			last--
+		}
+		body = append(body[:last], append([]string{line}, body[last:]...)...)
+	}
+
+	out := append(append(append([]string(nil), lines[:start+1]...), body...), lines[end:]...)
+	return []byte(strings.Join(out, "\n") + "\n")
+}
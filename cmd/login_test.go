@@ -0,0 +1,279 @@
+// cmd/login_test.go
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestUpsertINISection(t *testing.T) {
+	settings := []iniSetting{
+		{"sso_start_url", "https://my-org.awsapps.com/start"},
+		{"sso_region", "us-east-1"},
+		{"region", "us-west-2"},
+	}
+	tests := []struct {
+		name    string
+		data    string
+		section string
+		want    string
+	}{
+		{
+			name:    "empty file",
+			data:    "",
+			section: "profile awsmpirun",
+			want: `[profile awsmpirun]
+sso_start_url = https://my-org.awsapps.com/start
+sso_region = us-east-1
+region = us-west-2
+`,
+		},
+		{
+			name: "new section after others",
+			data: `[default]
+region = eu-west-1
+`,
+			section: "profile awsmpirun",
+			want: `[default]
+region = eu-west-1
+
+[profile awsmpirun]
+sso_start_url = https://my-org.awsapps.com/start
+sso_region = us-east-1
+region = us-west-2
+`,
+		},
+		{
+			name: "update keeps other keys, sections, and comments",
+			data: `# managed by hand
+[profile  awsmpirun]
+region=eu-west-1
+output = json
+
+[profile other]
+region = ap-south-1
+`,
+			section: "profile awsmpirun",
+			want: `# managed by hand
+[profile  awsmpirun]
+region = us-west-2
+output = json
+sso_start_url = https://my-org.awsapps.com/start
+sso_region = us-east-1
+
+[profile other]
+region = ap-south-1
+`,
+		},
+		{
+			name: "default section",
+			data: `[profile other]
+region = ap-south-1
+[default]
+output = text
+`,
+			section: "default",
+			want: `[profile other]
+region = ap-south-1
+[default]
+output = text
+sso_start_url = https://my-org.awsapps.com/start
+sso_region = us-east-1
+region = us-west-2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(upsertINISection([]byte(tt.data), tt.section, settings))
+			if got != tt.want {
+				t.Errorf("upsertINISection() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if again := string(upsertINISection([]byte(got), tt.section, settings)); again != got {
+				t.Errorf("second upsert changed the file:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestProfileSection(t *testing.T) {
+	if got := profileSection("default"); got != "default" {
+		t.Errorf("profileSection(default) = %q", got)
+	}
+	if got := profileSection("awsmpirun"); got != "profile awsmpirun" {
+		t.Errorf("profileSection(awsmpirun) = %q", got)
+	}
+}
+
+func TestChooseOption(t *testing.T) {
+	options := []string{"a", "b", "c"}
+	tests := []struct {
+		name        string
+		options     []string
+		interactive bool
+		input       string
+		want        int
+		wantErr     string
+	}{
+		{name: "single option", options: []string{"only"}, want: 0},
+		{name: "pick", options: options, interactive: true, input: "2\n", want: 1},
+		{name: "retry after invalid", options: options, interactive: true, input: "x\n9\n 3 \n", want: 2},
+		{name: "last line without newline", options: options, interactive: true, input: "1", want: 0},
+		{name: "end of input", options: options, interactive: true, input: "0\n", wantErr: "no role was chosen"},
+		{name: "not interactive", options: options, wantErr: "3 roles; choose one with --role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			in := bufio.NewReader(strings.NewReader(tt.input))
+			got, err := chooseOption(in, &out, tt.interactive, "role", "--role", tt.options)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("chooseOption() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chooseOption() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("chooseOption() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseAccount(t *testing.T) {
+	accounts := []awsManager.SSOAccount{
+		{ID: "111111111111", Name: "research"},
+		{ID: "222222222222", Name: "staging"},
+	}
+	tests := []struct {
+		name     string
+		accounts []awsManager.SSOAccount
+		want     string
+		input    string
+		wantID   string
+		wantErr  string
+	}{
+		{name: "by ID", accounts: accounts, want: "222222222222", wantID: "222222222222"},
+		{name: "by name", accounts: accounts, want: "research", wantID: "111111111111"},
+		{name: "picked", accounts: accounts, input: "2\n", wantID: "222222222222"},
+		{name: "unknown", accounts: accounts, want: "333333333333", wantErr: "no access to account 333333333333"},
+		{name: "none", wantErr: "no accounts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			in := bufio.NewReader(strings.NewReader(tt.input))
+			got, err := chooseAccount(in, &out, true, tt.accounts, tt.want)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("chooseAccount() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chooseAccount() error = %v", err)
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("chooseAccount() = %s, want %s", got.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestChooseRole(t *testing.T) {
+	roles := []string{"ReadOnly", "HPCOperator"}
+	tests := []struct {
+		name    string
+		roles   []string
+		want    string
+		wantErr string
+	}{
+		{name: "available", roles: roles, want: "HPCOperator"},
+		{name: "single", roles: []string{"HPCOperator"}},
+		{name: "unavailable", roles: roles, want: "Admin", wantErr: "choose one of ReadOnly, HPCOperator"},
+		{name: "none", wantErr: "no roles"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			got, err := chooseRole(bufio.NewReader(strings.NewReader("")), &out, false, tt.roles, tt.want)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("chooseRole() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chooseRole() error = %v", err)
+			}
+			if got != "HPCOperator" {
+				t.Errorf("chooseRole() = %s, want HPCOperator", got)
+			}
+		})
+	}
+}
+
+func TestWriteSSOToken(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sso", "cache")
+	expires := time.Date(2026, 10, 14, 18, 0, 0, 0, time.UTC)
+	token := awsManager.SSOToken{
+		StartURL:    "https://my-org.awsapps.com/start",
+		Region:      "us-east-1",
+		AccessToken: "secret",
+		ExpiresAt:   expires,
+	}
+	if err := writeSSOToken(dir, token); err != nil {
+		t.Fatal(err)
+	}
+	// The name the SDK looks up for a legacy sso_start_url profile
+	data, err := os.ReadFile(filepath.Join(dir, "acff06c7037450e5a3fddcacb0a34e921da42d68.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached map[string]any
+	if err := json.Unmarshal(data, &cached); err != nil {
+		t.Fatal(err)
+	}
+	if cached["accessToken"] != "secret" || cached["expiresAt"] != "2026-10-14T18:00:00Z" || cached["startUrl"] != token.StartURL {
+		t.Errorf("cached token = %s", data)
+	}
+}
+
+func TestUseLoginProfile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	path, err := userConfigPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUserConfig(path, userConfig{Project: "cfd", AWSProfile: "awsmpirun"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadUserConfig(path)
+	if err != nil || config.Project != "cfd" || config.AWSProfile != "awsmpirun" {
+		t.Fatalf("loadUserConfig() = %+v, %v", config, err)
+	}
+
+	t.Setenv("AWS_PROFILE", "mine")
+	useLoginProfile()
+	if got := os.Getenv("AWS_PROFILE"); got != "mine" {
+		t.Errorf("AWS_PROFILE = %q, want the one already set", got)
+	}
+	t.Setenv("AWS_PROFILE", "")
+	useLoginProfile()
+	if got := os.Getenv("AWS_PROFILE"); got != "awsmpirun" {
+		t.Errorf("AWS_PROFILE = %q, want awsmpirun", got)
+	}
+}
@@ -0,0 +1,195 @@
+// cmd/manifest.go
+// This file implements shared-manifest launches. Instead of pushing a script with the
+// full address table to every instance (O(N²) bytes overall), the address table is
+// uploaded to S3 once and every instance receives the same small script, which fetches
+// the manifest and derives its own rank from its instance ID.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// maxSendCommandTargets is the most instance IDs SSM accepts in one SendCommand call
+const maxSendCommandTargets = 50
+
+// manifestKey is the S3 key of a job's address manifest
+func manifestKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/manifest.txt"
+}
+
+// launchScriptKey is the S3 key of the script every rank of a job was started with.
+// awsmpirun migrate reruns it to start a rank on a replacement instance.
+func launchScriptKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/launch.sh"
+}
+
+// lookupRankInstance returns the instance running rank in a job started with --bucket
+func lookupRankInstance(ctx context.Context, bucket, project, jobID string, rank int) (string, error) {
+	s3Client, err := awsManager.NewS3Client(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	data, err := s3Client.DownloadBytes(ctx, manifestKey(project, jobID))
+	if err != nil {
+		return "", fmt.Errorf("failed to read job manifest: %v", err)
+	}
+	entries, err := parseManifest(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse job manifest: %v", err)
+	}
+	if rank < 0 || rank >= len(entries) {
+		return "", fmt.Errorf("rank %d is not part of the job (size %d)", rank, len(entries))
+	}
+	return entries[rank].InstanceID, nil
+}
+
+// buildManifest renders one manifest line per rank, see manifestEntry
+func buildManifest(instances []awsManager.InstanceInfo) []byte {
+	entries := make([]manifestEntry, len(instances))
+	for i, instance := range instances {
+		address := instance.PrivateIP
+		if address == "" {
+			address = instance.PublicIP
+		}
+		entries[i] = newManifestEntry(instance, instance.InstanceRank, address)
+	}
+	return renderManifest(entries)
+}
+
+// rankAddress returns the address table entry of rank, which listens on port of
+// instance
+func rankAddress(instance awsManager.InstanceInfo, rank, port int) mpi.RankAddress {
+	return mpi.RankAddress{
+		Rank:             rank,
+		Address:          fmt.Sprintf("%s:%d", rankHost(instance), port),
+		InstanceID:       instance.InstanceID,
+		InstanceType:     instance.InstanceType,
+		AvailabilityZone: instance.AvailabilityZone,
+		PlacementGroup:   instance.PlacementGroup,
+		Lifecycle:        instance.Lifecycle,
+	}
+}
+
+// addressTable renders the address table the runtime reads, with every rank's address
+// and instance
+func addressTable(instances []awsManager.InstanceInfo) []byte {
+	var table mpi.AddressTable
+	for _, instance := range instances {
+		table.Ranks = append(table.Ranks, rankAddress(instance, instance.InstanceRank, rankPort))
+	}
+	data, _ := json.Marshal(table)
+	return data
+}
+
+// manifestAddressTable returns the command that turns the manifest at manifest, a shell
+// word, into the address table the runtime reads at path. The instance columns are
+// left out where they are "-", and on the three-column lines of older manifests.
+func manifestAddressTable(manifest, path string) string {
+	return shellf(`awk 'BEGIN { printf "{\"ranks\":["; split("instance_type availability_zone lifecycle placement_group", keys, " ") }
+{
+  printf "%%s{\"rank\":%%d,\"address\":\"%%s:%d\",\"instance_id\":\"%%s\"", (NR > 1 ? "," : ""), $2, $3, $1
+  for (i = 4; i <= NF && i <= 7; i++) if ($i != "-") printf ",\"%%s\":\"%%s\"", keys[i - 3], $i
+  printf "}"
+}
+END { print "]}" }' %s > %s`, rankPort, shellExpr(manifest), path)
+}
+
+// buildManifestScript returns the script shared by all ranks. Each instance looks up its
+// own ID from instance metadata, exports the same variables buildRankScript would, and
+// turns the manifest into the address table file.
+func (o *runOptions) buildManifestScript(bucketRegion, region, command string) string {
+	manifestDir := fmt.Sprintf("/tmp/awsmpirun/%s", o.jobID)
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("MANIFEST=%s", manifestDir+"/manifest.txt")
+	script.Linef("mkdir -p %s", manifestDir)
+	script.Raw(`# Reuse the manifest if an earlier command of this job already fetched it
+if [ ! -s "$MANIFEST" ]; then`)
+	script.Linef(`  aws s3 cp s3://%s/%s "$MANIFEST" --region %s --only-show-errors`, o.bucket, manifestKey(o.project, o.jobID), bucketRegion)
+	script.Raw(`fi
+TOKEN=$(curl -s -X PUT http://169.254.169.254/latest/api/token -H "X-aws-ec2-metadata-token-ttl-seconds: 60")
+SELF=$(curl -s -H "X-aws-ec2-metadata-token: $TOKEN" http://169.254.169.254/latest/meta-data/instance-id)
+export MPI_SIZE=$(wc -l < "$MANIFEST")
+export MPI_RANK=$(awk -v self="$SELF" '$1 == self { print $2 }' "$MANIFEST")
+if [ -z "$MPI_RANK" ]; then
+  echo "instance $SELF is not in the job manifest" >&2
+  exit 1
+fi`)
+	script.Raw(manifestAddressTable(`"$MANIFEST"`, mpi.AddressFile(o.jobID)))
+	o.writeJobEnv(script, region)
+	script.Raw(workDirSetup())
+	o.writeSourceCheckout(script, region)
+	script.Raw("set +e")
+	script.Raw(o.rankLaunch(command))
+	return script.String()
+}
+
+// uploadManifest uploads the job manifest and the script every rank starts with, and
+// returns the script
+func (o *runOptions) uploadManifest(ctx context.Context, instances []awsManager.InstanceInfo, region string) (string, error) {
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return "", fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	err = s3Client.UploadBytes(ctx, buildManifest(instances), manifestKey(o.project, o.jobID))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload job manifest: %v", err)
+	}
+
+	script := o.buildManifestScript(s3Client.Client.Options().Region, region, o.executablePath)
+	err = s3Client.UploadBytes(ctx, []byte(script), launchScriptKey(o.project, o.jobID))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload launch script: %v", err)
+	}
+	return script, nil
+}
+
+// sendManifestCommands uploads the job manifest and starts the program on all instances
+// with one SendCommand per batch of instances. It returns the command ID for each instance.
+func (o *runOptions) sendManifestCommands(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) (map[string]string, error) {
+	script, err := o.uploadManifest(ctx, instances, ssmClient.Options().Region)
+	if err != nil {
+		return nil, err
+	}
+	return startManifestCommands(ctx, ssmClient, instances, script, o.executionTimeout())
+}
+
+// startManifestCommands starts the shared script on all instances, in batches of at
+// most maxSendCommandTargets, letting it run for executionTimeout seconds
+func startManifestCommands(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, script string, executionTimeout int) (map[string]string, error) {
+	commandIDs := make(map[string]string)
+
+	for start := 0; start < len(instances); start += maxSendCommandTargets {
+		end := start + maxSendCommandTargets
+		if end > len(instances) {
+			end = len(instances)
+		}
+
+		var instanceIDs []string
+		for _, instance := range instances[start:end] {
+			instanceIDs = append(instanceIDs, instance.InstanceID)
+		}
+
+		input := shellScriptInput(script, executionTimeout)
+		input.InstanceIds = instanceIDs
+		result, err := ssmClient.SendCommand(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute program on instances %v: %v", instanceIDs, err)
+		}
+
+		for _, instanceID := range instanceIDs {
+			commandIDs[instanceID] = *result.Command.CommandId
+		}
+	}
+
+	return commandIDs, nil
+}
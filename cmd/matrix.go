@@ -0,0 +1,553 @@
+// cmd/matrix.go
+// This file implements the matrix command, which builds one program under several
+// configurations and runs each of them on the same instances in one submission: every
+// combination of the Go versions, build tag sets, and GOGC settings given. The source
+// is staged once, each Go version and tag set is built once as build does, and the
+// GOGC settings of a build run the same binary. Every configuration runs --repeat times
+// with the same seed, and the report compares them with the first configuration: the
+// median wall time, the speedup over the baseline, and whether rank 0 printed the
+// same output, which is how a tuning study notices a configuration that is faster
+// because it computes something else.
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/spf13/cobra"
+)
+
+// maxMatrixCells is the most configurations one matrix may have
+const maxMatrixCells = 64
+
+// matrixDir is where the binaries of the matrix builds are written on the instances
+const matrixDir = "/var/lib/awsmpirun/matrix"
+
+// Verdicts of a configuration in the report
+const (
+	verdictBaseline = "baseline"
+	verdictSame     = "same"
+	verdictDiffers  = "differs" // Rank 0 printed something else than in the baseline
+	verdictVaries   = "varies"  // The runs of the configuration printed different outputs
+	verdictFailed   = "failed"  // A run failed
+	verdictNotBuilt = "not built"
+)
+
+// matrixOptions are the flags of the matrix command
+type matrixOptions struct {
+	project    string
+	vpc        string
+	instances  int
+	bucket     string
+	source     string
+	pkg        string
+	args       string
+	goVersions []string
+	tags       []string
+	gogc       []string
+	repeat     int
+	ignore     string
+	noCache    bool
+	json       bool
+}
+
+// newMatrixCmd returns the matrix command
+func newMatrixCmd() *cobra.Command {
+	o := &matrixOptions{}
+	cmd := &cobra.Command{
+		Use:   "matrix --vpc VPC --bucket BUCKET",
+		Short: "Build and run a Go program under several configurations and compare them",
+		Long: `matrix builds the module in --src on the instances under every combination of
+--go versions, --tags sets, and --gogc settings, runs each build with --args on the
+same instances, and reports how the configurations compare:
+
+    awsmpirun matrix -v vpc-0abc -n 8 --bucket my-staging --package ./cmd/solver \
+        --go 1.22.5,1.23.2 --tags "" --tags netgo --gogc 100,400,off --repeat 3
+
+Go versions are built with GOTOOLCHAIN, so the instances need Go 1.21 or later and
+access to the Go module proxy to download the others. --tags is repeated, once per
+set, since a set is itself comma-separated. The first configuration is the baseline.
+Every run uses the same seed, and rank 0's output is compared with the baseline's
+after dropping the lines that match --ignore, such as lines with timings. Wall times
+are measured from sending the commands to the last rank finishing, so they include
+SSM delivery; repeat short runs to see past it. The command exits non-zero when any
+configuration failed or printed something different.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runMatrix(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 1, "Number of EC2 instances")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "S3 bucket the source, build cache, and job manifests are staged in (required)")
+	cmd.Flags().StringVar(&o.source, "src", ".", "Local directory with the module to build")
+	cmd.Flags().StringVar(&o.pkg, "package", ".", "Package to build, relative to --src")
+	cmd.Flags().StringVar(&o.args, "args", "", "Arguments of the program; {rank}, {size}, {job_id}, and {work_dir} are expanded per rank")
+	cmd.Flags().StringSliceVar(&o.goVersions, "go", nil, "Go versions to build with, e.g. 1.22.5,1.23.2 (default: the Go installed on the instances)")
+	cmd.Flags().StringArrayVar(&o.tags, "tags", nil, `Build tag set, comma-separated; repeat the flag for every set, "" for none (default: no tags)`)
+	cmd.Flags().StringSliceVar(&o.gogc, "gogc", nil, `GOGC settings to run with, e.g. 100,400,off (default: the runtime default)`)
+	cmd.Flags().IntVar(&o.repeat, "repeat", 1, "Runs of every configuration")
+	cmd.Flags().StringVar(&o.ignore, "ignore", "", "Regular expression of output lines to leave out of the comparison, such as timings")
+	cmd.Flags().BoolVar(&o.noCache, "no-cache", false, "Build without restoring or saving the build cache")
+	cmd.Flags().BoolVar(&o.json, "json", false, "Print the report as JSON")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newMatrixCmd())
+}
+
+// matrixCell is one configuration of a matrix
+type matrixCell struct {
+	Go   string `json:"go,omitempty"`   // Empty for the Go installed on the instances
+	Tags string `json:"tags,omitempty"` // Comma-separated
+	GOGC string `json:"gogc,omitempty"` // Empty for the runtime default
+}
+
+// matrixBuildKey is what one build of a matrix is made with; the GOGC settings of a
+// matrix share the builds
+type matrixBuildKey struct {
+	Go   string
+	Tags string
+}
+
+func (c matrixCell) buildKey() matrixBuildKey {
+	return matrixBuildKey{Go: c.Go, Tags: c.Tags}
+}
+
+func (c matrixCell) String() string {
+	goVersion, tags, gogc := "installed Go", "no tags", "default GOGC"
+	if c.Go != "" {
+		goVersion = "go" + c.Go
+	}
+	if c.Tags != "" {
+		tags = "tags " + c.Tags
+	}
+	if c.GOGC != "" {
+		gogc = "GOGC=" + c.GOGC
+	}
+	return goVersion + ", " + tags + ", " + gogc
+}
+
+var (
+	goVersionPattern = regexp.MustCompile(`^1\.\d+(\.\d+)?((rc|beta)\d+)?$`)
+	buildTagsPattern = regexp.MustCompile(`^[A-Za-z0-9_.]+(,[A-Za-z0-9_.]+)*$`)
+)
+
+// parseMatrix returns every combination of the axes, Go versions outermost. An empty
+// axis has the one default value.
+func parseMatrix(goVersions, tagSets, gogc []string) ([]matrixCell, error) {
+	for _, version := range goVersions {
+		if !goVersionPattern.MatchString(version) {
+			return nil, fmt.Errorf("--go: invalid Go version %q, expected one such as 1.23.2", version)
+		}
+	}
+	for _, tags := range tagSets {
+		if tags != "" && !buildTagsPattern.MatchString(tags) {
+			return nil, fmt.Errorf("--tags: invalid build tags %q", tags)
+		}
+	}
+	for _, value := range gogc {
+		if n, err := strconv.Atoi(value); value != "off" && (err != nil || n < 0) {
+			return nil, fmt.Errorf("--gogc: invalid setting %q, expected a percentage or off", value)
+		}
+	}
+	axis := func(values []string) []string {
+		if len(values) == 0 {
+			return []string{""}
+		}
+		return values
+	}
+	var cells []matrixCell
+	for _, version := range axis(goVersions) {
+		for _, tags := range axis(tagSets) {
+			for _, value := range axis(gogc) {
+				cell := matrixCell{Go: version, Tags: tags, GOGC: value}
+				if slices.Contains(cells, cell) {
+					return nil, fmt.Errorf("configuration %s is given twice", cell)
+				}
+				cells = append(cells, cell)
+			}
+		}
+	}
+	if len(cells) > maxMatrixCells {
+		return nil, fmt.Errorf("the matrix has %d configurations, at most %d are allowed", len(cells), maxMatrixCells)
+	}
+	return cells, nil
+}
+
+// matrixResult is how one configuration did
+type matrixResult struct {
+	matrixCell
+	BuildError string    `json:"build_error,omitempty"`
+	WallTimes  []float64 `json:"wall_times,omitempty"` // Seconds of every run that finished
+	Failures   []string  `json:"failures,omitempty"`   // Why the runs that failed did
+	Output     string    `json:"output_sha256,omitempty"`
+	Verdict    string    `json:"verdict"`
+	Speedup    float64   `json:"speedup,omitempty"` // Median wall time of the baseline over this one's
+
+	digests []string // Digest of rank 0's output in every run that finished
+}
+
+// outputDigest returns the digest of a rank's output without the lines ignore matches
+func outputDigest(output string, ignore *regexp.Regexp) string {
+	var kept []string
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if ignore == nil || !ignore.MatchString(line) {
+			kept = append(kept, line)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(kept, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// median returns the median of values, which must not be empty
+func median(values []float64) float64 {
+	sorted := slices.Sorted(slices.Values(values))
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// judgeMatrix sets the verdict of every result, comparing them with the first one
+// whose runs all finished with the same output
+func judgeMatrix(results []matrixResult) {
+	baseline := -1
+	for i := range results {
+		r := &results[i]
+		switch {
+		case r.BuildError != "":
+			r.Verdict = verdictNotBuilt
+		case len(r.Failures) > 0:
+			r.Verdict = verdictFailed
+		case slices.ContainsFunc(r.digests, func(d string) bool { return d != r.digests[0] }):
+			r.Verdict = verdictVaries
+		default:
+			r.Output = r.digests[0]
+			if baseline < 0 {
+				baseline = i
+				r.Verdict = verdictBaseline
+			} else if r.Output == results[baseline].Output {
+				r.Verdict = verdictSame
+			} else {
+				r.Verdict = verdictDiffers
+			}
+		}
+	}
+	if baseline < 0 {
+		return
+	}
+	reference := median(results[baseline].WallTimes)
+	for i := range results {
+		if len(results[i].WallTimes) > 0 {
+			results[i].Speedup = reference / median(results[i].WallTimes)
+		}
+	}
+}
+
+// writeMatrixReport prints results as a table and returns how many configurations
+// failed or printed something other than the baseline
+func writeMatrixReport(w io.Writer, results []matrixResult) int {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "GO\tTAGS\tGOGC\tRUNS\tMEDIAN\tSPEEDUP\tRESULT")
+	bad := 0
+	for _, r := range results {
+		goVersion, tags, gogc := "installed", "-", "default"
+		if r.Go != "" {
+			goVersion = r.Go
+		}
+		if r.Tags != "" {
+			tags = r.Tags
+		}
+		if r.GOGC != "" {
+			gogc = r.GOGC
+		}
+		wall, speedup := "-", "-"
+		if len(r.WallTimes) > 0 {
+			wall = (time.Duration(median(r.WallTimes) * float64(time.Second))).Round(100 * time.Millisecond).String()
+		}
+		if r.Speedup > 0 {
+			speedup = fmt.Sprintf("%.2fx", r.Speedup)
+		}
+		result := r.Verdict
+		switch {
+		case r.BuildError != "":
+			result += ": " + lastLine(r.BuildError)
+		case len(r.Failures) > 0:
+			result += ": " + r.Failures[0]
+		}
+		if r.Verdict != verdictBaseline && r.Verdict != verdictSame {
+			bad++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d/%d\t%s\t%s\t%s\n", goVersion, tags, gogc, len(r.WallTimes), len(r.WallTimes)+len(r.Failures), wall, speedup, result)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "%d of %d configurations match the baseline\n", len(results)-bad, len(results))
+	return bad
+}
+
+func runMatrix(ctx context.Context, o *matrixOptions) {
+	if o.instances < 1 || o.repeat < 1 {
+		fmt.Println("Error: --num-instances and --repeat must be at least 1")
+		os.Exit(1)
+	}
+	if err := validateBucketName(o.bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if info, err := os.Stat(o.source); err != nil || !info.IsDir() {
+		fmt.Printf("Error: --src %s is not a directory\n", o.source)
+		os.Exit(1)
+	}
+	var ignore *regexp.Regexp
+	if o.ignore != "" {
+		var err error
+		if ignore, err = regexp.Compile(o.ignore); err != nil {
+			fmt.Printf("Error: --ignore: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	cells, err := parseMatrix(o.goVersions, o.tags, o.gogc)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validateCommandTemplate(matrixCommand("/bin/program", o.args), launcherNative); err != nil {
+		fmt.Printf("Error in --args: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	jobID, err := newJobID()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	seed, err := newJobSeed()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Job ID: %s\n", jobID)
+	fmt.Printf("%d configurations, %d runs each, seed %d\n", len(cells), o.repeat, seed)
+
+	// Step 1: Stage the source tree once for every build
+	archive, err := archiveSource(o.source)
+	if err != nil {
+		fmt.Printf("Error packing %s: %v\n", o.source, err)
+		os.Exit(1)
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := s3Client.UploadBytes(ctx, archive, buildSourceKey(project, jobID)); err != nil {
+		fmt.Printf("Error staging source: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 2: Pick the instances every configuration runs on
+	instances, err := discoverInstances(ctx, o.vpc, project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) < o.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", o.instances, len(instances))
+		os.Exit(1)
+	}
+	instances = instances[:o.instances]
+	assignRanks(instances)
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 3: Build and run every configuration
+	m := &matrixRun{
+		options:   o,
+		project:   project,
+		jobID:     jobID,
+		seed:      seed,
+		region:    s3Client.Client.Options().Region,
+		ssm:       ssmClient,
+		instances: instances,
+		builds:    make(map[matrixBuildKey]string),
+		buildErrs: make(map[matrixBuildKey]error),
+	}
+	results := make([]matrixResult, len(cells))
+	for i, cell := range cells {
+		fmt.Printf("Configuration %d/%d: %s\n", i+1, len(cells), cell)
+		results[i] = m.runCell(ctx, cell, ignore)
+	}
+	m.cleanUp(ctx)
+
+	judgeMatrix(results)
+	if o.json {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		for _, r := range results {
+			if r.Verdict != verdictBaseline && r.Verdict != verdictSame {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+	if writeMatrixReport(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// matrixCommand is the command the ranks of a configuration run the binary with args
+func matrixCommand(binary, args string) string {
+	return strings.TrimSpace(binary + " " + args)
+}
+
+// matrixRun is a matrix being built and run on its instances
+type matrixRun struct {
+	options   *matrixOptions
+	project   string
+	jobID     string
+	seed      uint64
+	region    string
+	ssm       *ssm.Client
+	instances []awsManager.InstanceInfo
+	builds    map[matrixBuildKey]string // Binary of every build that succeeded
+	buildErrs map[matrixBuildKey]error
+}
+
+// binary returns the binary of the build cell runs, building it the first time
+func (m *matrixRun) binary(ctx context.Context, cell matrixCell) (string, error) {
+	key := cell.buildKey()
+	if binary, ok := m.builds[key]; ok {
+		return binary, nil
+	}
+	if err, ok := m.buildErrs[key]; ok {
+		return "", err
+	}
+	binary := path.Join(matrixDir, m.jobID, strconv.Itoa(len(m.builds)+len(m.buildErrs)), "program")
+	b := &remoteBuild{
+		bucket:  m.options.bucket,
+		region:  m.region,
+		project: m.project,
+		jobID:   m.jobID,
+		pkg:     m.options.pkg,
+		output:  binary,
+		cache:   !m.options.noCache,
+		canary:  true,
+		writers: cacheWriters(m.instances),
+		tags:    cell.Tags,
+	}
+	if cell.Go != "" {
+		b.toolchain = "go" + cell.Go
+	}
+	if err := b.run(ctx, m.ssm, m.instances); err != nil {
+		m.buildErrs[key] = err
+		return "", err
+	}
+	m.builds[key] = binary
+	return binary, nil
+}
+
+// runCell builds the binary of cell if needed and runs it --repeat times
+func (m *matrixRun) runCell(ctx context.Context, cell matrixCell, ignore *regexp.Regexp) matrixResult {
+	result := matrixResult{matrixCell: cell}
+	binary, err := m.binary(ctx, cell)
+	if err != nil {
+		result.BuildError = err.Error()
+		return result
+	}
+	for run := 1; run <= m.options.repeat; run++ {
+		wall, output, err := m.runOnce(ctx, cell, binary)
+		if err != nil {
+			fmt.Printf("  run %d: failed: %v\n", run, err)
+			result.Failures = append(result.Failures, err.Error())
+			continue
+		}
+		fmt.Printf("  run %d: %s\n", run, wall.Round(100*time.Millisecond))
+		result.WallTimes = append(result.WallTimes, wall.Seconds())
+		result.digests = append(result.digests, outputDigest(output, ignore))
+	}
+	return result
+}
+
+// runOnce runs binary with the settings of cell as a job of its own and returns its
+// wall time and the output of rank 0
+func (m *matrixRun) runOnce(ctx context.Context, cell matrixCell, binary string) (time.Duration, string, error) {
+	jobID, err := newJobID()
+	if err != nil {
+		return 0, "", err
+	}
+	o := newRunOptions()
+	o.project = m.project
+	o.jobID = jobID
+	o.jobSeed = m.seed
+	o.bucket = m.options.bucket
+	o.workDir = "/tmp/awsmpirun/{job_id}"
+	o.executablePath = matrixCommand(binary, m.options.args)
+	if cell.GOGC != "" {
+		o.extraEnv = []string{"GOGC=" + cell.GOGC}
+	}
+
+	start := time.Now()
+	commandIDs, err := o.sendManifestCommands(ctx, m.ssm, m.instances)
+	if err != nil {
+		return 0, "", err
+	}
+	_, failures, err := waitForRanks(ctx, m.ssm, m.instances, commandIDs, nil)
+	wall := time.Since(start)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(failures) > 0 {
+		return 0, "", fmt.Errorf("%s", lastLine(summarizeFailures(failures)))
+	}
+	outputs, err := runScriptOnInstances(ctx, m.ssm, m.instances[:1], func(awsManager.InstanceInfo) string {
+		return o.rankOutputScript()
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read the output of rank 0: %v", err)
+	}
+	return wall, outputs[m.instances[0].InstanceID], nil
+}
+
+// cleanUp removes the binaries of the matrix from the instances
+func (m *matrixRun) cleanUp(ctx context.Context) {
+	_, err := runScriptOnInstances(ctx, m.ssm, m.instances, func(awsManager.InstanceInfo) string {
+		return shellf("rm -rf %s", path.Join(matrixDir, m.jobID))
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to remove the matrix builds from the instances: %v\n", err)
+	}
+}
@@ -0,0 +1,171 @@
+// cmd/matrix_test.go
+
+package cmd
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseMatrix(t *testing.T) {
+	tests := []struct {
+		name       string
+		goVersions []string
+		tagSets    []string
+		gogc       []string
+		want       []matrixCell
+		wantErr    string
+	}{
+		{name: "defaults", want: []matrixCell{{}}},
+		{
+			name:       "every axis",
+			goVersions: []string{"1.22.5", "1.23.2"},
+			tagSets:    []string{"", "netgo,osusergo"},
+			gogc:       []string{"100", "off"},
+			want: []matrixCell{
+				{Go: "1.22.5", GOGC: "100"}, {Go: "1.22.5", GOGC: "off"},
+				{Go: "1.22.5", Tags: "netgo,osusergo", GOGC: "100"}, {Go: "1.22.5", Tags: "netgo,osusergo", GOGC: "off"},
+				{Go: "1.23.2", GOGC: "100"}, {Go: "1.23.2", GOGC: "off"},
+				{Go: "1.23.2", Tags: "netgo,osusergo", GOGC: "100"}, {Go: "1.23.2", Tags: "netgo,osusergo", GOGC: "off"},
+			},
+		},
+		{name: "release candidate", goVersions: []string{"1.24rc1"}, want: []matrixCell{{Go: "1.24rc1"}}},
+		{name: "go prefix", goVersions: []string{"go1.23.2"}, wantErr: `invalid Go version "go1.23.2"`},
+		{name: "tags with a space", tagSets: []string{"netgo osusergo"}, wantErr: "invalid build tags"},
+		{name: "negative GOGC", gogc: []string{"-1"}, wantErr: `invalid setting "-1"`},
+		{name: "twice", gogc: []string{"100", "100"}, wantErr: "given twice"},
+		{name: "too many", goVersions: []string{"1.21", "1.22", "1.23", "1.24", "1.25"}, gogc: []string{"25", "50", "100", "200", "400", "800", "1600", "3200", "6400", "off", "12800", "25600", "51200"}, wantErr: "65 configurations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMatrix(tt.goVersions, tt.tagSets, tt.gogc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseMatrix() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMatrix() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputDigest(t *testing.T) {
+	ignore := regexp.MustCompile(`^elapsed`)
+	tests := []struct {
+		name   string
+		a, b   string
+		ignore *regexp.Regexp
+		same   bool
+	}{
+		{name: "same", a: "sum=42\n", b: "sum=42\n", same: true},
+		{name: "different", a: "sum=42\n", b: "sum=43\n"},
+		{name: "trailing whitespace", a: "sum=42  \r\n\n", b: "sum=42", same: true},
+		{name: "timing differs", a: "sum=42\nelapsed 1.2s\n", b: "sum=42\nelapsed 0.9s\n"},
+		{name: "timing ignored", a: "sum=42\nelapsed 1.2s\n", b: "sum=42\nelapsed 0.9s\n", ignore: ignore, same: true},
+		{name: "result differs next to ignored timing", a: "elapsed 1s\nsum=42\n", b: "elapsed 1s\nsum=41\n", ignore: ignore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := outputDigest(tt.a, tt.ignore) == outputDigest(tt.b, tt.ignore); same != tt.same {
+				t.Errorf("digests of %q and %q equal = %v, want %v", tt.a, tt.b, same, tt.same)
+			}
+		})
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{[]float64{3}, 3},
+		{[]float64{5, 1, 3}, 3},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	}
+	for _, tt := range tests {
+		if got := median(tt.values); got != tt.want {
+			t.Errorf("median(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestJudgeMatrix(t *testing.T) {
+	results := []matrixResult{
+		{matrixCell: matrixCell{Go: "1.22.5"}, BuildError: "go: download go1.22.5: not found"},
+		{matrixCell: matrixCell{GOGC: "50"}, Failures: []string{"rank 1 exited with 2"}},
+		{matrixCell: matrixCell{GOGC: "100"}, WallTimes: []float64{10, 12, 11}, digests: []string{"a", "a", "a"}},
+		{matrixCell: matrixCell{GOGC: "400"}, WallTimes: []float64{5, 6}, digests: []string{"a", "a"}},
+		{matrixCell: matrixCell{GOGC: "off"}, WallTimes: []float64{4}, digests: []string{"b"}},
+		{matrixCell: matrixCell{Tags: "fast"}, WallTimes: []float64{8, 8}, digests: []string{"a", "c"}},
+	}
+	judgeMatrix(results)
+	want := []struct {
+		verdict string
+		speedup float64
+	}{
+		{verdictNotBuilt, 0},
+		{verdictFailed, 0},
+		{verdictBaseline, 1},
+		{verdictSame, 2},
+		{verdictDiffers, 2.75},
+		{verdictVaries, 1.375},
+	}
+	for i, r := range results {
+		if r.Verdict != want[i].verdict || r.Speedup != want[i].speedup {
+			t.Errorf("%s: verdict %q, speedup %v; want %q, %v", r.matrixCell, r.Verdict, r.Speedup, want[i].verdict, want[i].speedup)
+		}
+	}
+}
+
+func TestJudgeMatrixNoBaseline(t *testing.T) {
+	results := []matrixResult{
+		{Failures: []string{"timed out"}},
+		{WallTimes: []float64{1, 1}, digests: []string{"a", "b"}},
+	}
+	judgeMatrix(results)
+	if results[0].Verdict != verdictFailed || results[1].Verdict != verdictVaries || results[1].Speedup != 0 {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestWriteMatrixReport(t *testing.T) {
+	results := []matrixResult{
+		{matrixCell: matrixCell{}, WallTimes: []float64{12.34}, digests: []string{"a"}},
+		{matrixCell: matrixCell{Go: "1.23.2", Tags: "netgo", GOGC: "off"}, WallTimes: []float64{6.17}, digests: []string{"a"}},
+		{matrixCell: matrixCell{Go: "1.21"}, BuildError: "building on i-1 failed\ngo: go.mod requires go >= 1.23"},
+		{matrixCell: matrixCell{GOGC: "10"}, WallTimes: []float64{20}, Failures: []string{"rank 0 exited with 1"}, digests: []string{"a"}},
+	}
+	judgeMatrix(results)
+	var out strings.Builder
+	bad := writeMatrixReport(&out, results)
+	if bad != 2 {
+		t.Errorf("writeMatrixReport() = %d, want 2", bad)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := [][]string{
+		{"GO", "TAGS", "GOGC", "RUNS", "MEDIAN", "SPEEDUP", "RESULT"},
+		{"installed", "-", "default", "1/1", "12.3s", "1.00x", "baseline"},
+		{"1.23.2", "netgo", "off", "1/1", "6.2s", "2.00x", "same"},
+		{"1.21", "-", "default", "0/0", "-", "-", "not built: go: go.mod requires go >= 1.23"},
+		{"installed", "-", "10", "1/2", "20s", "0.62x", "failed: rank 0 exited with 1"},
+	}
+	if len(lines) != len(want)+1 {
+		t.Fatalf("report has %d lines:\n%s", len(lines), out.String())
+	}
+	for i, fields := range want {
+		if got := strings.Join(strings.Fields(lines[i]), " "); got != strings.Join(fields, " ") {
+			t.Errorf("line %d = %q, want %q", i, got, strings.Join(fields, " "))
+		}
+	}
+	if lines[len(lines)-1] != "2 of 4 configurations match the baseline" {
+		t.Errorf("summary = %q", lines[len(lines)-1])
+	}
+}
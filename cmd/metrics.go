@@ -0,0 +1,126 @@
+// cmd/metrics.go
+// This file implements --metrics, which publishes the statistics of every run that
+// finishes or fails as CloudWatch custom metrics, so alarms (a job that suddenly takes
+// twice as long) and long-term dashboards need no storage of awsmpirun's own. The
+// metrics go to the AWSMPIRun namespace with the project as their dimension:
+//
+//	Ranks        ranks the job ran on
+//	WallTime     seconds from the start of the run to its end
+//	BytesSent    bytes the ranks sent each other, from the runtime's totals
+//	FailedRanks  ranks that failed
+//	JobFailed    1 if the run failed, 0 if it finished
+//	JobStarted   1 once the instances are found, which checks that publishing works
+//
+// The ranks report their traffic totals in a stdout line after the program exits, so
+// BytesSent is only published when the ranks ran on the awsmpirun runtime. Publishing
+// is best effort: a run is not failed because its metrics could not be sent.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// metricsNamespace is the CloudWatch namespace of the job metrics
+const metricsNamespace = "AWSMPIRun"
+
+// rankStatsMarker prefixes the stdout line in which a rank's script reports the
+// traffic totals the runtime wrote at Finalize
+const rankStatsMarker = "awsmpirun-rank-stats: "
+
+// rankStatsReport returns the script lines that print the rank's traffic totals, if
+// the runtime wrote them
+func rankStatsReport() string {
+	return shellf(`if [ -s "$%[1]s" ]; then
+  echo "%[2]s$(cat "$%[1]s")"
+fi`, shellExpr(mpi.EnvStatsFile), shellExpr(rankStatsMarker))
+}
+
+// parseRankStats returns the traffic totals a rank's script reported, whether it
+// reported any, and its output without the report
+func parseRankStats(stdout string) (mpi.Stats, bool, string) {
+	var stats mpi.Stats
+	found := false
+	var kept []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), rankStatsMarker); ok {
+			if !found && json.Unmarshal([]byte(value), &stats) == nil {
+				found = true
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return stats, found, strings.Join(kept, "\n")
+}
+
+// jobStats is what a run's metrics are built from
+type jobStats struct {
+	Ranks         int
+	WallTime      time.Duration
+	BytesSent     int64
+	StatsReported bool // Whether any rank reported its traffic totals
+	FailedRanks   int
+	Failed        bool
+}
+
+// jobMetrics returns the metric values of a run of project
+func jobMetrics(project string, stats jobStats, at time.Time) []awsManager.MetricDatum {
+	dimensions := map[string]string{"Project": project}
+	failed := 0.0
+	if stats.Failed {
+		failed = 1
+	}
+	data := []awsManager.MetricDatum{
+		{Name: "Ranks", Value: float64(stats.Ranks), Unit: "Count"},
+		{Name: "WallTime", Value: stats.WallTime.Seconds(), Unit: "Seconds"},
+		{Name: "FailedRanks", Value: float64(stats.FailedRanks), Unit: "Count"},
+		{Name: "JobFailed", Value: failed, Unit: "Count"},
+	}
+	if stats.StatsReported {
+		data = append(data, awsManager.MetricDatum{Name: "BytesSent", Value: float64(stats.BytesSent), Unit: "Bytes"})
+	}
+	for i := range data {
+		data[i].Dimensions = dimensions
+		data[i].Timestamp = at
+	}
+	return data
+}
+
+// publishJobStarted sends the JobStarted metric of a run
+func (o *runOptions) publishJobStarted(ctx context.Context) error {
+	client, err := awsManager.NewMetricsClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.PutMetricData(ctx, metricsNamespace, []awsManager.MetricDatum{
+		{Name: "JobStarted", Value: 1, Unit: "Count", Dimensions: map[string]string{"Project": o.project}, Timestamp: time.Now()},
+	})
+}
+
+// publishJobMetrics sends the metrics of a run that ran for wallTime, with --metrics
+func (o *runOptions) publishJobMetrics(ctx context.Context, s *runState, wallTime time.Duration, failed bool) {
+	if !o.metrics {
+		return
+	}
+	stats := s.stats
+	stats.Ranks = len(s.instances)
+	stats.WallTime = wallTime
+	stats.Failed = failed
+	client, err := awsManager.NewMetricsClient(ctx)
+	if err == nil {
+		err = client.PutMetricData(ctx, metricsNamespace, jobMetrics(o.project, stats, time.Now()))
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to publish the job metrics: %v\n", err)
+		return
+	}
+	fmt.Printf("Published the job metrics to CloudWatch namespace %s\n", metricsNamespace)
+}
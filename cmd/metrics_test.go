@@ -0,0 +1,122 @@
+// cmd/metrics_test.go
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestParseRankStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		stdout    string
+		want      mpi.Stats
+		wantFound bool
+		wantRest  string
+	}{
+		{
+			name:      "reported",
+			stdout:    "result 42\n" + rankStatsMarker + `{"bytes_sent":1048576,"messages_sent":12}` + "\n",
+			want:      mpi.Stats{BytesSent: 1048576, MessagesSent: 12},
+			wantFound: true,
+			wantRest:  "result 42\n",
+		},
+		{name: "not reported", stdout: "result 42\n", wantRest: "result 42\n"},
+		{name: "malformed report is dropped", stdout: rankStatsMarker + "{oops\nresult", wantRest: "result"},
+		{
+			name:      "first report wins",
+			stdout:    rankStatsMarker + `{"bytes_sent":1}` + "\n" + rankStatsMarker + `{"bytes_sent":2}`,
+			want:      mpi.Stats{BytesSent: 1},
+			wantFound: true,
+			wantRest:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, rest := parseRankStats(tt.stdout)
+			if got != tt.want || found != tt.wantFound || rest != tt.wantRest {
+				t.Errorf("parseRankStats() = %+v, %v, %q; want %+v, %v, %q", got, found, rest, tt.want, tt.wantFound, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestJobMetrics(t *testing.T) {
+	at := time.Date(2026, 10, 14, 2, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		stats jobStats
+		want  map[string]float64
+	}{
+		{
+			name:  "finished",
+			stats: jobStats{Ranks: 64, WallTime: 90 * time.Second, BytesSent: 5e9, StatsReported: true},
+			want:  map[string]float64{"Ranks": 64, "WallTime": 90, "BytesSent": 5e9, "FailedRanks": 0, "JobFailed": 0},
+		},
+		{
+			name:  "failed without runtime stats",
+			stats: jobStats{Ranks: 8, WallTime: 1500 * time.Millisecond, FailedRanks: 2, Failed: true},
+			want:  map[string]float64{"Ranks": 8, "WallTime": 1.5, "FailedRanks": 2, "JobFailed": 1},
+		},
+	}
+	units := map[string]string{"Ranks": "Count", "WallTime": "Seconds", "BytesSent": "Bytes", "FailedRanks": "Count", "JobFailed": "Count"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := jobMetrics("cfd", tt.stats, at)
+			if len(data) != len(tt.want) {
+				t.Fatalf("jobMetrics() returned %d values, want %d: %+v", len(data), len(tt.want), data)
+			}
+			for _, datum := range data {
+				want, ok := tt.want[datum.Name]
+				if !ok || datum.Value != want {
+					t.Errorf("%s = %v, want %v", datum.Name, datum.Value, want)
+				}
+				if datum.Unit != units[datum.Name] {
+					t.Errorf("%s unit %q, want %q", datum.Name, datum.Unit, units[datum.Name])
+				}
+				if datum.Dimensions["Project"] != "cfd" || len(datum.Dimensions) != 1 || !datum.Timestamp.Equal(at) {
+					t.Errorf("%s dimensions %v at %v", datum.Name, datum.Dimensions, datum.Timestamp)
+				}
+			}
+		})
+	}
+}
+
+func TestRankLaunchReportsStats(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID = "test-" + filepath.Base(t.TempDir())
+	defer os.RemoveAll(filepath.Dir(rankStatsFile(o.jobID)))
+
+	// The program plays the runtime, writing its totals where the script says
+	program := `echo '{"bytes_sent":300,"messages_sent":3}' > "$` + mpi.EnvStatsFile + `"`
+	rank := exec.Command("bash", "-c", o.rankLaunch(program))
+	rank.Dir = t.TempDir()
+	out, err := rank.Output()
+	if err != nil {
+		t.Fatalf("rank script failed: %v", err)
+	}
+	stats, found, _ := parseRankStats(string(out))
+	if !found || stats != (mpi.Stats{BytesSent: 300, MessagesSent: 3}) {
+		t.Errorf("reported %+v (found %v) in %q", stats, found, out)
+	}
+
+	// A program that does not write them reports nothing, even after a run that did
+	rank = exec.Command("bash", "-c", o.rankLaunch("true"))
+	rank.Dir = t.TempDir()
+	out, err = rank.Output()
+	if err != nil {
+		t.Fatalf("rank script failed: %v", err)
+	}
+	if _, found, _ := parseRankStats(string(out)); found {
+		t.Errorf("stats reported without a stats file: %q", out)
+	}
+}
@@ -0,0 +1,280 @@
+// cmd/migrate.go
+// This file implements the migrate command, which moves one rank of a running job to a
+// replacement instance without restarting the other ranks. The rank is drained with
+// SIGTERM so it can save its checkpoint (mpi.SaveCheckpoint), the job manifest is updated
+// with the new instance, and the job's launch script is rerun there with MPI_RESTARTED=1.
+// When the new rank calls mpi.Init, the other ranks see its hello, redial it at the new
+// address, and receive an EventPeerJoined. Only jobs started with --bucket can migrate,
+// because the manifest and launch script live in the staging bucket.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateOptions are the flags of the migrate command
+type migrateOptions struct {
+	project      string
+	jobID        string
+	bucket       string
+	rank         int
+	target       string
+	drainTimeout time.Duration
+}
+
+// newMigrateCmd returns the migrate command
+func newMigrateCmd() *cobra.Command {
+	o := &migrateOptions{}
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Move one rank of a running job to a replacement instance",
+		Long: `migrate drains a rank of a running job, for example one whose spot instance is being
+reclaimed, and restarts it on another instance from its checkpoint. The other ranks keep
+running and reconnect to the rank at its new address. The job must have been started
+with --bucket, and the program must save a checkpoint when it receives SIGTERM or an
+interruption event and resume from it when mpi.Restarted() is true.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runMigrate(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the job belongs to (default: project in config.yaml)")
+	cmd.Flags().StringVar(&o.jobID, "job", "", "ID of the running job (required)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Staging bucket the job was started with (required)")
+	cmd.Flags().IntVar(&o.rank, "rank", -1, "Rank to move (required)")
+	cmd.Flags().StringVar(&o.target, "to", "", "Instance ID of the replacement instance (required)")
+	cmd.Flags().DurationVar(&o.drainTimeout, "drain-timeout", 2*time.Minute, "How long the rank gets to checkpoint and exit before it is killed")
+	cmd.MarkFlagRequired("job")
+	cmd.MarkFlagRequired("bucket")
+	cmd.MarkFlagRequired("rank")
+	cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newMigrateCmd())
+}
+
+func runMigrate(ctx context.Context, o *migrateOptions) {
+	if o.drainTimeout <= 0 {
+		fmt.Printf("Error: --drain-timeout must be positive\n")
+		os.Exit(1)
+	}
+	if err := validateJobID(o.jobID); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validateBucketName(o.bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	manifestData, err := s3Client.DownloadBytes(ctx, manifestKey(project, o.jobID))
+	if err != nil {
+		fmt.Printf("Error reading job manifest: %v\n", err)
+		os.Exit(1)
+	}
+	entries, err := parseManifest(manifestData)
+	if err != nil {
+		fmt.Printf("Error parsing job manifest: %v\n", err)
+		os.Exit(1)
+	}
+	launchScript, err := s3Client.DownloadBytes(ctx, launchScriptKey(project, o.jobID))
+	if err != nil {
+		fmt.Printf("Error reading launch script: %v\n", err)
+		os.Exit(1)
+	}
+
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	targets, err := awsManager.DescribeInstanceInfo(ctx, ec2Client, []string{o.target})
+	if err != nil {
+		fmt.Printf("Error describing replacement instance: %v\n", err)
+		os.Exit(1)
+	}
+	target := targets[0]
+	if owner := target.Tags[projectTagKey]; owner != project {
+		fmt.Printf("Error: instance %s belongs to project %q, not %q\n", o.target, owner, project)
+		os.Exit(1)
+	}
+
+	old, err := moveRank(entries, o.rank, target)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 1: Drain the rank; an instance that is already gone has nothing to drain
+	fmt.Printf("Draining rank %d on %s...\n", o.rank, old.InstanceID)
+	_, err = runScriptOnInstances(ctx, ssmClient, []awsManager.InstanceInfo{{InstanceID: old.InstanceID}}, func(awsManager.InstanceInfo) string {
+		return drainRankScript(o.jobID, o.drainTimeout)
+	})
+	if err != nil {
+		fmt.Printf("Warning: could not drain rank %d, continuing: %v\n", o.rank, err)
+	}
+
+	// Step 2: Point the manifest at the replacement instance
+	err = s3Client.UploadBytes(ctx, renderManifest(entries), manifestKey(project, o.jobID))
+	if err != nil {
+		fmt.Printf("Error updating job manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Step 3: Start the rank on the replacement; the other ranks reconnect when it says hello
+	input := shellScriptInput(restartScript(string(launchScript)), maxExecutionTimeout)
+	input.InstanceIds = []string{target.InstanceID}
+	result, err := ssmClient.SendCommand(ctx, input)
+	if err != nil {
+		fmt.Printf("Error starting rank %d on %s: %v\n", o.rank, target.InstanceID, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rank %d moved from %s to %s (command %s)\n", o.rank, old.InstanceID, target.InstanceID, aws.ToString(result.Command.CommandId))
+}
+
+// manifestEntry is one "<instance-id> <rank> <address> <type> <zone> <lifecycle>
+// <placement-group>" line of a job manifest, with "-" for an empty column. Manifests
+// of jobs started by older versions have the first three columns only.
+type manifestEntry struct {
+	InstanceID string
+	Rank       int
+	Address    string
+
+	InstanceType     string
+	AvailabilityZone string
+	Lifecycle        string
+	PlacementGroup   string
+}
+
+// newManifestEntry returns the entry of rank, which runs on instance at address
+func newManifestEntry(instance awsManager.InstanceInfo, rank int, address string) manifestEntry {
+	return manifestEntry{
+		InstanceID:       instance.InstanceID,
+		Rank:             rank,
+		Address:          address,
+		InstanceType:     instance.InstanceType,
+		AvailabilityZone: instance.AvailabilityZone,
+		Lifecycle:        instance.Lifecycle,
+		PlacementGroup:   instance.PlacementGroup,
+	}
+}
+
+func parseManifest(data []byte) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected instance, rank, and address, and optionally type, zone, lifecycle, and placement group", i+1)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil || rank != i {
+			return nil, fmt.Errorf("line %d: expected rank %d, got %q", i+1, i, fields[1])
+		}
+		entry := manifestEntry{InstanceID: fields[0], Rank: rank, Address: fields[2]}
+		if len(fields) == 7 {
+			for j, column := range []*string{&entry.InstanceType, &entry.AvailabilityZone, &entry.Lifecycle, &entry.PlacementGroup} {
+				if fields[3+j] != "-" {
+					*column = fields[3+j]
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func renderManifest(entries []manifestEntry) []byte {
+	column := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s %d %s %s %s %s %s\n", entry.InstanceID, entry.Rank, entry.Address,
+			column(entry.InstanceType), column(entry.AvailabilityZone), column(entry.Lifecycle), column(entry.PlacementGroup))
+	}
+	return []byte(b.String())
+}
+
+// moveRank reassigns rank to target in entries and returns the entry it replaced
+func moveRank(entries []manifestEntry, rank int, target awsManager.InstanceInfo) (manifestEntry, error) {
+	if rank < 0 || rank >= len(entries) {
+		return manifestEntry{}, fmt.Errorf("rank %d is not part of the job (size %d)", rank, len(entries))
+	}
+	for _, entry := range entries {
+		if entry.InstanceID == target.InstanceID {
+			return manifestEntry{}, fmt.Errorf("instance %s already runs rank %d", target.InstanceID, entry.Rank)
+		}
+	}
+
+	address := target.PrivateIP
+	if address == "" {
+		address = target.PublicIP
+	}
+	if address == "" {
+		return manifestEntry{}, fmt.Errorf("instance %s has no IP address", target.InstanceID)
+	}
+
+	old := entries[rank]
+	entries[rank] = newManifestEntry(target, rank, address)
+	return old, nil
+}
+
+// drainRankScript sends SIGTERM to the process group of the rank of jobID and waits for
+// it to exit, killing it once timeout has passed
+func drainRankScript(jobID string, timeout time.Duration) string {
+	script := newShellScript()
+	script.Linef("PIDFILE=%s", rankPIDFile(jobID))
+	script.Linef(`if [ ! -s "$PIDFILE" ]; then
+  echo "rank is not running"
+  exit 0
+fi
+PGID=$(cat "$PIDFILE")
+kill -TERM -- "-$PGID" 2> /dev/null || exit 0
+for ((i = 0; i < %[1]d; i++)); do
+  kill -0 -- "-$PGID" 2> /dev/null || exit 0
+  sleep 1
+done
+echo "rank did not exit within %[1]ds, killing it" >&2
+kill -KILL -- "-$PGID" 2> /dev/null
+exit 0`, int(timeout.Seconds()))
+	return script.String()
+}
+
+// restartScript marks a launch script as starting a replacement incarnation of its rank
+func restartScript(launchScript string) string {
+	body := strings.TrimPrefix(launchScript, "#!/bin/bash\n")
+	return "#!/bin/bash\nexport MPI_RESTARTED=1\n" + body
+}
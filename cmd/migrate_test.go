@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestParseManifest(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-0", PrivateIP: "10.0.0.1", InstanceRank: 0, InstanceType: "c7g.large", AvailabilityZone: "us-east-2a", Lifecycle: "spot", PlacementGroup: "hpc"},
+		{InstanceID: "i-1", PublicIP: "54.0.0.2", InstanceRank: 1},
+	}
+	entries, err := parseManifest(buildManifest(instances))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []manifestEntry{
+		{InstanceID: "i-0", Rank: 0, Address: "10.0.0.1", InstanceType: "c7g.large", AvailabilityZone: "us-east-2a", Lifecycle: "spot", PlacementGroup: "hpc"},
+		{InstanceID: "i-1", Rank: 1, Address: "54.0.0.2"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseManifest = %+v, want %+v", entries, want)
+	}
+	if got := string(renderManifest(entries)); got != string(buildManifest(instances)) {
+		t.Errorf("renderManifest = %q, want the original manifest", got)
+	}
+
+	// Manifests of older versions have no instance columns
+	if entries, err := parseManifest([]byte("i-0 0 10.0.0.1\n")); err != nil || entries[0] != (manifestEntry{InstanceID: "i-0", Address: "10.0.0.1"}) {
+		t.Errorf("parseManifest of a three-column line = %+v, %v", entries, err)
+	}
+
+	for _, bad := range []string{"i-0 0", "i-0 0 10.0.0.1 c7g.large", "i-0 x 10.0.0.1", "i-0 1 10.0.0.1", "i-0 0 10.0.0.1\ni-1 0 10.0.0.2"} {
+		if _, err := parseManifest([]byte(bad)); err == nil {
+			t.Errorf("parseManifest(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestMoveRank(t *testing.T) {
+	entries := func() []manifestEntry {
+		return []manifestEntry{{InstanceID: "i-0", Rank: 0, Address: "10.0.0.1"}, {InstanceID: "i-1", Rank: 1, Address: "10.0.0.2"}}
+	}
+
+	moved := entries()
+	old, err := moveRank(moved, 1, awsManager.InstanceInfo{InstanceID: "i-9", PrivateIP: "10.0.0.9", Lifecycle: "on-demand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.InstanceID != "i-1" || moved[1] != (manifestEntry{InstanceID: "i-9", Rank: 1, Address: "10.0.0.9", Lifecycle: "on-demand"}) {
+		t.Errorf("moveRank replaced %+v and left %+v", old, moved[1])
+	}
+
+	tests := []struct {
+		name    string
+		rank    int
+		target  awsManager.InstanceInfo
+		wantErr string
+	}{
+		{name: "rank too large", rank: 2, target: awsManager.InstanceInfo{InstanceID: "i-9", PrivateIP: "10.0.0.9"}, wantErr: "not part of the job"},
+		{name: "negative rank", rank: -1, target: awsManager.InstanceInfo{InstanceID: "i-9", PrivateIP: "10.0.0.9"}, wantErr: "not part of the job"},
+		{name: "target in job", rank: 1, target: awsManager.InstanceInfo{InstanceID: "i-0", PrivateIP: "10.0.0.1"}, wantErr: "already runs rank 0"},
+		{name: "no address", rank: 1, target: awsManager.InstanceInfo{InstanceID: "i-9"}, wantErr: "no IP address"},
+	}
+	for _, tt := range tests {
+		_, err := moveRank(entries(), tt.rank, tt.target)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRestartScript(t *testing.T) {
+	got := restartScript("#!/bin/bash\nset -e\necho run\n")
+	want := "#!/bin/bash\nexport MPI_RESTARTED=1\nset -e\necho run\n"
+	if got != want {
+		t.Errorf("restartScript = %q, want %q", got, want)
+	}
+}
+
+// TestDrainRankScript drains a rank started the way the rank scripts do, in a
+// directory of its own
+func TestDrainRankScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID = "test-" + filepath.Base(t.TempDir())
+	defer os.RemoveAll(filepath.Dir(rankPIDFile(o.jobID)))
+
+	if out, err := bashInTempDir(t, drainRankScript(o.jobID, 5*time.Second)).Output(); err != nil || !strings.Contains(string(out), "not running") {
+		t.Fatalf("drain with no rank = %q, %v, want it reported as not running", out, err)
+	}
+
+	rank := bashInTempDir(t, o.rankLaunch("sleep 30"))
+	if err := rank.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- rank.Wait() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(rankPIDFile(o.jobID)); err == nil && strings.TrimSpace(string(data)) != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rank never wrote its pid file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if out, err := bashInTempDir(t, drainRankScript(o.jobID, 5*time.Second)).CombinedOutput(); err != nil {
+		t.Fatalf("drain failed: %v: %s", err, out)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rank kept running after the drain")
+	}
+}
@@ -0,0 +1,260 @@
+// cmd/mpirun.go
+// This file implements the mpirun compatibility command. It accepts the common
+// mpirun flag surface (-np, -hostfile, -x, --map-by) and translates it to this
+// tool's concepts so existing launch scripts and wrappers keep working:
+//
+//	awsmpirun mpirun --vpc vpc-123 -np 8 -x OMP_NUM_THREADS=4 ./a.out input.dat
+//
+// Each rank runs on its own instance, so only one-rank-per-node mappings are supported.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+)
+
+var mpirunCmd = &cobra.Command{
+	Use:   "mpirun [mpirun options] --vpc VPC_ID PROGRAM [ARGS...]",
+	Short: "Run a program with mpirun-style flags",
+	Long: `mpirun mimics the common mpirun command line (-np, -hostfile/-machinefile, -x, --map-by)
+and translates it to awsmpirun's options. The VPC is given with --vpc as usual, and the
+project with --project unless config.yaml sets a default.`,
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		o := newRunOptions()
+		options, err := parseMpirunArgs(args)
+		if err == nil {
+			err = applyMpirunOptions(o, options)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		runAWSMPIRun(cmd.Context(), o)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mpirunCmd)
+}
+
+// mpirunOptions holds the translated mpirun command line
+type mpirunOptions struct {
+	np       int // Zero when -np was not given
+	vpc      string
+	project  string
+	hostfile string
+	env      []string
+	program  []string
+}
+
+// mpirun options accepted but not meaningful here; the value is how many arguments they take
+var ignoredMpirunOptions = map[string]int{
+	"--oversubscribe":     0,
+	"--allow-run-as-root": 0,
+	"--bind-to":           1,
+	"-bind-to":            1,
+	"--mca":               2,
+	"-mca":                2,
+	"--report-bindings":   0,
+	"-wdir":               1,
+	"--wdir":              1,
+}
+
+func parseMpirunArgs(args []string) (mpirunOptions, error) {
+	var options mpirunOptions
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			options.program = args[i:]
+			break
+		}
+
+		// Accept both "--flag value" and "--flag=value"
+		name, inlineValue, hasInline := strings.Cut(arg, "=")
+		value := func() (string, error) {
+			if hasInline {
+				return inlineValue, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("%s needs a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch name {
+		case "-np", "-n", "--np", "-c":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			options.np, err = strconv.Atoi(v)
+			if err != nil || options.np <= 0 {
+				return options, fmt.Errorf("invalid process count %q", v)
+			}
+		case "--vpc", "-vpc":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			options.vpc = v
+		case "--project":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			options.project = v
+		case "-hostfile", "--hostfile", "-machinefile", "--machinefile":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			options.hostfile = v
+		case "-x":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			name, _, _ := strings.Cut(v, "=")
+			if !validEnvName(name) {
+				return options, fmt.Errorf("invalid environment variable name %q in -x %s", name, v)
+			}
+			options.env = append(options.env, v)
+		case "--map-by", "-map-by":
+			v, err := value()
+			if err != nil {
+				return options, err
+			}
+			if mapping := strings.SplitN(v, ":", 2)[0]; mapping != "node" {
+				return options, fmt.Errorf("--map-by %s is not supported: every rank runs on its own instance, use --map-by node", v)
+			}
+		case "--":
+			options.program = args[i+1:]
+			i = len(args)
+		default:
+			count, ok := ignoredMpirunOptions[name]
+			if !ok {
+				return options, fmt.Errorf("unsupported mpirun option %s", name)
+			}
+			fmt.Printf("Warning: ignoring mpirun option %s\n", name)
+			if !hasInline {
+				i += count
+			}
+		}
+	}
+
+	if options.vpc == "" {
+		return options, fmt.Errorf("--vpc is required")
+	}
+	if len(options.program) == 0 {
+		return options, fmt.Errorf("no program given")
+	}
+	return options, nil
+}
+
+// applyMpirunOptions sets o from a parsed mpirun command line. Like mpirun,
+// a hostfile without -np runs one rank on every listed host.
+func applyMpirunOptions(o *runOptions, options mpirunOptions) error {
+	o.numInstances = options.np
+	if o.numInstances == 0 {
+		o.numInstances = 1
+	}
+	o.vpcID = options.vpc
+	o.project = options.project
+	// Each word of the program's command line stays one argument, as with mpirun
+	o.executablePath = shellf("%s", options.program)
+
+	for _, entry := range options.env {
+		// "-x NAME" forwards the variable from the local environment, like mpirun
+		if !strings.Contains(entry, "=") {
+			entry = entry + "=" + os.Getenv(entry)
+		}
+		o.extraEnv = append(o.extraEnv, entry)
+	}
+
+	if options.hostfile != "" {
+		hosts, err := readHostfile(options.hostfile)
+		if err != nil {
+			return fmt.Errorf("failed to read hostfile: %v", err)
+		}
+		if len(hosts) == 0 {
+			return fmt.Errorf("hostfile %s lists no hosts", options.hostfile)
+		}
+		if options.np == 0 {
+			o.numInstances = len(hosts)
+		}
+		if o.numInstances > len(hosts) {
+			return fmt.Errorf("-np %d needs more hosts than the %d in %s", o.numInstances, len(hosts), options.hostfile)
+		}
+		o.hostSelection = hosts
+	}
+	return nil
+}
+
+// readHostfile returns the host names listed in an mpirun hostfile, ignoring slot counts
+func readHostfile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			fmt.Printf("Warning: ignoring %q for host %s, each instance runs one rank\n", strings.Join(fields[1:], " "), fields[0])
+		}
+		hosts = append(hosts, fields[0])
+	}
+	return hosts, scanner.Err()
+}
+
+var ec2HostnamePattern = regexp.MustCompile(`^ip-(\d+)-(\d+)-(\d+)-(\d+)(\..*)?$`)
+
+// selectHosts picks the instances matching hosts, in host order. Hosts may be given as
+// private or public IPs, instance IDs, or EC2 private host names (ip-10-0-0-1...).
+// Each instance can run only one rank, so an instance listed twice is an error.
+func selectHosts(instances []awsManager.InstanceInfo, hosts []string) ([]awsManager.InstanceInfo, error) {
+	var selected []awsManager.InstanceInfo
+	listedAs := make(map[string]string)
+	for _, host := range hosts {
+		listed := host
+		if match := ec2HostnamePattern.FindStringSubmatch(host); match != nil {
+			host = strings.Join(match[1:5], ".")
+		}
+
+		found := false
+		for _, instance := range instances {
+			if host == instance.PrivateIP || host == instance.PublicIP || host == instance.InstanceID {
+				if previous, ok := listedAs[instance.InstanceID]; ok {
+					return nil, fmt.Errorf("hosts %s and %s are the same instance %s, each instance runs one rank", previous, listed, instance.InstanceID)
+				}
+				listedAs[instance.InstanceID] = listed
+				selected = append(selected, instance)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("host %s is not a running instance in the VPC", host)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestParseMpirunArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    mpirunOptions
+		wantErr string
+	}{
+		{
+			name: "basic",
+			args: []string{"--vpc", "vpc-1", "-np", "8", "./a.out", "input.dat"},
+			want: mpirunOptions{np: 8, vpc: "vpc-1", program: []string{"./a.out", "input.dat"}},
+		},
+		{
+			name: "inline values and env",
+			args: []string{"--vpc=vpc-1", "--project", "team-a", "--np=2", "-x", "OMP_NUM_THREADS=4", "-x", "HOME", "./a.out"},
+			want: mpirunOptions{np: 2, vpc: "vpc-1", project: "team-a", env: []string{"OMP_NUM_THREADS=4", "HOME"}, program: []string{"./a.out"}},
+		},
+		{
+			name: "hostfile without np",
+			args: []string{"-vpc", "vpc-1", "-machinefile", "hosts", "--map-by", "node:PE=2", "prog"},
+			want: mpirunOptions{vpc: "vpc-1", hostfile: "hosts", program: []string{"prog"}},
+		},
+		{
+			name: "ignored options and separator",
+			args: []string{"--vpc", "vpc-1", "--mca", "btl", "tcp", "--oversubscribe", "--bind-to=core", "--", "-prog"},
+			want: mpirunOptions{vpc: "vpc-1", program: []string{"-prog"}},
+		},
+		{name: "missing vpc", args: []string{"-np", "2", "prog"}, wantErr: "--vpc is required"},
+		{name: "missing program", args: []string{"--vpc", "vpc-1"}, wantErr: "no program given"},
+		{name: "missing value", args: []string{"--vpc", "vpc-1", "-np"}, wantErr: "-np needs a value"},
+		{name: "bad count", args: []string{"--vpc", "vpc-1", "-np", "zero", "prog"}, wantErr: "invalid process count"},
+		{name: "zero count", args: []string{"--vpc", "vpc-1", "-np", "0", "prog"}, wantErr: "invalid process count"},
+		{name: "map by slot", args: []string{"--vpc", "vpc-1", "--map-by", "slot", "prog"}, wantErr: "not supported"},
+		{name: "unknown option", args: []string{"--vpc", "vpc-1", "--tag-output", "prog"}, wantErr: "unsupported mpirun option"},
+		{name: "bad env name", args: []string{"--vpc", "vpc-1", "-x", "A;rm -rf /=1", "prog"}, wantErr: "invalid environment variable name"},
+		{name: "env with leading digit", args: []string{"--vpc", "vpc-1", "-x", "1X=1", "prog"}, wantErr: "invalid environment variable name"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseMpirunArgs(tt.args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func writeHostfile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadHostfile(t *testing.T) {
+	path := writeHostfile(t, "# cluster\n10.0.0.1 slots=4\n\n  ip-10-0-0-2.ec2.internal  # second\ni-0abc\n")
+	hosts, err := readHostfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1", "ip-10-0-0-2.ec2.internal", "i-0abc"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("readHostfile = %v, want %v", hosts, want)
+	}
+
+	if _, err := readHostfile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readHostfile of a missing file succeeded")
+	}
+}
+
+func TestApplyMpirunOptions(t *testing.T) {
+	hostfile := writeHostfile(t, "10.0.0.1\n10.0.0.2\n10.0.0.3\n")
+	emptyHostfile := writeHostfile(t, "# nothing here\n")
+
+	tests := []struct {
+		name    string
+		options mpirunOptions
+		wantNP  int
+		wantErr string
+	}{
+		{name: "default", options: mpirunOptions{vpc: "vpc-1", program: []string{"prog"}}, wantNP: 1},
+		{name: "explicit", options: mpirunOptions{np: 4, vpc: "vpc-1", program: []string{"prog"}}, wantNP: 4},
+		{name: "hostfile uses every host", options: mpirunOptions{vpc: "vpc-1", hostfile: hostfile, program: []string{"prog"}}, wantNP: 3},
+		{name: "hostfile with np", options: mpirunOptions{np: 2, vpc: "vpc-1", hostfile: hostfile, program: []string{"prog"}}, wantNP: 2},
+		{name: "np above hosts", options: mpirunOptions{np: 5, vpc: "vpc-1", hostfile: hostfile, program: []string{"prog"}}, wantErr: "needs more hosts"},
+		{name: "empty hostfile", options: mpirunOptions{vpc: "vpc-1", hostfile: emptyHostfile, program: []string{"prog"}}, wantErr: "lists no hosts"},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		err := applyMpirunOptions(o, tt.options)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if o.numInstances != tt.wantNP {
+			t.Errorf("%s: numInstances = %d, want %d", tt.name, o.numInstances, tt.wantNP)
+		}
+	}
+}
+
+func TestApplyMpirunOptionsQuotesProgram(t *testing.T) {
+	o := newRunOptions()
+	program := []string{"printf", "%s|", "a b;echo x", "$HOME", "it's"}
+	if err := applyMpirunOptions(o, mpirunOptions{vpc: "vpc-1", program: program}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("bash", "-c", o.executablePath).Output()
+	if err != nil {
+		t.Fatalf("running %s: %v", o.executablePath, err)
+	}
+	if want := "a b;echo x|$HOME|it's|"; string(out) != want {
+		t.Errorf("%s printed %q, want %q", o.executablePath, out, want)
+	}
+}
+
+func TestSelectHosts(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-1", PrivateIP: "10.0.0.1", PublicIP: "54.0.0.1"},
+		{InstanceID: "i-2", PrivateIP: "10.0.0.2"},
+		{InstanceID: "i-3", PrivateIP: "10.0.0.3"},
+	}
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		want    []string
+		wantErr string
+	}{
+		{name: "by address", hosts: []string{"10.0.0.3", "54.0.0.1"}, want: []string{"i-3", "i-1"}},
+		{name: "by id and hostname", hosts: []string{"i-2", "ip-10-0-0-1.us-west-2.compute.internal"}, want: []string{"i-2", "i-1"}},
+		{name: "unknown host", hosts: []string{"10.0.0.9"}, wantErr: "not a running instance"},
+		{name: "duplicate", hosts: []string{"10.0.0.1", "10.0.0.1"}, wantErr: "same instance"},
+		{name: "duplicate by alias", hosts: []string{"i-2", "ip-10-0-0-2"}, wantErr: "same instance i-2"},
+	}
+
+	for _, tt := range tests {
+		selected, err := selectHosts(instances, tt.hosts)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		var ids []string
+		for _, instance := range selected {
+			ids = append(ids, instance.InstanceID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: selected %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// cmd/netns.go
+// This file implements --launcher netns, which packs many small ranks onto a few large
+// instances, typically metal ones, with each rank isolated in a network namespace of
+// its own. Every instance runs --slots-per-node ranks. The namespaces of an instance
+// hang off a bridge on a private subnet, and the instance forwards port rankPort+slot of
+// its own address to the rank in slot, so the ranks use the same address table and
+// runtime as the native launcher: rank i*slots+slot of instance i is reached at
+// instance:rankPort+slot from every rank, on its instance or another. The ranks start
+// in well under a second, as no instance boots; the price is that the job cannot grow
+// beyond the instances it starts on. The namespaces, bridge, and forwarding rules are
+// removed when the ranks end.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+const (
+	// netnsSubnet is the /24 the namespaces of an instance are addressed in, from the
+	// shared address space, which VPCs do not use. The bridge is .1 and slot k is .k+2.
+	netnsSubnet = "100.127.0"
+	// netnsMaxSlots is the most namespaces the subnet holds
+	netnsMaxSlots = 253
+)
+
+// validateNetnsOptions rejects run options --launcher netns does not implement
+func (o *runOptions) validateNetnsOptions() error {
+	if o.slotsPerNode < 1 || o.slotsPerNode > netnsMaxSlots {
+		return fmt.Errorf("--slots-per-node must be between 1 and %d with --launcher netns, got %d", netnsMaxSlots, o.slotsPerNode)
+	}
+	if o.chaosSpec != "" {
+		return fmt.Errorf("--chaos is not supported with --launcher netns")
+	}
+	if o.debugRank >= 0 {
+		return fmt.Errorf("--debug-rank is not supported with --launcher netns")
+	}
+	if o.checkNetwork {
+		return fmt.Errorf("--check-network is not supported with --launcher netns, it checks one rank port per instance")
+	}
+	if o.jobSecurityGroup {
+		return fmt.Errorf("--job-security-group is not supported with --launcher netns, it opens one rank port per instance")
+	}
+	if o.pprofPort != 0 {
+		return fmt.Errorf("--pprof-port is not supported with --launcher netns, awsmpirun profile reaches one rank per instance")
+	}
+	return nil
+}
+
+// netnsNames returns the names of the bridge and of the namespace and host end of the
+// veth pair of slot, which must differ between jobs sharing an instance. Interface
+// names are limited to 15 characters, so they carry a hash of the job ID.
+func netnsNames(jobID string, slot int) (bridge, namespace, veth string) {
+	h := fnv.New32a()
+	h.Write([]byte(jobID))
+	id := fmt.Sprintf("%08x", h.Sum32())
+	return "mb" + id, fmt.Sprintf("awsmpirun-%s-%d", id, slot), fmt.Sprintf("mv%s%d", id, slot)
+}
+
+// netnsAddressTable returns the address table of the ranks of instances, slotsPerNode
+// of them on each
+func netnsAddressTable(instances []awsManager.InstanceInfo, slotsPerNode int) []byte {
+	var table mpi.AddressTable
+	for _, instance := range instances {
+		for slot := range slotsPerNode {
+			table.Ranks = append(table.Ranks, rankAddress(instance, instance.InstanceRank*slotsPerNode+slot, rankPort+slot))
+		}
+	}
+	data, _ := json.Marshal(table)
+	return data
+}
+
+// netnsScript returns the script that creates the namespaces of instance, starts one
+// rank in each, and waits for them. It fails if any rank fails, with the end of its
+// output, and prints the output of rank 0 on the instance that runs it.
+func (o *runOptions) netnsScript(instance awsManager.InstanceInfo, instances []awsManager.InstanceInfo, region string) string {
+	slots := o.slotsPerNode
+	bridge, _, _ := netnsNames(o.jobID, 0)
+	tag := "awsmpirun:" + o.jobID
+
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Raw(`if ! command -v ip > /dev/null || ! command -v iptables > /dev/null; then
+  echo "--launcher netns needs ip and iptables on the instance" >&2
+  exit 1
+fi`)
+	o.writeJobEnv(script, region)
+	script.Export("MPI_SIZE", len(instances)*slots)
+	table := mpi.AddressFile(o.jobID)
+	script.Linef("mkdir -p %s", filepath.Dir(table))
+	script.Linef(`printf '%%s\n' %s > %s`, string(netnsAddressTable(instances, slots)), table)
+
+	// Removes what an earlier attempt left behind too
+	var namespaces []string
+	for slot := range slots {
+		_, namespace, _ := netnsNames(o.jobID, slot)
+		namespaces = append(namespaces, namespace)
+	}
+	script.Linef(`netns_cleanup() {
+  for NS in %[1]s; do ip netns delete "$NS" 2> /dev/null || true; done
+  ip link delete %[2]s 2> /dev/null || true
+  for TABLE in nat filter; do
+    iptables -t "$TABLE" -S | grep -F -- %[3]s | sed 's/^-A /-D /' | while read -r RULE; do iptables -t "$TABLE" $RULE; done
+  done
+}`, namespaces, bridge, tag)
+	script.Raw("netns_cleanup\ntrap netns_cleanup EXIT")
+
+	script.Raw("sysctl -qw net.ipv4.ip_forward=1")
+	script.Linef("ip link add %s type bridge", bridge)
+	script.Linef("ip addr add %s.1/24 dev %s", shellExpr(netnsSubnet), bridge)
+	script.Linef("ip link set %s up", bridge)
+	// Masquerading also turns around the connections between ranks of one instance,
+	// which reach each other through the instance's address
+	script.Linef("iptables -t nat -A POSTROUTING -s %s.0/24 -m comment --comment %s -j MASQUERADE", shellExpr(netnsSubnet), tag)
+	script.Linef("iptables -I FORWARD -i %s -m comment --comment %s -j ACCEPT", bridge, tag)
+	script.Linef("iptables -I FORWARD -o %s -m comment --comment %s -j ACCEPT", bridge, tag)
+	for slot := range slots {
+		_, namespace, veth := netnsNames(o.jobID, slot)
+		address := fmt.Sprintf("%s.%d", netnsSubnet, slot+2)
+		script.Linef("ip netns add %s", namespace)
+		script.Linef("ip link add %s type veth peer name eth0 netns %s", veth, namespace)
+		script.Linef("ip link set %s master %s up", veth, bridge)
+		script.Linef("ip -n %s addr add %s/24 dev eth0", namespace, address)
+		script.Linef("ip -n %s link set eth0 up", namespace)
+		script.Linef("ip -n %s link set lo up", namespace)
+		script.Linef("ip -n %s route add default via %s.1", namespace, shellExpr(netnsSubnet))
+		script.Linef("iptables -t nat -A PREROUTING -d %s -p tcp --dport %d -m comment --comment %s -j DNAT --to-destination %s",
+			rankHost(instance), rankPort+slot, tag, address)
+	}
+
+	// The ranks stop themselves at the deadline
+	command := shellf("sh -c %s", expandCommand(o.executablePath))
+	if !o.deadlineTime.IsZero() {
+		remaining := int(time.Until(o.deadlineTime).Seconds())
+		command = shellf("timeout %d %s", max(remaining, 1), shellExpr(command))
+	}
+	script.Raw("set +e")
+	script.Raw(workDirSetup())
+	o.writeSourceCheckout(script, region)
+	for slot := range slots {
+		_, namespace, _ := netnsNames(o.jobID, slot)
+		rank := instance.InstanceRank*slots + slot
+		script.Linef("ip netns exec %s env MPI_RANK=%d %s > output-%d.txt 2>&1 &", namespace, rank, shellExpr(command), rank)
+		script.Linef("PID_%d=$!", rank)
+	}
+	script.Raw("STATUS=0")
+	for slot := range slots {
+		rank := instance.InstanceRank*slots + slot
+		script.Linef(`wait $PID_%[1]d
+RANK_STATUS=$?
+if [ $RANK_STATUS -ne 0 ]; then
+  echo "rank %[1]d exited with status $RANK_STATUS:" >&2
+  tail -n 20 output-%[1]d.txt >&2
+  STATUS=$RANK_STATUS
+fi`, rank)
+	}
+	if instance.InstanceRank == 0 {
+		script.Raw("cat output-0.txt")
+	}
+	script.Raw("exit $STATUS")
+	return script.String()
+}
+
+// executeNetns runs the program in slotsPerNode namespaces on every instance
+func (o *runOptions) executeNetns(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	region := ssmClient.Options().Region
+
+	fmt.Printf("Starting %d ranks in network namespaces on %d instances...\n", len(instances)*o.slotsPerNode, len(instances))
+	outputs, err := runLongScriptOnInstances(ctx, ssmClient, instances, o.executionTimeout(), func(instance awsManager.InstanceInfo) string {
+		return o.netnsScript(instance, instances, region)
+	})
+	if err != nil {
+		return fmt.Errorf("ranks failed: %v", err)
+	}
+	o.recordRunDescriptor(ctx, instances, region, "")
+
+	for _, instance := range instances {
+		if instance.InstanceRank == 0 {
+			fmt.Println("Output from rank 0:")
+			fmt.Println(outputs[instance.InstanceID])
+		}
+	}
+	return nil
+}
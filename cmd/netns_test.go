@@ -0,0 +1,89 @@
+// cmd/netns_test.go
+
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestNetnsSlots(t *testing.T) {
+	for _, slots := range []int{0, netnsMaxSlots + 1} {
+		o := newRunOptions()
+		o.launcher, o.slotsPerNode = launcherNetns, slots
+		if err := o.validateLauncherOptions(); err == nil || !strings.Contains(err.Error(), "--slots-per-node") {
+			t.Errorf("%d slots: error = %v", slots, err)
+		}
+	}
+}
+
+func TestNetnsNames(t *testing.T) {
+	bridge, namespace, veth := netnsNames("job-20260101-120000-abcdef", 252)
+	for _, name := range []string{bridge, veth} {
+		if len(name) > 15 {
+			t.Errorf("interface name %q is longer than 15 characters", name)
+		}
+	}
+	if !strings.HasSuffix(namespace, "-252") {
+		t.Errorf("namespace = %q", namespace)
+	}
+	if other, _, _ := netnsNames("job-20260101-120000-abcdee", 0); other == bridge {
+		t.Errorf("two jobs share the bridge %s", bridge)
+	}
+}
+
+func TestNetnsAddressTable(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-1", PrivateIP: "10.0.0.1", InstanceRank: 0},
+		{InstanceID: "i-2", PrivateIP: "10.0.0.2", InstanceRank: 1},
+	}
+	var table mpi.AddressTable
+	if err := json.Unmarshal(netnsAddressTable(instances, 3), &table); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:50051", "10.0.0.1:50052", "10.0.0.1:50053", "10.0.0.2:50051", "10.0.0.2:50052", "10.0.0.2:50053"}
+	if len(table.Ranks) != len(want) {
+		t.Fatalf("table has %d ranks, want %d", len(table.Ranks), len(want))
+	}
+	for i, entry := range table.Ranks {
+		if entry.Rank != i || entry.Address != want[i] {
+			t.Errorf("entry %d = rank %d at %s, want rank %d at %s", i, entry.Rank, entry.Address, i, want[i])
+		}
+	}
+}
+
+func TestNetnsScript(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.executablePath = "job-test", "./worker --rank {rank}"
+	o.launcher, o.slotsPerNode = launcherNetns, 2
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-1", PrivateIP: "10.0.0.1", InstanceRank: 0},
+		{InstanceID: "i-2", PrivateIP: "10.0.0.2", InstanceRank: 1},
+	}
+	_, namespace, _ := netnsNames(o.jobID, 1)
+
+	script := o.netnsScript(instances[1], instances, "us-west-2")
+	for _, want := range []string{
+		"export MPI_SIZE=4\n",
+		"ip netns add '" + namespace + "'",
+		"--dport 50052 -m comment --comment 'awsmpirun:job-test' -j DNAT --to-destination '100.127.0.3'",
+		"-d '10.0.0.2' -p tcp --dport 50051",
+		"ip netns exec '" + namespace + "' env MPI_RANK=3 sh -c './worker --rank ${MPI_RANK}' > output-3.txt",
+		"trap netns_cleanup EXIT",
+		"exit $STATUS",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "cat output-0.txt") {
+		t.Error("an instance without rank 0 prints its output")
+	}
+	if script := o.netnsScript(instances[0], instances, "us-west-2"); !strings.Contains(script, "cat output-0.txt") {
+		t.Error("the instance of rank 0 does not print its output")
+	}
+}
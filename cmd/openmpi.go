@@ -0,0 +1,299 @@
+// cmd/openmpi.go
+// This file implements --launcher openmpi, which runs existing C/Fortran MPI binaries
+// with a real mpirun. awsmpirun only provides the AWS layer here: it installs OpenMPI
+// on the instances, creates a launch user with passwordless SSH between the nodes,
+// writes a hostfile from the assigned ranks, and invokes mpirun on rank 0.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Launchers selectable with --launcher
+const (
+	launcherNative  = "native"
+	launcherOpenMPI = "openmpi"
+	launcherNetns   = "netns" // See netns.go
+)
+
+// openMPIUser is the account mpirun runs as; SSH between the nodes is set up for it
+const openMPIUser = "awsmpirun"
+
+// installOpenMPIScript installs OpenMPI if needed and prepares the launch user
+const installOpenMPIScript = `#!/bin/bash
+set -e
+if ! command -v mpirun > /dev/null && [ ! -x /usr/lib64/openmpi/bin/mpirun ]; then
+  if command -v dnf > /dev/null; then
+    dnf install -y openmpi openmpi-devel
+  elif command -v yum > /dev/null; then
+    yum install -y openmpi openmpi-devel
+  elif command -v apt-get > /dev/null; then
+    DEBIAN_FRONTEND=noninteractive apt-get update -q
+    DEBIAN_FRONTEND=noninteractive apt-get install -y -q openmpi-bin
+  else
+    echo "no supported package manager found to install OpenMPI" >&2
+    exit 1
+  fi
+fi
+id ` + openMPIUser + ` > /dev/null 2>&1 || useradd -m ` + openMPIUser + `
+HOME_DIR=$(getent passwd ` + openMPIUser + ` | cut -d: -f6)
+mkdir -p "$HOME_DIR/.ssh"
+printf 'Host *\n  StrictHostKeyChecking accept-new\n  UserKnownHostsFile /dev/null\n  LogLevel ERROR\n' > "$HOME_DIR/.ssh/config"
+chmod 700 "$HOME_DIR/.ssh"
+chmod 600 "$HOME_DIR/.ssh/config"
+chown -R ` + openMPIUser + `: "$HOME_DIR/.ssh"
+`
+
+// validateLauncherOptions rejects run options the selected launcher does not implement
+func (o *runOptions) validateLauncherOptions() error {
+	switch o.launcher {
+	case launcherNative:
+		return nil
+	case launcherOpenMPI:
+		if o.chaosSpec != "" {
+			return fmt.Errorf("--chaos is not supported with --launcher openmpi")
+		}
+		if o.bucket != "" {
+			return fmt.Errorf("--bucket is not supported with --launcher openmpi, mpirun distributes the hostfile itself")
+		}
+		if o.minRanks != 0 {
+			return fmt.Errorf("--min-ranks is not supported with --launcher openmpi, mpirun starts all ranks together")
+		}
+		if o.debugRank >= 0 {
+			return fmt.Errorf("--debug-rank is not supported with --launcher openmpi")
+		}
+		if o.transport != "" {
+			return fmt.Errorf("--transport is not supported with --launcher openmpi, OpenMPI picks its own transport")
+		}
+		if o.eagerLimit >= 0 {
+			return fmt.Errorf("--eager-limit is not supported with --launcher openmpi, set OpenMPI's btl eager limits instead")
+		}
+		if o.reconnectTimeout >= 0 {
+			return fmt.Errorf("--reconnect-timeout is not supported with --launcher openmpi, mpirun's ranks do not use the runtime's transport")
+		}
+		if o.git.enabled() {
+			return fmt.Errorf("--git is not supported with --launcher openmpi, mpirun starts the ranks on the other instances itself")
+		}
+		if o.collectiveTimeout != 0 || o.timeoutPolicy != "" {
+			return fmt.Errorf("--collective-timeout and --timeout-policy are not supported with --launcher openmpi, mpirun's ranks do not use the runtime's collectives")
+		}
+		if o.maxBandwidth != "" {
+			return fmt.Errorf("--max-bandwidth-per-rank is not supported with --launcher openmpi, mpirun's ranks do not use the runtime's transport")
+		}
+		if o.broadcast != "" {
+			return fmt.Errorf("--broadcast is not supported with --launcher openmpi, mpirun's ranks do not use the runtime's collectives")
+		}
+		if o.maxClockSkew != 0 {
+			return fmt.Errorf("--max-clock-skew is not supported with --launcher openmpi, mpirun's ranks do not use the runtime's Init")
+		}
+		if o.encryptPayloads {
+			return fmt.Errorf("--encrypt-payloads is not supported with --launcher openmpi, mpirun's ranks do not use the runtime's transport")
+		}
+		if o.checkNetwork {
+			return fmt.Errorf("--check-network is not supported with --launcher openmpi, mpirun connects the ranks over SSH and its own ports")
+		}
+		if o.jobSecurityGroup {
+			return fmt.Errorf("--job-security-group is not supported with --launcher openmpi, mpirun connects the ranks over SSH and its own ports")
+		}
+		if o.pprofPort != 0 {
+			return fmt.Errorf("--pprof-port is not supported with --launcher openmpi, the ranks on one node would share the port")
+		}
+		return nil
+	case launcherNetns:
+		return o.validateNetnsOptions()
+	}
+	return fmt.Errorf("unknown launcher %q", o.launcher)
+}
+
+// installOpenMPI installs OpenMPI and creates the launch user on every instance
+func installOpenMPI(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+
+	fmt.Println("Installing OpenMPI on all instances...")
+	_, err = runScriptOnInstances(ctx, ssmClient, instances, func(awsManager.InstanceInfo) string {
+		return installOpenMPIScript
+	})
+	if err != nil {
+		return fmt.Errorf("failed to install OpenMPI: %v", err)
+	}
+	return nil
+}
+
+// executeOpenMPI runs the program with mpirun from rank 0 on instances OpenMPI was
+// installed on
+func (o *runOptions) executeOpenMPI(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	return o.launchOpenMPI(ctx, ssmClient, instances)
+}
+
+// launchOpenMPI authorizes a job key on every node and runs mpirun from rank 0, which SSM
+// lets run until the deadline
+func (o *runOptions) launchOpenMPI(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) error {
+	var rootInstance awsManager.InstanceInfo
+	for _, instance := range instances {
+		if instance.InstanceRank == 0 {
+			rootInstance = instance
+		}
+	}
+
+	// Step 1: Create a job key on rank 0 and authorize it on every node
+	publicKey, err := o.createOpenMPIKey(ctx, ssmClient, rootInstance)
+	if err != nil {
+		return err
+	}
+	defer o.revokeOpenMPIKey(ctx, ssmClient, instances)
+
+	_, err = runScriptOnInstances(ctx, ssmClient, instances, func(awsManager.InstanceInfo) string {
+		return o.authorizeKeyScript(publicKey)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authorize SSH key: %v", err)
+	}
+
+	// Step 2: Write the hostfile and run mpirun from rank 0
+	outputs, err := runLongScriptOnInstances(ctx, ssmClient, []awsManager.InstanceInfo{rootInstance}, o.executionTimeout(), func(awsManager.InstanceInfo) string {
+		return o.mpirunScript(instances, ssmClient.Options().Region)
+	})
+	if err != nil {
+		return fmt.Errorf("mpirun failed: %v", err)
+	}
+	o.recordRunDescriptor(ctx, instances, ssmClient.Options().Region, "")
+
+	fmt.Println("Output from mpirun:")
+	fmt.Println(outputs[rootInstance.InstanceID])
+	return nil
+}
+
+// createOpenMPIKey generates the job's SSH key on the launch node and returns its public half
+func (o *runOptions) createOpenMPIKey(ctx context.Context, ssmClient *ssm.Client, instance awsManager.InstanceInfo) (string, error) {
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("HOME_DIR=$(getent passwd %s | cut -d: -f6)", openMPIUser)
+	script.Linef(`KEY="$HOME_DIR/.ssh/"%s`, "id_"+o.jobID)
+	script.Linef(`[ -f "$KEY" ] || sudo -u %[1]s ssh-keygen -q -t ed25519 -N "" -C %[2]s -f "$KEY"`, openMPIUser, o.jobID)
+	script.Raw(`echo "  IdentityFile $KEY" >> "$HOME_DIR/.ssh/config"
+cat "$KEY.pub"`)
+
+	outputs, err := runScriptOnInstances(ctx, ssmClient, []awsManager.InstanceInfo{instance}, func(awsManager.InstanceInfo) string {
+		return script.String()
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH key: %v", err)
+	}
+	return strings.TrimSpace(outputs[instance.InstanceID]), nil
+}
+
+// authorizeKeyScript authorizes the job key and creates the work directory on one node
+func (o *runOptions) authorizeKeyScript(publicKey string) string {
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("HOME_DIR=$(getent passwd %s | cut -d: -f6)", openMPIUser)
+	script.Linef(`echo %s >> "$HOME_DIR/.ssh/authorized_keys"`, publicKey)
+	script.Raw(`chmod 600 "$HOME_DIR/.ssh/authorized_keys"`)
+	script.Linef(`chown %s: "$HOME_DIR/.ssh/authorized_keys"`, openMPIUser)
+	script.Linef("mkdir -p %s", o.openMPIWorkDir())
+	script.Linef("chown %s: %s", openMPIUser, o.openMPIWorkDir())
+	return script.String()
+}
+
+// openMPIWorkDir is the directory every process starts in, as a shellf argument. SSM's
+// working directory differs per command and node, so the launch user's home is the
+// default instead.
+func (o *runOptions) openMPIWorkDir() any {
+	if o.workDir == "" {
+		return shellExpr(`"$HOME_DIR"`)
+	}
+	return o.workDirValue()
+}
+
+// revokeOpenMPIKey removes the job key from every node once the run is over, even when
+// ctx has been cancelled
+func (o *runOptions) revokeOpenMPIKey(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	// Job IDs only contain letters, digits, and "._-", so a dot is the one character
+	// sed could misread, and it only ever matches itself in practice
+	script := newShellScript()
+	script.Linef("HOME_DIR=$(getent passwd %s | cut -d: -f6)", openMPIUser)
+	script.Linef(`sed -i %s "$HOME_DIR/.ssh/authorized_keys"`, "/ "+o.jobID+"$/d")
+	script.Linef(`sed -i %s "$HOME_DIR/.ssh/config"`, "/id_"+o.jobID+"$/d")
+	script.Linef(`cd "$HOME_DIR" && rm -f .ssh/%[1]s .ssh/%[1]s.pub %[2]s`, "id_"+o.jobID, "hostfile-"+o.jobID)
+
+	_, err := runScriptOnInstances(ctx, ssmClient, instances, func(awsManager.InstanceInfo) string {
+		return script.String()
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to revoke job SSH key: %v\n", err)
+	}
+}
+
+// mpirunScript writes the hostfile and runs mpirun as the launch user. --prefix tells
+// the remote nodes where OpenMPI lives, since the non-interactive ssh that starts orted
+// does not get our PATH, and tree spawn is off because only rank 0 holds the job key.
+func (o *runOptions) mpirunScript(instances []awsManager.InstanceInfo, region string) string {
+	var hostfile []string
+	for _, instance := range instances {
+		hostfile = append(hostfile, fmt.Sprintf("%s slots=%d", instance.PrivateIP, o.slotsPerNode))
+	}
+
+	// Forward the job variables and any -x/extra variables to every process
+	forward := []string{"-x", "MPI_JOB_ID", "-x", "MPI_WORK_DIR", "-x", "MPI_SIZE", "-x", "MPI_SEED"}
+	if o.kvTable != "" {
+		forward = append(forward, "-x", "MPI_KV_TABLE", "-x", "AWS_REGION")
+	}
+	if o.logLevel != "" {
+		forward = append(forward, "-x", "MPI_LOG_LEVEL")
+	}
+	if o.logRate != "" {
+		forward = append(forward, "-x", "MPI_LOG_RATE")
+	}
+	for _, entry := range o.extraEnv {
+		name, _, _ := strings.Cut(entry, "=")
+		forward = append(forward, "-x", name)
+	}
+	for _, name := range o.goRuntimeVariables() {
+		forward = append(forward, "-x", name)
+	}
+	// mpirun stops the job itself when the deadline passes
+	if !o.deadlineTime.IsZero() {
+		remaining := int(time.Until(o.deadlineTime).Seconds())
+		forward = append([]string{"--timeout", strconv.Itoa(max(remaining, 1))}, forward...)
+	}
+
+	script := newShellScript()
+	script.Raw("set -e")
+	script.Linef("HOME_DIR=$(getent passwd %s | cut -d: -f6)", openMPIUser)
+	script.Linef(`HOSTFILE="$HOME_DIR/"%s`, "hostfile-"+o.jobID)
+	script.Linef(`printf '%%s\n' %s > "$HOSTFILE"`, hostfile)
+	script.Linef(`chown %s: "$HOSTFILE"`, openMPIUser)
+	script.Raw(`if [ -x /usr/lib64/openmpi/bin/mpirun ]; then
+  PREFIX=/usr/lib64/openmpi
+else
+  PREFIX=$(dirname "$(dirname "$(command -v mpirun)")")
+fi
+export PATH="$PREFIX/bin:$PATH"`)
+	o.writeJobEnv(script, region)
+	script.Export("MPI_WORK_DIR", o.openMPIWorkDir())
+	script.Export("MPI_SIZE", len(instances)*o.slotsPerNode)
+	script.Raw(`cd "$MPI_WORK_DIR"`)
+	script.Linef(`sudo -E -u %s env PATH="$PATH" mpirun --prefix "$PREFIX" --mca plm_rsh_no_tree_spawn 1 -np %d --hostfile "$HOSTFILE" --map-by node --wdir "$MPI_WORK_DIR" %s %s 2>&1`,
+		openMPIUser, len(instances)*o.slotsPerNode, forward, shellExpr(expandCommand(o.executablePath)))
+	return script.String()
+}
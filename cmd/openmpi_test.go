@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestValidateLauncherOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		launcher      string
+		chaos         string
+		bucket        string
+		minRanks      int
+		pprofPort     int
+		transport     string
+		maxBandwidth  string
+		broadcast     string
+		checkNetwork  bool
+		jobGroup      bool
+		encrypt       bool
+		git           string
+		eagerLimit    int
+		setEagerLimit bool
+		debugRank     int
+		wantErr       string
+	}{
+		{name: "native with everything", launcher: launcherNative, chaos: "kill-rank=1@1s", bucket: "staging"},
+		{name: "openmpi plain", launcher: launcherOpenMPI},
+		{name: "openmpi with chaos", launcher: launcherOpenMPI, chaos: "kill-rank=1@1s", wantErr: "--chaos"},
+		{name: "openmpi with bucket", launcher: launcherOpenMPI, bucket: "staging", wantErr: "--bucket"},
+		{name: "openmpi with min ranks", launcher: launcherOpenMPI, minRanks: 2, wantErr: "--min-ranks"},
+		{name: "openmpi with pprof", launcher: launcherOpenMPI, pprofPort: 6060, wantErr: "--pprof-port"},
+		{name: "openmpi with transport", launcher: launcherOpenMPI, transport: "tcp", wantErr: "--transport"},
+		{name: "openmpi with eager limit", launcher: launcherOpenMPI, eagerLimit: 0, setEagerLimit: true, wantErr: "--eager-limit"},
+		{name: "openmpi with bandwidth limit", launcher: launcherOpenMPI, maxBandwidth: "1Gbit", wantErr: "--max-bandwidth-per-rank"},
+		{name: "openmpi with udp broadcast", launcher: launcherOpenMPI, broadcast: "udp", wantErr: "--broadcast"},
+		{name: "openmpi with encryption", launcher: launcherOpenMPI, encrypt: true, wantErr: "--encrypt-payloads"},
+		{name: "openmpi with network check", launcher: launcherOpenMPI, checkNetwork: true, wantErr: "--check-network"},
+		{name: "openmpi with job security group", launcher: launcherOpenMPI, jobGroup: true, wantErr: "--job-security-group"},
+		{name: "openmpi with debugger", launcher: launcherOpenMPI, debugRank: 1, wantErr: "--debug-rank"},
+		{name: "openmpi with git source", launcher: launcherOpenMPI, git: "https://github.com/example/solver", wantErr: "--git"},
+		{name: "netns plain", launcher: launcherNetns, bucket: "staging", minRanks: 2, transport: "tcp", encrypt: true},
+		{name: "netns with udp broadcast", launcher: launcherNetns, broadcast: "udp"},
+		{name: "netns with chaos", launcher: launcherNetns, chaos: "kill-rank=1@1s", wantErr: "--chaos"},
+		{name: "netns with pprof", launcher: launcherNetns, pprofPort: 6060, wantErr: "--pprof-port"},
+		{name: "netns with network check", launcher: launcherNetns, checkNetwork: true, wantErr: "--check-network"},
+		{name: "netns with job security group", launcher: launcherNetns, jobGroup: true, wantErr: "--job-security-group"},
+		{name: "netns with debugger", launcher: launcherNetns, debugRank: 1, wantErr: "--debug-rank"},
+		{name: "unknown", launcher: "slurm", wantErr: "unknown launcher"},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.launcher, o.chaosSpec, o.bucket, o.minRanks, o.pprofPort = tt.launcher, tt.chaos, tt.bucket, tt.minRanks, tt.pprofPort
+		o.transport, o.maxBandwidth, o.checkNetwork, o.encryptPayloads = tt.transport, tt.maxBandwidth, tt.checkNetwork, tt.encrypt
+		o.jobSecurityGroup, o.git.url, o.broadcast = tt.jobGroup, tt.git, tt.broadcast
+		if tt.setEagerLimit {
+			o.eagerLimit = tt.eagerLimit
+		}
+		if tt.debugRank != 0 {
+			o.debugRank = tt.debugRank
+		}
+		err := o.validateLauncherOptions()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMpirunScriptReachesRemoteNodes(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.executablePath = "job-test", "./a.out"
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-1", PrivateIP: "10.0.0.1", InstanceRank: 0},
+		{InstanceID: "i-2", PrivateIP: "10.0.0.2", InstanceRank: 1},
+	}
+
+	script := o.mpirunScript(instances, "us-west-2")
+	for _, want := range []string{`--prefix "$PREFIX"`, "--mca plm_rsh_no_tree_spawn 1", "-np 2", "'10.0.0.2 slots=1'"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("mpirun script missing %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestMpirunScriptDeadline(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.executablePath = "job-test", "./a.out"
+	instances := []awsManager.InstanceInfo{{InstanceID: "i-1", PrivateIP: "10.0.0.1", InstanceRank: 0}}
+
+	if script := o.mpirunScript(instances, "us-west-2"); strings.Contains(script, "--timeout") {
+		t.Errorf("script without a deadline has a timeout:\n%s", script)
+	}
+	o.deadlineTime = time.Now().Add(time.Hour)
+	if script := o.mpirunScript(instances, "us-west-2"); !strings.Contains(script, "'--timeout' '3599'") && !strings.Contains(script, "'--timeout' '3600'") {
+		t.Errorf("script lacks the remaining time as --timeout:\n%s", script)
+	}
+}
+
+func TestLaunchOpenMPIExecutionTimeout(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, deadline := range []time.Duration{0, 30 * time.Hour} {
+		o := newRunOptions()
+		o.jobID, o.executablePath, o.launcher = "job-test", "./a.out", launcherOpenMPI
+		if deadline != 0 {
+			o.deadlineTime = time.Now().Add(deadline)
+		}
+		want := o.executionTimeout()
+		f := &fakeSSM{}
+		if err := o.launchOpenMPI(context.Background(), newFakeSSM(t, f), testInstances()); err != nil {
+			t.Fatalf("deadline %v: launchOpenMPI: %v", deadline, err)
+		}
+
+		launched := false
+		for _, command := range f.sent() {
+			if !strings.Contains(command.script, "mpirun ") {
+				continue
+			}
+			launched = true
+			if got, err := strconv.Atoi(command.executionTimeout); err != nil || got < want-1 || got > want {
+				t.Errorf("deadline %v: mpirun executionTimeout = %q, want %d", deadline, command.executionTimeout, want)
+			}
+		}
+		if !launched {
+			t.Errorf("deadline %v: no command ran mpirun", deadline)
+		}
+	}
+}
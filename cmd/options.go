@@ -0,0 +1,160 @@
+// cmd/options.go
+// This file holds runOptions, the settings of one run of a program across the
+// instances. Commands that start a run fill in their own runOptions, from flags bound
+// with bindRunFlags or translated from another command line as mpirun does, and pass
+// it explicitly through discovery, script building, and execution, so no run state
+// is shared between commands or tests.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// runOptions are the settings of one run
+type runOptions struct {
+	project        string
+	numInstances   int
+	vpcID          string
+	executablePath string
+	kvTable        string
+	chaosSpec      string
+	bucket         string
+	jobID          string
+	extraEnv       []string // NAME=value pairs exported on every rank
+	hostSelection  []string // Hosts to run on, in rank order, instead of the first instances found
+	launcher       string
+	workDir        string
+	slotsPerNode   int
+	requirements   []string // Topology constraints the instances must meet, see topology.go
+	selector       string   // Built-in instance selector or plugin path, see the placement package
+	maxPerAZ       int      // Most instances in one availability zone; 0 is no limit
+	maxSpawnRanks  int      // Ranks the program may add with mpi.Comm.Spawn, see spawn.go
+
+	git gitSource // Repository checked out in the work directory, see gitsource.go
+
+	connectConcurrency int
+	connectTimeout     time.Duration
+	connectStagger     time.Duration
+	maxClockSkew       time.Duration
+	minRanks           int
+	transport          string        // Transport between ranks; empty uses the runtime default
+	eagerLimit         int           // Largest message sent eagerly in bytes; -1 uses the runtime default
+	reconnectTimeout   time.Duration // How long a broken peer stream may take to resume; negative uses the runtime default
+	collectiveTimeout  time.Duration // How long a collective waits for a rank; 0 waits forever
+	timeoutPolicy      string        // What a collective does when it times out, see mpi.TimeoutPolicy; empty uses the runtime default
+	maxBandwidth       string        // Cap on what each rank sends, see mpi.ParseBandwidth; empty is unlimited
+	broadcast          string        // How large broadcasts travel, see mpi.EnvBroadcast; empty uses the runtime default
+	encryptPayloads    bool          // Encrypt the frames between ranks with a job key, see payloadkey.go
+	pprofPort          int
+	checkNetwork       bool // Check the connections between all ranks before starting the program
+	jobSecurityGroup   bool // Open the rank port in a security group of the job's own, see securitygroup.go
+	metrics            bool // Publish the job's statistics to CloudWatch, see metrics.go
+
+	strictPermissions bool // Fail the run when an optional feature lacks permissions, see permissions.go
+	noNetworkPolicies bool // Report blocked pairs without reading the security groups and network ACLs
+	noResultIndex     bool // Skip the result manifest at collect
+
+	debugRank int
+	debugPort int
+	debugWait time.Duration
+
+	logLevel string
+	logRate  string
+	jobSeed  uint64
+	seedSet  bool // Whether the seed was given rather than drawn at start
+
+	goMaxProcs string // Runtime tuning of the ranks, see goruntime.go; empty is derived per instance
+	goGC       string
+	goMemLimit string
+
+	fromManifestPath string
+	pinnedManifest   *runDescriptor // The manifest loaded with --from-manifest
+
+	startAt        string
+	deadline       string
+	deadlineAction string
+	startTime      time.Time // When the run starts, set from startAt by resolveSchedule
+	deadlineTime   time.Time // When the run is cancelled; zero when it has no deadline
+
+	givenJobID string // Job ID to use instead of a generated one
+	stopAfter  string // Phase to stop after, leaving the rest for resume-phase
+
+	targetByTag    bool // Send the shared launch script to the awsmpirun:cluster tag, see targets.go
+	maxConcurrency string
+	maxErrors      string
+}
+
+// newRunOptions returns the options of a run before any flag is applied
+func newRunOptions() *runOptions {
+	return &runOptions{
+		numInstances:     1,
+		launcher:         launcherNative,
+		slotsPerNode:     1,
+		debugRank:        -1,
+		eagerLimit:       -1,
+		reconnectTimeout: -time.Second,
+		debugPort:        defaultDebugPort,
+		debugWait:        30 * time.Minute,
+
+		deadlineAction: deadlineCancel,
+	}
+}
+
+// bindRunFlags defines the run flags on flags, backed by o
+func (o *runOptions) bindRunFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.project, "project", o.project, "Project the run belongs to; only instances tagged awsmpirun:project with it are used (default: project in config.yaml)")
+	flags.IntVarP(&o.numInstances, "num-instances", "n", o.numInstances, "Number of EC2 instances")
+	flags.StringVarP(&o.vpcID, "vpc", "v", o.vpcID, "VPC ID (required)")
+	flags.StringVarP(&o.executablePath, "exec", "e", o.executablePath, "Command to run on the instances (required); {rank}, {size}, {job_id}, and {work_dir} are expanded per rank")
+	flags.StringVar(&o.chaosSpec, "chaos", o.chaosSpec, `Faults to inject during the run, e.g. "kill-rank=3@60s,partition=2-5@120s,stop-rank=1@90s"; partition=A-B cuts ranks A through B off from the rest`)
+	flags.StringVar(&o.bucket, "bucket", o.bucket, "S3 bucket for job staging. Without it every rank gets its own script embedding all N addresses (O(N²) bytes); with it the address table is uploaded once as a shared manifest")
+	flags.StringVar(&o.launcher, "launcher", o.launcher, `How to start the program: "native" runs it on every rank, "openmpi" runs it with OpenMPI's mpirun from rank 0, "netns" runs --slots-per-node ranks on every instance, each in a network namespace of its own`)
+	flags.IntVar(&o.slotsPerNode, "slots-per-node", o.slotsPerNode, "Processes per instance for --launcher openmpi and netns")
+	flags.StringVar(&o.workDir, "work-dir", o.workDir, "Directory the program runs in on each instance; may contain {job_id} (default: the SSM working directory)")
+	flags.StringSliceVar(&o.requirements, "require", o.requirements, `Topology the instances must have or the run stops before starting: same-az, same-type, placement-group, on-demand, spot, instance-type=TYPE, max-azs=N`)
+	flags.StringVar(&o.selector, "instance-selector", o.selector, `How the instances are chosen among those found, and their rank order: first, cheapest, newest, spread, packed, or the path of a Go plugin exporting a placement.InstanceSelector (default first)`)
+	flags.IntVar(&o.maxPerAZ, "max-instances-per-az", o.maxPerAZ, "Spread the instances so no availability zone has more than this many, and losing a zone loses at most this many ranks (0 is no limit)")
+	o.git.bindFlags(flags, "in the work directory of every rank, as {work_dir}/"+gitSourceDir+",")
+	flags.IntVar(&o.maxSpawnRanks, "max-spawn-ranks", o.maxSpawnRanks, "Ranks the program may add while it runs with mpi.Comm.Spawn, on idle instances of the project; needs --bucket (0 disables spawning)")
+	flags.BoolVar(&o.targetByTag, "target-by-tag", o.targetByTag, "Tag the instances awsmpirun:cluster with the job ID and start the ranks with one SSM command sent to the tag instead of instance ID lists; needs --bucket")
+	flags.StringVar(&o.maxConcurrency, "max-concurrency", o.maxConcurrency, `Instances SSM starts the ranks on at a time with --target-by-tag, as a count or a percentage (default "100%")`)
+	flags.StringVar(&o.maxErrors, "max-errors", o.maxErrors, `Failed ranks after which SSM stops starting the rest with --target-by-tag, as a count or a percentage (default "100%")`)
+	flags.StringVar(&o.kvTable, "kv-table", o.kvTable, "DynamoDB table backing the shared key-value store (created if missing)")
+
+	flags.IntVar(&o.connectConcurrency, "connect-concurrency", o.connectConcurrency, "Maximum peer handshakes each rank runs at once during Init (0 uses the runtime default)")
+	flags.DurationVar(&o.connectTimeout, "connect-timeout", o.connectTimeout, "How long Init keeps retrying peer connections (0 uses the runtime default)")
+	flags.DurationVar(&o.connectStagger, "connect-stagger", o.connectStagger, "Per-rank delay before Init starts dialing peers (0 uses the runtime default)")
+	flags.StringVar(&o.transport, "transport", o.transport, `Transport between ranks: "grpc", or "tcp" for raw TCP with lower small-message latency (default grpc)`)
+	flags.IntVar(&o.eagerLimit, "eager-limit", o.eagerLimit, "Largest message in bytes the ranks send at once; larger ones wait until the receiver asks for them, 0 sends everything at once (-1 uses the runtime default of 64 KiB)")
+	flags.DurationVar(&o.reconnectTimeout, "reconnect-timeout", o.reconnectTimeout, "How long a rank keeps trying to resume a broken connection to a peer before reporting it as left, resending what the peer missed; 0 reports it at once (-1s uses the runtime default of 30s)")
+	flags.DurationVar(&o.collectiveTimeout, "collective-timeout", o.collectiveTimeout, "How long a collective such as Barrier or Allreduce waits for each rank before it gives up, so a hung rank does not wedge the others (0 waits forever)")
+	flags.StringVar(&o.timeoutPolicy, "timeout-policy", o.timeoutPolicy, `What a collective does when it times out: "error" returns an error, "abort" ends every rank of the job, "retry" warns and waits a few more times before returning an error (default error)`)
+	flags.StringVar(&o.maxBandwidth, "max-bandwidth-per-rank", o.maxBandwidth, `Most each rank sends to the other ranks, e.g. "500Mbit" or "100MB/s", to leave room on shared NAT gateways and peering links (default unlimited)`)
+	flags.StringVar(&o.broadcast, "broadcast", o.broadcast, `How large broadcasts travel: "tree" down a binomial tree of the ranks, or "udp", experimental, in chunks over UDP that the other ranks relay, so the root sends a payload about once; needs the instances in one placement group and UDP open on the rank port (default tree)`)
+	flags.DurationVar(&o.maxClockSkew, "max-clock-skew", o.maxClockSkew, "Measure the ranks' clocks against each other in Init and warn from rank 0 when they are further apart than this, e.g. 10ms (0 does not measure)")
+	flags.BoolVar(&o.encryptPayloads, "encrypt-payloads", o.encryptPayloads, "Encrypt everything the ranks send each other with AES-GCM under a random key for the job, kept in SSM Parameter Store, on any --transport and without certificates")
+	flags.IntVar(&o.pprofPort, "pprof-port", o.pprofPort, "Localhost port every rank serves runtime profiles on, for awsmpirun profile (0 disables)")
+	flags.StringVar(&o.logLevel, "log-level", o.logLevel, `Level of mpi.Logger on the ranks, with per-rank overrides, e.g. "warn,0=info,4-7=debug" (default info)`)
+	flags.StringVar(&o.logRate, "log-rate", o.logRate, `Records with the same message each rank may log per window, e.g. "10/10s"; "0" disables the limit (default 10/10s)`)
+	flags.StringVar(&o.goMaxProcs, "gomaxprocs", o.goMaxProcs, `GOMAXPROCS of every rank, or "default" for Go's own (default: the instance's vCPUs divided among its ranks)`)
+	flags.StringVar(&o.goGC, "gogc", o.goGC, `GOGC of every rank, a percentage or "off", or "default" for Go's own (default: 200 when the rank's memory limit is 2 GiB or more, else 100)`)
+	flags.StringVar(&o.goMemLimit, "gomemlimit", o.goMemLimit, `GOMEMLIMIT of every rank, e.g. "3GiB" or "off", or "default" for Go's own (default: the instance's memory, less a tenth or 256 MiB, divided among its ranks)`)
+	flags.Uint64Var(&o.jobSeed, "seed", o.jobSeed, "Job-level random seed the ranks derive their generators from with mpi.NewRand (default: a random seed, printed at start)")
+	flags.IntVar(&o.debugRank, "debug-rank", o.debugRank, "Run this rank under dlv in headless mode and tunnel to it; the other ranks wait in Init until the debugger continues it")
+	flags.IntVar(&o.debugPort, "debug-port", o.debugPort, "Port dlv listens on, on the instance of --debug-rank")
+	flags.DurationVar(&o.debugWait, "debug-wait", o.debugWait, "How long the other ranks wait for the debugged rank in Init")
+	flags.IntVar(&o.minRanks, "min-ranks", o.minRanks, "Start computing once this many ranks are connected and admit the rest as they arrive (0 waits for all ranks)")
+	flags.BoolVar(&o.checkNetwork, "check-network", o.checkNetwork, "Before starting the program, check that every rank can reach every other rank on the rank port, and report the pairs that cannot with their likely cause")
+	flags.BoolVar(&o.jobSecurityGroup, "job-security-group", o.jobSecurityGroup, "Open the rank port only between the job's instances, in a security group created for the job when the ranks start and deleted when they finish")
+	flags.BoolVar(&o.metrics, "metrics", o.metrics, "Publish the rank count, wall time, bytes sent, and failures of the job as CloudWatch metrics in the "+metricsNamespace+" namespace")
+	flags.BoolVar(&o.strictPermissions, "strict-permissions", o.strictPermissions, "Fail the run when the caller lacks the permissions of an optional feature it asks for, such as --metrics or --target-by-tag, instead of turning the feature off with a warning")
+	flags.StringVar(&o.startAt, "start-at", o.startAt, `Wait until this time before starting, as RFC 3339, "2006-01-02 15:04", or "15:04" for its next occurrence, in local time`)
+	flags.StringVar(&o.deadline, "deadline", o.deadline, `Cancel the run if it is still going at this time, or this long after it starts, e.g. "6h" or "07:00"`)
+	flags.StringVar(&o.deadlineAction, "deadline-action", o.deadlineAction, `What to do with the instances when the deadline passes: "cancel" only cancels the ranks, "stop" or "terminate" also stops or terminates the instances`)
+	flags.StringVar(&o.givenJobID, "job-id", o.givenJobID, "Use this job ID instead of a generated one, e.g. to name the job after the workflow running it")
+	flags.StringVar(&o.stopAfter, "stop-after", o.stopAfter, "Stop once this phase has completed and leave the rest for awsmpirun resume-phase: discover, setup, distribute, execute, or collect")
+	flags.StringVar(&o.fromManifestPath, "from-manifest", o.fromManifestPath, "Repeat the run recorded in a job.yaml: same instances, options, seed, and program sha256; flags given as well override it")
+}
@@ -0,0 +1,53 @@
+// cmd/options_test.go
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestBindRunFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		check func(o *runOptions) bool
+	}{
+		{"defaults", nil, func(o *runOptions) bool {
+			return o.numInstances == 1 && o.launcher == launcherNative && o.slotsPerNode == 1 && o.debugRank == -1 && o.debugWait == 30*time.Minute
+		}},
+		{"size and command", []string{"-n", "4", "--exec", "./solver"}, func(o *runOptions) bool {
+			return o.numInstances == 4 && o.executablePath == "./solver"
+		}},
+		{"durations", []string{"--connect-timeout", "2m", "--debug-wait", "5s"}, func(o *runOptions) bool {
+			return o.connectTimeout == 2*time.Minute && o.debugWait == 5*time.Second
+		}},
+		{"requirements", []string{"--require", "same-az,on-demand", "--require", "max-azs=2"}, func(o *runOptions) bool {
+			return len(o.requirements) == 3 && o.requirements[0] == "same-az" && o.requirements[2] == "max-azs=2"
+		}},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		flags := pflag.NewFlagSet(tt.name, pflag.ContinueOnError)
+		o.bindRunFlags(flags)
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !tt.check(o) {
+			t.Errorf("%s: options = %+v", tt.name, o)
+		}
+	}
+}
+
+// TestRunOptionsIndependent checks that two runs do not share state
+func TestRunOptionsIndependent(t *testing.T) {
+	a, b := newRunOptions(), newRunOptions()
+	a.bindRunFlags(pflag.NewFlagSet("a", pflag.ContinueOnError))
+	a.jobID, a.extraEnv = "job-a", []string{"A=1"}
+	if b.jobID != "" || b.extraEnv != nil {
+		t.Errorf("second run sees %q, %v", b.jobID, b.extraEnv)
+	}
+}
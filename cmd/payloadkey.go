@@ -0,0 +1,70 @@
+// cmd/payloadkey.go
+// This file implements --encrypt-payloads. The execute phase generates a random key
+// for the job and stores it as a SecureString parameter in SSM Parameter Store,
+// encrypted with the account's aws/ssm KMS key, and the ranks read it at Init and
+// encrypt every frame they exchange with it, as mpi/encryption.go describes. The key
+// never appears in a command, a script, or the environment, only the parameter's name
+// does. The pipeline deletes the parameter however it ends, since no rank of the run
+// is left by then; a resumed run that executes the ranks again stores a new key.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// payloadKeyParameter is the SSM parameter the run's payload key is stored in
+func (o *runOptions) payloadKeyParameter() string {
+	return mpi.PayloadKeyParameter(o.project, o.jobID)
+}
+
+// createPayloadKey stores a new payload key for the job, replacing the key of an
+// earlier attempt at the same job
+func (o *runOptions) createPayloadKey(ctx context.Context) error {
+	key, err := mpi.NewPayloadKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate the payload key: %v", err)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	_, err = ssmClient.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:        aws.String(o.payloadKeyParameter()),
+		Value:       aws.String(key),
+		Type:        ssmTypes.ParameterTypeSecureString,
+		Description: aws.String("Payload key of awsmpirun job " + o.jobID),
+		Overwrite:   aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store the payload key in %s: %v", o.payloadKeyParameter(), err)
+	}
+	fmt.Printf("Stored the payload key of the job in SSM parameter %s\n", o.payloadKeyParameter())
+	return nil
+}
+
+// deletePayloadKey removes the payload key in the SSM parameter called name once no
+// rank needs it
+var deletePayloadKey = func(ctx context.Context, name string) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	_, err = ssmClient.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(name)})
+	var notFound *ssmTypes.ParameterNotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to delete the payload key %s: %v", name, err)
+	}
+	return nil
+}
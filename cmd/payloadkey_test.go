@@ -0,0 +1,101 @@
+// cmd/payloadkey_test.go
+
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestRankScriptPayloadKey(t *testing.T) {
+	instances := testInstances()
+	tests := []struct {
+		name    string
+		encrypt bool
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "plain",
+			notWant: []string{mpi.EnvPayloadKeyParameter, "AWS_REGION"},
+		},
+		{
+			name:    "encrypted",
+			encrypt: true,
+			want: []string{
+				"export " + mpi.EnvPayloadKeyParameter + "='/awsmpirun/projects/team-a/jobs/job-1/payload-key'",
+				"export AWS_REGION='us-west-2'",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.project, o.jobID, o.encryptPayloads = "team-a", "job-1", tt.encrypt
+			script := o.buildRankScript(instances[0], instances, "./solver", "us-west-2")
+			for _, want := range tt.want {
+				if !strings.Contains(script, want) {
+					t.Errorf("rank script does not contain %q:\n%s", want, script)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(script, notWant) {
+					t.Errorf("rank script contains %q:\n%s", notWant, script)
+				}
+			}
+		})
+	}
+}
+
+func TestRunPipelineDeletesPayloadKey(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	saved := deletePayloadKey
+	t.Cleanup(func() { deletePayloadKey = saved })
+	var deleted []string
+	deletePayloadKey = func(ctx context.Context, name string) error {
+		deleted = append(deleted, name)
+		return nil
+	}
+
+	tests := []struct {
+		name      string
+		fail      string // Phase that fails
+		stopAfter string
+		stored    bool // Whether a phase stores the key
+	}{
+		{name: "finished", stored: true},
+		{name: "failed after execute", fail: phaseCollect, stored: true},
+		{name: "stopped after execute", stopAfter: phaseExecute, stored: true},
+		{name: "failed before execute", fail: phaseDistribute},
+	}
+	for _, tt := range tests {
+		deleted = nil
+		o := newRunOptions()
+		o.jobID, o.project, o.vpcID, o.executablePath, o.stopAfter = "job-1", "team-a", "vpc-1", "./solver", tt.stopAfter
+		s := o.newRunState()
+		var ran []string
+		phases := fakePhases(&ran, map[string]bool{tt.fail: true})
+		for i, phase := range phases {
+			if phase.name == phaseExecute {
+				run := phase.run
+				phases[i].run = func(o *runOptions, ctx context.Context, s *runState) error {
+					s.payloadKey = true
+					return run(o, ctx, s)
+				}
+			}
+		}
+		o.runPipeline(context.Background(), s, phases)
+
+		var want []string
+		if tt.stored {
+			want = []string{mpi.PayloadKeyParameter("team-a", "job-1")}
+		}
+		if strings.Join(deleted, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: deleted %v, want %v", tt.name, deleted, want)
+		}
+	}
+}
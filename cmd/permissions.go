@@ -0,0 +1,193 @@
+// cmd/permissions.go
+// This file checks, once the instances of a run are known and before anything is
+// started on them, that the caller has the permissions of the optional features the
+// run asks for. A feature whose permission is missing is turned off with a warning
+// saying what the run does without it, rather than failing the run halfway or losing
+// its metrics to an AccessDenied after the program finished. Each feature is probed
+// with a call authorized like the real one: a DryRun for EC2, a listing of one key for
+// S3, and, since PutMetricData has no dry run, the JobStarted metric for CloudWatch.
+// With --strict-permissions a missing permission fails the run instead.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+// accessDeniedCodes are the error codes AWS APIs report a missing permission with
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":          true, // S3 and CloudWatch
+	"AccessDeniedException": true, // SSM and the JSON protocol services
+	"UnauthorizedOperation": true, // EC2
+}
+
+// isAccessDenied reports whether err is an AWS API refusing the caller a permission
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return accessDeniedCodes[apiErr.ErrorCode()]
+	}
+	return false
+}
+
+// dryRunResult returns the error of an EC2 call made with DryRun, which reports that
+// the call would have succeeded as a DryRunOperation error
+func dryRunResult(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		return nil
+	}
+	return err
+}
+
+// optionalFeature is a feature of a run that can be turned off when the caller lacks
+// the permissions it needs
+type optionalFeature struct {
+	name        string   // As the warning names it, e.g. "--metrics"
+	permissions []string // IAM actions the feature needs
+	without     string   // What the run does without the feature
+	probe       func(ctx context.Context) error
+	disable     func()
+}
+
+// optionalFeatures returns the optional features a run on instances asks for
+func (o *runOptions) optionalFeatures(instances []awsManager.InstanceInfo) []optionalFeature {
+	var features []optionalFeature
+	if o.targetByTag {
+		features = append(features, optionalFeature{
+			name:        "--target-by-tag",
+			permissions: []string{"ec2:CreateTags", "ssm:ListCommands"},
+			without:     "the ranks are started with instance ID lists",
+			probe:       func(ctx context.Context) error { return o.probeClusterTagging(ctx, instances) },
+			disable: func() {
+				o.targetByTag = false
+				o.maxConcurrency, o.maxErrors = "", ""
+			},
+		})
+	}
+	if o.checkNetwork {
+		features = append(features, optionalFeature{
+			name:        "explaining blocked pairs in --check-network",
+			permissions: []string{"ec2:DescribeSecurityGroups", "ec2:DescribeNetworkAcls"},
+			without:     "blocked rank pairs are reported without the rule that drops them",
+			probe:       probeNetworkPolicies,
+			disable:     func() { o.noNetworkPolicies = true },
+		})
+	}
+	if o.bucket != "" && o.launcher == launcherNative {
+		features = append(features, optionalFeature{
+			name:        "the result manifest",
+			permissions: []string{"s3:ListBucket"},
+			without:     "the results are not indexed, so results ls and merge cannot read them",
+			probe: func(ctx context.Context) error {
+				s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+				if err != nil {
+					return err
+				}
+				return s3Client.CheckList(ctx, resultsPrefix(o.project, o.jobID))
+			},
+			disable: func() { o.noResultIndex = true },
+		})
+	}
+	if o.metrics {
+		features = append(features, optionalFeature{
+			name:        "--metrics",
+			permissions: []string{"cloudwatch:PutMetricData"},
+			without:     "the job metrics are not published",
+			probe:       o.publishJobStarted,
+			disable:     func() { o.metrics = false },
+		})
+	}
+	return features
+}
+
+// checkOptionalPermissions probes the optional features of a run on instances and
+// turns off the ones the caller lacks permissions for, or with --strict-permissions
+// fails. A probe that fails for another reason leaves its feature on.
+func (o *runOptions) checkOptionalPermissions(ctx context.Context, instances []awsManager.InstanceInfo, journal *eventJournal) error {
+	return o.applyPermissionChecks(ctx, o.optionalFeatures(instances), journal, os.Stdout)
+}
+
+// applyPermissionChecks probes features, reporting what it turns off to w
+func (o *runOptions) applyPermissionChecks(ctx context.Context, features []optionalFeature, journal *eventJournal, w io.Writer) error {
+	var missing []string
+	for _, feature := range features {
+		err := feature.probe(ctx)
+		if err == nil {
+			continue
+		}
+		if !isAccessDenied(err) {
+			fmt.Fprintf(w, "Warning: could not check the permissions of %s: %v\n", feature.name, err)
+			continue
+		}
+		permissions := strings.Join(feature.permissions, ", ")
+		if o.strictPermissions {
+			missing = append(missing, fmt.Sprintf("%s needs %s", feature.name, permissions))
+			continue
+		}
+		feature.disable()
+		fmt.Fprintf(w, "Warning: turning off %s, the caller lacks %s; %s\n", feature.name, permissions, feature.without)
+		journal.recordf(eventFeatureDisabled, "%s, missing %s", feature.name, permissions)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the caller lacks permissions the run needs (awsmpirun iam print-policy --for run lists them):\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// probeClusterTagging checks that the instances may be tagged with the job ID and the
+// command sent to the tag tracked
+func (o *runOptions) probeClusterTagging(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, instance := range instances[:min(len(instances), maxTagResources)] {
+		ids = append(ids, instance.InstanceID)
+	}
+	_, err = ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+		DryRun:    aws.Bool(true),
+		Resources: ids,
+		Tags:      []ec2Types.Tag{{Key: aws.String(clusterTagKey), Value: aws.String(o.jobID)}},
+	})
+	if err := dryRunResult(err); err != nil {
+		return err
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ssmClient.ListCommands(ctx, &ssm.ListCommandsInput{MaxResults: aws.Int32(1)})
+	return err
+}
+
+// probeNetworkPolicies checks that the security groups and network ACLs may be read
+func probeNetworkPolicies(ctx context.Context) error {
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ec2Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{DryRun: aws.Bool(true)})
+	if err := dryRunResult(err); err != nil {
+		return err
+	}
+	_, err = ec2Client.DescribeNetworkAcls(ctx, &ec2.DescribeNetworkAclsInput{DryRun: aws.Bool(true)})
+	return dryRunResult(err)
+}
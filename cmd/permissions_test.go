@@ -0,0 +1,142 @@
+// cmd/permissions_test.go
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsAccessDenied(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "EC2", err: &smithy.GenericAPIError{Code: "UnauthorizedOperation"}, want: true},
+		{name: "S3 wrapped", err: fmt.Errorf("failed to list: %w", &smithy.GenericAPIError{Code: "AccessDenied"}), want: true},
+		{name: "SSM", err: &smithy.GenericAPIError{Code: "AccessDeniedException"}, want: true},
+		{name: "CloudWatch", err: fmt.Errorf("PutMetricData failed: %w", &smithy.GenericAPIError{Code: "AccessDenied"}), want: true},
+		{name: "other API error", err: &smithy.GenericAPIError{Code: "NoSuchBucket"}},
+		{name: "CloudWatch throttling", err: &smithy.GenericAPIError{Code: "Throttling"}},
+		{name: "not an API error", err: errors.New("dial tcp: i/o timeout")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAccessDenied(tt.err); got != tt.want {
+				t.Errorf("isAccessDenied(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDryRunResult(t *testing.T) {
+	if err := dryRunResult(fmt.Errorf("wrapped: %w", &smithy.GenericAPIError{Code: "DryRunOperation"})); err != nil {
+		t.Errorf("dryRunResult(DryRunOperation) = %v, want nil", err)
+	}
+	denied := &smithy.GenericAPIError{Code: "UnauthorizedOperation"}
+	if err := dryRunResult(denied); err != denied {
+		t.Errorf("dryRunResult(UnauthorizedOperation) = %v, want it returned", err)
+	}
+}
+
+func TestOptionalFeatures(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(o *runOptions)
+		want  []string
+	}{
+		{name: "none", apply: func(o *runOptions) {}},
+		{
+			name: "everything",
+			apply: func(o *runOptions) {
+				o.targetByTag, o.checkNetwork, o.metrics, o.bucket = true, true, true, "staging"
+			},
+			want: []string{"--target-by-tag", "explaining blocked pairs in --check-network", "the result manifest", "--metrics"},
+		},
+		{
+			name: "mpirun gathers no results",
+			apply: func(o *runOptions) {
+				o.bucket, o.launcher = "staging", launcherOpenMPI
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			tt.apply(o)
+			var names []string
+			for _, feature := range o.optionalFeatures(testInstances()) {
+				names = append(names, feature.name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("optionalFeatures() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPermissionChecks(t *testing.T) {
+	denied := fmt.Errorf("CreateTags: %w", &smithy.GenericAPIError{Code: "UnauthorizedOperation"})
+	tests := []struct {
+		name         string
+		strict       bool
+		probeErr     error
+		wantDisabled bool
+		wantOutput   string
+		wantErr      string
+	}{
+		{name: "allowed"},
+		{name: "denied", probeErr: denied, wantDisabled: true, wantOutput: "Warning: turning off --target-by-tag, the caller lacks ec2:CreateTags; the ranks are started with instance ID lists"},
+		{name: "denied with --strict-permissions", strict: true, probeErr: denied, wantErr: "--target-by-tag needs ec2:CreateTags"},
+		{name: "probe failed", probeErr: errors.New("dial tcp: i/o timeout"), wantOutput: "could not check the permissions of --target-by-tag: dial tcp"},
+		{name: "probe failed with --strict-permissions", strict: true, probeErr: errors.New("dial tcp: i/o timeout"), wantOutput: "could not check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.strictPermissions = tt.strict
+			disabled := false
+			features := []optionalFeature{{
+				name:        "--target-by-tag",
+				permissions: []string{"ec2:CreateTags"},
+				without:     "the ranks are started with instance ID lists",
+				probe:       func(context.Context) error { return tt.probeErr },
+				disable:     func() { disabled = true },
+			}}
+			var out strings.Builder
+			err := o.applyPermissionChecks(context.Background(), features, nil, &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyPermissionChecks() error = %v, want one containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("applyPermissionChecks() error = %v", err)
+			}
+			if disabled != tt.wantDisabled {
+				t.Errorf("disabled = %v, want %v", disabled, tt.wantDisabled)
+			}
+			if tt.wantOutput == "" && out.Len() > 0 || !strings.Contains(out.String(), tt.wantOutput) {
+				t.Errorf("output = %q, want it to contain %q", out.String(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestDisableTargetByTag(t *testing.T) {
+	o := newRunOptions()
+	o.targetByTag, o.bucket, o.maxConcurrency = true, "staging", "10%"
+	o.optionalFeatures(testInstances())[0].disable()
+	if o.targetByTag || o.maxConcurrency != "" {
+		t.Errorf("targetByTag = %v, maxConcurrency = %q after disabling", o.targetByTag, o.maxConcurrency)
+	}
+	if err := o.validateTargeting(); err != nil {
+		t.Errorf("validateTargeting() = %v after disabling", err)
+	}
+}
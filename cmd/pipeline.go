@@ -0,0 +1,592 @@
+// cmd/pipeline.go
+// This file models a run as a pipeline of phases: discover finds and ranks the
+// instances, setup prepares shared resources, distribute stages the address manifest,
+// execute runs the program, and collect records the run and shows its output. The
+// state the phases hand to each other is saved after every phase to phases.yaml in the
+// job's configuration directory, so a run that failed in one phase can be resumed from
+// it with awsmpirun resume-phase instead of repeating the phases that succeeded.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Phases of a run, in pipeline order
+const (
+	phaseDiscover   = "discover"
+	phaseSetup      = "setup"
+	phaseDistribute = "distribute"
+	phaseExecute    = "execute"
+	phaseCollect    = "collect"
+)
+
+// runStateVersion is the format version of phases.yaml
+const runStateVersion = 1
+
+// runPhase is one step of a run
+type runPhase struct {
+	name string
+	run  func(o *runOptions, ctx context.Context, s *runState) error
+}
+
+// runState is what the phases of a run hand to each other. The exported fields are
+// saved after every phase; the others only live as long as the process.
+type runState struct {
+	Version    int               `yaml:"version"`
+	JobID      string            `yaml:"job_id"`
+	Updated    string            `yaml:"updated"`
+	Completed  []string          `yaml:"completed,omitempty"`
+	Failed     string            `yaml:"failed,omitempty"`
+	Error      string            `yaml:"error,omitempty"`
+	Run        *runDescriptor    `yaml:"run"`
+	Size       int               `yaml:"size"`
+	Hosts      []string          `yaml:"hosts,omitempty"`
+	CommandIDs map[string]string `yaml:"command_ids,omitempty"`
+
+	instances    []awsManager.InstanceInfo // The ranked instances, also recorded in Run
+	launchScript string                    // The shared script uploaded by distribute
+	outputs      map[string]string         // Standard output of every rank, by instance ID
+	journal      *eventJournal             // The job's event journal while the pipeline runs
+	stats        jobStats                  // Traffic and failures of the ranks, for --metrics
+	payloadKey   bool                      // Whether the payload key is stored, until the pipeline ends
+}
+
+// phaseError is a run that stopped in a phase
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string {
+	return fmt.Sprintf("%s phase failed: %v", e.phase, e.err)
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+// newRunState returns the state of a run that has not started any phase
+func (o *runOptions) newRunState() *runState {
+	return &runState{
+		Version: runStateVersion,
+		JobID:   o.jobID,
+		Run:     o.newRunDescriptor(nil, "", o.pinnedProgramHash()),
+		Size:    o.numInstances,
+		Hosts:   o.hostSelection,
+	}
+}
+
+// runPhases returns the phases of a run with o's launcher. mpirun and the netns
+// launcher distribute the address table and gather the output themselves, so only the
+// native launcher has distribute and collect phases.
+func (o *runOptions) runPhases() []runPhase {
+	if o.launcher != launcherNative {
+		return []runPhase{
+			{phaseDiscover, (*runOptions).discoverPhase},
+			{phaseSetup, (*runOptions).setupPhase},
+			{phaseExecute, (*runOptions).executePhase},
+		}
+	}
+	return []runPhase{
+		{phaseDiscover, (*runOptions).discoverPhase},
+		{phaseSetup, (*runOptions).setupPhase},
+		{phaseDistribute, (*runOptions).distributePhase},
+		{phaseExecute, (*runOptions).executePhase},
+		{phaseCollect, (*runOptions).collectPhase},
+	}
+}
+
+// runPipeline runs the phases s has not completed, saving s after each one, and stops
+// at the first phase that fails. Every step is recorded in the job's event journal.
+func (o *runOptions) runPipeline(ctx context.Context, s *runState, phases []runPhase) (runErr error) {
+	s.journal = o.openEventJournal()
+	defer func() {
+		// A cancelled run is still recorded in the bucket
+		s.journal.close(context.WithoutCancel(ctx))
+		s.journal = nil
+	}()
+	defer func() {
+		// No rank is left to read the key, however the run ended
+		if s.payloadKey {
+			if err := deletePayloadKey(context.WithoutCancel(ctx), o.payloadKeyParameter()); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+			s.payloadKey = false
+		}
+	}()
+	started, stopped := time.Now(), false
+	defer func() {
+		if !stopped {
+			o.publishJobMetrics(context.WithoutCancel(ctx), s, time.Since(started), runErr != nil)
+		}
+	}()
+	defer func() {
+		status := jobSucceeded
+		if runErr != nil {
+			status = jobFailed
+		} else if stopped {
+			status = jobStopped
+		}
+		o.recordUsage(context.WithoutCancel(ctx), s, started, status)
+	}()
+	start := s.resumeIndex(phases)
+	if len(s.Completed) > 0 || s.Failed != "" {
+		s.journal.recordf(eventRunResumed, "from the %s phase", phases[min(start, len(phases)-1)].name)
+	} else {
+		s.journal.recordf(eventRunStarted, "%d instances in %s, running %s", o.numInstances, o.vpcID, o.executablePath)
+	}
+
+	for _, phase := range phases[start:] {
+		s.journal.enter(phase.name)
+		s.journal.record(jobEvent{Type: eventPhaseStarted})
+		var err error
+		if o.pastDeadline() {
+			err = o.deadlineExceeded(ctx, s.instances, "before the "+phase.name+" phase")
+		} else {
+			err = phase.run(o, ctx, s)
+		}
+		if err != nil {
+			s.Failed, s.Error = phase.name, err.Error()
+			s.save()
+			s.journal.record(jobEvent{Type: eventPhaseFailed, Message: err.Error()})
+			s.journal.record(jobEvent{Type: eventRunFailed})
+			return &phaseError{phase: phase.name, err: err}
+		}
+		s.Completed = append(s.Completed, phase.name)
+		s.Failed, s.Error = "", ""
+		s.save()
+		s.journal.record(jobEvent{Type: eventPhaseCompleted})
+		s.journal.sync(ctx)
+		if phase.name == o.stopAfter && len(s.Completed) < len(phases) {
+			s.journal.recordf(eventRunStopped, "continue with awsmpirun resume-phase --job %s", o.jobID)
+			stopped = true
+			return nil
+		}
+	}
+	s.journal.enter("")
+	s.journal.record(jobEvent{Type: eventRunFinished})
+	return nil
+}
+
+// validateStopAfter rejects a --stop-after that is not a phase of the run
+func (o *runOptions) validateStopAfter() error {
+	if o.stopAfter == "" {
+		return nil
+	}
+	var names []string
+	for _, phase := range o.runPhases() {
+		if phase.name == o.stopAfter {
+			return nil
+		}
+		names = append(names, phase.name)
+	}
+	return fmt.Errorf("--stop-after must be one of %s, got %q", strings.Join(names, ", "), o.stopAfter)
+}
+
+// resumeIndex returns the index of the first phase s has not completed
+func (s *runState) resumeIndex(phases []runPhase) int {
+	for i, phase := range phases {
+		if i >= len(s.Completed) || s.Completed[i] != phase.name {
+			return i
+		}
+	}
+	return len(phases)
+}
+
+// rewind forgets phase and every phase after it, so they run again
+func (s *runState) rewind(phases []runPhase, phase string) error {
+	for i, p := range phases {
+		if p.name != phase {
+			continue
+		}
+		if i > len(s.Completed) {
+			return fmt.Errorf("phase %s cannot run before %s has completed", phase, phases[len(s.Completed)].name)
+		}
+		s.Completed = s.Completed[:i]
+		return nil
+	}
+	return fmt.Errorf("this run has no %s phase", phase)
+}
+
+// runStatePath returns where the state of a job is saved
+func runStatePath(jobID string) (string, error) {
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "jobs", jobID, "phases.yaml"), nil
+}
+
+// save writes s to the job's configuration directory, warning when it cannot
+func (s *runState) save() {
+	s.Updated = time.Now().UTC().Format(time.RFC3339)
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		fmt.Printf("Warning: failed to render phase state: %v\n", err)
+		return
+	}
+	path, err := runStatePath(s.JobID)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(path, data, 0o600)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save phase state: %v\n", err)
+	}
+}
+
+// loadRunState reads the saved state of a job
+func loadRunState(jobID string) (*runState, error) {
+	if err := validateJobID(jobID); err != nil {
+		return nil, err
+	}
+	path, err := runStatePath(jobID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no saved phases for job %s: %v", jobID, err)
+	}
+	return parseRunState(data)
+}
+
+func parseRunState(data []byte) (*runState, error) {
+	var s runState
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != runStateVersion {
+		return nil, fmt.Errorf("unsupported phase state version %d", s.Version)
+	}
+	if s.Run == nil || s.JobID == "" {
+		return nil, fmt.Errorf("phase state has no job or run options")
+	}
+	s.instances = descriptorInstances(s.Run)
+	return &s, nil
+}
+
+// discoverPhase finds the instances of the run and assigns their ranks
+func (o *runOptions) discoverPhase(ctx context.Context, s *runState) error {
+	instances, err := discoverInstances(ctx, o.vpcID, o.project)
+	if err != nil {
+		return fmt.Errorf("failed to discover instances: %v", err)
+	}
+	if len(o.hostSelection) > 0 {
+		instances, err = selectHosts(instances, o.hostSelection)
+		if err != nil {
+			return fmt.Errorf("failed to select hosts: %v", err)
+		}
+	}
+	selectedInstances, err := o.selectInstances(instances)
+	if err != nil {
+		return err
+	}
+
+	assignRanks(selectedInstances)
+	requirements, err := parseRequirements(o.requirements)
+	if err != nil {
+		return err
+	}
+	achieved := summarizeTopology(selectedInstances)
+	fmt.Print(achieved.report(o.numInstances, requirements))
+	if problems := achieved.unmet(requirements); len(problems) > 0 {
+		return fmt.Errorf("the instances do not meet --require:\n  %s", strings.Join(problems, "\n  "))
+	}
+	if zone, n := achieved.busiestZone(); o.maxPerAZ > 0 && n > o.maxPerAZ {
+		return fmt.Errorf("the instances do not meet --max-instances-per-az: %d are in %s, at most %d allowed", n, zone, o.maxPerAZ)
+	}
+	if o.broadcast == mpi.BroadcastUDP {
+		// Outside a placement group UDP loses too many chunks to be worth it
+		if problems := achieved.unmet([]requirement{{name: "placement-group"}}); len(problems) > 0 {
+			fmt.Printf("Warning: --broadcast udp needs the instances in one placement group, broadcasting down the tree instead: %s\n", problems[0])
+			o.broadcast = mpi.BroadcastTree
+		}
+	}
+	if o.pinnedManifest != nil {
+		for _, drift := range descriptorDrift(o.pinnedManifest, selectedInstances) {
+			fmt.Printf("Warning: %s\n", drift)
+		}
+	}
+
+	if ranks := len(selectedInstances) * o.ranksPerNode(); o.minRanks < 0 || o.minRanks > ranks {
+		return fmt.Errorf("--min-ranks must be between 0 and the number of ranks (%d), got %d", ranks, o.minRanks)
+	}
+	err = validateCommandTemplate(o.executablePath, o.launcher)
+	if err == nil {
+		err = o.validateDebugOptions(o.executablePath, len(selectedInstances))
+	}
+	if err != nil {
+		return fmt.Errorf("error in command: %v", err)
+	}
+	if _, err := parseChaosSpec(o.chaosSpec, len(selectedInstances)); err != nil {
+		return fmt.Errorf("failed to parse chaos spec: %v", err)
+	}
+	ids := make([]string, len(selectedInstances))
+	for i, instance := range selectedInstances {
+		ids[i] = instance.InstanceID
+	}
+	if err := checkInstanceCompliance(ctx, ids); err != nil {
+		return err
+	}
+	if err := o.checkOptionalPermissions(ctx, selectedInstances, s.journal); err != nil {
+		return err
+	}
+
+	s.instances = selectedInstances
+	s.Run = o.newRunDescriptor(selectedInstances, "", o.pinnedProgramHash())
+	return nil
+}
+
+// setupPhase prepares what the ranks share: the commit of the Git source, the
+// key-value table, and, for mpirun, the OpenMPI installation and launch user
+func (o *runOptions) setupPhase(ctx context.Context, s *runState) error {
+	if o.git.enabled() {
+		if err := o.resolveGitSource(ctx, s); err != nil {
+			return err
+		}
+	}
+	if o.kvTable != "" {
+		if err := ensureKVTable(ctx, o.kvTable); err != nil {
+			return fmt.Errorf("failed to prepare key-value table: %v", err)
+		}
+	}
+	if o.launcher == launcherOpenMPI {
+		return installOpenMPI(ctx, s.instances)
+	}
+	return nil
+}
+
+// distributePhase uploads the address manifest the ranks start from when the run has
+// a bucket. Without one, every rank script carries the address table itself.
+func (o *runOptions) distributePhase(ctx context.Context, s *runState) error {
+	if o.bucket == "" {
+		return nil
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	s.launchScript, err = o.uploadManifest(ctx, s.instances, ssmClient.Options().Region)
+	return err
+}
+
+// executePhase runs the program on every rank and waits for all of them
+func (o *runOptions) executePhase(ctx context.Context, s *runState) error {
+	if o.encryptPayloads {
+		if err := o.createPayloadKey(ctx); err != nil {
+			return err
+		}
+		s.payloadKey = true
+	}
+	if o.launcher == launcherOpenMPI {
+		err := o.executeOpenMPI(ctx, s.instances)
+		if err != nil && o.pastDeadline() {
+			return o.deadlineExceeded(ctx, s.instances, "while mpirun was running")
+		}
+		return err
+	}
+	if o.launcher == launcherNetns {
+		err := o.executeNetns(ctx, s.instances)
+		if err != nil && o.pastDeadline() {
+			return o.deadlineExceeded(ctx, s.instances, "while the ranks were running")
+		}
+		return err
+	}
+	faults, err := parseChaosSpec(o.chaosSpec, len(s.instances))
+	if err != nil {
+		return fmt.Errorf("failed to parse chaos spec: %v", err)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	if o.jobSecurityGroup {
+		ec2ClientCreator := awsManager.EC2ClientCreator{}
+		ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create EC2 client: %v", err)
+		}
+		// Removed however the ranks end, including at the deadline or on an interrupt
+		groupID, err := o.openJobSecurityGroup(ctx, ec2Client, s.instances)
+		if groupID != "" {
+			s.journal.recordf(eventGroupOpened, "%s", groupID)
+			defer func() {
+				if err := closeJobSecurityGroup(context.WithoutCancel(ctx), ec2Client, groupID); err != nil {
+					fmt.Printf("Warning: %v; delete it with aws ec2 delete-security-group --group-id %s\n", err, groupID)
+					return
+				}
+				s.journal.recordf(eventGroupClosed, "%s", groupID)
+			}()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if o.checkNetwork {
+		if err := checkReachability(ctx, ssmClient, s.instances, !o.noNetworkPolicies); err != nil {
+			return err
+		}
+	}
+
+	// Start the program everywhere, through the shared manifest when a bucket is available
+	if o.bucket != "" {
+		if s.launchScript == "" {
+			s.launchScript, err = o.downloadLaunchScript(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		if o.targetByTag {
+			s.CommandIDs, err = o.startClusterCommand(ctx, ssmClient, s.instances, s.launchScript)
+		} else {
+			s.CommandIDs, err = startManifestCommands(ctx, ssmClient, s.instances, s.launchScript, o.executionTimeout())
+		}
+	} else {
+		if len(s.instances) > maxSendCommandTargets {
+			fmt.Printf("Note: sending %d per-rank scripts; pass --bucket to share one address manifest instead\n", len(s.instances))
+		}
+		s.CommandIDs, err = o.sendRankCommands(ctx, ssmClient, s.instances)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Attach the debugger tunnel before the other ranks give up waiting in Init
+	if o.debugRank >= 0 {
+		tunnel, err := o.openDebugTunnel(ctx, ssmClient, s.instances)
+		if err != nil {
+			return err
+		}
+		defer tunnel.Close()
+	}
+
+	// Inject chaos faults while the program runs
+	if len(faults) > 0 {
+		monkey, err := newChaosMonkey(ctx, ssmClient, s.instances, o.jobID)
+		if err != nil {
+			return fmt.Errorf("failed to start chaos injection: %v", err)
+		}
+		monkey.Start(ctx, faults)
+		defer monkey.Stop(ctx)
+	}
+
+	// Answer the program's spawn requests while it runs
+	var spawns *spawner
+	if o.maxSpawnRanks > 0 {
+		spawns, err = o.startSpawner(ctx, ssmClient, s.instances, s.journal)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Wait for every rank, cancelling them at the deadline; a failed run is recorded
+	// too, so it can be repeated
+	for _, instance := range s.instances {
+		event := rankEvent(eventCommandSent, instance)
+		event.CommandID = s.CommandIDs[instance.InstanceID]
+		s.journal.record(event)
+	}
+	deadline := o.watchDeadline(ctx, ssmClient, s.CommandIDs)
+	var outputs map[string]string
+	var failures []rankFailure
+	if o.targetByTag {
+		outputs, failures, err = waitForClusterRanks(ctx, ssmClient, s.instances, s.CommandIDs[s.instances[0].InstanceID], s.journal)
+	} else {
+		outputs, failures, err = waitForRanks(ctx, ssmClient, s.instances, s.CommandIDs, s.journal)
+	}
+	if spawns != nil {
+		waitForSpawnedRanks(ctx, ssmClient, spawns.Stop())
+	}
+	if deadline.Stop() {
+		s.journal.recordf(eventDeadlinePassed, "%s, then %s", o.deadlineTime.Format(time.RFC3339), o.deadlineAction)
+		return o.deadlineExceeded(ctx, s.instances, "while the ranks were running")
+	}
+	if err != nil {
+		return err
+	}
+	s.outputs = outputs
+	s.stats.FailedRanks = len(failures)
+	if len(failures) > 0 {
+		o.recordRunOutputs(ctx, s, ssmClient.Options().Region)
+		return errors.New(summarizeFailures(failures))
+	}
+	return nil
+}
+
+// collectPhase records the run, indexes the results the ranks saved, and displays the
+// output from rank 0. A resumed run reads the output of the finished commands again.
+func (o *runOptions) collectPhase(ctx context.Context, s *runState) error {
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	if s.outputs == nil {
+		outputs, failures, err := waitForRanks(ctx, ssmClient, s.instances, s.CommandIDs, nil)
+		if err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			s.stats.FailedRanks = len(failures)
+			return errors.New(summarizeFailures(failures))
+		}
+		s.outputs = outputs
+	}
+	o.recordRunOutputs(ctx, s, ssmClient.Options().Region)
+	if o.bucket != "" && !o.noResultIndex {
+		if err := o.writeResultManifest(ctx); err != nil {
+			fmt.Printf("Warning: failed to write the result manifest: %v\n", err)
+		}
+	}
+	fmt.Println("Output from rank 0:")
+	fmt.Println(s.outputs[s.instances[0].InstanceID])
+	return nil
+}
+
+// recordRunOutputs strips the program hash and traffic markers from the rank outputs,
+// adds up the traffic, and writes the run manifest with the hash the ranks agree on
+func (o *runOptions) recordRunOutputs(ctx context.Context, s *runState, region string) {
+	hashes := make(map[string]string)
+	s.stats.BytesSent, s.stats.StatsReported = 0, false
+	for instanceID, output := range s.outputs {
+		hashes[instanceID], output = parseProgramHash(output)
+		stats, reported, rest := parseRankStats(output)
+		if reported {
+			s.stats.BytesSent += stats.BytesSent
+			s.stats.StatsReported = true
+		}
+		s.outputs[instanceID] = rest
+	}
+	o.recordRunDescriptor(ctx, s.instances, region, agreedProgramHash(s.instances, hashes))
+}
+
+// downloadLaunchScript reads back the shared script distribute uploaded
+func (o *runOptions) downloadLaunchScript(ctx context.Context) (string, error) {
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return "", fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	data, err := s3Client.DownloadBytes(ctx, launchScriptKey(o.project, o.jobID))
+	if err != nil {
+		return "", fmt.Errorf("failed to read launch script: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,180 @@
+// cmd/pipeline_test.go
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakePhases returns phases that record their name in ran and fail when named in fail
+func fakePhases(ran *[]string, fail map[string]bool) []runPhase {
+	var phases []runPhase
+	for _, name := range []string{phaseDiscover, phaseSetup, phaseDistribute, phaseExecute, phaseCollect} {
+		name := name
+		phases = append(phases, runPhase{name, func(o *runOptions, ctx context.Context, s *runState) error {
+			*ran = append(*ran, name)
+			if fail[name] {
+				return errors.New("boom")
+			}
+			return nil
+		}})
+	}
+	return phases
+}
+
+func TestRunPipelineResumesFailedPhase(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath, o.numInstances = "job-1", "vpc-1", "./solver", 3
+	s := o.newRunState()
+
+	var ran []string
+	err := o.runPipeline(context.Background(), s, fakePhases(&ran, map[string]bool{phaseDistribute: true}))
+	var failed *phaseError
+	if !errors.As(err, &failed) || failed.phase != phaseDistribute {
+		t.Fatalf("err = %v, want a distribute phase error", err)
+	}
+	if !reflect.DeepEqual(ran, []string{phaseDiscover, phaseSetup, phaseDistribute}) {
+		t.Errorf("ran %v", ran)
+	}
+
+	saved, err := loadRunState("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Failed != phaseDistribute || saved.Error != "boom" || saved.Size != 3 {
+		t.Errorf("saved state = %+v", saved)
+	}
+
+	ran = nil
+	if err := o.runPipeline(context.Background(), saved, fakePhases(&ran, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []string{phaseDistribute, phaseExecute, phaseCollect}) {
+		t.Errorf("resumed run ran %v", ran)
+	}
+	if saved, _ = loadRunState("job-1"); saved.Failed != "" || len(saved.Completed) != 5 {
+		t.Errorf("state after resuming = %+v", saved)
+	}
+}
+
+func TestRewind(t *testing.T) {
+	tests := []struct {
+		name      string
+		completed []string
+		phase     string
+		want      int
+		wantErr   string
+	}{
+		{"failed phase", []string{phaseDiscover, phaseSetup}, phaseDistribute, 2, ""},
+		{"earlier phase", []string{phaseDiscover, phaseSetup, phaseDistribute, phaseExecute}, phaseExecute, 3, ""},
+		{"first phase", []string{phaseDiscover}, phaseDiscover, 0, ""},
+		{"skips a phase", []string{phaseDiscover}, phaseExecute, 0, "before setup"},
+		{"unknown phase", nil, "deploy", 0, "no deploy phase"},
+	}
+
+	var ran []string
+	phases := fakePhases(&ran, nil)
+	for _, tt := range tests {
+		s := &runState{Completed: tt.completed}
+		err := s.rewind(phases, tt.phase)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got := s.resumeIndex(phases); got != tt.want {
+			t.Errorf("%s: resumes at %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRunStateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown field", "version: 1\njob_id: job-1\nrun: {version: 1}\nextra: true\n"},
+		{"wrong version", "version: 2\njob_id: job-1\nrun: {version: 1}\n"},
+		{"no run", "version: 1\njob_id: job-1\n"},
+	}
+	for _, tt := range tests {
+		if _, err := parseRunState([]byte(tt.data)); err == nil {
+			t.Errorf("%s: parseRunState succeeded", tt.name)
+		}
+	}
+}
+
+func TestResumedRunOptions(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath = "job-1", "vpc-1", "./solver"
+	o.jobSeed, o.bucket, o.extraEnv, o.numInstances = 42, "staging", []string{"A=1"}, 2
+	s := o.newRunState()
+	s.Run = o.newRunDescriptor(testInstances(), "", "")
+
+	resumed, err := resumedRunOptions(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.jobID != "job-1" || !resumed.seedSet || resumed.jobSeed != 42 || resumed.bucket != "staging" {
+		t.Errorf("options = %+v", resumed)
+	}
+	if resumed.numInstances != 2 || !reflect.DeepEqual(resumed.hostSelection, []string{"i-0", "i-1"}) {
+		t.Errorf("hosts = %d %v", resumed.numInstances, resumed.hostSelection)
+	}
+	if !reflect.DeepEqual(resumed.extraEnv, []string{"A=1"}) {
+		t.Errorf("env = %v", resumed.extraEnv)
+	}
+}
+
+func TestRunPipelineStopAfter(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath, o.stopAfter = "job-1", "vpc-1", "./solver", phaseSetup
+	s := o.newRunState()
+
+	var ran []string
+	if err := o.runPipeline(context.Background(), s, fakePhases(&ran, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []string{phaseDiscover, phaseSetup}) {
+		t.Errorf("ran %v", ran)
+	}
+	saved, err := loadRunState("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Completed, []string{phaseDiscover, phaseSetup}) {
+		t.Errorf("saved %v", saved.Completed)
+	}
+}
+
+func TestValidateStopAfter(t *testing.T) {
+	tests := []struct {
+		launcher  string
+		stopAfter string
+		wantErr   bool
+	}{
+		{launcherNative, "", false},
+		{launcherNative, phaseDistribute, false},
+		{launcherOpenMPI, phaseExecute, false},
+		{launcherOpenMPI, phaseDistribute, true},
+		{launcherNative, "deploy", true},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.launcher, o.stopAfter = tt.launcher, tt.stopAfter
+		if err := o.validateStopAfter(); (err != nil) != tt.wantErr {
+			t.Errorf("%s %q: error = %v, wantErr %v", tt.launcher, tt.stopAfter, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// cmd/portforward.go
+// This file opens SSM Session Manager port-forwarding sessions from a local port to a
+// port on an instance, so local tools can reach rank services without any inbound
+// security group rule. The session is started through the SSM API with awsmpirun's own
+// credentials and carried by the session-manager-plugin, the same way the AWS CLI's
+// "aws ssm start-session" does; the plugin must be installed and on the PATH.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const (
+	portForwardDocument = "AWS-StartPortForwardingSession"
+	portForwardReady    = 30 * time.Second // How long the plugin gets to open the local port
+)
+
+// portForward is an open port-forwarding session
+type portForward struct {
+	InstanceID string
+	RemotePort int
+	LocalPort  int
+
+	ssmClient *ssm.Client
+	sessionID string
+	plugin    *exec.Cmd
+	exited    chan error // Receives the plugin's exit status
+}
+
+// startPortForward forwards 127.0.0.1:localPort to remotePort on the instance and returns
+// once the local port accepts connections. A localPort of 0 picks a free port.
+func startPortForward(ctx context.Context, ssmClient *ssm.Client, instanceID string, remotePort, localPort int) (*portForward, error) {
+	pluginPath, err := exec.LookPath("session-manager-plugin")
+	if err != nil {
+		return nil, fmt.Errorf("session-manager-plugin not found; install the Session Manager plugin for the AWS CLI")
+	}
+	if localPort == 0 {
+		localPort, err = freeLocalPort()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	input := &ssm.StartSessionInput{
+		Target:       aws.String(instanceID),
+		DocumentName: aws.String(portForwardDocument),
+		Parameters: map[string][]string{
+			"portNumber":      {strconv.Itoa(remotePort)},
+			"localPortNumber": {strconv.Itoa(localPort)},
+		},
+	}
+	session, err := ssmClient.StartSession(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start session on %s: %v", instanceID, err)
+	}
+
+	region := ssmClient.Options().Region
+	args, err := pluginArgs(input, session, region)
+	if err != nil {
+		return nil, err
+	}
+	f := &portForward{
+		InstanceID: instanceID,
+		RemotePort: remotePort,
+		LocalPort:  localPort,
+		ssmClient:  ssmClient,
+		sessionID:  aws.ToString(session.SessionId),
+		plugin:     exec.Command(pluginPath, args...),
+		exited:     make(chan error, 1),
+	}
+	f.plugin.Stderr = os.Stderr
+	if err := f.plugin.Start(); err != nil {
+		f.terminate()
+		return nil, fmt.Errorf("failed to run session-manager-plugin: %v", err)
+	}
+	go func() { f.exited <- f.plugin.Wait() }()
+
+	if err := f.waitReady(ctx, portForwardReady); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// pluginArgs returns the command line session-manager-plugin expects: the StartSession
+// response and request as JSON around the region and operation name
+func pluginArgs(input *ssm.StartSessionInput, session *ssm.StartSessionOutput, region string) ([]string, error) {
+	response, err := json.Marshal(map[string]string{
+		"SessionId":  aws.ToString(session.SessionId),
+		"StreamUrl":  aws.ToString(session.StreamUrl),
+		"TokenValue": aws.ToString(session.TokenValue),
+	})
+	if err != nil {
+		return nil, err
+	}
+	request, err := json.Marshal(map[string]any{
+		"Target":       aws.ToString(input.Target),
+		"DocumentName": aws.ToString(input.DocumentName),
+		"Parameters":   input.Parameters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("https://ssm.%s.amazonaws.com", region)
+	return []string{string(response), region, "StartSession", "", string(request), endpoint}, nil
+}
+
+// waitReady polls the local port until the plugin listens on it, or ctx is done
+func (f *portForward) waitReady(ctx context.Context, timeout time.Duration) error {
+	address := f.LocalAddress()
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case err := <-f.exited:
+			f.exited <- err
+			return fmt.Errorf("session-manager-plugin exited before the tunnel was ready: %v", err)
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel to %s:%d not ready after %v", f.InstanceID, f.RemotePort, timeout)
+		}
+		if err := awsManager.SleepContext(ctx, 200*time.Millisecond); err != nil {
+			return fmt.Errorf("stopped waiting for the tunnel to %s:%d: %w", f.InstanceID, f.RemotePort, err)
+		}
+	}
+}
+
+// LocalAddress is the address local tools connect to
+func (f *portForward) LocalAddress() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(f.LocalPort))
+}
+
+// Wait blocks until the plugin exits, for example when the session times out
+func (f *portForward) Wait() error {
+	err := <-f.exited
+	f.exited <- err
+	return err
+}
+
+// Close stops the plugin and ends the session
+func (f *portForward) Close() {
+	if f.plugin.Process != nil {
+		f.plugin.Process.Kill()
+	}
+	f.terminate()
+}
+
+// terminate ends the session; it runs on a context of its own, since a tunnel is closed
+// when its command is interrupted too
+func (f *portForward) terminate() {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	f.ssmClient.TerminateSession(ctx, &ssm.TerminateSessionInput{SessionId: aws.String(f.sessionID)})
+}
+
+// freeLocalPort returns a localhost port nothing listens on
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free local port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,187 @@
+// cmd/profile.go
+// This file implements the profile command, which downloads a runtime profile from one
+// rank of a job started with --pprof-port. The rank serves its profiles on localhost
+// only (see mpi/pprof.go); the command reaches them through an SSM port-forwarding
+// session and saves the profile for go tool pprof, or go tool trace for traces.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+)
+
+// profileOptions are the flags of the profile command
+type profileOptions struct {
+	project  string
+	jobID    string
+	bucket   string
+	instance string
+	rank     int
+	kind     string
+	duration time.Duration
+	port     int
+	output   string
+}
+
+// newProfileCmd returns the profile command
+func newProfileCmd() *cobra.Command {
+	o := &profileOptions{}
+	cmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Download a CPU, heap, or other runtime profile from a rank",
+		Long: `profile fetches a profile from a rank of a job started with --pprof-port, through an
+SSM port-forwarding session, and saves it locally:
+
+  awsmpirun profile --job job-20240101-120000-abcdef --bucket my-staging --rank 2 --type cpu --duration 30s
+  go tool pprof job-20240101-120000-abcdef-rank2-cpu.pprof
+
+The rank is found through the job manifest, so the job must have been started with
+--bucket; otherwise pass --instance. Block and mutex profiles are empty unless the
+program enables them with runtime.SetBlockProfileRate and runtime.SetMutexProfileFraction.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runProfile(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the job belongs to (default: project in config.yaml)")
+	cmd.Flags().StringVar(&o.jobID, "job", "", "ID of the running job")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Staging bucket the job was started with")
+	cmd.Flags().StringVar(&o.instance, "instance", "", "Instance to profile, instead of looking up --rank in the job manifest")
+	cmd.Flags().IntVar(&o.rank, "rank", 0, "Rank to profile")
+	cmd.Flags().StringVar(&o.kind, "type", "cpu", "Profile to take: cpu, heap, allocs, goroutine, block, mutex, threadcreate, or trace")
+	cmd.Flags().DurationVar(&o.duration, "duration", 30*time.Second, "How long to sample cpu profiles and traces")
+	cmd.Flags().IntVar(&o.port, "port", defaultPprofPort, "Port the rank serves profiles on (its --pprof-port)")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "File to save the profile to (default: <job>-rank<N>-<type>.pprof)")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newProfileCmd())
+}
+
+func runProfile(ctx context.Context, o *profileOptions) {
+	path, err := profilePath(o.kind, o.duration)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	instanceID, err := resolveRankTarget(ctx, o.instance, o.project, o.bucket, o.jobID, o.rank)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	output := o.output
+	if output == "" {
+		output = profileFileName(o.jobID, instanceID, o.rank, o.kind)
+	}
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	tunnel, err := startPortForward(ctx, ssmClient, instanceID, o.port, 0)
+	if err != nil {
+		fmt.Printf("Error opening tunnel: %v\n", err)
+		os.Exit(1)
+	}
+	defer tunnel.Close()
+
+	if o.kind == "cpu" || o.kind == "trace" {
+		fmt.Printf("Sampling %s on %s for %v...\n", o.kind, instanceID, o.duration)
+	}
+	client := &http.Client{Timeout: o.duration + time.Minute}
+	resp, err := client.Get("http://" + tunnel.LocalAddress() + path)
+	if err != nil {
+		tunnel.Close()
+		fmt.Printf("Error fetching profile: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		tunnel.Close()
+		fmt.Printf("Error fetching profile: %s: %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	file, err := os.Create(output)
+	if err == nil {
+		_, err = io.Copy(file, resp.Body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		tunnel.Close()
+		fmt.Printf("Error saving profile: %v\n", err)
+		os.Exit(1)
+	}
+	if o.kind == "trace" {
+		fmt.Printf("Saved trace to %s; open it with: go tool trace %s\n", output, output)
+	} else {
+		fmt.Printf("Saved %s profile to %s; open it with: go tool pprof %s\n", o.kind, output, output)
+	}
+}
+
+// profilePath returns the pprof endpoint for a profile type
+func profilePath(kind string, duration time.Duration) (string, error) {
+	switch kind {
+	case "cpu", "trace":
+		seconds := int(duration.Round(time.Second).Seconds())
+		if seconds <= 0 {
+			return "", fmt.Errorf("--duration must be at least one second for %s", kind)
+		}
+		endpoint := "profile"
+		if kind == "trace" {
+			endpoint = "trace"
+		}
+		return fmt.Sprintf("/debug/pprof/%s?seconds=%d", endpoint, seconds), nil
+	case "heap", "allocs", "goroutine", "block", "mutex", "threadcreate":
+		return "/debug/pprof/" + kind, nil
+	}
+	return "", fmt.Errorf("unknown profile type %q", kind)
+}
+
+// profileFileName is the default file a profile is saved to
+func profileFileName(jobID, instanceID string, rank int, kind string) string {
+	extension := ".pprof"
+	if kind == "trace" {
+		extension = ".trace"
+	}
+	if jobID == "" {
+		return fmt.Sprintf("%s-%s%s", instanceID, kind, extension)
+	}
+	return fmt.Sprintf("%s-rank%d-%s%s", jobID, rank, kind, extension)
+}
+
+// resolveRankTarget returns the instance to connect to: instanceID when given, otherwise
+// the instance running rank according to the job manifest
+func resolveRankTarget(ctx context.Context, instanceID, project, bucket, jobID string, rank int) (string, error) {
+	if instanceID != "" {
+		return instanceID, nil
+	}
+	if bucket == "" || jobID == "" {
+		return "", fmt.Errorf("pass --instance, or --job and --bucket to look up the rank")
+	}
+	if err := validateJobID(jobID); err != nil {
+		return "", err
+	}
+	if err := validateBucketName(bucket); err != nil {
+		return "", err
+	}
+	project, err := resolveProject(project)
+	if err != nil {
+		return "", err
+	}
+	return lookupRankInstance(ctx, bucket, project, jobID, rank)
+}
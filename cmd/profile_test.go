@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestProfilePath(t *testing.T) {
+	tests := []struct {
+		kind     string
+		duration time.Duration
+		want     string
+		wantErr  bool
+	}{
+		{kind: "cpu", duration: 30 * time.Second, want: "/debug/pprof/profile?seconds=30"},
+		{kind: "cpu", duration: 1500 * time.Millisecond, want: "/debug/pprof/profile?seconds=2"},
+		{kind: "trace", duration: 5 * time.Second, want: "/debug/pprof/trace?seconds=5"},
+		{kind: "heap", want: "/debug/pprof/heap"},
+		{kind: "goroutine", duration: time.Minute, want: "/debug/pprof/goroutine"},
+		{kind: "mutex", want: "/debug/pprof/mutex"},
+		{kind: "cpu", duration: 100 * time.Millisecond, wantErr: true},
+		{kind: "wall", wantErr: true},
+		{kind: "../cmdline", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := profilePath(tt.kind, tt.duration)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("profilePath(%q, %v) error = %v, wantErr %v", tt.kind, tt.duration, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("profilePath(%q, %v) = %q, want %q", tt.kind, tt.duration, got, tt.want)
+		}
+	}
+}
+
+func TestProfileFileName(t *testing.T) {
+	tests := []struct {
+		jobID, instanceID string
+		rank              int
+		kind              string
+		want              string
+	}{
+		{jobID: "job-1", instanceID: "i-1", rank: 2, kind: "cpu", want: "job-1-rank2-cpu.pprof"},
+		{jobID: "job-1", instanceID: "i-1", rank: 0, kind: "trace", want: "job-1-rank0-trace.trace"},
+		{instanceID: "i-0abc", kind: "heap", want: "i-0abc-heap.pprof"},
+	}
+
+	for _, tt := range tests {
+		if got := profileFileName(tt.jobID, tt.instanceID, tt.rank, tt.kind); got != tt.want {
+			t.Errorf("profileFileName(%q, %q, %d, %q) = %q, want %q", tt.jobID, tt.instanceID, tt.rank, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRankTargetNeedsAJob(t *testing.T) {
+	tests := []struct {
+		instanceID, bucket, jobID string
+		want                      string
+		wantErr                   bool
+	}{
+		{instanceID: "i-1", want: "i-1"},
+		{instanceID: "i-1", bucket: "staging", jobID: "job-1", want: "i-1"},
+		{bucket: "staging", wantErr: true},
+		{jobID: "job-1", wantErr: true},
+		{bucket: "staging", jobID: "../other", wantErr: true},
+		{bucket: "Bad_Bucket", jobID: "job-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveRankTarget(context.Background(), tt.instanceID, "team-a", tt.bucket, tt.jobID, 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveRankTarget(%q, %q, %q) error = %v, wantErr %v", tt.instanceID, tt.bucket, tt.jobID, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveRankTarget(%q, %q, %q) = %q, want %q", tt.instanceID, tt.bucket, tt.jobID, got, tt.want)
+		}
+	}
+}
+
+func TestPluginArgs(t *testing.T) {
+	input := &ssm.StartSessionInput{
+		Target:       aws.String("i-0abc"),
+		DocumentName: aws.String(portForwardDocument),
+		Parameters:   map[string][]string{"portNumber": {"6060"}, "localPortNumber": {"51000"}},
+	}
+	session := &ssm.StartSessionOutput{
+		SessionId:  aws.String("user-0123"),
+		StreamUrl:  aws.String("wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/user-0123"),
+		TokenValue: aws.String("token"),
+	}
+
+	args, err := pluginArgs(input, session, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 6 || args[1] != "us-east-1" || args[2] != "StartSession" || args[3] != "" || args[5] != "https://ssm.us-east-1.amazonaws.com" {
+		t.Fatalf("args = %q", args)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal([]byte(args[0]), &response); err != nil {
+		t.Fatal(err)
+	}
+	wantResponse := map[string]string{"SessionId": "user-0123", "StreamUrl": aws.ToString(session.StreamUrl), "TokenValue": "token"}
+	if !reflect.DeepEqual(response, wantResponse) {
+		t.Errorf("response = %v, want %v", response, wantResponse)
+	}
+
+	var request struct {
+		Target       string
+		DocumentName string
+		Parameters   map[string][]string
+	}
+	if err := json.Unmarshal([]byte(args[4]), &request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Target != "i-0abc" || request.DocumentName != portForwardDocument || !reflect.DeepEqual(request.Parameters, input.Parameters) {
+		t.Errorf("request = %+v", request)
+	}
+}
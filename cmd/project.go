@@ -0,0 +1,105 @@
+// cmd/project.go
+// This file implements projects, which keep teams sharing an AWS account out of each
+// other's clusters. Every command that finds, launches, or changes instances or staged
+// objects needs a project, from --project or the "project:" default in config.yaml in
+// the configuration directory. Instances belong to the project whose name their
+// awsmpirun:project tag carries and discovery only returns those; staged objects live
+// under projects/<project>/ in the bucket (see mpi.JobPrefix), and the policies of
+// awsmpirun iam print-policy --project are scoped to both.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"gopkg.in/yaml.v2"
+)
+
+// projectTagKey is the instance tag naming the project an instance belongs to
+const projectTagKey = "awsmpirun:project"
+
+// Project names are used in tag values, S3 keys, and resource names, so they are kept
+// to lower case letters, digits, and dashes
+var projectPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// userConfig holds the defaults read from config.yaml
+type userConfig struct {
+	Project          string             `yaml:"project"`
+	SSMRateLimits    []ssmRateLimitRule `yaml:"ssm_rate_limits,omitempty"`   // See ratelimit.go
+	CompliancePolicy string             `yaml:"compliance_policy,omitempty"` // See compliance.go
+	AWSProfile       string             `yaml:"aws_profile,omitempty"`       // See login.go
+}
+
+// userConfigPath returns where config.yaml is read from
+func userConfigPath() (string, error) {
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// loadUserConfig reads config.yaml; a missing file leaves every default unset
+func loadUserConfig(path string) (userConfig, error) {
+	var config userConfig
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// saveUserConfig writes config to path, creating the configuration directory
+func saveUserConfig(path string, config userConfig) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// resolveProject returns the project given with --project, or else the default from
+// config.yaml, and fails when there is neither
+func resolveProject(flagValue string) (string, error) {
+	project := flagValue
+	if project == "" {
+		path, err := userConfigPath()
+		if err != nil {
+			return "", err
+		}
+		config, err := loadUserConfig(path)
+		if err != nil {
+			return "", err
+		}
+		project = config.Project
+		if project == "" {
+			return "", fmt.Errorf("--project is required; pass it or set \"project: <name>\" in %s", path)
+		}
+	}
+	if err := validateProjectName(project); err != nil {
+		return "", err
+	}
+	return project, nil
+}
+
+// validateProjectName rejects project names that cannot be a tag value and S3 key part
+func validateProjectName(name string) error {
+	if !projectPattern.MatchString(name) {
+		return fmt.Errorf("invalid project %q: use up to 32 lower case letters, digits, and '-'", name)
+	}
+	return nil
+}
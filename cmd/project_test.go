@@ -0,0 +1,55 @@
+// cmd/project_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveProject(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string // Content of config.yaml; empty leaves it out
+		flag    string
+		want    string
+		wantErr string
+	}{
+		{name: "flag", flag: "team-a", want: "team-a"},
+		{name: "flag over config", config: "project: team-b\n", flag: "team-a", want: "team-a"},
+		{name: "config default", config: "project: team-b\n", want: "team-b"},
+		{name: "neither", wantErr: "--project is required"},
+		{name: "config without project", config: "{}\n", wantErr: "--project is required"},
+		{name: "unknown config key", config: "projekt: team-b\n", wantErr: "invalid"},
+		{name: "upper case", flag: "Team-A", wantErr: "invalid project"},
+		{name: "slash", flag: "team/a", wantErr: "invalid project"},
+		{name: "too long", flag: strings.Repeat("a", 33), wantErr: "invalid project"},
+	}
+
+	for _, tt := range tests {
+		home := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", home)
+		if tt.config != "" {
+			dir := filepath.Join(home, "awsmpirun")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := resolveProject(tt.flag)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: resolveProject = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
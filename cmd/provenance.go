@@ -0,0 +1,151 @@
+// cmd/provenance.go
+// This file implements the provenance command, which traces an output object in S3
+// back to the run that produced it. Objects uploaded by ranks, with mpi.SaveResult,
+// mpi.SaveCheckpoint, or a crash report, carry metadata naming their job, rank, and
+// program sha256 (see mpi.Provenance); the command reads it and the job's run manifest
+// to show the code version, command, options, and instance behind the object.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/spf13/cobra"
+)
+
+var provenanceCmd = &cobra.Command{
+	Use:   "provenance s3://BUCKET/KEY",
+	Short: "Show which run produced an object in S3",
+	Long: `provenance reads the awsmpirun metadata of an S3 object written by a rank and
+the run manifest (job.yaml) of its job, and prints the job, rank, program sha256,
+command, options, and instance that produced it. The manifest is read from the job's
+staging bucket, or from the local configuration directory when the job ran without
+--bucket on this machine.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProvenance(cmd.Context(), args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(provenanceCmd)
+}
+
+func runProvenance(ctx context.Context, uri string) {
+	objectBucket, key, err := parseS3URI(uri)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, objectBucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	metadata, err := s3Client.ObjectMetadata(ctx, key)
+	if err != nil {
+		fmt.Printf("Error reading object metadata: %v\n", err)
+		os.Exit(1)
+	}
+	if metadata[mpi.MetaJobID] == "" {
+		fmt.Printf("Error: %s has no awsmpirun provenance metadata\n", uri)
+		os.Exit(1)
+	}
+
+	d, err := findRunDescriptor(ctx, metadata)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	fmt.Print(renderProvenance(uri, metadata, d))
+}
+
+// findRunDescriptor loads the run manifest an object's metadata points to, falling
+// back to the copy in the local configuration directory
+func findRunDescriptor(ctx context.Context, metadata map[string]string) (*runDescriptor, error) {
+	jobID := metadata[mpi.MetaJobID]
+	if err := validateJobID(jobID); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var remoteErr error
+	if location := metadata[mpi.MetaManifest]; location != "" {
+		manifestBucket, key, err := parseS3URI(location)
+		if err == nil {
+			var s3Client *awsManager.S3Client
+			s3Client, err = awsManager.NewS3Client(ctx, manifestBucket)
+			if err == nil {
+				data, err = s3Client.DownloadBytes(ctx, key)
+			}
+		}
+		remoteErr = err
+	}
+	if data == nil {
+		dir, err := platform.Current().ConfigDir()
+		if err == nil {
+			data, err = os.ReadFile(filepath.Join(dir, "jobs", jobID, "job.yaml"))
+		}
+		if err != nil {
+			if remoteErr != nil {
+				return nil, fmt.Errorf("no run manifest found for job %s: %v", jobID, remoteErr)
+			}
+			return nil, fmt.Errorf("no run manifest found for job %s: %v", jobID, err)
+		}
+	}
+	return parseRunDescriptor(data)
+}
+
+// renderProvenance describes the run that produced an object; d may be nil when the
+// run manifest could not be found
+func renderProvenance(uri string, metadata map[string]string, d *runDescriptor) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Object:   %s\n", uri)
+	fmt.Fprintf(&b, "Job:      %s\n", metadata[mpi.MetaJobID])
+	rank, rankErr := strconv.Atoi(metadata[mpi.MetaRank])
+	if rankErr == nil {
+		fmt.Fprintf(&b, "Rank:     %d\n", rank)
+	}
+	hash := metadata[mpi.MetaProgramSHA256]
+	if hash != "" {
+		fmt.Fprintf(&b, "Program:  sha256 %s\n", hash)
+	}
+	if d == nil {
+		return b.String()
+	}
+	if d.JobID != metadata[mpi.MetaJobID] {
+		fmt.Fprintf(&b, "Warning:  the run manifest belongs to job %s\n", d.JobID)
+	}
+	if hash != "" && d.Program.SHA256 != "" && hash != d.Program.SHA256 {
+		fmt.Fprintf(&b, "Warning:  the run manifest records program sha256 %s\n", d.Program.SHA256)
+	}
+
+	fmt.Fprintf(&b, "Started:  %s\n", d.Created)
+	fmt.Fprintf(&b, "Command:  %s\n", d.Program.Command)
+	fmt.Fprintf(&b, "Tool:     awsmpirun %s, %s\n", describeTool(d.Tool), d.Tool.GoVersion)
+	fmt.Fprintf(&b, "Seed:     %d\n", d.Options.Seed)
+	for _, entry := range d.Options.Env {
+		fmt.Fprintf(&b, "Env:      %s\n", entry)
+	}
+	if rankErr == nil && rank >= 0 && rank < len(d.Cluster.Instances) {
+		instance := d.Cluster.Instances[rank]
+		fmt.Fprintf(&b, "Instance: %s (%s, %s) in %s, %s\n", instance.InstanceID, instance.InstanceType, instance.ImageID, d.Cluster.VPC, d.Region)
+	}
+	fmt.Fprintf(&b, "Reproduce with: awsmpirun --from-manifest job.yaml (from %s)\n", provenanceManifestSource(metadata, d.JobID))
+	return b.String()
+}
+
+func provenanceManifestSource(metadata map[string]string, jobID string) string {
+	if location := metadata[mpi.MetaManifest]; location != "" {
+		return location
+	}
+	return filepath.Join("<config dir>", "jobs", jobID, "job.yaml")
+}
@@ -0,0 +1,72 @@
+// cmd/provenance_test.go
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestRenderProvenance(t *testing.T) {
+	d := &runDescriptor{
+		JobID:   "job-1",
+		Created: "2026-01-02T03:04:05Z",
+		Tool:    toolInfo{Version: "v1.2.0", GoVersion: "go1.23.2"},
+		Region:  "us-east-2",
+		Cluster: clusterSpec{VPC: "vpc-1", Instances: []instanceRecord{
+			{Rank: 0, InstanceID: "i-0", InstanceType: "c7g.large", ImageID: "ami-1"},
+			{Rank: 1, InstanceID: "i-1", InstanceType: "c7g.large", ImageID: "ami-1"},
+		}},
+		Program: programSpec{Command: "./solver", SHA256: "abc"},
+		Options: runOptionsSpec{Seed: 42, Env: []string{"OMP_NUM_THREADS=4"}},
+	}
+	metadata := map[string]string{
+		mpi.MetaJobID:         "job-1",
+		mpi.MetaRank:          "1",
+		mpi.MetaProgramSHA256: "abc",
+		mpi.MetaManifest:      "s3://staging/jobs/job-1/job.yaml",
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		d        *runDescriptor
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:     "manifest found",
+			metadata: metadata,
+			d:        d,
+			want:     []string{"Rank:     1", "sha256 abc", "Command:  ./solver", "Seed:     42", "Env:      OMP_NUM_THREADS=4", "i-1 (c7g.large, ami-1) in vpc-1, us-east-2", "from s3://staging/jobs/job-1/job.yaml"},
+			notWant:  []string{"Warning"},
+		},
+		{
+			name:     "no manifest",
+			metadata: metadata,
+			want:     []string{"Job:      job-1", "Rank:     1"},
+			notWant:  []string{"Command:"},
+		},
+		{
+			name:     "program changed",
+			metadata: map[string]string{mpi.MetaJobID: "job-1", mpi.MetaRank: "0", mpi.MetaProgramSHA256: "def"},
+			d:        d,
+			want:     []string{"records program sha256 abc", "i-0 (c7g.large"},
+		},
+	}
+	for _, test := range tests {
+		got := renderProvenance("s3://results/out.dat", test.metadata, test.d)
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: output does not contain %q:\n%s", test.name, want, got)
+			}
+		}
+		for _, notWant := range test.notWant {
+			if strings.Contains(got, notWant) {
+				t.Errorf("%s: output contains %q:\n%s", test.name, notWant, got)
+			}
+		}
+	}
+}
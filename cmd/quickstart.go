@@ -0,0 +1,983 @@
+// cmd/quickstart.go
+// This file implements quickstart, the guided first run for new users. It asks a
+// handful of questions (region, VPC or a new one, instance type, and number of
+// instances), launches a small cluster of Amazon Linux instances, runs the built-in
+// ring example on it, shows rank 0's output, and prints the command that deletes the
+// cluster again. Every resource quickstart creates is tagged awsmpirun:quickstart=<id>
+// and recorded in quickstart/<id>.json in the configuration directory as soon as it
+// exists, so quickstart teardown can delete it even after a failed or interrupted run.
+
+package cmd
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/spf13/cobra"
+)
+
+// quickstartTagKey tags every resource quickstart creates with the quickstart's ID
+const quickstartTagKey = "awsmpirun:quickstart"
+
+const (
+	quickstartNewVPC           = "new" // --vpc value that creates a VPC
+	quickstartVPCCIDR          = "10.0.0.0/16"
+	quickstartSubnetCIDR       = "10.0.0.0/24"
+	quickstartExample          = "ring"
+	quickstartMaxInstances     = 16
+	quickstartRunningTimeout   = 5 * time.Minute
+	quickstartSSMOnlineTimeout = 10 * time.Minute
+	quickstartTerminateTimeout = 10 * time.Minute
+)
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// quickstartOptions are the flags of quickstart
+type quickstartOptions struct {
+	region       string
+	vpc          string
+	subnet       string
+	instanceType string
+	instances    int
+	profile      string
+	bucket       string
+	project      string
+	binary       string
+}
+
+// newQuickstartCmd returns quickstart, with its teardown command
+func newQuickstartCmd() *cobra.Command {
+	o := &quickstartOptions{}
+	cmd := &cobra.Command{
+		Use:   "quickstart",
+		Short: "Launch a small cluster and run a first MPI job on it, step by step",
+		Long: `quickstart is the guided way to a first job. It asks for the region, the VPC to
+use or whether to create one, the instance type, and the number of instances, then
+launches that many Amazon Linux 2023 instances, runs the built-in ring example on them,
+and prints rank 0's output. Press Enter to take the default shown in brackets; each
+question has a flag that answers it, and without a terminal the unanswered questions
+take their defaults.
+
+The instances need an instance profile whose role allows the SSM agent and reading the
+staging bucket; "awsmpirun iam print-policy --for quickstart" prints the policy of the
+role and the one quickstart itself needs. Unless --bucket names an existing bucket,
+quickstart creates one for the job.
+
+The cluster keeps running, and is billed, until "awsmpirun quickstart teardown"
+deletes the instances and whatever else quickstart created for them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runQuickstart(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.region, "region", "", "Region to launch the cluster in (default: ask)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID to launch into, or \"new\" to create a VPC (default: ask)")
+	cmd.Flags().StringVar(&o.subnet, "subnet", "", "Subnet of --vpc to launch into (default: ask)")
+	cmd.Flags().StringVar(&o.instanceType, "instance-type", "", "Instance type (default: ask)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 0, "Number of instances (default: ask)")
+	cmd.Flags().StringVar(&o.profile, "instance-profile", "", "Instance profile of the instances (default: ask)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Existing S3 bucket to stage the job in (default: ask)")
+	cmd.Flags().StringVar(&o.project, "project", "quickstart", "Project to tag the instances with")
+	cmd.Flags().StringVar(&o.binary, "binary", "", "awsmpirun build to run on the instances (default: this binary, on Linux only)")
+	cmd.AddCommand(newQuickstartTeardownCmd())
+	return cmd
+}
+
+// quickstartTeardownOptions are the flags of quickstart teardown
+type quickstartTeardownOptions struct {
+	id string
+}
+
+// newQuickstartTeardownCmd returns quickstart teardown
+func newQuickstartTeardownCmd() *cobra.Command {
+	o := &quickstartTeardownOptions{}
+	cmd := &cobra.Command{
+		Use:   "teardown",
+		Short: "Delete the cluster and the resources a quickstart created",
+		Long: `teardown terminates the instances of a quickstart and deletes the security
+group, the VPC with its subnet and internet gateway, and the bucket, of those that
+quickstart created. --id picks the quickstart; it may be left out when only one is on
+record. A teardown that fails part way can be run again.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runQuickstartTeardown(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.id, "id", "", "ID of the quickstart to delete (default: the only one on record)")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newQuickstartCmd())
+}
+
+// quickstartState is what a quickstart created, and so what its teardown deletes
+type quickstartState struct {
+	ID                string   `json:"id"`
+	Region            string   `json:"region"`
+	Project           string   `json:"project"`
+	VPCID             string   `json:"vpc_id,omitempty"` // Set only when quickstart created the VPC
+	SubnetID          string   `json:"subnet_id,omitempty"`
+	InternetGatewayID string   `json:"internet_gateway_id,omitempty"`
+	SecurityGroupID   string   `json:"security_group_id,omitempty"`
+	InstanceIDs       []string `json:"instance_ids,omitempty"`
+	Bucket            string   `json:"bucket,omitempty"` // Set only when quickstart created the bucket
+}
+
+// quickstartPlan is the answers to the questions of quickstart
+type quickstartPlan struct {
+	VPCID           string // quickstartNewVPC to create one
+	SubnetID        string // Of an existing VPC
+	Zone            string // Availability zone of a new VPC's subnet
+	InstanceType    string
+	Arch            string // GOARCH of the instance type
+	Count           int
+	InstanceProfile string
+	Bucket          string
+	CreateBucket    bool
+}
+
+// newQuickstartID returns a random ID for a quickstart, short enough for bucket names
+func newQuickstartID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return "qs-" + hex.EncodeToString(suffix)
+}
+
+// tags are the tags of every resource the quickstart creates
+func (s *quickstartState) tags() map[string]string {
+	return map[string]string{quickstartTagKey: s.ID, projectTagKey: s.Project, "Name": "awsmpirun-" + s.ID}
+}
+
+// tagSpec tags a resource of type resource when it is created
+func (s *quickstartState) tagSpec(resource ec2Types.ResourceType) []ec2Types.TagSpecification {
+	return []ec2Types.TagSpecification{{ResourceType: resource, Tags: ec2Tags(s.tags())}}
+}
+
+// quickstartDir is the directory the states of the quickstarts are kept in
+func quickstartDir() (string, error) {
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "quickstart"), nil
+}
+
+// save records the state, so teardown finds everything created so far
+func (s *quickstartState) save() error {
+	dir, err := quickstartDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, s.ID+".json"), data, 0o600); err != nil {
+		return fmt.Errorf("failed to record quickstart %s: %v", s.ID, err)
+	}
+	return nil
+}
+
+// loadQuickstartState reads the state of quickstart id, or of the only quickstart on
+// record when id is empty
+func loadQuickstartState(id string) (*quickstartState, error) {
+	dir, err := quickstartDir()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var ids []string
+		for _, entry := range entries {
+			if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+				ids = append(ids, name)
+			}
+		}
+		switch len(ids) {
+		case 0:
+			return nil, fmt.Errorf("no quickstart is on record")
+		case 1:
+			id = ids[0]
+		default:
+			return nil, fmt.Errorf("%d quickstarts are on record (%s); choose one with --id", len(ids), strings.Join(ids, ", "))
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("quickstart %s is not on record", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state quickstartState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("quickstart %s: %v", id, err)
+	}
+	return &state, nil
+}
+
+// removeQuickstartState forgets a quickstart that was torn down
+func removeQuickstartState(id string) error {
+	dir, err := quickstartDir()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// teardownCommand is the command that deletes the quickstart
+func (s *quickstartState) teardownCommand() string {
+	return "awsmpirun quickstart teardown --id " + s.ID
+}
+
+// wizard asks the questions of quickstart. A question answered by its flag is not
+// asked; without a terminal, unanswered questions take their defaults.
+type wizard struct {
+	in          *bufio.Reader
+	out         io.Writer
+	interactive bool
+}
+
+// ask returns the answer to question: answer, when its flag gave one, or else what the
+// operator types, def for an empty line. valid, if not nil, rejects an answer; a
+// rejected answer typed in is asked for again.
+func (w *wizard) ask(question, flag, answer, def string, valid func(string) error) (string, error) {
+	check := func(answer string) error {
+		if valid == nil {
+			return nil
+		}
+		return valid(answer)
+	}
+	if answer != "" {
+		if err := check(answer); err != nil {
+			return "", fmt.Errorf("%s: %v", flag, err)
+		}
+		return answer, nil
+	}
+	if !w.interactive {
+		if def == "" {
+			return "", fmt.Errorf("%s is required without a terminal", flag)
+		}
+		if err := check(def); err != nil {
+			return "", fmt.Errorf("%v; pass %s", err, flag)
+		}
+		return def, nil
+	}
+	for {
+		if def != "" {
+			fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(w.out, "%s: ", question)
+		}
+		line, err := w.in.ReadString('\n')
+		answer := cmp.Or(strings.TrimSpace(line), def)
+		if answer != "" {
+			checkErr := check(answer)
+			if checkErr == nil {
+				return answer, nil
+			}
+			fmt.Fprintf(w.out, "%v\n", checkErr)
+		} else if err == nil {
+			fmt.Fprintf(w.out, "An answer is required\n")
+		}
+		if err != nil {
+			return "", fmt.Errorf("no answer to %q; pass %s", question, flag)
+		}
+	}
+}
+
+// choose returns the index of the option the operator picks, def for an empty line
+func (w *wizard) choose(what string, options []string, def int) (int, error) {
+	if !w.interactive {
+		return def, nil
+	}
+	for i, option := range options {
+		fmt.Fprintf(w.out, "  %d) %s\n", i+1, option)
+	}
+	answer, err := w.ask("Which "+what+"?", "--"+what, "", strconv.Itoa(def+1), func(answer string) error {
+		if n, err := strconv.Atoi(answer); err != nil || n < 1 || n > len(options) {
+			return fmt.Errorf("Enter a number from 1 to %d", len(options))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.Atoi(answer)
+	return n - 1, nil
+}
+
+// validateRegion rejects what cannot be a region name
+func validateRegion(region string) error {
+	if !regionPattern.MatchString(region) {
+		return fmt.Errorf("invalid region %q", region)
+	}
+	return nil
+}
+
+// validateQuickstartInstances rejects instance counts outside what a quickstart
+// launches: a ring needs two ranks, and a first cluster should stay small
+func validateQuickstartInstances(answer string) error {
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 2 || n > quickstartMaxInstances {
+		return fmt.Errorf("the number of instances must be from 2 to %d", quickstartMaxInstances)
+	}
+	return nil
+}
+
+// defaultQuickstartType is the instance type offered first: a small burstable type of
+// the architecture the binary to stage is built for
+func defaultQuickstartType(goarch string) string {
+	if goarch == "arm64" {
+		return "t4g.micro"
+	}
+	return "t3.micro"
+}
+
+// instanceArch returns the GOARCH of the architectures an instance type supports
+func instanceArch(architectures []ec2Types.ArchitectureType) (string, error) {
+	switch {
+	case slices.Contains(architectures, ec2Types.ArchitectureTypeArm64):
+		return "arm64", nil
+	case slices.Contains(architectures, ec2Types.ArchitectureTypeX8664):
+		return "amd64", nil
+	}
+	return "", fmt.Errorf("architectures %v are not supported", architectures)
+}
+
+// quickstartImageParameter is the public SSM parameter holding the latest Amazon Linux
+// 2023 image for goarch; the image has the SSM agent and the AWS CLI installed
+func quickstartImageParameter(goarch string) string {
+	arch := "x86_64"
+	if goarch == "arm64" {
+		arch = "arm64"
+	}
+	return "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-" + arch
+}
+
+// vpcLabel describes a VPC in the list to choose from
+func vpcLabel(vpc ec2Types.Vpc) string {
+	label := aws.ToString(vpc.VpcId) + " (" + aws.ToString(vpc.CidrBlock)
+	for _, tag := range vpc.Tags {
+		if aws.ToString(tag.Key) == "Name" && aws.ToString(tag.Value) != "" {
+			label += ", " + aws.ToString(tag.Value)
+		}
+	}
+	if aws.ToBool(vpc.IsDefault) {
+		label += ", default"
+	}
+	return label + ")"
+}
+
+// subnetLabel describes a subnet in the list to choose from
+func subnetLabel(subnet ec2Types.Subnet) string {
+	label := fmt.Sprintf("%s (%s, %s", aws.ToString(subnet.SubnetId), aws.ToString(subnet.AvailabilityZone), aws.ToString(subnet.CidrBlock))
+	if !aws.ToBool(subnet.MapPublicIpOnLaunch) {
+		label += ", no public IPs: SSM needs a NAT gateway or VPC endpoints"
+	}
+	return label + ")"
+}
+
+// quickstartSubnets returns the subnets of the VPC in zones, the public ones first
+func quickstartSubnets(subnets []ec2Types.Subnet, zones []string) []ec2Types.Subnet {
+	var usable []ec2Types.Subnet
+	for _, subnet := range subnets {
+		if slices.Contains(zones, aws.ToString(subnet.AvailabilityZone)) {
+			usable = append(usable, subnet)
+		}
+	}
+	slices.SortStableFunc(usable, func(a, b ec2Types.Subnet) int {
+		if aws.ToBool(a.MapPublicIpOnLaunch) == aws.ToBool(b.MapPublicIpOnLaunch) {
+			return 0
+		}
+		if aws.ToBool(a.MapPublicIpOnLaunch) {
+			return -1
+		}
+		return 1
+	})
+	return usable
+}
+
+func runQuickstart(ctx context.Context, q *quickstartOptions) {
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout, interactive: stdinIsTerminal()}
+	if err := validateProjectName(q.project); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	binary, err := exampleBinary(q.binary, runtime.GOOS)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	state := &quickstartState{ID: newQuickstartID(), Project: q.project}
+
+	fmt.Println("This launches a small cluster, runs an MPI job on it, and shows what the job printed.")
+	state.Region, err = w.ask("Region", "--region", q.region, cmp.Or(os.Getenv("AWS_REGION"), "us-west-2"), validateRegion)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("AWS_REGION", state.Region)
+
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+
+	plan, err := askQuickstartPlan(ctx, w, ec2Client, state, q)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if w.interactive {
+		where := "a new VPC"
+		if plan.VPCID != quickstartNewVPC {
+			where = plan.SubnetID + " of " + plan.VPCID
+		}
+		fmt.Printf("\nquickstart will launch %d %s instances in %s, tagged %s=%s.\n", plan.Count, plan.InstanceType, where, quickstartTagKey, state.ID)
+		answer, err := w.ask("Launch them? (yes/no)", "", "", "yes", func(answer string) error {
+			if !slices.Contains([]string{"y", "yes", "n", "no"}, strings.ToLower(answer)) {
+				return fmt.Errorf("Answer yes or no")
+			}
+			return nil
+		})
+		if err != nil || strings.HasPrefix(strings.ToLower(answer), "n") {
+			fmt.Println("Nothing was launched.")
+			return
+		}
+	}
+
+	// Record the quickstart before creating anything, so teardown can find it
+	if err := state.save(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	go handleQuickstartInterrupt(state)
+
+	fmt.Printf("Quickstart ID: %s\n", state.ID)
+	instances, err := state.provision(ctx, ec2Client, ssmClient, plan)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Printf("Delete what was created with:\n    %s\n", state.teardownCommand())
+		os.Exit(1)
+	}
+
+	o := newRunOptions()
+	o.project = state.Project
+	if o.jobID, err = newJobID(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Printf("The cluster is still running. Delete it with:\n    %s\n", state.teardownCommand())
+		os.Exit(1)
+	}
+	o.bucket = plan.Bucket
+	assignRanks(instances)
+	fmt.Printf("Running the %s example as job %s...\n", quickstartExample, o.jobID)
+	if err := o.runExampleOn(ctx, ssmClient, binary, quickstartExample, 0, instances); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Printf("The cluster is still running. Delete it with:\n    %s\n", state.teardownCommand())
+		os.Exit(1)
+	}
+
+	vpcID := cmp.Or(state.VPCID, plan.VPCID)
+	fmt.Printf("\nThe job ran on all %d instances. The cluster keeps running, and is billed, until it is deleted.\n", len(instances))
+	fmt.Printf("Run another example on it with:\n    awsmpirun examples run pi --project %s --vpc %s --bucket %s --num-instances %d\n",
+		state.Project, vpcID, plan.Bucket, len(instances))
+	fmt.Printf("Delete the cluster and everything quickstart created with:\n    %s\n", state.teardownCommand())
+}
+
+// askQuickstartPlan asks the questions of quickstart, checking the answers against
+// what the region offers
+func askQuickstartPlan(ctx context.Context, w *wizard, ec2Client *ec2.Client, state *quickstartState, q *quickstartOptions) (quickstartPlan, error) {
+	plan := quickstartPlan{VPCID: q.vpc}
+	if plan.VPCID == "" {
+		result, err := ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{})
+		if err != nil {
+			return plan, fmt.Errorf("failed to list VPCs: %v", err)
+		}
+		options := []string{"Create a new VPC for the quickstart"}
+		for _, vpc := range result.Vpcs {
+			options = append(options, vpcLabel(vpc))
+		}
+		fmt.Fprintln(w.out, "VPC to launch the cluster in:")
+		i, err := w.choose("vpc", options, 0)
+		if err != nil {
+			return plan, err
+		}
+		plan.VPCID = quickstartNewVPC
+		if i > 0 {
+			plan.VPCID = aws.ToString(result.Vpcs[i-1].VpcId)
+		}
+	}
+
+	instanceType, err := w.ask("Instance type", "--instance-type", q.instanceType, defaultQuickstartType(runtime.GOARCH), func(instanceType string) error {
+		arch, err := describeInstanceArch(ctx, ec2Client, instanceType)
+		if err != nil {
+			return err
+		}
+		if q.binary == "" && arch != runtime.GOARCH {
+			return fmt.Errorf("%s is an %s type but this awsmpirun is built for %s; pick an %[3]s type or pass --binary with a linux/%[2]s build", instanceType, arch, runtime.GOARCH)
+		}
+		plan.Arch = arch
+		return nil
+	})
+	if err != nil {
+		return plan, err
+	}
+	plan.InstanceType = instanceType
+	zones, err := instanceTypeZones(ctx, ec2Client, instanceType)
+	if err != nil {
+		return plan, err
+	}
+	if len(zones) == 0 {
+		return plan, fmt.Errorf("%s is not offered in %s", instanceType, state.Region)
+	}
+
+	count := ""
+	if q.instances != 0 {
+		count = strconv.Itoa(q.instances)
+	}
+	count, err = w.ask("Number of instances", "--num-instances", count, "2", validateQuickstartInstances)
+	if err != nil {
+		return plan, err
+	}
+	plan.Count, _ = strconv.Atoi(count)
+
+	if plan.VPCID == quickstartNewVPC {
+		plan.Zone = zones[0]
+	} else if plan.SubnetID, err = askQuickstartSubnet(ctx, w, ec2Client, plan.VPCID, zones, q); err != nil {
+		return plan, err
+	}
+
+	plan.InstanceProfile, err = w.ask("Instance profile of the instances (its role needs the SSM agent's permissions and to read the bucket)",
+		"--instance-profile", q.profile, "", nil)
+	if err != nil {
+		return plan, err
+	}
+	newBucket := "awsmpirun-" + state.ID
+	plan.Bucket, err = w.ask("S3 bucket to stage the job in (the default is created for the quickstart)", "--bucket", q.bucket, newBucket, validateBucketName)
+	if err != nil {
+		return plan, err
+	}
+	plan.CreateBucket = plan.Bucket == newBucket
+	return plan, nil
+}
+
+// askQuickstartSubnet returns the subnet of an existing VPC to launch into, in one of
+// zones, which offer the instance type
+func askQuickstartSubnet(ctx context.Context, w *wizard, ec2Client *ec2.Client, vpcID string, zones []string, q *quickstartOptions) (string, error) {
+	result, err := ec2Client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		Filters: []ec2Types.Filter{{Name: aws.String("vpc-id"), Values: []string{vpcID}}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list the subnets of %s: %v", vpcID, err)
+	}
+	subnets := quickstartSubnets(result.Subnets, zones)
+	if q.subnet != "" {
+		for _, subnet := range subnets {
+			if aws.ToString(subnet.SubnetId) == q.subnet {
+				return q.subnet, nil
+			}
+		}
+		return "", fmt.Errorf("--subnet: %s is not a subnet of %s in a zone that offers the instance type", q.subnet, vpcID)
+	}
+	if len(subnets) == 0 {
+		return "", fmt.Errorf("%s has no subnet in a zone that offers the instance type; pass --vpc new", vpcID)
+	}
+	options := make([]string, len(subnets))
+	for i, subnet := range subnets {
+		options[i] = subnetLabel(subnet)
+	}
+	fmt.Fprintln(w.out, "Subnet to launch the cluster in:")
+	i, err := w.choose("subnet", options, 0)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(subnets[i].SubnetId), nil
+}
+
+// describeInstanceArch returns the GOARCH of an instance type, failing for a type the
+// region does not know
+func describeInstanceArch(ctx context.Context, ec2Client *ec2.Client, instanceType string) (string, error) {
+	result, err := ec2Client.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2Types.InstanceType{ec2Types.InstanceType(instanceType)},
+	})
+	if hasErrorCode(err, "InvalidInstanceType") || (err == nil && len(result.InstanceTypes) == 0) {
+		return "", fmt.Errorf("unknown instance type %q", instanceType)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to describe instance type %s: %v", instanceType, err)
+	}
+	var architectures []ec2Types.ArchitectureType
+	if info := result.InstanceTypes[0].ProcessorInfo; info != nil {
+		architectures = info.SupportedArchitectures
+	}
+	arch, err := instanceArch(architectures)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", instanceType, err)
+	}
+	return arch, nil
+}
+
+// instanceTypeZones returns the availability zones that offer instanceType, sorted
+func instanceTypeZones(ctx context.Context, ec2Client *ec2.Client, instanceType string) ([]string, error) {
+	var zones []string
+	paginator := ec2.NewDescribeInstanceTypeOfferingsPaginator(ec2Client, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: ec2Types.LocationTypeAvailabilityZone,
+		Filters:      []ec2Types.Filter{{Name: aws.String("instance-type"), Values: []string{instanceType}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the zones offering %s: %v", instanceType, err)
+		}
+		for _, offering := range page.InstanceTypeOfferings {
+			zones = append(zones, aws.ToString(offering.Location))
+		}
+	}
+	slices.Sort(zones)
+	return zones, nil
+}
+
+// provision creates what plan needs and launches the instances, recording each
+// resource as soon as it exists. It returns the instances once they are online in SSM.
+func (s *quickstartState) provision(ctx context.Context, ec2Client *ec2.Client, ssmClient *ssm.Client, plan quickstartPlan) ([]awsManager.InstanceInfo, error) {
+	if plan.CreateBucket {
+		fmt.Printf("Creating bucket %s...\n", plan.Bucket)
+		s3Client, err := awsManager.NewS3Client(ctx, plan.Bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 client: %v", err)
+		}
+		err = s3Client.CreateBucket(ctx, s.Region, s.tags())
+		if err == nil || hasErrorCode(err, "BucketAlreadyOwnedByYou") {
+			s.Bucket = plan.Bucket
+			err = cmp.Or(s.save(), err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vpcID, subnetID := plan.VPCID, plan.SubnetID
+	if vpcID == quickstartNewVPC {
+		fmt.Printf("Creating a VPC with a public subnet in %s...\n", plan.Zone)
+		if err := s.createNetwork(ctx, ec2Client, plan.Zone); err != nil {
+			return nil, err
+		}
+		vpcID, subnetID = s.VPCID, s.SubnetID
+	}
+	if err := s.createSecurityGroup(ctx, ec2Client, vpcID); err != nil {
+		return nil, err
+	}
+
+	image, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(quickstartImageParameter(plan.Arch))})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the Amazon Linux image: %v", err)
+	}
+	fmt.Printf("Launching %d %s instances...\n", plan.Count, plan.InstanceType)
+	instanceIDs, err := awsManager.LaunchInstances(ctx, ec2Client, awsManager.LaunchSpec{
+		ImageID:          aws.ToString(image.Parameter.Value),
+		InstanceType:     plan.InstanceType,
+		SubnetID:         subnetID,
+		SecurityGroupIDs: []string{s.SecurityGroupID},
+		InstanceProfile:  plan.InstanceProfile,
+		Count:            int32(plan.Count),
+		Tags:             s.tags(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.InstanceIDs = instanceIDs
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Waiting for the instances to start and come online in SSM, which takes a few minutes...")
+	instances, err := awsManager.WaitForInstancesRunning(ctx, ec2Client, instanceIDs, quickstartRunningTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := awsManager.WaitForSSMOnline(ctx, ssmClient, instanceIDs, quickstartSSMOnlineTimeout); err != nil {
+		return nil, fmt.Errorf("%v; check that the instance profile allows the SSM agent and that the subnet reaches SSM", err)
+	}
+	return instances, nil
+}
+
+// createNetwork creates a VPC with one public subnet in zone, routed to the internet
+// so the SSM agent can reach SSM
+func (s *quickstartState) createNetwork(ctx context.Context, ec2Client *ec2.Client, zone string) error {
+	vpc, err := ec2Client.CreateVpc(ctx, &ec2.CreateVpcInput{
+		CidrBlock:         aws.String(quickstartVPCCIDR),
+		TagSpecifications: s.tagSpec(ec2Types.ResourceTypeVpc),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create VPC: %v", err)
+	}
+	s.VPCID = aws.ToString(vpc.Vpc.VpcId)
+	if err := s.save(); err != nil {
+		return err
+	}
+	err = ec2.NewVpcAvailableWaiter(ec2Client).Wait(ctx, &ec2.DescribeVpcsInput{VpcIds: []string{s.VPCID}}, time.Minute)
+	if err != nil {
+		return fmt.Errorf("VPC %s did not become available: %v", s.VPCID, err)
+	}
+	_, err = ec2Client.ModifyVpcAttribute(ctx, &ec2.ModifyVpcAttributeInput{
+		VpcId:              aws.String(s.VPCID),
+		EnableDnsHostnames: &ec2Types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable DNS hostnames in %s: %v", s.VPCID, err)
+	}
+
+	gateway, err := ec2Client.CreateInternetGateway(ctx, &ec2.CreateInternetGatewayInput{
+		TagSpecifications: s.tagSpec(ec2Types.ResourceTypeInternetGateway),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create internet gateway: %v", err)
+	}
+	s.InternetGatewayID = aws.ToString(gateway.InternetGateway.InternetGatewayId)
+	if err := s.save(); err != nil {
+		return err
+	}
+	_, err = ec2Client.AttachInternetGateway(ctx, &ec2.AttachInternetGatewayInput{
+		InternetGatewayId: aws.String(s.InternetGatewayID),
+		VpcId:             aws.String(s.VPCID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach internet gateway %s: %v", s.InternetGatewayID, err)
+	}
+
+	subnet, err := ec2Client.CreateSubnet(ctx, &ec2.CreateSubnetInput{
+		VpcId:             aws.String(s.VPCID),
+		CidrBlock:         aws.String(quickstartSubnetCIDR),
+		AvailabilityZone:  aws.String(zone),
+		TagSpecifications: s.tagSpec(ec2Types.ResourceTypeSubnet),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create subnet: %v", err)
+	}
+	s.SubnetID = aws.ToString(subnet.Subnet.SubnetId)
+	if err := s.save(); err != nil {
+		return err
+	}
+	_, err = ec2Client.ModifySubnetAttribute(ctx, &ec2.ModifySubnetAttributeInput{
+		SubnetId:            aws.String(s.SubnetID),
+		MapPublicIpOnLaunch: &ec2Types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to give the instances of %s public IPs: %v", s.SubnetID, err)
+	}
+
+	// The main route table goes with the VPC, so the default route needs no cleanup
+	tables, err := ec2Client.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []ec2Types.Filter{
+			{Name: aws.String("vpc-id"), Values: []string{s.VPCID}},
+			{Name: aws.String("association.main"), Values: []string{"true"}},
+		},
+	})
+	if err != nil || len(tables.RouteTables) == 0 {
+		return fmt.Errorf("failed to find the main route table of %s: %v", s.VPCID, err)
+	}
+	_, err = ec2Client.CreateRoute(ctx, &ec2.CreateRouteInput{
+		RouteTableId:         tables.RouteTables[0].RouteTableId,
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		GatewayId:            aws.String(s.InternetGatewayID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to route %s to the internet: %v", s.VPCID, err)
+	}
+	return nil
+}
+
+// createSecurityGroup creates the group of the instances, which lets the ranks reach
+// each other's rank port; EC2's default egress rule lets them reach SSM and S3
+func (s *quickstartState) createSecurityGroup(ctx context.Context, ec2Client *ec2.Client, vpcID string) error {
+	group, err := ec2Client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:         aws.String("awsmpirun-" + s.ID),
+		Description:       aws.String("awsmpirun quickstart " + s.ID),
+		VpcId:             aws.String(vpcID),
+		TagSpecifications: s.tagSpec(ec2Types.ResourceTypeSecurityGroup),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create security group: %v", err)
+	}
+	s.SecurityGroupID = aws.ToString(group.GroupId)
+	if err := s.save(); err != nil {
+		return err
+	}
+	_, err = ec2Client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(s.SecurityGroupID),
+		IpPermissions: rankPortPermissions(s.SecurityGroupID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to allow the rank port in %s: %v", s.SecurityGroupID, err)
+	}
+	return nil
+}
+
+// handleQuickstartInterrupt prints how to delete what was created so far when the
+// quickstart is interrupted with SIGINT or SIGTERM
+func handleQuickstartInterrupt(s *quickstartState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Printf("\nInterrupted. Delete what was created so far with:\n    %s\n", s.teardownCommand())
+	os.Exit(1)
+}
+
+func runQuickstartTeardown(ctx context.Context, o *quickstartTeardownOptions) {
+	state, err := loadQuickstartState(o.id)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("AWS_REGION", state.Region)
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Deleting quickstart %s in %s...\n", state.ID, state.Region)
+	if len(state.InstanceIDs) > 0 {
+		fmt.Printf("Terminating %d instances...\n", len(state.InstanceIDs))
+		err := awsManager.TerminateInstances(ctx, ec2Client, state.InstanceIDs, quickstartTerminateTimeout)
+		if err != nil && !hasErrorCode(err, "InvalidInstanceID.NotFound") {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := state.teardownNetwork(ctx, ec2Client); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if state.Bucket != "" {
+		s3Client, err := awsManager.NewS3Client(ctx, state.Bucket)
+		if err == nil {
+			err = s3Client.DeleteBucket(ctx)
+		}
+		if err != nil && !hasErrorCode(err, "NoSuchBucket") {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted bucket %s\n", state.Bucket)
+	}
+	if err := removeQuickstartState(state.ID); err != nil {
+		fmt.Printf("Warning: failed to forget quickstart %s: %v\n", state.ID, err)
+	}
+	fmt.Printf("Quickstart %s is deleted.\n", state.ID)
+}
+
+// teardownNetwork deletes the security group and, if the quickstart created them, the
+// internet gateway, subnet, and VPC. Resources already gone are skipped, so a teardown
+// that failed part way can run again.
+func (s *quickstartState) teardownNetwork(ctx context.Context, ec2Client *ec2.Client) error {
+	if s.SecurityGroupID != "" {
+		if err := closeJobSecurityGroup(ctx, ec2Client, s.SecurityGroupID); err != nil {
+			return err
+		}
+	}
+	if s.InternetGatewayID != "" {
+		// The gateway stays in use until the public addresses of the terminated
+		// instances are released
+		err := deleteWhenUnused(ctx, func() error {
+			_, err := ec2Client.DetachInternetGateway(ctx, &ec2.DetachInternetGatewayInput{
+				InternetGatewayId: aws.String(s.InternetGatewayID),
+				VpcId:             aws.String(s.VPCID),
+			})
+			return err
+		}, "Gateway.NotAttached", "InvalidInternetGatewayID.NotFound")
+		if err != nil {
+			return fmt.Errorf("failed to detach internet gateway %s: %v", s.InternetGatewayID, err)
+		}
+		err = deleteWhenUnused(ctx, func() error {
+			_, err := ec2Client.DeleteInternetGateway(ctx, &ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(s.InternetGatewayID)})
+			return err
+		}, "InvalidInternetGatewayID.NotFound")
+		if err != nil {
+			return fmt.Errorf("failed to delete internet gateway %s: %v", s.InternetGatewayID, err)
+		}
+		fmt.Printf("Deleted internet gateway %s\n", s.InternetGatewayID)
+	}
+	if s.SubnetID != "" {
+		err := deleteWhenUnused(ctx, func() error {
+			_, err := ec2Client.DeleteSubnet(ctx, &ec2.DeleteSubnetInput{SubnetId: aws.String(s.SubnetID)})
+			return err
+		}, "InvalidSubnetID.NotFound")
+		if err != nil {
+			return fmt.Errorf("failed to delete subnet %s: %v", s.SubnetID, err)
+		}
+		fmt.Printf("Deleted subnet %s\n", s.SubnetID)
+	}
+	if s.VPCID != "" {
+		err := deleteWhenUnused(ctx, func() error {
+			_, err := ec2Client.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: aws.String(s.VPCID)})
+			return err
+		}, "InvalidVpcID.NotFound")
+		if err != nil {
+			return fmt.Errorf("failed to delete VPC %s: %v", s.VPCID, err)
+		}
+		fmt.Printf("Deleted VPC %s\n", s.VPCID)
+	}
+	return nil
+}
+
+// deleteWhenUnused calls del until EC2 no longer answers that the resource is in use,
+// for at most securityGroupDeleteTimeout. Errors with one of the gone codes mean the
+// resource is already deleted.
+func deleteWhenUnused(ctx context.Context, del func() error, gone ...string) error {
+	deadline := time.Now().Add(securityGroupDeleteTimeout)
+	for wait := securityGroupDeleteRetry; ; wait = min(2*wait, 10*time.Second) {
+		err := del()
+		if err == nil || slices.ContainsFunc(gone, func(code string) bool { return hasErrorCode(err, code) }) {
+			return nil
+		}
+		if !hasErrorCode(err, "DependencyViolation") || time.Now().After(deadline) {
+			return err
+		}
+		if err := awsManager.SleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// cmd/quickstart_test.go
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestWizardAsk(t *testing.T) {
+	valid := func(answer string) error {
+		if strings.HasPrefix(answer, "bad") {
+			return fmt.Errorf("bad answer")
+		}
+		return nil
+	}
+	tests := []struct {
+		name        string
+		interactive bool
+		input       string
+		answer      string // From the flag
+		def         string
+		want        string
+		wantErr     string
+		wantOut     string
+	}{
+		{name: "typed", interactive: true, input: "eu-west-1\n", def: "us-west-2", want: "eu-west-1", wantOut: "Question [us-west-2]: "},
+		{name: "default", interactive: true, input: "\n", def: "us-west-2", want: "us-west-2"},
+		{name: "flag", interactive: true, answer: "ap-south-1", def: "us-west-2", want: "ap-south-1", wantOut: ""},
+		{name: "retry invalid", interactive: true, input: "bad\ngood\n", want: "good", wantOut: "Question: bad answer\nQuestion: "},
+		{name: "required", interactive: true, input: "\nab\n", want: "ab", wantOut: "Question: An answer is required\nQuestion: "},
+		{name: "no answer", interactive: true, input: "", wantErr: `no answer to "Question"; pass --flag`},
+		{name: "last line", interactive: true, input: "ab", want: "ab"},
+		{name: "invalid flag", interactive: true, answer: "bad", wantErr: "--flag: bad answer"},
+		{name: "not a terminal", input: "ignored\n", def: "xy", want: "xy"},
+		{name: "not a terminal without default", wantErr: "--flag is required without a terminal"},
+		{name: "not a terminal invalid default", def: "bad", wantErr: "bad answer; pass --flag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := &wizard{in: bufio.NewReader(strings.NewReader(tt.input)), out: &out, interactive: tt.interactive}
+			got, err := w.ask("Question", "--flag", tt.answer, tt.def, valid)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ask() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ask() = %q, %v, want %q", got, err, tt.want)
+			}
+			if tt.wantOut != "" && out.String() != tt.wantOut {
+				t.Errorf("ask() wrote %q, want %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestWizardChoose(t *testing.T) {
+	options := []string{"new", "vpc-1", "vpc-2"}
+	tests := []struct {
+		interactive bool
+		input       string
+		want        int
+	}{
+		{interactive: true, input: "3\n", want: 2},
+		{interactive: true, input: "\n", want: 1},
+		{interactive: true, input: "0\n9\n1\n", want: 0},
+		{interactive: false, input: "3\n", want: 1},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		w := &wizard{in: bufio.NewReader(strings.NewReader(tt.input)), out: &out, interactive: tt.interactive}
+		got, err := w.choose("vpc", options, 1)
+		if err != nil || got != tt.want {
+			t.Errorf("choose() with input %q = %d, %v, want %d", tt.input, got, err, tt.want)
+		}
+		if tt.interactive && !strings.Contains(out.String(), "  3) vpc-2\nWhich vpc? [2]: ") {
+			t.Errorf("choose() wrote %q", out.String())
+		}
+	}
+}
+
+func TestValidateQuickstartAnswers(t *testing.T) {
+	for _, tt := range []struct {
+		valid    func(string) error
+		answer   string
+		accepted bool
+	}{
+		{validateRegion, "us-west-2", true},
+		{validateRegion, "us-gov-east-1", true},
+		{validateRegion, "ap-southeast-4", true},
+		{validateRegion, "us-west", false},
+		{validateRegion, "US-WEST-2", false},
+		{validateQuickstartInstances, "2", true},
+		{validateQuickstartInstances, "16", true},
+		{validateQuickstartInstances, "1", false},
+		{validateQuickstartInstances, "17", false},
+		{validateQuickstartInstances, "two", false},
+	} {
+		if err := tt.valid(tt.answer); (err == nil) != tt.accepted {
+			t.Errorf("validating %q = %v, want accepted %v", tt.answer, err, tt.accepted)
+		}
+	}
+}
+
+func TestInstanceArch(t *testing.T) {
+	tests := []struct {
+		architectures []ec2Types.ArchitectureType
+		want          string
+	}{
+		{[]ec2Types.ArchitectureType{ec2Types.ArchitectureTypeI386, ec2Types.ArchitectureTypeX8664}, "amd64"},
+		{[]ec2Types.ArchitectureType{ec2Types.ArchitectureTypeArm64}, "arm64"},
+		{[]ec2Types.ArchitectureType{ec2Types.ArchitectureTypeX8664Mac}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := instanceArch(tt.architectures)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("instanceArch(%v) = %q, %v, want %q", tt.architectures, got, err, tt.want)
+		}
+	}
+
+	for goarch, want := range map[string]string{"amd64": "x86_64", "arm64": "arm64"} {
+		if got := quickstartImageParameter(goarch); got != "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-"+want {
+			t.Errorf("quickstartImageParameter(%s) = %s", goarch, got)
+		}
+	}
+	for goarch, want := range map[string]string{"amd64": "t3.micro", "arm64": "t4g.micro"} {
+		if got := defaultQuickstartType(goarch); got != want {
+			t.Errorf("defaultQuickstartType(%s) = %s, want %s", goarch, got, want)
+		}
+	}
+}
+
+func TestQuickstartSubnets(t *testing.T) {
+	subnet := func(id, zone string, public bool) ec2Types.Subnet {
+		return ec2Types.Subnet{SubnetId: aws.String(id), AvailabilityZone: aws.String(zone), MapPublicIpOnLaunch: aws.Bool(public)}
+	}
+	subnets := []ec2Types.Subnet{
+		subnet("subnet-private-a", "us-west-2a", false),
+		subnet("subnet-public-d", "us-west-2d", true),
+		subnet("subnet-public-b", "us-west-2b", true),
+		subnet("subnet-private-b", "us-west-2b", false),
+		subnet("subnet-public-c", "us-west-2c", true),
+	}
+	var got []string
+	for _, s := range quickstartSubnets(subnets, []string{"us-west-2a", "us-west-2b", "us-west-2c"}) {
+		got = append(got, aws.ToString(s.SubnetId))
+	}
+	want := []string{"subnet-public-b", "subnet-public-c", "subnet-private-a", "subnet-private-b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("quickstartSubnets() = %v, want %v", got, want)
+	}
+	if label := subnetLabel(subnets[0]); !strings.Contains(label, "no public IPs") {
+		t.Errorf("subnetLabel() of a private subnet = %q", label)
+	}
+}
+
+func TestQuickstartState(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if _, err := loadQuickstartState(""); err == nil || err.Error() != "no quickstart is on record" {
+		t.Fatalf("loadQuickstartState() with none = %v", err)
+	}
+	first := &quickstartState{ID: "qs-1", Region: "eu-west-1", Project: "quickstart", VPCID: "vpc-1", InstanceIDs: []string{"i-1", "i-2"}}
+	if err := first.save(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadQuickstartState("")
+	if err != nil || !reflect.DeepEqual(got, first) {
+		t.Fatalf("loadQuickstartState() = %+v, %v, want %+v", got, err, first)
+	}
+
+	second := &quickstartState{ID: "qs-2", Region: "us-west-2", Project: "quickstart"}
+	if err := second.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadQuickstartState(""); err == nil || !strings.Contains(err.Error(), "(qs-1, qs-2); choose one with --id") {
+		t.Errorf("loadQuickstartState() with two = %v", err)
+	}
+	if got, err := loadQuickstartState("qs-2"); err != nil || !reflect.DeepEqual(got, second) {
+		t.Errorf("loadQuickstartState(qs-2) = %+v, %v", got, err)
+	}
+
+	if err := removeQuickstartState("qs-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadQuickstartState("qs-1"); err == nil {
+		t.Error("loadQuickstartState(qs-1) found a removed quickstart")
+	}
+	if got, err := loadQuickstartState(""); err != nil || got.ID != "qs-2" {
+		t.Errorf("loadQuickstartState() after removing qs-1 = %+v, %v", got, err)
+	}
+}
+
+func TestQuickstartTeardownNetwork(t *testing.T) {
+	defer func(retry time.Duration) { securityGroupDeleteRetry = retry }(securityGroupDeleteRetry)
+	securityGroupDeleteRetry = time.Millisecond
+
+	tests := []struct {
+		name   string
+		state  quickstartState
+		errors map[string][]string // Error codes the next calls of an action answer with
+		want   []string
+	}{
+		{
+			name:  "created VPC",
+			state: quickstartState{VPCID: "vpc-1", SubnetID: "subnet-1", InternetGatewayID: "igw-1", SecurityGroupID: "sg-1"},
+			// The public addresses of the terminated instances are still being released
+			errors: map[string][]string{"DetachInternetGateway": {"DependencyViolation", "DependencyViolation"}},
+			want: []string{
+				"DescribeNetworkInterfaces", "DeleteSecurityGroup",
+				"DetachInternetGateway", "DetachInternetGateway", "DetachInternetGateway", "DeleteInternetGateway",
+				"DeleteSubnet", "DeleteVpc",
+			},
+		},
+		{
+			name:  "existing VPC",
+			state: quickstartState{SecurityGroupID: "sg-1"},
+			want:  []string{"DescribeNetworkInterfaces", "DeleteSecurityGroup"},
+		},
+		{
+			name:  "partly deleted",
+			state: quickstartState{VPCID: "vpc-1", SubnetID: "subnet-1", InternetGatewayID: "igw-1", SecurityGroupID: "sg-1"},
+			errors: map[string][]string{
+				"DeleteSecurityGroup":   {"InvalidGroup.NotFound"},
+				"DetachInternetGateway": {"Gateway.NotAttached"},
+				"DeleteInternetGateway": {"InvalidInternetGatewayID.NotFound"},
+				"DeleteSubnet":          {"DependencyViolation"},
+			},
+			want: []string{
+				"DescribeNetworkInterfaces", "DeleteSecurityGroup",
+				"DetachInternetGateway", "DeleteInternetGateway",
+				"DeleteSubnet", "DeleteSubnet", "DeleteVpc",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				r.ParseForm()
+				action := r.Form.Get("Action")
+				calls = append(calls, action)
+				if codes := tt.errors[action]; len(codes) > 0 {
+					tt.errors[action] = codes[1:]
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>r</RequestID></Response>`, codes[0], codes[0])
+					return
+				}
+				if action == "DescribeNetworkInterfaces" {
+					fmt.Fprint(w, `<DescribeNetworkInterfacesResponse><networkInterfaceSet></networkInterfaceSet></DescribeNetworkInterfacesResponse>`)
+					return
+				}
+				fmt.Fprintf(w, `<%sResponse><return>true</return></%sResponse>`, action, action)
+			}))
+			defer server.Close()
+			client := ec2.New(ec2.Options{
+				Region:       "us-west-2",
+				BaseEndpoint: aws.String(server.URL),
+				HTTPClient:   server.Client(),
+				Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+					return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+				}),
+				RetryMaxAttempts: 1,
+			})
+
+			if err := tt.state.teardownNetwork(context.Background(), client); err != nil {
+				t.Fatalf("teardownNetwork() = %v", err)
+			}
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("calls = %v, want %v", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteWhenUnusedGivesUp(t *testing.T) {
+	defer func(retry time.Duration) { securityGroupDeleteRetry = retry }(securityGroupDeleteRetry)
+	securityGroupDeleteRetry = time.Millisecond
+
+	calls := 0
+	err := deleteWhenUnused(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("access denied")
+	}, "InvalidVpcID.NotFound")
+	if err == nil || calls != 1 {
+		t.Errorf("deleteWhenUnused() = %v after %d calls, want the error after 1", err, calls)
+	}
+}
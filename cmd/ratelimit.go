@@ -0,0 +1,93 @@
+// cmd/ratelimit.go
+// This file applies the "ssm_rate_limits:" of config.yaml before any command runs. All
+// SSM calls of the process go through one client-side limiter per account and region
+// (see aws/rate_limiter.go); a rule sets its rate, burst, and ceiling on calls in
+// flight, for an account, a region, or both:
+//
+//	ssm_rate_limits:
+//	  - region: us-east-1
+//	    rate: 10
+//	    burst: 20
+//	    max_in_flight: 16
+//	  - account: "123456789012"
+//	    rate: 5
+//
+// Several awsmpirun processes sharing an account each take their own rate, so teams
+// running many at once lower it to their share.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+)
+
+// accountPattern matches an AWS account ID
+var accountPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// ssmRateLimitRule is one entry of ssm_rate_limits in config.yaml
+type ssmRateLimitRule struct {
+	Account     string  `yaml:"account,omitempty"`
+	Region      string  `yaml:"region,omitempty"`
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst,omitempty"`
+	MaxInFlight int     `yaml:"max_in_flight,omitempty"`
+}
+
+func init() {
+	cobra.OnInitialize(applySSMRateLimits)
+}
+
+// applySSMRateLimits installs the rate limits of config.yaml for the SSM clients
+func applySSMRateLimits() {
+	path, err := userConfigPath()
+	if err != nil {
+		return
+	}
+	config, err := loadUserConfig(path)
+	if err == nil {
+		var rules []awsManager.RateLimitRule
+		rules, err = ssmRateLimitRules(config.SSMRateLimits)
+		awsManager.SetSSMRateLimits(rules)
+	}
+	if err != nil {
+		fmt.Printf("Error: %s: %v\n", path, err)
+		os.Exit(1)
+	}
+}
+
+// ssmRateLimitRules validates the configured rules. A rule without a burst may send
+// one second's worth of calls at once.
+func ssmRateLimitRules(configured []ssmRateLimitRule) ([]awsManager.RateLimitRule, error) {
+	var rules []awsManager.RateLimitRule
+	seen := make(map[string]bool)
+	for i, rule := range configured {
+		if rule.Account != "" && !accountPattern.MatchString(rule.Account) {
+			return nil, fmt.Errorf("ssm_rate_limits[%d]: invalid account %q, use the 12-digit account ID", i, rule.Account)
+		}
+		if rule.Rate < 0 || rule.Burst < 0 || rule.MaxInFlight < 0 {
+			return nil, fmt.Errorf("ssm_rate_limits[%d]: rate, burst, and max_in_flight cannot be negative", i)
+		}
+		key := rule.Account + "/" + rule.Region
+		if seen[key] {
+			return nil, fmt.Errorf("ssm_rate_limits[%d]: a rule for account %q and region %q is already set", i, rule.Account, rule.Region)
+		}
+		seen[key] = true
+
+		burst := rule.Burst
+		if burst == 0 {
+			burst = max(int(rule.Rate), 1)
+		}
+		rules = append(rules, awsManager.RateLimitRule{
+			Account: rule.Account,
+			Region:  rule.Region,
+			Limit:   awsManager.RateLimit{Rate: rule.Rate, Burst: burst, MaxInFlight: rule.MaxInFlight},
+		})
+	}
+	return rules, nil
+}
@@ -0,0 +1,70 @@
+// cmd/ratelimit_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestSSMRateLimitRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []ssmRateLimitRule
+		want    []awsManager.RateLimit
+		wantErr string
+	}{
+		{name: "none"},
+		{
+			name:  "burst defaults to a second of calls",
+			rules: []ssmRateLimitRule{{Region: "us-east-1", Rate: 10}, {Account: "123456789012", Rate: 0.5, MaxInFlight: 4}},
+			want:  []awsManager.RateLimit{{Rate: 10, Burst: 10}, {Rate: 0.5, Burst: 1, MaxInFlight: 4}},
+		},
+		{name: "explicit burst", rules: []ssmRateLimitRule{{Rate: 5, Burst: 50}}, want: []awsManager.RateLimit{{Rate: 5, Burst: 50}}},
+		{name: "bad account", rules: []ssmRateLimitRule{{Account: "prod", Rate: 5}}, wantErr: "12-digit"},
+		{name: "negative", rules: []ssmRateLimitRule{{Rate: -1}}, wantErr: "negative"},
+		{name: "duplicate", rules: []ssmRateLimitRule{{Region: "us-east-1", Rate: 1}, {Region: "us-east-1", Rate: 2}}, wantErr: "already set"},
+	}
+
+	for _, tt := range tests {
+		rules, err := ssmRateLimitRules(tt.rules)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(rules) != len(tt.want) {
+			t.Fatalf("%s: %d rules, want %d", tt.name, len(rules), len(tt.want))
+		}
+		for i, rule := range rules {
+			if rule.Limit != tt.want[i] || rule.Account != tt.rules[i].Account || rule.Region != tt.rules[i].Region {
+				t.Errorf("%s: rule %d = %+v, want limit %+v", tt.name, i, rule, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLoadUserConfigRateLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "project: team-a\nssm_rate_limits:\n  - region: us-east-1\n    rate: 10\n    max_in_flight: 16\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadUserConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ssmRateLimitRule{Region: "us-east-1", Rate: 10, MaxInFlight: 16}
+	if config.Project != "team-a" || len(config.SSMRateLimits) != 1 || config.SSMRateLimits[0] != want {
+		t.Errorf("config = %+v", config)
+	}
+}
@@ -0,0 +1,461 @@
+// cmd/reachability.go
+// This file implements --check-network, a connectivity check run before the program
+// starts. Without it, a pair of ranks that cannot reach each other is only noticed when
+// Init gives up after --connect-timeout, deep inside the program. The check has every
+// instance listen on the rank port and connect to every other instance for a few
+// seconds, then reports each pair that did not connect with its likely cause. A refused
+// connection and a missing route are told apart by what the connection attempt saw;
+// for dropped packets the security groups and network ACLs of both instances are read
+// from EC2 and checked against the port.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// rankPort is the port every rank serves its peers on
+const rankPort = 50051
+
+// probeWindowSeconds is how long each instance keeps trying to reach the others. SSM
+// starts the probes within a few seconds of each other, so early connections are
+// refused until the peer listens.
+const probeWindowSeconds = 15
+
+// ephemeralPort stands for the port replies return to. Network ACLs are stateless, so
+// the replies need rules of their own; Linux picks local ports from 32768 up.
+const ephemeralPort = 32768
+
+// Outcomes of the connection attempts to one peer
+const (
+	probeOK          = "ok"
+	probeTimeout     = "timeout"
+	probeRefused     = "refused"
+	probeUnreachable = "unreachable"
+	probeError       = "error"
+)
+
+// probeProgram is the Python program every instance runs for the check. Its arguments
+// are the port, the window in seconds, and RANK=HOST for every peer. It prints
+// "listen ok" or "listen error MESSAGE", then "probe RANK OUTCOME" for every peer.
+const probeProgram = `import errno, socket, sys, threading, time
+
+port, window = int(sys.argv[1]), float(sys.argv[2])
+peers = [arg.split("=", 1) for arg in sys.argv[3:]]
+start = time.time()
+
+def serve(server):
+    # Keep accepting until the slowest peer has given up
+    while time.time() < start + 2 * window:
+        try:
+            server.accept()[0].close()
+        except OSError:
+            pass
+
+try:
+    server = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+    server.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    server.bind(("0.0.0.0", port))
+    server.listen(1024)
+    server.settimeout(0.5)
+    print("listen ok", flush=True)
+    threading.Thread(target=serve, args=(server,)).start()
+except OSError as e:
+    print("listen error " + str(e).replace("\n", " "), flush=True)
+
+lock = threading.Lock()
+slots = threading.BoundedSemaphore(64)
+
+def probe(rank, host):
+    with slots:
+        while True:
+            try:
+                socket.create_connection((host, port), timeout=2).close()
+                outcome = "ok"
+                break
+            except socket.timeout:
+                outcome = "timeout"
+            except ConnectionRefusedError:
+                outcome = "refused"
+            except OSError as e:
+                outcome = "unreachable" if e.errno in (errno.EHOSTUNREACH, errno.ENETUNREACH) else "error"
+            if time.time() >= start + window:
+                break
+            time.sleep(0.5)
+    with lock:
+        print("probe %s %s" % (rank, outcome), flush=True)
+
+threads = [threading.Thread(target=probe, args=peer) for peer in peers]
+for thread in threads:
+    thread.start()
+for thread in threads:
+    thread.join()
+`
+
+// rankHost is the address the other ranks reach instance at
+func rankHost(instance awsManager.InstanceInfo) string {
+	if instance.PrivateIP != "" {
+		return instance.PrivateIP
+	}
+	return instance.PublicIP
+}
+
+// probeScript returns the script that checks the connections of self to every other instance
+func probeScript(self awsManager.InstanceInfo, instances []awsManager.InstanceInfo) string {
+	args := []string{strconv.Itoa(rankPort), strconv.Itoa(probeWindowSeconds)}
+	for _, instance := range instances {
+		if instance.InstanceID != self.InstanceID {
+			args = append(args, fmt.Sprintf("%d=%s", instance.InstanceRank, rankHost(instance)))
+		}
+	}
+	script := newShellScript()
+	script.Linef("python3 - %s <<'PROBE'", args)
+	script.Raw(probeProgram)
+	script.Raw("PROBE")
+	return script.String()
+}
+
+// probeReport is what the check saw on one instance
+type probeReport struct {
+	listenErr string         // Why the instance could not listen on the rank port, if it could not
+	outcomes  map[int]string // Outcome of the connections to each peer, by rank
+}
+
+// parseProbeOutput reads the lines probeProgram prints
+func parseProbeOutput(output string) probeReport {
+	report := probeReport{outcomes: make(map[int]string)}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if message, ok := strings.CutPrefix(line, "listen error "); ok {
+			report.listenErr = message
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "probe" {
+			continue
+		}
+		if rank, err := strconv.Atoi(fields[1]); err == nil {
+			report.outcomes[rank] = fields[2]
+		}
+	}
+	return report
+}
+
+// blockedPair is a pair of ranks the check could not connect
+type blockedPair struct {
+	from, to int
+	address  string // Where from tried to reach to
+	outcome  string
+	cause    string // The likely cause, empty until explained
+}
+
+func (p blockedPair) String() string {
+	var seen string
+	switch p.outcome {
+	case probeTimeout:
+		seen = "timed out"
+	case probeRefused:
+		seen = "connection refused"
+	case probeUnreachable:
+		seen = "no route to host"
+	case "":
+		seen = "no result"
+	default:
+		seen = p.outcome
+	}
+	line := fmt.Sprintf("rank %d -> rank %d (%s:%d): %s", p.from, p.to, p.address, rankPort, seen)
+	if p.cause != "" {
+		line += "; " + p.cause
+	}
+	return line
+}
+
+// blockedPairs returns the pairs that did not connect, ordered by rank, from the
+// reports of every instance by instance ID. Connections to an instance that could not
+// listen are explained by that.
+func blockedPairs(instances []awsManager.InstanceInfo, reports map[string]probeReport) []blockedPair {
+	listenErrs := make(map[int]string)
+	for _, instance := range instances {
+		if err := reports[instance.InstanceID].listenErr; err != "" {
+			listenErrs[instance.InstanceRank] = err
+		}
+	}
+
+	var pairs []blockedPair
+	for _, from := range instances {
+		report, ok := reports[from.InstanceID]
+		for _, to := range instances {
+			if to.InstanceID == from.InstanceID {
+				continue
+			}
+			outcome := report.outcomes[to.InstanceRank]
+			if outcome == probeOK {
+				continue
+			}
+			pair := blockedPair{from: from.InstanceRank, to: to.InstanceRank, address: rankHost(to), outcome: outcome}
+			switch {
+			case !ok:
+				pair.cause = fmt.Sprintf("the check did not run on rank %d", from.InstanceRank)
+			case listenErrs[to.InstanceRank] != "":
+				pair.cause = fmt.Sprintf("rank %d could not listen on the port: %s", to.InstanceRank, listenErrs[to.InstanceRank])
+			case outcome == probeRefused:
+				pair.cause = fmt.Sprintf("a firewall on rank %d rejects the port", to.InstanceRank)
+			case outcome == probeUnreachable:
+				pair.cause = "check the route tables of both subnets"
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].from != pairs[j].from {
+			return pairs[i].from < pairs[j].from
+		}
+		return pairs[i].to < pairs[j].to
+	})
+	return pairs
+}
+
+// networkPolicy is what EC2 filters the traffic of one instance with
+type networkPolicy struct {
+	address netip.Addr
+	groups  []ec2Types.SecurityGroup
+	acl     *ec2Types.NetworkAcl // The network ACL of the instance's subnet, nil if unknown
+}
+
+// explainDrop returns which security group or network ACL rule keeps from from
+// reaching to on the rank port, or a pointer to what is left when they allow it
+func explainDrop(from, to int, policies map[int]networkPolicy) string {
+	src, dst := policies[from], policies[to]
+	switch {
+	case !groupsAllow(dst.groups, false, src, rankPort):
+		return fmt.Sprintf("the security groups of rank %d (%s) do not allow TCP %d in from %s", to, groupIDs(dst.groups), rankPort, src.address)
+	case !groupsAllow(src.groups, true, dst, rankPort):
+		return fmt.Sprintf("the security groups of rank %d (%s) do not allow TCP %d out to %s", from, groupIDs(src.groups), rankPort, dst.address)
+	case !aclAllows(dst.acl, false, src.address, rankPort):
+		return fmt.Sprintf("network ACL %s of rank %d denies TCP %d in from %s", aclID(dst.acl), to, rankPort, src.address)
+	case !aclAllows(src.acl, true, dst.address, rankPort):
+		return fmt.Sprintf("network ACL %s of rank %d denies TCP %d out to %s", aclID(src.acl), from, rankPort, dst.address)
+	case !aclAllows(dst.acl, true, src.address, ephemeralPort):
+		return fmt.Sprintf("network ACL %s of rank %d denies the replies out to %s on ephemeral ports", aclID(dst.acl), to, src.address)
+	case !aclAllows(src.acl, false, dst.address, ephemeralPort):
+		return fmt.Sprintf("network ACL %s of rank %d denies the replies in from %s on ephemeral ports", aclID(src.acl), from, dst.address)
+	}
+	return "the security groups and network ACLs allow the port; check the route tables and any firewall on the instances"
+}
+
+// groupsAllow reports whether any of groups lets TCP traffic on port pass to or from
+// peer. Rules matching prefix lists cannot be checked here and count as allowing.
+func groupsAllow(groups []ec2Types.SecurityGroup, egress bool, peer networkPolicy, port int32) bool {
+	peerGroups := make(map[string]bool)
+	for _, group := range peer.groups {
+		peerGroups[aws.ToString(group.GroupId)] = true
+	}
+	for _, group := range groups {
+		permissions := group.IpPermissions
+		if egress {
+			permissions = group.IpPermissionsEgress
+		}
+		for _, permission := range permissions {
+			if !permitsTCPPort(aws.ToString(permission.IpProtocol), permission.FromPort, permission.ToPort, port) {
+				continue
+			}
+			if len(permission.PrefixListIds) > 0 {
+				return true
+			}
+			for _, r := range permission.IpRanges {
+				if cidrContains(aws.ToString(r.CidrIp), peer.address) {
+					return true
+				}
+			}
+			for _, pair := range permission.UserIdGroupPairs {
+				if peerGroups[aws.ToString(pair.GroupId)] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// aclAllows reports whether acl lets TCP traffic on port pass to or from address. The
+// rules are evaluated in order of their numbers and the first match decides; a nil ACL
+// allows everything.
+func aclAllows(acl *ec2Types.NetworkAcl, egress bool, address netip.Addr, port int32) bool {
+	if acl == nil {
+		return true
+	}
+	var entries []ec2Types.NetworkAclEntry
+	for _, entry := range acl.Entries {
+		if aws.ToBool(entry.Egress) == egress {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return aws.ToInt32(entries[i].RuleNumber) < aws.ToInt32(entries[j].RuleNumber) })
+	for _, entry := range entries {
+		var from, to *int32
+		if entry.PortRange != nil {
+			from, to = entry.PortRange.From, entry.PortRange.To
+		}
+		if permitsTCPPort(aws.ToString(entry.Protocol), from, to, port) && cidrContains(aws.ToString(entry.CidrBlock), address) {
+			return entry.RuleAction == ec2Types.RuleActionAllow
+		}
+	}
+	return false
+}
+
+// permitsTCPPort reports whether a rule for protocol and the port range covers TCP
+// traffic on port. Security groups name TCP "tcp" and network ACLs "6"; "-1" is every
+// protocol, which has no port range.
+func permitsTCPPort(protocol string, from, to *int32, port int32) bool {
+	switch protocol {
+	case "-1":
+		return true
+	case "tcp", "6":
+		return from == nil || (aws.ToInt32(from) <= port && port <= aws.ToInt32(to))
+	}
+	return false
+}
+
+func cidrContains(cidr string, address netip.Addr) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	return err == nil && prefix.Contains(address)
+}
+
+func groupIDs(groups []ec2Types.SecurityGroup) string {
+	var ids []string
+	for _, group := range groups {
+		ids = append(ids, aws.ToString(group.GroupId))
+	}
+	return strings.Join(ids, ", ")
+}
+
+func aclID(acl *ec2Types.NetworkAcl) string {
+	return aws.ToString(acl.NetworkAclId)
+}
+
+// loadNetworkPolicies reads the security groups and subnet network ACLs of instances, by rank
+func loadNetworkPolicies(ctx context.Context, ec2Client *ec2.Client, instances []awsManager.InstanceInfo) (map[int]networkPolicy, error) {
+	ranks := make(map[string]int)
+	var ids []string
+	for _, instance := range instances {
+		ranks[instance.InstanceID] = instance.InstanceRank
+		ids = append(ids, instance.InstanceID)
+	}
+	result, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instances: %v", err)
+	}
+
+	groupsOf := make(map[int][]string)
+	subnetOf := make(map[int]string)
+	policies := make(map[int]networkPolicy)
+	groupSet, subnetSet := make(map[string]bool), make(map[string]bool)
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			rank := ranks[aws.ToString(instance.InstanceId)]
+			address, _ := netip.ParseAddr(aws.ToString(instance.PrivateIpAddress))
+			policies[rank] = networkPolicy{address: address}
+			for _, group := range instance.SecurityGroups {
+				groupsOf[rank] = append(groupsOf[rank], aws.ToString(group.GroupId))
+				groupSet[aws.ToString(group.GroupId)] = true
+			}
+			subnetOf[rank] = aws.ToString(instance.SubnetId)
+			subnetSet[aws.ToString(instance.SubnetId)] = true
+		}
+	}
+
+	groups := make(map[string]ec2Types.SecurityGroup)
+	if len(groupSet) > 0 {
+		described, err := ec2Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: sortedKeys(groupSet)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %v", err)
+		}
+		for _, group := range described.SecurityGroups {
+			groups[aws.ToString(group.GroupId)] = group
+		}
+	}
+	acls := make(map[string]*ec2Types.NetworkAcl)
+	described, err := ec2Client.DescribeNetworkAcls(ctx, &ec2.DescribeNetworkAclsInput{
+		Filters: []ec2Types.Filter{{Name: aws.String("association.subnet-id"), Values: sortedKeys(subnetSet)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe network ACLs: %v", err)
+	}
+	for i := range described.NetworkAcls {
+		for _, association := range described.NetworkAcls[i].Associations {
+			acls[aws.ToString(association.SubnetId)] = &described.NetworkAcls[i]
+		}
+	}
+
+	for rank, policy := range policies {
+		for _, id := range groupsOf[rank] {
+			policy.groups = append(policy.groups, groups[id])
+		}
+		policy.acl = acls[subnetOf[rank]]
+		policies[rank] = policy
+	}
+	return policies, nil
+}
+
+// checkReachability runs the check on instances and returns an error listing every
+// pair of ranks that could not connect. With explain, pairs whose connections were
+// dropped are explained from the security groups and network ACLs.
+func checkReachability(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, explain bool) error {
+	fmt.Printf("Checking the connections between %d ranks on port %d...\n", len(instances), rankPort)
+	outputs, err := runScriptOnInstances(ctx, ssmClient, instances, func(instance awsManager.InstanceInfo) string {
+		return probeScript(instance, instances)
+	})
+	if err != nil && len(outputs) == 0 {
+		return fmt.Errorf("network check failed: %v", err)
+	}
+	reports := make(map[string]probeReport)
+	for id, output := range outputs {
+		reports[id] = parseProbeOutput(output)
+	}
+	pairs := blockedPairs(instances, reports)
+	if len(pairs) == 0 {
+		fmt.Println("Every rank can reach every other rank")
+		return nil
+	}
+
+	var dropped bool
+	for _, pair := range pairs {
+		dropped = dropped || pair.cause == ""
+	}
+	if dropped && explain {
+		ec2ClientCreator := awsManager.EC2ClientCreator{}
+		ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+		var policies map[int]networkPolicy
+		if err == nil {
+			policies, err = loadNetworkPolicies(ctx, ec2Client, instances)
+		}
+		if err != nil {
+			fmt.Printf("Warning: the security groups and network ACLs could not be checked: %v\n", err)
+		}
+		for i := range pairs {
+			if pairs[i].cause == "" && policies != nil {
+				pairs[i].cause = explainDrop(pairs[i].from, pairs[i].to, policies)
+			}
+		}
+	}
+
+	lines := make([]string, len(pairs))
+	for i, pair := range pairs {
+		lines[i] = "  " + pair.String()
+	}
+	return fmt.Errorf("%d rank pairs cannot connect, the program was not started:\n%s", len(pairs), strings.Join(lines, "\n"))
+}
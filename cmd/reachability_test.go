@@ -0,0 +1,202 @@
+// cmd/reachability_test.go
+
+package cmd
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestProbeScript(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-0", PrivateIP: "10.0.0.1", InstanceRank: 0},
+		{InstanceID: "i-1", PrivateIP: "10.0.0.2", InstanceRank: 1},
+		{InstanceID: "i-2", PublicIP: "3.3.3.3", InstanceRank: 2},
+	}
+	script := probeScript(instances[1], instances)
+	if !strings.Contains(script, "python3 - '50051' '15' '0=10.0.0.1' '2=3.3.3.3' <<'PROBE'\n") {
+		t.Errorf("script does not probe the other ranks:\n%s", script)
+	}
+	if !strings.HasSuffix(script, "\nPROBE\n") {
+		t.Errorf("heredoc is not closed:\n%s", script)
+	}
+}
+
+func TestParseProbeOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   probeReport
+	}{
+		{
+			name:   "all reached",
+			output: "listen ok\nprobe 1 ok\nprobe 2 ok\n",
+			want:   probeReport{outcomes: map[int]string{1: probeOK, 2: probeOK}},
+		},
+		{
+			name:   "port taken",
+			output: "listen error [Errno 98] Address already in use\nprobe 0 timeout\n",
+			want:   probeReport{listenErr: "[Errno 98] Address already in use", outcomes: map[int]string{0: probeTimeout}},
+		},
+		{
+			name:   "noise ignored",
+			output: "warning: something\nprobe x ok\nprobe 3\nprobe 4 refused\n",
+			want:   probeReport{outcomes: map[int]string{4: probeRefused}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseProbeOutput(tt.output); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBlockedPairs(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-0", PrivateIP: "10.0.0.1", InstanceRank: 0},
+		{InstanceID: "i-1", PrivateIP: "10.0.0.2", InstanceRank: 1},
+		{InstanceID: "i-2", PrivateIP: "10.0.0.3", InstanceRank: 2},
+	}
+	reports := map[string]probeReport{
+		"i-0": {outcomes: map[int]string{1: probeOK, 2: probeTimeout}},
+		"i-1": {outcomes: map[int]string{0: probeRefused}},
+		"i-2": {listenErr: "in use", outcomes: map[int]string{0: probeUnreachable, 1: probeOK}},
+	}
+	want := []string{
+		"rank 0 -> rank 2 (10.0.0.3:50051): timed out; rank 2 could not listen on the port: in use",
+		"rank 1 -> rank 0 (10.0.0.1:50051): connection refused; a firewall on rank 0 rejects the port",
+		"rank 1 -> rank 2 (10.0.0.3:50051): no result; rank 2 could not listen on the port: in use",
+		"rank 2 -> rank 0 (10.0.0.1:50051): no route to host; check the route tables of both subnets",
+	}
+	var got []string
+	for _, pair := range blockedPairs(instances, reports) {
+		got = append(got, pair.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pairs:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+
+	delete(reports, "i-1")
+	pairs := blockedPairs(instances, reports)
+	if len(pairs) != 4 || pairs[1].from != 1 || !strings.Contains(pairs[1].cause, "did not run on rank 1") {
+		t.Errorf("pairs without rank 1's report = %+v", pairs)
+	}
+}
+
+// tcpRule is a security group rule allowing TCP on ports from-to from the CIDRs and groups
+func tcpRule(from, to int32, cidrs []string, groups []string) ec2Types.IpPermission {
+	rule := ec2Types.IpPermission{IpProtocol: aws.String("tcp"), FromPort: aws.Int32(from), ToPort: aws.Int32(to)}
+	for _, cidr := range cidrs {
+		rule.IpRanges = append(rule.IpRanges, ec2Types.IpRange{CidrIp: aws.String(cidr)})
+	}
+	for _, group := range groups {
+		rule.UserIdGroupPairs = append(rule.UserIdGroupPairs, ec2Types.UserIdGroupPair{GroupId: aws.String(group)})
+	}
+	return rule
+}
+
+// aclEntry is a network ACL rule for TCP on ports from-to
+func aclEntry(number int32, egress bool, cidr string, from, to int32, action ec2Types.RuleAction) ec2Types.NetworkAclEntry {
+	return ec2Types.NetworkAclEntry{
+		RuleNumber: aws.Int32(number),
+		Egress:     aws.Bool(egress),
+		CidrBlock:  aws.String(cidr),
+		Protocol:   aws.String("6"),
+		PortRange:  &ec2Types.PortRange{From: aws.Int32(from), To: aws.Int32(to)},
+		RuleAction: action,
+	}
+}
+
+func TestExplainDrop(t *testing.T) {
+	allEgress := []ec2Types.IpPermission{{IpProtocol: aws.String("-1"), IpRanges: []ec2Types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}}}
+	openACL := &ec2Types.NetworkAcl{
+		NetworkAclId: aws.String("acl-open"),
+		Entries: []ec2Types.NetworkAclEntry{
+			{RuleNumber: aws.Int32(100), Egress: aws.Bool(false), CidrBlock: aws.String("0.0.0.0/0"), Protocol: aws.String("-1"), RuleAction: ec2Types.RuleActionAllow},
+			{RuleNumber: aws.Int32(100), Egress: aws.Bool(true), CidrBlock: aws.String("0.0.0.0/0"), Protocol: aws.String("-1"), RuleAction: ec2Types.RuleActionAllow},
+		},
+	}
+	group := func(id string, ingress ...ec2Types.IpPermission) ec2Types.SecurityGroup {
+		return ec2Types.SecurityGroup{GroupId: aws.String(id), IpPermissions: ingress, IpPermissionsEgress: allEgress}
+	}
+	policy := func(address string, acl *ec2Types.NetworkAcl, groups ...ec2Types.SecurityGroup) networkPolicy {
+		return networkPolicy{address: netip.MustParseAddr(address), groups: groups, acl: acl}
+	}
+	source := policy("10.0.1.5", openACL, group("sg-src"))
+
+	tests := []struct {
+		name string
+		dst  networkPolicy
+		src  networkPolicy
+		want string
+	}{
+		{
+			name: "no ingress rule",
+			dst:  policy("10.0.2.5", openACL, group("sg-dst", tcpRule(22, 22, []string{"0.0.0.0/0"}, nil))),
+			src:  source,
+			want: "the security groups of rank 1 (sg-dst) do not allow TCP 50051 in from 10.0.1.5",
+		},
+		{
+			name: "rule for another CIDR",
+			dst:  policy("10.0.2.5", openACL, group("sg-dst", tcpRule(50051, 50051, []string{"10.0.2.0/24"}, nil))),
+			src:  source,
+			want: "the security groups of rank 1 (sg-dst) do not allow TCP 50051 in from 10.0.1.5",
+		},
+		{
+			name: "allowed by CIDR",
+			dst:  policy("10.0.2.5", openACL, group("sg-dst", tcpRule(50000, 50100, []string{"10.0.0.0/16"}, nil))),
+			src:  source,
+			want: "the security groups and network ACLs allow the port; check the route tables and any firewall on the instances",
+		},
+		{
+			name: "allowed by source group",
+			dst:  policy("10.0.2.5", openACL, group("sg-dst", tcpRule(50051, 50051, nil, []string{"sg-src"}))),
+			src:  source,
+			want: "the security groups and network ACLs allow the port; check the route tables and any firewall on the instances",
+		},
+		{
+			name: "no egress rule",
+			dst:  policy("10.0.2.5", openACL, group("sg-dst", tcpRule(50051, 50051, nil, []string{"sg-src"}))),
+			src:  policy("10.0.1.5", openACL, ec2Types.SecurityGroup{GroupId: aws.String("sg-src")}),
+			want: "the security groups of rank 0 (sg-src) do not allow TCP 50051 out to 10.0.2.5",
+		},
+		{
+			name: "acl denies before it allows",
+			dst: policy("10.0.2.5", &ec2Types.NetworkAcl{
+				NetworkAclId: aws.String("acl-dst"),
+				Entries: []ec2Types.NetworkAclEntry{
+					aclEntry(200, false, "0.0.0.0/0", 0, 65535, ec2Types.RuleActionAllow),
+					aclEntry(100, false, "10.0.1.0/24", 50000, 51000, ec2Types.RuleActionDeny),
+					aclEntry(100, true, "0.0.0.0/0", 0, 65535, ec2Types.RuleActionAllow),
+				},
+			}, group("sg-dst", tcpRule(50051, 50051, nil, []string{"sg-src"}))),
+			src:  source,
+			want: "network ACL acl-dst of rank 1 denies TCP 50051 in from 10.0.1.5",
+		},
+		{
+			name: "acl blocks replies",
+			dst: policy("10.0.2.5", &ec2Types.NetworkAcl{
+				NetworkAclId: aws.String("acl-dst"),
+				Entries: []ec2Types.NetworkAclEntry{
+					aclEntry(100, false, "0.0.0.0/0", 0, 65535, ec2Types.RuleActionAllow),
+					aclEntry(100, true, "0.0.0.0/0", 443, 443, ec2Types.RuleActionAllow),
+				},
+			}, group("sg-dst", tcpRule(50051, 50051, nil, []string{"sg-src"}))),
+			src:  source,
+			want: "network ACL acl-dst of rank 1 denies the replies out to 10.0.1.5 on ephemeral ports",
+		},
+	}
+	for _, tt := range tests {
+		policies := map[int]networkPolicy{0: tt.src, 1: tt.dst}
+		if got := explainDrop(0, 1, policies); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// cmd/remote.go
+// This file holds helpers for running short administrative scripts on instances
+// through SSM and waiting for their results, and for building the SendCommand input of
+// the scripts that run ranks, which may run for as long as SSM allows.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// maxExecutionTimeout is the longest SSM lets an AWS-RunShellScript command run, in
+// seconds. Without an executionTimeout it stops the script after an hour.
+const maxExecutionTimeout = 172800
+
+// shellScriptInput returns the input that runs script with AWS-RunShellScript, which
+// stops it after executionTimeout seconds, or after an hour when executionTimeout is 0.
+// The caller sets the instances to run it on.
+func shellScriptInput(script string, executionTimeout int) *ssm.SendCommandInput {
+	parameters := map[string][]string{
+		"commands": {script},
+	}
+	if executionTimeout > 0 {
+		parameters["executionTimeout"] = []string{strconv.Itoa(min(executionTimeout, maxExecutionTimeout))}
+	}
+	return &ssm.SendCommandInput{
+		DocumentName:   aws.String("AWS-RunShellScript"),
+		Parameters:     parameters,
+		TimeoutSeconds: aws.Int32(600),
+	}
+}
+
+// executionTimeoutOf returns timeout as the executionTimeout of a script, in seconds,
+// or as long as SSM allows when timeout is 0
+func executionTimeoutOf(timeout time.Duration) int {
+	if timeout == 0 {
+		return maxExecutionTimeout
+	}
+	return min(max(int(timeout.Seconds()), 1), maxExecutionTimeout)
+}
+
+// runScriptOnInstances runs a script on each instance concurrently, waits for all of them,
+// and returns the standard output per instance ID
+func runScriptOnInstances(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, scriptFor func(awsManager.InstanceInfo) string) (map[string]string, error) {
+	return runLongScriptOnInstances(ctx, ssmClient, instances, 0, scriptFor)
+}
+
+// runLongScriptOnInstances is runScriptOnInstances for scripts that may take over an
+// hour, such as those that run ranks or move large files, which SSM lets run for
+// executionTimeout seconds
+func runLongScriptOnInstances(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, executionTimeout int, scriptFor func(awsManager.InstanceInfo) string) (map[string]string, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	outputs := make(map[string]string)
+	var failures []string
+
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance awsManager.InstanceInfo) {
+			defer wg.Done()
+
+			input := shellScriptInput(scriptFor(instance), executionTimeout)
+			input.InstanceIds = []string{instance.InstanceID}
+			result, err := ssmClient.SendCommand(ctx, input)
+			var output *ssm.GetCommandInvocationOutput
+			if err == nil {
+				output, err = waitForCommandInvocation(ctx, ssmClient, aws.ToString(result.Command.CommandId), instance.InstanceID)
+			}
+			if err == nil && output.Status != ssmTypes.CommandInvocationStatusSuccess {
+				err = fmt.Errorf("status %s: %s", output.Status, strings.TrimSpace(aws.ToString(output.StandardErrorContent)))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", instance.InstanceID, err))
+				return
+			}
+			outputs[instance.InstanceID] = aws.ToString(output.StandardOutputContent)
+		}(instance)
+	}
+
+	wg.Wait()
+	if len(failures) > 0 {
+		return outputs, fmt.Errorf("command failed on %d instances:\n  %s", len(failures), strings.Join(failures, "\n  "))
+	}
+	return outputs, nil
+}
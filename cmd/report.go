@@ -0,0 +1,351 @@
+// cmd/report.go
+// This file implements the report command, which rolls up the usage records of
+// usage.go for one month, so a lab can charge its projects and users for what they ran
+// without going through Cost Explorer. The records come from this machine's ledger, or
+// with --bucket from every run that recorded to the bucket. Rows are keyed by any of
+// project, user, and instance type, and count the jobs and attempts, the
+// instance-hours, and the bytes the ranks sent.
+
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+)
+
+// Keys the rows of a report can have
+const (
+	usageByProject      = "project"
+	usageByUser         = "user"
+	usageByInstanceType = "instance-type"
+)
+
+// Formats report can write
+const (
+	reportTable = "table"
+	reportCSV   = "csv"
+	reportJSON  = "json"
+)
+
+// reportOptions are the flags of the report command
+type reportOptions struct {
+	month   string
+	by      string
+	format  string
+	bucket  string
+	project string
+}
+
+// newReportCmd returns the report command
+func newReportCmd() *cobra.Command {
+	o := &reportOptions{}
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Roll up the instance-hours, data sent, and jobs of a month by project or user",
+		Long: `report adds up what the runs of one month used, from the usage record every run
+writes when it ends: the jobs run, the attempts at them (a resume-phase is another
+attempt), how many attempts failed, the instance-hours, and the bytes the ranks sent
+each other. Instance-hours are the number of ranks times the wall time of an attempt,
+and an attempt counts in the UTC month it started in. Without --bucket only the runs
+started from this machine are counted; with --bucket every run that recorded its
+usage to the bucket is, in every project unless --project is given.
+
+--by takes a comma-separated list of project, user, and instance-type; user is the IAM
+user or role session name of the credentials the run used. --format csv and json
+write the exact bytes and hours for chargeback spreadsheets.`,
+		Example: `  awsmpirun report --month 2025-01 --by project
+  awsmpirun report --month 2025-01 --by project,user --bucket my-staging --format csv > 2025-01.csv`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runReport(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.month, "month", "", "Month to report, as YYYY-MM (default: the current UTC month)")
+	cmd.Flags().StringVar(&o.by, "by", usageByProject, "Comma-separated keys of the rows: project, user, and instance-type")
+	cmd.Flags().StringVar(&o.format, "format", reportTable, "Output format: table, csv, or json (JSON lines)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Read the usage records runs stored in this bucket instead of this machine's")
+	cmd.Flags().StringVar(&o.project, "project", "", "Only report this project")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newReportCmd())
+}
+
+// usageRollup is one row of a report
+type usageRollup struct {
+	Month         string  `json:"month"`
+	Project       *string `json:"project,omitempty"`
+	User          *string `json:"user,omitempty"`
+	InstanceType  *string `json:"instance_type,omitempty"`
+	Jobs          int     `json:"jobs"`
+	Runs          int     `json:"runs"`
+	FailedRuns    int     `json:"failed_runs"`
+	InstanceHours float64 `json:"instance_hours"`
+	BytesSent     int64   `json:"bytes_sent"`
+
+	jobs map[string]bool
+}
+
+func runReport(ctx context.Context, o *reportOptions) {
+	month := o.month
+	if month == "" {
+		month = time.Now().UTC().Format(usageMonthLayout)
+	}
+	if _, err := time.Parse(usageMonthLayout, month); err != nil {
+		fmt.Printf("Error: --month must be YYYY-MM, got %q\n", month)
+		os.Exit(1)
+	}
+	keys, err := parseUsageKeys(o.by)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.format != reportTable && o.format != reportCSV && o.format != reportJSON {
+		fmt.Printf("Error: --format must be table, csv, or json, got %q\n", o.format)
+		os.Exit(1)
+	}
+
+	var records []usageRecord
+	if o.bucket != "" {
+		records, err = bucketUsage(ctx, o.bucket, o.project, month)
+	} else {
+		records, err = localUsage()
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.project != "" {
+		records = slices.DeleteFunc(records, func(r usageRecord) bool { return r.Project != o.project })
+	}
+	rows := rollUpUsage(records, month, keys)
+	if len(rows) == 0 && o.format == reportTable {
+		fmt.Printf("No usage recorded in %s\n", month)
+		return
+	}
+	if err := writeReport(os.Stdout, rows, keys, o.format); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseUsageKeys parses the value of --by
+func parseUsageKeys(by string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(by, ",") {
+		key = strings.TrimSpace(key)
+		switch key {
+		case usageByProject, usageByUser, usageByInstanceType:
+		default:
+			return nil, fmt.Errorf("--by takes project, user, and instance-type, got %q", key)
+		}
+		if slices.Contains(keys, key) {
+			return nil, fmt.Errorf("--by lists %s twice", key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// localUsage reads this machine's ledger
+func localUsage() ([]usageRecord, error) {
+	path, err := usageLedgerPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseUsage(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return records, nil
+}
+
+// bucketUsage reads the usage records of month from the bucket, of project or, if it
+// is empty, of every project
+func bucketUsage(ctx context.Context, bucket, project, month string) ([]usageRecord, error) {
+	s3Client, err := awsManager.NewS3Client(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	prefixes := []string{usagePrefix(project, month)}
+	if project == "" {
+		projects, err := s3Client.ListPrefixes(ctx, "projects/")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range projects {
+			prefixes = append(prefixes, p+"usage/"+month+"/")
+		}
+	}
+	var records []usageRecord
+	for _, prefix := range prefixes {
+		objects, err := s3Client.ListObjects(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			data, err := s3Client.DownloadBytes(ctx, object.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read usage record %s: %v", object.Key, err)
+			}
+			parsed, err := parseUsage(data)
+			if err != nil {
+				return nil, fmt.Errorf("usage record %s: %v", object.Key, err)
+			}
+			records = append(records, parsed...)
+		}
+	}
+	return records, nil
+}
+
+// rollUpUsage adds up the records of month into one row per distinct value of keys,
+// sorted by them. A record on several instance types is split between their rows by
+// their share of the ranks.
+func rollUpUsage(records []usageRecord, month string, keys []string) []usageRollup {
+	rows := make(map[string]*usageRollup)
+	for _, r := range records {
+		if r.month() != month {
+			continue
+		}
+		shares := map[string]int{"": r.Ranks}
+		if slices.Contains(keys, usageByInstanceType) && len(r.InstanceTypes) > 0 {
+			shares = r.InstanceTypes
+		}
+		for instanceType, ranks := range shares {
+			values := map[string]string{usageByProject: r.Project, usageByUser: r.User, usageByInstanceType: instanceType}
+			id := ""
+			for _, key := range keys {
+				id += values[key] + "\x00"
+			}
+			row, ok := rows[id]
+			if !ok {
+				row = &usageRollup{Month: month, jobs: make(map[string]bool)}
+				for _, key := range keys {
+					value := values[key]
+					switch key {
+					case usageByProject:
+						row.Project = &value
+					case usageByUser:
+						row.User = &value
+					case usageByInstanceType:
+						row.InstanceType = &value
+					}
+				}
+				rows[id] = row
+			}
+			share := 1.0
+			if r.Ranks > 0 {
+				share = float64(ranks) / float64(r.Ranks)
+			}
+			row.jobs[r.JobID] = true
+			row.Runs++
+			if r.Status == jobFailed {
+				row.FailedRuns++
+			}
+			row.InstanceHours += r.instanceHours() * share
+			row.BytesSent += int64(float64(r.BytesSent) * share)
+		}
+	}
+
+	ids := make([]string, 0, len(rows))
+	for id := range rows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rollups := make([]usageRollup, len(ids))
+	for i, id := range ids {
+		rows[id].Jobs = len(rows[id].jobs)
+		rollups[i] = *rows[id]
+	}
+	return rollups
+}
+
+// reportColumns returns the columns of row, with the exact hours and bytes or rounded
+// for reading
+func reportColumns(row usageRollup, keys []string, exact bool) []string {
+	values := []string{row.Month}
+	for _, key := range keys {
+		switch key {
+		case usageByProject:
+			values = append(values, *row.Project)
+		case usageByUser:
+			values = append(values, *row.User)
+		case usageByInstanceType:
+			values = append(values, *row.InstanceType)
+		}
+	}
+	values = append(values, strconv.Itoa(row.Jobs), strconv.Itoa(row.Runs), strconv.Itoa(row.FailedRuns))
+	if exact {
+		return append(values, strconv.FormatFloat(row.InstanceHours, 'f', 4, 64), strconv.FormatInt(row.BytesSent, 10))
+	}
+	return append(values, strconv.FormatFloat(row.InstanceHours, 'f', 1, 64), strconv.FormatFloat(float64(row.BytesSent)/(1<<30), 'f', 2, 64))
+}
+
+// writeReport writes rows as a table, CSV with a header, or JSON lines
+func writeReport(w io.Writer, rows []usageRollup, keys []string, format string) error {
+	header := []string{"month"}
+	for _, key := range keys {
+		header = append(header, strings.ReplaceAll(key, "-", "_"))
+	}
+	header = append(header, "jobs", "runs", "failed_runs")
+	switch format {
+	case reportJSON:
+		for _, row := range rows {
+			row.InstanceHours = roundHours(row.InstanceHours)
+			line, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		return nil
+	case reportCSV:
+		out := csv.NewWriter(w)
+		out.Write(append(header, "instance_hours", "bytes_sent"))
+		for _, row := range rows {
+			out.Write(reportColumns(row, keys, true))
+		}
+		out.Flush()
+		return out.Error()
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header = append(header, "instance_hours", "gib_sent")
+	fmt.Fprintln(table, strings.ToUpper(strings.ReplaceAll(strings.Join(header, "\t"), "_", " ")))
+	for _, row := range rows {
+		values := reportColumns(row, keys, false)
+		for i, value := range values {
+			if value == "" {
+				values[i] = "-"
+			}
+		}
+		fmt.Fprintln(table, strings.Join(values, "\t"))
+	}
+	return table.Flush()
+}
+
+// roundHours rounds instance-hours to the 4 places CSV has
+func roundHours(hours float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(hours, 'f', 4, 64), 64)
+	return rounded
+}
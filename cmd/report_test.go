@@ -0,0 +1,149 @@
+// cmd/report_test.go
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usageAt is a record of job that started at day of January 2025 and ran for hours
+func usageAt(job, project, user string, day int, hours float64, status string, types map[string]int, sent int64) usageRecord {
+	started := time.Date(2025, 1, day, 12, 0, 0, 0, time.UTC)
+	ranks := 0
+	for _, n := range types {
+		ranks += n
+	}
+	return usageRecord{
+		JobID: job, Project: project, User: user, Status: status, BytesSent: sent,
+		Started: started, Ended: started.Add(time.Duration(hours * float64(time.Hour))),
+		Ranks: ranks, InstanceTypes: types,
+	}
+}
+
+func testUsage() []usageRecord {
+	return []usageRecord{
+		usageAt("job-1", "team-a", "ana", 3, 2, jobFailed, map[string]int{"c7i.large": 4}, 1000),
+		usageAt("job-1", "team-a", "ana", 3, 1, jobSucceeded, map[string]int{"c7i.large": 4}, 500), // Resumed
+		usageAt("job-2", "team-a", "ben", 10, 0.5, jobSucceeded, map[string]int{"c7i.large": 2, "hpc7g.16xlarge": 6}, 800),
+		usageAt("job-3", "team-b", "ana", 20, 3, jobSucceeded, map[string]int{"hpc7g.16xlarge": 1}, 0),
+		usageAt("job-4", "team-a", "ana", 1, 10, jobSucceeded, nil, 0), // Failed before ranks were found
+		{JobID: "job-5", Project: "team-a", User: "ana", Ranks: 8, Started: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+func TestRollUpUsage(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		keys []string
+		want []usageRollup
+	}{
+		{
+			name: "by project",
+			keys: []string{usageByProject},
+			want: []usageRollup{
+				{Month: "2025-01", Project: str("team-a"), Jobs: 3, Runs: 4, FailedRuns: 1, InstanceHours: 16, BytesSent: 2300},
+				{Month: "2025-01", Project: str("team-b"), Jobs: 1, Runs: 1, InstanceHours: 3},
+			},
+		},
+		{
+			name: "by project and user",
+			keys: []string{usageByProject, usageByUser},
+			want: []usageRollup{
+				{Month: "2025-01", Project: str("team-a"), User: str("ana"), Jobs: 2, Runs: 3, FailedRuns: 1, InstanceHours: 12, BytesSent: 1500},
+				{Month: "2025-01", Project: str("team-a"), User: str("ben"), Jobs: 1, Runs: 1, InstanceHours: 4, BytesSent: 800},
+				{Month: "2025-01", Project: str("team-b"), User: str("ana"), Jobs: 1, Runs: 1, InstanceHours: 3},
+			},
+		},
+		{
+			name: "by instance type",
+			keys: []string{usageByInstanceType},
+			want: []usageRollup{
+				{Month: "2025-01", InstanceType: str(""), Jobs: 1, Runs: 1},
+				{Month: "2025-01", InstanceType: str("c7i.large"), Jobs: 2, Runs: 3, FailedRuns: 1, InstanceHours: 13, BytesSent: 1700},
+				{Month: "2025-01", InstanceType: str("hpc7g.16xlarge"), Jobs: 2, Runs: 2, InstanceHours: 6, BytesSent: 600},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rollUpUsage(testUsage(), "2025-01", tt.keys)
+			for i := range got {
+				got[i].jobs = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("rollUpUsage()\n%s\nwant\n%s", gotJSON, wantJSON)
+			}
+		})
+	}
+	if rows := rollUpUsage(testUsage(), "2024-12", []string{usageByProject}); len(rows) != 0 {
+		t.Errorf("a month without records has %d rows", len(rows))
+	}
+}
+
+func TestParseUsageKeys(t *testing.T) {
+	tests := []struct {
+		by      string
+		want    []string
+		wantErr string
+	}{
+		{by: "project", want: []string{usageByProject}},
+		{by: "user, project", want: []string{usageByUser, usageByProject}},
+		{by: "project,user,instance-type", want: []string{usageByProject, usageByUser, usageByInstanceType}},
+		{by: "team", wantErr: `got "team"`},
+		{by: "user,user", wantErr: "twice"},
+		{by: "", wantErr: `got ""`},
+	}
+	for _, tt := range tests {
+		got, err := parseUsageKeys(tt.by)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseUsageKeys(%q) error = %v, want %q", tt.by, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseUsageKeys(%q) = %v, %v, want %v", tt.by, got, err, tt.want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	keys := []string{usageByProject, usageByUser}
+	rows := rollUpUsage(testUsage(), "2025-01", keys)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{reportCSV, `month,project,user,jobs,runs,failed_runs,instance_hours,bytes_sent
+2025-01,team-a,ana,2,3,1,12.0000,1500
+2025-01,team-a,ben,1,1,0,4.0000,800
+2025-01,team-b,ana,1,1,0,3.0000,0
+`},
+		{reportJSON, `{"month":"2025-01","project":"team-a","user":"ana","jobs":2,"runs":3,"failed_runs":1,"instance_hours":12,"bytes_sent":1500}
+{"month":"2025-01","project":"team-a","user":"ben","jobs":1,"runs":1,"failed_runs":0,"instance_hours":4,"bytes_sent":800}
+{"month":"2025-01","project":"team-b","user":"ana","jobs":1,"runs":1,"failed_runs":0,"instance_hours":3,"bytes_sent":0}
+`},
+		{reportTable, `MONTH    PROJECT  USER  JOBS  RUNS  FAILED RUNS  INSTANCE HOURS  GIB SENT
+2025-01  team-a   ana   2     3     1            12.0            0.00
+2025-01  team-a   ben   1     1     0            4.0             0.00
+2025-01  team-b   ana   1     1     0            3.0             0.00
+`},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeReport(&b, rows, keys, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s report\n%s\nwant\n%s", tt.format, b.String(), tt.want)
+		}
+	}
+}
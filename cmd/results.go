@@ -0,0 +1,352 @@
+// cmd/results.go
+// This file implements the result manifest and the results command. When a run with
+// --bucket collects its output, it lists the objects the ranks saved with
+// mpi.SaveResult, under results/rank-<n>/ in the job's prefix, once, and writes an
+// index of them, every rank's objects with their sizes and ETags, to results.json next
+// to the job. results ls and results merge read that index, so looking at or joining
+// the output of thousands of ranks needs one GetObject rather than listing a huge
+// prefix, and merge checks every part it downloads against the ETag recorded for it.
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/spf13/cobra"
+)
+
+// resultsOptions are the flags of results ls and results merge
+type resultsOptions struct {
+	bucket  string
+	project string
+	jobID   string
+	rank    int    // ls only
+	json    bool   // ls only
+	output  string // merge only
+}
+
+// bindResultsFlags binds the flags that pick the job to o
+func (o *resultsOptions) bindResultsFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Staging bucket the job ran with (required)")
+	cmd.Flags().StringVar(&o.jobID, "job-id", "", "Job whose results to read (required)")
+	cmd.Flags().StringVar(&o.project, "project", "", "Project of the job (default: project in config.yaml)")
+	cmd.MarkFlagRequired("bucket")
+	cmd.MarkFlagRequired("job-id")
+}
+
+var resultsCmd = &cobra.Command{
+	Use:   "results",
+	Short: "List and merge the results the ranks of a job saved",
+}
+
+// newResultsLsCmd returns results ls
+func newResultsLsCmd() *cobra.Command {
+	o := &resultsOptions{}
+	cmd := &cobra.Command{
+		Use:   "ls --bucket BUCKET --job-id JOB",
+		Short: "List the results of a job from its result manifest",
+		Long: `ls prints the objects the ranks of a job saved with mpi.SaveResult, rank by rank, with
+their sizes and ETags, from the result manifest the run wrote when it collected its
+output. --rank keeps the objects of one rank, and --json prints the manifest itself.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runResultsLs(cmd.Context(), o)
+		},
+	}
+	o.bindResultsFlags(cmd)
+	cmd.Flags().IntVar(&o.rank, "rank", -1, "Only list the results of this rank")
+	cmd.Flags().BoolVar(&o.json, "json", false, "Print the result manifest as JSON")
+	return cmd
+}
+
+// newResultsMergeCmd returns results merge
+func newResultsMergeCmd() *cobra.Command {
+	o := &resultsOptions{}
+	cmd := &cobra.Command{
+		Use:   "merge NAME --bucket BUCKET --job-id JOB -o FILE",
+		Short: "Join a result every rank saved into one file, in rank order",
+		Long: `merge downloads the result called NAME from every rank that saved one, in rank
+order, and writes them one after the other to -o, or to standard output with -o -.
+NAME may be a pattern as in path.Match, such as "part-*.csv", in which case the
+matching objects of each rank follow each other in name order. Every part is checked
+against the ETag in the result manifest, so a part changed since the run fails the merge.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runResultsMerge(cmd.Context(), args[0], o)
+		},
+	}
+	o.bindResultsFlags(cmd)
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "File to write the merged result to, or - for standard output (required)")
+	cmd.MarkFlagRequired("output")
+	return cmd
+}
+
+func init() {
+	resultsCmd.AddCommand(newResultsLsCmd(), newResultsMergeCmd())
+	rootCmd.AddCommand(resultsCmd)
+}
+
+// resultManifest is the index of the results of a job, results.json
+type resultManifest struct {
+	JobID   string        `json:"job_id"`
+	Project string        `json:"project,omitempty"`
+	Created string        `json:"created"`
+	Objects int           `json:"objects"`
+	Bytes   int64         `json:"bytes"`
+	Ranks   []rankResults `json:"ranks"`
+}
+
+// rankResults are the results of one rank
+type rankResults struct {
+	Rank    int            `json:"rank"`
+	Bytes   int64          `json:"bytes"`
+	Objects []resultObject `json:"objects"`
+}
+
+// resultObject is one saved result
+type resultObject struct {
+	Name string `json:"name"` // As passed to mpi.SaveResult
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// resultsPrefix is the S3 prefix the ranks of a job save their results under
+func resultsPrefix(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/results/"
+}
+
+// resultManifestKey is the S3 key of a job's result manifest. It is outside the
+// results prefix so the manifest does not list itself.
+func resultManifestKey(project, jobID string) string {
+	return mpi.JobPrefix(project, jobID) + "/results.json"
+}
+
+// buildResultManifest indexes the objects listed under the results prefix of a job by
+// rank. Objects that are not under a rank-<n>/ prefix were not saved by mpi.SaveResult
+// and are left out.
+func buildResultManifest(project, jobID string, objects []awsManager.S3Object, created time.Time) resultManifest {
+	manifest := resultManifest{JobID: jobID, Project: project, Created: created.UTC().Format(time.RFC3339)}
+	prefix := resultsPrefix(project, jobID)
+	byRank := make(map[int]*rankResults)
+	for _, object := range objects {
+		dir, name, ok := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+		digits, isRank := strings.CutPrefix(dir, "rank-")
+		rank, err := strconv.Atoi(digits)
+		if !ok || !isRank || err != nil || rank < 0 || name == "" {
+			continue
+		}
+		results := byRank[rank]
+		if results == nil {
+			results = &rankResults{Rank: rank}
+			byRank[rank] = results
+		}
+		results.Objects = append(results.Objects, resultObject{Name: name, Key: object.Key, Size: object.Size, ETag: object.ETag})
+		results.Bytes += object.Size
+		manifest.Objects++
+		manifest.Bytes += object.Size
+	}
+	// Keys sort rank-10 before rank-2, so the ranks are put in numeric order
+	for _, rank := range slices.Sorted(maps.Keys(byRank)) {
+		results := byRank[rank]
+		slices.SortFunc(results.Objects, func(a, b resultObject) int { return cmp.Compare(a.Name, b.Name) })
+		manifest.Ranks = append(manifest.Ranks, *results)
+	}
+	return manifest
+}
+
+// writeResultManifest indexes the results the ranks saved and uploads the index. Jobs
+// whose ranks saved nothing get no manifest.
+func (o *runOptions) writeResultManifest(ctx context.Context) error {
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	objects, err := s3Client.ListObjects(ctx, resultsPrefix(o.project, o.jobID))
+	if err != nil {
+		return err
+	}
+	manifest := buildResultManifest(o.project, o.jobID, objects, time.Now())
+	if manifest.Objects == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the result manifest: %v", err)
+	}
+	key := resultManifestKey(o.project, o.jobID)
+	if err := s3Client.UploadBytes(ctx, data, key); err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d results of %d ranks in s3://%s/%s\n", manifest.Objects, len(manifest.Ranks), o.bucket, key)
+	return nil
+}
+
+// loadResultManifest reads the result manifest of the job given with --job-id
+func loadResultManifest(ctx context.Context, o *resultsOptions) (*awsManager.S3Client, resultManifest, error) {
+	var manifest resultManifest
+	if err := validateJobID(o.jobID); err != nil {
+		return nil, manifest, err
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		return nil, manifest, err
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return nil, manifest, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	data, err := s3Client.DownloadBytes(ctx, resultManifestKey(project, o.jobID))
+	if err != nil {
+		return nil, manifest, fmt.Errorf("job %s has no result manifest; runs write it when they collect their output, if the ranks saved results: %v", o.jobID, err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, manifest, fmt.Errorf("invalid result manifest: %v", err)
+	}
+	return s3Client, manifest, nil
+}
+
+func runResultsLs(ctx context.Context, o *resultsOptions) {
+	_, manifest, err := loadResultManifest(ctx, o)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.rank >= 0 {
+		manifest = manifest.forRank(o.rank)
+	}
+	if o.json {
+		out, _ := json.MarshalIndent(manifest, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	writeResultList(os.Stdout, manifest)
+}
+
+// forRank returns the manifest with only the results of rank
+func (m resultManifest) forRank(rank int) resultManifest {
+	kept := m
+	kept.Ranks, kept.Objects, kept.Bytes = nil, 0, 0
+	for _, results := range m.Ranks {
+		if results.Rank == rank {
+			kept.Ranks = append(kept.Ranks, results)
+			kept.Objects += len(results.Objects)
+			kept.Bytes += results.Bytes
+		}
+	}
+	return kept
+}
+
+// writeResultList prints the results of a manifest as a table with a total
+func writeResultList(w io.Writer, manifest resultManifest) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RANK\tSIZE\tETAG\tNAME")
+	for _, results := range manifest.Ranks {
+		for _, object := range results.Objects {
+			fmt.Fprintf(table, "%d\t%d\t%s\t%s\n", results.Rank, object.Size, object.ETag, object.Name)
+		}
+	}
+	table.Flush()
+	fmt.Fprintf(w, "%d objects, %d bytes from %d ranks\n", manifest.Objects, manifest.Bytes, len(manifest.Ranks))
+}
+
+// mergeParts returns the objects merge joins for pattern, in rank order and, within a
+// rank, in name order
+func mergeParts(manifest resultManifest, pattern string) ([]resultObject, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid result name %q: %v", pattern, err)
+	}
+	var parts []resultObject
+	for _, results := range manifest.Ranks {
+		for _, object := range results.Objects {
+			if matched, _ := path.Match(pattern, object.Name); matched {
+				parts = append(parts, object)
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no rank saved a result matching %q", pattern)
+	}
+	return parts, nil
+}
+
+// checkPart compares the content of a part with the ETag the manifest recorded. The
+// ETags of multipart uploads are not the MD5 of the content and are only compared by size.
+func checkPart(part resultObject, size int64, sum []byte) error {
+	if size != part.Size {
+		return fmt.Errorf("%s is %d bytes, the result manifest says %d", part.Key, size, part.Size)
+	}
+	if strings.Contains(part.ETag, "-") {
+		return nil
+	}
+	if got := hex.EncodeToString(sum); got != part.ETag {
+		return fmt.Errorf("%s has MD5 %s, the result manifest says %s: it changed since the run", part.Key, got, part.ETag)
+	}
+	return nil
+}
+
+func runResultsMerge(ctx context.Context, pattern string, o *resultsOptions) {
+	s3Client, manifest, err := loadResultManifest(ctx, o)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	parts, err := mergeParts(manifest, pattern)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if o.output != "-" {
+		out, err = os.Create(o.output)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var total int64
+	for _, part := range parts {
+		sum := md5.New()
+		n, err := s3Client.WriteObjectTo(ctx, part.Key, io.MultiWriter(out, sum))
+		if err == nil {
+			err = checkPart(part, n, sum.Sum(nil))
+		}
+		if err != nil {
+			// Standard output holds the merged parts, so the error goes to stderr
+			if o.output == "-" {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			out.Close()
+			os.Remove(o.output)
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		total += n
+	}
+	if o.output == "-" {
+		return
+	}
+	if err := out.Close(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Merged %d parts, %d bytes, into %s\n", len(parts), total, o.output)
+}
@@ -0,0 +1,141 @@
+// cmd/results_test.go
+
+package cmd
+
+import (
+	"crypto/md5"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestBuildResultManifest(t *testing.T) {
+	key := func(rank int, name string) string { return mpi.ResultKey("team-a", "job-1", rank, name) }
+	prefix := resultsPrefix("team-a", "job-1")
+	objects := []awsManager.S3Object{
+		{Key: key(10, "out.csv"), Size: 30, ETag: "c"},
+		{Key: key(2, "part-b.csv"), Size: 20, ETag: "b2"},
+		{Key: key(2, "part-a.csv"), Size: 10, ETag: "a2"},
+		{Key: prefix + "notes.txt", Size: 5},      // Not saved by a rank
+		{Key: prefix + "rank-x/out.csv", Size: 5}, // Not a rank number
+		{Key: prefix + "rank-3/", Size: 0},        // A folder placeholder
+		{Key: key(2, "logs/rank.log"), Size: 1, ETag: "l"},
+	}
+	at := time.Date(2026, 10, 14, 2, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	got := buildResultManifest("team-a", "job-1", objects, at)
+	want := resultManifest{
+		JobID: "job-1", Project: "team-a", Created: "2026-10-14T09:00:00Z", Objects: 4, Bytes: 61,
+		Ranks: []rankResults{
+			{Rank: 2, Bytes: 31, Objects: []resultObject{
+				{Name: "logs/rank.log", Key: key(2, "logs/rank.log"), Size: 1, ETag: "l"},
+				{Name: "part-a.csv", Key: key(2, "part-a.csv"), Size: 10, ETag: "a2"},
+				{Name: "part-b.csv", Key: key(2, "part-b.csv"), Size: 20, ETag: "b2"},
+			}},
+			{Rank: 10, Bytes: 30, Objects: []resultObject{{Name: "out.csv", Key: key(10, "out.csv"), Size: 30, ETag: "c"}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildResultManifest() =\n%+v\nwant\n%+v", got, want)
+	}
+	if kept := got.forRank(10); kept.Objects != 1 || kept.Bytes != 30 || len(kept.Ranks) != 1 || kept.Ranks[0].Rank != 10 {
+		t.Errorf("forRank(10) = %+v", kept)
+	}
+}
+
+func TestMergeParts(t *testing.T) {
+	manifest := resultManifest{Ranks: []rankResults{
+		{Rank: 0, Objects: []resultObject{{Name: "part-0.csv", Key: "k0a"}, {Name: "part-1.csv", Key: "k0b"}, {Name: "summary.txt", Key: "k0s"}}},
+		{Rank: 1, Objects: []resultObject{{Name: "part-0.csv", Key: "k1a"}}},
+		{Rank: 2, Objects: []resultObject{{Name: "summary.txt", Key: "k2s"}}},
+	}}
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr string
+	}{
+		{pattern: "summary.txt", want: []string{"k0s", "k2s"}},
+		{pattern: "part-*.csv", want: []string{"k0a", "k0b", "k1a"}},
+		{pattern: "missing.bin", wantErr: "no rank saved"},
+		{pattern: "[", wantErr: "invalid result name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			parts, err := mergeParts(manifest, tt.pattern)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("mergeParts() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			var keys []string
+			for _, part := range parts {
+				keys = append(keys, part.Key)
+			}
+			if err != nil || !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("mergeParts() = %v, %v; want %v", keys, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPart(t *testing.T) {
+	content := []byte("rank 0 output\n")
+	sum := md5.Sum(content)
+	etag := fmt.Sprintf("%x", sum)
+	tests := []struct {
+		name    string
+		part    resultObject
+		size    int64
+		wantErr string
+	}{
+		{name: "matches", part: resultObject{Size: 14, ETag: etag}, size: 14},
+		{name: "changed content", part: resultObject{Size: 14, ETag: strings.Repeat("0", 32)}, size: 14, wantErr: "changed since the run"},
+		{name: "changed size", part: resultObject{Size: 20, ETag: etag}, size: 14, wantErr: "is 14 bytes"},
+		{name: "multipart ETag checks the size only", part: resultObject{Size: 14, ETag: strings.Repeat("0", 32) + "-3"}, size: 14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPart(tt.part, tt.size, sum[:])
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkPart() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteResultList(t *testing.T) {
+	manifest := resultManifest{Objects: 2, Bytes: 1034, Ranks: []rankResults{
+		{Rank: 0, Objects: []resultObject{{Name: "out.csv", Size: 1024, ETag: "abc"}}},
+		{Rank: 1, Objects: []resultObject{{Name: "out.csv", Size: 10, ETag: "def"}}},
+	}}
+	var out strings.Builder
+	writeResultList(&out, manifest)
+	want := `RANK  SIZE  ETAG  NAME
+0     1024  abc   out.csv
+1     10    def   out.csv
+2 objects, 1034 bytes from 2 ranks
+`
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+// BenchmarkBuildResultManifest indexes 16 results of each of 1024 ranks
+func BenchmarkBuildResultManifest(b *testing.B) {
+	var objects []awsManager.S3Object
+	for rank := range 1024 {
+		for part := range 16 {
+			objects = append(objects, awsManager.S3Object{Key: mpi.ResultKey("team-a", "job-1", rank, fmt.Sprintf("part-%02d.bin", part)), Size: 1 << 20, ETag: "abc"})
+		}
+	}
+	at := time.Now()
+	b.ResetTimer()
+	for range b.N {
+		buildResultManifest("team-a", "job-1", objects, at)
+	}
+}
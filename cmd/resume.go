@@ -0,0 +1,118 @@
+// cmd/resume.go
+// This file implements the resume-phase command, which continues a run that stopped in
+// one of its phases (see pipeline.go) from the phase that failed. The run options come
+// from the saved phase state, and the phases that completed, such as discovering the
+// instances and uploading the address manifest, are not repeated. A resumed run keeps
+// its job ID and seed; --debug-rank, --start-at, and --deadline are not recorded and do
+// not carry over.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// resumeOptions are the flags of resume-phase
+type resumeOptions struct {
+	jobID     string
+	from      string
+	stopAfter string
+}
+
+// newResumePhaseCmd returns resume-phase
+func newResumePhaseCmd() *cobra.Command {
+	o := &resumeOptions{}
+	cmd := &cobra.Command{
+		Use:   "resume-phase --job JOB_ID",
+		Short: "Resume a failed run from the phase it failed in",
+		Long: `resume-phase reads the phase state awsmpirun saved for a job on this machine and
+runs the job again from the first phase that did not complete, with the same instances,
+options, and seed. --from runs again from an earlier phase, for example "execute" to
+repeat a run whose program failed on the instances it already set up.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runResumePhase(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.jobID, "job", "", "ID of the job to resume (required)")
+	cmd.Flags().StringVar(&o.from, "from", "", "Phase to resume from: discover, setup, distribute, execute, or collect (default: the phase that failed)")
+	cmd.Flags().StringVar(&o.stopAfter, "stop-after", "", "Stop once this phase has completed, leaving the rest for another resume-phase")
+	cmd.MarkFlagRequired("job")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newResumePhaseCmd())
+}
+
+func runResumePhase(ctx context.Context, r *resumeOptions) {
+	s, err := loadRunState(r.jobID)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	o, err := resumedRunOptions(s)
+	if err != nil {
+		fmt.Printf("Error restoring the run options: %v\n", err)
+		os.Exit(1)
+	}
+
+	phases := o.runPhases()
+	if r.from != "" {
+		if err := s.rewind(phases, r.from); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	start := s.resumeIndex(phases)
+	if start == len(phases) {
+		fmt.Printf("Job %s completed every phase; pass --from to run a phase again\n", s.JobID)
+		return
+	}
+
+	o.stopAfter = r.stopAfter
+	err = o.validateStopAfter()
+	for i := 0; err == nil && i < start; i++ {
+		if phases[i].name == o.stopAfter {
+			err = fmt.Errorf("job %s already completed the %s phase", s.JobID, o.stopAfter)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Resuming job %s from the %s phase\n", s.JobID, phases[start].name)
+	if err := o.runPipeline(ctx, s, phases); err != nil {
+		reportPhaseError(s.JobID, err)
+		os.Exit(1)
+	}
+	o.reportPipelineDone(s)
+}
+
+// resumedRunOptions rebuilds the options of a saved run, keeping its job ID and seed
+func resumedRunOptions(s *runState) (*runOptions, error) {
+	o := newRunOptions()
+	flags := pflag.NewFlagSet("resume-phase", pflag.ContinueOnError)
+	o.bindRunFlags(flags)
+	if err := o.applyRunDescriptor(s.Run, flags); err != nil {
+		return nil, err
+	}
+	o.jobID, o.seedSet = s.JobID, true
+	if s.Size > 0 {
+		o.numInstances = s.Size
+	}
+	if len(s.Hosts) > 0 {
+		o.hostSelection = s.Hosts
+	}
+
+	err := o.validateLauncherOptions()
+	if err == nil {
+		err = o.validateRunInputs()
+	}
+	return o, err
+}
@@ -4,13 +4,18 @@ package cmd
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -21,24 +26,33 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var (
-	numInstances   int
-	vpcID          string
-	executablePath string
-)
+// rootOptions are the run options of the root command
+var rootOptions = newRunOptions()
+
+// defaultPprofPort is the port awsmpirun profile connects to unless told otherwise
+const defaultPprofPort = 6060
 
 var rootCmd = &cobra.Command{
 	Use:   "awsmpirun",
 	Short: "Distribute and run MPI-like programs on AWS EC2 instances",
 	Long: `awsmpirun is a CLI tool that runs a program across existing EC2 instances
 in a VPC, assigns ranks, and sets up environment variables for MPI-like communication.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		// Runs before the required flags are checked, so the manifest can supply them
+		return rootOptions.loadRunDescriptor(cmd.Flags())
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		runAWSMPIRun()
+		rootOptions.seedSet = cmd.Flags().Changed("seed")
+		runAWSMPIRun(cmd.Context(), rootOptions)
 	},
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := interruptContext(context.Background())
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
+	stop()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -46,47 +60,74 @@ func Execute() {
 
 func init() {
 	// Define flags
-	rootCmd.Flags().IntVarP(&numInstances, "num-instances", "n", 1, "Number of EC2 instances")
-	rootCmd.Flags().StringVarP(&vpcID, "vpc", "v", "", "VPC ID (required)")
-	rootCmd.Flags().StringVarP(&executablePath, "exec", "e", "", "Path to the executable on the instances (required)")
+	rootOptions.bindRunFlags(rootCmd.Flags())
 
 	// Mark required flags
 	rootCmd.MarkFlagRequired("vpc")
 	rootCmd.MarkFlagRequired("exec")
 }
 
-func runAWSMPIRun() {
-	// Step 1: Discover EC2 instances in the VPC
-	instances, err := discoverInstances(vpcID)
+func runAWSMPIRun(ctx context.Context, o *runOptions) {
+	var err error
+	o.project, err = resolveProject(o.project)
+	if err == nil {
+		err = o.validateLauncherOptions()
+	}
+	if err == nil {
+		err = o.validateRunInputs()
+	}
+	if err == nil {
+		err = o.resolveSchedule(time.Now())
+	}
+	if err == nil {
+		err = o.validateStopAfter()
+	}
+	if err == nil && o.givenJobID != "" {
+		err = validateJobID(o.givenJobID)
+	}
 	if err != nil {
-		fmt.Printf("Error discovering instances: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Step 2: Select the required number of instances
-	if len(instances) < numInstances {
-		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", numInstances, len(instances))
+	o.jobID = o.givenJobID
+	if o.jobID == "" {
+		if o.jobID, err = newJobID(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Job ID: %s\n", o.jobID)
+	if !o.seedSet {
+		if o.jobSeed, err = newJobSeed(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Seed: %d (pass --seed %d to reproduce)\n", o.jobSeed, o.jobSeed)
+	if !o.deadlineTime.IsZero() {
+		fmt.Printf("Deadline: %s (then %s)\n", o.deadlineTime.Format(time.RFC3339), o.deadlineAction)
+	}
+	if err := o.waitForStart(ctx); err != nil {
+		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-	selectedInstances := instances[:numInstances]
 
-	// Step 3: Assign ranks
-	assignRanks(selectedInstances)
-
-	// Step 4: Execute the program on all instances
-	err = executeProgram(selectedInstances)
-	if err != nil {
-		fmt.Printf("Error executing program: %v\n", err)
+	// Discover, set up, distribute, execute, and collect, saving the state after every
+	// phase so a failed run can be resumed
+	s := o.newRunState()
+	if err := o.runPipeline(ctx, s, o.runPhases()); err != nil {
+		reportPhaseError(o.jobID, err)
 		os.Exit(1)
 	}
-
-	fmt.Println("Program executed successfully on all instances.")
+	o.reportPipelineDone(s)
 }
 
-func discoverInstances(vpcID string) ([]awsManager.InstanceInfo, error) {
+// discoverInstances returns the running instances of project in the VPC
+func discoverInstances(ctx context.Context, vpcID, project string) ([]awsManager.InstanceInfo, error) {
 	// Initialize EC2 client
 	ec2ClientCreator := awsManager.EC2ClientCreator{}
-	ec2Client, err := ec2ClientCreator.CreateClient()
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create EC2 client: %v", err)
 	}
@@ -102,10 +143,14 @@ func discoverInstances(vpcID string) ([]awsManager.InstanceInfo, error) {
 				Name:   aws.String("instance-state-name"),
 				Values: []string{"running"},
 			},
+			{
+				Name:   aws.String("tag:" + projectTagKey),
+				Values: []string{project},
+			},
 		},
 	}
 
-	result, err := ec2Client.DescribeInstances(context.TODO(), input)
+	result, err := ec2Client.DescribeInstances(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to describe instances: %v", err)
 	}
@@ -118,7 +163,15 @@ func discoverInstances(vpcID string) ([]awsManager.InstanceInfo, error) {
 					InstanceID:   *instance.InstanceId,
 					PrivateIP:    *instance.PrivateIpAddress,
 					PublicIP:     aws.ToString(instance.PublicIpAddress),
+					InstanceType: string(instance.InstanceType),
+					ImageID:      aws.ToString(instance.ImageId),
 					InstanceRank: -1, // Initialize with -1
+					Tags:         awsManager.InstanceTags(instance),
+					LaunchTime:   aws.ToTime(instance.LaunchTime),
+
+					AvailabilityZone: awsManager.PlacementZone(instance),
+					PlacementGroup:   awsManager.PlacementGroup(instance),
+					Lifecycle:        awsManager.Lifecycle(instance),
 				})
 			}
 		}
@@ -127,6 +180,129 @@ func discoverInstances(vpcID string) ([]awsManager.InstanceInfo, error) {
 	return instances, nil
 }
 
+// validateRunInputs rejects resource and variable names the rank scripts cannot use
+func (o *runOptions) validateRunInputs() error {
+	if o.bucket != "" {
+		if err := validateBucketName(o.bucket); err != nil {
+			return err
+		}
+	}
+	if o.kvTable != "" {
+		if err := validateTableName(o.kvTable); err != nil {
+			return err
+		}
+	}
+	for _, entry := range o.extraEnv {
+		name, _, _ := strings.Cut(entry, "=")
+		if !validEnvName(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	if o.transport != "" {
+		if err := mpi.ValidateTransport(o.transport); err != nil {
+			return fmt.Errorf("--transport: %v", err)
+		}
+	}
+	if o.eagerLimit < -1 {
+		return fmt.Errorf("--eager-limit must be a size in bytes, or -1 for the runtime default, got %d", o.eagerLimit)
+	}
+	if o.reconnectTimeout < 0 && o.reconnectTimeout != -time.Second {
+		return fmt.Errorf("--reconnect-timeout must not be negative, or -1s for the runtime default, got %v", o.reconnectTimeout)
+	}
+	if o.collectiveTimeout < 0 {
+		return fmt.Errorf("--collective-timeout must not be negative, got %v", o.collectiveTimeout)
+	}
+	if o.timeoutPolicy != "" {
+		if err := mpi.ValidateTimeoutPolicy(o.timeoutPolicy); err != nil {
+			return fmt.Errorf("--timeout-policy: %v", err)
+		}
+	}
+	if o.broadcast != "" {
+		if err := mpi.ValidateBroadcast(o.broadcast); err != nil {
+			return fmt.Errorf("--broadcast: %v", err)
+		}
+	}
+	if o.broadcast == mpi.BroadcastUDP && o.encryptPayloads {
+		return fmt.Errorf("--broadcast udp is not supported with --encrypt-payloads, its chunks travel in the clear")
+	}
+	if o.maxClockSkew < 0 {
+		return fmt.Errorf("--max-clock-skew must not be negative, got %v", o.maxClockSkew)
+	}
+	if _, err := mpi.ParseBandwidth(o.maxBandwidth); err != nil {
+		return fmt.Errorf("--max-bandwidth-per-rank: %v", err)
+	}
+	if o.pprofPort < 0 || o.pprofPort > 65535 {
+		return fmt.Errorf("--pprof-port must be a port number, got %d", o.pprofPort)
+	}
+	if _, err := mpi.ParseLogLevel(o.logLevel, 0); err != nil {
+		return fmt.Errorf("--log-level: %v", err)
+	}
+	if _, _, err := mpi.ParseLogRate(o.logRate); err != nil {
+		return fmt.Errorf("--log-rate: %v", err)
+	}
+	if _, err := parseRequirements(o.requirements); err != nil {
+		return fmt.Errorf("--require: %v", err)
+	}
+	if o.maxPerAZ < 0 {
+		return fmt.Errorf("--max-instances-per-az must not be negative, got %d", o.maxPerAZ)
+	}
+	if err := o.validateSpawn(); err != nil {
+		return err
+	}
+	if err := o.git.validate(); err != nil {
+		return err
+	}
+	if err := o.validateSelector(); err != nil {
+		return fmt.Errorf("--instance-selector: %v", err)
+	}
+	if err := o.validateGoRuntime(); err != nil {
+		return err
+	}
+	return o.validateTargeting()
+}
+
+// reportPipelineDone prints how a run that did not fail ended
+func (o *runOptions) reportPipelineDone(s *runState) {
+	if next := s.resumeIndex(o.runPhases()); next < len(o.runPhases()) {
+		fmt.Printf("Stopped after the %s phase. Continue with: awsmpirun resume-phase --job %s\n", o.stopAfter, o.jobID)
+		return
+	}
+	fmt.Println("Program executed successfully on all instances.")
+}
+
+// reportPhaseError prints the error a run stopped with and how to resume it
+func reportPhaseError(jobID string, err error) {
+	fmt.Printf("Error: %v\n", err)
+	fmt.Printf("Resume with: awsmpirun resume-phase --job %s\n", jobID)
+}
+
+// newJobID returns an ID for a job started without --job-id, from the time and a random suffix
+func newJobID() (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate a job ID: %v", err)
+	}
+	return fmt.Sprintf("job-%s-%s", time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(suffix)), nil
+}
+
+// newJobSeed returns a random seed for jobs started without --seed
+func newJobSeed() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate a job seed: %v", err)
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func ensureKVTable(ctx context.Context, tableName string) error {
+	dynamoClientCreator := awsManager.DynamoDBClientCreator{}
+	dynamoClient, err := dynamoClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create DynamoDB client: %v", err)
+	}
+	return awsManager.EnsureKVTable(ctx, dynamoClient, tableName)
+}
+
 func assignRanks(instances []awsManager.InstanceInfo) {
 	// Assign ranks to instances
 	for i := range instances {
@@ -134,13 +310,40 @@ func assignRanks(instances []awsManager.InstanceInfo) {
 	}
 }
 
-func executeProgram(instances []awsManager.InstanceInfo) error {
-	ssmClientCreator := awsManager.SSMClientCreator{}
-	ssmClient, err := ssmClientCreator.CreateClient()
-	if err != nil {
-		return fmt.Errorf("failed to create SSM client: %v", err)
+// waitForRanks waits for the command of every rank to finish and returns the standard
+// output of the ranks that succeeded, by instance ID, and the ranks that did not. Each
+// rank finishing is recorded in journal, which may be nil.
+func waitForRanks(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, commandIDs map[string]string, journal *eventJournal) (map[string]string, []rankFailure, error) {
+	outputs := make(map[string]string)
+	var failures []rankFailure
+	for _, instance := range instances {
+		output, err := waitForCommandInvocation(ctx, ssmClient, commandIDs[instance.InstanceID], instance.InstanceID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get the result of rank %d: %v", instance.InstanceRank, err)
+		}
+		if output.Status != ssmTypes.CommandInvocationStatusSuccess {
+			failure := rankFailure{
+				Rank:       instance.InstanceRank,
+				InstanceID: instance.InstanceID,
+				Status:     string(output.Status),
+				ExitCode:   int(output.ResponseCode),
+				Stderr:     aws.ToString(output.StandardErrorContent),
+			}
+			failures = append(failures, failure)
+			event := rankEvent(eventRankFailed, instance)
+			class, reason := failure.classify()
+			event.Message = fmt.Sprintf("%s, exit code %d, %s: %s", failure.Status, failure.ExitCode, class, reason)
+			journal.record(event)
+			continue
+		}
+		outputs[instance.InstanceID] = aws.ToString(output.StandardOutputContent)
+		journal.record(rankEvent(eventRankSucceeded, instance))
 	}
+	return outputs, failures, nil
+}
 
+// sendRankCommands starts the program with a separate script per instance and returns the command ID for each
+func (o *runOptions) sendRankCommands(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo) (map[string]string, error) {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	errorsOccurred := false
@@ -153,37 +356,11 @@ func executeProgram(instances []awsManager.InstanceInfo) error {
 		go func(instance awsManager.InstanceInfo) {
 			defer wg.Done()
 
-			// Prepare environment variables as a string
-			var envVars []string
-			envVars = append(envVars, fmt.Sprintf("export MPI_RANK=%d", instance.InstanceRank))
-			envVars = append(envVars, fmt.Sprintf("export MPI_SIZE=%d", len(instances)))
-
-			for _, inst := range instances {
-				address := inst.PrivateIP
-				if address == "" {
-					address = inst.PublicIP
-				}
-				if inst.InstanceID == instance.InstanceID {
-					address = "0.0.0.0" // For the local instance
-				}
-				envVars = append(envVars, fmt.Sprintf(`export MPI_ADDRESS_%d="%s:50051"`, inst.InstanceRank, address))
-			}
+			script := o.buildRankScript(instance, instances, o.executablePath, ssmClient.Options().Region)
 
-			// Build the script to set environment variables and run the program
-			script := fmt.Sprintf(`#!/bin/bash
-%s
-%s > output.txt 2>&1
-`, strings.Join(envVars, "\n"), executablePath)
-
-			input := &ssm.SendCommandInput{
-				DocumentName: aws.String("AWS-RunShellScript"),
-				Parameters: map[string][]string{
-					"commands": {script},
-				},
-				InstanceIds:    []string{instance.InstanceID},
-				TimeoutSeconds: aws.Int32(600),
-			}
-			result, err := ssmClient.SendCommand(context.TODO(), input)
+			input := shellScriptInput(script, o.executionTimeout())
+			input.InstanceIds = []string{instance.InstanceID}
+			result, err := ssmClient.SendCommand(ctx, input)
 			if err != nil {
 				fmt.Printf("Failed to execute program on instance %s: %v\n", instance.InstanceID, err)
 				mu.Lock()
@@ -203,27 +380,110 @@ func executeProgram(instances []awsManager.InstanceInfo) error {
 	wg.Wait()
 
 	if errorsOccurred {
-		return fmt.Errorf("errors occurred during program execution")
+		return nil, fmt.Errorf("errors occurred during program execution")
 	}
+	return commandIDs, nil
+}
 
-	// Retrieve and display output from rank 0
-	for _, instance := range instances {
-		if instance.InstanceRank == 0 {
-			commandID := commandIDs[instance.InstanceID]
-			output, err := getCommandOutput(ssmClient, commandID, instance.InstanceID)
-			if err != nil {
-				return fmt.Errorf("failed to get output from rank 0: %v", err)
-			}
-			fmt.Println("Output from rank 0:")
-			fmt.Println(output)
-			break
-		}
+// writeJobEnv exports the variables that are the same on every rank
+func (o *runOptions) writeJobEnv(script *shellScript, region string) {
+	script.Export("MPI_JOB_ID", o.jobID)
+	if o.project != "" {
+		script.Export("MPI_PROJECT", o.project)
 	}
+	script.Export("MPI_SEED", o.jobSeed)
+	script.Export("MPI_WORK_DIR", o.workDirValue())
+	if o.kvTable != "" {
+		script.Export("MPI_KV_TABLE", o.kvTable)
+	}
+	if o.bucket != "" {
+		script.Export("MPI_BUCKET", o.bucket)
+	}
+	if o.encryptPayloads {
+		script.Export(mpi.EnvPayloadKeyParameter, o.payloadKeyParameter())
+	}
+	if o.kvTable != "" || o.bucket != "" || o.encryptPayloads {
+		script.Export("AWS_REGION", region)
+	}
+	for _, entry := range o.extraEnv {
+		name, value, _ := strings.Cut(entry, "=")
+		script.Export(name, value)
+	}
+	if o.connectConcurrency > 0 {
+		script.Export("MPI_CONNECT_CONCURRENCY", o.connectConcurrency)
+	}
+	if timeout := o.debugConnectTimeout(); timeout > 0 {
+		script.Export("MPI_CONNECT_TIMEOUT", timeout.String())
+	}
+	if o.connectStagger > 0 {
+		script.Export("MPI_CONNECT_STAGGER", o.connectStagger.String())
+	}
+	if o.minRanks > 0 {
+		script.Export("MPI_MIN_RANKS", o.minRanks)
+	}
+	if o.transport != "" {
+		script.Export("MPI_TRANSPORT", o.transport)
+	}
+	if o.eagerLimit >= 0 {
+		script.Export("MPI_EAGER_LIMIT", o.eagerLimit)
+	}
+	if o.reconnectTimeout >= 0 {
+		script.Export(mpi.EnvReconnectTimeout, o.reconnectTimeout.String())
+	}
+	if o.collectiveTimeout > 0 {
+		script.Export(mpi.EnvCollectiveTimeout, o.collectiveTimeout.String())
+	}
+	if o.timeoutPolicy != "" {
+		script.Export(mpi.EnvTimeoutPolicy, o.timeoutPolicy)
+	}
+	if o.maxBandwidth != "" {
+		script.Export("MPI_MAX_BANDWIDTH", o.maxBandwidth)
+	}
+	if o.broadcast != "" {
+		script.Export(mpi.EnvBroadcast, o.broadcast)
+	}
+	if o.maxSpawnRanks > 0 {
+		script.Export(mpi.EnvMaxSpawn, o.maxSpawnRanks)
+	}
+	if o.maxClockSkew > 0 {
+		script.Export(mpi.EnvMaxClockSkew, o.maxClockSkew.String())
+	}
+	if o.pprofPort > 0 {
+		script.Export("MPI_PPROF_PORT", o.pprofPort)
+	}
+	if o.logLevel != "" {
+		script.Export("MPI_LOG_LEVEL", o.logLevel)
+	}
+	if o.logRate != "" {
+		script.Export("MPI_LOG_RATE", o.logRate)
+	}
+	if hash := o.pinnedProgramHash(); hash != "" {
+		script.Export("MPI_EXPECT_SHA256", hash)
+	}
+	o.writeGoRuntimeEnv(script)
+}
 
-	return nil
+// buildRankScript returns the shell script that sets up the MPI environment for one rank and runs command
+func (o *runOptions) buildRankScript(instance awsManager.InstanceInfo, instances []awsManager.InstanceInfo, command, region string) string {
+	script := newShellScript()
+	script.Export("MPI_RANK", instance.InstanceRank)
+	script.Export("MPI_SIZE", len(instances))
+	o.writeJobEnv(script, region)
+
+	// The table goes in a file, which unlike one variable per rank has no size limit
+	table := mpi.AddressFile(o.jobID)
+	script.Linef("mkdir -p %s", filepath.Dir(table))
+	script.Linef(`printf '%%s\n' %s > %s`, string(addressTable(instances)), table)
+
+	script.Raw(workDirSetup())
+	o.writeSourceCheckout(script, region)
+	script.Raw(o.rankLaunch(command))
+	return script.String()
 }
 
-func getCommandOutput(ssmClient *ssm.Client, commandID, instanceID string) (string, error) {
+// waitForCommandInvocation polls a command invocation until it reaches a terminal status
+// or ctx is done
+func waitForCommandInvocation(ctx context.Context, ssmClient *ssm.Client, commandID, instanceID string) (*ssm.GetCommandInvocationOutput, error) {
 	input := &ssm.GetCommandInvocationInput{
 		CommandId:  aws.String(commandID),
 		InstanceId: aws.String(instanceID),
@@ -231,26 +491,26 @@ func getCommandOutput(ssmClient *ssm.Client, commandID, instanceID string) (stri
 
 	// Poll for command completion
 	for {
-		output, err := ssmClient.GetCommandInvocation(context.TODO(), input)
+		output, err := ssmClient.GetCommandInvocation(ctx, input)
 		if err != nil {
-			// If it's a throttling error, wait and retry
-			if strings.Contains(err.Error(), "ThrottlingException") {
-				time.Sleep(2 * time.Second)
+			// If it's a throttling error, or the invocation is not registered yet, wait and retry
+			if strings.Contains(err.Error(), "ThrottlingException") || strings.Contains(err.Error(), "InvocationDoesNotExist") {
+				if err := awsManager.SleepContext(ctx, 2*time.Second); err != nil {
+					return nil, fmt.Errorf("stopped waiting for command %s: %w", commandID, err)
+				}
 				continue
 			}
-			return "", fmt.Errorf("failed to get command invocation: %v", err)
+			return nil, fmt.Errorf("failed to get command invocation: %w", err)
 		}
 
 		status := output.Status
-		if status == ssmTypes.CommandInvocationStatusInProgress || status == ssmTypes.CommandInvocationStatusPending {
-			time.Sleep(2 * time.Second)
+		if status == ssmTypes.CommandInvocationStatusInProgress || status == ssmTypes.CommandInvocationStatusPending || status == ssmTypes.CommandInvocationStatusDelayed {
+			if err := awsManager.SleepContext(ctx, 2*time.Second); err != nil {
+				return nil, fmt.Errorf("stopped waiting for command %s: %w", commandID, err)
+			}
 			continue
 		}
 
-		if status == ssmTypes.CommandInvocationStatusSuccess {
-			return aws.ToString(output.StandardOutputContent), nil
-		}
-
-		return "", fmt.Errorf("command failed with status %s: %s", status, aws.ToString(output.StandardErrorContent))
+		return output, nil
 	}
 }
@@ -0,0 +1,219 @@
+// cmd/schedule.go
+// This file implements scheduled runs. --start-at submits a run now that waits, before
+// discovering its instances, until an off-peak time; --deadline is the latest time the
+// run may still be going. A phase is not started after the deadline, and ranks still
+// running when it passes have their commands cancelled. --deadline-action decides what
+// then happens to the instances: they keep running by default, "stop" stops them and
+// "terminate" terminates them, so an overnight batch job cannot run up costs into the
+// next day.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// What happens to the instances of a run when its deadline passes
+const (
+	deadlineCancel    = "cancel"
+	deadlineStop      = "stop"
+	deadlineTerminate = "terminate"
+)
+
+// deadlineTerminateTimeout is how long a run waits for its instances to terminate
+const deadlineTerminateTimeout = 10 * time.Minute
+
+// deadlineGrace is how long past the deadline SSM lets the rank scripts run, so the
+// deadline cancels them before SSM times them out
+const deadlineGrace = 5 * time.Minute
+
+// Layouts --start-at and --deadline accept besides RFC 3339, in local time
+var scheduleLayouts = []string{"2006-01-02 15:04", "2006-01-02T15:04"}
+
+// parseScheduleTime parses a --start-at time: an RFC 3339 time, a local date and time
+// such as "2024-06-01 02:00", or a local clock time such as "02:00", taken as its
+// next occurrence after now
+func parseScheduleTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range scheduleLayouts {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	clock, err := time.ParseInLocation("15:04", value, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339, \"2006-01-02 15:04\", or \"15:04\"", value)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseDeadline parses a --deadline: a duration counted from start, such as "6h", or
+// a time as parseScheduleTime takes it
+func parseDeadline(value string, start time.Time) (time.Time, error) {
+	var deadline time.Time
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("deadline %q must be positive", value)
+		}
+		deadline = start.Add(d)
+	} else {
+		deadline, err = parseScheduleTime(value, start)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if !deadline.After(start) {
+		return time.Time{}, fmt.Errorf("deadline %s is not after the start of the run at %s", deadline.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	return deadline, nil
+}
+
+// resolveSchedule sets the start time and deadline of the run from --start-at and
+// --deadline, relative to now
+func (o *runOptions) resolveSchedule(now time.Time) error {
+	switch o.deadlineAction {
+	case deadlineCancel, deadlineStop, deadlineTerminate:
+	default:
+		return fmt.Errorf("--deadline-action must be cancel, stop, or terminate, got %q", o.deadlineAction)
+	}
+	start := now
+	if o.startAt != "" {
+		t, err := parseScheduleTime(o.startAt, now)
+		if err != nil {
+			return fmt.Errorf("--start-at: %v", err)
+		}
+		if t.After(now) {
+			start = t
+		}
+		o.startTime = t
+	}
+	if o.deadline != "" {
+		t, err := parseDeadline(o.deadline, start)
+		if err != nil {
+			return fmt.Errorf("--deadline: %v", err)
+		}
+		o.deadlineTime = t
+	}
+	return nil
+}
+
+// waitForStart sleeps until the --start-at time, if it is still ahead, or until ctx is done
+func (o *runOptions) waitForStart(ctx context.Context) error {
+	wait := time.Until(o.startTime)
+	if wait <= 0 {
+		return nil
+	}
+	fmt.Printf("Waiting until %s to start (%s)\n", o.startTime.Format(time.RFC3339), wait.Round(time.Second))
+	if err := awsManager.SleepContext(ctx, wait); err != nil {
+		return fmt.Errorf("stopped waiting for --start-at: %w", err)
+	}
+	return nil
+}
+
+// pastDeadline reports whether the run's deadline has passed
+func (o *runOptions) pastDeadline() bool {
+	return !o.deadlineTime.IsZero() && !time.Now().Before(o.deadlineTime)
+}
+
+// executionTimeout returns how many seconds SSM lets the rank scripts of the run go on:
+// until a little past the deadline, or as long as SSM allows when the run has none
+func (o *runOptions) executionTimeout() int {
+	if o.deadlineTime.IsZero() {
+		return maxExecutionTimeout
+	}
+	remaining := int(time.Until(o.deadlineTime.Add(deadlineGrace)).Seconds())
+	return min(max(remaining, 1), maxExecutionTimeout)
+}
+
+// deadlineWatch cancels the rank commands of a run when its deadline passes
+type deadlineWatch struct {
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// watchDeadline starts cancelling the commands when the deadline passes; it returns
+// nil when the run has no deadline
+func (o *runOptions) watchDeadline(ctx context.Context, ssmClient *ssm.Client, commandIDs map[string]string) *deadlineWatch {
+	if o.deadlineTime.IsZero() {
+		return nil
+	}
+	w := &deadlineWatch{}
+	w.timer = time.AfterFunc(time.Until(o.deadlineTime), func() {
+		w.expired.Store(true)
+		fmt.Printf("Deadline %s passed, cancelling the ranks\n", o.deadlineTime.Format(time.RFC3339))
+		cancelled := make(map[string]bool)
+		for _, commandID := range commandIDs {
+			if cancelled[commandID] {
+				continue
+			}
+			cancelled[commandID] = true
+			if _, err := ssmClient.CancelCommand(ctx, &ssm.CancelCommandInput{CommandId: aws.String(commandID)}); err != nil {
+				fmt.Printf("Warning: failed to cancel command %s: %v\n", commandID, err)
+			}
+		}
+	})
+	return w
+}
+
+// Stop ends the watch and reports whether the deadline passed while it ran
+func (w *deadlineWatch) Stop() bool {
+	if w == nil {
+		return false
+	}
+	w.timer.Stop()
+	return w.expired.Load()
+}
+
+// deadlineExceeded releases the instances of a run that ran out of time and returns
+// the error the run stops with; when says when the deadline passed
+func (o *runOptions) deadlineExceeded(ctx context.Context, instances []awsManager.InstanceInfo, when string) error {
+	err := fmt.Errorf("deadline %s passed %s", o.deadlineTime.Format(time.RFC3339), when)
+	if len(instances) == 0 {
+		return err
+	}
+	if releaseErr := o.releaseInstances(ctx, instances); releaseErr != nil {
+		return fmt.Errorf("%v; releasing the instances failed: %v", err, releaseErr)
+	}
+	return err
+}
+
+// releaseInstances applies --deadline-action to the instances of a run that ran out
+// of time
+func (o *runOptions) releaseInstances(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	if o.deadlineAction == deadlineCancel {
+		return nil
+	}
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create EC2 client: %v", err)
+	}
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	if o.deadlineAction == deadlineTerminate {
+		fmt.Printf("Terminating %d instances\n", len(ids))
+		return awsManager.TerminateInstances(ctx, ec2Client, ids, deadlineTerminateTimeout)
+	}
+	fmt.Printf("Stopping %d instances\n", len(ids))
+	if _, err := ec2Client.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: ids}); err != nil {
+		return fmt.Errorf("failed to stop instances: %v", err)
+	}
+	return nil
+}
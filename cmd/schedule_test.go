@@ -0,0 +1,264 @@
+// cmd/schedule_test.go
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2024-06-02T02:00:00Z", want: time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{value: "2024-06-02 02:00", want: time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{value: "23:15", want: time.Date(2024, 6, 1, 23, 15, 0, 0, time.UTC)},
+		{value: "02:00", want: time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{value: "22:30", want: time.Date(2024, 6, 2, 22, 30, 0, 0, time.UTC)},
+		{value: "tonight", wantErr: true},
+		{value: "25:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseScheduleTime(tt.value, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("%q = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSchedule(t *testing.T) {
+	now := time.Date(2024, 6, 1, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		startAt      string
+		deadline     string
+		action       string
+		wantStart    time.Time
+		wantDeadline time.Time
+		wantErr      string
+	}{
+		{name: "no schedule", action: deadlineCancel},
+		{name: "duration from now", deadline: "6h", action: deadlineCancel,
+			wantDeadline: now.Add(6 * time.Hour)},
+		{name: "duration from the start", startAt: "02:00", deadline: "4h", action: deadlineTerminate,
+			wantStart:    time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC),
+			wantDeadline: time.Date(2024, 6, 2, 6, 0, 0, 0, time.UTC)},
+		{name: "clock deadline after the start", startAt: "02:00", deadline: "07:00", action: deadlineStop,
+			wantStart:    time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC),
+			wantDeadline: time.Date(2024, 6, 2, 7, 0, 0, 0, time.UTC)},
+		{name: "deadline before the start", startAt: "2024-06-02 02:00", deadline: "2024-06-02 01:00", action: deadlineCancel,
+			wantErr: "not after the start"},
+		{name: "negative duration", deadline: "-1h", action: deadlineCancel, wantErr: "must be positive"},
+		{name: "bad start", startAt: "soon", action: deadlineCancel, wantErr: "--start-at"},
+		{name: "bad action", action: "hibernate", wantErr: "--deadline-action"},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.startAt, o.deadline, o.deadlineAction = tt.startAt, tt.deadline, tt.action
+		err := o.resolveSchedule(now)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !o.startTime.Equal(tt.wantStart) || !o.deadlineTime.Equal(tt.wantDeadline) {
+			t.Errorf("%s: start %s, deadline %s", tt.name, o.startTime, o.deadlineTime)
+		}
+	}
+}
+
+func TestRunPipelineStopsAtDeadline(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath = "job-1", "vpc-1", "./solver"
+	o.deadlineTime = time.Now().Add(-time.Minute)
+	s := o.newRunState()
+
+	var ran []string
+	err := o.runPipeline(context.Background(), s, fakePhases(&ran, nil))
+	var failed *phaseError
+	if !errors.As(err, &failed) || failed.phase != phaseDiscover || !strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("err = %v, want a deadline error in the discover phase", err)
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran %v after the deadline", ran)
+	}
+}
+
+// fakeSSM records the commands sent to it, which all succeed at once
+type fakeSSM struct {
+	mu       sync.Mutex
+	commands []fakeSSMCommand
+}
+
+// fakeSSMCommand is the script and execution timeout of a SendCommand
+type fakeSSMCommand struct {
+	script           string
+	executionTimeout string // Empty when not set
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body struct {
+		Parameters map[string][]string
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSSM.SendCommand":
+		command := fakeSSMCommand{script: strings.Join(body.Parameters["commands"], "\n")}
+		if timeout := body.Parameters["executionTimeout"]; len(timeout) > 0 {
+			command.executionTimeout = timeout[0]
+		}
+		f.commands = append(f.commands, command)
+		fmt.Fprintf(w, `{"Command":{"CommandId":"cmd-%d"}}`, len(f.commands))
+	case "AmazonSSM.GetCommandInvocation":
+		fmt.Fprint(w, `{"Status":"Success","StandardOutputContent":"ok"}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"InvalidAction","message":"not faked"}`)
+	}
+}
+
+// sent returns the commands sent so far
+func (f *fakeSSM) sent() []fakeSSMCommand {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSSMCommand(nil), f.commands...)
+}
+
+func newFakeSSM(t *testing.T, f *fakeSSM) *ssm.Client {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return ssm.New(ssm.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestExecutionTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration // From now; 0 for no deadline
+		want     int
+	}{
+		{name: "no deadline", want: maxExecutionTimeout},
+		{name: "deadline ahead", deadline: 2 * time.Hour, want: int((2*time.Hour + deadlineGrace).Seconds())},
+		{name: "deadline passed", deadline: -time.Hour, want: 1},
+		{name: "deadline beyond the SSM limit", deadline: 72 * time.Hour, want: maxExecutionTimeout},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		if tt.deadline != 0 {
+			o.deadlineTime = time.Now().Add(tt.deadline)
+		}
+		// A second may pass between setting the deadline and reading it
+		if got := o.executionTimeout(); got != tt.want && got != tt.want-1 {
+			t.Errorf("%s: executionTimeout() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRankCommandsExecutionTimeout(t *testing.T) {
+	ctx := context.Background()
+	o := newRunOptions()
+	o.jobID, o.project, o.executablePath = "job-1", "team-a", "./solver"
+	o.deadlineTime = time.Now().Add(3 * time.Hour)
+	want := o.executionTimeout()
+	// A second may pass between the commands
+	checkTimeout := func(what, value string) {
+		if got, err := strconv.Atoi(value); err != nil || got < want-1 || got > want {
+			t.Errorf("%s: executionTimeout = %q, want %d", what, value, want)
+		}
+	}
+
+	// Every path that starts ranks
+	f := &fakeSSM{}
+	client := newFakeSSM(t, f)
+	if _, err := o.sendRankCommands(ctx, client, testInstances()); err != nil {
+		t.Fatalf("sendRankCommands: %v", err)
+	}
+	if _, err := startManifestCommands(ctx, client, testInstances(), "#!/bin/bash\n", o.executionTimeout()); err != nil {
+		t.Fatalf("startManifestCommands: %v", err)
+	}
+	if _, err := sendScripts(ctx, client, map[string]string{"i-0": "#!/bin/bash\n"}, o.executionTimeout()); err != nil {
+		t.Fatalf("sendScripts: %v", err)
+	}
+	commands := f.sent()
+	if len(commands) != 4 {
+		t.Fatalf("sent %d commands, want 2 rank scripts, 1 manifest launch, and 1 spawned rank", len(commands))
+	}
+	for i, command := range commands {
+		checkTimeout(fmt.Sprintf("command %d", i), command.executionTimeout)
+	}
+	input := o.clusterCommandInput("#!/bin/bash\n", 2)
+	checkTimeout("tag-targeted command", strings.Join(input.Parameters["executionTimeout"], ","))
+
+	// Administrative scripts keep the default of an hour
+	f = &fakeSSM{}
+	if _, err := runScriptOnInstances(ctx, newFakeSSM(t, f), testInstances(), func(awsManager.InstanceInfo) string { return "true" }); err != nil {
+		t.Fatalf("runScriptOnInstances: %v", err)
+	}
+	for _, command := range f.sent() {
+		if command.executionTimeout != "" {
+			t.Errorf("administrative script: executionTimeout = %q, want none", command.executionTimeout)
+		}
+	}
+}
+
+func TestWaitForStartCancelled(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   time.Time
+		wantErr bool
+	}{
+		{name: "no start time"},
+		{name: "start time passed", start: time.Now().Add(-time.Minute)},
+		{name: "start time ahead", start: time.Now().Add(time.Hour), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			o := newRunOptions()
+			o.startTime = tt.start
+			if err := o.waitForStart(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("waitForStart = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
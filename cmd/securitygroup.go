@@ -0,0 +1,278 @@
+// cmd/securitygroup.go
+// This file implements --job-security-group. Instead of relying on a long-lived group
+// that opens the rank port to the whole VPC, the execute phase creates a security group
+// for the job that allows only the rank port, and only between the members of the
+// group, and adds it to the primary network interface of every rank. When the ranks
+// have finished, failed, or been stopped at the deadline, the group is taken off the
+// interfaces again and deleted, so the port is open only while the job runs. A resumed
+// execute phase reuses the group an interrupted attempt left behind.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// jobTagKey tags the resources created for a single job with its job ID
+const jobTagKey = "awsmpirun:job"
+
+// securityGroupDeleteTimeout bounds how long deleting the job's group waits for EC2 to
+// finish detaching it from the interfaces
+const securityGroupDeleteTimeout = time.Minute
+
+// securityGroupDeleteRetry is the first wait before deleting the group again
+var securityGroupDeleteRetry = time.Second
+
+// jobSecurityGroupName is the name of the job's security group
+func jobSecurityGroupName(jobID string) string {
+	return "awsmpirun-job-" + jobID
+}
+
+// rankPortPermissions allows the rank port from and to the members of groupID only
+func rankPortPermissions(groupID string) []ec2Types.IpPermission {
+	return []ec2Types.IpPermission{{
+		IpProtocol:       aws.String("tcp"),
+		FromPort:         aws.Int32(rankPort),
+		ToPort:           aws.Int32(rankPort),
+		UserIdGroupPairs: []ec2Types.UserIdGroupPair{{GroupId: aws.String(groupID), Description: aws.String("awsmpirun ranks of the job")}},
+	}}
+}
+
+// jobPortPermissions allows what the ranks of the job send each other: the rank port
+// over TCP, and over UDP too when large broadcasts travel over UDP
+func (o *runOptions) jobPortPermissions(groupID string) []ec2Types.IpPermission {
+	permissions := rankPortPermissions(groupID)
+	if o.broadcast == mpi.BroadcastUDP {
+		udp := permissions[0]
+		udp.IpProtocol = aws.String("udp")
+		permissions = append(permissions, udp)
+	}
+	return permissions
+}
+
+// defaultEgress is the allow-all egress rule EC2 gives every new group
+var defaultEgress = []ec2Types.IpPermission{{
+	IpProtocol: aws.String("-1"),
+	IpRanges:   []ec2Types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+}}
+
+// withGroup returns groups with groupID added, once
+func withGroup(groups []string, groupID string) []string {
+	if slices.Contains(groups, groupID) {
+		return groups
+	}
+	return append(slices.Clone(groups), groupID)
+}
+
+// withoutGroup returns groups with groupID removed
+func withoutGroup(groups []string, groupID string) []string {
+	return slices.DeleteFunc(slices.Clone(groups), func(id string) bool { return id == groupID })
+}
+
+// networkInterface is an interface and the security groups it is in
+type networkInterface struct {
+	ID     string
+	Groups []string
+}
+
+// primaryInterfaces returns the primary network interface of every instance in
+// reservations, by instance ID; the ranks connect over its private address
+func primaryInterfaces(reservations []ec2Types.Reservation) map[string]networkInterface {
+	interfaces := make(map[string]networkInterface)
+	for _, reservation := range reservations {
+		for _, instance := range reservation.Instances {
+			for _, eni := range instance.NetworkInterfaces {
+				if eni.Attachment == nil || aws.ToInt32(eni.Attachment.DeviceIndex) != 0 {
+					continue
+				}
+				var groups []string
+				for _, group := range eni.Groups {
+					groups = append(groups, aws.ToString(group.GroupId))
+				}
+				interfaces[aws.ToString(instance.InstanceId)] = networkInterface{ID: aws.ToString(eni.NetworkInterfaceId), Groups: groups}
+			}
+		}
+	}
+	return interfaces
+}
+
+// hasErrorCode reports whether err is an AWS API error with code
+func hasErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
+
+// openJobSecurityGroup creates the job's security group, or finds the one an earlier
+// attempt left, and adds it to the primary interface of every instance. It returns
+// the group's ID, which is set whenever the group exists, even on error, so the
+// caller can remove it.
+func (o *runOptions) openJobSecurityGroup(ctx context.Context, ec2Client *ec2.Client, instances []awsManager.InstanceInfo) (string, error) {
+	groupID, err := o.createJobSecurityGroup(ctx, ec2Client)
+	if err != nil {
+		return groupID, err
+	}
+
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.InstanceID
+	}
+	var reservations []ec2Types.Reservation
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return groupID, fmt.Errorf("failed to describe the network interfaces of the instances: %v", err)
+		}
+		reservations = append(reservations, page.Reservations...)
+	}
+	interfaces := primaryInterfaces(reservations)
+	for _, instance := range instances {
+		eni, ok := interfaces[instance.InstanceID]
+		if !ok {
+			return groupID, fmt.Errorf("instance %s has no primary network interface", instance.InstanceID)
+		}
+		groups := withGroup(eni.Groups, groupID)
+		if len(groups) == len(eni.Groups) {
+			continue
+		}
+		_, err := ec2Client.ModifyNetworkInterfaceAttribute(ctx, &ec2.ModifyNetworkInterfaceAttributeInput{
+			NetworkInterfaceId: aws.String(eni.ID),
+			Groups:             groups,
+		})
+		if err != nil {
+			return groupID, fmt.Errorf("failed to add security group %s to instance %s: %v", groupID, instance.InstanceID, err)
+		}
+	}
+	fmt.Printf("Opened the rank port between the %d instances in security group %s\n", len(instances), groupID)
+	return groupID, nil
+}
+
+// createJobSecurityGroup creates the job's group with its rules in the run's VPC
+func (o *runOptions) createJobSecurityGroup(ctx context.Context, ec2Client *ec2.Client) (string, error) {
+	name := jobSecurityGroupName(o.jobID)
+	tags := map[string]string{projectTagKey: o.project, jobTagKey: o.jobID, "Name": name}
+	result, err := ec2Client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("Rank port of awsmpirun job " + o.jobID),
+		VpcId:       aws.String(o.vpcID),
+		TagSpecifications: []ec2Types.TagSpecification{
+			{ResourceType: ec2Types.ResourceTypeSecurityGroup, Tags: ec2Tags(tags)},
+		},
+	})
+	var groupID string
+	switch {
+	case err == nil:
+		groupID = aws.ToString(result.GroupId)
+	case hasErrorCode(err, "InvalidGroup.Duplicate"):
+		groupID, err = findSecurityGroup(ctx, ec2Client, o.vpcID, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("Reusing security group %s of an earlier attempt at the job\n", groupID)
+	default:
+		return "", fmt.Errorf("failed to create security group %s: %v", name, err)
+	}
+
+	// A reused group may have its rules already
+	_, err = ec2Client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: o.jobPortPermissions(groupID),
+	})
+	if err != nil && !hasErrorCode(err, "InvalidPermission.Duplicate") {
+		return groupID, fmt.Errorf("failed to allow the rank port into security group %s: %v", groupID, err)
+	}
+	_, err = ec2Client.RevokeSecurityGroupEgress(ctx, &ec2.RevokeSecurityGroupEgressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: defaultEgress,
+	})
+	if err != nil && !hasErrorCode(err, "InvalidPermission.NotFound") {
+		return groupID, fmt.Errorf("failed to remove the default egress rule of security group %s: %v", groupID, err)
+	}
+	_, err = ec2Client.AuthorizeSecurityGroupEgress(ctx, &ec2.AuthorizeSecurityGroupEgressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: o.jobPortPermissions(groupID),
+	})
+	if err != nil && !hasErrorCode(err, "InvalidPermission.Duplicate") {
+		return groupID, fmt.Errorf("failed to allow the rank port out of security group %s: %v", groupID, err)
+	}
+	return groupID, nil
+}
+
+// findSecurityGroup returns the ID of the security group named name in the VPC
+func findSecurityGroup(ctx context.Context, ec2Client *ec2.Client, vpcID, name string) (string, error) {
+	result, err := ec2Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []ec2Types.Filter{
+			{Name: aws.String("vpc-id"), Values: []string{vpcID}},
+			{Name: aws.String("group-name"), Values: []string{name}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to find security group %s: %v", name, err)
+	}
+	if len(result.SecurityGroups) == 0 {
+		return "", fmt.Errorf("security group %s was not found in %s", name, vpcID)
+	}
+	return aws.ToString(result.SecurityGroups[0].GroupId), nil
+}
+
+// closeJobSecurityGroup takes the job's group off every interface it is on, including
+// any added since it was opened, and deletes it
+func closeJobSecurityGroup(ctx context.Context, ec2Client *ec2.Client, groupID string) error {
+	paginator := ec2.NewDescribeNetworkInterfacesPaginator(ec2Client, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []ec2Types.Filter{{Name: aws.String("group-id"), Values: []string{groupID}}},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find the interfaces in security group %s: %v", groupID, err)
+		}
+		for _, eni := range page.NetworkInterfaces {
+			var groups []string
+			for _, group := range eni.Groups {
+				groups = append(groups, aws.ToString(group.GroupId))
+			}
+			// An interface must stay in at least one group; this never happens to the
+			// ranks, which were in their own groups before the job's was added
+			groups = withoutGroup(groups, groupID)
+			if len(groups) == 0 {
+				return fmt.Errorf("interface %s is in no security group but %s", aws.ToString(eni.NetworkInterfaceId), groupID)
+			}
+			_, err := ec2Client.ModifyNetworkInterfaceAttribute(ctx, &ec2.ModifyNetworkInterfaceAttributeInput{
+				NetworkInterfaceId: eni.NetworkInterfaceId,
+				Groups:             groups,
+			})
+			// The interfaces of instances terminated at the deadline go with them
+			if err != nil && !hasErrorCode(err, "InvalidNetworkInterfaceID.NotFound") {
+				return fmt.Errorf("failed to remove security group %s from interface %s: %v", groupID, aws.ToString(eni.NetworkInterfaceId), err)
+			}
+		}
+	}
+
+	// EC2 reports the group in use until it has processed the interface changes
+	deadline := time.Now().Add(securityGroupDeleteTimeout)
+	for wait := securityGroupDeleteRetry; ; wait = min(2*wait, 10*time.Second) {
+		_, err := ec2Client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(groupID)})
+		if err == nil || hasErrorCode(err, "InvalidGroup.NotFound") {
+			fmt.Printf("Deleted security group %s\n", groupID)
+			return nil
+		}
+		if !hasErrorCode(err, "DependencyViolation") || time.Now().After(deadline) {
+			return fmt.Errorf("failed to delete security group %s: %v", groupID, err)
+		}
+		if err := awsManager.SleepContext(ctx, wait); err != nil {
+			return fmt.Errorf("failed to delete security group %s: %v", groupID, err)
+		}
+	}
+}
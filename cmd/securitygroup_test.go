@@ -0,0 +1,291 @@
+// cmd/securitygroup_test.go
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestWithGroup(t *testing.T) {
+	tests := []struct {
+		groups  []string
+		with    []string
+		without []string
+	}{
+		{groups: nil, with: []string{"sg-job"}, without: nil},
+		{groups: []string{"sg-a"}, with: []string{"sg-a", "sg-job"}, without: []string{"sg-a"}},
+		{groups: []string{"sg-a", "sg-job", "sg-b"}, with: []string{"sg-a", "sg-job", "sg-b"}, without: []string{"sg-a", "sg-b"}},
+	}
+	for _, tt := range tests {
+		original := append([]string(nil), tt.groups...)
+		if got := withGroup(tt.groups, "sg-job"); !reflect.DeepEqual(got, tt.with) {
+			t.Errorf("withGroup(%v) = %v, want %v", tt.groups, got, tt.with)
+		}
+		if got := withoutGroup(tt.groups, "sg-job"); len(got) != len(tt.without) || (len(got) > 0 && !reflect.DeepEqual(got, tt.without)) {
+			t.Errorf("withoutGroup(%v) = %v, want %v", tt.groups, got, tt.without)
+		}
+		if !reflect.DeepEqual(tt.groups, original) {
+			t.Errorf("groups changed to %v", tt.groups)
+		}
+	}
+}
+
+func TestPrimaryInterfaces(t *testing.T) {
+	eni := func(id string, index int32, groups ...string) ec2Types.InstanceNetworkInterface {
+		var set []ec2Types.GroupIdentifier
+		for _, group := range groups {
+			set = append(set, ec2Types.GroupIdentifier{GroupId: aws.String(group)})
+		}
+		return ec2Types.InstanceNetworkInterface{
+			NetworkInterfaceId: aws.String(id),
+			Attachment:         &ec2Types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(index)},
+			Groups:             set,
+		}
+	}
+	reservations := []ec2Types.Reservation{
+		{Instances: []ec2Types.Instance{
+			{InstanceId: aws.String("i-1"), NetworkInterfaces: []ec2Types.InstanceNetworkInterface{eni("eni-efa", 1, "sg-efa"), eni("eni-1", 0, "sg-a", "sg-b")}},
+			{InstanceId: aws.String("i-2"), NetworkInterfaces: []ec2Types.InstanceNetworkInterface{{NetworkInterfaceId: aws.String("eni-detached")}}},
+		}},
+		{Instances: []ec2Types.Instance{
+			{InstanceId: aws.String("i-3"), NetworkInterfaces: []ec2Types.InstanceNetworkInterface{eni("eni-3", 0, "sg-a")}},
+		}},
+	}
+	want := map[string]networkInterface{
+		"i-1": {ID: "eni-1", Groups: []string{"sg-a", "sg-b"}},
+		"i-3": {ID: "eni-3", Groups: []string{"sg-a"}},
+	}
+	if got := primaryInterfaces(reservations); !reflect.DeepEqual(got, want) {
+		t.Errorf("primaryInterfaces() = %v, want %v", got, want)
+	}
+}
+
+func TestRankPortPermissions(t *testing.T) {
+	permissions := rankPortPermissions("sg-job")
+	if len(permissions) != 1 {
+		t.Fatalf("got %d permissions, want 1", len(permissions))
+	}
+	p := permissions[0]
+	if aws.ToString(p.IpProtocol) != "tcp" || aws.ToInt32(p.FromPort) != rankPort || aws.ToInt32(p.ToPort) != rankPort {
+		t.Errorf("permission allows %s %d-%d, want tcp %d", aws.ToString(p.IpProtocol), aws.ToInt32(p.FromPort), aws.ToInt32(p.ToPort), rankPort)
+	}
+	if len(p.IpRanges) > 0 || len(p.Ipv6Ranges) > 0 || len(p.UserIdGroupPairs) != 1 || aws.ToString(p.UserIdGroupPairs[0].GroupId) != "sg-job" {
+		t.Errorf("permission is open to %v %v %v, want only the group itself", p.IpRanges, p.Ipv6Ranges, p.UserIdGroupPairs)
+	}
+}
+
+func TestJobPortPermissions(t *testing.T) {
+	o := newRunOptions()
+	if got := o.jobPortPermissions("sg-job"); len(got) != 1 {
+		t.Errorf("got %d permissions without --broadcast udp, want 1", len(got))
+	}
+	o.broadcast = "udp"
+	got := o.jobPortPermissions("sg-job")
+	if len(got) != 2 || aws.ToString(got[0].IpProtocol) != "tcp" || aws.ToString(got[1].IpProtocol) != "udp" {
+		t.Fatalf("got %d permissions with --broadcast udp, want tcp and udp", len(got))
+	}
+	if aws.ToInt32(got[1].FromPort) != rankPort || aws.ToString(got[1].UserIdGroupPairs[0].GroupId) != "sg-job" {
+		t.Errorf("udp permission = %+v, want the rank port within the group", got[1])
+	}
+}
+
+// fakeEC2 is an EC2 endpoint with network interfaces and security groups
+type fakeEC2 struct {
+	mu         sync.Mutex
+	groups     map[string]string   // Group ID by name
+	interfaces map[string][]string // Groups by interface ID
+	instances  map[string]string   // Primary interface by instance ID
+	calls      []string
+	inUse      int // DeleteSecurityGroup calls answered with DependencyViolation
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	action := r.Form.Get("Action")
+	f.calls = append(f.calls, action)
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>r</RequestID></Response>`, code, code)
+	}
+	groupSet := func(groups []string) string {
+		var items strings.Builder
+		for _, group := range groups {
+			fmt.Fprintf(&items, "<item><groupId>%s</groupId></item>", group)
+		}
+		return "<groupSet>" + items.String() + "</groupSet>"
+	}
+	switch action {
+	case "CreateSecurityGroup":
+		name := r.Form.Get("GroupName")
+		if _, ok := f.groups[name]; ok {
+			fail("InvalidGroup.Duplicate")
+			return
+		}
+		f.groups[name] = "sg-job"
+		fmt.Fprint(w, `<CreateSecurityGroupResponse><groupId>sg-job</groupId></CreateSecurityGroupResponse>`)
+	case "DescribeSecurityGroups":
+		id := f.groups[r.Form.Get("Filter.2.Value.1")]
+		fmt.Fprintf(w, `<DescribeSecurityGroupsResponse><securityGroupInfo><item><groupId>%s</groupId></item></securityGroupInfo></DescribeSecurityGroupsResponse>`, id)
+	case "AuthorizeSecurityGroupIngress", "AuthorizeSecurityGroupEgress", "RevokeSecurityGroupEgress":
+		fmt.Fprintf(w, `<%sResponse><return>true</return></%sResponse>`, action, action)
+	case "DescribeInstances":
+		var items strings.Builder
+		for instance, eni := range f.instances {
+			fmt.Fprintf(&items, `<item><instanceId>%s</instanceId><networkInterfaceSet><item><networkInterfaceId>%s</networkInterfaceId><attachment><deviceIndex>0</deviceIndex></attachment>%s</item></networkInterfaceSet></item>`,
+				instance, eni, groupSet(f.interfaces[eni]))
+		}
+		fmt.Fprintf(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>%s</instancesSet></item></reservationSet></DescribeInstancesResponse>`, items.String())
+	case "DescribeNetworkInterfaces":
+		group := r.Form.Get("Filter.1.Value.1")
+		var items strings.Builder
+		for _, eni := range sortedKeys(f.interfaces) {
+			for _, g := range f.interfaces[eni] {
+				if g == group {
+					fmt.Fprintf(&items, "<item><networkInterfaceId>%s</networkInterfaceId>%s</item>", eni, groupSet(f.interfaces[eni]))
+				}
+			}
+		}
+		fmt.Fprintf(w, `<DescribeNetworkInterfacesResponse><networkInterfaceSet>%s</networkInterfaceSet></DescribeNetworkInterfacesResponse>`, items.String())
+	case "ModifyNetworkInterfaceAttribute":
+		var groups []string
+		for i := 1; r.Form.Has(fmt.Sprintf("SecurityGroupId.%d", i)); i++ {
+			groups = append(groups, r.Form.Get(fmt.Sprintf("SecurityGroupId.%d", i)))
+		}
+		f.interfaces[r.Form.Get("NetworkInterfaceId")] = groups
+		fmt.Fprint(w, `<ModifyNetworkInterfaceAttributeResponse><return>true</return></ModifyNetworkInterfaceAttributeResponse>`)
+	case "DeleteSecurityGroup":
+		if f.inUse > 0 {
+			f.inUse--
+			fail("DependencyViolation")
+			return
+		}
+		for name, id := range f.groups {
+			if id == r.Form.Get("GroupId") {
+				delete(f.groups, name)
+			}
+		}
+		fmt.Fprint(w, `<DeleteSecurityGroupResponse><return>true</return></DeleteSecurityGroupResponse>`)
+	default:
+		fail("InvalidAction")
+	}
+}
+
+func newFakeEC2(t *testing.T, f *fakeEC2) *ec2.Client {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return ec2.New(ec2.Options{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(server.URL),
+		HTTPClient:   server.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestJobSecurityGroupLifecycle(t *testing.T) {
+	defer func(retry time.Duration) { securityGroupDeleteRetry = retry }(securityGroupDeleteRetry)
+	securityGroupDeleteRetry = time.Millisecond
+
+	for _, earlier := range []bool{false, true} {
+		f := &fakeEC2{
+			groups:     map[string]string{},
+			interfaces: map[string][]string{"eni-1": {"sg-a"}, "eni-2": {"sg-a", "sg-b"}, "eni-other": {"sg-a"}},
+			instances:  map[string]string{"i-1": "eni-1", "i-2": "eni-2"},
+			inUse:      2,
+		}
+		if earlier {
+			// An interrupted attempt created the group and attached it to one rank
+			f.groups[jobSecurityGroupName("job-1")] = "sg-job"
+			f.interfaces["eni-1"] = []string{"sg-a", "sg-job"}
+		}
+		client := newFakeEC2(t, f)
+		o := newRunOptions()
+		o.jobID, o.project, o.vpcID = "job-1", "team-a", "vpc-1"
+		instances := []awsManager.InstanceInfo{{InstanceID: "i-1"}, {InstanceID: "i-2"}}
+
+		groupID, err := o.openJobSecurityGroup(context.Background(), client, instances)
+		if err != nil || groupID != "sg-job" {
+			t.Fatalf("earlier attempt %v: openJobSecurityGroup() = %q, %v", earlier, groupID, err)
+		}
+		want := map[string][]string{"eni-1": {"sg-a", "sg-job"}, "eni-2": {"sg-a", "sg-b", "sg-job"}, "eni-other": {"sg-a"}}
+		if !reflect.DeepEqual(f.interfaces, want) {
+			t.Errorf("earlier attempt %v: interfaces after opening = %v, want %v", earlier, f.interfaces, want)
+		}
+
+		if err := closeJobSecurityGroup(context.Background(), client, groupID); err != nil {
+			t.Fatalf("earlier attempt %v: %v", earlier, err)
+		}
+		want = map[string][]string{"eni-1": {"sg-a"}, "eni-2": {"sg-a", "sg-b"}, "eni-other": {"sg-a"}}
+		if !reflect.DeepEqual(f.interfaces, want) || len(f.groups) != 0 {
+			t.Errorf("earlier attempt %v: after closing interfaces = %v, groups = %v", earlier, f.interfaces, f.groups)
+		}
+		deletes := 0
+		for _, call := range f.calls {
+			if call == "DeleteSecurityGroup" {
+				deletes++
+			}
+		}
+		if deletes != 3 {
+			t.Errorf("earlier attempt %v: %d deletes, want 2 refused while in use and 1 that succeeds", earlier, deletes)
+		}
+	}
+}
+
+func TestBuildPoliciesJobSecurityGroup(t *testing.T) {
+	for _, jobGroup := range []bool{false, true} {
+		policies, err := buildPolicies(policyForRun, policyScope{Region: "us-east-1", Account: "123456789012", VPC: "vpc-1", JobGroup: jobGroup})
+		if err != nil {
+			t.Fatal(err)
+		}
+		operator := statementsByID(policies.Operator)
+		var actions []string
+		for _, sid := range []string{"CreateJobSecurityGroup", "CreateJobSecurityGroupInVPC", "TagJobSecurityGroup", "ManageJobSecurityGroup", "AttachJobSecurityGroup", "FindJobSecurityGroup"} {
+			if statement, ok := operator[sid]; ok {
+				actions = append(actions, statement.Action...)
+			} else if jobGroup {
+				t.Errorf("statement %s missing", sid)
+			}
+		}
+		if !jobGroup {
+			if len(actions) > 0 {
+				t.Errorf("run without the job group is allowed %v", actions)
+			}
+			continue
+		}
+		// Every call securitygroup.go makes is allowed
+		for _, action := range []string{
+			"ec2:AuthorizeSecurityGroupEgress", "ec2:AuthorizeSecurityGroupIngress", "ec2:CreateSecurityGroup", "ec2:CreateTags",
+			"ec2:DeleteSecurityGroup", "ec2:DescribeNetworkInterfaces", "ec2:DescribeSecurityGroups",
+			"ec2:ModifyNetworkInterfaceAttribute", "ec2:RevokeSecurityGroupEgress",
+		} {
+			if !slices.Contains(actions, action) {
+				t.Errorf("%s is not allowed", action)
+			}
+		}
+		if got := operator["ManageJobSecurityGroup"].Condition; !reflect.DeepEqual(got, map[string]map[string]string{"Null": {"aws:ResourceTag/awsmpirun:job": "false"}}) {
+			t.Errorf("ManageJobSecurityGroup condition = %v, want groups tagged with a job", got)
+		}
+		if got := operator["CreateJobSecurityGroupInVPC"].Condition["StringEquals"]["ec2:Vpc"]; got != "arn:aws:ec2:us-east-1:123456789012:vpc/vpc-1" {
+			t.Errorf("CreateJobSecurityGroupInVPC VPC = %q", got)
+		}
+	}
+}
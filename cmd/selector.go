@@ -0,0 +1,68 @@
+// cmd/selector.go
+// This file applies --instance-selector, which chooses the instances of a run among
+// the running instances of its project in the VPC and their rank order, with one of the
+// selectors of the placement package or one loaded from a Go plugin. A host list, from
+// mpirun -hostfile or a run manifest, fixes both already, so it cannot be combined with
+// a selector.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/placement"
+)
+
+// validateSelector checks --instance-selector before anything is discovered; plugins
+// are only loaded once the instances are found
+func (o *runOptions) validateSelector() error {
+	if o.selector == "" || o.selector == placement.DefaultSelector {
+		return nil
+	}
+	if len(o.hostSelection) > 0 {
+		return fmt.Errorf("cannot be combined with a host list, which fixes the instances and their rank order")
+	}
+	if placement.IsPlugin(o.selector) {
+		if _, err := os.Stat(o.selector); err != nil {
+			return fmt.Errorf("plugin not found: %v", err)
+		}
+		return nil
+	}
+	_, err := placement.Resolve(o.selector)
+	return err
+}
+
+// selectInstances returns the instances the run's ranks run on, in rank order. The
+// selector keeps to --max-instances-per-az; a host list is checked against it with the
+// topology.
+func (o *runOptions) selectInstances(instances []awsManager.InstanceInfo) ([]awsManager.InstanceInfo, error) {
+	if len(o.hostSelection) > 0 {
+		if len(instances) < o.numInstances {
+			return nil, fmt.Errorf("not enough instances in the VPC. Requested: %d, Available: %d", o.numInstances, len(instances))
+		}
+		return instances[:o.numInstances], nil
+	}
+	selector, err := placement.Resolve(o.selector)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := placement.Select(selector, instances, placement.Requirements{
+		Ranks:   o.numInstances,
+		Require: o.requirements,
+		Project: o.project,
+
+		MaxPerAZ: o.maxPerAZ,
+	})
+	if err != nil {
+		if o.selector == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("instance selector %s: %v", o.selector, err)
+	}
+	if o.selector != "" && o.selector != placement.DefaultSelector {
+		fmt.Printf("Chose %d of %d instances with the %s instance selector\n", len(selected), len(instances), o.selector)
+	}
+	return selected, nil
+}
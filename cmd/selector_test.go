@@ -0,0 +1,91 @@
+// cmd/selector_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestValidateSelector(t *testing.T) {
+	plugin := filepath.Join(t.TempDir(), "rack.so")
+	if err := os.WriteFile(plugin, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		selector string
+		hosts    []string
+		wantErr  string
+	}{
+		{name: "default"},
+		{name: "default with hosts", selector: "first", hosts: []string{"10.0.0.1"}},
+		{name: "built-in", selector: "spread"},
+		{name: "plugin", selector: plugin},
+		{name: "missing plugin", selector: filepath.Join(t.TempDir(), "missing.so"), wantErr: "plugin not found"},
+		{name: "unknown", selector: "round-robin", wantErr: `unknown instance selector "round-robin"`},
+		{name: "with hosts", selector: "packed", hosts: []string{"10.0.0.1"}, wantErr: "cannot be combined with a host list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.selector, o.hostSelection = tt.selector, tt.hosts
+			err := o.validateRunInputs()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateRunInputs() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "--instance-selector: "+tt.wantErr) {
+				t.Errorf("validateRunInputs() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectInstances(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		hosts    []string
+		count    int
+		want     []string
+		wantErr  string
+	}{
+		{name: "default", count: 2, want: []string{"i-0", "i-1"}},
+		{name: "selected hosts", hosts: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, count: 2, want: []string{"i-0", "i-1"}},
+		{name: "cheapest", selector: "cheapest", count: 1, want: []string{"i-2"}},
+		{name: "too many", count: 4, wantErr: "not enough instances in the VPC. Requested: 4, Available: 3"},
+		{name: "too many with a selector", selector: "spread", count: 4, wantErr: "instance selector spread: not enough instances"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances := append(testInstances(), awsManager.InstanceInfo{InstanceID: "i-2", PrivateIP: "10.0.0.3", InstanceType: "c7g.medium"})
+			o := newRunOptions()
+			o.selector, o.hostSelection, o.numInstances = tt.selector, tt.hosts, tt.count
+			got, err := o.selectInstances(instances)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectInstances() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, instance := range got {
+				ids = append(ids, instance.InstanceID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("selectInstances() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// cmd/shell.go
+// This file holds the helpers for building the shell scripts sent to instances through
+// SSM. Every value awsmpirun puts into a script, whether a file path, a bucket name, an
+// address, or a user argument, goes through shellf or shellScript.Export, which quote it
+// as a single shell word. Only script text written here and the --exec command itself,
+// which is meant to be shell code, are passed through as they are.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	jobIDPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	bucketPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	tablePattern   = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,255}$`)
+)
+
+// shellQuote returns s as a single-quoted shell word. Nothing inside single quotes is
+// expanded, so the value reaches the program exactly as given.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellExpr is script text that shellf inserts unquoted, such as a variable reference
+// the script itself defines. It must never hold user input.
+type shellExpr string
+
+// shellf formats a line of script. String arguments are quoted as one shell word each,
+// string slices as one word per element, and shellExpr and numbers are inserted as they
+// are. Quoted words concatenate with the text around them, so
+//
+//	shellf("aws s3 cp s3://%s/%s %s", bucket, key, dest)
+//
+// stays one command however odd the bucket, key, or destination are. Verbs must not sit
+// inside double quotes in format, where the single quotes would be taken literally.
+func shellf(format string, args ...any) string {
+	quoted := make([]any, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			quoted[i] = shellQuote(v)
+		case []string:
+			words := make([]string, len(v))
+			for j, word := range v {
+				words[j] = shellQuote(word)
+			}
+			quoted[i] = strings.Join(words, " ")
+		case shellExpr:
+			quoted[i] = string(v)
+		default:
+			quoted[i] = arg
+		}
+	}
+	return fmt.Sprintf(format, quoted...)
+}
+
+// shellScript assembles a bash script line by line
+type shellScript struct {
+	b strings.Builder
+}
+
+func newShellScript() *shellScript {
+	s := &shellScript{}
+	s.b.WriteString("#!/bin/bash\n")
+	return s
+}
+
+// Raw appends script text written by awsmpirun itself; a trailing newline is added if missing
+func (s *shellScript) Raw(text string) {
+	s.b.WriteString(text)
+	if !strings.HasSuffix(text, "\n") {
+		s.b.WriteByte('\n')
+	}
+}
+
+// Linef appends one line formatted with shellf
+func (s *shellScript) Linef(format string, args ...any) {
+	s.Raw(shellf(format, args...))
+}
+
+// Export appends an export of name, with value quoted as by shellf. Names that come
+// from the user must be checked with validEnvName first; an invalid name here is a bug.
+func (s *shellScript) Export(name string, value any) {
+	if !validEnvName(name) {
+		panic(fmt.Sprintf("invalid shell variable name %q", name))
+	}
+	s.Linef("export %s=%v", shellExpr(name), value)
+}
+
+func (s *shellScript) String() string {
+	return s.b.String()
+}
+
+// validEnvName reports whether name can be exported as a shell variable
+func validEnvName(name string) bool {
+	return envNamePattern.MatchString(name)
+}
+
+// validateJobID rejects job IDs that cannot be part of a path or an S3 key as they are
+func validateJobID(id string) error {
+	if len(id) > 128 || !jobIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid job ID %q: use letters, digits, '.', '_', and '-'", id)
+	}
+	return nil
+}
+
+// validateBucketName applies the S3 naming rules for general purpose buckets
+func validateBucketName(name string) error {
+	if !bucketPattern.MatchString(name) || strings.Contains(name, "..") || net.ParseIP(name) != nil {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+	return nil
+}
+
+// validateTableName applies the DynamoDB table naming rules
+func validateTableName(name string) error {
+	if !tablePattern.MatchString(name) {
+		return fmt.Errorf("invalid table name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestShellQuoteSurvivesTheShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh available")
+	}
+
+	values := []string{
+		"",
+		"plain",
+		"two words",
+		"$(touch /tmp/pwned)",
+		"`id`",
+		"$HOME and ${PATH}",
+		"it's",
+		`'; echo injected; '`,
+		"line\nbreak",
+		`back\slash "double"`,
+		"*",
+	}
+
+	for _, value := range values {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Errorf("shellQuote(%q) broke the script: %v", value, err)
+			continue
+		}
+		if string(out) != value {
+			t.Errorf("shellQuote(%q) came back as %q", value, out)
+		}
+	}
+}
+
+func TestValidEnvName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"OMP_NUM_THREADS", true},
+		{"_private", true},
+		{"a1", true},
+		{"", false},
+		{"1ABC", false},
+		{"A-B", false},
+		{"A B", false},
+		{"A;rm", false},
+		{"$X", false},
+	}
+
+	for _, tt := range tests {
+		if got := validEnvName(tt.name); got != tt.want {
+			t.Errorf("validEnvName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// hostileValues are inputs that break or hijack a script when pasted in unquoted
+var hostileValues = []string{
+	"",
+	"two words",
+	"$(touch pwned)",
+	"`touch pwned`",
+	"it's",
+	`'; touch pwned; '`,
+	"line\nbreak; touch pwned",
+	`"double" and \back\slash`,
+	"* ? [a]",
+	"--option",
+	"a|b&c;d>e<f",
+}
+
+func TestShellfQuotesEveryArgument(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	dir := t.TempDir()
+
+	for _, value := range hostileValues {
+		// One string, a slice, and a word glued to surrounding text must all survive
+		line := shellf(`printf '%%s\n' %s %s prefix-%s/suffix`, value, []string{value, "x"}, value)
+		cmd := exec.Command("bash", "-c", line)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("shellf(%q) broke the script: %v\n%s", value, err, line)
+			continue
+		}
+		want := value + "\n" + value + "\nx\nprefix-" + value + "/suffix\n"
+		if string(out) != want {
+			t.Errorf("shellf(%q) came back as %q, want %q", value, out, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Error("a hostile value was executed")
+	}
+}
+
+func TestShellfLeavesExpressionsAndNumbers(t *testing.T) {
+	got := shellf("cd %s && sleep %d && echo %s", shellExpr(`"$HOME"`), 3, "$HOME")
+	want := `cd "$HOME" && sleep 3 && echo '$HOME'`
+	if got != want {
+		t.Errorf("shellf = %q, want %q", got, want)
+	}
+}
+
+func TestShellScriptExport(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	for _, value := range hostileValues {
+		script := newShellScript()
+		script.Export("VALUE", value)
+		script.Raw(`printf '%s' "$VALUE"`)
+		out, err := exec.Command("bash", "-c", script.String()).Output()
+		if err != nil {
+			t.Errorf("Export(%q) broke the script: %v", value, err)
+			continue
+		}
+		if string(out) != value {
+			t.Errorf("Export(%q) came back as %q", value, out)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Export accepted an invalid variable name")
+		}
+	}()
+	newShellScript().Export("A;B", "x")
+}
+
+// TestRankScriptWithHostileInputs runs a whole rank script with a work directory and
+// an extra variable that would each run a command if they were pasted in unquoted
+func TestRankScriptWithHostileInputs(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID = "test-" + filepath.Base(t.TempDir())
+	defer os.RemoveAll(filepath.Dir(rankPIDFile(o.jobID)))
+
+	base := t.TempDir()
+	o.workDir = filepath.Join(base, "it's a dir", "$(touch pwned)", "{job_id}")
+	hostile := `'; touch pwned; echo "`
+	o.extraEnv = []string{"HOSTILE=" + hostile}
+
+	instances := []awsManager.InstanceInfo{{InstanceID: "i-0", PrivateIP: "10.0.0.1"}}
+	script := o.buildRankScript(instances[0], instances, `printf '%s|%s' "$MPI_WORK_DIR" "$HOSTILE"`, "us-west-2")
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Dir = base
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("rank script failed: %v\n%s\n%s", err, out, script)
+	}
+
+	resolved := filepath.Join(base, "it's a dir", "$(touch pwned)", o.jobID)
+	out, err := os.ReadFile(filepath.Join(resolved, "output.txt"))
+	if err != nil {
+		t.Fatalf("rank did not run in %q: %v", resolved, err)
+	}
+	if want := resolved + "|" + hostile; string(out) != want {
+		t.Errorf("rank saw %q, want %q", out, want)
+	}
+	for _, dir := range []string{base, resolved} {
+		if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+			t.Errorf("a hostile value was executed in %s", dir)
+		}
+	}
+}
+
+// TestScriptsParseWithHostileInputs checks that the other generated scripts stay valid
+// bash when the values they embed contain shell syntax
+func TestScriptsParseWithHostileInputs(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID, o.workDir, o.bucket, o.kvTable = "job-1", "/scratch/it's here/$(id)", "staging", "kv"
+	o.extraEnv = []string{"NOTE=\"quoted\" `id` 'single'"}
+
+	d := &distribution{
+		bucket: "data", key: "sets/it's a key; rm -rf ~", region: "us-west-2",
+		workDir: "/tmp/awsmpirun/job-1/chunks", dest: "/data/my set/$(id).bin",
+		chunks: 2, chunkSize: 1 << 20, objectSize: 3 << 19, port: 50052, checksum: "abc",
+	}
+	instances := []awsManager.InstanceInfo{{InstanceID: "i-0", PrivateIP: "10.0.0.1"}}
+	scripts := map[string]string{
+		"manifest":  o.buildManifestScript("us-east-1", "us-west-2", "./a.out"),
+		"seed":      d.seedScript("10.0.0.1"),
+		"fetch":     d.fetchScript([]string{"10.0.0.2", "10.0.0.3"}, "10.0.0.1"),
+		"authorize": o.authorizeKeyScript("ssh-ed25519 AAAA job-1'; touch pwned; '"),
+		"mpirun":    o.mpirunScript(instances, "us-west-2"),
+		"drain":     drainRankScript(o.jobID, time.Minute),
+	}
+	for name, script := range scripts {
+		if out, err := exec.Command("bash", "-n", "-c", script).CombinedOutput(); err != nil {
+			t.Errorf("%s script does not parse: %v: %s\n%s", name, err, out, script)
+		}
+		if strings.Contains(script, "; touch pwned;") && !strings.Contains(script, `'\''; touch pwned; '\''`) {
+			t.Errorf("%s script embeds a value unquoted:\n%s", name, script)
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func(string) error
+		value    string
+		wantErr  bool
+	}{
+		{"job ID", validateJobID, "job-20240101-120000-abcdef", false},
+		{"job ID with dots", validateJobID, "nightly.v2_run", false},
+		{"job ID with slash", validateJobID, "../other", true},
+		{"job ID with space", validateJobID, "my job", true},
+		{"job ID with quote", validateJobID, "job'1", true},
+		{"empty job ID", validateJobID, "", true},
+		{"bucket", validateBucketName, "my-staging.bucket", false},
+		{"short bucket", validateBucketName, "ab", true},
+		{"upper case bucket", validateBucketName, "MyBucket", true},
+		{"bucket with dots in a row", validateBucketName, "my..bucket", true},
+		{"bucket shaped like an IP", validateBucketName, "192.168.0.1", true},
+		{"bucket with shell syntax", validateBucketName, "b$(id)", true},
+		{"table", validateTableName, "mpi_kv-store.v1", false},
+		{"short table", validateTableName, "kv", true},
+		{"table with space", validateTableName, "kv table", true},
+	}
+
+	for _, tt := range tests {
+		err := tt.validate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validating %q returned %v, wantErr %v", tt.name, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateRunInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(o *runOptions)
+		wantErr string
+	}{
+		{name: "nothing set", set: func(o *runOptions) {}},
+		{name: "everything valid", set: func(o *runOptions) {
+			o.bucket, o.kvTable, o.extraEnv = "staging", "kv-table", []string{"OMP_NUM_THREADS=4"}
+			o.pprofPort, o.logLevel, o.logRate, o.transport = 6060, "warn,0=info", "5/1s", "tcp"
+			o.maxBandwidth = "500Mbit"
+		}},
+		{name: "bad bucket", set: func(o *runOptions) { o.bucket = "Staging" }, wantErr: "bucket"},
+		{name: "bad table", set: func(o *runOptions) { o.kvTable = "kv" }, wantErr: "table"},
+		{name: "bad variable", set: func(o *runOptions) { o.extraEnv = []string{"A-B=1"} }, wantErr: "variable"},
+		{name: "eager limit off", set: func(o *runOptions) { o.eagerLimit = 0 }},
+		{name: "bad eager limit", set: func(o *runOptions) { o.eagerLimit = -2 }, wantErr: "--eager-limit"},
+		{name: "reconnects off", set: func(o *runOptions) { o.reconnectTimeout = 0 }},
+		{name: "bad reconnect timeout", set: func(o *runOptions) { o.reconnectTimeout = -2 * time.Second }, wantErr: "--reconnect-timeout"},
+		{name: "collective timeout", set: func(o *runOptions) { o.collectiveTimeout, o.timeoutPolicy = time.Minute, "abort" }},
+		{name: "bad collective timeout", set: func(o *runOptions) { o.collectiveTimeout = -time.Second }, wantErr: "--collective-timeout"},
+		{name: "bad timeout policy", set: func(o *runOptions) { o.timeoutPolicy = "ignore" }, wantErr: "--timeout-policy"},
+		{name: "git source", set: func(o *runOptions) { o.git = gitSource{url: "https://github.com/example/solver", ref: "v1.2.0"} }},
+		{name: "bad git source", set: func(o *runOptions) { o.git.url = "http://github.com/example/solver" }, wantErr: "--git"},
+		{name: "bad bandwidth", set: func(o *runOptions) { o.maxBandwidth = "500" }, wantErr: "--max-bandwidth-per-rank"},
+		{name: "bad transport", set: func(o *runOptions) { o.transport = "quic" }, wantErr: "--transport"},
+		{name: "udp broadcast", set: func(o *runOptions) { o.broadcast = "udp" }},
+		{name: "bad broadcast", set: func(o *runOptions) { o.broadcast = "multicast" }, wantErr: "--broadcast"},
+		{name: "udp broadcast with encryption", set: func(o *runOptions) { o.broadcast, o.encryptPayloads = "udp", true }, wantErr: "--encrypt-payloads"},
+		{name: "bad pprof port", set: func(o *runOptions) { o.pprofPort = 70000 }, wantErr: "--pprof-port"},
+		{name: "bad log level", set: func(o *runOptions) { o.logLevel = "warn,0=verbose" }, wantErr: "--log-level"},
+		{name: "bad log rate", set: func(o *runOptions) { o.logRate = "10" }, wantErr: "--log-rate"},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		tt.set(o)
+		err := o.validateRunInputs()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestManifestAddressTable turns a job manifest into the address table with the
+// command the shared script runs, and checks it matches the one per-rank scripts write
+func TestManifestAddressTable(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("no awk available")
+	}
+	instances := testInstances()
+	instances[0].AvailabilityZone, instances[0].Lifecycle, instances[0].PlacementGroup = "us-east-2a", "spot", "hpc"
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.txt")
+	if err := os.WriteFile(manifest, buildManifest(instances), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table := filepath.Join(dir, "addresses.json")
+	if out, err := exec.Command("bash", "-c", manifestAddressTable(shellQuote(manifest), table)).CombinedOutput(); err != nil {
+		t.Fatalf("address table command failed: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want mpi.AddressTable
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid address table %q: %v", data, err)
+	}
+	if err := json.Unmarshal(addressTable(instances), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || len(got.Ranks) != len(instances) {
+		t.Errorf("manifest address table = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,315 @@
+// cmd/spawn.go
+// This file implements --max-spawn-ranks, the side of mpi.Comm.Spawn that runs in
+// awsmpirun. While the ranks run, a spawner polls the job's spawn prefix in the bucket
+// for requests. For each it chooses idle instances of the project in the VPC, those
+// running neither a rank of the job nor a spawned one, with the run's instance
+// selector, starts the uploaded program on them, and answers with their addresses. A
+// request that would take the job past --max-spawn-ranks, or that finds too few idle
+// instances, is answered with the reason instead, which Spawn returns as its error.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/placement"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// spawnPollInterval is how often the spawner looks for new requests
+const spawnPollInterval = 5 * time.Second
+
+// validateSpawn checks --max-spawn-ranks
+func (o *runOptions) validateSpawn() error {
+	if o.maxSpawnRanks < 0 {
+		return fmt.Errorf("--max-spawn-ranks must not be negative, got %d", o.maxSpawnRanks)
+	}
+	if o.maxSpawnRanks == 0 {
+		return nil
+	}
+	if o.bucket == "" {
+		return fmt.Errorf("--max-spawn-ranks needs --bucket, spawn requests and programs are passed through it")
+	}
+	if o.launcher != launcherNative {
+		return fmt.Errorf("--max-spawn-ranks is not supported with --launcher %s", o.launcher)
+	}
+	return nil
+}
+
+// spawnedRanks are the ranks started for one spawn request
+type spawnedRanks struct {
+	id         string
+	instances  []awsManager.InstanceInfo
+	commandIDs map[string]string
+}
+
+// spawner answers the spawn requests of a running job
+type spawner struct {
+	o         *runOptions
+	s3        *awsManager.S3Client
+	ssmClient *ssm.Client
+	journal   *eventJournal
+	region    string
+
+	busy    map[string]bool // Instance IDs running a rank of the job, spawned or not
+	handled map[string]bool // Spawn IDs answered
+	left    int             // Ranks the job may still spawn
+	spawned []spawnedRanks
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// startSpawner starts answering the spawn requests of the job running on instances,
+// until Stop
+func (o *runOptions) startSpawner(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, journal *eventJournal) (*spawner, error) {
+	client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	sp := &spawner{
+		o:         o,
+		s3:        client,
+		ssmClient: ssmClient,
+		journal:   journal,
+		region:    ssmClient.Options().Region,
+		busy:      make(map[string]bool),
+		handled:   make(map[string]bool),
+		left:      o.maxSpawnRanks,
+	}
+	for _, instance := range instances {
+		sp.busy[instance.InstanceID] = true
+	}
+	ctx, sp.cancel = context.WithCancel(ctx)
+	sp.done.Add(1)
+	go func() {
+		defer sp.done.Done()
+		for {
+			sp.poll(ctx)
+			if awsManager.SleepContext(ctx, spawnPollInterval) != nil {
+				return
+			}
+		}
+	}()
+	return sp, nil
+}
+
+// Stop stops answering requests and returns the ranks that were spawned. Requests that
+// arrive later wait until Spawn gives up on them.
+func (sp *spawner) Stop() []spawnedRanks {
+	sp.cancel()
+	sp.done.Wait()
+	return sp.spawned
+}
+
+// poll answers the requests that arrived since the last poll
+func (sp *spawner) poll(ctx context.Context) {
+	prefix := mpi.SpawnPrefix(sp.o.project, sp.o.jobID)
+	objects, err := sp.s3.ListObjects(ctx, prefix)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Warning: failed to look for spawn requests: %v\n", err)
+		}
+		return
+	}
+	for _, id := range spawnRequestIDs(objects, prefix) {
+		if sp.handled[id] || ctx.Err() != nil {
+			continue
+		}
+		sp.handled[id] = true
+		resp := sp.handle(ctx, id)
+		data, _ := json.Marshal(resp)
+		if err := sp.s3.UploadBytes(ctx, data, mpi.SpawnKey(sp.o.project, sp.o.jobID, id, mpi.SpawnResponseObject)); err != nil {
+			fmt.Printf("Warning: failed to answer spawn request %s: %v\n", id, err)
+		}
+	}
+}
+
+// handle starts the ranks of spawn request id and returns the answer to it
+func (sp *spawner) handle(ctx context.Context, id string) mpi.SpawnResponse {
+	refuse := func(format string, args ...any) mpi.SpawnResponse {
+		reason := fmt.Sprintf(format, args...)
+		fmt.Printf("Refused spawn request %s: %s\n", id, reason)
+		sp.journal.recordf(eventSpawnRefused, "%s: %s", id, reason)
+		return mpi.SpawnResponse{Error: reason}
+	}
+
+	data, err := sp.s3.DownloadBytes(ctx, mpi.SpawnKey(sp.o.project, sp.o.jobID, id, mpi.SpawnRequestObject))
+	if err != nil {
+		return refuse("%v", err)
+	}
+	var req mpi.SpawnRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return refuse("invalid request: %v", err)
+	}
+	if req.Ranks < 1 || req.Address == "" || req.Context == 0 {
+		return refuse("invalid request for %d ranks", req.Ranks)
+	}
+	if req.Ranks > sp.left {
+		return refuse("the job may spawn %d more ranks with --max-spawn-ranks %d, %d asked for", sp.left, sp.o.maxSpawnRanks, req.Ranks)
+	}
+
+	found, err := discoverInstances(ctx, sp.o.vpcID, sp.o.project)
+	if err != nil {
+		return refuse("failed to discover instances: %v", err)
+	}
+	instances, err := sp.o.selectSpawnInstances(found, sp.busy, req.Ranks)
+	if err != nil {
+		return refuse("%v", err)
+	}
+
+	scripts := make(map[string]string)
+	for _, instance := range instances {
+		scripts[instance.InstanceID] = sp.o.buildSpawnScript(id, req, instance, instances, sp.region)
+	}
+	commandIDs, err := sendScripts(ctx, sp.ssmClient, scripts, sp.o.executionTimeout())
+	// Ranks that did start are busy, even if the others did not
+	for instanceID := range commandIDs {
+		sp.busy[instanceID] = true
+	}
+	if err != nil {
+		return refuse("%v", err)
+	}
+	sp.left -= req.Ranks
+	sp.spawned = append(sp.spawned, spawnedRanks{id: id, instances: instances, commandIDs: commandIDs})
+
+	resp := mpi.SpawnResponse{}
+	for _, instance := range instances {
+		resp.Addresses = append(resp.Addresses, fmt.Sprintf("%s:%d", rankHost(instance), rankPort))
+		resp.Instances = append(resp.Instances, instance.InstanceID)
+	}
+	fmt.Printf("Rank %d spawned %d ranks on %s\n", req.Parent, req.Ranks, strings.Join(resp.Instances, ", "))
+	sp.journal.recordf(eventRanksSpawned, "%s: %d ranks for rank %d on %s", id, req.Ranks, req.Parent, strings.Join(resp.Instances, ", "))
+	return resp
+}
+
+// spawnRequestIDs returns the IDs of the spawn requests among the objects under prefix
+func spawnRequestIDs(objects []awsManager.S3Object, prefix string) []string {
+	var ids []string
+	for _, object := range objects {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(object.Key, prefix), "/"+mpi.SpawnRequestObject)
+		if ok && id != "" && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// selectSpawnInstances returns n of the instances found that are not busy, chosen with
+// the run's instance selector and ranked 1 to n
+func (o *runOptions) selectSpawnInstances(found []awsManager.InstanceInfo, busy map[string]bool, n int) ([]awsManager.InstanceInfo, error) {
+	var idle []awsManager.InstanceInfo
+	for _, instance := range found {
+		if !busy[instance.InstanceID] {
+			idle = append(idle, instance)
+		}
+	}
+	if len(idle) < n {
+		return nil, fmt.Errorf("%d ranks asked for, but %d instances of the project are idle", n, len(idle))
+	}
+	selector, err := placement.Resolve(o.selector)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := placement.Select(selector, idle, placement.Requirements{
+		Ranks:    n,
+		Project:  o.project,
+		MaxPerAZ: o.maxPerAZ,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range selected {
+		selected[i].InstanceRank = i + 1
+	}
+	return selected, nil
+}
+
+// buildSpawnScript returns the script that starts rank instance.InstanceRank of spawn
+// request id. The spawning rank is rank 0 of the address table, which is kept apart
+// from the job's in case a spawned rank shares an instance with it later.
+func (o *runOptions) buildSpawnScript(id string, req mpi.SpawnRequest, instance awsManager.InstanceInfo, instances []awsManager.InstanceInfo, region string) string {
+	// Spawned ranks connect on their own, and are never the debugged rank
+	spawn := *o
+	spawn.minRanks = 0
+	spawn.debugRank = -1
+
+	dir := path.Join(path.Dir(mpi.AddressFile(o.jobID)), "spawn", id)
+	program := path.Join(dir, mpi.SpawnProgramObject)
+	table := mpi.AddressTable{Ranks: []mpi.RankAddress{{Rank: 0, Address: req.Address}}}
+	for _, peer := range instances {
+		table.Ranks = append(table.Ranks, rankAddress(peer, peer.InstanceRank, rankPort))
+	}
+	data, _ := json.Marshal(table)
+
+	script := newShellScript()
+	script.Export("MPI_RANK", instance.InstanceRank)
+	script.Export("MPI_SIZE", req.Ranks+1)
+	script.Export(mpi.EnvSpawnContext, req.Context)
+	spawn.writeJobEnv(script, region)
+	script.Export(mpi.EnvAddressFile, path.Join(dir, "addresses.json"))
+	script.Linef("mkdir -p %s", dir)
+	script.Linef(`printf '%%s\n' %s > "$%s"`, string(data), shellExpr(mpi.EnvAddressFile))
+	script.Linef("aws s3 cp %s %s --region %s --only-show-errors", fmt.Sprintf("s3://%s/%s", o.bucket, mpi.SpawnKey(o.project, o.jobID, id, mpi.SpawnProgramObject)), program, region)
+	script.Linef("chmod +x %s", program)
+	script.Raw(workDirSetup())
+	script.Raw(spawn.rankLaunch(shellf("%s %s", program, req.Args)))
+	return script.String()
+}
+
+// sendScripts runs each script on its instance, by instance ID, for at most
+// executionTimeout seconds, and returns the command IDs of those that started, with an
+// error if any did not
+func sendScripts(ctx context.Context, ssmClient *ssm.Client, scripts map[string]string, executionTimeout int) (map[string]string, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	commandIDs := make(map[string]string)
+	for instanceID, script := range scripts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input := shellScriptInput(script, executionTimeout)
+			input.InstanceIds = []string{instanceID}
+			result, err := ssmClient.SendCommand(ctx, input)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", instanceID, err))
+				return
+			}
+			commandIDs[instanceID] = aws.ToString(result.Command.CommandId)
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return commandIDs, fmt.Errorf("failed to start the program on %s", strings.Join(failed, "; "))
+	}
+	return commandIDs, nil
+}
+
+// waitForSpawnedRanks waits for the ranks spawned during the run and warns about those
+// that failed; they do not fail the run, whose ranks handle them
+func waitForSpawnedRanks(ctx context.Context, ssmClient *ssm.Client, spawned []spawnedRanks) {
+	for _, ranks := range spawned {
+		_, failures, err := waitForRanks(ctx, ssmClient, ranks.instances, ranks.commandIDs, nil)
+		if err != nil {
+			fmt.Printf("Warning: spawn %s: %v\n", ranks.id, err)
+			continue
+		}
+		for _, failure := range failures {
+			class, reason := failure.classify()
+			fmt.Printf("Warning: spawned rank %d of %s on %s failed with exit code %d, %s: %s\n", failure.Rank, ranks.id, failure.InstanceID, failure.ExitCode, class, reason)
+		}
+	}
+}
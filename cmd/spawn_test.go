@@ -0,0 +1,122 @@
+// cmd/spawn_test.go
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestValidateSpawn(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		bucket   string
+		launcher string
+		wantErr  string
+	}{
+		{name: "off"},
+		{name: "negative", max: -1, wantErr: "must not be negative"},
+		{name: "no bucket", max: 4, wantErr: "needs --bucket"},
+		{name: "openmpi", max: 4, bucket: "staging", launcher: launcherOpenMPI, wantErr: "--launcher openmpi"},
+		{name: "on", max: 4, bucket: "staging"},
+	}
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.maxSpawnRanks, o.bucket = tt.max, tt.bucket
+		if tt.launcher != "" {
+			o.launcher = tt.launcher
+		}
+		err := o.validateSpawn()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSpawnRequestIDs(t *testing.T) {
+	prefix := mpi.SpawnPrefix("demo", "job-1")
+	objects := []awsManager.S3Object{
+		{Key: prefix + "rank-0-0000002a/program"},
+		{Key: prefix + "rank-0-0000002a/request.json"},
+		{Key: prefix + "rank-0-0000002a/response.json"},
+		{Key: prefix + "rank-3-00000b0b/program"},
+		{Key: prefix + "nested/rank-1-00000001/request.json"},
+		{Key: prefix + "rank-5-00000c0c/request.json"},
+	}
+	got := spawnRequestIDs(objects, prefix)
+	want := []string{"rank-0-0000002a", "rank-5-00000c0c"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("spawnRequestIDs = %v, want %v", got, want)
+	}
+}
+
+func TestSelectSpawnInstances(t *testing.T) {
+	found := []awsManager.InstanceInfo{
+		{InstanceID: "i-world0", PrivateIP: "10.0.0.1"},
+		{InstanceID: "i-idle1", PrivateIP: "10.0.0.2"},
+		{InstanceID: "i-world1", PrivateIP: "10.0.0.3"},
+		{InstanceID: "i-idle2", PrivateIP: "10.0.0.4"},
+	}
+	busy := map[string]bool{"i-world0": true, "i-world1": true}
+	o := newRunOptions()
+
+	selected, err := o.selectSpawnInstances(found, busy, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"i-idle1", "i-idle2"} {
+		if selected[i].InstanceID != want || selected[i].InstanceRank != i+1 {
+			t.Errorf("instance %d = %s as rank %d, want %s as rank %d", i, selected[i].InstanceID, selected[i].InstanceRank, want, i+1)
+		}
+	}
+
+	if _, err := o.selectSpawnInstances(found, busy, 3); err == nil || !strings.Contains(err.Error(), "2 instances of the project are idle") {
+		t.Errorf("selecting 3 of 2 idle instances: error = %v", err)
+	}
+}
+
+func TestBuildSpawnScript(t *testing.T) {
+	o := newRunOptions()
+	o.jobID = "job-1"
+	o.project = "demo"
+	o.bucket = "staging"
+	o.maxSpawnRanks = 4
+	o.minRanks = 2
+	o.debugRank = 0
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-a", PrivateIP: "10.0.0.2", InstanceRank: 1},
+		{InstanceID: "i-b", PrivateIP: "10.0.0.3", InstanceRank: 2},
+	}
+	req := mpi.SpawnRequest{Ranks: 2, Args: []string{"--worker", "it's"}, Parent: 3, Address: "10.0.0.9:50051", Context: 42}
+	script := o.buildSpawnScript("rank-3-0000002a", req, instances[1], instances, "us-west-2")
+
+	for _, want := range []string{
+		"export MPI_RANK=2\n",
+		"export MPI_SIZE=3\n",
+		"export MPI_SPAWN_CONTEXT=42\n",
+		"export MPI_MAX_SPAWN=4\n",
+		"export MPI_ADDRESS_FILE='/tmp/awsmpirun/job-1/spawn/rank-3-0000002a/addresses.json'",
+		`{"rank":0,"address":"10.0.0.9:50051"}`,
+		`{"rank":2,"address":"10.0.0.3:50051","instance_id":"i-b"}`,
+		"aws s3 cp 's3://staging/" + mpi.SpawnKey("demo", "job-1", "rank-3-0000002a", mpi.SpawnProgramObject) + "'",
+		`'/tmp/awsmpirun/job-1/spawn/rank-3-0000002a/program' '--worker' 'it'\''s'`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+	// Spawned ranks connect on their own, and are never debugged
+	for _, unwanted := range []string{"MPI_MIN_RANKS", "dlv"} {
+		if strings.Contains(script, unwanted) {
+			t.Errorf("script contains %q", unwanted)
+		}
+	}
+}
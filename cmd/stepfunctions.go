@@ -0,0 +1,323 @@
+// cmd/stepfunctions.go
+// This file implements the export-sfn command, which turns a run manifest into an AWS
+// Step Functions state machine for teams that want the orchestration managed by AWS.
+// The states provision (discover and setup), stage (distribute), run (execute), and
+// collect map to the phases of pipeline.go, and each one is a CodeBuild build that runs
+// awsmpirun for that phase alone. The phase state is synced to the job's prefix in the
+// staging bucket around every build, so each build resumes where the previous one
+// stopped. A failing phase goes to teardown, which stops or terminates the manifest's
+// instances, before the execution fails.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// Teardowns export-sfn can append to the state machine
+const (
+	teardownNone      = "none"
+	teardownStop      = "stop"
+	teardownTerminate = "terminate"
+)
+
+// sfnConfigHome is the configuration home of awsmpirun inside the CodeBuild builds
+const sfnConfigHome = "/tmp/awsmpirun-config"
+
+// exportSFNOptions are the flags of export-sfn
+type exportSFNOptions struct {
+	manifest string
+	project  string
+	bucket   string
+	teardown string
+	retries  int
+	output   string
+}
+
+// newExportSFNCmd returns export-sfn
+func newExportSFNCmd() *cobra.Command {
+	o := &exportSFNOptions{}
+	cmd := &cobra.Command{
+		Use:   "export-sfn --manifest job.yaml --codebuild-project NAME",
+		Short: "Export a run manifest as an AWS Step Functions state machine",
+		Long: `export-sfn prints the Amazon States Language definition of a state machine that
+repeats the run a manifest records in managed steps: Provision, Stage, Run, and Collect,
+then Teardown. Every step starts a build of the CodeBuild project, whose image must have
+awsmpirun on its PATH and whose role needs the policies of awsmpirun iam print-policy
+--for run. The execution name is the job ID, and the phase state is kept in the job's
+prefix of the staging bucket between the steps. A failed step is retried --retries times,
+resuming the failed phase, before Teardown runs and the execution fails.
+iam print-policy --for stepfunctions prints the policy of the state machine's role.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runExportSFN(o)
+		},
+	}
+	cmd.Flags().StringVar(&o.manifest, "manifest", "", "Run manifest (job.yaml) to export (required)")
+	cmd.Flags().StringVar(&o.project, "codebuild-project", "", "CodeBuild project the steps run awsmpirun in (required)")
+	cmd.Flags().StringVar(&o.bucket, "state-bucket", "", "Bucket the phase state is kept in between steps (default: the manifest's --bucket)")
+	cmd.Flags().StringVar(&o.teardown, "teardown", teardownStop, "What Teardown does with the manifest's instances: none, stop, or terminate")
+	cmd.Flags().IntVar(&o.retries, "retries", 0, "How many times a failed step is retried")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "File to write the definition to (default: standard output)")
+	cmd.MarkFlagRequired("manifest")
+	cmd.MarkFlagRequired("codebuild-project")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newExportSFNCmd())
+}
+
+func runExportSFN(o *exportSFNOptions) {
+	data, err := os.ReadFile(o.manifest)
+	if err != nil {
+		fmt.Printf("Error reading manifest: %v\n", err)
+		os.Exit(1)
+	}
+	d, err := parseRunDescriptor(data)
+	if err != nil {
+		fmt.Printf("Error parsing manifest %s: %v\n", o.manifest, err)
+		os.Exit(1)
+	}
+	machine, err := newStateMachine(d, data, sfnExport{
+		codeBuildProject: o.project,
+		stateBucket:      o.bucket,
+		teardown:         o.teardown,
+		retries:          o.retries,
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(machine, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding state machine: %v\n", err)
+		os.Exit(1)
+	}
+	out = append(out, '\n')
+	if o.output == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if err := os.WriteFile(o.output, out, 0o644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", o.output, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote the state machine to %s\n", o.output)
+}
+
+// sfnExport holds the options of an export
+type sfnExport struct {
+	codeBuildProject string
+	stateBucket      string
+	teardown         string
+	retries          int
+}
+
+// stateMachine is an Amazon States Language definition
+type stateMachine struct {
+	Comment string               `json:"Comment"`
+	StartAt string               `json:"StartAt"`
+	States  map[string]*sfnState `json:"States"`
+}
+
+type sfnState struct {
+	Type       string         `json:"Type"`
+	Comment    string         `json:"Comment,omitempty"`
+	Resource   string         `json:"Resource,omitempty"`
+	Parameters map[string]any `json:"Parameters,omitempty"`
+	ResultPath string         `json:"ResultPath,omitempty"`
+	Retry      []sfnRetry     `json:"Retry,omitempty"`
+	Catch      []sfnCatch     `json:"Catch,omitempty"`
+	Next       string         `json:"Next,omitempty"`
+	Error      string         `json:"Error,omitempty"`
+	Cause      string         `json:"Cause,omitempty"`
+}
+
+type sfnRetry struct {
+	ErrorEquals     []string `json:"ErrorEquals"`
+	IntervalSeconds int      `json:"IntervalSeconds"`
+	MaxAttempts     int      `json:"MaxAttempts"`
+	BackoffRate     float64  `json:"BackoffRate"`
+}
+
+type sfnCatch struct {
+	ErrorEquals []string `json:"ErrorEquals"`
+	ResultPath  string   `json:"ResultPath"`
+	Next        string   `json:"Next"`
+}
+
+// sfnStep is a state of the machine and the last phase it runs
+type sfnStep struct {
+	name      string
+	lastPhase string
+	comment   string
+}
+
+// sfnSteps returns the steps of a run with launcher; mpirun and netns runs have no
+// distribute and collect phases, so they have no Stage and Collect steps either
+func sfnSteps(launcher string) []sfnStep {
+	provision := sfnStep{"Provision", phaseSetup, "Discover and rank the instances and prepare the shared resources"}
+	run := sfnStep{"Run", phaseExecute, "Run the program on every rank"}
+	if launcher != launcherNative {
+		return []sfnStep{provision, run}
+	}
+	return []sfnStep{
+		provision,
+		{"Stage", phaseDistribute, "Upload the address manifest"},
+		run,
+		{"Collect", phaseCollect, "Record the run and its output"},
+	}
+}
+
+// newStateMachine returns the state machine repeating the run of manifest d, whose
+// file content is data
+func newStateMachine(d *runDescriptor, data []byte, export sfnExport) (*stateMachine, error) {
+	bucket := export.stateBucket
+	if bucket == "" {
+		bucket = d.Options.Bucket
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("the manifest has no bucket; pass --state-bucket for the phase state")
+	}
+	if err := validateBucketName(bucket); err != nil {
+		return nil, err
+	}
+	if export.retries < 0 {
+		return nil, fmt.Errorf("--retries must not be negative")
+	}
+
+	var teardown string
+	switch export.teardown {
+	case teardownNone:
+	case teardownStop:
+		teardown = "arn:aws:states:::aws-sdk:ec2:stopInstances"
+	case teardownTerminate:
+		teardown = "arn:aws:states:::aws-sdk:ec2:terminateInstances"
+	default:
+		return nil, fmt.Errorf("--teardown must be none, stop, or terminate, got %q", export.teardown)
+	}
+	var instanceIDs []string
+	for _, instance := range d.Cluster.Instances {
+		instanceIDs = append(instanceIDs, instance.InstanceID)
+	}
+
+	machine := &stateMachine{
+		Comment: fmt.Sprintf("awsmpirun run of %q on %d instances; start executions with the job ID as their name", d.Program.Command, len(d.Cluster.Instances)),
+		States:  make(map[string]*sfnState),
+	}
+	done, failed := "Succeeded", "Failed"
+	if teardown != "" {
+		done, failed = "Teardown", "TeardownAfterFailure"
+		parameters := map[string]any{"InstanceIds": instanceIDs}
+		machine.States["Teardown"] = &sfnState{
+			Type:       "Task",
+			Comment:    fmt.Sprintf("%s the instances of the run", export.teardown),
+			Resource:   teardown,
+			Parameters: parameters,
+			ResultPath: "$.teardown",
+			Next:       "Succeeded",
+		}
+		machine.States["TeardownAfterFailure"] = &sfnState{
+			Type:       "Task",
+			Comment:    fmt.Sprintf("%s the instances of the failed run", export.teardown),
+			Resource:   teardown,
+			Parameters: parameters,
+			ResultPath: "$.teardown",
+			Catch:      []sfnCatch{{ErrorEquals: []string{"States.ALL"}, ResultPath: "$.teardownError", Next: "Failed"}},
+			Next:       "Failed",
+		}
+	}
+	machine.States["Succeeded"] = &sfnState{Type: "Succeed"}
+	machine.States["Failed"] = &sfnState{
+		Type:  "Fail",
+		Error: "awsmpirun.PhaseFailed",
+		Cause: "A phase of the run failed; see $.error and continue it with awsmpirun resume-phase --job <execution name>",
+	}
+
+	steps := sfnSteps(d.Program.Launcher)
+	machine.StartAt = steps[0].name
+	for i, step := range steps {
+		command := fmt.Sprintf(`awsmpirun resume-phase --job "$JOB_ID" --stop-after %s`, step.lastPhase)
+		if i == 0 {
+			command = fmt.Sprintf(`awsmpirun --from-manifest job.yaml --job-id "$JOB_ID" --stop-after %s`, step.lastPhase)
+		}
+		spec, err := sfnBuildspec(bucket, d.Project, command, data, i == 0)
+		if err != nil {
+			return nil, err
+		}
+		state := &sfnState{
+			Type:     "Task",
+			Comment:  step.comment,
+			Resource: "arn:aws:states:::codebuild:startBuild.sync",
+			Parameters: map[string]any{
+				"ProjectName":       export.codeBuildProject,
+				"BuildspecOverride": spec,
+				"EnvironmentVariablesOverride": []map[string]string{
+					{"Name": "JOB_ID", "Type": "PLAINTEXT", "Value.$": "$$.Execution.Name"},
+				},
+			},
+			ResultPath: "$.builds." + step.name,
+			Catch:      []sfnCatch{{ErrorEquals: []string{"States.ALL"}, ResultPath: "$.error", Next: failed}},
+			Next:       done,
+		}
+		if export.retries > 0 {
+			state.Retry = []sfnRetry{{ErrorEquals: []string{"States.TaskFailed"}, IntervalSeconds: 30, MaxAttempts: export.retries, BackoffRate: 2}}
+		}
+		if i+1 < len(steps) {
+			state.Next = steps[i+1].name
+		}
+		machine.States[step.name] = state
+	}
+	return machine, nil
+}
+
+// codeBuildSpec is a CodeBuild buildspec
+type codeBuildSpec struct {
+	Version string `yaml:"version"`
+	Env     struct {
+		Variables map[string]string `yaml:"variables"`
+	} `yaml:"env"`
+	Phases struct {
+		Build struct {
+			Commands []string `yaml:"commands"`
+			Finally  []string `yaml:"finally,omitempty"`
+		} `yaml:"build"`
+	} `yaml:"phases"`
+}
+
+// sfnBuildspec returns the buildspec of a step that runs command between restoring and
+// saving the phase state; the first step also writes the manifest to job.yaml
+func sfnBuildspec(bucket, project, command string, manifest []byte, first bool) (string, error) {
+	var spec codeBuildSpec
+	spec.Version = "0.2"
+	spec.Env.Variables = map[string]string{
+		"XDG_CONFIG_HOME": sfnConfigHome,
+		"STATE_BUCKET":    bucket,
+		"JOBS_PREFIX":     mpi.JobPrefix(project, ""),
+	}
+	commands := []string{
+		`export STATE_DIR="$XDG_CONFIG_HOME/awsmpirun/jobs/$JOB_ID"`,
+		`export STATE_URI="s3://$STATE_BUCKET/$JOBS_PREFIX$JOB_ID/state"`,
+		`mkdir -p "$STATE_DIR"`,
+		`aws s3 sync "$STATE_URI" "$STATE_DIR" --only-show-errors`,
+	}
+	if first {
+		spec.Env.Variables["MANIFEST"] = base64.StdEncoding.EncodeToString(manifest)
+		commands = append(commands, `echo "$MANIFEST" | base64 -d > job.yaml`)
+	}
+	spec.Phases.Build.Commands = append(commands, command)
+	spec.Phases.Build.Finally = []string{`aws s3 sync "$STATE_DIR" "$STATE_URI" --only-show-errors`}
+	out, err := yaml.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to render buildspec: %v", err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,131 @@
+// cmd/stepfunctions_test.go
+
+package cmd
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// sfnChain follows Next from StartAt and returns the names of the states visited
+func sfnChain(machine *stateMachine) []string {
+	var names []string
+	for name := machine.StartAt; name != ""; name = machine.States[name].Next {
+		names = append(names, name)
+		if len(names) > len(machine.States) {
+			break
+		}
+	}
+	return names
+}
+
+func TestNewStateMachine(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath, o.bucket, o.project = "job-1", "vpc-1", "./solver", "staging", "team-a"
+	native := o.newRunDescriptor(testInstances(), "us-east-2", "")
+	o.launcher, o.bucket = launcherOpenMPI, ""
+	openmpi := o.newRunDescriptor(testInstances(), "us-east-2", "")
+
+	tests := []struct {
+		name       string
+		d          *runDescriptor
+		export     sfnExport
+		wantChain  []string
+		wantCaught string // Where a failing step goes
+	}{
+		{"native with teardown", native, sfnExport{codeBuildProject: "awsmpirun", teardown: teardownStop},
+			[]string{"Provision", "Stage", "Run", "Collect", "Teardown", "Succeeded"}, "TeardownAfterFailure"},
+		{"openmpi without teardown", openmpi, sfnExport{codeBuildProject: "awsmpirun", stateBucket: "state", teardown: teardownNone, retries: 2},
+			[]string{"Provision", "Run", "Succeeded"}, "Failed"},
+	}
+	for _, tt := range tests {
+		machine, err := newStateMachine(tt.d, []byte("manifest"), tt.export)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := sfnChain(machine); !reflect.DeepEqual(got, tt.wantChain) {
+			t.Errorf("%s: chain %v, want %v", tt.name, got, tt.wantChain)
+		}
+		provision := machine.States["Provision"]
+		if provision.Catch[0].Next != tt.wantCaught {
+			t.Errorf("%s: failures go to %s, want %s", tt.name, provision.Catch[0].Next, tt.wantCaught)
+		}
+		if (tt.export.retries > 0) != (len(provision.Retry) > 0) {
+			t.Errorf("%s: retry = %+v", tt.name, provision.Retry)
+		}
+		if provision.Parameters["ProjectName"] != "awsmpirun" {
+			t.Errorf("%s: project = %v", tt.name, provision.Parameters["ProjectName"])
+		}
+	}
+
+	teardown := func() *stateMachine {
+		m, _ := newStateMachine(native, nil, sfnExport{teardown: teardownTerminate})
+		return m
+	}().States["Teardown"]
+	if teardown.Resource != "arn:aws:states:::aws-sdk:ec2:terminateInstances" || !reflect.DeepEqual(teardown.Parameters["InstanceIds"], []string{"i-0", "i-1"}) {
+		t.Errorf("teardown = %+v", teardown)
+	}
+}
+
+func TestNewStateMachineErrors(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath = "job-1", "vpc-1", "./solver"
+	d := o.newRunDescriptor(testInstances(), "", "")
+	tests := []struct {
+		name    string
+		export  sfnExport
+		wantErr string
+	}{
+		{"no bucket", sfnExport{teardown: teardownStop}, "--state-bucket"},
+		{"bad bucket", sfnExport{stateBucket: "Bad_Bucket", teardown: teardownStop}, "invalid bucket"},
+		{"bad teardown", sfnExport{stateBucket: "state", teardown: "hibernate"}, "--teardown"},
+		{"negative retries", sfnExport{stateBucket: "state", teardown: teardownNone, retries: -1}, "--retries"},
+	}
+	for _, tt := range tests {
+		if _, err := newStateMachine(d, nil, tt.export); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSFNBuildspec(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   bool
+		command string
+	}{
+		{"first step", true, `awsmpirun --from-manifest job.yaml --job-id "$JOB_ID" --stop-after setup`},
+		{"later step", false, `awsmpirun resume-phase --job "$JOB_ID" --stop-after execute`},
+	}
+	for _, tt := range tests {
+		out, err := sfnBuildspec("staging", "team-a", tt.command, []byte("version: 1\n"), tt.first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spec codeBuildSpec
+		if err := yaml.UnmarshalStrict([]byte(out), &spec); err != nil {
+			t.Fatalf("%s: %v\n%s", tt.name, err, out)
+		}
+		commands := spec.Phases.Build.Commands
+		if commands[len(commands)-1] != tt.command {
+			t.Errorf("%s: last command %q", tt.name, commands[len(commands)-1])
+		}
+		if spec.Env.Variables["JOBS_PREFIX"] != "projects/team-a/jobs/" || spec.Env.Variables["STATE_BUCKET"] != "staging" {
+			t.Errorf("%s: variables %v", tt.name, spec.Env.Variables)
+		}
+		manifest, ok := spec.Env.Variables["MANIFEST"]
+		if ok != tt.first {
+			t.Errorf("%s: has manifest %v", tt.name, ok)
+		}
+		if decoded, _ := base64.StdEncoding.DecodeString(manifest); tt.first && string(decoded) != "version: 1\n" {
+			t.Errorf("%s: manifest %q", tt.name, decoded)
+		}
+		if len(spec.Phases.Build.Finally) != 1 || !strings.Contains(spec.Phases.Build.Finally[0], `"$STATE_DIR" "$STATE_URI"`) {
+			t.Errorf("%s: finally %v", tt.name, spec.Phases.Build.Finally)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+// cmd/stress.go
+// This file implements the stress command, a soak/scale harness that repeatedly
+// provisions instances, runs a canary program at increasing scales, and tears the
+// instances down again. The report it prints is used to certify that an
+// account/region/AMI combination works reliably before running real jobs on it.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	stressRunningTimeout   = 5 * time.Minute
+	stressSSMOnlineTimeout = 10 * time.Minute
+	stressTerminateTimeout = 10 * time.Minute
+
+	// stressTagKey tags every instance stress launches, with the run's ID as the value
+	stressTagKey = "awsmpirun:stress"
+)
+
+// stressOptions are the flags of the stress command
+type stressOptions struct {
+	project         string
+	imageID         string
+	instanceType    string
+	subnetID        string
+	securityGroups  []string
+	instanceProfile string
+	scales          string
+	iterations      int
+	canary          string
+	reportPath      string
+	tags            map[string]string
+}
+
+// newStressCmd returns the stress command
+func newStressCmd() *cobra.Command {
+	o := &stressOptions{}
+	cmd := &cobra.Command{
+		Use:   "stress",
+		Short: "Repeatedly provision, run a canary, and tear down at increasing scales",
+		Long: `stress certifies an account/region/AMI combination by launching instances at each
+requested scale, waiting for them to register with SSM, running a canary program on
+every rank, and terminating them. It reports success rates, startup latencies, and
+the classes of errors that were seen.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runStress(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the launched instances are tagged with (default: project in config.yaml)")
+	cmd.Flags().StringVar(&o.imageID, "ami", "", "AMI ID to launch (required)")
+	cmd.Flags().StringVar(&o.instanceType, "instance-type", "t3.micro", "Instance type to launch")
+	cmd.Flags().StringVar(&o.subnetID, "subnet", "", "Subnet to launch instances in")
+	cmd.Flags().StringSliceVar(&o.securityGroups, "security-group", nil, "Security group IDs to attach")
+	cmd.Flags().StringVar(&o.instanceProfile, "iam-profile", "", "Instance profile granting SSM access (required)")
+	cmd.Flags().StringVar(&o.scales, "scales", "1,2,4,8", "Comma-separated instance counts to test")
+	cmd.Flags().IntVar(&o.iterations, "iterations", 3, "Number of trials at each scale")
+	cmd.Flags().StringVar(&o.canary, "canary", `test -n "$MPI_RANK" && test -s "/tmp/awsmpirun/$MPI_JOB_ID/addresses.json"`, "Canary command run on every rank")
+	cmd.Flags().StringVar(&o.reportPath, "report", "", "Write the per-trial results as JSON to this file")
+	cmd.Flags().StringToStringVar(&o.tags, "tags", nil, "More tags for the launched instances, as KEY=VALUE, such as those a compliance policy requires")
+	cmd.MarkFlagRequired("ami")
+	cmd.MarkFlagRequired("iam-profile")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newStressCmd())
+}
+
+// stressTrial records the outcome of one provision/run/teardown cycle
+type stressTrial struct {
+	Scale          int            `json:"scale"`
+	Iteration      int            `json:"iteration"`
+	Success        bool           `json:"success"`
+	RunningLatency time.Duration  `json:"running_latency"`
+	StartupLatency time.Duration  `json:"startup_latency"` // Launch until every instance is online in SSM
+	RunLatency     time.Duration  `json:"run_latency"`
+	ErrorClasses   map[string]int `json:"error_classes,omitempty"`
+}
+
+func runStress(ctx context.Context, o *stressOptions) {
+	scales, err := parseScales(o.scales)
+	if err != nil {
+		fmt.Printf("Error parsing scales: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating EC2 client: %v\n", err)
+		os.Exit(1)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The canary runs like a job whose ID is the stress run's
+	canary := newRunOptions()
+	canary.project = project
+	if canary.jobID, err = newJobID(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	specs := make(map[string]awsManager.LaunchSpec)
+	for _, scale := range scales {
+		specs[fmt.Sprintf("launch of %d instances", scale)] = stressLaunchSpec(canary, scale, o)
+	}
+	if err := checkLaunchCompliance(ctx, ec2Client, specs); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Stress run ID: %s\n", canary.jobID)
+	fmt.Printf("Instances are tagged awsmpirun:stress=%s\n", canary.jobID)
+	go handleStressInterrupt(ctx, ec2Client, canary.jobID)
+
+	var trials []stressTrial
+	for _, scale := range scales {
+		for iteration := 1; iteration <= o.iterations; iteration++ {
+			progress := platform.NewStdoutProgress()
+			trial := runStressTrial(ctx, canary, ec2Client, ssmClient, progress, scale, iteration, o)
+			progress.Done()
+			trials = append(trials, trial)
+		}
+	}
+
+	printStressSummary(trials)
+
+	if o.reportPath != "" {
+		data, err := json.MarshalIndent(trials, "", "  ")
+		if err == nil {
+			err = os.WriteFile(o.reportPath, data, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// stressLaunchSpec describes the launch of the instances of a trial at scale
+func stressLaunchSpec(canary *runOptions, scale int, o *stressOptions) awsManager.LaunchSpec {
+	tags := map[string]string{"Name": "awsmpirun-stress"}
+	for key, value := range o.tags {
+		tags[key] = value
+	}
+	tags[stressTagKey] = canary.jobID
+	tags[projectTagKey] = canary.project
+	return awsManager.LaunchSpec{
+		ImageID:          o.imageID,
+		InstanceType:     o.instanceType,
+		SubnetID:         o.subnetID,
+		SecurityGroupIDs: o.securityGroups,
+		InstanceProfile:  o.instanceProfile,
+		Count:            int32(scale),
+		Tags:             tags,
+	}
+}
+
+func runStressTrial(ctx context.Context, canary *runOptions, ec2Client *ec2.Client, ssmClient *ssm.Client, progress *platform.Progress, scale, iteration int, o *stressOptions) stressTrial {
+	trial := stressTrial{Scale: scale, Iteration: iteration, ErrorClasses: make(map[string]int)}
+	start := time.Now()
+	status := func(phase string) {
+		progress.Update("Scale %d, iteration %d/%d: %s", scale, iteration, o.iterations, phase)
+	}
+
+	status("launching")
+	instanceIDs, err := awsManager.LaunchInstances(ctx, ec2Client, stressLaunchSpec(canary, scale, o))
+	if err != nil {
+		trial.ErrorClasses[classifyError("launch", err)]++
+		return trial
+	}
+	setStressActive(instanceIDs)
+
+	// Always tear down, whatever happened during the trial
+	defer func() {
+		defer setStressActive(nil)
+		status("tearing down")
+		if err := awsManager.TerminateInstances(context.WithoutCancel(ctx), ec2Client, instanceIDs, stressTerminateTimeout); err != nil {
+			trial.ErrorClasses[classifyError("teardown", err)]++
+			progress.Println("Warning: failed to tear down %v: %v", instanceIDs, err)
+		}
+	}()
+
+	status("waiting for instances to run")
+	instances, err := awsManager.WaitForInstancesRunning(ctx, ec2Client, instanceIDs, stressRunningTimeout)
+	if err != nil {
+		trial.ErrorClasses[classifyError("running", err)]++
+		return trial
+	}
+	trial.RunningLatency = time.Since(start)
+
+	status("waiting for SSM")
+	err = awsManager.WaitForSSMOnline(ctx, ssmClient, instanceIDs, stressSSMOnlineTimeout)
+	if err != nil {
+		trial.ErrorClasses[classifyError("ssm-online", err)]++
+		return trial
+	}
+	trial.StartupLatency = time.Since(start)
+
+	assignRanks(instances)
+	status("running canary")
+	runStart := time.Now()
+	failures := runCanary(ctx, canary, ssmClient, instances, trial.ErrorClasses, o)
+	trial.RunLatency = time.Since(runStart)
+	trial.Success = failures == 0
+	return trial
+}
+
+var (
+	stressActiveMu sync.Mutex
+	stressActive   []string // Instances of the trial in progress
+)
+
+func setStressActive(instanceIDs []string) {
+	stressActiveMu.Lock()
+	stressActive = instanceIDs
+	stressActiveMu.Unlock()
+}
+
+// handleStressInterrupt tears down the current trial of stress run runID on SIGINT or
+// SIGTERM so an interrupted run does not leak instances. The teardown runs even though
+// the signal cancels ctx. A second signal exits immediately.
+func handleStressInterrupt(ctx context.Context, ec2Client *ec2.Client, runID string) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	go func() {
+		<-signals
+		fmt.Printf("Exiting without teardown; clean up instances tagged awsmpirun:stress=%s\n", runID)
+		os.Exit(1)
+	}()
+
+	// Hold the lock so the running trial cannot launch or terminate meanwhile
+	stressActiveMu.Lock()
+	instanceIDs := stressActive
+	if len(instanceIDs) > 0 {
+		fmt.Printf("Interrupted, terminating %d instances of the current trial...\n", len(instanceIDs))
+		if err := awsManager.TerminateInstances(context.WithoutCancel(ctx), ec2Client, instanceIDs, stressTerminateTimeout); err != nil {
+			fmt.Printf("Failed to terminate %v: %v\n", instanceIDs, err)
+			fmt.Printf("Clean up instances tagged awsmpirun:stress=%s\n", runID)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Interrupted. Any instance still tagged awsmpirun:stress=%s can be terminated safely.\n", runID)
+	os.Exit(1)
+}
+
+// runCanary runs the canary on every rank, recording error classes, and returns the number of failed ranks
+func runCanary(ctx context.Context, canary *runOptions, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, errorClasses map[string]int, o *stressOptions) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance awsManager.InstanceInfo) {
+			defer wg.Done()
+
+			class := runCanaryOnRank(ctx, canary, ssmClient, instance, instances, o)
+			if class == "" {
+				return
+			}
+			mu.Lock()
+			failures++
+			errorClasses[class]++
+			mu.Unlock()
+		}(instance)
+	}
+
+	wg.Wait()
+	return failures
+}
+
+// runCanaryOnRank returns the error class of a failed canary, or an empty string on success
+func runCanaryOnRank(ctx context.Context, canary *runOptions, ssmClient *ssm.Client, instance awsManager.InstanceInfo, instances []awsManager.InstanceInfo, o *stressOptions) string {
+	script := canary.buildRankScript(instance, instances, o.canary, ssmClient.Options().Region)
+	result, err := ssmClient.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		Parameters: map[string][]string{
+			"commands": {script},
+		},
+		InstanceIds:    []string{instance.InstanceID},
+		TimeoutSeconds: aws.Int32(600),
+	})
+	if err != nil {
+		return classifyError("send-command", err)
+	}
+
+	output, err := waitForCommandInvocation(ctx, ssmClient, aws.ToString(result.Command.CommandId), instance.InstanceID)
+	if err != nil {
+		return classifyError("invocation", err)
+	}
+	if output.Status != "Success" {
+		return fmt.Sprintf("canary:%s", aws.ToString(output.StatusDetails))
+	}
+	return ""
+}
+
+// classifyError reduces an error to "phase:code" using the AWS API error code when there is one
+func classifyError(phase string, err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%s:%s", phase, apiErr.ErrorCode())
+	}
+	if strings.Contains(err.Error(), "ThrottlingException") {
+		return fmt.Sprintf("%s:ThrottlingException", phase)
+	}
+	if strings.Contains(err.Error(), "exceeded max wait time") || strings.Contains(err.Error(), "timed out") {
+		return fmt.Sprintf("%s:timeout", phase)
+	}
+	return fmt.Sprintf("%s:other", phase)
+}
+
+func parseScales(spec string) ([]int, error) {
+	var scales []int
+	for _, part := range strings.Split(spec, ",") {
+		scale, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || scale <= 0 {
+			return nil, fmt.Errorf("invalid scale %q", part)
+		}
+		scales = append(scales, scale)
+	}
+	return scales, nil
+}
+
+func printStressSummary(trials []stressTrial) {
+	fmt.Println()
+	fmt.Printf("%-6s %-8s %-9s %-14s %-14s %-12s\n", "SCALE", "TRIALS", "SUCCESS", "AVG STARTUP", "MAX STARTUP", "AVG RUN")
+
+	byScale := make(map[int][]stressTrial)
+	var scales []int
+	errorClasses := make(map[string]int)
+	for _, trial := range trials {
+		if _, ok := byScale[trial.Scale]; !ok {
+			scales = append(scales, trial.Scale)
+		}
+		byScale[trial.Scale] = append(byScale[trial.Scale], trial)
+		for class, count := range trial.ErrorClasses {
+			errorClasses[class] += count
+		}
+	}
+
+	for _, scale := range scales {
+		var successes int
+		var totalStartup, maxStartup, totalRun time.Duration
+		for _, trial := range byScale[scale] {
+			if !trial.Success {
+				continue
+			}
+			successes++
+			totalStartup += trial.StartupLatency
+			totalRun += trial.RunLatency
+			if trial.StartupLatency > maxStartup {
+				maxStartup = trial.StartupLatency
+			}
+		}
+
+		var avgStartup, avgRun time.Duration
+		if successes > 0 {
+			avgStartup = totalStartup / time.Duration(successes)
+			avgRun = totalRun / time.Duration(successes)
+		}
+		rate := fmt.Sprintf("%d%%", successes*100/len(byScale[scale]))
+		fmt.Printf("%-6d %-8d %-9s %-14s %-14s %-12s\n", scale, len(byScale[scale]), rate,
+			avgStartup.Round(time.Second), maxStartup.Round(time.Second), avgRun.Round(time.Second))
+	}
+
+	if len(errorClasses) == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Error classes:")
+	var classes []string
+	for class := range errorClasses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Printf("  %-40s %d\n", class, errorClasses[class])
+	}
+}
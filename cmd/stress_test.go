@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestParseScales(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "1,2,4,8", want: []int{1, 2, 4, 8}},
+		{spec: " 16 , 32 ", want: []int{16, 32}},
+		{spec: "", wantErr: true},
+		{spec: "1,,2", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "-4", wantErr: true},
+		{spec: "four", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseScales(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseScales(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseScales(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"}, want: "launch:InsufficientInstanceCapacity"},
+		{err: fmt.Errorf("wrapped: %w", &smithy.GenericAPIError{Code: "RequestLimitExceeded"}), want: "launch:RequestLimitExceeded"},
+		{err: errors.New("operation error: ThrottlingException: rate exceeded"), want: "launch:ThrottlingException"},
+		{err: errors.New("exceeded max wait time for InstanceRunning waiter"), want: "launch:timeout"},
+		{err: errors.New("timed out after 5m with 3 of 4 instances online in SSM"), want: "launch:timeout"},
+		{err: errors.New("something else"), want: "launch:other"},
+	}
+
+	for _, tt := range tests {
+		if got := classifyError("launch", tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// cmd/targets.go
+// This file implements --target-by-tag. Instead of listing instance IDs in batches of
+// maxSendCommandTargets, the instances of a job are tagged awsmpirun:cluster with the
+// job ID and the shared launch script is sent once to that tag, which scales to any
+// number of ranks and lets SSM fan the command out under --max-concurrency and
+// --max-errors. Only the shared manifest script of a run with --bucket is sent this
+// way, since the per-rank scripts differ by instance.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// clusterTagKey tags the instances a job runs on with its job ID
+const clusterTagKey = "awsmpirun:cluster"
+
+// maxTagResources is the most resources one CreateTags call accepts
+const maxTagResources = 1000
+
+// parseFanOut parses a --max-concurrency or --max-errors value, a count or a
+// percentage as SSM takes them, and returns how many of size targets it allows
+func parseFanOut(value string, size int) (int, error) {
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.Atoi(percent)
+		if err != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage %q", value)
+		}
+		// SSM rounds a percentage up to at least one target
+		return max((size*p+99)/100, min(p, 1)), nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid count %q: use a number or a percentage such as 10%%", value)
+	}
+	return n, nil
+}
+
+// validateTargeting rejects --target-by-tag settings that cannot work
+func (o *runOptions) validateTargeting() error {
+	if !o.targetByTag {
+		if o.maxConcurrency != "" || o.maxErrors != "" {
+			return fmt.Errorf("--max-concurrency and --max-errors need --target-by-tag")
+		}
+		return nil
+	}
+	if o.bucket == "" {
+		return fmt.Errorf("--target-by-tag needs --bucket, the ranks share one launch script through it")
+	}
+	if o.launcher != launcherNative {
+		return fmt.Errorf("--target-by-tag is not supported with --launcher %s", o.launcher)
+	}
+	if o.maxConcurrency != "" {
+		if n, err := parseFanOut(o.maxConcurrency, 100); err != nil {
+			return fmt.Errorf("--max-concurrency: %v", err)
+		} else if n == 0 {
+			return fmt.Errorf("--max-concurrency must allow at least one instance")
+		}
+	}
+	if o.maxErrors != "" {
+		if _, err := parseFanOut(o.maxErrors, 100); err != nil {
+			return fmt.Errorf("--max-errors: %v", err)
+		}
+	}
+	return nil
+}
+
+// clusterFanOut returns the MaxConcurrency and MaxErrors of the command starting size
+// ranks. Every rank runs at once by default, since the ranks wait for each other in Init.
+func (o *runOptions) clusterFanOut(size int) (string, string) {
+	concurrency, errors := o.maxConcurrency, o.maxErrors
+	if concurrency == "" {
+		concurrency = "100%"
+	}
+	if errors == "" {
+		errors = "100%"
+	}
+	if n, _ := parseFanOut(concurrency, size); n < size {
+		fmt.Printf("Warning: --max-concurrency %s starts %d of the %d ranks at a time; ranks that exchange messages will wait for ones not yet started\n", concurrency, n, size)
+	}
+	return concurrency, errors
+}
+
+// tagCluster tags the instances with the job ID, replacing the tag of any earlier job
+func (o *runOptions) tagCluster(ctx context.Context, instances []awsManager.InstanceInfo) error {
+	ec2ClientCreator := awsManager.EC2ClientCreator{}
+	ec2Client, err := ec2ClientCreator.CreateClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create EC2 client: %v", err)
+	}
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	for start := 0; start < len(ids); start += maxTagResources {
+		end := min(start+maxTagResources, len(ids))
+		_, err := ec2Client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: ids[start:end],
+			Tags:      []ec2Types.Tag{{Key: aws.String(clusterTagKey), Value: aws.String(o.jobID)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag the instances with %s: %v", clusterTagKey, err)
+		}
+	}
+	return nil
+}
+
+// clusterCommandInput sends the script to the instances tagged with the job ID
+func (o *runOptions) clusterCommandInput(script string, size int) *ssm.SendCommandInput {
+	concurrency, errors := o.clusterFanOut(size)
+	input := shellScriptInput(script, o.executionTimeout())
+	input.Targets = []ssmTypes.Target{{Key: aws.String("tag:" + clusterTagKey), Values: []string{o.jobID}}}
+	input.MaxConcurrency = aws.String(concurrency)
+	input.MaxErrors = aws.String(errors)
+	return input
+}
+
+// startClusterCommand tags the instances and starts the shared script on all of them
+// with one tag-targeted SendCommand. It returns the command ID for each instance.
+func (o *runOptions) startClusterCommand(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, script string) (map[string]string, error) {
+	if err := o.tagCluster(ctx, instances); err != nil {
+		return nil, err
+	}
+	result, err := ssmClient.SendCommand(ctx, o.clusterCommandInput(script, len(instances)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute program on the instances tagged %s=%s: %v", clusterTagKey, o.jobID, err)
+	}
+	commandIDs := make(map[string]string)
+	for _, instance := range instances {
+		commandIDs[instance.InstanceID] = aws.ToString(result.Command.CommandId)
+	}
+	return commandIDs, nil
+}
+
+// commandFinished reports whether SSM is done sending a command and all its invocations
+// have ended
+func commandFinished(status ssmTypes.CommandStatus) bool {
+	switch status {
+	case ssmTypes.CommandStatusPending, ssmTypes.CommandStatusInProgress, ssmTypes.CommandStatusCancelling:
+		return false
+	}
+	return true
+}
+
+// waitForClusterRanks waits for a tag-targeted command to finish and returns the ranks'
+// outputs and failures as waitForRanks does. SSM never sends the command to instances
+// left over once --max-errors is exceeded, so the command's status rather than each
+// invocation's decides when the wait is over.
+func waitForClusterRanks(ctx context.Context, ssmClient *ssm.Client, instances []awsManager.InstanceInfo, commandID string, journal *eventJournal) (map[string]string, []rankFailure, error) {
+	for {
+		result, err := ssmClient.ListCommands(ctx, &ssm.ListCommandsInput{CommandId: aws.String(commandID)})
+		if err != nil && !strings.Contains(err.Error(), "ThrottlingException") {
+			return nil, nil, fmt.Errorf("failed to get the status of command %s: %v", commandID, err)
+		}
+		if err == nil && len(result.Commands) > 0 && commandFinished(result.Commands[0].Status) {
+			break
+		}
+		if err := awsManager.SleepContext(ctx, 2*time.Second); err != nil {
+			return nil, nil, fmt.Errorf("stopped waiting for command %s: %w", commandID, err)
+		}
+	}
+
+	sent := make(map[string]bool)
+	paginator := ssm.NewListCommandInvocationsPaginator(ssmClient, &ssm.ListCommandInvocationsInput{CommandId: aws.String(commandID)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list the invocations of command %s: %v", commandID, err)
+		}
+		for _, invocation := range page.CommandInvocations {
+			sent[aws.ToString(invocation.InstanceId)] = true
+		}
+	}
+
+	var delivered []awsManager.InstanceInfo
+	var failures []rankFailure
+	commandIDs := make(map[string]string)
+	for _, instance := range instances {
+		if !sent[instance.InstanceID] {
+			failures = append(failures, rankFailure{
+				Rank:       instance.InstanceRank,
+				InstanceID: instance.InstanceID,
+				Status:     "NotSent",
+				ExitCode:   -1,
+				Stderr:     "the command was not sent to this instance: --max-errors was exceeded, or the instance lost its " + clusterTagKey + " tag",
+			})
+			continue
+		}
+		delivered = append(delivered, instance)
+		commandIDs[instance.InstanceID] = commandID
+	}
+	for _, failure := range failures {
+		journal.record(jobEvent{Type: eventRankFailed, Rank: &failure.Rank, InstanceID: failure.InstanceID, Message: "NotSent"})
+	}
+	outputs, deliveredFailures, err := waitForRanks(ctx, ssmClient, delivered, commandIDs, journal)
+	if err != nil {
+		return nil, nil, err
+	}
+	return outputs, append(deliveredFailures, failures...), nil
+}
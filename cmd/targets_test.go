@@ -0,0 +1,104 @@
+// cmd/targets_test.go
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestParseFanOut(t *testing.T) {
+	tests := []struct {
+		value   string
+		size    int
+		want    int
+		wantErr bool
+	}{
+		{value: "10", size: 100, want: 10},
+		{value: "0", size: 100, want: 0},
+		{value: "100%", size: 37, want: 37},
+		{value: "50%", size: 5, want: 3},
+		{value: "1%", size: 5, want: 1},
+		{value: "0%", size: 5, want: 0},
+		{value: "101%", size: 5, wantErr: true},
+		{value: "ten", size: 5, wantErr: true},
+		{value: "-1", size: 5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFanOut(tt.value, tt.size)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseFanOut(%q) = %d, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseFanOut(%q, %d) = %d, %v, want %d", tt.value, tt.size, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateTargeting(t *testing.T) {
+	tests := []struct {
+		name        string
+		targetByTag bool
+		bucket      string
+		launcher    string
+		concurrency string
+		errors      string
+		wantErr     string
+	}{
+		{name: "off"},
+		{name: "fan-out without tag", concurrency: "10", wantErr: "need --target-by-tag"},
+		{name: "no bucket", targetByTag: true, wantErr: "needs --bucket"},
+		{name: "openmpi", targetByTag: true, bucket: "staging", launcher: launcherOpenMPI, wantErr: "--launcher openmpi"},
+		{name: "defaults", targetByTag: true, bucket: "staging"},
+		{name: "fan-out", targetByTag: true, bucket: "staging", concurrency: "25%", errors: "3"},
+		{name: "zero concurrency", targetByTag: true, bucket: "staging", concurrency: "0", wantErr: "at least one"},
+		{name: "bad errors", targetByTag: true, bucket: "staging", errors: "some", wantErr: "--max-errors"},
+	}
+
+	for _, tt := range tests {
+		o := newRunOptions()
+		o.targetByTag, o.bucket, o.maxConcurrency, o.maxErrors = tt.targetByTag, tt.bucket, tt.concurrency, tt.errors
+		if tt.launcher != "" {
+			o.launcher = tt.launcher
+		}
+		err := o.validateTargeting()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClusterCommandInput(t *testing.T) {
+	o := newRunOptions()
+	o.jobID = "job-test"
+	input := o.clusterCommandInput("#!/bin/bash\n", 200)
+
+	if len(input.InstanceIds) != 0 {
+		t.Errorf("tag-targeted command lists instances %v", input.InstanceIds)
+	}
+	if len(input.Targets) != 1 || aws.ToString(input.Targets[0].Key) != "tag:"+clusterTagKey || input.Targets[0].Values[0] != "job-test" {
+		t.Errorf("targets = %+v", input.Targets)
+	}
+	// Every rank starts at once unless asked otherwise
+	if aws.ToString(input.MaxConcurrency) != "100%" || aws.ToString(input.MaxErrors) != "100%" {
+		t.Errorf("fan-out = %s/%s, want 100%%/100%%", aws.ToString(input.MaxConcurrency), aws.ToString(input.MaxErrors))
+	}
+
+	o.maxConcurrency, o.maxErrors = "50", "5%"
+	input = o.clusterCommandInput("#!/bin/bash\n", 200)
+	if aws.ToString(input.MaxConcurrency) != "50" || aws.ToString(input.MaxErrors) != "5%" {
+		t.Errorf("fan-out = %s/%s, want 50/5%%", aws.ToString(input.MaxConcurrency), aws.ToString(input.MaxErrors))
+	}
+}
@@ -0,0 +1,94 @@
+// cmd/template.go
+// This file expands the placeholders allowed in the run command. Placeholders are
+// replaced by references to the variables exported on every rank, so the same
+// command works whether the script is built per rank or shared through the manifest:
+//
+//	--exec "./solver --rank {rank} --of {size} --out {work_dir}/result-{rank}.dat"
+
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// commandPlaceholders maps each placeholder to the shell variable it expands to
+var commandPlaceholders = map[string]string{
+	"{rank}":     "${MPI_RANK}",
+	"{size}":     "${MPI_SIZE}",
+	"{job_id}":   "${MPI_JOB_ID}",
+	"{work_dir}": "${MPI_WORK_DIR}",
+}
+
+// expandCommand replaces the placeholders in command with per-rank shell variables
+func expandCommand(command string) string {
+	for placeholder, variable := range commandPlaceholders {
+		command = strings.ReplaceAll(command, placeholder, variable)
+	}
+	return command
+}
+
+// validateCommandTemplate rejects placeholders the selected launcher cannot expand
+func validateCommandTemplate(command, launcher string) error {
+	if launcher == launcherOpenMPI && strings.Contains(command, "{rank}") {
+		return fmt.Errorf("{rank} is not available with --launcher openmpi, read OMPI_COMM_WORLD_RANK instead")
+	}
+	return nil
+}
+
+// workDirValue returns, as a shellf argument, the configured work directory with
+// {job_id} filled in, or the shell's current directory when none was configured
+func (o *runOptions) workDirValue() any {
+	if o.workDir == "" {
+		return shellExpr(`"$PWD"`)
+	}
+	return strings.ReplaceAll(o.workDir, "{job_id}", o.jobID)
+}
+
+// rankStatsFile is where the runtime of a rank in jobID writes its traffic totals
+func rankStatsFile(jobID string) string {
+	return fmt.Sprintf("/tmp/awsmpirun/%s/stats.json", jobID)
+}
+
+// rankPIDFile is where each instance records the process group of its rank in jobID
+func rankPIDFile(jobID string) string {
+	return fmt.Sprintf("/tmp/awsmpirun/%s/rank.pid", jobID)
+}
+
+// rankLaunch returns the script lines that run the expanded command with its output in
+// output.txt. The command runs as its own process group, recorded in rankPIDFile, so
+// --chaos can kill exactly this rank. With --debug-rank, that rank runs under dlv
+// (see debugLaunch). A rank that crashes leaves a crash report (see
+// crashCollection). The program's sha256 is reported first (see programCheck), and the
+// rank's traffic totals last (see rankStatsReport). The script exits with the
+// command's status.
+func (o *runOptions) rankLaunch(command string) string {
+	return shellf(`mkdir -p %[1]s
+touch %[4]s
+export %[7]s=%[8]s
+rm -f "$%[7]s"
+%[6]s
+ulimit -c unlimited 2> /dev/null
+export GOTRACEBACK="${GOTRACEBACK:-crash}"
+set -m
+{
+%[3]s
+} > output.txt 2>&1 &
+RANK_PID=$!
+echo $RANK_PID > %[2]s
+wait $RANK_PID
+RANK_STATUS=$?
+rm -f %[2]s
+%[5]s
+%[9]s
+exit $RANK_STATUS`, path.Dir(rankPIDFile(o.jobID)), rankPIDFile(o.jobID), shellExpr(expandCommand(o.debugLaunch(command))), rankStartMarker(o.jobID), shellExpr(crashCollection(o.jobID)), shellExpr(programCheck(command)),
+		shellExpr(mpi.EnvStatsFile), rankStatsFile(o.jobID), shellExpr(rankStatsReport()))
+}
+
+// workDirSetup returns the script lines that create and enter the work directory
+func workDirSetup() string {
+	return `mkdir -p "$MPI_WORK_DIR" && cd "$MPI_WORK_DIR"`
+}
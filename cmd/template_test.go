@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "./a.out", want: "./a.out"},
+		{command: "./solver --rank {rank} --of {size}", want: "./solver --rank ${MPI_RANK} --of ${MPI_SIZE}"},
+		{command: "{work_dir}/out-{job_id}-{rank}.dat", want: "${MPI_WORK_DIR}/out-${MPI_JOB_ID}-${MPI_RANK}.dat"},
+		{command: "echo {rank}{rank}", want: "echo ${MPI_RANK}${MPI_RANK}"},
+		{command: "echo {ranks} {Rank}", want: "echo {ranks} {Rank}"},
+	}
+
+	for _, tt := range tests {
+		if got := expandCommand(tt.command); got != tt.want {
+			t.Errorf("expandCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCommandTemplate(t *testing.T) {
+	if err := validateCommandTemplate("./a.out {rank}", launcherNative); err != nil {
+		t.Errorf("native launcher rejected {rank}: %v", err)
+	}
+	if err := validateCommandTemplate("./a.out {size} {work_dir}", launcherOpenMPI); err != nil {
+		t.Errorf("openmpi launcher rejected {size}: %v", err)
+	}
+	if err := validateCommandTemplate("./a.out {rank}", launcherOpenMPI); err == nil {
+		t.Error("openmpi launcher accepted {rank}")
+	}
+}
+
+func TestWorkDirValue(t *testing.T) {
+	o := newRunOptions()
+	o.jobID = "job-1"
+
+	if got := o.workDirValue(); got != shellExpr(`"$PWD"`) {
+		t.Errorf("default work dir = %#v, want the current directory", got)
+	}
+	o.workDir = "/scratch/{job_id}/my run"
+	if got := o.workDirValue(); got != "/scratch/job-1/my run" {
+		t.Errorf("work dir = %#v, want /scratch/job-1/my run", got)
+	}
+}
+
+// bashInTempDir returns the command that runs script with bash in a directory of its
+// own, so the output.txt of a rank script stays out of the source tree
+func bashInTempDir(t *testing.T, script string) *exec.Cmd {
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Dir = t.TempDir()
+	return cmd
+}
+
+// TestKillRankScript starts a rank the way the rank scripts do and checks that the
+// chaos kill reaches the whole command rather than processes with a similar name
+func TestKillRankScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("no bash available")
+	}
+	o := newRunOptions()
+	o.jobID = "test-" + filepath.Base(t.TempDir())
+	defer os.RemoveAll(filepath.Dir(rankPIDFile(o.jobID)))
+
+	// A kill before the rank started must fail instead of reporting success
+	if err := bashInTempDir(t, killRankScript(o.jobID)).Run(); err == nil {
+		t.Fatal("kill succeeded with no rank running")
+	}
+
+	rank := bashInTempDir(t, o.rankLaunch("sleep 30 && echo finished"))
+	if err := rank.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- rank.Wait() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(rankPIDFile(o.jobID)); err == nil && strings.TrimSpace(string(data)) != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rank never wrote its pid file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if out, err := bashInTempDir(t, killRankScript(o.jobID)).CombinedOutput(); err != nil {
+		t.Fatalf("kill failed: %v: %s", err, out)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("rank script exited successfully after being killed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rank kept running after the kill")
+	}
+
+	if _, err := os.Stat(rankPIDFile(o.jobID)); !os.IsNotExist(err) {
+		t.Errorf("pid file left behind: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// cmd/topology.go
+// This file implements the topology report printed once a run's instances are chosen:
+// how many instances were requested and obtained, and how they spread over instance
+// types, availability zones, placement groups, and on-demand or spot capacity. A run
+// that needs a particular topology states it with --require, and the run stops before
+// anything is set up when the instances do not meet it, instead of running slowly on a
+// cluster spread across zones.
+
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// requirement is one --require constraint
+type requirement struct {
+	name  string // same-az, same-type, placement-group, on-demand, spot, instance-type, or max-azs
+	value string // The instance type of instance-type and the count of max-azs
+}
+
+func (r requirement) String() string {
+	if r.value == "" {
+		return r.name
+	}
+	return r.name + "=" + r.value
+}
+
+// parseRequirements parses the --require constraints
+func parseRequirements(specs []string) ([]requirement, error) {
+	var requirements []requirement
+	for _, spec := range specs {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(spec), "=")
+		switch name {
+		case "same-az", "same-type", "placement-group", "on-demand", "spot":
+			if hasValue {
+				return nil, fmt.Errorf("requirement %s takes no value", name)
+			}
+		case "instance-type":
+			if value == "" {
+				return nil, fmt.Errorf("requirement instance-type needs a type, e.g. instance-type=c7gn.16xlarge")
+			}
+		case "max-azs":
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				return nil, fmt.Errorf("requirement max-azs needs a positive count, got %q", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown requirement %q, expected same-az, same-type, placement-group, on-demand, spot, instance-type=TYPE, or max-azs=N", spec)
+		}
+		requirements = append(requirements, requirement{name: name, value: value})
+	}
+	return requirements, nil
+}
+
+// topology counts the instances of a run by type, zone, placement group, and lifecycle
+type topology struct {
+	size            int
+	types           map[string]int
+	zones           map[string]int
+	zoneRanks       map[string][]int // The ranks in each zone, in order
+	placementGroups map[string]int   // "" counts the instances in no placement group
+	lifecycles      map[string]int
+}
+
+// summarizeTopology returns the topology of instances
+func summarizeTopology(instances []awsManager.InstanceInfo) topology {
+	t := topology{
+		size:            len(instances),
+		types:           make(map[string]int),
+		zones:           make(map[string]int),
+		zoneRanks:       make(map[string][]int),
+		placementGroups: make(map[string]int),
+		lifecycles:      make(map[string]int),
+	}
+	for _, instance := range instances {
+		t.types[orUnknown(instance.InstanceType)]++
+		t.zones[orUnknown(instance.AvailabilityZone)]++
+		t.zoneRanks[orUnknown(instance.AvailabilityZone)] = append(t.zoneRanks[orUnknown(instance.AvailabilityZone)], instance.InstanceRank)
+		t.placementGroups[instance.PlacementGroup]++
+		t.lifecycles[orUnknown(instance.Lifecycle)]++
+	}
+	return t
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// report describes the topology next to what the run requested
+func (t topology) report(requested int, requirements []requirement) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Topology: requested %d instances, obtained %d\n", requested, t.size)
+	fmt.Fprintf(&b, "  Instance types:     %s\n", countList(t.types))
+	fmt.Fprintf(&b, "  Availability zones: %s\n", countList(t.zones))
+	if len(t.zones) > 1 {
+		fmt.Fprintf(&b, "  Ranks by zone:      %s\n", t.zoneRankList())
+	}
+	groups := make(map[string]int)
+	for name, n := range t.placementGroups {
+		if name == "" {
+			name = "none"
+		}
+		groups[name] = n
+	}
+	fmt.Fprintf(&b, "  Placement groups:   %s\n", countList(groups))
+	fmt.Fprintf(&b, "  Capacity:           %s\n", countList(t.lifecycles))
+	if len(requirements) > 0 {
+		var names []string
+		for _, r := range requirements {
+			names = append(names, r.String())
+		}
+		fmt.Fprintf(&b, "  Required:           %s\n", strings.Join(names, ", "))
+	}
+	return b.String()
+}
+
+// zoneRankList renders the ranks of every zone as "a 0-3, b 4-7", by zone
+func (t topology) zoneRankList() string {
+	var parts []string
+	for _, zone := range slices.Sorted(maps.Keys(t.zoneRanks)) {
+		parts = append(parts, zone+" "+rankRanges(t.zoneRanks[zone]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// busiestZone returns the zone with the most instances and their count
+func (t topology) busiestZone() (string, int) {
+	var busiest string
+	for zone, n := range t.zones {
+		if n > t.zones[busiest] || (n == t.zones[busiest] && zone < busiest) {
+			busiest = zone
+		}
+	}
+	return busiest, t.zones[busiest]
+}
+
+// rankRanges renders ascending ranks as "0-3,6,8-9"
+func rankRanges(ranks []int) string {
+	var parts []string
+	for i := 0; i < len(ranks); {
+		j := i
+		for j+1 < len(ranks) && ranks[j+1] == ranks[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.Itoa(ranks[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", ranks[i], ranks[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// countList renders counts as "a x3, b x1", largest first
+func countList(counts map[string]int) string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s x%d", key, counts[key]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// unmet returns how the topology falls short of each requirement it does not meet
+func (t topology) unmet(requirements []requirement) []string {
+	var problems []string
+	for _, r := range requirements {
+		var problem string
+		switch r.name {
+		case "same-az":
+			if len(t.zones) > 1 {
+				problem = fmt.Sprintf("instances span %d availability zones: %s", len(t.zones), countList(t.zones))
+			}
+		case "max-azs":
+			if max, _ := strconv.Atoi(r.value); len(t.zones) > max {
+				problem = fmt.Sprintf("instances span %d availability zones, at most %d allowed: %s", len(t.zones), max, countList(t.zones))
+			}
+		case "same-type":
+			if len(t.types) > 1 {
+				problem = fmt.Sprintf("instances have %d types: %s", len(t.types), countList(t.types))
+			}
+		case "instance-type":
+			if n := t.types[r.value]; n != t.size {
+				problem = fmt.Sprintf("%d of %d instances are %s: %s", n, t.size, r.value, countList(t.types))
+			}
+		case "placement-group":
+			if n := t.placementGroups[""]; n > 0 {
+				problem = fmt.Sprintf("%d instances are in no placement group", n)
+			} else if len(t.placementGroups) > 1 {
+				problem = fmt.Sprintf("instances are in %d placement groups: %s", len(t.placementGroups), countList(t.placementGroups))
+			}
+		case "on-demand", "spot":
+			if n := t.lifecycles[r.name]; n != t.size {
+				problem = fmt.Sprintf("%d of %d instances are %s: %s", n, t.size, r.name, countList(t.lifecycles))
+			}
+		}
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", r, problem))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,128 @@
+// cmd/topology_test.go
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestParseRequirements(t *testing.T) {
+	tests := []struct {
+		specs   []string
+		want    string
+		wantErr string
+	}{
+		{[]string{"same-az", "on-demand"}, "same-az on-demand", ""},
+		{[]string{"instance-type=c7gn.16xlarge", "max-azs=2"}, "instance-type=c7gn.16xlarge max-azs=2", ""},
+		{[]string{"same-az=yes"}, "", "takes no value"},
+		{[]string{"instance-type"}, "", "needs a type"},
+		{[]string{"max-azs=0"}, "", "positive count"},
+		{[]string{"fast"}, "", "unknown requirement"},
+	}
+	for _, tt := range tests {
+		requirements, err := parseRequirements(tt.specs)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: error = %v, want %q", tt.specs, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.specs, err)
+			continue
+		}
+		var got []string
+		for _, r := range requirements {
+			got = append(got, r.String())
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%v: parsed %v", tt.specs, got)
+		}
+	}
+}
+
+// topologyInstances returns three instances over two zones, one of them spot and
+// outside the placement group
+func topologyInstances() []awsManager.InstanceInfo {
+	return []awsManager.InstanceInfo{
+		{InstanceID: "i-0", InstanceType: "c7g.large", AvailabilityZone: "us-east-2a", PlacementGroup: "mpi", Lifecycle: awsManager.LifecycleOnDemand},
+		{InstanceID: "i-1", InstanceType: "c7g.large", AvailabilityZone: "us-east-2a", PlacementGroup: "mpi", Lifecycle: awsManager.LifecycleOnDemand, InstanceRank: 1},
+		{InstanceID: "i-2", InstanceType: "c7g.xlarge", AvailabilityZone: "us-east-2b", Lifecycle: awsManager.LifecycleSpot, InstanceRank: 2},
+	}
+}
+
+func TestTopologyUnmet(t *testing.T) {
+	tests := []struct {
+		specs     []string
+		instances []awsManager.InstanceInfo
+		want      string // Substring of the first problem, or "" when all are met
+	}{
+		{[]string{"same-az"}, topologyInstances(), "span 2 availability zones"},
+		{[]string{"max-azs=2"}, topologyInstances(), ""},
+		{[]string{"max-azs=1"}, topologyInstances(), "at most 1 allowed"},
+		{[]string{"same-type"}, topologyInstances(), "2 types: c7g.large x2, c7g.xlarge x1"},
+		{[]string{"instance-type=c7g.large"}, topologyInstances(), "2 of 3 instances are c7g.large"},
+		{[]string{"placement-group"}, topologyInstances(), "1 instances are in no placement group"},
+		{[]string{"on-demand"}, topologyInstances(), "2 of 3 instances are on-demand"},
+		{[]string{"spot"}, topologyInstances(), "1 of 3 instances are spot"},
+		{[]string{"same-az", "same-type", "placement-group", "on-demand"}, topologyInstances()[:2], ""},
+	}
+	for _, tt := range tests {
+		requirements, err := parseRequirements(tt.specs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems := summarizeTopology(tt.instances).unmet(requirements)
+		if tt.want == "" {
+			if len(problems) > 0 {
+				t.Errorf("%v: unmet %v", tt.specs, problems)
+			}
+			continue
+		}
+		if len(problems) == 0 || !strings.Contains(problems[0], tt.want) {
+			t.Errorf("%v: unmet %v, want %q", tt.specs, problems, tt.want)
+		}
+	}
+}
+
+func TestTopologyReport(t *testing.T) {
+	requirements, _ := parseRequirements([]string{"same-az"})
+	got := summarizeTopology(topologyInstances()).report(3, requirements)
+	want := `Topology: requested 3 instances, obtained 3
+  Instance types:     c7g.large x2, c7g.xlarge x1
+  Availability zones: us-east-2a x2, us-east-2b x1
+  Ranks by zone:      us-east-2a 0-1, us-east-2b 2
+  Placement groups:   mpi x2, none x1
+  Capacity:           on-demand x2, spot x1
+  Required:           same-az
+`
+	if got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRankRanges(t *testing.T) {
+	tests := []struct {
+		ranks []int
+		want  string
+	}{
+		{nil, ""},
+		{[]int{4}, "4"},
+		{[]int{0, 1, 2, 3}, "0-3"},
+		{[]int{0, 2, 3, 4, 7, 9, 10}, "0,2-4,7,9-10"},
+	}
+	for _, tt := range tests {
+		if got := rankRanges(tt.ranks); got != tt.want {
+			t.Errorf("rankRanges(%v) = %q, want %q", tt.ranks, got, tt.want)
+		}
+	}
+}
+
+func TestBusiestZone(t *testing.T) {
+	if zone, n := summarizeTopology(topologyInstances()).busiestZone(); zone != "us-east-2a" || n != 2 {
+		t.Errorf("busiestZone() = %s, %d, want us-east-2a, 2", zone, n)
+	}
+}
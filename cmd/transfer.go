@@ -0,0 +1,525 @@
+// cmd/transfer.go
+// This file implements the cp and sync commands, which move files between this machine
+// and the instances without a hand-written SSM script. A path on the instances is
+// written with a leading colon. Files pushed to the instances are uploaded once to a
+// staging prefix in the bucket, like a job's binary, and every selected rank copies
+// them from there through the SSM agent. Files pulled from the instances take the same
+// way back: every rank uploads its copy under a prefix of its own, and the command
+// downloads each rank's files into a rank-N directory, since the ranks' files usually
+// differ.
+//
+// cp stages under a new prefix every time. sync stages under a prefix named after its
+// two paths, which it keeps a mirror of the source, so each leg moves only the files
+// whose size changed or whose source copy is newer: aws s3 sync on the instances, and
+// the same comparison here. A rank that syncs to this machine also uploads the list of
+// its files, so the files it removed are dropped from the staging prefix. With
+// --delete, files the source does not have are removed from the destination.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/spf13/cobra"
+)
+
+// transferOptions are the flags of cp and sync
+type transferOptions struct {
+	project   string
+	vpc       string
+	instances int
+	bucket    string
+	ranks     string
+	timeout   time.Duration
+	delete    bool // sync only
+}
+
+// bindTransferFlags binds the flags cp and sync share to o
+func (o *transferOptions) bindTransferFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the instances belong to (default: project in config.yaml)")
+	cmd.Flags().StringVarP(&o.vpc, "vpc", "v", "", "VPC ID (required)")
+	cmd.Flags().IntVarP(&o.instances, "num-instances", "n", 0, "Number of instances the ranks are counted over (0 uses all of them)")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "S3 bucket to stage the files in (required)")
+	cmd.Flags().StringVar(&o.ranks, "ranks", "", `Ranks to copy to or from, e.g. "0,4-7" (default: every rank)`)
+	cmd.Flags().DurationVar(&o.timeout, "copy-timeout", 0, "How long the copy on each rank may take before SSM stops it (default: as long as SSM allows)")
+	cmd.MarkFlagRequired("vpc")
+	cmd.MarkFlagRequired("bucket")
+}
+
+// newCpCmd returns the cp command
+func newCpCmd() *cobra.Command {
+	o := &transferOptions{}
+	cmd := &cobra.Command{
+		Use:   "cp SOURCE DEST",
+		Short: "Copy files between this machine and the instances",
+		Long: `cp copies a file or directory to the instances, or from them. Paths on the
+instances start with a colon and must be absolute:
+
+  awsmpirun cp --vpc vpc-0abc --bucket my-staging config.yaml :/etc/app/config.yaml
+  awsmpirun cp --vpc vpc-0abc --bucket my-staging ./inputs :/data/inputs
+  awsmpirun cp --vpc vpc-0abc --bucket my-staging --ranks 0,4-7 :/tmp/job/logs ./logs
+
+A destination on the instances that ends in a slash is a directory the file is copied
+into. Files copied from the instances land in DEST/rank-N for each rank N. Every copy
+goes through a staging prefix in --bucket, so the instances need no route to this
+machine; the staged files stay there like a job's staged binary.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			runTransfer(cmd.Context(), args[0], args[1], false, o)
+		},
+	}
+	o.bindTransferFlags(cmd)
+	return cmd
+}
+
+// newSyncCmd returns the sync command
+func newSyncCmd() *cobra.Command {
+	o := &transferOptions{}
+	cmd := &cobra.Command{
+		Use:   "sync SOURCE DEST",
+		Short: "Bring a directory on the instances or this machine up to date with the other",
+		Long: `sync copies the files of a directory that are missing or changed at the destination,
+to the instances or from them, with paths on the instances written as for cp:
+
+  awsmpirun sync --vpc vpc-0abc --bucket my-staging ./config :/etc/app
+  awsmpirun sync --vpc vpc-0abc --bucket my-staging --delete :/tmp/job/checkpoints ./checkpoints
+
+A file counts as changed when its size differs or the source copy is newer. With
+--delete, files the source does not have are removed from the destination.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			runTransfer(cmd.Context(), args[0], args[1], true, o)
+		},
+	}
+	o.bindTransferFlags(cmd)
+	cmd.Flags().BoolVar(&o.delete, "delete", false, "Remove files from the destination that the source does not have")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newCpCmd(), newSyncCmd())
+}
+
+func runTransfer(ctx context.Context, source, dest string, sync bool, o *transferOptions) {
+	local, remote, push, err := parseTransferPaths(source, dest)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if o.instances < 0 {
+		fmt.Println("Error: --num-instances must not be negative")
+		os.Exit(1)
+	}
+	if o.timeout < 0 {
+		fmt.Println("Error: --copy-timeout must not be negative")
+		os.Exit(1)
+	}
+	if err := validateBucketName(o.bucket); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	project, err := resolveProject(o.project)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	instances, err := discoverInstances(ctx, o.vpc, project)
+	if err != nil {
+		fmt.Printf("Error discovering instances: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) == 0 || len(instances) < o.instances {
+		fmt.Printf("Not enough instances in the VPC. Requested: %d, Available: %d\n", max(o.instances, 1), len(instances))
+		os.Exit(1)
+	}
+	if o.instances > 0 {
+		instances = instances[:o.instances]
+	}
+	assignRanks(instances)
+	ranks, err := parseRankSelection(o.ranks, len(instances))
+	if err != nil {
+		fmt.Printf("Error: --ranks: %v\n", err)
+		os.Exit(1)
+	}
+	var selected []awsManager.InstanceInfo
+	for _, rank := range ranks {
+		selected = append(selected, instances[rank])
+	}
+
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err != nil {
+		fmt.Printf("Error creating S3 client: %v\n", err)
+		os.Exit(1)
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	jobID, err := newJobID()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	prefix := mpi.JobPrefix(project, jobID)
+	if sync {
+		if local, err = filepath.Abs(local); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		prefix = mpi.JobPrefix(project, syncStagingID(local, remote))
+	}
+	t := &fileTransfer{
+		ssmClient: ssmClient,
+		s3Client:  s3Client,
+		region:    s3Client.Client.Options().Region,
+		prefix:    prefix,
+		sync:      sync,
+		delete:    o.delete,
+		timeout:   executionTimeoutOf(o.timeout),
+	}
+
+	if push {
+		err = t.push(ctx, local, remote, selected)
+	} else {
+		err = t.pull(ctx, remote, local, selected)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseTransferPaths returns the local and the remote path of a cp or sync, and
+// whether the files go to the instances. Exactly one path must be remote, written
+// with a leading colon.
+func parseTransferPaths(source, dest string) (local, remote string, push bool, err error) {
+	sourceRemote, sourceIsRemote := strings.CutPrefix(source, ":")
+	destRemote, destIsRemote := strings.CutPrefix(dest, ":")
+	switch {
+	case sourceIsRemote && destIsRemote:
+		return "", "", false, fmt.Errorf("%q and %q are both on the instances; one path must be on this machine", source, dest)
+	case !sourceIsRemote && !destIsRemote:
+		return "", "", false, fmt.Errorf("%q and %q are both on this machine; write the path on the instances with a leading colon, e.g. :/data", source, dest)
+	case destIsRemote:
+		local, remote, push = source, destRemote, true
+	default:
+		local, remote = dest, sourceRemote
+	}
+	if !path.IsAbs(remote) {
+		return "", "", false, fmt.Errorf("path on the instances %q must be absolute", remote)
+	}
+	if local == "" {
+		return "", "", false, fmt.Errorf("the path on this machine must not be empty")
+	}
+	return local, remote, push, nil
+}
+
+// parseRankSelection returns the ranks of spec, a comma-separated list of ranks and
+// ranges such as "0,4-7", in ascending order; an empty spec selects all size ranks
+func parseRankSelection(spec string, size int) ([]int, error) {
+	if spec == "" {
+		ranks := make([]int, size)
+		for rank := range ranks {
+			ranks[rank] = rank
+		}
+		return ranks, nil
+	}
+	selected := make([]bool, size)
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from > to {
+			return nil, fmt.Errorf("invalid rank or range %q", item)
+		}
+		if from < 0 || to >= size {
+			return nil, fmt.Errorf("%q is outside ranks 0-%d", item, size-1)
+		}
+		for rank := from; rank <= to; rank++ {
+			selected[rank] = true
+		}
+	}
+	var ranks []int
+	for rank, ok := range selected {
+		if ok {
+			ranks = append(ranks, rank)
+		}
+	}
+	return ranks, nil
+}
+
+// syncStagingID names the staging prefix of a sync between local, an absolute path,
+// and remote, the same for every sync between them
+func syncStagingID(local, remote string) string {
+	h := fnv.New64a()
+	h.Write([]byte(local + "\x00" + remote))
+	return fmt.Sprintf("sync-%016x", h.Sum64())
+}
+
+// fileTransfer is one cp or sync through the staging prefix of the bucket
+type fileTransfer struct {
+	ssmClient *ssm.Client
+	s3Client  *awsManager.S3Client
+	region    string
+	prefix    string // Staging prefix of the transfer, without a trailing slash
+	sync      bool
+	delete    bool
+	timeout   int // Seconds SSM lets the copy script of each rank run
+}
+
+// push stages local, a file or directory, and copies it to remote on every instance
+func (t *fileTransfer) push(ctx context.Context, local, remote string, instances []awsManager.InstanceInfo) error {
+	files, isDir, err := localFiles(local)
+	if err != nil {
+		return err
+	}
+	if t.sync && !isDir {
+		return fmt.Errorf("sync copies directories; use cp for the file %s", local)
+	}
+
+	staged := make(map[string]awsManager.S3Object)
+	if t.sync {
+		objects, err := t.s3Client.ListObjects(ctx, t.prefix+"/files/")
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			staged[strings.TrimPrefix(object.Key, t.prefix+"/files/")] = object
+		}
+	}
+	uploaded, size := 0, int64(0)
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		info := files[rel]
+		if object, ok := staged[rel]; ok && object.Size == info.Size() && !info.ModTime().After(object.LastModified) {
+			continue
+		}
+		file := local
+		if isDir {
+			file = filepath.Join(local, filepath.FromSlash(rel))
+		}
+		if err := t.s3Client.UploadFile(ctx, file, t.prefix+"/files/"+rel); err != nil {
+			return fmt.Errorf("failed to stage %s: %v", file, err)
+		}
+		uploaded, size = uploaded+1, size+info.Size()
+	}
+	// The staging prefix mirrors the source, so aws s3 sync --delete can follow it
+	var stale []string
+	for rel, object := range staged {
+		if _, ok := files[rel]; !ok {
+			stale = append(stale, object.Key)
+		}
+	}
+	if err := t.s3Client.DeleteObjects(ctx, stale); err != nil {
+		return err
+	}
+
+	name := ""
+	if !isDir {
+		name = filepath.Base(local)
+	}
+	fmt.Printf("Staged %d of %d files (%d bytes), copying them to %s on %d ranks...\n", uploaded, len(files), size, remote, len(instances))
+	_, err = runLongScriptOnInstances(ctx, t.ssmClient, instances, t.timeout, func(awsManager.InstanceInfo) string {
+		return t.pushScript(remote, name)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %s to %s on %d ranks\n", local, remote, len(instances))
+	return nil
+}
+
+// pushScript returns the script that copies the staged files to remote: the file name
+// when one file was staged, or the whole directory when name is empty
+func (t *fileTransfer) pushScript(remote, name string) string {
+	staged := fmt.Sprintf("s3://%s/%s/files/", t.s3Client.Bucket, t.prefix)
+	script := newShellScript()
+	script.Raw("set -e")
+	switch {
+	case name != "":
+		dir := path.Dir(remote)
+		if strings.HasSuffix(remote, "/") {
+			dir = remote
+		}
+		script.Linef("mkdir -p %s", dir)
+		script.Linef("aws s3 cp %s %s --region %s --only-show-errors", staged+name, remote, t.region)
+	case t.sync:
+		script.Linef("mkdir -p %s", remote)
+		script.Linef("aws s3 sync %s %s --region %s --only-show-errors%s", staged, remote, t.region, t.deleteFlag())
+	default:
+		script.Linef("mkdir -p %s", remote)
+		script.Linef("aws s3 cp %s %s --recursive --region %s --only-show-errors", staged, remote, t.region)
+	}
+	return script.String()
+}
+
+// pull has every instance upload remote, a file or directory, and downloads the copy
+// of each rank into local/rank-N
+func (t *fileTransfer) pull(ctx context.Context, remote, local string, instances []awsManager.InstanceInfo) error {
+	fmt.Printf("Copying %s from %d ranks...\n", remote, len(instances))
+	_, err := runLongScriptOnInstances(ctx, t.ssmClient, instances, t.timeout, func(instance awsManager.InstanceInfo) string {
+		return t.pullScript(remote, instance.InstanceRank)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		rank := instance.InstanceRank
+		prefix := fmt.Sprintf("%s/ranks/%d/", t.prefix, rank)
+		objects, err := t.s3Client.ListObjects(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		// A sync keeps only the files the rank still has, and drops the rest
+		var listed map[string]bool
+		if t.sync {
+			listing, err := t.s3Client.DownloadBytes(ctx, fmt.Sprintf("%s/ranks/%d.files", t.prefix, rank))
+			if err != nil {
+				return fmt.Errorf("rank %d: %v", rank, err)
+			}
+			listed = parseFileListing(listing)
+		}
+
+		dir := filepath.Join(local, fmt.Sprintf("rank-%d", rank))
+		wanted := make(map[string]bool)
+		var stale []string
+		copied := 0
+		for _, object := range objects {
+			rel := strings.TrimPrefix(object.Key, prefix)
+			if listed != nil && !listed[rel] {
+				stale = append(stale, object.Key)
+				continue
+			}
+			file := filepath.Join(dir, filepath.FromSlash(rel))
+			wanted[file] = true
+			if t.sync && !localFileChanged(file, object) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+				return err
+			}
+			if err := t.s3Client.DownloadFile(ctx, object.Key, file); err != nil {
+				return fmt.Errorf("rank %d: %v", rank, err)
+			}
+			copied++
+		}
+		if err := t.s3Client.DeleteObjects(ctx, stale); err != nil {
+			return err
+		}
+		if t.delete {
+			if err := removeUnwanted(dir, wanted); err != nil {
+				return fmt.Errorf("rank %d: %v", rank, err)
+			}
+		}
+		fmt.Printf("Rank %d: copied %d of %d files to %s\n", rank, copied, len(wanted), dir)
+	}
+	return nil
+}
+
+// pullScript returns the script that uploads remote on rank under the rank's prefix,
+// with the list of its files for a sync
+func (t *fileTransfer) pullScript(remote string, rank int) string {
+	staged := fmt.Sprintf("s3://%s/%s/ranks/%d/", t.s3Client.Bucket, t.prefix, rank)
+	script := newShellScript()
+	script.Raw("set -e")
+	if t.sync {
+		script.Linef("if [ ! -d %s ]; then echo %s >&2; exit 1; fi", remote, remote+" is not a directory")
+		script.Linef("aws s3 sync %s %s --region %s --only-show-errors", remote, staged, t.region)
+		script.Linef("cd %s", remote)
+		script.Linef("find . -type f -print0 | aws s3 cp - %s --region %s --only-show-errors",
+			fmt.Sprintf("s3://%s/%s/ranks/%d.files", t.s3Client.Bucket, t.prefix, rank), t.region)
+		return script.String()
+	}
+	script.Linef("if [ -d %s ]; then", remote)
+	script.Linef("  aws s3 cp %s %s --recursive --region %s --only-show-errors", remote, staged, t.region)
+	script.Raw("else")
+	script.Linef("  aws s3 cp %s %s --region %s --only-show-errors", remote, staged+path.Base(remote), t.region)
+	script.Raw("fi")
+	return script.String()
+}
+
+func (t *fileTransfer) deleteFlag() shellExpr {
+	if t.delete {
+		return " --delete"
+	}
+	return ""
+}
+
+// localFiles returns the regular files under root by their slash-separated path
+// relative to it, or root itself by its name when it is a file
+func localFiles(root string) (map[string]fs.FileInfo, bool, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.IsDir() {
+		return map[string]fs.FileInfo{filepath.Base(root): info}, false, nil
+	}
+	files := make(map[string]fs.FileInfo)
+	err = filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		files[filepath.ToSlash(rel)] = info
+		return err
+	})
+	return files, true, err
+}
+
+// parseFileListing returns the paths of a listing find -print0 wrote in a directory
+func parseFileListing(listing []byte) map[string]bool {
+	files := make(map[string]bool)
+	for _, file := range strings.Split(string(listing), "\x00") {
+		if file = strings.TrimPrefix(file, "./"); file != "" {
+			files[file] = true
+		}
+	}
+	return files
+}
+
+// localFileChanged reports whether file differs from object in size, or is older
+func localFileChanged(file string, object awsManager.S3Object) bool {
+	info, err := os.Stat(file)
+	return err != nil || info.Size() != object.Size || info.ModTime().Before(object.LastModified)
+}
+
+// removeUnwanted removes the files under dir that are not in wanted
+func removeUnwanted(dir string, wanted map[string]bool) error {
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || wanted[file] {
+			return err
+		}
+		return os.Remove(file)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+// cmd/transfer_test.go
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+func TestParseTransferPaths(t *testing.T) {
+	tests := []struct {
+		source, dest  string
+		local, remote string
+		push          bool
+		wantErr       string
+	}{
+		{source: "config.yaml", dest: ":/etc/app/", local: "config.yaml", remote: "/etc/app/", push: true},
+		{source: ":/tmp/job/logs", dest: "./logs", local: "./logs", remote: "/tmp/job/logs"},
+		{source: "a", dest: "b", wantErr: "both on this machine"},
+		{source: ":/a", dest: ":/b", wantErr: "both on the instances"},
+		{source: "a", dest: ":data", wantErr: "must be absolute"},
+		{source: ":/a", dest: "", wantErr: "must not be empty"},
+	}
+	for _, test := range tests {
+		local, remote, push, err := parseTransferPaths(test.source, test.dest)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%q %q: got error %v, want one containing %q", test.source, test.dest, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || local != test.local || remote != test.remote || push != test.push {
+			t.Errorf("%q %q: got %q, %q, %v, %v, want %q, %q, %v", test.source, test.dest, local, remote, push, err, test.local, test.remote, test.push)
+		}
+	}
+}
+
+func TestParseRankSelection(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "", want: []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{spec: "0,4-7", want: []int{0, 4, 5, 6, 7}},
+		{spec: "5, 2-3,2", want: []int{2, 3, 5}},
+		{spec: "8", wantErr: true},
+		{spec: "3-1", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "one", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseRankSelection(test.spec, 8)
+		if (err != nil) != test.wantErr || (!test.wantErr && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("%q: got %v, %v, want %v, error %v", test.spec, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestTransferScripts(t *testing.T) {
+	transfer := &fileTransfer{s3Client: &awsManager.S3Client{Bucket: "staging"}, region: "us-west-2", prefix: "jobs/sync-1"}
+	if got := transfer.pushScript("/etc/app/", "config.yaml"); !strings.Contains(got, "mkdir -p '/etc/app/'\naws s3 cp 's3://staging/jobs/sync-1/files/config.yaml' '/etc/app/'") {
+		t.Errorf("push of a file:\n%s", got)
+	}
+	if got := transfer.pushScript("/data", ""); !strings.Contains(got, "aws s3 cp 's3://staging/jobs/sync-1/files/' '/data' --recursive") {
+		t.Errorf("push of a directory:\n%s", got)
+	}
+	if got := transfer.pullScript("/tmp/out.log", 3); !strings.Contains(got, "aws s3 cp '/tmp/out.log' 's3://staging/jobs/sync-1/ranks/3/out.log'") {
+		t.Errorf("pull of a file:\n%s", got)
+	}
+
+	transfer.sync, transfer.delete = true, true
+	if got := transfer.pushScript("/data", ""); !strings.Contains(got, "aws s3 sync 's3://staging/jobs/sync-1/files/' '/data' --region 'us-west-2' --only-show-errors --delete") {
+		t.Errorf("sync to the instances:\n%s", got)
+	}
+	got := transfer.pullScript("/data", 3)
+	for _, want := range []string{
+		"aws s3 sync '/data' 's3://staging/jobs/sync-1/ranks/3/'",
+		"find . -type f -print0 | aws s3 cp - 's3://staging/jobs/sync-1/ranks/3.files'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sync from the instances lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestSyncStagingID(t *testing.T) {
+	id := syncStagingID("/home/me/config", "/etc/app")
+	if id != syncStagingID("/home/me/config", "/etc/app") {
+		t.Error("the same paths got different staging prefixes")
+	}
+	if id == syncStagingID("/home/me/config", "/etc/app2") {
+		t.Error("different paths got the same staging prefix")
+	}
+	if !jobIDPattern.MatchString(id) {
+		t.Errorf("%q is not a valid job ID", id)
+	}
+}
+
+func TestParseFileListing(t *testing.T) {
+	got := parseFileListing([]byte("./a.txt\x00./sub/b c.txt\x00"))
+	want := map[string]bool{"a.txt": true, "sub/b c.txt": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLocalFilesAndRemoveUnwanted(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		if err := os.WriteFile(file, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, isDir, err := localFiles(dir)
+	if err != nil || !isDir || len(files) != 2 || files["sub/b.txt"] == nil {
+		t.Fatalf("localFiles = %v, %v, %v, want a.txt and sub/b.txt", files, isDir, err)
+	}
+	files, isDir, err = localFiles(filepath.Join(dir, "a.txt"))
+	if err != nil || isDir || len(files) != 1 || files["a.txt"] == nil {
+		t.Fatalf("localFiles of a file = %v, %v, %v, want a.txt", files, isDir, err)
+	}
+
+	object := awsManager.S3Object{Size: int64(len("a.txt")), LastModified: time.Now().Add(-time.Hour)}
+	if localFileChanged(filepath.Join(dir, "a.txt"), object) {
+		t.Error("a file newer than its object of the same size counts as changed")
+	}
+	object.Size++
+	if !localFileChanged(filepath.Join(dir, "a.txt"), object) {
+		t.Error("a file of another size counts as unchanged")
+	}
+
+	if err := removeUnwanted(dir, map[string]bool{filepath.Join(dir, "a.txt"): true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("unwanted file survived: %v", err)
+	}
+	if err := removeUnwanted(filepath.Join(dir, "missing"), nil); err != nil {
+		t.Errorf("removing from a missing directory: %v", err)
+	}
+}
+
+func TestExecutionTimeoutOf(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    int
+	}{
+		{timeout: 0, want: maxExecutionTimeout},
+		{timeout: 90 * time.Minute, want: 5400},
+		{timeout: time.Millisecond, want: 1},
+		{timeout: 100 * time.Hour, want: maxExecutionTimeout},
+	}
+	for _, test := range tests {
+		if got := executionTimeoutOf(test.timeout); got != test.want {
+			t.Errorf("%v: got %d seconds, want %d", test.timeout, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// cmd/tunnel.go
+// This file implements the tunnel command, which forwards a local port to a port of one
+// rank's instance through SSM Session Manager (see portforward.go). Local tools such as
+// grpcurl, go tool pprof, or a debugger can then reach the rank's services without an
+// inbound security group rule. The tunnel stays open until interrupted.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/spf13/cobra"
+)
+
+// Ports of the services a rank runs, by the name --service takes
+var tunnelServices = map[string]int{
+	"grpc":  50051,
+	"pprof": defaultPprofPort,
+	"dlv":   defaultDebugPort,
+}
+
+// tunnelOptions are the flags of the tunnel command
+type tunnelOptions struct {
+	project   string
+	jobID     string
+	bucket    string
+	instance  string
+	rank      int
+	service   string
+	port      int
+	localPort int
+}
+
+// newTunnelCmd returns the tunnel command
+func newTunnelCmd() *cobra.Command {
+	o := &tunnelOptions{}
+	cmd := &cobra.Command{
+		Use:   "tunnel",
+		Short: "Forward a local port to a service of one rank through SSM",
+		Long: `tunnel opens an SSM port-forwarding session from a local port to a port on the
+instance of one rank and keeps it open until interrupted:
+
+  awsmpirun tunnel --job job-20240101-120000-abcdef --bucket my-staging --rank 2 --service pprof
+  go tool pprof http://127.0.0.1:<local port>/debug/pprof/heap
+
+Pick the remote port with --service or --port. The rank is found through the job
+manifest, so the job must have been started with --bucket; otherwise pass --instance.
+The Session Manager plugin for the AWS CLI must be installed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runTunnel(cmd.Context(), o)
+		},
+	}
+	cmd.Flags().StringVar(&o.project, "project", "", "Project the job belongs to (default: project in config.yaml)")
+	cmd.Flags().StringVar(&o.jobID, "job", "", "ID of the running job")
+	cmd.Flags().StringVar(&o.bucket, "bucket", "", "Staging bucket the job was started with")
+	cmd.Flags().StringVar(&o.instance, "instance", "", "Instance to connect to, instead of looking up --rank in the job manifest")
+	cmd.Flags().IntVar(&o.rank, "rank", 0, "Rank to connect to")
+	cmd.Flags().StringVar(&o.service, "service", "", "Service to reach: "+strings.Join(tunnelServiceNames(), ", "))
+	cmd.Flags().IntVar(&o.port, "port", 0, "Remote port to reach, instead of --service")
+	cmd.Flags().IntVar(&o.localPort, "local-port", 0, "Local port to listen on (0 picks a free port)")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newTunnelCmd())
+}
+
+func runTunnel(ctx context.Context, o *tunnelOptions) {
+	remotePort, err := tunnelRemotePort(o.service, o.port)
+	if err == nil && (o.localPort < 0 || o.localPort > 65535) {
+		err = fmt.Errorf("--local-port must be a port number, got %d", o.localPort)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	instanceID, err := resolveRankTarget(ctx, o.instance, o.project, o.bucket, o.jobID, o.rank)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	ssmClient, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		fmt.Printf("Error creating SSM client: %v\n", err)
+		os.Exit(1)
+	}
+	tunnel, err := startPortForward(ctx, ssmClient, instanceID, remotePort, o.localPort)
+	if err != nil {
+		fmt.Printf("Error opening tunnel: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Forwarding %s to port %d on %s. Press Ctrl-C to close the tunnel.\n", tunnel.LocalAddress(), remotePort, instanceID)
+	exited := make(chan error, 1)
+	go func() { exited <- tunnel.Wait() }()
+
+	// Ctrl-C and --timeout both cancel ctx
+	select {
+	case <-ctx.Done():
+		tunnel.Close()
+		fmt.Println("Tunnel closed.")
+	case err := <-exited:
+		tunnel.Close()
+		fmt.Printf("Error: the session ended: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// tunnelRemotePort returns the port to forward to, from exactly one of --service and --port
+func tunnelRemotePort(service string, port int) (int, error) {
+	switch {
+	case service != "" && port != 0:
+		return 0, fmt.Errorf("pass either --service or --port, not both")
+	case service != "":
+		port, ok := tunnelServices[service]
+		if !ok {
+			return 0, fmt.Errorf("unknown service %q, expected one of %s", service, strings.Join(tunnelServiceNames(), ", "))
+		}
+		return port, nil
+	case port > 0 && port <= 65535:
+		return port, nil
+	case port != 0:
+		return 0, fmt.Errorf("--port must be a port number, got %d", port)
+	}
+	return 0, fmt.Errorf("pass --service or --port")
+}
+
+func tunnelServiceNames() []string {
+	names := make([]string, 0, len(tunnelServices))
+	for name := range tunnelServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
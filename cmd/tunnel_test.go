@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTunnelRemotePort(t *testing.T) {
+	tests := []struct {
+		service string
+		port    int
+		want    int
+		wantErr string
+	}{
+		{service: "grpc", want: 50051},
+		{service: "pprof", want: defaultPprofPort},
+		{port: 8080, want: 8080},
+		{port: 65535, want: 65535},
+		{wantErr: "pass --service or --port"},
+		{service: "grpc", port: 8080, wantErr: "not both"},
+		{service: "ssh", wantErr: "unknown service"},
+		{port: -1, wantErr: "port number"},
+		{port: 70000, wantErr: "port number"},
+	}
+
+	for _, tt := range tests {
+		got, err := tunnelRemotePort(tt.service, tt.port)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("tunnelRemotePort(%q, %d) error = %v, want %q", tt.service, tt.port, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("tunnelRemotePort(%q, %d) = %d, %v, want %d", tt.service, tt.port, got, err, tt.want)
+		}
+	}
+}
+
+func TestTunnelPolicyMatchesProfile(t *testing.T) {
+	scope := policyScope{Region: "eu-west-1", Account: "123456789012", Bucket: "staging"}
+	profile, err := buildPolicies(policyForProfile, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := buildPolicies(policyForTunnel, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profile, tunnel) {
+		t.Errorf("tunnel policies differ from profile policies:\n%+v\n%+v", tunnel.Operator, profile.Operator)
+	}
+}
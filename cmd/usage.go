@@ -0,0 +1,185 @@
+// cmd/usage.go
+// This file records what every run used, for awsmpirun report. At the end of each
+// attempt at a job, including a failed one and each resume-phase, one usage record is
+// appended to usage.jsonl in the configuration directory and, with --bucket, written to
+// the project's usage/<month>/ prefix in the bucket, so the runs of everyone sharing
+// the bucket can be rolled up. A record holds who ran the job, in which project, on
+// how many instances of which types, for how long, and how much the ranks sent.
+// Recording never fails the run.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/platform"
+)
+
+// usageMonthLayout is the layout of the months usage is rolled up by
+const usageMonthLayout = "2006-01"
+
+// usageRecord is what one attempt at a job used
+type usageRecord struct {
+	JobID         string         `json:"job_id"`
+	Project       string         `json:"project,omitempty"`
+	User          string         `json:"user"`
+	Principal     string         `json:"principal,omitempty"` // ARN of the credentials the run used
+	Started       time.Time      `json:"started"`
+	Ended         time.Time      `json:"ended"`
+	Status        string         `json:"status"` // jobSucceeded, jobFailed, or jobStopped
+	Ranks         int            `json:"ranks"`
+	InstanceTypes map[string]int `json:"instance_types,omitempty"` // Ranks by instance type
+	BytesSent     int64          `json:"bytes_sent"`
+}
+
+// instanceHours is the time the record's instances were held for the run
+func (r usageRecord) instanceHours() float64 {
+	return float64(r.Ranks) * r.Ended.Sub(r.Started).Hours()
+}
+
+// month is the month the record counts in, the UTC month the attempt started in
+func (r usageRecord) month() string {
+	return r.Started.UTC().Format(usageMonthLayout)
+}
+
+// callerARN looks up the principal of the credentials, see usageUser
+var callerARN = awsManager.CallerARN
+
+// principalUser returns the user name in a principal ARN: the user of an IAM user, and
+// the session name of an assumed role, which is the user name for SSO sign-ins
+func principalUser(arn string) string {
+	if i := strings.LastIndex(arn, "/"); i >= 0 {
+		return arn[i+1:]
+	}
+	return arn
+}
+
+// usageUser returns who the run counts against and the principal behind it. Without an
+// identity from STS, the run counts against the local user.
+func usageUser(ctx context.Context) (string, string) {
+	arn, err := callerARN(ctx)
+	if err == nil && arn != "" {
+		return principalUser(arn), arn
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username, ""
+	}
+	return "unknown", ""
+}
+
+// usageLedgerPath is the local file the usage records of this machine are appended to
+func usageLedgerPath() (string, error) {
+	dir, err := platform.Current().ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "usage.jsonl"), nil
+}
+
+// usageRoot is the S3 prefix the usage records of project are kept under
+func usageRoot(project string) string {
+	return strings.TrimSuffix(mpi.JobPrefix(project, ""), "jobs/") + "usage/"
+}
+
+// usagePrefix is the S3 prefix the usage records of project in month are kept under
+func usagePrefix(project, month string) string {
+	return usageRoot(project) + month + "/"
+}
+
+// usageKey is the S3 key of r, one per attempt at a job
+func usageKey(r usageRecord) string {
+	return usagePrefix(r.Project, r.month()) + r.JobID + "-" + r.Started.UTC().Format("20060102T150405Z") + ".json"
+}
+
+// newUsageRecord describes the attempt at the run's job that started at started
+func (o *runOptions) newUsageRecord(ctx context.Context, s *runState, started, ended time.Time, status string) usageRecord {
+	r := usageRecord{
+		JobID:   o.jobID,
+		Project: o.project,
+		Started: started.UTC(),
+		Ended:   ended.UTC(),
+		Status:  status,
+		Ranks:   len(s.instances),
+	}
+	r.User, r.Principal = usageUser(ctx)
+	for _, instance := range s.instances {
+		if r.InstanceTypes == nil {
+			r.InstanceTypes = make(map[string]int)
+		}
+		r.InstanceTypes[instance.InstanceType]++
+	}
+	if s.stats.StatsReported {
+		r.BytesSent = s.stats.BytesSent
+	}
+	return r
+}
+
+// recordUsage appends the usage of an attempt at the job to the ledger, and with
+// --bucket stores it in the bucket as well
+func (o *runOptions) recordUsage(ctx context.Context, s *runState, started time.Time, status string) {
+	r := o.newUsageRecord(ctx, s, started, time.Now(), status)
+	line, err := json.Marshal(r)
+	if err != nil {
+		fmt.Printf("Warning: failed to record the usage of the run: %v\n", err)
+		return
+	}
+	if err := appendUsage(line); err != nil {
+		fmt.Printf("Warning: failed to record the usage of the run: %v\n", err)
+	}
+	if o.bucket == "" {
+		return
+	}
+	s3Client, err := awsManager.NewS3Client(ctx, o.bucket)
+	if err == nil {
+		err = s3Client.UploadBytes(ctx, line, usageKey(r))
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to record the usage of the run in bucket %s: %v\n", o.bucket, err)
+	}
+}
+
+// appendUsage appends one record to the local ledger, which only the user may read
+// since it names their principal
+func appendUsage(line []byte) error {
+	path, err := usageLedgerPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// parseUsage parses records, one JSON object per line, skipping blank lines
+func parseUsage(data []byte) ([]usageRecord, error) {
+	var records []usageRecord
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var r usageRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
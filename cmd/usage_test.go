@@ -0,0 +1,122 @@
+// cmd/usage_test.go
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// fakeCaller makes the runs of a test count against arn, or "" for no identity
+func fakeCaller(t *testing.T, arn string) {
+	saved := callerARN
+	t.Cleanup(func() { callerARN = saved })
+	callerARN = func(context.Context) (string, error) {
+		if arn == "" {
+			return "", errors.New("no credentials")
+		}
+		return arn, nil
+	}
+}
+
+func TestPrincipalUser(t *testing.T) {
+	tests := []struct {
+		arn  string
+		want string
+	}{
+		{"arn:aws:iam::123456789012:user/ana", "ana"},
+		{"arn:aws:iam::123456789012:user/lab/ana", "ana"},
+		{"arn:aws:sts::123456789012:assumed-role/AWSReservedSSO_Researcher_0abc/ana@lab.example", "ana@lab.example"},
+		{"arn:aws:iam::123456789012:root", "arn:aws:iam::123456789012:root"},
+	}
+	for _, tt := range tests {
+		if got := principalUser(tt.arn); got != tt.want {
+			t.Errorf("principalUser(%q) = %q, want %q", tt.arn, got, tt.want)
+		}
+	}
+}
+
+func TestUsageKey(t *testing.T) {
+	started := time.Date(2025, 1, 31, 23, 30, 0, 0, time.FixedZone("PST", -8*3600))
+	tests := []struct {
+		project string
+		want    string
+	}{
+		{"team-a", "projects/team-a/usage/2025-02/job-1-20250201T073000Z.json"},
+		{"", "usage/2025-02/job-1-20250201T073000Z.json"},
+	}
+	for _, tt := range tests {
+		r := usageRecord{JobID: "job-1", Project: tt.project, Started: started}
+		if got := usageKey(r); got != tt.want {
+			t.Errorf("usageKey(%q) = %q, want %q", tt.project, got, tt.want)
+		}
+	}
+}
+
+func TestNewUsageRecord(t *testing.T) {
+	o := newRunOptions()
+	o.jobID, o.project = "job-1", "team-a"
+	s := o.newRunState()
+	s.instances = []awsManager.InstanceInfo{{InstanceType: "c7i.large"}, {InstanceType: "c7i.large"}, {InstanceType: "hpc7g.16xlarge"}}
+	s.stats.BytesSent, s.stats.StatsReported = 4096, true
+	started := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	fakeCaller(t, "arn:aws:sts::123456789012:assumed-role/Researcher/ana")
+	r := o.newUsageRecord(context.Background(), s, started, started.Add(90*time.Minute), jobSucceeded)
+	want := usageRecord{
+		JobID: "job-1", Project: "team-a", User: "ana", Principal: "arn:aws:sts::123456789012:assumed-role/Researcher/ana",
+		Started: started, Ended: started.Add(90 * time.Minute), Status: jobSucceeded, Ranks: 3,
+		InstanceTypes: map[string]int{"c7i.large": 2, "hpc7g.16xlarge": 1}, BytesSent: 4096,
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("newUsageRecord() = %+v, want %+v", r, want)
+	}
+	if r.instanceHours() != 4.5 {
+		t.Errorf("instanceHours() = %v, want 4.5", r.instanceHours())
+	}
+
+	// Without an identity the run counts against the local user
+	fakeCaller(t, "")
+	s.stats.StatsReported = false
+	r = o.newUsageRecord(context.Background(), s, started, started, jobFailed)
+	if r.User == "" || r.Principal != "" || r.BytesSent != 0 {
+		t.Errorf("without an identity: user %q, principal %q, bytes %d", r.User, r.Principal, r.BytesSent)
+	}
+}
+
+func TestRunPipelineRecordsUsage(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	fakeCaller(t, "arn:aws:iam::123456789012:user/ana")
+	o := newRunOptions()
+	o.jobID, o.vpcID, o.executablePath = "job-1", "vpc-1", "./solver"
+
+	var ran []string
+	o.runPipeline(context.Background(), o.newRunState(), fakePhases(&ran, map[string]bool{phaseExecute: true}))
+	saved, err := loadRunState("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.runPipeline(context.Background(), saved, fakePhases(&ran, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := localUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, r := range records {
+		if r.JobID != "job-1" || r.User != "ana" || r.Ended.Before(r.Started) {
+			t.Errorf("record %+v", r)
+		}
+		statuses = append(statuses, r.Status)
+	}
+	if want := []string{jobFailed, jobSucceeded}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("recorded attempts %v, want %v", statuses, want)
+	}
+}
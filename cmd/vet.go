@@ -0,0 +1,623 @@
+// cmd/vet.go
+// This file implements the vet command, which reads the source of a program written
+// against the mpi package and reports the mistakes that otherwise only show once the
+// instances are running it: using the communicator without mpi.Init or after Finalize,
+// a main package that never calls Finalize, receiving into a value rather than a
+// pointer, and receiving a type with a tag the program only sends other types with.
+// Only the program's own package is type-checked; every import is stubbed, so vet
+// needs neither the module's dependencies nor a Go toolchain, and only the values whose
+// types the package defines itself are compared. The functions that need a
+// communicator are read from the mpi source embedded in this binary, so the list
+// always matches the runtime. build runs vet on its package before anything is staged.
+
+package cmd
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+	"github.com/spf13/cobra"
+)
+
+// mpiImportPath is the import path of the runtime the programs use
+const mpiImportPath = modulePath + "/mpi"
+
+// The checks of vet
+const (
+	vetInit          = "init"           // The communicator is used without mpi.Init
+	vetBeforeInit    = "before-init"    // The communicator is used before mpi.Init
+	vetFinalize      = "finalize"       // The program never calls Finalize
+	vetAfterFinalize = "after-finalize" // The communicator is used after Finalize
+	vetRecvPointer   = "recv-pointer"   // RecvValue is given a value rather than a pointer
+	vetTypes         = "types"          // A tag is received as a type it is never sent as
+)
+
+// vetOptions are the flags of the vet command
+type vetOptions struct {
+	source string
+	pkg    string
+}
+
+// newVetCmd returns the vet command
+func newVetCmd() *cobra.Command {
+	o := &vetOptions{}
+	cmd := &cobra.Command{
+		Use:   "vet",
+		Short: "Check a Go program for misuse of the mpi package before running it",
+		Long: `vet reads the package given with --src and --package and reports misuse of the mpi
+package that would otherwise only fail on the instances:
+
+    init            a collective, mpi.World, or a *mpi.Comm is used, but the program never calls mpi.Init
+    before-init     mpi.World or a collective is called before mpi.Init in the same function
+    finalize        the main package calls mpi.Init but never Finalize
+    after-finalize  the communicator is used after its Finalize in the same function
+    recv-pointer    RecvValue is given a value to decode into instead of a pointer
+    types           RecvValue receives a type with a tag the program only sends other types with
+
+It exits non-zero when it finds anything. Only the package itself is type-checked, so
+the types check compares the values of types the package defines or builds from the
+built-in ones. build runs the same checks before staging the source; pass --vet=false
+there to skip them.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := filepath.Join(o.source, o.pkg)
+			findings, err := vetProgram(dir)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if writeVetFindings(os.Stdout, dir, findings) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&o.source, "src", ".", "Local directory with the module")
+	cmd.Flags().StringVar(&o.pkg, "package", ".", "Package to check, relative to --src")
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(newVetCmd())
+}
+
+// vetBeforeBuild checks the package pkg of the module in src before a build stages it,
+// and reports whether the build may go on. It leaves package patterns alone, and a
+// package it cannot read to the compiler.
+func vetBeforeBuild(src, pkg string) bool {
+	if strings.Contains(pkg, "...") {
+		return true
+	}
+	dir := filepath.Join(src, pkg)
+	findings, err := vetProgram(dir)
+	if err != nil {
+		fmt.Printf("Warning: vet skipped %s: %v\n", dir, err)
+		return true
+	}
+	if len(findings) == 0 {
+		return true
+	}
+	writeVetFindings(os.Stdout, dir, findings)
+	fmt.Println("Fix the problems, or build anyway with --vet=false")
+	return false
+}
+
+// vetFinding is one misuse vet found
+type vetFinding struct {
+	Pos     token.Position
+	Check   string
+	Message string
+}
+
+func (f vetFinding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", f.Pos, f.Message, f.Check)
+}
+
+// writeVetFindings prints the findings in dir and a summary line, and returns how many
+// there were
+func writeVetFindings(w io.Writer, dir string, findings []vetFinding) int {
+	for _, f := range findings {
+		fmt.Fprintln(w, f)
+	}
+	if len(findings) == 0 {
+		fmt.Fprintf(w, "vet: no problems found in %s\n", dir)
+	} else {
+		fmt.Fprintf(w, "vet: %d problems found in %s\n", len(findings), dir)
+	}
+	return len(findings)
+}
+
+// vetTarget is the platform the instances build for, which picks the files vet reads
+func vetTarget() build.Context {
+	target := build.Default
+	target.GOOS, target.GOARCH = "linux", "amd64"
+	return target
+}
+
+// parseVetPackage parses the Go files of the package in dir the instances would
+// build, leaving out tests
+func parseVetPackage(fset *token.FileSet, dir string) ([]*ast.File, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	target := vetTarget()
+	var files []*ast.File
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := target.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 && file.Name.Name != files[0].Name.Name {
+			return nil, fmt.Errorf("%s holds packages %s and %s", dir, files[0].Name.Name, file.Name.Name)
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return files, nil
+}
+
+// stubImporter gives every import an empty package, so the program type-checks
+// without its dependencies; whatever comes from them has an invalid type
+type stubImporter struct{}
+
+func (stubImporter) Import(importPath string) (*types.Package, error) {
+	name := path.Base(importPath)
+	if strings.HasPrefix(name, "v") && strings.Trim(name[1:], "0123456789") == "" && path.Dir(importPath) != "." {
+		name = path.Base(path.Dir(importPath))
+	}
+	pkg := types.NewPackage(importPath, strings.NewReplacer("-", "_", ".", "_").Replace(name))
+	pkg.MarkComplete()
+	return pkg, nil
+}
+
+// mpiCommFuncs returns the functions of the mpi package that take the communicator as
+// their first argument, read from its embedded source
+func mpiCommFuncs() (map[string]bool, error) {
+	names, err := fs.Glob(mpi.Source, "*.go")
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	funcs := make(map[string]bool)
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		data, err := fs.ReadFile(mpi.Source, name)
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(fset, name, data, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !fn.Name.IsExported() || len(fn.Type.Params.List) == 0 {
+				continue
+			}
+			if star, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr); ok {
+				if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "Comm" {
+					funcs[fn.Name.Name] = true
+				}
+			}
+		}
+	}
+	return funcs, nil
+}
+
+// vetter holds what one run of vet knows about the program
+type vetter struct {
+	fset      *token.FileSet
+	info      *types.Info
+	pkg       *types.Package
+	commFuncs map[string]bool
+	comms     map[types.Object]bool // Variables holding the communicator
+	findings  []vetFinding
+}
+
+// vetProgram returns what vet finds in the package in dir, in source order
+func vetProgram(dir string) ([]vetFinding, error) {
+	fset := token.NewFileSet()
+	files, err := parseVetPackage(fset, dir)
+	if err != nil {
+		return nil, err
+	}
+	commFuncs, err := mpiCommFuncs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the mpi package: %v", err)
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	config := types.Config{Importer: stubImporter{}, Error: func(error) {}}
+	pkg, _ := config.Check(files[0].Name.Name, fset, files, info)
+
+	v := &vetter{fset: fset, info: info, pkg: pkg, commFuncs: commFuncs, comms: make(map[types.Object]bool)}
+	v.findComms(files)
+	v.checkLifecycle(files)
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			if block := blockStatements(n); block != nil {
+				v.checkBlock(block)
+			}
+			return true
+		})
+	}
+	v.checkReceives(files)
+	sort.SliceStable(v.findings, func(i, j int) bool {
+		a, b := v.findings[i].Pos, v.findings[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return v.findings, nil
+}
+
+func (v *vetter) report(pos token.Pos, check, format string, args ...any) {
+	v.findings = append(v.findings, vetFinding{Pos: v.fset.Position(pos), Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+// line is the line pos is on
+func (v *vetter) line(pos token.Pos) int {
+	return v.fset.Position(pos).Line
+}
+
+// mpiFunc returns the name of the mpi function call calls, if it calls one
+func (v *vetter) mpiFunc(call *ast.CallExpr) (string, bool) {
+	fun := ast.Unparen(call.Fun)
+	switch index := fun.(type) {
+	case *ast.IndexExpr:
+		fun = index.X
+	case *ast.IndexListExpr:
+		fun = index.X
+	}
+	sel, ok := fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	return sel.Sel.Name, v.isMPI(sel.X)
+}
+
+// isMPI reports whether expr names the mpi package
+func (v *vetter) isMPI(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	name, ok := v.info.Uses[ident].(*types.PkgName)
+	return ok && name.Imported().Path() == mpiImportPath
+}
+
+// commMethod returns the communicator variable and the method call calls on it, if it
+// calls a method of one
+func (v *vetter) commMethod(call *ast.CallExpr) (types.Object, string, bool) {
+	sel, ok := ast.Unparen(call.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return nil, "", false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return nil, "", false
+	}
+	obj := v.info.Uses[ident]
+	return obj, sel.Sel.Name, obj != nil && v.comms[obj]
+}
+
+// isCommType reports whether expr is the type *mpi.Comm
+func (v *vetter) isCommType(expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := star.X.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Comm" && v.isMPI(sel.X)
+}
+
+// findComms records the variables holding a communicator: those assigned from
+// mpi.Init or mpi.World, and those declared as *mpi.Comm
+func (v *vetter) findComms(files []*ast.File) {
+	fromRuntime := func(expr ast.Expr) bool {
+		call, ok := ast.Unparen(expr).(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		name, ok := v.mpiFunc(call)
+		return ok && (name == "Init" || name == "World")
+	}
+	record := func(ident *ast.Ident) {
+		if obj := v.info.Defs[ident]; obj != nil {
+			v.comms[obj] = true
+		} else if obj := v.info.Uses[ident]; obj != nil {
+			v.comms[obj] = true
+		}
+	}
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if len(n.Rhs) == 1 && len(n.Lhs) > 0 && fromRuntime(n.Rhs[0]) {
+					if ident, ok := n.Lhs[0].(*ast.Ident); ok {
+						record(ident)
+					}
+				}
+			case *ast.ValueSpec:
+				if (len(n.Values) == 1 && len(n.Names) > 0 && fromRuntime(n.Values[0])) || (n.Type != nil && v.isCommType(n.Type)) {
+					record(n.Names[0])
+					for _, name := range n.Names[1:] {
+						if n.Type != nil {
+							record(name)
+						}
+					}
+				}
+			case *ast.Field:
+				if v.isCommType(n.Type) {
+					for _, name := range n.Names {
+						record(name)
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+// needsComm reports whether call needs a communicator: a function of the mpi package
+// that takes one, or mpi.World
+func (v *vetter) needsComm(call *ast.CallExpr) (string, bool) {
+	name, ok := v.mpiFunc(call)
+	if !ok || !(name == "World" || v.commFuncs[name]) {
+		return "", false
+	}
+	return "mpi." + name, true
+}
+
+// checkLifecycle reports a main package that uses the communicator without mpi.Init,
+// or calls mpi.Init without ever calling Finalize
+func (v *vetter) checkLifecycle(files []*ast.File) {
+	if files[0].Name.Name != "main" {
+		return
+	}
+	var inits []token.Pos
+	var firstUse ast.Node
+	var firstUseName string
+	finalized := false
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if name, ok := v.mpiFunc(n); ok && name == "Init" {
+					inits = append(inits, n.Pos())
+				}
+				if name, ok := v.needsComm(n); ok && firstUse == nil {
+					firstUse, firstUseName = n, name
+				}
+				if sel, ok := ast.Unparen(n.Fun).(*ast.SelectorExpr); ok && sel.Sel.Name == "Finalize" && len(n.Args) == 0 {
+					finalized = true
+				}
+			case *ast.Ident:
+				if obj := v.info.Uses[n]; obj != nil && v.comms[obj] && firstUse == nil {
+					firstUse, firstUseName = n, n.Name
+				}
+			}
+			return true
+		})
+	}
+	if len(inits) == 0 {
+		if firstUse != nil {
+			v.report(firstUse.Pos(), vetInit, "%s is used, but the program never calls mpi.Init", firstUseName)
+		}
+		return
+	}
+	if !finalized {
+		for _, pos := range inits {
+			v.report(pos, vetFinalize, "mpi.Init is called, but the program never calls Finalize; the other ranks see this rank fail when it exits")
+		}
+	}
+}
+
+// inspectNow calls fn on the nodes of n that run when n does, leaving out function
+// literals, and deferred and go statements. With unconditional, it also leaves out the
+// blocks of n, which may not run.
+func inspectNow(n ast.Node, unconditional bool, fn func(ast.Node)) {
+	ast.Inspect(n, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.FuncLit, *ast.DeferStmt, *ast.GoStmt:
+			return false
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+			if unconditional && node != n {
+				return false
+			}
+		}
+		fn(node)
+		return true
+	})
+}
+
+// blockStatements returns the statements of n if it is a block of statements
+func blockStatements(n ast.Node) []ast.Stmt {
+	switch n := n.(type) {
+	case *ast.BlockStmt:
+		return n.List
+	case *ast.CaseClause:
+		return n.Body
+	case *ast.CommClause:
+		return n.Body
+	}
+	return nil
+}
+
+// checkBlock reports uses of the communicator in the statements of one block that
+// come before mpi.Init or after the communicator's Finalize. Only the calls a
+// statement makes whenever it runs count, not those in its branches.
+func (v *vetter) checkBlock(stmts []ast.Stmt) {
+	for i, stmt := range stmts {
+		inspectNow(stmt, true, func(n ast.Node) {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return
+			}
+			if name, ok := v.mpiFunc(call); ok && name == "Init" {
+				v.checkBeforeInit(stmts[:i], call)
+			}
+			if obj, method, ok := v.commMethod(call); ok && method == "Finalize" {
+				v.checkAfterFinalize(stmts[i+1:], obj, call)
+			}
+		})
+	}
+}
+
+// checkBeforeInit reports the first call in stmts that needs the communicator, which
+// run before init
+func (v *vetter) checkBeforeInit(stmts []ast.Stmt, init *ast.CallExpr) {
+	for _, stmt := range stmts {
+		var found *ast.CallExpr
+		var name string
+		inspectNow(stmt, false, func(n ast.Node) {
+			if call, ok := n.(*ast.CallExpr); ok && found == nil {
+				if name, ok = v.needsComm(call); ok {
+					found = call
+				}
+			}
+		})
+		if found != nil {
+			v.report(found.Pos(), vetBeforeInit, "%s is called before mpi.Init on line %d", name, v.line(init.Pos()))
+			return
+		}
+	}
+}
+
+// checkAfterFinalize reports the first use of comm in stmts, which run after
+// finalize was called on it
+func (v *vetter) checkAfterFinalize(stmts []ast.Stmt, comm types.Object, finalize *ast.CallExpr) {
+	for _, stmt := range stmts {
+		var found *ast.Ident
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok && found == nil && v.info.Uses[ident] == comm {
+				found = ident
+			}
+			return found == nil
+		})
+		if found != nil {
+			v.report(found.Pos(), vetAfterFinalize, "%s is used after %s.Finalize() on line %d", found.Name, comm.Name(), v.line(finalize.Pos()))
+			return
+		}
+	}
+}
+
+// typeString names t as the package's source would
+func (v *vetter) typeString(t types.Type) string {
+	return types.TypeString(t, types.RelativeTo(v.pkg))
+}
+
+// knownType returns the type of expr when the package alone determines it
+func (v *vetter) knownType(expr ast.Expr) (types.Type, bool) {
+	t := v.info.TypeOf(expr)
+	if t == nil || strings.Contains(types.TypeString(t, nil), "invalid type") {
+		return nil, false
+	}
+	return types.Default(t), true
+}
+
+// tagOf returns the value of a constant tag
+func (v *vetter) tagOf(expr ast.Expr) (string, bool) {
+	value := v.info.Types[expr].Value
+	if value == nil || value.Kind() != constant.Int {
+		return "", false
+	}
+	return value.ExactString(), true
+}
+
+// checkReceives reports RecvValue calls given a value rather than a pointer, and those
+// receiving a type with a constant tag the program only sends other types with
+func (v *vetter) checkReceives(files []*ast.File) {
+	type send struct {
+		typ  types.Type
+		line int
+	}
+	type receive struct {
+		call *ast.CallExpr
+		tag  string
+		typ  types.Type
+	}
+	sends := make(map[string][]send)
+	var receives []receive
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) < 3 {
+				return true
+			}
+			_, method, ok := v.commMethod(call)
+			if !ok || (method != "SendValue" && method != "RecvValue") {
+				return true
+			}
+			arg := call.Args[2]
+			t, known := v.knownType(arg)
+			if method == "RecvValue" {
+				if _, isAddr := ast.Unparen(arg).(*ast.UnaryExpr); !isAddr && known {
+					if _, isPointer := t.Underlying().(*types.Pointer); !isPointer {
+						v.report(arg.Pos(), vetRecvPointer, "RecvValue decodes into a %s, which must be a pointer such as &%s", v.typeString(t), types.ExprString(arg))
+						return true
+					}
+				}
+			}
+			tag, constTag := v.tagOf(call.Args[1])
+			if !known || !constTag {
+				return true
+			}
+			if method == "SendValue" {
+				sends[tag] = append(sends[tag], send{typ: t, line: v.line(call.Pos())})
+			} else if pointer, ok := t.Underlying().(*types.Pointer); ok {
+				receives = append(receives, receive{call: call, tag: tag, typ: pointer.Elem()})
+			}
+			return true
+		})
+	}
+	for _, r := range receives {
+		sent := sends[r.tag]
+		if len(sent) == 0 {
+			continue
+		}
+		var kinds []string
+		matched := false
+		for _, s := range sent {
+			if types.Identical(s.typ, r.typ) {
+				matched = true
+			}
+			if pointer, ok := s.typ.Underlying().(*types.Pointer); ok && types.Identical(pointer.Elem(), r.typ) {
+				matched = true
+			}
+			kinds = append(kinds, fmt.Sprintf("%s on line %d", v.typeString(s.typ), s.line))
+		}
+		if !matched {
+			v.report(r.call.Pos(), vetTypes, "RecvValue receives a %s with tag %s, but the program sends it %s", v.typeString(r.typ), r.tag, strings.Join(kinds, ", "))
+		}
+	}
+}
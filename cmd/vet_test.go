@@ -0,0 +1,245 @@
+// cmd/vet_test.go
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vetSourceOf returns a program importing the mpi package around body
+func vetSourceOf(body string) string {
+	return `package main
+
+import (
+	"fmt"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+type point struct{ X, Y float64 }
+
+const tagPoint = 7
+
+var _ = fmt.Sprint
+
+` + body
+}
+
+func TestVetProgram(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string // "line: check" of every finding
+	}{
+		{
+			name: "clean",
+			src: vetSourceOf(`func main() {
+	c, err := mpi.Init()
+	if err != nil {
+		return
+	}
+	defer c.Finalize()
+	if c.Rank() == 0 {
+		c.SendValue(1, tagPoint, point{1, 2})
+	} else {
+		var p point
+		c.RecvValue(0, tagPoint, &p)
+	}
+	total, _ := mpi.AllreduceSum(c, []float64{1})
+	fmt.Println(total)
+}
+`),
+		},
+		{
+			name: "no init",
+			src: vetSourceOf(`func main() {
+	total, _ := mpi.AllreduceSum(mpi.World(), []float64{1})
+	fmt.Println(total)
+}
+`),
+			want: []string{"16: init"},
+		},
+		{
+			name: "no finalize",
+			src: vetSourceOf(`func main() {
+	c, _ := mpi.Init()
+	fmt.Println(c.Rank())
+}
+`),
+			want: []string{"16: finalize"},
+		},
+		{
+			name: "world before init",
+			src: vetSourceOf(`func main() {
+	fmt.Println(mpi.World().Rank())
+	c, _ := mpi.Init()
+	defer c.Finalize()
+}
+`),
+			want: []string{"16: before-init"},
+		},
+		{
+			name: "used after finalize",
+			src: vetSourceOf(`func main() {
+	c, _ := mpi.Init()
+	if err := c.Finalize(); err != nil {
+		return
+	}
+	mpi.BroadcastValue(c, 0, 1)
+}
+`),
+			want: []string{"20: after-finalize"},
+		},
+		{
+			name: "finalize in a branch",
+			src: vetSourceOf(`func main() {
+	c, _ := mpi.Init()
+	if c.Size() == 1 {
+		c.Finalize()
+		return
+	}
+	c.SendValue(1, tagPoint, point{})
+	c.Finalize()
+}
+`),
+		},
+		{
+			name: "receive into a value",
+			src: vetSourceOf(`func main() {
+	c, _ := mpi.Init()
+	defer c.Finalize()
+	var p point
+	c.RecvValue(0, tagPoint, p)
+}
+`),
+			want: []string{"19: recv-pointer"},
+		},
+		{
+			name: "type mismatch",
+			src: vetSourceOf(`func main() {
+	c, _ := mpi.Init()
+	defer c.Finalize()
+	if c.Rank() == 0 {
+		c.SendValue(1, tagPoint, point{1, 2})
+		c.SendValue(1, 8, 3)
+		return
+	}
+	var x float64
+	c.RecvValue(0, tagPoint, &x)
+	var n int
+	c.RecvValue(0, 8, &n)
+}
+`),
+			want: []string{"24: types"},
+		},
+		{
+			name: "communicator parameter",
+			src: vetSourceOf(`func exchange(comm *mpi.Comm) {
+	comm.SendValue(1, tagPoint, []int{1})
+	var got []string
+	comm.RecvValue(0, tagPoint, &got)
+}
+
+func main() {
+	c, _ := mpi.Init()
+	exchange(c)
+	c.Finalize()
+}
+`),
+			want: []string{"18: types"},
+		},
+		{
+			name: "aliased import",
+			src: `package main
+
+import runtime "github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+
+func main() {
+	c, _ := runtime.Init()
+	c.Finalize()
+	c.Rank()
+}
+`,
+			want: []string{"8: after-finalize"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(tt.src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// Tests and files for other platforms are not what the instances build
+			os.WriteFile(filepath.Join(dir, "main_test.go"), []byte("package main\n\nfunc init() { mpi.World() }\n"), 0o644)
+			os.WriteFile(filepath.Join(dir, "main_windows.go"), []byte("package main\n\nfunc init() { mpi.World() }\n"), 0o644)
+
+			findings, err := vetProgram(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range findings {
+				got = append(got, fmt.Sprintf("%d: %s", f.Pos.Line, f.Check))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findings %v, want %v\n%v", got, tt.want, findings)
+			}
+		})
+	}
+}
+
+func TestVetProgramErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := vetProgram(dir); err == nil || !strings.Contains(err.Error(), "no Go files") {
+		t.Errorf("empty directory: error %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.go"), []byte("package main\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.go"), []byte("package solver\n"), 0o644)
+	if _, err := vetProgram(dir); err == nil || !strings.Contains(err.Error(), "packages main and solver") {
+		t.Errorf("two packages: error %v", err)
+	}
+}
+
+func TestMPICommFuncs(t *testing.T) {
+	funcs, err := mpiCommFuncs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"AllreduceSum", "BroadcastValue", "GatherTo", "MeasureClockOffsets"} {
+		if !funcs[name] {
+			t.Errorf("mpiCommFuncs() is missing %s", name)
+		}
+	}
+	for _, name := range []string{"Init", "World", "Logger", "ClockSkew"} {
+		if funcs[name] {
+			t.Errorf("mpiCommFuncs() has %s, which takes no communicator", name)
+		}
+	}
+}
+
+func TestVetBeforeBuild(t *testing.T) {
+	src := t.TempDir()
+	solver := filepath.Join(src, "cmd", "solver")
+	os.MkdirAll(solver, 0o755)
+	os.WriteFile(filepath.Join(solver, "main.go"), []byte(vetSourceOf("func main() {\n\tmpi.Init()\n}\n")), 0o644)
+
+	tests := []struct {
+		pkg  string
+		want bool
+	}{
+		{pkg: "./cmd/solver", want: false},
+		{pkg: "./...", want: true},  // Patterns are left to go build
+		{pkg: "./cmd", want: true},  // No Go files to read
+		{pkg: "./none", want: true}, // A package that is not there fails the build itself
+	}
+	for _, tt := range tests {
+		if got := vetBeforeBuild(src, tt.pkg); got != tt.want {
+			t.Errorf("vetBeforeBuild(%q) = %v, want %v", tt.pkg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// examples/canary.go
+// This file is the program of awsmpirun canary. Unlike the examples it runs on every
+// rank to a deadline and every rank reports, so a cluster check says which ranks are
+// unhealthy rather than only that the job failed. Each rank joins the job, exchanges
+// a token with every other rank for a few rounds, measures its clock against rank 0's,
+// sums the ranks through rank 0, and prints one line: "canary: pass ..." or
+// "canary: fail CHECK: reason". A passing line ends with the rank's clock offset, as
+// "clock +1.2ms ±80µs", for awsmpirun canary to judge the skew across the ranks.
+
+package examples
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// The checks of the canary, in the order it makes them
+const (
+	CanaryConnect    = "connect"
+	CanaryAllToAll   = "all-to-all"
+	CanaryClock      = "clock"
+	CanaryCollective = "collective"
+	CanaryFinalize   = "finalize"
+)
+
+// canaryMarker starts the report line of a rank
+const canaryMarker = "canary: "
+
+// canaryClockMarker starts the clock offset in a passing report
+const canaryClockMarker = ", clock "
+
+// canaryClockSamples is how many round trips rank 0 takes to each rank's clock
+const canaryClockSamples = 5
+
+// CanaryReport is the result one rank reported
+type CanaryReport struct {
+	Passed bool
+	Check  string // The check that failed; empty when the rank passed
+	Detail string
+	Clock  *mpi.ClockOffset // The rank's clock against rank 0's, from a passing report; Rank is not set
+}
+
+// RunCanary joins the job, makes the canary's checks for rounds rounds, and writes the
+// rank's report to out. It gives up on the check it is in once deadline has passed.
+func RunCanary(rounds int, deadline time.Duration, out io.Writer) error {
+	var mu sync.Mutex
+	check := CanaryConnect
+	enter := func(next string) {
+		mu.Lock()
+		check = next
+		mu.Unlock()
+	}
+	type result struct {
+		detail string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		detail, err := canaryChecks(rounds, enter)
+		done <- result{detail, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(deadline):
+		mu.Lock()
+		r.err = fmt.Errorf("%s: timed out after %v", check, deadline)
+		mu.Unlock()
+	}
+	detail, err := r.detail, r.err
+	if err != nil {
+		fmt.Fprintf(out, "%sfail %v\n", canaryMarker, err)
+		return err
+	}
+	fmt.Fprintf(out, "%spass %s\n", canaryMarker, detail)
+	return nil
+}
+
+// canaryChecks runs the checks, calling enter as each starts, and describes how they went
+func canaryChecks(rounds int, enter func(check string)) (string, error) {
+	c, err := mpi.Init()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", CanaryConnect, err)
+	}
+	rank, size := c.Rank(), c.Size()
+
+	enter(CanaryAllToAll)
+	var slowest time.Duration
+	for round := 0; round < rounds; round++ {
+		start := time.Now()
+		for peer := 0; peer < size; peer++ {
+			if peer == rank {
+				continue
+			}
+			if err := c.SendValue(peer, tagCanary, canaryToken(rank, peer, round)); err != nil {
+				return "", fmt.Errorf("%s: send to rank %d: %v", CanaryAllToAll, peer, err)
+			}
+		}
+		for peer := 0; peer < size; peer++ {
+			if peer == rank {
+				continue
+			}
+			var token uint64
+			if err := c.RecvValue(peer, tagCanary, &token); err != nil {
+				return "", fmt.Errorf("%s: receive from rank %d: %v", CanaryAllToAll, peer, err)
+			}
+			if want := canaryToken(peer, rank, round); token != want {
+				return "", fmt.Errorf("%s: rank %d sent %#x in round %d, want %#x", CanaryAllToAll, peer, token, round, want)
+			}
+		}
+		slowest = max(slowest, time.Since(start))
+	}
+
+	enter(CanaryClock)
+	offsets, err := mpi.MeasureClockOffsets(c, canaryClockSamples)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", CanaryClock, err)
+	}
+	clock := offsets[rank]
+
+	enter(CanaryCollective)
+	start := time.Now()
+	total, err := canarySum(c, rank)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", CanaryCollective, err)
+	}
+	if want := size * (size - 1) / 2; total != want {
+		return "", fmt.Errorf("%s: the ranks sum to %d, want %d", CanaryCollective, total, want)
+	}
+	collective := time.Since(start)
+
+	enter(CanaryFinalize)
+	if err := c.Finalize(); err != nil {
+		return "", fmt.Errorf("%s: %v", CanaryFinalize, err)
+	}
+	return fmt.Sprintf("%d peers, %d rounds, slowest round %v, sum %v%s%v",
+		size-1, rounds, slowest.Round(time.Microsecond), collective.Round(time.Microsecond), canaryClockMarker, clock), nil
+}
+
+// parseCanaryClock returns the clock offset at the end of a passing report's detail, as
+// mpi.ClockOffset formats it
+func parseCanaryClock(detail string) *mpi.ClockOffset {
+	i := strings.LastIndex(detail, canaryClockMarker)
+	if i < 0 {
+		return nil
+	}
+	offset, uncertainty, ok := strings.Cut(detail[i+len(canaryClockMarker):], " ±")
+	if !ok {
+		return nil
+	}
+	o, err := time.ParseDuration(offset)
+	if err != nil {
+		return nil
+	}
+	u, err := time.ParseDuration(uncertainty)
+	if err != nil {
+		return nil
+	}
+	return &mpi.ClockOffset{Offset: o, RTT: 2 * u}
+}
+
+// canaryToken is what rank from sends rank to in a round, distinct for every pair and
+// round so a misrouted message is caught
+func canaryToken(from, to, round int) uint64 {
+	return uint64(round)<<48 | uint64(from)<<24 | uint64(to)
+}
+
+// canarySum adds value over all ranks on rank 0 and sends the total back to every rank
+func canarySum(c *mpi.Comm, value int) (int, error) {
+	if c.Rank() != 0 {
+		if err := c.SendValue(0, tagCanarySum, value); err != nil {
+			return 0, err
+		}
+		var total int
+		err := c.RecvValue(0, tagCanaryTotal, &total)
+		return total, err
+	}
+	total := value
+	for source := 1; source < c.Size(); source++ {
+		var part int
+		if err := c.RecvValue(source, tagCanarySum, &part); err != nil {
+			return 0, fmt.Errorf("receive from rank %d: %v", source, err)
+		}
+		total += part
+	}
+	for dest := 1; dest < c.Size(); dest++ {
+		if err := c.SendValue(dest, tagCanaryTotal, total); err != nil {
+			return 0, fmt.Errorf("send to rank %d: %v", dest, err)
+		}
+	}
+	return total, nil
+}
+
+// ParseCanaryReport returns the report in a rank's output, and whether it has one
+func ParseCanaryReport(output string) (CanaryReport, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), canaryMarker)
+		if !ok {
+			continue
+		}
+		if detail, ok := strings.CutPrefix(rest, "pass "); ok {
+			return CanaryReport{Passed: true, Detail: detail, Clock: parseCanaryClock(detail)}, true
+		}
+		if rest, ok := strings.CutPrefix(rest, "fail "); ok {
+			check, detail, _ := strings.Cut(rest, ": ")
+			return CanaryReport{Check: check, Detail: detail}, true
+		}
+	}
+	return CanaryReport{}, false
+}
@@ -0,0 +1,136 @@
+// examples/examples.go
+// Package examples holds the programs built into awsmpirun for validating a new cluster
+// and showing the runtime APIs at work: a token ring, a pi estimate, a matrix multiply
+// with scatter and gather, and a halo exchange. awsmpirun examples run stages the
+// awsmpirun binary itself on the instances and runs "awsmpirun examples exec <name>" on
+// every rank, so nothing has to be written or built first. Each example checks its own
+// result and rank 0 prints a one-line report.
+package examples
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Message tags, one per example so they never mix
+const (
+	tagRing = 100 + iota
+	tagPi
+	tagMatMulRows
+	tagMatMulB
+	tagMatMulResult
+	tagHalo
+	tagHaloResult
+	tagCanary
+	tagCanarySum
+	tagCanaryTotal
+)
+
+// Example is one built-in program. Size is its single problem-size parameter.
+type Example struct {
+	Name        string
+	Summary     string
+	SizeHelp    string // What size controls
+	DefaultSize int
+	Run         func(c *mpi.Comm, size int, out io.Writer) error
+}
+
+// All returns the built-in examples in the order they are listed
+func All() []Example {
+	return []Example{
+		{
+			Name:        "ring",
+			Summary:     "Pass a counter around all ranks and time each hop",
+			SizeHelp:    "laps around the ring",
+			DefaultSize: 100,
+			Run:         runRing,
+		},
+		{
+			Name:        "pi",
+			Summary:     "Estimate pi by numerical integration, summed on rank 0",
+			SizeHelp:    "integration intervals",
+			DefaultSize: 10_000_000,
+			Run:         runPi,
+		},
+		{
+			Name:        "matmul",
+			Summary:     "Multiply two matrices with rows scattered from and gathered to rank 0",
+			SizeHelp:    "matrix dimension",
+			DefaultSize: 512,
+			Run:         runMatMul,
+		},
+		{
+			Name:        "halo",
+			Summary:     "Simulate 1D heat diffusion, exchanging boundary cells with neighbours",
+			SizeHelp:    "grid cells",
+			DefaultSize: 100_000,
+			Run:         runHalo,
+		},
+	}
+}
+
+// Lookup returns the example called name
+func Lookup(name string) (Example, bool) {
+	for _, example := range All() {
+		if example.Name == name {
+			return example, true
+		}
+	}
+	return Example{}, false
+}
+
+// Run joins the job, runs the example called name with the given size (0 for its
+// default), and finalizes. Rank 0 writes the example's report to out.
+func Run(name string, size int, out io.Writer) error {
+	example, ok := Lookup(name)
+	if !ok {
+		return fmt.Errorf("unknown example %q", name)
+	}
+	if size <= 0 {
+		size = example.DefaultSize
+	}
+
+	c, err := mpi.Init()
+	if err != nil {
+		return err
+	}
+	err = example.Run(c, size, out)
+	if finalizeErr := c.Finalize(); err == nil {
+		err = finalizeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// rowRange returns the half-open range of the n rows that part i of parts owns. The
+// first n%parts parts get one row more than the rest.
+func rowRange(n, parts, i int) (start, end int) {
+	rows, extra := n/parts, n%parts
+	start = i*rows + min(i, extra)
+	end = start + rows
+	if i < extra {
+		end++
+	}
+	return start, end
+}
+
+// gatherFloats sends local to rank 0, which returns every rank's slice joined in rank order.
+// Other ranks return nil.
+func gatherFloats(c *mpi.Comm, tag int, local []float64) ([]float64, error) {
+	if c.Rank() != 0 {
+		return nil, c.SendValue(0, tag, local)
+	}
+	all := append([]float64(nil), local...)
+	for source := 1; source < c.Size(); source++ {
+		var part []float64
+		if err := c.RecvValue(source, tag, &part); err != nil {
+			return nil, err
+		}
+		all = append(all, part...)
+	}
+	return all, nil
+}
@@ -0,0 +1,221 @@
+package examples
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"ring", "pi", "matmul", "halo"} {
+		example, ok := Lookup(name)
+		if !ok || example.Name != name || example.Run == nil || example.DefaultSize <= 0 {
+			t.Errorf("Lookup(%q) = %+v, %v", name, example, ok)
+		}
+	}
+	if _, ok := Lookup("mandelbrot"); ok {
+		t.Error("Lookup found an example that does not exist")
+	}
+}
+
+func TestRowRange(t *testing.T) {
+	tests := []struct {
+		n, parts int
+		want     [][2]int
+	}{
+		{n: 8, parts: 4, want: [][2]int{{0, 2}, {2, 4}, {4, 6}, {6, 8}}},
+		{n: 10, parts: 4, want: [][2]int{{0, 3}, {3, 6}, {6, 8}, {8, 10}}},
+		{n: 3, parts: 3, want: [][2]int{{0, 1}, {1, 2}, {2, 3}}},
+		{n: 5, parts: 1, want: [][2]int{{0, 5}}},
+	}
+
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			start, end := rowRange(tt.n, tt.parts, i)
+			if start != want[0] || end != want[1] {
+				t.Errorf("rowRange(%d, %d, %d) = %d, %d, want %d, %d", tt.n, tt.parts, i, start, end, want[0], want[1])
+			}
+		}
+	}
+}
+
+func TestPiPartialsSumToPi(t *testing.T) {
+	for _, size := range []int{1, 3, 7} {
+		total := 0.0
+		for rank := 0; rank < size; rank++ {
+			total += piPartial(100000, rank, size)
+		}
+		if diff := math.Abs(total - math.Pi); diff > 1e-9 {
+			t.Errorf("%d partials sum to %v, %.2e away from pi", size, total, diff)
+		}
+	}
+}
+
+func TestMultiplyRows(t *testing.T) {
+	a := []float64{1, 2, 3, 4}
+	b := []float64{5, 6, 7, 8}
+	tests := []struct {
+		rows []float64
+		want []float64
+	}{
+		{rows: a, want: []float64{19, 22, 43, 50}},
+		{rows: a[2:], want: []float64{43, 50}},
+	}
+
+	for _, tt := range tests {
+		got := multiplyRows(tt.rows, b, 2)
+		if len(got) != len(tt.want) {
+			t.Fatalf("multiplyRows(%v) = %v, want %v", tt.rows, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("multiplyRows(%v) = %v, want %v", tt.rows, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestProductChecksum(t *testing.T) {
+	for _, n := range []int{1, 5, 16} {
+		a, b := matrixA(n), matrixB(n)
+		sum := 0.0
+		for _, v := range multiplyRows(a, b, n) {
+			sum += v
+		}
+		if want := productChecksum(a, b, n); sum != want {
+			t.Errorf("n=%d: product sums to %v, checksum %v", n, sum, want)
+		}
+	}
+}
+
+// TestHeatStepSplit checks that stepping blocks of the rod with their neighbours' edge
+// cells as ghosts matches stepping the whole rod, which runHalo relies on
+func TestHeatStepSplit(t *testing.T) {
+	const n, steps = 11, 20
+	want := heatSerial(n, steps)
+
+	for _, parts := range []int{1, 2, 4, 11} {
+		blocks := make([][]float64, parts)
+		for i := range blocks {
+			start, end := rowRange(n, parts, i)
+			blocks[i] = heatInitial(n, start, end)
+		}
+		for step := 0; step < steps; step++ {
+			next := make([][]float64, parts)
+			for i, block := range blocks {
+				left, right := 0.0, 0.0
+				if i > 0 {
+					left = blocks[i-1][len(blocks[i-1])-1]
+				}
+				if i < parts-1 {
+					right = blocks[i+1][0]
+				}
+				next[i] = heatStep(append(append([]float64{left}, block...), right))
+			}
+			blocks = next
+		}
+
+		var got []float64
+		for _, block := range blocks {
+			got = append(got, block...)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%d parts: cell %d = %v, want %v", parts, i, got[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestParseCanaryReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   CanaryReport
+		wantOK bool
+	}{
+		{
+			name:   "pass",
+			output: "canary: pass 7 peers, 3 rounds, slowest round 1.2ms, sum 310µs\n",
+			want:   CanaryReport{Passed: true, Detail: "7 peers, 3 rounds, slowest round 1.2ms, sum 310µs"},
+			wantOK: true,
+		},
+		{
+			name:   "pass with the clock",
+			output: "canary: pass 7 peers, 3 rounds, slowest round 1.2ms, sum 310µs, clock -1.5ms ±80µs\n",
+			want: CanaryReport{
+				Passed: true,
+				Detail: "7 peers, 3 rounds, slowest round 1.2ms, sum 310µs, clock -1.5ms ±80µs",
+				Clock:  &mpi.ClockOffset{Offset: -1500 * time.Microsecond, RTT: 160 * time.Microsecond},
+			},
+			wantOK: true,
+		},
+		{
+			name:   "pass with an unreadable clock",
+			output: "canary: pass 1 peers, 3 rounds, slowest round 1ms, sum 1ms, clock soon ±80µs\n",
+			want:   CanaryReport{Passed: true, Detail: "1 peers, 3 rounds, slowest round 1ms, sum 1ms, clock soon ±80µs"},
+			wantOK: true,
+		},
+		{
+			name:   "fail",
+			output: "starting\ncanary: fail all-to-all: receive from rank 3: connection reset\n",
+			want:   CanaryReport{Check: CanaryAllToAll, Detail: "receive from rank 3: connection reset"},
+			wantOK: true,
+		},
+		{name: "no report", output: "Error: exec format error\n"},
+		{name: "empty", output: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseCanaryReport(tt.output)
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("ParseCanaryReport() = %+v, %v; want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCanaryTokensAreDistinct(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for round := 0; round < 3; round++ {
+		for from := 0; from < 16; from++ {
+			for to := 0; to < 16; to++ {
+				token := canaryToken(from, to, round)
+				if seen[token] {
+					t.Fatalf("canaryToken(%d, %d, %d) = %#x repeats", from, to, round, token)
+				}
+				seen[token] = true
+			}
+		}
+	}
+}
+
+func TestRunCanary(t *testing.T) {
+	t.Setenv("MPI_RANK", "0")
+	t.Setenv("MPI_SIZE", "1")
+
+	// Without its address the rank cannot join, and says so in its report
+	t.Setenv("MPI_ADDRESS_0", "")
+	var out strings.Builder
+	if err := RunCanary(1, time.Minute, &out); err == nil {
+		t.Fatal("RunCanary() without an address succeeded")
+	}
+	if report, ok := ParseCanaryReport(out.String()); !ok || report.Passed || report.Check != CanaryConnect {
+		t.Errorf("report %+v (found %v) in %q, want a failed %s", report, ok, out.String(), CanaryConnect)
+	}
+
+	t.Setenv("MPI_ADDRESS_0", "127.0.0.1:0")
+	out.Reset()
+	if err := RunCanary(3, time.Minute, &out); err != nil {
+		t.Fatalf("RunCanary() on one rank: %v\n%s", err, out.String())
+	}
+	if report, ok := ParseCanaryReport(out.String()); !ok || !report.Passed || !strings.Contains(report.Detail, "0 peers, 3 rounds") || report.Clock == nil || report.Clock.Offset != 0 {
+		t.Errorf("report %+v (found %v) in %q, want a pass", report, ok, out.String())
+	}
+}
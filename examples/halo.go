@@ -0,0 +1,103 @@
+// examples/halo.go
+
+package examples
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+const (
+	haloSteps = 500
+	haloAlpha = 0.25 // Diffusion coefficient; explicit steps are stable up to 0.5
+)
+
+// heatInitial returns cells [start, end) of the initial temperature of an n-cell rod:
+// one hot cell in the middle
+func heatInitial(n, start, end int) []float64 {
+	u := make([]float64, end-start)
+	if mid := n / 2; mid >= start && mid < end {
+		u[mid-start] = 1
+	}
+	return u
+}
+
+// heatStep advances the interior of u, which carries one ghost cell at each end, by
+// one explicit diffusion step and returns the new interior
+func heatStep(u []float64) []float64 {
+	next := make([]float64, len(u)-2)
+	for i := range next {
+		next[i] = u[i+1] + haloAlpha*(u[i]-2*u[i+1]+u[i+2])
+	}
+	return next
+}
+
+// heatSerial runs the whole simulation on one rank
+func heatSerial(n, steps int) []float64 {
+	u := heatInitial(n, 0, n)
+	for step := 0; step < steps; step++ {
+		u = heatStep(append(append([]float64{0}, u...), 0))
+	}
+	return u
+}
+
+// runHalo splits the rod among the ranks. Every step each rank sends its edge cells to
+// its neighbours and fills its ghost cells with theirs; the ends of the rod stay at zero.
+// Rank 0 gathers the result and compares it with a serial run.
+func runHalo(c *mpi.Comm, n int, out io.Writer) error {
+	rank, size := c.Rank(), c.Size()
+	if n < size {
+		return fmt.Errorf("grid of %d cells is smaller than the %d ranks", n, size)
+	}
+	first, last := rowRange(n, size, rank)
+
+	start := time.Now()
+	u := heatInitial(n, first, last)
+	for step := 0; step < haloSteps; step++ {
+		if rank > 0 {
+			if err := c.SendValue(rank-1, tagHalo, u[0]); err != nil {
+				return err
+			}
+		}
+		if rank < size-1 {
+			if err := c.SendValue(rank+1, tagHalo, u[len(u)-1]); err != nil {
+				return err
+			}
+		}
+
+		left, right := 0.0, 0.0
+		if rank > 0 {
+			if err := c.RecvValue(rank-1, tagHalo, &left); err != nil {
+				return err
+			}
+		}
+		if rank < size-1 {
+			if err := c.RecvValue(rank+1, tagHalo, &right); err != nil {
+				return err
+			}
+		}
+		u = heatStep(append(append([]float64{left}, u...), right))
+	}
+	elapsed := time.Since(start)
+
+	rod, err := gatherFloats(c, tagHaloResult, u)
+	if err != nil || rank != 0 {
+		return err
+	}
+
+	// Every cell goes through the same operations as in the serial run, so the
+	// results must match exactly
+	serial := heatSerial(n, haloSteps)
+	total := 0.0
+	for i, v := range rod {
+		if v != serial[i] {
+			return fmt.Errorf("cell %d is %v after %d steps, want %v", i, v, haloSteps, serial[i])
+		}
+		total += v
+	}
+	fmt.Fprintf(out, "halo: %d cells on %d ranks, %d steps in %v, total heat %.6f\n", n, size, haloSteps, elapsed.Round(time.Millisecond), total)
+	return nil
+}
@@ -0,0 +1,110 @@
+// examples/matmul.go
+
+package examples
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// matrixA and matrixB return the n×n input matrices, row-major. Their entries are
+// small integers, so every sum the example forms is exact in float64.
+func matrixA(n int) []float64 {
+	m := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			m[i*n+j] = float64((i + 2*j) % 7)
+		}
+	}
+	return m
+}
+
+func matrixB(n int) []float64 {
+	m := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			m[i*n+j] = float64((3*i+j)%5) - 2
+		}
+	}
+	return m
+}
+
+// multiplyRows multiplies the rows of A in a by the n×n matrix b
+func multiplyRows(a, b []float64, n int) []float64 {
+	rows := len(a) / n
+	c := make([]float64, rows*n)
+	for i := 0; i < rows; i++ {
+		for k := 0; k < n; k++ {
+			aik := a[i*n+k]
+			for j := 0; j < n; j++ {
+				c[i*n+j] += aik * b[k*n+j]
+			}
+		}
+	}
+	return c
+}
+
+// productChecksum returns the sum of all entries of a·b without forming the product:
+// the sum over k of column k of a times row k of b
+func productChecksum(a, b []float64, n int) float64 {
+	sum := 0.0
+	for k := 0; k < n; k++ {
+		colA, rowB := 0.0, 0.0
+		for i := 0; i < n; i++ {
+			colA += a[i*n+k]
+			rowB += b[k*n+i]
+		}
+		sum += colA * rowB
+	}
+	return sum
+}
+
+// runMatMul scatters row blocks of A and all of B from rank 0, multiplies the blocks on
+// every rank, and gathers the product on rank 0, which checks it against its checksum
+func runMatMul(c *mpi.Comm, n int, out io.Writer) error {
+	if n < c.Size() {
+		return fmt.Errorf("matrix dimension %d is smaller than the %d ranks", n, c.Size())
+	}
+
+	start := time.Now()
+	var a, b, rows []float64
+	if c.Rank() == 0 {
+		a, b = matrixA(n), matrixB(n)
+		for dest := 1; dest < c.Size(); dest++ {
+			first, last := rowRange(n, c.Size(), dest)
+			if err := c.SendValue(dest, tagMatMulRows, a[first*n:last*n]); err != nil {
+				return err
+			}
+			if err := c.SendValue(dest, tagMatMulB, b); err != nil {
+				return err
+			}
+		}
+		_, last := rowRange(n, c.Size(), 0)
+		rows = a[:last*n]
+	} else {
+		if err := c.RecvValue(0, tagMatMulRows, &rows); err != nil {
+			return err
+		}
+		if err := c.RecvValue(0, tagMatMulB, &b); err != nil {
+			return err
+		}
+	}
+
+	product, err := gatherFloats(c, tagMatMulResult, multiplyRows(rows, b, n))
+	if err != nil || c.Rank() != 0 {
+		return err
+	}
+
+	sum := 0.0
+	for _, v := range product {
+		sum += v
+	}
+	if want := productChecksum(a, b, n); len(product) != n*n || sum != want {
+		return fmt.Errorf("product of %d entries sums to %v, want %d entries summing to %v", len(product), sum, n*n, want)
+	}
+	fmt.Fprintf(out, "matmul: %dx%d product on %d ranks in %v, checksum %v\n", n, n, c.Size(), time.Since(start).Round(time.Millisecond), sum)
+	return nil
+}
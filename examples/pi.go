@@ -0,0 +1,48 @@
+// examples/pi.go
+
+package examples
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// piPartial is one rank's share of the midpoint rule for the integral of 4/(1+x²) over
+// [0, 1] with n intervals: it sums intervals rank, rank+size, rank+2·size, and so on
+func piPartial(n, rank, size int) float64 {
+	h := 1 / float64(n)
+	sum := 0.0
+	for i := rank; i < n; i += size {
+		x := h * (float64(i) + 0.5)
+		sum += 4 / (1 + x*x)
+	}
+	return sum * h
+}
+
+// runPi integrates on every rank and sums the partial results on rank 0
+func runPi(c *mpi.Comm, intervals int, out io.Writer) error {
+	partial := piPartial(intervals, c.Rank(), c.Size())
+	if c.Rank() != 0 {
+		return c.SendValue(0, tagPi, partial)
+	}
+
+	total := partial
+	for source := 1; source < c.Size(); source++ {
+		var p float64
+		if err := c.RecvValue(source, tagPi, &p); err != nil {
+			return err
+		}
+		total += p
+	}
+
+	// The midpoint rule is off by at most max|f''|/(24n²) = 1/(3n²), plus rounding
+	diff := math.Abs(total - math.Pi)
+	if bound := 1/(3*float64(intervals)*float64(intervals)) + 1e-10; diff > bound {
+		return fmt.Errorf("estimate %.12f is %.2e away from pi", total, diff)
+	}
+	fmt.Fprintf(out, "pi: %.12f from %d intervals on %d ranks, error %.2e\n", total, intervals, c.Size(), diff)
+	return nil
+}
@@ -0,0 +1,49 @@
+// examples/ring.go
+
+package examples
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// runRing passes a counter from rank to rank around the ring laps times, each rank
+// adding one, and checks that it returns to rank 0 as laps times the world size
+func runRing(c *mpi.Comm, laps int, out io.Writer) error {
+	rank, size := c.Rank(), c.Size()
+	next, prev := (rank+1)%size, (rank+size-1)%size
+
+	start := time.Now()
+	token := 0
+	for lap := 0; lap < laps; lap++ {
+		if rank == 0 {
+			if err := c.SendValue(next, tagRing, token+1); err != nil {
+				return err
+			}
+			if err := c.RecvValue(prev, tagRing, &token); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.RecvValue(prev, tagRing, &token); err != nil {
+			return err
+		}
+		if err := c.SendValue(next, tagRing, token+1); err != nil {
+			return err
+		}
+	}
+	if rank != 0 {
+		return nil
+	}
+
+	if want := laps * size; token != want {
+		return fmt.Errorf("counter is %d after %d laps of %d ranks, want %d", token, laps, size, want)
+	}
+	elapsed := time.Since(start)
+	perHop := elapsed / time.Duration(laps*size)
+	fmt.Fprintf(out, "ring: %d laps of %d ranks in %v, %v per hop\n", laps, size, elapsed.Round(time.Millisecond), perHop.Round(time.Microsecond))
+	return nil
+}
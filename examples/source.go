@@ -0,0 +1,12 @@
+// examples/source.go
+// This file embeds the source of the built-in examples, which awsmpirun docs serve shows
+// next to the API documentation as complete programs using it.
+
+package examples
+
+import "embed"
+
+// Source holds the Go files of the package
+//
+//go:embed *.go
+var Source embed.FS
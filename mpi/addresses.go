@@ -0,0 +1,147 @@
+// mpi/addresses.go
+// This file reads the job's address table. awsmpirun writes it as a JSON file on every
+// instance, at AddressFile(jobID) unless MPI_ADDRESS_FILE names another path, because
+// one variable per rank runs into the limits on the size of a process's environment
+// in worlds of a thousand ranks and more. Launchers that export MPI_ADDRESS_<rank> for
+// every rank still work: those variables are used when no file is named.
+
+package mpi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// EnvAddressFile names the address table when it is not at AddressFile(jobID)
+const EnvAddressFile = "MPI_ADDRESS_FILE"
+
+// AddressTable is the format of the address table file
+type AddressTable struct {
+	Ranks []RankAddress `json:"ranks"`
+}
+
+// RankAddress is the address one rank is reached on, as host:port, and the instance
+// it runs on, which launchers that do not know it leave empty
+type RankAddress struct {
+	Rank    int    `json:"rank"`
+	Address string `json:"address"`
+
+	InstanceID       string `json:"instance_id,omitempty"`
+	InstanceType     string `json:"instance_type,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	PlacementGroup   string `json:"placement_group,omitempty"` // Empty when the instance is in no placement group
+	Lifecycle        string `json:"lifecycle,omitempty"`       // "on-demand" or "spot"
+}
+
+// AddressFile is the path awsmpirun writes the address table of a job to
+func AddressFile(jobID string) string {
+	return filepath.Join("/tmp/awsmpirun", jobID, "addresses.json")
+}
+
+// loadAddresses returns the addresses of the ranks of a world of size, with the local
+// rank's the address it listens on, and the address peers reach the local rank on
+func loadAddresses(rank, size int) ([]string, string, error) {
+	path, err := addressTablePath()
+	if err != nil {
+		return nil, "", err
+	}
+	if path == "" {
+		return addressesFromEnv(rank, size)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read the address table: %v", err)
+	}
+	addresses, err := parseAddressTable(data, size)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid address table %s: %v", path, err)
+	}
+	advertise := os.Getenv(EnvAdvertiseAddress)
+	if advertise == "" {
+		advertise = addresses[rank]
+	}
+	// Every rank reads the same table, so the local rank listens on all interfaces
+	_, port, err := net.SplitHostPort(addresses[rank])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid address table %s: rank %d: %v", path, rank, err)
+	}
+	addresses[rank] = net.JoinHostPort("0.0.0.0", port)
+	return addresses, advertise, nil
+}
+
+// addressTablePath returns the path of the address table, or "" when the addresses
+// are in MPI_ADDRESS_<rank>
+func addressTablePath() (string, error) {
+	path := os.Getenv(EnvAddressFile)
+	if path == "" && os.Getenv("MPI_ADDRESS_0") == "" && JobID() != "" {
+		path = AddressFile(JobID())
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("MPI_ADDRESS_0 is not set and there is no address table at %s", path)
+		}
+	}
+	return path, nil
+}
+
+// addressesFromEnv returns the addresses of the ranks from MPI_ADDRESS_<rank>, which
+// launchers set to 0.0.0.0 for the local rank along with MPI_ADVERTISE_ADDRESS
+func addressesFromEnv(rank, size int) ([]string, string, error) {
+	addresses := make([]string, size)
+	for i := range addresses {
+		name := fmt.Sprintf("MPI_ADDRESS_%d", i)
+		addresses[i] = os.Getenv(name)
+		if addresses[i] == "" {
+			return nil, "", fmt.Errorf("%s is not set", name)
+		}
+	}
+	advertise := os.Getenv(EnvAdvertiseAddress)
+	if advertise == "" {
+		advertise = addresses[rank]
+	}
+	return addresses, advertise, nil
+}
+
+// parseAddressTable returns the addresses in an address table, indexed by rank. The
+// table must have exactly one address for every rank of a world of size.
+func parseAddressTable(data []byte, size int) ([]string, error) {
+	ranks, err := parseRankTable(data, size)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, size)
+	for i, entry := range ranks {
+		addresses[i] = entry.Address
+	}
+	return addresses, nil
+}
+
+// parseRankTable returns the entries of an address table, indexed by rank, checked
+// like parseAddressTable does
+func parseRankTable(data []byte, size int) ([]RankAddress, error) {
+	var table AddressTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, err
+	}
+	if len(table.Ranks) != size {
+		return nil, fmt.Errorf("it has %d ranks, but the world has %d", len(table.Ranks), size)
+	}
+	ranks := make([]RankAddress, size)
+	for _, entry := range table.Ranks {
+		if entry.Rank < 0 || entry.Rank >= size {
+			return nil, fmt.Errorf("rank %d is outside of a world of size %d", entry.Rank, size)
+		}
+		if entry.Address == "" {
+			return nil, fmt.Errorf("rank %d has no address", entry.Rank)
+		}
+		if ranks[entry.Rank].Address != "" {
+			return nil, fmt.Errorf("rank %d is listed twice", entry.Rank)
+		}
+		ranks[entry.Rank] = entry
+	}
+	return ranks, nil
+}
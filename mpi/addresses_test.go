@@ -0,0 +1,118 @@
+// mpi/addresses_test.go
+
+package mpi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAddressTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		size    int
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "out of order",
+			data: `{"ranks":[{"rank":1,"address":"10.0.0.2:50051"},{"rank":0,"address":"10.0.0.1:50051"}]}`,
+			size: 2,
+			want: []string{"10.0.0.1:50051", "10.0.0.2:50051"},
+		},
+		{name: "wrong size", data: `{"ranks":[{"rank":0,"address":"10.0.0.1:50051"}]}`, size: 2, wantErr: "has 1 ranks"},
+		{name: "rank out of range", data: `{"ranks":[{"rank":2,"address":"10.0.0.1:50051"}]}`, size: 1, wantErr: "outside"},
+		{name: "rank listed twice", data: `{"ranks":[{"rank":0,"address":"a:1"},{"rank":0,"address":"b:1"}]}`, size: 2, wantErr: "twice"},
+		{name: "empty address", data: `{"ranks":[{"rank":0,"address":""}]}`, size: 1, wantErr: "no address"},
+		{name: "not JSON", data: `0 i-0 10.0.0.1`, size: 1, wantErr: "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddressTable([]byte(tt.data), tt.size)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseAddressTable() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAddressTable() = %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.json")
+	table := `{"ranks":[{"rank":0,"address":"10.0.0.1:50051"},{"rank":1,"address":"10.0.0.2:50051"}]}`
+	if err := os.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantAddresses []string
+		wantAdvertise string
+		wantErr       string
+	}{
+		{
+			name:          "file",
+			env:           map[string]string{EnvAddressFile: path},
+			wantAddresses: []string{"10.0.0.1:50051", "0.0.0.0:50051"},
+			wantAdvertise: "10.0.0.2:50051",
+		},
+		{
+			name:          "file with an advertised address",
+			env:           map[string]string{EnvAddressFile: path, EnvAdvertiseAddress: "203.0.113.7:50051"},
+			wantAddresses: []string{"10.0.0.1:50051", "0.0.0.0:50051"},
+			wantAdvertise: "203.0.113.7:50051",
+		},
+		{
+			name:          "variables",
+			env:           map[string]string{"MPI_ADDRESS_0": "10.0.0.1:50051", "MPI_ADDRESS_1": "0.0.0.0:50051", EnvAdvertiseAddress: "10.0.0.2:50051"},
+			wantAddresses: []string{"10.0.0.1:50051", "0.0.0.0:50051"},
+			wantAdvertise: "10.0.0.2:50051",
+		},
+		{name: "missing variable", env: map[string]string{"MPI_ADDRESS_0": "10.0.0.1:50051"}, wantErr: "MPI_ADDRESS_1 is not set"},
+		{name: "no table for the job", env: map[string]string{EnvJobID: "no-such-job"}, wantErr: AddressFile("no-such-job")},
+		{name: "unreadable file", env: map[string]string{EnvAddressFile: path + ".missing"}, wantErr: "failed to read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{EnvAddressFile, EnvAdvertiseAddress, EnvJobID, "MPI_ADDRESS_0", "MPI_ADDRESS_1"} {
+				t.Setenv(name, tt.env[name])
+			}
+			addresses, advertise, err := loadAddresses(1, 2)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAddresses() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(addresses, tt.wantAddresses) || advertise != tt.wantAdvertise {
+				t.Errorf("loadAddresses() = %v, %q, %v; want %v, %q", addresses, advertise, err, tt.wantAddresses, tt.wantAdvertise)
+			}
+		})
+	}
+}
+
+// BenchmarkParseAddressTable parses the table of a world of 4096 ranks
+func BenchmarkParseAddressTable(b *testing.B) {
+	const size = 4096
+	var entries []string
+	for rank := range size {
+		entries = append(entries, fmt.Sprintf(`{"rank":%d,"address":"10.%d.%d.%d:50051"}`, rank, rank>>16, rank>>8&255, rank&255))
+	}
+	data := []byte(`{"ranks":[` + strings.Join(entries, ",") + `]}`)
+	b.ResetTimer()
+	for range b.N {
+		if _, err := parseAddressTable(data, size); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// mpi/bandwidth.go
+// This file caps the bandwidth a rank sends to its peers, for jobs sharing a VPC with
+// services that must not lose their NAT gateway or peering link to an MPI job. One
+// token bucket per rank covers all of its peer streams. Data frames wait for their
+// bytes before they take the stream, so a throttled transfer never holds up the
+// control frames behind it (see priority.go); control frames spend tokens without
+// waiting, since they are small and must not be delayed.
+
+package mpi
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvMaxBandwidth caps the bytes per second a rank sends, set by awsmpirun from
+// --max-bandwidth-per-rank. See ParseBandwidth for the format.
+const EnvMaxBandwidth = "MPI_MAX_BANDWIDTH"
+
+// bandwidthBurstWindow is how much unused bandwidth a rank may save up and spend at once
+const bandwidthBurstWindow = 100 * time.Millisecond
+
+// bandwidthUnits are the units ParseBandwidth accepts, in bytes per second
+var bandwidthUnits = map[string]float64{
+	"B":    1,
+	"KB":   1e3,
+	"MB":   1e6,
+	"GB":   1e9,
+	"Kbit": 1e3 / 8,
+	"Mbit": 1e6 / 8,
+	"Gbit": 1e9 / 8,
+}
+
+// ParseBandwidth parses a bandwidth such as "500Mbit", "2Gbit/s", or "100MB/s" into
+// bytes per second. Units are decimal; "/s" is optional. An empty value or "0" means
+// no limit and returns 0.
+func ParseBandwidth(value string) (float64, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	trimmed := strings.TrimSuffix(value, "/s")
+	i := strings.IndexFunc(trimmed, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected a number and a unit such as 500Mbit or 100MB/s", value)
+	}
+	number, err := strconv.ParseFloat(trimmed[:i], 64)
+	unit, ok := bandwidthUnits[trimmed[i:]]
+	if err != nil || !ok || number <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected a number and a unit such as 500Mbit or 100MB/s", value)
+	}
+	return number * unit, nil
+}
+
+// bandwidthLimiter is a token bucket in bytes. A nil limiter does not limit.
+type bandwidthLimiter struct {
+	rate  float64 // Bytes per second
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64 // Negative while sends are waiting for bytes already spent
+	last   time.Time
+}
+
+func newBandwidthLimiter(rate float64) *bandwidthLimiter {
+	// A whole chunk must fit in the bucket, or large messages would always wait
+	burst := max(rate*bandwidthBurstWindow.Seconds(), sendChunkSize+frameHeaderSize)
+	return &bandwidthLimiter{rate: rate, burst: burst, now: time.Now, tokens: burst}
+}
+
+// bandwidthLimiterFromEnv returns the limiter MPI_MAX_BANDWIDTH asks for, or nil
+func bandwidthLimiterFromEnv() (*bandwidthLimiter, error) {
+	value := os.Getenv(EnvMaxBandwidth)
+	rate, err := ParseBandwidth(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", EnvMaxBandwidth, err)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return newBandwidthLimiter(rate), nil
+}
+
+// reserve spends n bytes and returns how long the caller must wait before sending them
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n more bytes may be sent
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	if delay := l.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// spend takes n bytes from the bucket without waiting
+func (l *bandwidthLimiter) spend(n int) {
+	if l != nil {
+		l.reserve(n)
+	}
+}
@@ -0,0 +1,116 @@
+// mpi/bandwidth_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "500Mbit", want: 62.5e6},
+		{value: "2Gbit/s", want: 250e6},
+		{value: "100MB/s", want: 100e6},
+		{value: "1.5KB", want: 1500},
+		{value: "800B", want: 800},
+		{value: "100", wantErr: true},
+		{value: "MB", wantErr: true},
+		{value: "10mb", wantErr: true},
+		{value: "0MB", wantErr: true},
+		{value: "-5MB", wantErr: true},
+		{value: "1.2.3MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want && !tt.wantErr {
+			t.Errorf("ParseBandwidth(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBandwidthLimiterFromEnv(t *testing.T) {
+	t.Setenv(EnvMaxBandwidth, "")
+	if l, err := bandwidthLimiterFromEnv(); l != nil || err != nil {
+		t.Errorf("unset: got %v, %v; want no limiter", l, err)
+	}
+	t.Setenv(EnvMaxBandwidth, "80Mbit")
+	if l, err := bandwidthLimiterFromEnv(); err != nil || l == nil || l.rate != 10e6 {
+		t.Errorf("80Mbit: got %+v, %v; want 10e6 bytes per second", l, err)
+	}
+	t.Setenv(EnvMaxBandwidth, "fast")
+	if _, err := bandwidthLimiterFromEnv(); err == nil {
+		t.Error("invalid value accepted")
+	}
+}
+
+func TestBandwidthLimiterReserve(t *testing.T) {
+	// 10 MB/s gives a burst of 1 MB
+	type step struct {
+		after time.Duration // Since the previous step
+		bytes int
+		want  time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "within the burst", steps: []step{{bytes: 1e6}}},
+		{name: "past the burst", steps: []step{{bytes: 1e6}, {bytes: 1e5, want: 10 * time.Millisecond}}},
+		{name: "debt adds up", steps: []step{{bytes: 2e6, want: 100 * time.Millisecond}, {bytes: 1e6, want: 200 * time.Millisecond}}},
+		{name: "refills over time", steps: []step{{bytes: 1e6}, {after: 50 * time.Millisecond, bytes: 5e5}}},
+		{name: "refill is capped", steps: []step{{after: time.Hour, bytes: 15e5, want: 50 * time.Millisecond}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			l := newBandwidthLimiter(10e6)
+			l.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if got := l.reserve(s.bytes); got != s.want {
+					t.Errorf("step %d: delay %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterSmallRate(t *testing.T) {
+	// The bucket always holds a whole chunk, so one chunk never waits at first
+	l := newBandwidthLimiter(1000)
+	if got := l.reserve(sendChunkSize + frameHeaderSize); got != 0 {
+		t.Errorf("first chunk waits %v", got)
+	}
+}
+
+func TestBandwidthLimitedSend(t *testing.T) {
+	// 4 MB/s with a 400 KB burst: 2 MiB needs about 0.4s beyond the burst
+	comms := startLocalWorld(t, 2, 0, TransportTCP)
+	comms[0].limiter = newBandwidthLimiter(4e6)
+	for _, p := range comms[0].peers {
+		if p != nil {
+			p.limiter = comms[0].limiter
+		}
+	}
+	payload := bytes.Repeat([]byte{3}, 2<<20)
+	start := time.Now()
+	if err := comms[0].Send(1, 0, payload); err != nil {
+		t.Fatal(err)
+	}
+	got, err := comms[1].Recv(0, 0)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("2 MiB at 4 MB/s took %v, want at least 350ms", elapsed)
+	}
+	finalizeAll(t, comms)
+}
@@ -0,0 +1,61 @@
+// mpi/checkpoint.go
+// This file stores per-rank checkpoints in the job's staging bucket. A rank that is
+// drained for migration saves its state before exiting; its replacement, started with
+// MPI_RESTARTED=1 on another instance, loads the state and rejoins the running job.
+// Checkpoints carry the rank's provenance metadata like results do.
+
+package mpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// CheckpointKey is the S3 key holding the checkpoint of rank in job
+func CheckpointKey(project, jobID string, rank int) string {
+	return fmt.Sprintf("%s/checkpoints/rank-%d", JobPrefix(project, jobID), rank)
+}
+
+// SaveCheckpoint stores data as the calling rank's checkpoint, replacing any earlier one
+func SaveCheckpoint(data []byte) error {
+	client, key, err := checkpointLocation()
+	if err != nil {
+		return err
+	}
+	return client.UploadBytesWithMetadata(context.Background(), data, key, Provenance())
+}
+
+// LoadCheckpoint returns the calling rank's checkpoint and whether one exists
+func LoadCheckpoint() ([]byte, bool, error) {
+	client, key, err := checkpointLocation()
+	if err != nil {
+		return nil, false, err
+	}
+
+	data, err := client.DownloadBytes(context.Background(), key)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func checkpointLocation() (*awsManager.S3Client, string, error) {
+	client, err := jobBucket()
+	if err != nil {
+		return nil, "", err
+	}
+	rank, err := Rank()
+	if err != nil {
+		return nil, "", err
+	}
+	return client, CheckpointKey(Project(), JobID(), rank), nil
+}
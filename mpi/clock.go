@@ -0,0 +1,191 @@
+// mpi/clock.go
+// This file measures how far the ranks' clocks are apart. Timestamps from different
+// instances only order correctly when the clocks agree, so a skewed instance scrambles
+// merged logs and traces and breaks algorithms that compare times across ranks. Rank 0
+// pings every other rank a few times, NTP style: the rank answers with its clock, and
+// the offset is that time less the midpoint of the round trip, taken from the fastest
+// round trip, whose midpoint is the most certain.
+//
+// With MPI_MAX_CLOCK_SKEW set, Init measures the offsets once every rank has joined
+// and rank 0 logs a warning naming the ranks whose clocks are out of line.
+
+package mpi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EnvMaxClockSkew is the skew above which Init warns, set by awsmpirun from --max-clock-skew
+const EnvMaxClockSkew = "MPI_MAX_CLOCK_SKEW"
+
+// clockSamples is how many round trips Init takes to each rank
+const clockSamples = 5
+
+// ClockOffset is how far one rank's clock is from rank 0's
+type ClockOffset struct {
+	Rank   int
+	Offset time.Duration // The rank's clock less rank 0's
+	RTT    time.Duration // Round trip the offset was taken from; the offset is good to half of it
+}
+
+// String formats the offset with its sign and uncertainty to the microsecond, as
+// "+1.2ms ±80µs"
+func (o ClockOffset) String() string {
+	offset := o.Offset.Round(time.Microsecond).String()
+	if o.Offset >= time.Microsecond/2 {
+		offset = "+" + offset
+	}
+	return offset + " ±" + (o.RTT / 2).Round(time.Microsecond).String()
+}
+
+// MeasureClockOffsets returns the offset of every rank's clock from rank 0's, indexed
+// by rank, on every rank, from the fastest of samples round trips to each rank. Every
+// rank must call it, like a collective; it takes samples round trips per rank in turn.
+func MeasureClockOffsets(c *Comm, samples int) ([]ClockOffset, error) {
+	if samples < 1 {
+		return nil, fmt.Errorf("clock offsets: samples must be at least 1, got %d", samples)
+	}
+	call, err := c.collective("clock offsets", nil)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if c.rank != 0 {
+		for i := 0; i < samples; i++ {
+			if _, err := c.Recv(0, tagClock); err != nil {
+				return nil, fmt.Errorf("clock offsets: %w", err)
+			}
+			if err := c.sendOwned(0, tagClock, binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))); err != nil {
+				return nil, fmt.Errorf("clock offsets: %w", err)
+			}
+		}
+	} else {
+		measured := make([]int64, 2*c.size)
+		for rank := 1; rank < c.size; rank++ {
+			offset, rtt, err := c.pingClock(rank, samples)
+			if err != nil {
+				return nil, fmt.Errorf("clock offsets: rank %d: %w", rank, err)
+			}
+			measured[2*rank], measured[2*rank+1] = int64(offset), int64(rtt)
+		}
+		payload = encodeNumbers(measured)
+	}
+	payload, err = call.broadcastBytes(0, payload)
+	if err != nil {
+		return nil, fmt.Errorf("clock offsets: %w", err)
+	}
+	measured, err := decodeNumbers[int64](payload)
+	if err != nil || len(measured) != 2*c.size {
+		return nil, fmt.Errorf("clock offsets: rank 0 sent %d values for %d ranks", len(measured), c.size)
+	}
+	offsets := make([]ClockOffset, c.size)
+	for rank := range offsets {
+		offsets[rank] = ClockOffset{Rank: rank, Offset: time.Duration(measured[2*rank]), RTT: time.Duration(measured[2*rank+1])}
+	}
+	return offsets, nil
+}
+
+// pingClock takes samples round trips to rank and returns the offset of the fastest
+func (c *Comm) pingClock(rank, samples int) (time.Duration, time.Duration, error) {
+	var offset, best time.Duration
+	for i := 0; i < samples; i++ {
+		sent := time.Now()
+		if err := c.sendOwned(rank, tagClock, nil); err != nil {
+			return 0, 0, err
+		}
+		reply, err := c.Recv(rank, tagClock)
+		if err != nil {
+			return 0, 0, err
+		}
+		rtt := time.Since(sent)
+		if len(reply) != 8 {
+			return 0, 0, fmt.Errorf("clock reply of %d bytes", len(reply))
+		}
+		if i == 0 || rtt < best {
+			offset, best = clockOffset(sent, rtt, int64(binary.LittleEndian.Uint64(reply))), rtt
+		}
+	}
+	return offset, best, nil
+}
+
+// clockOffset is how far a peer that read its clock as peerNanos is ahead, when the
+// ping was sent at sent and answered after rtt
+func clockOffset(sent time.Time, rtt time.Duration, peerNanos int64) time.Duration {
+	return time.Duration(peerNanos - sent.Add(rtt/2).UnixNano())
+}
+
+// ClockSkew is the largest difference between two of the ranks' clocks
+func ClockSkew(offsets []ClockOffset) time.Duration {
+	if len(offsets) == 0 {
+		return 0
+	}
+	lowest, highest := offsets[0].Offset, offsets[0].Offset
+	for _, o := range offsets[1:] {
+		lowest, highest = min(lowest, o.Offset), max(highest, o.Offset)
+	}
+	return highest - lowest
+}
+
+// ClockOutliers returns the ranks whose clocks are more than half of limit from the
+// median of the ranks' clocks, the ones to fix when the skew is above limit. With a
+// majority of agreeing clocks that singles out the skewed instances, rank 0's
+// included.
+func ClockOutliers(offsets []ClockOffset, limit time.Duration) []ClockOffset {
+	if len(offsets) == 0 {
+		return nil
+	}
+	sorted := make([]time.Duration, len(offsets))
+	for i, o := range offsets {
+		sorted[i] = o.Offset
+	}
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+	var outliers []ClockOffset
+	for _, o := range offsets {
+		if d := o.Offset - median; d > limit/2 || d < -limit/2 {
+			outliers = append(outliers, o)
+		}
+	}
+	return outliers
+}
+
+// maxClockSkewFromEnv returns MPI_MAX_CLOCK_SKEW, or 0 when Init does not measure
+func maxClockSkewFromEnv() (time.Duration, error) {
+	value := os.Getenv(EnvMaxClockSkew)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", EnvMaxClockSkew, value)
+	}
+	return d, nil
+}
+
+// checkClockSkew measures the offsets at Init and warns on rank 0 when the skew is
+// above limit. A job started with MPI_MIN_RANKS below the world size is not measured,
+// as the ranks do not all take part in Init.
+func (c *Comm) checkClockSkew(limit time.Duration) error {
+	if c.options.MinRanks > 0 && c.options.MinRanks < c.size {
+		return nil
+	}
+	offsets, err := MeasureClockOffsets(c, clockSamples)
+	if err != nil {
+		return err
+	}
+	skew := ClockSkew(offsets)
+	if c.rank != 0 || skew <= limit {
+		return nil
+	}
+	var ranks []string
+	for _, o := range ClockOutliers(offsets, limit) {
+		ranks = append(ranks, fmt.Sprintf("%d (%v)", o.Rank, o))
+	}
+	Logger().Warn("clocks of the ranks are skewed", "skew", skew.Round(time.Microsecond), "limit", limit, "ranks", strings.Join(ranks, ", "))
+	return nil
+}
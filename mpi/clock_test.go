@@ -0,0 +1,132 @@
+// mpi/clock_test.go
+
+package mpi
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClockOffset(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	tests := []struct {
+		rtt       time.Duration
+		peerNanos int64
+		want      time.Duration
+	}{
+		{rtt: 2 * time.Millisecond, peerNanos: sent.Add(time.Millisecond).UnixNano(), want: 0},
+		{rtt: 2 * time.Millisecond, peerNanos: sent.Add(251 * time.Millisecond).UnixNano(), want: 250 * time.Millisecond},
+		{rtt: 0, peerNanos: sent.Add(-3 * time.Second).UnixNano(), want: -3 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := clockOffset(sent, tt.rtt, tt.peerNanos); got != tt.want {
+			t.Errorf("clockOffset(rtt %v) = %v, want %v", tt.rtt, got, tt.want)
+		}
+	}
+}
+
+func TestClockOffsetString(t *testing.T) {
+	tests := []struct {
+		offset ClockOffset
+		want   string
+	}{
+		{offset: ClockOffset{}, want: "0s ±0s"},
+		{offset: ClockOffset{Offset: 1234567 * time.Nanosecond, RTT: 160 * time.Microsecond}, want: "+1.235ms ±80µs"},
+		{offset: ClockOffset{Offset: -2 * time.Second, RTT: time.Millisecond}, want: "-2s ±500µs"},
+		{offset: ClockOffset{Offset: 100 * time.Nanosecond}, want: "0s ±0s"},
+	}
+	for _, tt := range tests {
+		if got := tt.offset.String(); got != tt.want {
+			t.Errorf("%#v: String() = %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestClockSkewAndOutliers(t *testing.T) {
+	ms := time.Millisecond
+	offsets := func(values ...time.Duration) []ClockOffset {
+		var o []ClockOffset
+		for rank, v := range values {
+			o = append(o, ClockOffset{Rank: rank, Offset: v})
+		}
+		return o
+	}
+	tests := []struct {
+		name     string
+		offsets  []ClockOffset
+		limit    time.Duration
+		skew     time.Duration
+		outliers []int
+	}{
+		{name: "none", limit: 10 * ms},
+		{name: "agreeing", offsets: offsets(0, ms, -ms, 2*ms), limit: 10 * ms, skew: 3 * ms},
+		{name: "one ahead", offsets: offsets(0, ms, 300*ms, -ms), limit: 10 * ms, skew: 301 * ms, outliers: []int{2}},
+		{name: "rank 0 behind", offsets: offsets(0, 200*ms, 201*ms, 199*ms), limit: 10 * ms, skew: 201 * ms, outliers: []int{0}},
+		{name: "spread both ways", offsets: offsets(0, -40*ms, 40*ms), limit: 50 * ms, skew: 80 * ms, outliers: []int{1, 2}},
+	}
+	for _, tt := range tests {
+		if got := ClockSkew(tt.offsets); got != tt.skew {
+			t.Errorf("%s: ClockSkew() = %v, want %v", tt.name, got, tt.skew)
+		}
+		var ranks []int
+		for _, o := range ClockOutliers(tt.offsets, tt.limit) {
+			ranks = append(ranks, o.Rank)
+		}
+		if !reflect.DeepEqual(ranks, tt.outliers) {
+			t.Errorf("%s: ClockOutliers() = %v, want %v", tt.name, ranks, tt.outliers)
+		}
+	}
+}
+
+func TestMeasureClockOffsets(t *testing.T) {
+	for _, size := range []int{1, 2, 5} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			comms := startLocalWorld(t, size, defaultEagerLimit, TransportTCP)
+			defer finalizeAll(t, comms)
+			results := make([][]ClockOffset, size)
+			checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+				offsets, err := MeasureClockOffsets(c, 3)
+				results[c.Rank()] = offsets
+				return err
+			}))
+			// The ranks share one clock, so every offset is within the uncertainty of its round trip
+			for rank, offsets := range results {
+				if len(offsets) != size {
+					t.Fatalf("rank %d: %d offsets, want %d", rank, len(offsets), size)
+				}
+				if !reflect.DeepEqual(offsets, results[0]) {
+					t.Errorf("rank %d: offsets %v differ from rank 0's %v", rank, offsets, results[0])
+				}
+			}
+			for _, o := range results[0] {
+				if o.Offset > o.RTT/2+time.Millisecond || o.Offset < -o.RTT/2-time.Millisecond {
+					t.Errorf("rank %d: offset %v with a round trip of %v on one clock", o.Rank, o.Offset, o.RTT)
+				}
+			}
+			// The measurement is collective; checking at Init must leave every message matched
+			checkRanks(t, onEveryRank(comms, func(c *Comm) error { return c.checkClockSkew(time.Hour) }))
+		})
+	}
+}
+
+func TestMaxClockSkewFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "50ms", want: 50 * time.Millisecond},
+		{value: "0s", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv(EnvMaxClockSkew, tt.value)
+		got, err := maxClockSkewFromEnv()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: got %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
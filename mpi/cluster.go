@@ -0,0 +1,141 @@
+// mpi/cluster.go
+// This file tells a running program about the job and the instances its ranks run on,
+// so it can adapt, e.g. checkpoint more often on spot capacity or keep traffic within
+// an availability zone, without reading environment variables or the instance
+// metadata service itself. awsmpirun writes where every rank runs into the address
+// table; with a launcher that does not, the calling rank's own instance is looked up
+// in the instance metadata service instead, and the other ranks' are left empty.
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// Instance metadata of the calling rank's instance, for address tables without it
+const (
+	imdsInstanceID       = "/latest/meta-data/instance-id"
+	imdsInstanceType     = "/latest/meta-data/instance-type"
+	imdsAvailabilityZone = "/latest/meta-data/placement/availability-zone"
+	imdsPlacementGroup   = "/latest/meta-data/placement/group-name"
+	imdsLifecycle        = "/latest/meta-data/instance-life-cycle"
+)
+
+// Lifecycles of an instance, in RankAddress.Lifecycle
+const (
+	LifecycleOnDemand = awsManager.LifecycleOnDemand
+	LifecycleSpot     = awsManager.LifecycleSpot
+)
+
+// Cluster is the job of the calling rank and where each of its ranks runs
+type Cluster struct {
+	JobID   string
+	Project string
+	Rank    int           // The calling rank
+	Ranks   []RankAddress // Every rank of the world, indexed by rank
+}
+
+// Size returns the number of ranks in the job
+func (c *Cluster) Size() int {
+	return len(c.Ranks)
+}
+
+// Self returns the calling rank's entry
+func (c *Cluster) Self() RankAddress {
+	return c.Ranks[c.Rank]
+}
+
+// Spot reports whether the calling rank runs on a spot instance, which EC2 may reclaim
+// at two minutes' notice
+func (c *Cluster) Spot() bool {
+	return c.Self().Spot()
+}
+
+// Spot reports whether the rank runs on a spot instance
+func (r RankAddress) Spot() bool {
+	return r.Lifecycle == LifecycleSpot
+}
+
+// ClusterInfo returns the job of the calling rank and where its ranks run. It reads
+// the address table on every call, which in a large world is worth keeping the result
+// of. Where the ranks run is as of the start of the calling rank, so a rank moved by
+// awsmpirun migrate since still shows its old instance.
+func ClusterInfo() (*Cluster, error) {
+	rank, err := Rank()
+	if err != nil {
+		return nil, err
+	}
+	size, err := Size()
+	if err != nil {
+		return nil, err
+	}
+	if rank < 0 || rank >= size {
+		return nil, fmt.Errorf("rank %d is outside of a world of size %d", rank, size)
+	}
+	ranks, err := loadRankTable(rank, size)
+	if err != nil {
+		return nil, err
+	}
+	if ranks[rank].InstanceID == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), imdsRequestTimeout)
+		defer cancel()
+		ranks[rank].fillFromMetadata(&imdsClient{ctx: ctx, http: &http.Client{Timeout: imdsRequestTimeout}})
+	}
+	return &Cluster{JobID: JobID(), Project: Project(), Rank: rank, Ranks: ranks}, nil
+}
+
+// loadRankTable returns the entries of the address table of a world of size, or
+// entries with just the addresses from MPI_ADDRESS_<rank>
+func loadRankTable(rank, size int) ([]RankAddress, error) {
+	path, err := addressTablePath()
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		addresses, advertise, err := addressesFromEnv(rank, size)
+		if err != nil {
+			return nil, err
+		}
+		addresses[rank] = advertise
+		ranks := make([]RankAddress, size)
+		for i, address := range addresses {
+			ranks[i] = RankAddress{Rank: i, Address: address}
+		}
+		return ranks, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the address table: %v", err)
+	}
+	ranks, err := parseRankTable(data, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address table %s: %v", path, err)
+	}
+	return ranks, nil
+}
+
+// fillFromMetadata fills in the instance r runs on from the instance metadata service,
+// and leaves it empty when not running on EC2
+func (r *RankAddress) fillFromMetadata(imds *imdsClient) {
+	if _, err := imds.token(); err != nil {
+		return
+	}
+	for path, field := range map[string]*string{
+		imdsInstanceID:       &r.InstanceID,
+		imdsInstanceType:     &r.InstanceType,
+		imdsAvailabilityZone: &r.AvailabilityZone,
+		imdsPlacementGroup:   &r.PlacementGroup,
+		imdsLifecycle:        &r.Lifecycle,
+	} {
+		if body, ok := imds.get(path); ok {
+			*field = strings.TrimSpace(string(body))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// mpi/cluster_test.go
+
+package mpi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClusterInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.json")
+	table := `{"ranks":[` +
+		`{"rank":1,"address":"10.0.0.2:50051","instance_id":"i-1","instance_type":"c7g.large","availability_zone":"us-east-2b","lifecycle":"spot"},` +
+		`{"rank":0,"address":"10.0.0.1:50051","instance_id":"i-0","instance_type":"c7g.large","availability_zone":"us-east-2a","placement_group":"hpc","lifecycle":"on-demand"}]}`
+	if err := os.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvAddressFile, path)
+	t.Setenv(EnvJobID, "job-1")
+	t.Setenv(EnvProject, "climate")
+	t.Setenv(EnvRank, "1")
+	t.Setenv(EnvSize, "2")
+
+	info, err := ClusterInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.JobID != "job-1" || info.Project != "climate" || info.Rank != 1 || info.Size() != 2 {
+		t.Errorf("cluster = %+v", info)
+	}
+	if self := info.Self(); self.InstanceID != "i-1" || self.AvailabilityZone != "us-east-2b" || !info.Spot() {
+		t.Errorf("self = %+v, want i-1 in us-east-2b on spot", self)
+	}
+	if r := info.Ranks[0]; r.Rank != 0 || r.PlacementGroup != "hpc" || r.Lifecycle != LifecycleOnDemand || r.Spot() {
+		t.Errorf("rank 0 = %+v, want on-demand in placement group hpc", r)
+	}
+
+	t.Setenv(EnvSize, "3")
+	if _, err := ClusterInfo(); err == nil {
+		t.Error("a table of 2 ranks passed for a world of 3")
+	}
+	t.Setenv(EnvRank, "")
+	if _, err := ClusterInfo(); err == nil {
+		t.Error("no error without MPI_RANK")
+	}
+}
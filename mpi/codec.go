@@ -0,0 +1,229 @@
+// mpi/codec.go
+// This file lets programs send typed values instead of raw bytes. The codec used
+// for a message is chosen per call with WithCodec, per Go type with RegisterCodec,
+// or by default from the value itself: []byte goes out untouched, protobuf messages
+// use proto, FlatBuffers builders and generated tables use flatbuffers, and anything
+// else falls back to gob.
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts between typed values and message payloads
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Built-in codecs
+var (
+	// RawCodec sends []byte payloads as-is and receives into *[]byte without copying
+	RawCodec Codec = rawCodec{}
+	// ProtoCodec marshals proto.Message values
+	ProtoCodec Codec = protoCodec{}
+	// FlatBuffersCodec sends finished *flatbuffers.Builder values and receives into
+	// generated FlatBuffers tables (anything with an Init method) without parsing
+	FlatBuffersCodec Codec = flatBuffersCodec{}
+	// GobCodec encodes arbitrary Go values with encoding/gob
+	GobCodec Codec = gobCodec{}
+)
+
+var (
+	codecsMu     sync.RWMutex
+	codecsByType = make(map[reflect.Type]Codec)
+)
+
+// RegisterCodec makes codec the default for messages of the same type as example.
+// Pointer and non-pointer forms of the type share the registration.
+func RegisterCodec(example any, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecsByType[baseType(example)] = codec
+}
+
+// MessageOption configures a single SendValue or RecvValue call, or a collective
+type MessageOption func(*messageOptions)
+
+type messageOptions struct {
+	codec Codec
+
+	// Limits of a collective, see timeout.go
+	ctx        context.Context
+	timeout    time.Duration
+	timeoutSet bool
+	policy     TimeoutPolicy
+}
+
+// WithCodec selects the codec for one message, overriding registrations and defaults
+func WithCodec(codec Codec) MessageOption {
+	return func(o *messageOptions) {
+		o.codec = codec
+	}
+}
+
+// SendValue encodes v and sends it to rank dest with the given tag. The encoded
+// payload is handed to the transport without a copy; with RawCodec and
+// FlatBuffersCodec that payload is v's own buffer, which must not be modified
+// after SendValue returns.
+func (c *Comm) SendValue(dest, tag int, v any, opts ...MessageOption) error {
+	codec := codecFor(v, opts)
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message for rank %d with %s codec: %v", dest, codec.Name(), err)
+	}
+	return c.sendOwned(dest, tag, data)
+}
+
+// RecvValue receives a message from rank source with the given tag and decodes it into v,
+// which must be a pointer (or a FlatBuffers table for FlatBuffersCodec)
+func (c *Comm) RecvValue(source, tag int, v any, opts ...MessageOption) error {
+	data, err := c.Recv(source, tag)
+	if err != nil {
+		return err
+	}
+
+	codec := codecFor(v, opts)
+	err = codec.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("failed to decode message from rank %d with %s codec: %v", source, codec.Name(), err)
+	}
+	return nil
+}
+
+func codecFor(v any, opts []MessageOption) Codec {
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.codec != nil {
+		return options.codec
+	}
+
+	codecsMu.RLock()
+	codec, ok := codecsByType[baseType(v)]
+	codecsMu.RUnlock()
+	if ok {
+		return codec
+	}
+
+	switch v.(type) {
+	case []byte, *[]byte:
+		return RawCodec
+	case proto.Message:
+		return ProtoCodec
+	case *flatbuffers.Builder, flatBuffersTable:
+		return FlatBuffersCodec
+	}
+	return GobCodec
+}
+
+func baseType(v any) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return "raw" }
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return nil, fmt.Errorf("raw codec needs []byte, got %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	target, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec needs *[]byte, got %T", v)
+	}
+	*target = data
+	return nil
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("proto codec needs proto.Message, got %T", v)
+	}
+	return proto.Marshal(message)
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("proto codec needs proto.Message, got %T", v)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// flatBuffersTable is implemented by every table type generated by flatc
+type flatBuffersTable interface {
+	Init(buf []byte, i flatbuffers.UOffsetT)
+}
+
+type flatBuffersCodec struct{}
+
+func (flatBuffersCodec) Name() string { return "flatbuffers" }
+
+func (flatBuffersCodec) Marshal(v any) ([]byte, error) {
+	switch message := v.(type) {
+	case *flatbuffers.Builder:
+		return message.FinishedBytes(), nil
+	case []byte:
+		return message, nil
+	}
+	return nil, fmt.Errorf("flatbuffers codec needs a finished *flatbuffers.Builder, got %T", v)
+}
+
+func (flatBuffersCodec) Unmarshal(data []byte, v any) error {
+	switch target := v.(type) {
+	case flatBuffersTable:
+		if len(data) < flatbuffers.SizeUOffsetT {
+			return fmt.Errorf("flatbuffer of %d bytes is too short", len(data))
+		}
+		target.Init(data, flatbuffers.GetUOffsetT(data))
+		return nil
+	case *[]byte:
+		*target = data
+		return nil
+	}
+	return fmt.Errorf("flatbuffers codec needs a generated table or *[]byte, got %T", v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,288 @@
+package mpi
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testTable is a minimal flatc-style table holding one byte vector in slot 0
+type testTable struct {
+	tab flatbuffers.Table
+}
+
+func (t *testTable) Init(buf []byte, i flatbuffers.UOffsetT) {
+	t.tab.Bytes = buf
+	t.tab.Pos = i
+}
+
+func (t *testTable) Data() []byte {
+	if o := flatbuffers.UOffsetT(t.tab.Offset(4)); o != 0 {
+		return t.tab.ByteVector(o + t.tab.Pos)
+	}
+	return nil
+}
+
+func buildTestTable(payload []byte) *flatbuffers.Builder {
+	builder := flatbuffers.NewBuilder(len(payload) + 64)
+	data := builder.CreateByteVector(payload)
+	builder.StartObject(1)
+	builder.PrependUOffsetTSlot(0, data, 0)
+	builder.Finish(builder.EndObject())
+	return builder
+}
+
+type gobMessage struct {
+	Name string
+	Data []byte
+}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame frame
+	}{
+		{name: "hello", frame: frame{Kind: frameHello, Source: 7}},
+		{name: "data", frame: frame{Kind: frameData, Source: 3, Tag: 42, Payload: []byte("payload")}},
+		{name: "negative tag", frame: frame{Kind: frameData, Source: 1, Tag: -5, Payload: []byte{0}}},
+		{name: "event", frame: frame{Kind: frameEvent, Source: 2, Payload: []byte(`{"Kind":5}`)}},
+	}
+
+	codec := frameCodec{}
+	for _, tt := range tests {
+		encoded, err := codec.Marshal(&tt.frame)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", tt.name, err)
+		}
+
+		// gRPC hands over either one contiguous buffer or several pieces
+		inputs := map[string]mem.BufferSlice{
+			"split":      encoded,
+			"contiguous": {mem.SliceBuffer(encoded.Materialize())},
+		}
+		for layout, input := range inputs {
+			var got frame
+			if err := codec.Unmarshal(input, &got); err != nil {
+				t.Fatalf("%s/%s: unmarshal: %v", tt.name, layout, err)
+			}
+			if got.Kind != tt.frame.Kind || got.Source != tt.frame.Source || got.Tag != tt.frame.Tag || !bytes.Equal(got.Payload, tt.frame.Payload) {
+				t.Errorf("%s/%s: got %+v, want %+v", tt.name, layout, got, tt.frame)
+			}
+		}
+	}
+}
+
+func TestFrameCodecErrors(t *testing.T) {
+	codec := frameCodec{}
+	if _, err := codec.Marshal("not a frame"); err == nil {
+		t.Error("marshal of a non-frame succeeded")
+	}
+	var f frame
+	if err := codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer([]byte{1, 2, 3})}, &f); err == nil {
+		t.Error("unmarshal of a short frame succeeded")
+	}
+	if err := codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer(make([]byte, frameHeaderSize))}, new(int)); err == nil {
+		t.Error("unmarshal into a non-frame succeeded")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	payload := []byte("hello, ranks")
+
+	t.Run("raw", func(t *testing.T) {
+		data, err := RawCodec.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		if err := RawCodec.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, payload) {
+			t.Errorf("got %q, want %q", out, payload)
+		}
+	})
+
+	t.Run("proto", func(t *testing.T) {
+		data, err := ProtoCodec.Marshal(wrapperspb.Bytes(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out wrapperspb.BytesValue
+		if err := ProtoCodec.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.GetValue(), payload) {
+			t.Errorf("got %q, want %q", out.GetValue(), payload)
+		}
+	})
+
+	t.Run("flatbuffers", func(t *testing.T) {
+		data, err := FlatBuffersCodec.Marshal(buildTestTable(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out testTable
+		if err := FlatBuffersCodec.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Data(), payload) {
+			t.Errorf("got %q, want %q", out.Data(), payload)
+		}
+	})
+
+	t.Run("gob", func(t *testing.T) {
+		in := gobMessage{Name: "block", Data: payload}
+		data, err := GobCodec.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out gobMessage
+		if err := GobCodec.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Name != in.Name || !bytes.Equal(out.Data, in.Data) {
+			t.Errorf("got %+v, want %+v", out, in)
+		}
+	})
+}
+
+func TestCodecTypeMismatch(t *testing.T) {
+	if _, err := RawCodec.Marshal(42); err == nil {
+		t.Error("raw codec marshaled an int")
+	}
+	if err := RawCodec.Unmarshal(nil, new(string)); err == nil {
+		t.Error("raw codec unmarshaled into *string")
+	}
+	if _, err := ProtoCodec.Marshal("text"); err == nil {
+		t.Error("proto codec marshaled a string")
+	}
+	if _, err := FlatBuffersCodec.Marshal(42); err == nil {
+		t.Error("flatbuffers codec marshaled an int")
+	}
+	if err := FlatBuffersCodec.Unmarshal([]byte{1}, &testTable{}); err == nil {
+		t.Error("flatbuffers codec accepted a truncated buffer")
+	}
+}
+
+type registeredMessage struct{ N int }
+
+func TestCodecFor(t *testing.T) {
+	RegisterCodec(registeredMessage{}, RawCodec)
+	defer func() {
+		codecsMu.Lock()
+		delete(codecsByType, baseType(registeredMessage{}))
+		codecsMu.Unlock()
+	}()
+
+	tests := []struct {
+		name  string
+		value any
+		opts  []MessageOption
+		want  Codec
+	}{
+		{name: "bytes", value: []byte{1}, want: RawCodec},
+		{name: "bytes pointer", value: new([]byte), want: RawCodec},
+		{name: "proto", value: wrapperspb.Bytes(nil), want: ProtoCodec},
+		{name: "builder", value: flatbuffers.NewBuilder(0), want: FlatBuffersCodec},
+		{name: "table", value: &testTable{}, want: FlatBuffersCodec},
+		{name: "struct", value: gobMessage{}, want: GobCodec},
+		{name: "registered", value: &registeredMessage{}, want: RawCodec},
+		{name: "option wins", value: []byte{1}, opts: []MessageOption{WithCodec(GobCodec)}, want: GobCodec},
+	}
+
+	for _, tt := range tests {
+		if got := codecFor(tt.value, tt.opts); got != tt.want {
+			t.Errorf("%s: codecFor(%T) = %s, want %s", tt.name, tt.value, got.Name(), tt.want.Name())
+		}
+	}
+}
+
+var benchmarkSizes = []int{64, 4 << 10, 1 << 20}
+
+func benchmarkCodec(b *testing.B, roundTrip func(b *testing.B, payload []byte)) {
+	for _, size := range benchmarkSizes {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				roundTrip(b, payload)
+			}
+		})
+	}
+}
+
+func BenchmarkCodecRaw(b *testing.B) {
+	benchmarkCodec(b, func(b *testing.B, payload []byte) {
+		data, err := RawCodec.Marshal(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out []byte
+		if err := RawCodec.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkCodecFlatBuffers(b *testing.B) {
+	benchmarkCodec(b, func(b *testing.B, payload []byte) {
+		data, err := FlatBuffersCodec.Marshal(buildTestTable(payload))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out testTable
+		if err := FlatBuffersCodec.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkCodecProto(b *testing.B) {
+	benchmarkCodec(b, func(b *testing.B, payload []byte) {
+		data, err := ProtoCodec.Marshal(wrapperspb.Bytes(payload))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out wrapperspb.BytesValue
+		if err := ProtoCodec.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkCodecGob(b *testing.B) {
+	benchmarkCodec(b, func(b *testing.B, payload []byte) {
+		data, err := GobCodec.Marshal(gobMessage{Data: payload})
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out gobMessage
+		if err := GobCodec.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkCodecFrame(b *testing.B) {
+	codec := frameCodec{}
+	benchmarkCodec(b, func(b *testing.B, payload []byte) {
+		encoded, err := codec.Marshal(&frame{Kind: frameData, Source: 1, Tag: 2, Payload: payload})
+		if err != nil {
+			b.Fatal(err)
+		}
+		var out frame
+		if err := codec.Unmarshal(encoded, &out); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,464 @@
+// mpi/collectives.go
+// This file implements typed collectives over every rank of a communicator, as
+// one-line calls instead of loops of Send and Recv:
+//
+//	total, err := mpi.AllreduceSum(comm, partial)     // []float64 summed element-wise
+//	cfg, err := mpi.BroadcastValue(comm, 0, config)  // rank 0's config on every rank
+//
+// Every rank must call the same collectives in the same order, as in MPI; the
+// messages of one collective match by arrival order per peer, on tags near
+// math.MinInt32 that programs must not use themselves. Broadcasts and reductions run
+// over a binomial tree rooted at the root rank, so they take log2(size) steps. Numeric
+// slices travel as fixed-width little-endian values, so ranks on amd64 and arm64
+// instances agree, and other values use the codec their type has with SendValue.
+// A reduction combines the contributions in the same order on every run, so the same
+// inputs give the same floating-point result. Every collective takes the timeout
+// options of timeout.go, so a hung rank makes it fail instead of wait forever.
+
+package mpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Tags of the collectives
+const (
+	tagBroadcast = math.MinInt32 + iota
+	tagReduce
+	tagGather
+	tagScatter
+	tagGatherStream
+	tagClock
+)
+
+// Integer is the constraint of the built-in integer types
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Float is the constraint of the built-in floating-point types
+type Float interface {
+	~float32 | ~float64
+}
+
+// Number is the constraint of the element types numeric reductions work on
+type Number interface {
+	Integer | Float
+}
+
+// Sum adds a and b, for Reduce and Allreduce
+func Sum[T Number](a, b T) T { return a + b }
+
+// Product multiplies a and b, for Reduce and Allreduce
+func Product[T Number](a, b T) T { return a * b }
+
+// Min returns the smaller of a and b, for Reduce and Allreduce
+func Min[T Number](a, b T) T { return min(a, b) }
+
+// Max returns the larger of a and b, for Reduce and Allreduce
+func Max[T Number](a, b T) T { return max(a, b) }
+
+// Reduce combines data element-wise across the ranks with op and returns the result
+// on root, and nil on the other ranks. Every rank must pass the same number of
+// values. op must be associative; the ranks are combined in order starting at root.
+func Reduce[T Number](c *Comm, root int, data []T, op func(a, b T) T, opts ...MessageOption) ([]T, error) {
+	if err := c.checkRoot(root); err != nil {
+		return nil, err
+	}
+	call, err := c.collective("reduce", opts)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(call, root, data, op)
+}
+
+// reduce runs Reduce as part of call
+func reduce[T Number](call *collectiveCall, root int, data []T, op func(a, b T) T) ([]T, error) {
+	c := call.c
+	acc := append([]T(nil), data...)
+	rel := (c.rank - root + c.size) % c.size
+	for mask := 1; mask < c.size; mask <<= 1 {
+		if rel&mask != 0 {
+			parent := (rel - mask + root) % c.size
+			if err := c.sendOwned(parent, tagReduce, encodeNumbers(acc)); err != nil {
+				return nil, fmt.Errorf("reduce: %w", err)
+			}
+			return nil, nil
+		}
+		if rel+mask >= c.size {
+			continue
+		}
+		child := (rel + mask + root) % c.size
+		payload, err := call.recv(child, tagReduce)
+		if err != nil {
+			return nil, fmt.Errorf("reduce: %w", err)
+		}
+		values, err := decodeNumbers[T](payload)
+		if err != nil {
+			return nil, fmt.Errorf("reduce: values from rank %d: %v", child, err)
+		}
+		if len(values) != len(acc) {
+			return nil, fmt.Errorf("reduce: rank %d sent %d values, rank %d has %d", child, len(values), c.rank, len(acc))
+		}
+		for i, v := range values {
+			acc[i] = op(acc[i], v)
+		}
+	}
+	return acc, nil
+}
+
+// Allreduce combines data element-wise across the ranks with op and returns the
+// result on every rank
+func Allreduce[T Number](c *Comm, data []T, op func(a, b T) T, opts ...MessageOption) ([]T, error) {
+	call, err := c.collective("allreduce", opts)
+	if err != nil {
+		return nil, err
+	}
+	reduced, err := reduce(call, 0, data, op)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if c.rank == 0 {
+		payload = encodeNumbers(reduced)
+	}
+	payload, err = call.broadcastBytes(0, payload)
+	if err != nil {
+		return nil, fmt.Errorf("allreduce: %w", err)
+	}
+	return decodeNumbers[T](payload)
+}
+
+// ReduceSum sums data element-wise across the ranks onto root
+func ReduceSum[T Number](c *Comm, root int, data []T, opts ...MessageOption) ([]T, error) {
+	return Reduce(c, root, data, Sum[T], opts...)
+}
+
+// AllreduceSum sums data element-wise across the ranks and returns the sums on every rank
+func AllreduceSum[T Number](c *Comm, data []T, opts ...MessageOption) ([]T, error) {
+	return Allreduce(c, data, Sum[T], opts...)
+}
+
+// AllreduceMin returns the element-wise minimum of data across the ranks on every rank
+func AllreduceMin[T Number](c *Comm, data []T, opts ...MessageOption) ([]T, error) {
+	return Allreduce(c, data, Min[T], opts...)
+}
+
+// AllreduceMax returns the element-wise maximum of data across the ranks on every rank
+func AllreduceMax[T Number](c *Comm, data []T, opts ...MessageOption) ([]T, error) {
+	return Allreduce(c, data, Max[T], opts...)
+}
+
+// Barrier returns once every rank has called it
+func Barrier(c *Comm, opts ...MessageOption) error {
+	call, err := c.collective("barrier", opts)
+	if err != nil {
+		return err
+	}
+	if _, err := reduce(call, 0, []int64(nil), Sum[int64]); err != nil {
+		return fmt.Errorf("barrier: %w", err)
+	}
+	if _, err := call.broadcastBytes(0, nil); err != nil {
+		return fmt.Errorf("barrier: %w", err)
+	}
+	return nil
+}
+
+// BroadcastValue returns root's v on every rank; the other ranks' v is ignored. v is
+// encoded once, with the codec SendValue would choose for T or the one in opts.
+func BroadcastValue[T any](c *Comm, root int, v T, opts ...MessageOption) (T, error) {
+	var zero T
+	if err := c.checkRoot(root); err != nil {
+		return zero, err
+	}
+	call, err := c.collective("broadcast", opts)
+	if err != nil {
+		return zero, err
+	}
+	codec := valueCodec[T](opts)
+	var payload []byte
+	if c.rank == root {
+		if payload, err = encodeValue(v, codec); err != nil {
+			return zero, fmt.Errorf("broadcast: %v", err)
+		}
+	}
+	payload, err = call.broadcastBytes(root, payload)
+	if err != nil {
+		return zero, fmt.Errorf("broadcast: %w", err)
+	}
+	if c.rank == root {
+		return v, nil
+	}
+	return decodeValue[T](payload, codec)
+}
+
+// GatherValue returns the v of every rank, indexed by rank, on root, and nil on the
+// other ranks
+func GatherValue[T any](c *Comm, root int, v T, opts ...MessageOption) ([]T, error) {
+	if err := c.checkRoot(root); err != nil {
+		return nil, err
+	}
+	call, err := c.collective("gather", opts)
+	if err != nil {
+		return nil, err
+	}
+	codec := valueCodec[T](opts)
+	if c.rank != root {
+		payload, err := encodeValue(v, codec)
+		if err != nil {
+			return nil, fmt.Errorf("gather: %v", err)
+		}
+		if err := c.sendOwned(root, tagGather, payload); err != nil {
+			return nil, fmt.Errorf("gather: %w", err)
+		}
+		return nil, nil
+	}
+	values := make([]T, c.size)
+	for source := range values {
+		if source == root {
+			values[source] = v
+			continue
+		}
+		payload, err := call.recv(source, tagGather)
+		if err != nil {
+			return nil, fmt.Errorf("gather: %w", err)
+		}
+		if values[source], err = decodeValue[T](payload, codec); err != nil {
+			return nil, fmt.Errorf("gather: value from rank %d: %v", source, err)
+		}
+	}
+	return values, nil
+}
+
+// AllgatherValue returns the v of every rank, indexed by rank, on every rank
+func AllgatherValue[T any](c *Comm, v T, opts ...MessageOption) ([]T, error) {
+	call, err := c.collective("allgather", opts)
+	if err != nil {
+		return nil, err
+	}
+	codec := valueCodec[T](opts)
+	own, err := encodeValue(v, codec)
+	if err != nil {
+		return nil, fmt.Errorf("allgather: %v", err)
+	}
+	// Rank 0 collects the encoded values and broadcasts them in one message, so no
+	// value is decoded and encoded again on the way
+	var packed []byte
+	if c.rank != 0 {
+		if err := c.sendOwned(0, tagGather, own); err != nil {
+			return nil, fmt.Errorf("allgather: %w", err)
+		}
+	} else {
+		packed = binary.AppendUvarint(packed, uint64(len(own)))
+		packed = append(packed, own...)
+		for source := 1; source < c.size; source++ {
+			payload, err := call.recv(source, tagGather)
+			if err != nil {
+				return nil, fmt.Errorf("allgather: %w", err)
+			}
+			packed = binary.AppendUvarint(packed, uint64(len(payload)))
+			packed = append(packed, payload...)
+		}
+	}
+	if packed, err = call.broadcastBytes(0, packed); err != nil {
+		return nil, fmt.Errorf("allgather: %w", err)
+	}
+	values := make([]T, c.size)
+	for rank := range values {
+		n, read := binary.Uvarint(packed)
+		if read <= 0 || uint64(len(packed)-read) < n {
+			return nil, fmt.Errorf("allgather: truncated value of rank %d", rank)
+		}
+		payload := packed[read : read+int(n)]
+		packed = packed[read+int(n):]
+		if values[rank], err = decodeValue[T](payload, codec); err != nil {
+			return nil, fmt.Errorf("allgather: value from rank %d: %v", rank, err)
+		}
+	}
+	return values, nil
+}
+
+// ScatterValue sends values[i] from root to rank i and returns the calling rank's
+// value. Only root's values are used, and it must hold one value per rank.
+func ScatterValue[T any](c *Comm, root int, values []T, opts ...MessageOption) (T, error) {
+	var zero T
+	if err := c.checkRoot(root); err != nil {
+		return zero, err
+	}
+	call, err := c.collective("scatter", opts)
+	if err != nil {
+		return zero, err
+	}
+	codec := valueCodec[T](opts)
+	if c.rank != root {
+		payload, err := call.recv(root, tagScatter)
+		if err != nil {
+			return zero, fmt.Errorf("scatter: %w", err)
+		}
+		return decodeValue[T](payload, codec)
+	}
+	if len(values) != c.size {
+		return zero, fmt.Errorf("scatter: %d values for %d ranks", len(values), c.size)
+	}
+	for dest, v := range values {
+		if dest == root {
+			continue
+		}
+		payload, err := encodeValue(v, codec)
+		if err != nil {
+			return zero, fmt.Errorf("scatter: %v", err)
+		}
+		if err := c.sendOwned(dest, tagScatter, payload); err != nil {
+			return zero, fmt.Errorf("scatter: %w", err)
+		}
+	}
+	return values[root], nil
+}
+
+// checkRoot rejects a root rank outside the communicator
+func (c *Comm) checkRoot(root int) error {
+	if root < 0 || root >= c.size {
+		return fmt.Errorf("invalid root rank %d in a communicator of %d ranks", root, c.size)
+	}
+	return nil
+}
+
+// broadcastBytes returns root's data on every rank, over UDP when the job asks for
+// it (see udpcast.go) and down the tree otherwise
+func (call *collectiveCall) broadcastBytes(root int, data []byte) ([]byte, error) {
+	if call.c.udpcast != nil {
+		return call.udpBroadcast(root, data)
+	}
+	return call.treeBroadcast(root, data)
+}
+
+// treeBroadcast passes root's data down a binomial tree and returns it on every
+// rank. Ranks forward the payload they received, which is never modified.
+func (call *collectiveCall) treeBroadcast(root int, data []byte) ([]byte, error) {
+	c := call.c
+	rel := (c.rank - root + c.size) % c.size
+	mask := 1
+	for ; mask < c.size; mask <<= 1 {
+		if rel&mask != 0 {
+			var err error
+			if data, err = call.recv((rel-mask+root)%c.size, tagBroadcast); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	for mask >>= 1; mask > 0; mask >>= 1 {
+		if rel+mask < c.size {
+			if err := c.sendOwned((rel+mask+root)%c.size, tagBroadcast, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// encodeValue encodes v with codec into a payload of its own. The raw and FlatBuffers
+// codecs return v's buffer, which the caller may change once the collective returns
+// while the transport still sends it.
+func encodeValue[T any](v T, codec Codec) ([]byte, error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T with %s codec: %v", v, codec.Name(), err)
+	}
+	if codec == RawCodec || codec == FlatBuffersCodec {
+		data = bytes.Clone(data)
+	}
+	return data, nil
+}
+
+// valueCodec returns the codec values of type T are sent with, the same on every rank
+func valueCodec[T any](opts []MessageOption) Codec {
+	var zero T
+	return codecFor(any(zero), opts)
+}
+
+// decodeValue decodes a value of type T, allocating what T points to if it is a pointer
+func decodeValue[T any](data []byte, codec Codec) (T, error) {
+	if codec == RawCodec || codec == FlatBuffersCodec {
+		// The payload is forwarded down the tree, and the caller owns the result
+		data = bytes.Clone(data)
+	}
+	var v T
+	target := any(&v)
+	if t := reflect.TypeFor[T](); t.Kind() == reflect.Pointer {
+		v = reflect.New(t.Elem()).Interface().(T)
+		target = v
+	}
+	if err := codec.Unmarshal(data, target); err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to decode %T with %s codec: %v", v, codec.Name(), err)
+	}
+	return v, nil
+}
+
+// numberWidth is the encoded size of a value of kind
+func numberWidth(kind reflect.Kind) int {
+	if kind == reflect.Float32 {
+		return 4
+	}
+	return 8
+}
+
+// encodeNumbers encodes data little-endian, integers as 64 bits for portability
+// between ranks whose int sizes differ
+func encodeNumbers[T Number](data []T) []byte {
+	kind := reflect.TypeFor[T]().Kind()
+	out := make([]byte, 0, len(data)*numberWidth(kind))
+	switch kind {
+	case reflect.Float32:
+		for _, v := range data {
+			out = binary.LittleEndian.AppendUint32(out, math.Float32bits(float32(v)))
+		}
+	case reflect.Float64:
+		for _, v := range data {
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(float64(v)))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for _, v := range data {
+			out = binary.LittleEndian.AppendUint64(out, uint64(int64(v)))
+		}
+	default:
+		for _, v := range data {
+			out = binary.LittleEndian.AppendUint64(out, uint64(v))
+		}
+	}
+	return out
+}
+
+// decodeNumbers decodes values encoded by encodeNumbers
+func decodeNumbers[T Number](data []byte) ([]T, error) {
+	kind := reflect.TypeFor[T]().Kind()
+	width := numberWidth(kind)
+	if len(data)%width != 0 {
+		return nil, fmt.Errorf("%d bytes are not a whole number of %d-byte values", len(data), width)
+	}
+	out := make([]T, len(data)/width)
+	switch kind {
+	case reflect.Float32:
+		for i := range out {
+			out[i] = T(math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:])))
+		}
+	case reflect.Float64:
+		for i := range out {
+			out[i] = T(math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:])))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for i := range out {
+			out[i] = T(int64(binary.LittleEndian.Uint64(data[i*8:])))
+		}
+	default:
+		for i := range out {
+			out[i] = T(binary.LittleEndian.Uint64(data[i*8:]))
+		}
+	}
+	return out, nil
+}
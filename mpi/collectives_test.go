@@ -0,0 +1,418 @@
+// mpi/collectives_test.go
+
+package mpi
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// onEveryRank calls fn on every communicator at once and returns the errors by rank
+func onEveryRank(comms []*Comm, fn func(c *Comm) error) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(comms))
+	for i, c := range comms {
+		wg.Add(1)
+		go func(i int, c *Comm) {
+			defer wg.Done()
+			errs[i] = fn(c)
+		}(i, c)
+	}
+	wg.Wait()
+	return errs
+}
+
+func checkRanks(t *testing.T, errs []error) {
+	t.Helper()
+	for rank, err := range errs {
+		if err != nil {
+			t.Errorf("rank %d: %v", rank, err)
+		}
+	}
+}
+
+type celsius float32
+
+func TestAllreduce(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		for _, size := range []int{1, 2, 3, 5, 8} {
+			t.Run(fmt.Sprintf("%s-%d", name, size), func(t *testing.T) {
+				comms := startLocalWorld(t, size, defaultEagerLimit, name)
+				defer finalizeAll(t, comms)
+				n := size * (size - 1) / 2
+				checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+					r := c.Rank()
+					tests := []struct {
+						name string
+						run  func() (any, error)
+						want any
+					}{
+						{
+							name: "sum int",
+							run:  func() (any, error) { return AllreduceSum(c, []int{r, -r, 1}) },
+							want: []int{n, -n, size},
+						},
+						{
+							name: "sum float64",
+							run:  func() (any, error) { return AllreduceSum(c, []float64{float64(r) / 2, 1e300}) },
+							want: []float64{float64(n) / 2, 1e300 * float64(size)},
+						},
+						{
+							name: "min float32",
+							run:  func() (any, error) { return AllreduceMin(c, []float32{float32(r) - 0.5}) },
+							want: []float32{-0.5},
+						},
+						{
+							name: "max uint8",
+							run:  func() (any, error) { return AllreduceMax(c, []uint8{uint8(200 + r), 7}) },
+							want: []uint8{uint8(200 + size - 1), 7},
+						},
+						{
+							name: "max int64",
+							run:  func() (any, error) { return AllreduceMax(c, []int64{math.MinInt64 + int64(r)}) },
+							want: []int64{math.MinInt64 + int64(size-1)},
+						},
+						{
+							name: "product named type",
+							run:  func() (any, error) { return Allreduce(c, []celsius{2}, Product[celsius]) },
+							want: []celsius{celsius(math.Pow(2, float64(size)))},
+						},
+						{
+							name: "empty",
+							run:  func() (any, error) { return AllreduceSum(c, []float64{}) },
+							want: []float64{},
+						},
+					}
+					for _, tt := range tests {
+						got, err := tt.run()
+						if err != nil {
+							return fmt.Errorf("%s: %v", tt.name, err)
+						}
+						if !reflect.DeepEqual(got, tt.want) {
+							return fmt.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+						}
+					}
+					return nil
+				}))
+			})
+		}
+	}
+}
+
+func TestReduceToRoot(t *testing.T) {
+	const size = 5
+	comms := startLocalWorld(t, size, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	for root := range size {
+		t.Run(fmt.Sprintf("root-%d", root), func(t *testing.T) {
+			checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+				got, err := ReduceSum(c, root, []int{1, c.Rank()})
+				if err != nil {
+					return err
+				}
+				if c.Rank() != root {
+					if got != nil {
+						return fmt.Errorf("ReduceSum() = %v on rank %d, want nil off the root", got, c.Rank())
+					}
+					return nil
+				}
+				if want := []int{size, 10}; !reflect.DeepEqual(got, want) {
+					return fmt.Errorf("ReduceSum() = %v, want %v", got, want)
+				}
+				return nil
+			}))
+		})
+	}
+}
+
+// TestReduceDeterministic checks that ranks are combined in the same order each time,
+// so floating-point sums that depend on the order agree between runs
+func TestReduceDeterministic(t *testing.T) {
+	const size = 8
+	comms := startLocalWorld(t, size, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	var first []float64
+	for run := range 5 {
+		var got []float64
+		checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+			v := []float64{math.Pow(10, float64(c.Rank()*3-12)) + 0.1}
+			sum, err := AllreduceSum(c, v)
+			if c.Rank() == 0 {
+				got = sum
+			}
+			return err
+		}))
+		if run == 0 {
+			first = got
+		} else if !reflect.DeepEqual(got, first) {
+			t.Fatalf("run %d: AllreduceSum() = %v, first run gave %v", run, got, first)
+		}
+	}
+}
+
+func TestCollectiveErrors(t *testing.T) {
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+
+	tests := []struct {
+		name    string
+		run     func(c *Comm) error
+		wantErr []string // By rank; empty means no error
+	}{
+		{
+			name: "length mismatch",
+			run: func(c *Comm) error {
+				_, err := ReduceSum(c, 0, make([]int, c.Rank()+1))
+				return err
+			},
+			wantErr: []string{"reduce: rank 1 sent 2 values, rank 0 has 1", ""},
+		},
+		{
+			name: "invalid root",
+			run: func(c *Comm) error {
+				_, err := BroadcastValue(c, 2, "x")
+				return err
+			},
+			wantErr: []string{"invalid root rank 2 in a communicator of 2 ranks", "invalid root rank 2"},
+		},
+		{
+			name: "negative root",
+			run: func(c *Comm) error {
+				_, err := Reduce(c, -1, []int{1}, Sum[int])
+				return err
+			},
+			wantErr: []string{"invalid root rank -1", "invalid root rank -1"},
+		},
+		{
+			name: "scatter count",
+			run: func(c *Comm) error {
+				if c.Rank() == 1 {
+					// Nothing is sent, so rank 1 would wait forever
+					return nil
+				}
+				_, err := ScatterValue(c, 0, []int{1, 2, 3})
+				return err
+			},
+			wantErr: []string{"scatter: 3 values for 2 ranks", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for rank, err := range onEveryRank(comms, tt.run) {
+				want := tt.wantErr[rank]
+				if want == "" {
+					if err != nil {
+						t.Errorf("rank %d: %v", rank, err)
+					}
+					continue
+				}
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("rank %d: error = %v, want one containing %q", rank, err, want)
+				}
+			}
+		})
+	}
+}
+
+type collectiveConfig struct {
+	Name    string
+	Weights map[string]float64
+}
+
+func TestValueCollectives(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		for _, size := range []int{1, 3, 4} {
+			t.Run(fmt.Sprintf("%s-%d", name, size), func(t *testing.T) {
+				comms := startLocalWorld(t, size, defaultEagerLimit, name)
+				defer finalizeAll(t, comms)
+				root := size - 1
+				checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+					r := c.Rank()
+					tests := []struct {
+						name string
+						run  func() (any, error)
+						want any
+					}{
+						{
+							name: "broadcast struct",
+							run: func() (any, error) {
+								v := collectiveConfig{Name: fmt.Sprint("rank ", r), Weights: map[string]float64{"a": float64(r)}}
+								return BroadcastValue(c, root, v)
+							},
+							want: collectiveConfig{Name: fmt.Sprint("rank ", root), Weights: map[string]float64{"a": float64(root)}},
+						},
+						{
+							name: "broadcast bytes",
+							run:  func() (any, error) { return BroadcastValue(c, 0, []byte{byte(r), 9}) },
+							want: []byte{0, 9},
+						},
+						{
+							name: "broadcast pointer",
+							run: func() (any, error) {
+								v, err := BroadcastValue(c, root, wrapperspb.String(fmt.Sprint(r)))
+								if err != nil {
+									return nil, err
+								}
+								return v.GetValue(), nil
+							},
+							want: fmt.Sprint(root),
+						},
+						{
+							name: "broadcast with codec",
+							run:  func() (any, error) { return BroadcastValue(c, 0, r+10, WithCodec(GobCodec)) },
+							want: 10,
+						},
+						{
+							name: "gather",
+							run: func() (any, error) {
+								got, err := GatherValue(c, root, fmt.Sprint(r*r))
+								if r != root && got == nil {
+									return "off root", err
+								}
+								return got, err
+							},
+							want: func() any {
+								if r != root {
+									return "off root"
+								}
+								want := make([]string, size)
+								for i := range want {
+									want[i] = fmt.Sprint(i * i)
+								}
+								return want
+							}(),
+						},
+						{
+							name: "allgather",
+							run:  func() (any, error) { return AllgatherValue(c, []byte(strings.Repeat("x", r))) },
+							want: func() any {
+								want := make([][]byte, size)
+								for i := range want {
+									want[i] = []byte(strings.Repeat("x", i))
+								}
+								return want
+							}(),
+						},
+						{
+							name: "scatter",
+							run: func() (any, error) {
+								var values []collectiveConfig
+								if r == root {
+									for i := range size {
+										values = append(values, collectiveConfig{Name: fmt.Sprint(i)})
+									}
+								}
+								return ScatterValue(c, root, values)
+							},
+							want: collectiveConfig{Name: fmt.Sprint(r)},
+						},
+					}
+					for _, tt := range tests {
+						got, err := tt.run()
+						if err != nil {
+							return fmt.Errorf("%s: %v", tt.name, err)
+						}
+						if !reflect.DeepEqual(got, tt.want) {
+							return fmt.Errorf("%s = %#v, want %#v", tt.name, got, tt.want)
+						}
+					}
+					return nil
+				}))
+			})
+		}
+	}
+}
+
+// TestBroadcastOwnsBuffers checks that changing a broadcast []byte afterwards changes
+// neither what other ranks received nor what is forwarded to them
+func TestBroadcastOwnsBuffers(t *testing.T) {
+	const size = 4
+	comms := startLocalWorld(t, size, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		data := []byte("payload")
+		for range 3 {
+			got, err := BroadcastValue(c, 0, data)
+			if err != nil {
+				return err
+			}
+			if string(got) != "payload" {
+				return fmt.Errorf("BroadcastValue() = %q, want payload", got)
+			}
+			clear(got)
+			copy(data, "payload")
+		}
+		return nil
+	}))
+}
+
+func TestNumberEncoding(t *testing.T) {
+	roundTrip := func(t *testing.T, name string, got, want any) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: round trip = %v, want %v", name, got, want)
+		}
+	}
+	ints := []int{0, -1, math.MaxInt64, math.MinInt64}
+	encoded := encodeNumbers(ints)
+	if len(encoded) != 8*len(ints) {
+		t.Errorf("int: %d bytes, want %d", len(encoded), 8*len(ints))
+	}
+	decodedInts, _ := decodeNumbers[int](encoded)
+	roundTrip(t, "int", decodedInts, ints)
+
+	int8s := []int8{-128, 127, -1}
+	decodedInt8s, _ := decodeNumbers[int8](encodeNumbers(int8s))
+	roundTrip(t, "int8", decodedInt8s, int8s)
+
+	uints := []uint64{0, math.MaxUint64}
+	decodedUints, _ := decodeNumbers[uint64](encodeNumbers(uints))
+	roundTrip(t, "uint64", decodedUints, uints)
+
+	floats := []float32{0, -1.5, float32(math.Inf(1)), math.SmallestNonzeroFloat32}
+	encoded = encodeNumbers(floats)
+	if len(encoded) != 4*len(floats) {
+		t.Errorf("float32: %d bytes, want %d", len(encoded), 4*len(floats))
+	}
+	decodedFloats, _ := decodeNumbers[float32](encoded)
+	roundTrip(t, "float32", decodedFloats, floats)
+
+	if _, err := decodeNumbers[float64](make([]byte, 12)); err == nil || !strings.Contains(err.Error(), "12 bytes are not a whole number of 8-byte values") {
+		t.Errorf("decodeNumbers(12 bytes) = %v", err)
+	}
+}
+
+// BenchmarkAllreduceSum sums 64K float64 values over 4 ranks per iteration
+func BenchmarkAllreduceSum(b *testing.B) {
+	comms := startLocalWorld(b, 4, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(b, comms)
+	data := make([]float64, 1<<16)
+	b.SetBytes(int64(len(data) * 8))
+	b.ResetTimer()
+	for range b.N {
+		for rank, err := range onEveryRank(comms, func(c *Comm) error {
+			_, err := AllreduceSum(c, data)
+			return err
+		}) {
+			if err != nil {
+				b.Fatalf("rank %d: %v", rank, err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeNumbers(b *testing.B) {
+	data := make([]float64, 1<<16)
+	b.SetBytes(int64(len(data) * 8))
+	for range b.N {
+		if _, err := decodeNumbers[float64](encodeNumbers(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
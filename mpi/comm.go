@@ -0,0 +1,711 @@
+// mpi/comm.go
+// This file provides Comm, the communicator connecting all ranks of a job, and the
+// Init/Finalize lifecycle around it.
+
+package mpi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFinalized is returned by operations on a communicator after Finalize
+var ErrFinalized = errors.New("communicator is finalized")
+
+// ErrNotConnected is returned when sending to a rank that has not joined the job yet,
+// or has left it. See Members.
+var ErrNotConnected = errors.New("rank is not connected")
+
+// Comm is the communicator of all ranks in a job, or of a rank and the ranks it
+// spawned (see spawn.go)
+type Comm struct {
+	rank      int
+	size      int
+	advertise string // Our own address as peers dial it, sent in every hello
+	options   connectOptions
+	context   int32 // Names the communicator in every hello; zero for the world
+
+	parent     *Comm           // The communicator whose listener serves this one, for a spawn
+	childrenMu sync.Mutex      // Guards children
+	children   map[int32]*Comm // Communicators spawned from this one, by context
+
+	eagerLimit       int           // Largest payload sent eagerly; 0 sends every message eagerly
+	reconnectTimeout time.Duration // How long a broken peer stream may take to resume; 0 never resumes (see retry.go)
+	rendezvousMu     sync.Mutex
+	heldBack         map[rendezvousKey][]byte // Announced payloads the receivers have not asked for
+	nextMessage      uint32
+	transfers        sync.WaitGroup    // Rendezvous payloads being sent
+	limiter          *bandwidthLimiter // Caps the bandwidth sent to all peers; nil when unlimited
+	traffic          *trafficCounter   // What the rank sent, shared by all peers
+	cipher           *payloadCipher    // Encrypts the frames of every stream; nil sends them in the clear
+	broadcast        string            // How large broadcasts travel, see udpcast.go
+	udpcast          *udpCaster        // The UDP side of broadcasts with broadcast udp, nil otherwise
+
+	collectiveTimeout time.Duration // How long a collective waits for a message; 0 waits forever (see timeout.go)
+	timeoutPolicy     TimeoutPolicy // What a collective does when it times out
+	collectiveMu      sync.Mutex    // Guards collectiveErr
+	collectiveErr     error         // Why an earlier collective failed, which every later one fails with
+
+	listener  net.Listener
+	transport transport
+	mailbox   *mailbox
+	profiler  *http.Server // Serves runtime profiles when MPI_PPROF_PORT is set
+
+	peersMu   sync.RWMutex
+	addresses []string // Peer addresses, updated when a rank moves to a new instance
+	peers     []*peer  // Outgoing streams indexed by rank, nil for the local rank
+
+	inboundMu     sync.Mutex // Guards the connection state below
+	inboundReady  map[int]bool
+	inboundGen    map[int]int           // Latest inbound stream per rank; older streams belong to replaced incarnations
+	inbound       map[int]*inboundState // The connection from each rank, which resumed streams carry on
+	outboundReady map[int]bool
+	members       map[int]bool // Remote ranks connected in both directions
+	accepting     bool         // Set once Init stops waiting; later members are announced as joined
+	inboundCond   *sync.Cond
+	inboundDone   sync.WaitGroup
+
+	running  atomic.Bool   // Set once Init has returned
+	done     chan struct{} // Closed to stop background watchers
+	stopOnce sync.Once
+	watchers sync.WaitGroup
+
+	eventsMu     sync.Mutex
+	subscribers  []chan Event
+	peerLeft     map[int]bool
+	eventsClosed bool
+
+	control controlState // The key-value store of rank 0 and the requests waiting on it, see control.go
+}
+
+// peer is the outgoing stream to one remote rank
+type peer struct {
+	rank    int
+	address string
+	writer  sendLock   // Serializes writes, streams are not safe for concurrent sends
+	dataMu  sync.Mutex // Keeps the chunks of one data message together
+	stream  peerStream
+	limiter *bandwidthLimiter // The rank's limiter, shared by all peers
+	traffic *trafficCounter   // The rank's counter, shared by all peers; nil counts nothing
+	closed  bool              // Set under writer once Finalize has closed the stream for sending
+
+	// Resuming the stream after a transient fault, see retry.go. All but streamMu and
+	// acked are guarded by writer.
+	seq              uint64       // Frames written on the connection
+	replay           replayBuffer // The latest frames written, kept when redial is set
+	broken           error        // Why the connection failed for good
+	redial           func(context.Context) (peerStream, error)
+	reconnectTimeout time.Duration
+	done             <-chan struct{} // Closed when the communicator shuts down
+	streamMu         sync.Mutex      // Guards replacing stream, so shutdown closes the latest one
+	acked            chan error      // The end of the stream Finalize closed, from watch
+}
+
+var (
+	worldMu sync.Mutex
+	world   *Comm
+)
+
+// Init starts the local rank's server, connects to every peer, and returns the world communicator.
+// It returns once all ranks have connected to each other, or with MPI_MIN_RANKS set, once
+// this rank is connected to that many ranks including itself.
+func Init() (*Comm, error) {
+	worldMu.Lock()
+	defer worldMu.Unlock()
+	if world != nil {
+		return nil, fmt.Errorf("mpi.Init called twice")
+	}
+
+	rank, err := Rank()
+	if err != nil {
+		return nil, err
+	}
+	size, err := Size()
+	if err != nil {
+		return nil, err
+	}
+	if rank < 0 || rank >= size {
+		return nil, fmt.Errorf("rank %d outside of world of size %d", rank, size)
+	}
+
+	addresses, advertise, err := loadAddresses(rank, size)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := connectOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if options.MinRanks > size {
+		return nil, fmt.Errorf("%s is %d, but the world has only %d ranks", EnvMinRanks, options.MinRanks, size)
+	}
+
+	eagerLimit, err := eagerLimitFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := bandwidthLimiterFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	payloadCipher, err := payloadCipherFromEnv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	maxClockSkew, err := maxClockSkewFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	spawnContext, err := spawnContextFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	reconnectTimeout, err := reconnectTimeoutFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	collectiveTimeout, timeoutPolicy, err := collectiveTimeoutFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := broadcastFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	comm := newComm(rank, size, addresses, advertise, options)
+	comm.context = spawnContext
+	comm.eagerLimit = eagerLimit
+	comm.reconnectTimeout = reconnectTimeout
+	comm.collectiveTimeout = collectiveTimeout
+	comm.timeoutPolicy = timeoutPolicy
+	comm.limiter = limiter
+	comm.cipher = payloadCipher
+	if spawnContext == 0 {
+		comm.broadcast = broadcast
+	}
+	if err := comm.start(); err != nil {
+		return nil, err
+	}
+	if maxClockSkew > 0 {
+		if err := comm.checkClockSkew(maxClockSkew); err != nil {
+			comm.shutdown()
+			return nil, err
+		}
+	}
+
+	comm.running.Store(true)
+	comm.watchers.Add(1)
+	go comm.watchSpotNotices()
+
+	world = comm
+	return comm, nil
+}
+
+// newComm returns the communicator of rank before it is connected
+func newComm(rank, size int, addresses []string, advertise string, options connectOptions) *Comm {
+	comm := &Comm{
+		rank:          rank,
+		size:          size,
+		advertise:     advertise,
+		options:       options,
+		eagerLimit:    defaultEagerLimit,
+		timeoutPolicy: TimeoutError,
+		traffic:       &trafficCounter{},
+		heldBack:      make(map[rendezvousKey][]byte),
+		addresses:     addresses,
+		mailbox:       newMailbox(),
+		peers:         make([]*peer, size),
+		inboundReady:  make(map[int]bool),
+		inboundGen:    make(map[int]int),
+		inbound:       make(map[int]*inboundState),
+		outboundReady: make(map[int]bool),
+		members:       make(map[int]bool),
+		done:          make(chan struct{}),
+		peerLeft:      make(map[int]bool),
+	}
+	comm.inboundCond = sync.NewCond(&comm.inboundMu)
+	return comm
+}
+
+// start serves the local rank, on c.listener if it is already set, and connects to the peers
+func (c *Comm) start() error {
+	var err error
+	c.profiler, err = startProfiler()
+	if err != nil {
+		return err
+	}
+
+	if c.listener == nil {
+		c.listener, err = net.Listen("tcp", c.addresses[c.rank])
+		if err != nil {
+			c.stopProfiler()
+			return fmt.Errorf("failed to listen on %s: %v", c.addresses[c.rank], err)
+		}
+	}
+
+	c.transport = newTransport(c.options.Transport)
+	if c.cipher != nil {
+		c.transport = sealedTransport{transport: c.transport, cipher: c.cipher}
+	}
+	c.transport.serve(c.listener, c.exchange)
+	if c.broadcast == BroadcastUDP && c.cipher == nil {
+		c.udpcast = newUDPCaster(c)
+	}
+
+	err = c.connect(c.options)
+	if err != nil {
+		c.shutdown()
+		return err
+	}
+	return nil
+}
+
+// World returns the communicator created by Init, or nil before Init
+func World() *Comm {
+	worldMu.Lock()
+	defer worldMu.Unlock()
+	return world
+}
+
+// Rank returns the rank of the local process in the communicator
+func (c *Comm) Rank() int {
+	return c.rank
+}
+
+// Size returns the number of ranks in the communicator
+func (c *Comm) Size() int {
+	return c.size
+}
+
+// Members returns the ranks currently connected to this one, including itself, in
+// ascending order. It is every rank unless the job started with MPI_MIN_RANKS below
+// the world size or a rank has left; ranks that join later are announced with
+// EventPeerJoined. Subscribe to Events before calling Members so no join is missed.
+func (c *Comm) Members() []int {
+	c.inboundMu.Lock()
+	defer c.inboundMu.Unlock()
+	var members []int
+	for rank := 0; rank < c.size; rank++ {
+		if rank == c.rank || c.members[rank] {
+			members = append(members, rank)
+		}
+	}
+	return members
+}
+
+// Send delivers data to rank dest with the given tag. It returns once the message
+// has been handed to the transport; the receiver buffers it until a matching Recv.
+// Messages above the eager limit are only announced, and this rank holds on to them
+// until the receiver's Recv asks for them (see rendezvous.go). data is copied, so
+// the caller may reuse it as soon as Send returns.
+func (c *Comm) Send(dest, tag int, data []byte) error {
+	return c.sendOwned(dest, tag, append([]byte(nil), data...))
+}
+
+// sendOwned sends data without copying it. The transport may read data after
+// sendOwned returns, so the caller must not modify it afterwards.
+func (c *Comm) sendOwned(dest, tag int, data []byte) error {
+	if dest < 0 || dest >= c.size {
+		return fmt.Errorf("send to invalid rank %d", dest)
+	}
+	if dest == c.rank {
+		c.mailbox.deliver(c.rank, tag, data)
+		return nil
+	}
+	var err error
+	if c.eagerLimit > 0 && len(data) > c.eagerLimit {
+		err = c.sendRendezvous(dest, tag, data)
+	} else {
+		err = c.sendFrame(dest, &frame{Kind: frameData, Source: int32(c.rank), Tag: int32(tag), Payload: data})
+	}
+	if err == nil {
+		c.traffic.messages.Add(1)
+	}
+	return err
+}
+
+// sendFrame writes f to the stream of remote rank dest
+func (c *Comm) sendFrame(dest int, f *frame) error {
+	p := c.peer(dest)
+	if p == nil {
+		select {
+		case <-c.done:
+			return fmt.Errorf("send to rank %d: %w", dest, ErrFinalized)
+		default:
+			return fmt.Errorf("send to rank %d: %w", dest, ErrNotConnected)
+		}
+	}
+
+	err := p.send(f)
+	if errors.Is(err, ErrFinalized) {
+		return fmt.Errorf("send to rank %d: %w", dest, err)
+	}
+	if err != nil {
+		c.leave(dest, err.Error())
+		return fmt.Errorf("send to rank %d: %v", dest, err)
+	}
+	return nil
+}
+
+// peer returns the outgoing stream to rank dest, or nil once the communicator is shut down
+func (c *Comm) peer(dest int) *peer {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+	return c.peers[dest]
+}
+
+// setPeer records the outgoing stream to rank dest
+func (c *Comm) setPeer(dest int, p *peer) {
+	c.peersMu.Lock()
+	c.peers[dest] = p
+	c.peersMu.Unlock()
+}
+
+// address returns the address rank dest is currently reached on
+func (c *Comm) address(dest int) string {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+	return c.addresses[dest]
+}
+
+// replacePeer points the outgoing stream for dest at address, closing the stream to
+// the rank's previous incarnation. Messages sent to the old incarnation are lost.
+func (c *Comm) replacePeer(dest int, address string) error {
+	c.peersMu.Lock()
+	c.addresses[dest] = address
+	old := c.peers[dest]
+	c.peersMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
+	defer cancel()
+	if failure := c.dialPeer(ctx, dest); failure != nil {
+		return fmt.Errorf("failed to reconnect to restarted %s", failure)
+	}
+
+	if old != nil {
+		old.writer.lock(true)
+		old.closed = true
+		old.writer.unlock()
+		old.stream.close()
+	}
+	return nil
+}
+
+// Recv blocks until a message with tag arrives from rank source and returns its payload
+func (c *Comm) Recv(source, tag int) ([]byte, error) {
+	if source < 0 || source >= c.size {
+		return nil, fmt.Errorf("receive from invalid rank %d", source)
+	}
+	msg, err := c.mailbox.take(context.Background(), source, tag)
+	if err != nil || !msg.rendezvous {
+		return msg.payload, err
+	}
+	return c.fetch(context.Background(), source, tag, msg.id)
+}
+
+// Finalize flushes outgoing messages, waits for every peer to finish sending, and shuts down.
+func (c *Comm) Finalize() error {
+	// Background watchers forward events over the streams, so they must be gone
+	// before the streams are closed for sending
+	c.stopWatchers()
+
+	// Receivers that have not asked for a held-back message yet get it now, before
+	// the streams close
+	firstErr := c.flushRendezvous()
+
+	c.peersMu.RLock()
+	peers := append([]*peer(nil), c.peers...)
+	c.peersMu.RUnlock()
+
+	for _, p := range peers {
+		if p == nil {
+			continue
+		}
+		// The end of a stream that was reset may look like the end of a clean one, so
+		// the last frame says that it is
+		err := p.write(&frame{Kind: frameFinal, Source: int32(c.rank)}, true)
+		p.writer.lock(true)
+		p.closed = true
+		if err == nil {
+			err = p.stream.closeSend()
+		}
+		p.writer.unlock()
+		if err == nil {
+			// The peer acknowledges once it has consumed every frame we sent
+			err = <-p.acked
+		}
+		if err != nil && err != io.EOF && firstErr == nil {
+			firstErr = fmt.Errorf("failed to flush messages to rank %d: %v", p.rank, err)
+		}
+	}
+
+	// Peers close their streams to us in their own Finalize; stopping gracefully
+	// lets their acknowledgements flush before the connections go away
+	c.inboundDone.Wait()
+	c.transport.gracefulStop()
+	c.shutdown()
+	c.closeEvents()
+	if c.parent != nil {
+		// The parent's totals include this communicator's, and are written at its Finalize
+		c.parent.dropChild(c.context)
+	} else if err := c.writeStatsFile(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	worldMu.Lock()
+	if world == c {
+		world = nil
+	}
+	worldMu.Unlock()
+	return firstErr
+}
+
+// doneContext returns a context that is cancelled when the communicator shuts down
+func (c *Comm) doneContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopWatchers stops the background watchers and waits for them to return
+func (c *Comm) stopWatchers() {
+	c.stopOnce.Do(func() { close(c.done) })
+	c.watchers.Wait()
+}
+
+func (c *Comm) shutdown() {
+	c.stopWatchers()
+
+	c.peersMu.Lock()
+	peers := c.peers
+	c.peers = make([]*peer, c.size)
+	c.peersMu.Unlock()
+
+	for _, p := range peers {
+		if p == nil {
+			continue
+		}
+		p.streamMu.Lock()
+		p.stream.close()
+		p.streamMu.Unlock()
+	}
+	c.transport.stop()
+	if c.udpcast != nil {
+		c.udpcast.close()
+	}
+	c.mailbox.close(ErrFinalized)
+	c.stopProfiler()
+}
+
+func (c *Comm) stopProfiler() {
+	if c.profiler != nil {
+		c.profiler.Close()
+	}
+}
+
+// exchange receives one peer's stream and files its frames into the mailbox of the
+// communicator its hello names
+func (c *Comm) exchange(stream frameStream) error {
+	var hello frame
+	if err := stream.recv(&hello); err != nil {
+		return err
+	}
+	if (hello.Kind == frameHello || hello.Kind == frameResume) && hello.Tag != c.context {
+		child := c.child(hello.Tag)
+		if child == nil {
+			return fmt.Errorf("stream for unknown communicator %d", hello.Tag)
+		}
+		return child.receive(&hello, stream)
+	}
+	return c.receive(&hello, stream)
+}
+
+// receive files the frames of stream, which started with hello, into the mailbox
+func (c *Comm) receive(hello *frame, stream frameStream) error {
+	source := int(hello.Source)
+	if (hello.Kind != frameHello && hello.Kind != frameResume) || source < 0 || source >= c.size {
+		return fmt.Errorf("unexpected first frame from peer")
+	}
+
+	c.inboundDone.Add(1)
+	defer c.inboundDone.Done()
+	if hello.Kind == frameResume {
+		return c.resumeInbound(source, stream)
+	}
+	gen, state := c.markInbound(source)
+
+	// A second hello after Init comes from a restarted rank, possibly on a new instance.
+	// Our stream to the old incarnation is dead, so dial the new one. A first hello
+	// after Init is a straggler, which the background dials of Init already cover.
+	if c.running.Load() && gen > 1 {
+		address := string(hello.Payload)
+		if address == "" {
+			address = c.address(source)
+		}
+		c.dropMember(source)
+		if err := c.replacePeer(source, address); err != nil {
+			return err
+		}
+	}
+
+	return c.receiveFrames(source, gen, state, 0, stream)
+}
+
+// receiveFrames files the frames of stream, the stream of generation gen from source,
+// into the mailbox. The first frame is the one after the first seq of the connection.
+func (c *Comm) receiveFrames(source, gen int, state *inboundState, seq uint64, stream frameStream) error {
+	for {
+		var f frame
+		err := stream.recv(&f)
+		if err == io.EOF {
+			state.mu.Lock()
+			finalized := state.finalized
+			state.mu.Unlock()
+			if finalized || c.reconnectTimeout <= 0 {
+				c.publishLeft(source, gen, "finalized")
+				return stream.send(&frame{Kind: frameHello, Source: int32(c.rank)})
+			}
+		}
+		if err != nil {
+			c.streamLost(source, gen, err.Error())
+			return err
+		}
+		seq++
+		// Frames a resumed stream carries again, and whatever a stream it replaced still
+		// delivers, were handled already
+		var ack []byte
+		state.mu.Lock()
+		if state.current == gen && seq > state.received {
+			state.received = seq
+			if f.Kind == frameFinal {
+				state.finalized = true
+			}
+			c.handleFrame(source, &f, &state.chunks)
+			state.unacked += frameHeaderSize + len(f.Payload)
+			if c.reconnectTimeout > 0 && state.unacked >= ackInterval {
+				state.unacked = 0
+				ack = binary.BigEndian.AppendUint64(nil, seq)
+			}
+		}
+		state.mu.Unlock()
+		if ack != nil {
+			// A failed send fails the next recv too
+			stream.send(&frame{Kind: frameAck, Source: int32(c.rank), Payload: ack})
+		}
+	}
+}
+
+// handleFrame files f, a frame from source, into the mailbox
+func (c *Comm) handleFrame(source int, f *frame, chunks *chunkBuffer) {
+	switch f.Kind {
+	case frameChunk:
+		chunks.add(f.Payload)
+	case frameData:
+		c.mailbox.deliver(source, int(f.Tag), chunks.complete(f.Payload))
+	case frameEvent:
+		c.receiveEvent(f.Payload)
+	case frameReadyToSend:
+		c.receiveAnnouncement(source, f)
+	case frameClearToSend:
+		c.clearToSend(source, uint32(f.Tag))
+	case frameRequest:
+		go c.serveControl(source, f)
+	case frameReply:
+		c.receiveControlReply(f)
+	case frameBulkChunk:
+		if !c.streamBulk(source, f, chunks) {
+			chunks.add(f.Payload)
+		}
+	case frameBulk:
+		if !c.streamBulk(source, f, chunks) {
+			c.mailbox.deliverBulk(source, uint32(f.Tag), chunks.complete(f.Payload))
+		}
+	}
+}
+
+// markInbound records a new inbound stream from source and returns its generation and
+// the connection it starts
+func (c *Comm) markInbound(source int) (int, *inboundState) {
+	c.inboundMu.Lock()
+	c.inboundReady[source] = true
+	c.inboundGen[source]++
+	gen := c.inboundGen[source]
+	state := &inboundState{current: gen}
+	c.inbound[source] = state
+	c.admitLocked(source)
+	c.inboundMu.Unlock()
+	c.inboundCond.Broadcast()
+	return gen, state
+}
+
+// markOutbound records that our stream to target is open
+func (c *Comm) markOutbound(target int) {
+	c.inboundMu.Lock()
+	c.outboundReady[target] = true
+	c.admitLocked(target)
+	c.inboundMu.Unlock()
+	c.inboundCond.Broadcast()
+}
+
+// admitLocked makes rank a member once it is connected in both directions, announcing
+// it if Init has already returned. c.inboundMu must be held.
+func (c *Comm) admitLocked(rank int) {
+	if c.members[rank] || !c.inboundReady[rank] || !c.outboundReady[rank] {
+		return
+	}
+	c.members[rank] = true
+	if c.accepting {
+		c.publish(Event{Kind: EventPeerJoined, Rank: rank, Time: time.Now(), Detail: c.address(rank)})
+	}
+}
+
+// startAccepting marks the end of Init's wait, after which new members are announced
+func (c *Comm) startAccepting() {
+	c.inboundMu.Lock()
+	c.accepting = true
+	c.inboundMu.Unlock()
+}
+
+// dropMember forgets rank's membership so its next incarnation is announced again
+func (c *Comm) dropMember(rank int) {
+	c.inboundMu.Lock()
+	delete(c.members, rank)
+	delete(c.outboundReady, rank)
+	c.inboundMu.Unlock()
+}
+
+// leave reports that rank left the job
+func (c *Comm) leave(rank int, detail string) {
+	c.dropMember(rank)
+	if rank == 0 {
+		c.failControl(detail)
+	}
+	c.publish(Event{Kind: EventPeerLeft, Rank: rank, Time: time.Now(), Detail: detail})
+}
+
+// publishLeft reports that source left, unless the stream ending is one a newer
+// incarnation of the rank has already replaced
+func (c *Comm) publishLeft(source, gen int, detail string) {
+	c.inboundMu.Lock()
+	current := c.inboundGen[source] == gen
+	c.inboundMu.Unlock()
+	if current {
+		c.leave(source, detail)
+	}
+}
@@ -0,0 +1,306 @@
+// mpi/connect.go
+// This file establishes the all-to-all connections at Init. When N ranks dial
+// N-1 peers at the same moment the resulting SYN storm causes handshake timeouts
+// at scale, so connection setup is spread out: each rank waits a rank-proportional
+// stagger before dialing, dials peers in ring order starting after itself so that
+// no single rank is hit by everyone first, and keeps at most a bounded number of
+// handshakes in flight. Peers that cannot be reached are reported pair by pair.
+//
+// With MPI_MIN_RANKS set below the world size, Init returns as soon as the rank is
+// connected in both directions to enough peers, and keeps dialing the stragglers in
+// the background until Finalize. Each straggler is announced with EventPeerJoined
+// once it is connected.
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables tuning connection setup, set by awsmpirun from its flags
+const (
+	EnvConnectConcurrency = "MPI_CONNECT_CONCURRENCY"
+	EnvConnectTimeout     = "MPI_CONNECT_TIMEOUT"
+	EnvConnectStagger     = "MPI_CONNECT_STAGGER"
+	EnvMinRanks           = "MPI_MIN_RANKS"
+)
+
+const (
+	defaultConnectConcurrency = 16
+	defaultConnectTimeout     = 2 * time.Minute
+	defaultConnectStagger     = 10 * time.Millisecond
+	maxStaggerDelay           = 2 * time.Second
+)
+
+// connectOptions controls how Init establishes peer connections
+type connectOptions struct {
+	Concurrency int           // Maximum number of handshakes in flight
+	Timeout     time.Duration // Overall deadline for reaching every peer
+	Stagger     time.Duration // Start delay per rank, capped at maxStaggerDelay
+	MinRanks    int           // Ranks, including this one, that must be connected before Init returns; 0 means all
+	Transport   string        // Transport carrying the peer streams, see transport.go
+}
+
+func connectOptionsFromEnv() (connectOptions, error) {
+	options := connectOptions{
+		Concurrency: defaultConnectConcurrency,
+		Timeout:     defaultConnectTimeout,
+		Stagger:     defaultConnectStagger,
+		Transport:   TransportGRPC,
+	}
+
+	if value := os.Getenv(EnvConnectConcurrency); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return options, fmt.Errorf("invalid %s %q", EnvConnectConcurrency, value)
+		}
+		options.Concurrency = n
+	}
+	if value := os.Getenv(EnvConnectTimeout); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return options, fmt.Errorf("invalid %s %q", EnvConnectTimeout, value)
+		}
+		options.Timeout = d
+	}
+	if value := os.Getenv(EnvConnectStagger); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return options, fmt.Errorf("invalid %s %q", EnvConnectStagger, value)
+		}
+		options.Stagger = d
+	}
+	if value := os.Getenv(EnvMinRanks); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return options, fmt.Errorf("invalid %s %q", EnvMinRanks, value)
+		}
+		options.MinRanks = n
+	}
+	if value := os.Getenv(EnvTransport); value != "" {
+		if err := ValidateTransport(value); err != nil {
+			return options, fmt.Errorf("invalid %s: %v", EnvTransport, err)
+		}
+		options.Transport = value
+	}
+	return options, nil
+}
+
+// connectFailure describes a peer pair that could not be connected
+type connectFailure struct {
+	from, to int
+	address  string
+	attempts int
+	lastErr  string
+}
+
+func (f connectFailure) String() string {
+	if f.address == "" {
+		return fmt.Sprintf("rank %d -> rank %d: no connection was received", f.from, f.to)
+	}
+	return fmt.Sprintf("rank %d -> rank %d (%s): %d attempts, last error: %s", f.from, f.to, f.address, f.attempts, f.lastErr)
+}
+
+// connect dials every peer and waits until every peer has dialed us
+func (c *Comm) connect(options connectOptions) error {
+	if options.MinRanks > 0 && options.MinRanks < c.size {
+		return c.connectPartial(options)
+	}
+	deadline := time.Now().Add(options.Timeout)
+
+	time.Sleep(staggerDelay(c.rank, options))
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []connectFailure
+	slots := make(chan struct{}, options.Concurrency)
+
+	for offset := 1; offset < c.size; offset++ {
+		target := (c.rank + offset) % c.size
+		wg.Add(1)
+		go func(target int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			failure := c.dialPeer(ctx, target)
+			if failure != nil {
+				mu.Lock()
+				failures = append(failures, *failure)
+				mu.Unlock()
+			}
+		}(target)
+	}
+	wg.Wait()
+
+	failures = append(failures, c.waitInbound(deadline)...)
+	if len(failures) == 0 {
+		c.startAccepting()
+		return nil
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].from != failures[j].from {
+			return failures[i].from < failures[j].from
+		}
+		return failures[i].to < failures[j].to
+	})
+	var lines []string
+	for _, failure := range failures {
+		lines = append(lines, "  "+failure.String())
+	}
+	return fmt.Errorf("rank %d could not connect %d peer pairs within %s:\n%s",
+		c.rank, len(failures), options.Timeout, strings.Join(lines, "\n"))
+}
+
+// connectPartial dials every peer in the background and returns once this rank is
+// connected to MinRanks-1 of them. Dialing the rest continues until Finalize.
+func (c *Comm) connectPartial(options connectOptions) error {
+	deadline := time.Now().Add(options.Timeout)
+	time.Sleep(staggerDelay(c.rank, options))
+
+	// The dials are watchers so shutdown cancels the stragglers and waits for them
+	ctx, cancel := c.doneContext()
+	slots := make(chan struct{}, options.Concurrency)
+	var dials sync.WaitGroup
+	for offset := 1; offset < c.size; offset++ {
+		target := (c.rank + offset) % c.size
+		dials.Add(1)
+		c.watchers.Add(1)
+		go func(target int) {
+			defer c.watchers.Done()
+			defer dials.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			c.dialPeer(ctx, target)
+		}(target)
+	}
+	c.watchers.Add(1)
+	go func() {
+		defer c.watchers.Done()
+		dials.Wait()
+		cancel()
+	}()
+
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.inboundMu.Lock()
+		c.inboundCond.Broadcast()
+		c.inboundMu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.inboundMu.Lock()
+	for len(c.members) < options.MinRanks-1 && time.Now().Before(deadline) {
+		c.inboundCond.Wait()
+	}
+	connected := len(c.members)
+	c.accepting = true
+	c.inboundMu.Unlock()
+
+	if connected < options.MinRanks-1 {
+		return fmt.Errorf("rank %d connected to %d peers within %s, but %d ranks are required to start",
+			c.rank, connected, options.Timeout, options.MinRanks)
+	}
+	return nil
+}
+
+// staggerDelay is how long rank waits before dialing, with jitter so ranks with
+// close numbers do not collide
+func staggerDelay(rank int, options connectOptions) time.Duration {
+	delay := time.Duration(rank) * options.Stagger
+	if delay > maxStaggerDelay {
+		delay = maxStaggerDelay
+	}
+	if options.Stagger > 0 {
+		delay += time.Duration(rand.Int63n(int64(options.Stagger)))
+	}
+	return delay
+}
+
+// dialPeer opens the outgoing stream to target, retrying with backoff until ctx is done
+func (c *Comm) dialPeer(ctx context.Context, target int) *connectFailure {
+	address := c.address(target)
+	failure := &connectFailure{from: c.rank, to: target, address: address}
+
+	// Transports retry on their own; counting attempts here records every one
+	var mu sync.Mutex
+	attempt := func(err error) {
+		mu.Lock()
+		failure.attempts++
+		if err != nil {
+			failure.lastErr = err.Error()
+		}
+		mu.Unlock()
+	}
+
+	stream, err := c.transport.dial(ctx, address, attempt)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		if failure.lastErr == "" {
+			failure.lastErr = err.Error()
+		}
+		return failure
+	}
+
+	err = stream.send(&frame{Kind: frameHello, Source: int32(c.rank), Tag: c.context, Payload: []byte(c.advertise)})
+	if err != nil {
+		stream.close()
+		mu.Lock()
+		defer mu.Unlock()
+		failure.lastErr = err.Error()
+		return failure
+	}
+
+	p := &peer{rank: target, address: address, stream: stream, limiter: c.limiter, traffic: c.traffic, acked: make(chan error, 1)}
+	if c.reconnectTimeout > 0 {
+		p.redial = func(ctx context.Context) (peerStream, error) { return c.dialResume(ctx, target) }
+		p.reconnectTimeout = c.reconnectTimeout
+		p.done = c.done
+	}
+	go p.watch(stream)
+	c.setPeer(target, p)
+	c.markOutbound(target)
+	return nil
+}
+
+// waitInbound waits until every peer has opened its stream to us
+func (c *Comm) waitInbound(deadline time.Time) []connectFailure {
+	// Broadcasting under the lock keeps the wakeup from landing between the
+	// deadline check and Wait, where it would be lost
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.inboundMu.Lock()
+		c.inboundCond.Broadcast()
+		c.inboundMu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.inboundMu.Lock()
+	defer c.inboundMu.Unlock()
+	for len(c.inboundReady) < c.size-1 && time.Now().Before(deadline) {
+		c.inboundCond.Wait()
+	}
+
+	var failures []connectFailure
+	for source := 0; source < c.size; source++ {
+		if source != c.rank && !c.inboundReady[source] {
+			failures = append(failures, connectFailure{from: source, to: c.rank})
+		}
+	}
+	return failures
+}
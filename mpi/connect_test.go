@@ -0,0 +1,66 @@
+package mpi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectOptionsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    connectOptions
+		wantErr bool
+	}{
+		{name: "defaults", want: connectOptions{Concurrency: defaultConnectConcurrency, Timeout: defaultConnectTimeout, Stagger: defaultConnectStagger, Transport: TransportGRPC}},
+		{
+			name: "all set",
+			env:  map[string]string{EnvConnectConcurrency: "4", EnvConnectTimeout: "30s", EnvConnectStagger: "0s", EnvMinRanks: "3", EnvTransport: "tcp"},
+			want: connectOptions{Concurrency: 4, Timeout: 30 * time.Second, MinRanks: 3, Transport: TransportTCP},
+		},
+		{name: "zero concurrency", env: map[string]string{EnvConnectConcurrency: "0"}, wantErr: true},
+		{name: "bad timeout", env: map[string]string{EnvConnectTimeout: "soon"}, wantErr: true},
+		{name: "negative stagger", env: map[string]string{EnvConnectStagger: "-1s"}, wantErr: true},
+		{name: "zero min ranks", env: map[string]string{EnvMinRanks: "0"}, wantErr: true},
+		{name: "bad min ranks", env: map[string]string{EnvMinRanks: "half"}, wantErr: true},
+		{name: "unknown transport", env: map[string]string{EnvTransport: "quic"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{EnvConnectConcurrency, EnvConnectTimeout, EnvConnectStagger, EnvMinRanks, EnvTransport} {
+				t.Setenv(name, tt.env[name])
+			}
+			got, err := connectOptionsFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaggerDelay(t *testing.T) {
+	options := connectOptions{Stagger: 100 * time.Millisecond}
+	for _, rank := range []int{0, 5, 1000} {
+		base := time.Duration(rank) * options.Stagger
+		if base > maxStaggerDelay {
+			base = maxStaggerDelay
+		}
+		got := staggerDelay(rank, options)
+		if got < base || got >= base+options.Stagger {
+			t.Errorf("rank %d: delay %v outside [%v, %v)", rank, got, base, base+options.Stagger)
+		}
+	}
+	if got := staggerDelay(7, connectOptions{}); got != 0 {
+		t.Errorf("delay without stagger = %v, want 0", got)
+	}
+}
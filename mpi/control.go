@@ -0,0 +1,216 @@
+// mpi/control.go
+// This file implements the control channel, a small key-value store that rank 0 of a
+// communicator keeps in memory and the other ranks reach with request frames. It holds
+// the state of the mpi/sync primitives, so barriers, mutexes, and elections need
+// nothing outside the job. Requests and replies are control frames, so they overtake
+// the chunks of large messages on the same stream (see priority.go). The store lives as
+// long as rank 0 does: requests fail once rank 0 has left or the rank has finalized.
+
+package mpi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Operations of a control request
+const (
+	controlGet            = "get"
+	controlCompareAndSwap = "cas"
+	controlAdd            = "add"
+	controlDelete         = "delete"
+)
+
+// controlRequest is the payload of a request frame, whose tag is the request's id
+type controlRequest struct {
+	Op    string
+	Key   string
+	Old   []byte // For cas, the value the key must have; nil if it must not exist
+	New   []byte // For cas, the value to store
+	Delta int64  // For add, what to add to the counter
+}
+
+// controlReply is the payload of the reply to the control request whose id is the tag
+type controlReply struct {
+	Value   []byte
+	Exists  bool
+	Swapped bool
+	Count   int64
+	Error   string
+}
+
+// controlState is the rank's side of the control channel
+type controlState struct {
+	mu       sync.Mutex
+	values   map[string][]byte           // The store, on rank 0
+	counters map[string]int64            // Counters of the store, on rank 0
+	pending  map[int32]chan controlReply // Requests waiting for rank 0's reply, by id
+	next     int32
+}
+
+// ControlStore is the key-value store of a communicator, kept by its rank 0. Every
+// rank of the communicator sees the same values; they are lost when rank 0 leaves.
+type ControlStore struct {
+	comm *Comm
+}
+
+// ControlStore returns the key-value store of c
+func (c *Comm) ControlStore() *ControlStore {
+	return &ControlStore{comm: c}
+}
+
+// Get returns the value of key and whether it exists
+func (s *ControlStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.comm.controlCall(controlRequest{Op: controlGet, Key: key})
+	return reply.Value, reply.Exists, err
+}
+
+// CompareAndSwap stores value under key if the key currently holds old, and reports
+// whether it did. A nil old requires that the key does not exist yet.
+func (s *ControlStore) CompareAndSwap(key string, old, value []byte) (bool, error) {
+	reply, err := s.comm.controlCall(controlRequest{Op: controlCompareAndSwap, Key: key, Old: old, New: value})
+	return reply.Swapped, err
+}
+
+// Add adds delta to the counter under key, which starts at zero, and returns its new
+// value. Counters are apart from the values of Get and CompareAndSwap.
+func (s *ControlStore) Add(key string, delta int64) (int64, error) {
+	reply, err := s.comm.controlCall(controlRequest{Op: controlAdd, Key: key, Delta: delta})
+	return reply.Count, err
+}
+
+// Delete removes key, both its value and its counter
+func (s *ControlStore) Delete(key string) error {
+	_, err := s.comm.controlCall(controlRequest{Op: controlDelete, Key: key})
+	return err
+}
+
+// controlCall runs request against the store of rank 0 and waits for the reply
+func (c *Comm) controlCall(request controlRequest) (controlReply, error) {
+	var reply controlReply
+	if c.rank == 0 {
+		reply = c.applyControl(request)
+	} else {
+		var err error
+		if reply, err = c.sendControl(request); err != nil {
+			return controlReply{}, err
+		}
+	}
+	if reply.Error != "" {
+		return controlReply{}, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// sendControl sends request to rank 0 and waits for its reply
+func (c *Comm) sendControl(request controlRequest) (controlReply, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return controlReply{}, fmt.Errorf("failed to encode a control request: %v", err)
+	}
+
+	replies := make(chan controlReply, 1)
+	c.control.mu.Lock()
+	if c.control.pending == nil {
+		c.control.pending = make(map[int32]chan controlReply)
+	}
+	c.control.next++
+	id := c.control.next
+	c.control.pending[id] = replies
+	c.control.mu.Unlock()
+	defer func() {
+		c.control.mu.Lock()
+		delete(c.control.pending, id)
+		c.control.mu.Unlock()
+	}()
+
+	if err := c.sendFrame(0, &frame{Kind: frameRequest, Source: int32(c.rank), Tag: id, Payload: payload}); err != nil {
+		return controlReply{}, err
+	}
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-c.done:
+		return controlReply{}, ErrFinalized
+	}
+}
+
+// serveControl answers the control request f from source. It runs on its own
+// goroutine, as clearToSend does, so the reply does not block the stream's reader.
+func (c *Comm) serveControl(source int, f *frame) {
+	var request controlRequest
+	reply := controlReply{Error: "invalid control request"}
+	if err := json.Unmarshal(f.Payload, &request); err == nil {
+		reply = c.applyControl(request)
+	}
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	// A failed send leaves source waiting until rank 0 leaves or it finalizes
+	c.sendFrame(source, &frame{Kind: frameReply, Source: int32(c.rank), Tag: f.Tag, Payload: payload})
+}
+
+// applyControl runs request against the store, which only rank 0 keeps
+func (c *Comm) applyControl(request controlRequest) controlReply {
+	if c.rank != 0 {
+		return controlReply{Error: fmt.Sprintf("rank %d does not keep the control store", c.rank)}
+	}
+
+	c.control.mu.Lock()
+	defer c.control.mu.Unlock()
+	if c.control.values == nil {
+		c.control.values = make(map[string][]byte)
+		c.control.counters = make(map[string]int64)
+	}
+
+	switch request.Op {
+	case controlGet:
+		value, exists := c.control.values[request.Key]
+		return controlReply{Value: value, Exists: exists}
+	case controlCompareAndSwap:
+		value, exists := c.control.values[request.Key]
+		if request.Old == nil && exists || request.Old != nil && (!exists || !bytes.Equal(value, request.Old)) {
+			return controlReply{}
+		}
+		c.control.values[request.Key] = bytes.Clone(request.New)
+		return controlReply{Swapped: true}
+	case controlAdd:
+		c.control.counters[request.Key] += request.Delta
+		return controlReply{Count: c.control.counters[request.Key]}
+	case controlDelete:
+		delete(c.control.values, request.Key)
+		delete(c.control.counters, request.Key)
+		return controlReply{}
+	default:
+		return controlReply{Error: fmt.Sprintf("unknown control operation %q", request.Op)}
+	}
+}
+
+// receiveControlReply hands the reply f to the request waiting for it
+func (c *Comm) receiveControlReply(f *frame) {
+	var reply controlReply
+	if err := json.Unmarshal(f.Payload, &reply); err != nil {
+		reply = controlReply{Error: fmt.Sprintf("invalid control reply: %v", err)}
+	}
+	c.control.mu.Lock()
+	replies, ok := c.control.pending[f.Tag]
+	delete(c.control.pending, f.Tag)
+	c.control.mu.Unlock()
+	if ok {
+		replies <- reply
+	}
+}
+
+// failControl fails every request waiting for a reply, once rank 0 has left
+func (c *Comm) failControl(detail string) {
+	c.control.mu.Lock()
+	defer c.control.mu.Unlock()
+	for id, replies := range c.control.pending {
+		replies <- controlReply{Error: "rank 0 left: " + detail}
+		delete(c.control.pending, id)
+	}
+}
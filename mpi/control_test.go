@@ -0,0 +1,114 @@
+// mpi/control_test.go
+
+package mpi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestControlStore(t *testing.T) {
+	comms := startLocalWorld(t, 4, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+
+	// Every rank counts itself, and exactly one wins the key
+	wins := make([]bool, len(comms))
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		store := c.ControlStore()
+		if _, err := store.Add("arrived", 1); err != nil {
+			return err
+		}
+		swapped, err := store.CompareAndSwap("leader", nil, []byte(fmt.Sprint(c.Rank())))
+		wins[c.Rank()] = swapped
+		if err != nil {
+			return err
+		}
+		return Barrier(c)
+	}))
+	winner := -1
+	for rank, won := range wins {
+		if won && winner >= 0 {
+			t.Fatalf("ranks %d and %d both swapped a missing key", winner, rank)
+		}
+		if won {
+			winner = rank
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no rank swapped a missing key")
+	}
+
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		store := c.ControlStore()
+		if arrived, err := store.Add("arrived", 0); err != nil || arrived != int64(len(comms)) {
+			return fmt.Errorf("got %d arrivals, %v, want %d", arrived, err, len(comms))
+		}
+		value, exists, err := store.Get("leader")
+		if err != nil || !exists || string(value) != fmt.Sprint(winner) {
+			return fmt.Errorf("got leader %q, %v, %v, want %d", value, exists, err, winner)
+		}
+		if _, exists, err := store.Get("missing"); err != nil || exists {
+			return fmt.Errorf("got a missing key, %v", err)
+		}
+		return nil
+	}))
+}
+
+func TestControlCompareAndSwap(t *testing.T) {
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	store := comms[1].ControlStore()
+
+	tests := []struct {
+		name       string
+		old, value []byte
+		want       bool
+	}{
+		{name: "create", old: nil, value: []byte("a"), want: true},
+		{name: "create an existing key", old: nil, value: []byte("b"), want: false},
+		{name: "stale value", old: []byte("b"), value: []byte("c"), want: false},
+		{name: "current value", old: []byte("a"), value: []byte{}, want: true},
+		{name: "empty value", old: []byte{}, value: []byte("d"), want: true},
+	}
+	for _, test := range tests {
+		got, err := store.CompareAndSwap("key", test.old, test.value)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, err, test.want)
+		}
+	}
+	if value, _, err := store.Get("key"); err != nil || string(value) != "d" {
+		t.Errorf("got %q, %v, want %q", value, err, "d")
+	}
+
+	if _, err := store.Add("key", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := store.Get("key"); err != nil || exists {
+		t.Errorf("got a deleted key, %v", err)
+	}
+	if count, err := store.Add("key", 0); err != nil || count != 0 {
+		t.Errorf("got %d, %v for a deleted counter, want 0", count, err)
+	}
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestControlRankZeroLeft(t *testing.T) {
+	c := newComm(1, 2, make([]string, 2), "", connectOptions{})
+	replies := make(chan controlReply, 1)
+	c.control.pending = map[int32]chan controlReply{7: replies}
+
+	c.leave(0, "instance terminated")
+	reply := <-replies
+	if !strings.Contains(reply.Error, "rank 0 left") {
+		t.Errorf("got error %q, want one about rank 0 leaving", reply.Error)
+	}
+	if len(c.control.pending) != 0 {
+		t.Errorf("%d requests still wait for a reply", len(c.control.pending))
+	}
+}
@@ -0,0 +1,234 @@
+// mpi/encryption.go
+// This file encrypts the frames ranks exchange when the job has a payload key, for
+// clusters where managing TLS certificates is not an option. awsmpirun generates a
+// random 256-bit key for every job run with --encrypt-payloads and stores it as an SSM
+// SecureString parameter, which each rank reads at Init. Every frame payload on every
+// transport is then sealed with AES-GCM under a random nonce, with the frame header,
+// the session ID of its stream, and the frame's position on the stream as additional
+// data, so a frame that was altered, replayed, reordered, or sent by a process without
+// the key fails to open and ends the stream. Each end of a stream picks half of its
+// session ID at random and sends it in the clear before any other frame, so frames
+// recorded on one stream do not open on another, even one replayed from its start. The
+// frame header itself (kind, source rank, and tag) is not secret and travels in the
+// clear.
+
+package mpi
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// EnvPayloadKeyParameter names the SSM parameter holding the job's payload key. Frames
+// are sent in the clear when it is not set.
+const EnvPayloadKeyParameter = "MPI_PAYLOAD_KEY_PARAMETER"
+
+// PayloadKeySize is the size of a payload key in bytes, for AES-256
+const PayloadKeySize = 32
+
+// sessionHalfSize is the size of the half of a stream's session ID each end picks
+const sessionHalfSize = 16
+
+// PayloadKeyParameter is the name of the SSM parameter awsmpirun stores the payload
+// key of a job in
+func PayloadKeyParameter(project, jobID string) string {
+	return "/awsmpirun/" + JobPrefix(project, jobID) + "/payload-key"
+}
+
+// NewPayloadKey returns a random payload key, encoded as it is stored in SSM
+func NewPayloadKey() (string, error) {
+	key := make([]byte, PayloadKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// payloadCipherFromEnv reads the payload key named by MPI_PAYLOAD_KEY_PARAMETER, and
+// returns nil when it is not set
+func payloadCipherFromEnv(ctx context.Context) (*payloadCipher, error) {
+	name := os.Getenv(EnvPayloadKeyParameter)
+	if name == "" {
+		return nil, nil
+	}
+	ssmClientCreator := awsManager.SSMClientCreator{}
+	client, err := ssmClientCreator.CreateClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSM client: %v", err)
+	}
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the payload key %s: %v", name, err)
+	}
+	c, err := parsePayloadKey(aws.ToString(output.Parameter.Value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload key %s: %v", name, err)
+	}
+	return c, nil
+}
+
+// payloadCipher seals and opens frame payloads with the job's key
+type payloadCipher struct {
+	aead cipher.AEAD
+}
+
+// parsePayloadKey returns the cipher of a key encoded by NewPayloadKey
+func parsePayloadKey(encoded string) (*payloadCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != PayloadKeySize {
+		return nil, fmt.Errorf("the key is %d bytes, expected %d", len(key), PayloadKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadCipher{aead: aead}, nil
+}
+
+// additionalData binds a payload to the header of its frame, the session ID of its
+// stream, and its position seq on the stream
+func additionalData(f *frame, session []byte, seq uint64) []byte {
+	ad := make([]byte, frameHeaderSize, frameHeaderSize+len(session)+8)
+	putFrameHeader(ad, f)
+	ad = append(ad, session...)
+	return binary.BigEndian.AppendUint64(ad, seq)
+}
+
+// seal returns the payload of f encrypted as the frame at position seq of the stream
+// with session ID session, preceded by its nonce
+func (c *payloadCipher) seal(f *frame, session []byte, seq uint64) []byte {
+	nonceSize := c.aead.NonceSize()
+	out := make([]byte, nonceSize, nonceSize+len(f.Payload)+c.aead.Overhead())
+	rand.Read(out)
+	return c.aead.Seal(out, out, f.Payload, additionalData(f, session, seq))
+}
+
+// open decrypts the payload of f, received at position seq of the stream with session
+// ID session, in place
+func (c *payloadCipher) open(f *frame, session []byte, seq uint64) error {
+	nonceSize := c.aead.NonceSize()
+	if len(f.Payload) < nonceSize+c.aead.Overhead() {
+		return fmt.Errorf("sealed payload of %d bytes is too short", len(f.Payload))
+	}
+	nonce, sealed := f.Payload[:nonceSize], f.Payload[nonceSize:]
+	plain, err := c.aead.Open(sealed[:0], nonce, sealed, additionalData(f, session, seq))
+	if err != nil {
+		return err
+	}
+	f.Payload = plain
+	return nil
+}
+
+// sealedTransport encrypts the frames of every stream of the transport it wraps
+type sealedTransport struct {
+	transport
+	cipher *payloadCipher
+}
+
+func (t sealedTransport) serve(listener net.Listener, handle func(frameStream) error) {
+	t.transport.serve(listener, func(stream frameStream) error {
+		session, err := startSession(stream, false)
+		if err != nil {
+			return err
+		}
+		return handle(&sealedStream{frameStream: stream, cipher: t.cipher, session: session})
+	})
+}
+
+func (t sealedTransport) dial(ctx context.Context, address string, attempt func(error)) (peerStream, error) {
+	stream, err := t.transport.dial(ctx, address, attempt)
+	if err != nil {
+		return nil, err
+	}
+	session, err := startSession(stream, true)
+	if err != nil {
+		stream.close()
+		return nil, err
+	}
+	return &sealedPeerStream{sealedStream: sealedStream{frameStream: stream, cipher: t.cipher, session: session}, peer: stream}, nil
+}
+
+// startSession sends our half of the session ID of a new stream, picked at random, and
+// returns the whole ID once the peer's half arrives. The dialing end's half comes first.
+func startSession(stream frameStream, dialer bool) ([]byte, error) {
+	ours := make([]byte, sessionHalfSize)
+	if _, err := rand.Read(ours); err != nil {
+		return nil, err
+	}
+	if err := stream.send(&frame{Kind: frameSession, Payload: ours}); err != nil {
+		return nil, fmt.Errorf("failed to start an encrypted session: %v", err)
+	}
+	var theirs frame
+	if err := stream.recv(&theirs); err != nil {
+		return nil, fmt.Errorf("failed to start an encrypted session: %v", err)
+	}
+	if theirs.Kind != frameSession || len(theirs.Payload) != sessionHalfSize {
+		return nil, fmt.Errorf("rank %d did not start an encrypted session, it does not have the job's payload key", theirs.Source)
+	}
+	if dialer {
+		return append(ours, theirs.Payload...), nil
+	}
+	return append(theirs.Payload, ours...), nil
+}
+
+// sealedStream encrypts the frames sent on a stream and decrypts the ones received.
+// Each direction counts its frames, which both ends see in the same order.
+type sealedStream struct {
+	frameStream
+	cipher   *payloadCipher
+	session  []byte // Session ID of the stream, see startSession
+	sent     uint64
+	received uint64
+}
+
+func (s *sealedStream) send(f *frame) error {
+	sealed := *f
+	sealed.Payload = s.cipher.seal(f, s.session, s.sent)
+	s.sent++
+	return s.frameStream.send(&sealed)
+}
+
+func (s *sealedStream) recv(f *frame) error {
+	if err := s.frameStream.recv(f); err != nil {
+		return err
+	}
+	seq := s.received
+	s.received++
+	if err := s.cipher.open(f, s.session, seq); err != nil {
+		return fmt.Errorf("frame %d from rank %d failed to decrypt, the sender does not have the job's payload key or the frame was altered: %v", seq, f.Source, err)
+	}
+	return nil
+}
+
+// sealedPeerStream is a sealedStream on an outgoing stream
+type sealedPeerStream struct {
+	sealedStream
+	peer peerStream
+}
+
+func (s *sealedPeerStream) closeSend() error {
+	return s.peer.closeSend()
+}
+
+func (s *sealedPeerStream) close() {
+	s.peer.close()
+}
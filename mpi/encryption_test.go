@@ -0,0 +1,340 @@
+// mpi/encryption_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCipher returns the cipher of a new random key
+func testCipher(tb testing.TB) *payloadCipher {
+	tb.Helper()
+	key, err := NewPayloadKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c, err := parsePayloadKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestParsePayloadKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr string
+	}{
+		{name: "valid", key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="},
+		{name: "not base64", key: "not a key!", wantErr: "illegal base64"},
+		{name: "AES-128 key", key: "AAECAwQFBgcICQoLDA0ODw==", wantErr: "is 16 bytes, expected 32"},
+		{name: "empty", key: "", wantErr: "is 0 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePayloadKey(tt.key)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("parsePayloadKey() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPayloadKeyParameter(t *testing.T) {
+	if got := PayloadKeyParameter("team-a", "job-1"); got != "/awsmpirun/projects/team-a/jobs/job-1/payload-key" {
+		t.Errorf("PayloadKeyParameter() = %q", got)
+	}
+	if got := PayloadKeyParameter("", "job-1"); got != "/awsmpirun/jobs/job-1/payload-key" {
+		t.Errorf("PayloadKeyParameter() without a project = %q", got)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	c := testCipher(t)
+	session := bytes.Repeat([]byte{1}, 2*sessionHalfSize)
+	other := bytes.Repeat([]byte{2}, 2*sessionHalfSize)
+	sent := frame{Kind: frameData, Source: 3, Tag: 42, Payload: []byte("the secret array")}
+	tests := []struct {
+		name    string
+		tamper  func(f *frame) (*payloadCipher, []byte, uint64)
+		wantErr bool
+	}{
+		{name: "intact", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { return c, session, 7 }},
+		{name: "payload altered", tamper: func(f *frame) (*payloadCipher, []byte, uint64) {
+			f.Payload[len(f.Payload)-1] ^= 1
+			return c, session, 7
+		}, wantErr: true},
+		{name: "tag altered", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { f.Tag = 43; return c, session, 7 }, wantErr: true},
+		{name: "source altered", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { f.Source = 4; return c, session, 7 }, wantErr: true},
+		{name: "replayed later on the stream", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { return c, session, 8 }, wantErr: true},
+		{name: "replayed on another stream", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { return c, other, 7 }, wantErr: true},
+		{name: "other key", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { return testCipher(t), session, 7 }, wantErr: true},
+		{name: "truncated", tamper: func(f *frame) (*payloadCipher, []byte, uint64) { f.Payload = f.Payload[:10]; return c, session, 7 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := sent
+			received.Payload = c.seal(&sent, session, 7)
+			if bytes.Contains(received.Payload, sent.Payload) {
+				t.Fatal("sealed payload contains the plaintext")
+			}
+			opener, session, seq := tt.tamper(&received)
+			err := opener.open(&received, session, seq)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("open() succeeded on a tampered frame: %q", received.Payload)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(received.Payload, sent.Payload) {
+				t.Errorf("open() = %q, %v; want %q", received.Payload, err, sent.Payload)
+			}
+		})
+	}
+}
+
+// startSealedLoopback serves the transport called name under server on a local port
+// and returns the transport under client, the address, and the frames received. The
+// error a stream ended with goes to the returned error channel.
+func startSealedLoopback(tb testing.TB, name string, server, client *payloadCipher) (transport, string, <-chan frame, <-chan error) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	frames := make(chan frame, 16)
+	errs := make(chan error, 1)
+	t := sealedTransport{transport: newTransport(name), cipher: server}
+	t.serve(listener, func(stream frameStream) error {
+		for {
+			var f frame
+			err := stream.recv(&f)
+			if err == io.EOF {
+				return stream.send(&frame{Kind: frameHello, Source: 7, Payload: []byte("bye")})
+			}
+			if err != nil {
+				errs <- err
+				return err
+			}
+			frames <- f
+		}
+	})
+	tb.Cleanup(t.stop)
+	return sealedTransport{transport: newTransport(name), cipher: client}, listener.Addr().String(), frames, errs
+}
+
+func TestSealedTransport(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			c := testCipher(t)
+			tr, address, frames, _ := startSealedLoopback(t, name, c, c)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream, err := tr.dial(ctx, address, func(error) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.close()
+
+			payloads := [][]byte{nil, []byte("hello"), bytes.Repeat([]byte{0xab}, 1<<20)}
+			for i, payload := range payloads {
+				if err := stream.send(&frame{Kind: frameData, Source: 1, Tag: int32(i), Payload: payload}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, payload := range payloads {
+				got := <-frames
+				if got.Tag != int32(i) || !bytes.Equal(got.Payload, payload) {
+					t.Errorf("frame %d = tag %d, %d bytes; want %d bytes", i, got.Tag, len(got.Payload), len(payload))
+				}
+			}
+			if err := stream.closeSend(); err != nil {
+				t.Fatal(err)
+			}
+			var reply frame
+			if err := stream.recv(&reply); err != nil || string(reply.Payload) != "bye" {
+				t.Errorf("reply = %q, %v", reply.Payload, err)
+			}
+		})
+	}
+}
+
+func TestSealedTransportWrongKey(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			tr, address, frames, errs := startSealedLoopback(t, name, testCipher(t), testCipher(t))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream, err := tr.dial(ctx, address, func(error) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.close()
+			if err := stream.send(&frame{Kind: frameHello, Source: 1}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case f := <-frames:
+				t.Fatalf("frame sealed with another key was accepted: %+v", f)
+			case err := <-errs:
+				if !strings.Contains(err.Error(), "does not have the job's payload key") {
+					t.Errorf("stream ended with %v", err)
+				}
+			case <-ctx.Done():
+				t.Fatal("the stream was not ended")
+			}
+		})
+	}
+}
+
+// pipeStream is one end of an in-memory stream
+type pipeStream struct {
+	in  <-chan frame
+	out chan<- frame
+}
+
+func newPipe() (pipeStream, pipeStream) {
+	a, b := make(chan frame, 16), make(chan frame, 16)
+	return pipeStream{in: a, out: b}, pipeStream{in: b, out: a}
+}
+
+func (p pipeStream) send(f *frame) error {
+	sent := *f
+	sent.Payload = bytes.Clone(f.Payload)
+	p.out <- sent
+	return nil
+}
+
+func (p pipeStream) recv(f *frame) error {
+	received, ok := <-p.in
+	if !ok {
+		return io.EOF
+	}
+	*f = received
+	return nil
+}
+
+// connectSealed returns the dialing and accepting ends of a new sealed stream
+func connectSealed(t *testing.T, c *payloadCipher) (*sealedStream, *sealedStream) {
+	t.Helper()
+	dialEnd, serveEnd := newPipe()
+	serverSession := make(chan []byte, 1)
+	go func() {
+		session, err := startSession(serveEnd, false)
+		if err != nil {
+			t.Error(err)
+		}
+		serverSession <- session
+	}()
+	session, err := startSession(dialEnd, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &sealedStream{frameStream: serveEnd, cipher: c, session: <-serverSession}
+	if !bytes.Equal(server.session, session) || len(session) != 2*sessionHalfSize {
+		t.Fatalf("the ends agreed on sessions %x and %x", session, server.session)
+	}
+	return &sealedStream{frameStream: dialEnd, cipher: c, session: session}, server
+}
+
+func TestSealedStreamReplay(t *testing.T) {
+	c := testCipher(t)
+
+	// Record the frames of a stream as they travel
+	first, firstServer := connectSealed(t, c)
+	var recorded []frame
+	for _, payload := range []string{"hello", "the secret array"} {
+		if err := first.send(&frame{Kind: frameData, Source: 1, Payload: []byte(payload)}); err != nil {
+			t.Fatal(err)
+		}
+		var f frame
+		if err := firstServer.frameStream.recv(&f); err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, f)
+	}
+	for i, f := range recorded {
+		f.Payload = bytes.Clone(f.Payload)
+		if err := c.open(&f, firstServer.session, uint64(i)); err != nil {
+			t.Fatalf("recorded frame %d does not open on its own stream: %v", i, err)
+		}
+	}
+
+	// Replay them from the start on a new stream with the same key
+	second, secondServer := connectSealed(t, c)
+	if err := second.frameStream.send(&recorded[0]); err != nil {
+		t.Fatal(err)
+	}
+	var f frame
+	err := secondServer.recv(&f)
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("replayed frame = %q, %v; want it to fail to decrypt", f.Payload, err)
+	}
+}
+
+func TestStartSessionWithoutKey(t *testing.T) {
+	dialEnd, serveEnd := newPipe()
+	// A rank without the key starts with its hello
+	serveEnd.send(&frame{Kind: frameHello, Source: 2, Payload: []byte("10.0.0.2:7000")})
+	if _, err := startSession(dialEnd, true); err == nil || !strings.Contains(err.Error(), "rank 2 did not start an encrypted session") {
+		t.Errorf("startSession() = %v, want an error naming rank 2", err)
+	}
+}
+
+func TestEncryptedWorld(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			c := testCipher(t)
+			comms := startLocalWorldWith(t, 3, name, func(comm *Comm) {
+				comm.eagerLimit = 1024
+				comm.cipher = c
+			})
+			eager, large := []byte("eager"), bytes.Repeat([]byte{0xcd}, 600<<10)
+			var wg sync.WaitGroup
+			for _, comm := range comms[1:] {
+				wg.Add(1)
+				go func(comm *Comm) {
+					defer wg.Done()
+					for _, payload := range [][]byte{eager, large} {
+						if err := comm.Send(0, comm.Rank(), payload); err != nil {
+							t.Errorf("rank %d: Send: %v", comm.Rank(), err)
+						}
+					}
+				}(comm)
+			}
+			for source := 1; source < 3; source++ {
+				for _, want := range [][]byte{eager, large} {
+					got, err := comms[0].Recv(source, source)
+					if err != nil || !bytes.Equal(got, want) {
+						t.Errorf("Recv from rank %d = %d bytes, %v; want %d bytes", source, len(got), err, len(want))
+					}
+				}
+			}
+			wg.Wait()
+			finalizeAll(t, comms)
+		})
+	}
+}
+
+// BenchmarkSeal seals and opens 64 KiB payloads, the default eager limit
+func BenchmarkSeal(b *testing.B) {
+	c := testCipher(b)
+	f := frame{Kind: frameData, Source: 1, Tag: 2, Payload: bytes.Repeat([]byte{0xab}, 64<<10)}
+	b.SetBytes(int64(len(f.Payload)))
+	b.ResetTimer()
+	for i := range b.N {
+		received := f
+		received.Payload = c.seal(&f, nil, uint64(i))
+		if err := c.open(&received, nil, uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
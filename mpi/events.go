@@ -0,0 +1,311 @@
+// mpi/events.go
+// This file delivers cluster lifecycle events to the running program so elastic-aware
+// jobs can rebalance work instead of dying. Events come from three places: the peer
+// streams (a peer joined or went away), the instance metadata service (a spot
+// interruption or rebalance recommendation for this instance), and other ranks, which
+// forward their own interruption notices and scale requests over the peer streams.
+
+package mpi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventKind identifies what happened in the cluster
+type EventKind int
+
+const (
+	EventPeerJoined              EventKind = iota + 1 // A rank connected after Init, e.g. a straggler or a replacement instance
+	EventPeerLeft                                     // A rank's stream ended, either on Finalize or by failure
+	EventSpotInterruption                             // The instance running Rank will be reclaimed at Time
+	EventRebalanceRecommendation                      // The instance running Rank is at elevated risk of interruption
+	EventScaleRequest                                 // A rank asked the job to resize to Size ranks
+	EventAbort                                        // Rank aborted the job; every rank exits on it, see Abort
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventPeerJoined:
+		return "peer-joined"
+	case EventPeerLeft:
+		return "peer-left"
+	case EventSpotInterruption:
+		return "spot-interruption"
+	case EventRebalanceRecommendation:
+		return "rebalance-recommendation"
+	case EventScaleRequest:
+		return "scale-request"
+	case EventAbort:
+		return "abort"
+	}
+	return fmt.Sprintf("event-%d", int(k))
+}
+
+// Event is a change in the cluster the job may want to react to
+type Event struct {
+	Kind   EventKind
+	Rank   int       // Rank the event concerns
+	Time   time.Time // When the event was observed; for spot interruptions, when the instance is reclaimed
+	Size   int       // Requested world size, for EventScaleRequest
+	Detail string    // Interruption action, or why a peer left
+}
+
+const (
+	eventBufferSize      = 64
+	imdsTokenTTL         = 6 * time.Hour
+	imdsRequestTimeout   = 2 * time.Second
+	spotInstanceAction   = "/latest/meta-data/spot/instance-action"
+	rebalanceNoticeEvent = "/latest/meta-data/events/recommendations/rebalance"
+)
+
+// Where the instance metadata service listens, and how often it is polled for
+// interruption notices; tests point them at a fake service and poll faster
+var (
+	imdsAddress       = "http://169.254.169.254"
+	spotWatchInterval = 5 * time.Second
+)
+
+// Events subscribes to the events of the world communicator. It returns nil before Init.
+func Events() <-chan Event {
+	c := World()
+	if c == nil {
+		return nil
+	}
+	return c.Events()
+}
+
+// Events returns a new subscription to the communicator's events. Every subscriber
+// sees every event; a subscriber that falls more than eventBufferSize events behind
+// loses the oldest ones. The channel is closed by Finalize.
+func (c *Comm) Events() <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.eventsClosed {
+		close(ch)
+		return ch
+	}
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+// RequestScale asks every rank, including the caller, to resize the job to size ranks.
+// The runtime only delivers the request; acting on it is up to the program.
+func (c *Comm) RequestScale(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid scale request to %d ranks", size)
+	}
+	return c.broadcastEvent(Event{Kind: EventScaleRequest, Rank: c.rank, Time: time.Now(), Size: size})
+}
+
+// publish hands e to every subscriber without blocking the caller
+func (c *Comm) publish(e Event) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.eventsClosed {
+		return
+	}
+
+	switch e.Kind {
+	case EventPeerLeft:
+		if c.peerLeft[e.Rank] {
+			return
+		}
+		c.peerLeft[e.Rank] = true
+	case EventPeerJoined:
+		delete(c.peerLeft, e.Rank)
+	}
+
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// Drop the oldest event to make room
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+// broadcastEvent publishes e locally and forwards it to every peer
+func (c *Comm) broadcastEvent(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	c.publish(e)
+
+	var firstErr error
+	for dest := 0; dest < c.size; dest++ {
+		if dest == c.rank {
+			continue
+		}
+		err := c.sendFrame(dest, &frame{Kind: frameEvent, Source: int32(c.rank), Payload: payload})
+		if errors.Is(err, ErrNotConnected) {
+			continue
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// receiveEvent publishes an event forwarded by another rank
+func (c *Comm) receiveEvent(payload []byte) {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return
+	}
+	c.publish(e)
+	if e.Kind == EventAbort {
+		c.receiveAbort(e)
+	}
+}
+
+func (c *Comm) closeEvents() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.eventsClosed {
+		return
+	}
+	c.eventsClosed = true
+	for _, ch := range c.subscribers {
+		close(ch)
+	}
+	c.subscribers = nil
+}
+
+// watchSpotNotices polls the instance metadata service for interruption notices and
+// forwards each one to all ranks once. It returns immediately when not running on EC2.
+func (c *Comm) watchSpotNotices() {
+	defer c.watchers.Done()
+
+	// Cancel in-flight metadata requests as soon as the communicator is finalized
+	ctx, cancel := c.doneContext()
+	defer cancel()
+
+	imds := &imdsClient{ctx: ctx, http: &http.Client{Timeout: imdsRequestTimeout}}
+	if _, err := imds.token(); err != nil {
+		return
+	}
+
+	var interruptionSeen, rebalanceSeen bool
+	ticker := time.NewTicker(spotWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		if !interruptionSeen {
+			if body, ok := imds.get(spotInstanceAction); ok {
+				var notice struct {
+					Action string    `json:"action"`
+					Time   time.Time `json:"time"`
+				}
+				if json.Unmarshal(body, &notice) == nil {
+					interruptionSeen = true
+					c.broadcastEvent(Event{Kind: EventSpotInterruption, Rank: c.rank, Time: notice.Time, Detail: notice.Action})
+				}
+			}
+		}
+		if !rebalanceSeen {
+			if _, ok := imds.get(rebalanceNoticeEvent); ok {
+				rebalanceSeen = true
+				c.broadcastEvent(Event{Kind: EventRebalanceRecommendation, Rank: c.rank, Time: time.Now()})
+			}
+		}
+		if interruptionSeen && rebalanceSeen {
+			return
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// imdsClient reads instance metadata using IMDSv2 session tokens
+type imdsClient struct {
+	ctx     context.Context
+	http    *http.Client
+	value   string
+	expires time.Time
+}
+
+func (m *imdsClient) token() (string, error) {
+	if m.value != "" && time.Now().Before(m.expires) {
+		return m.value, nil
+	}
+
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodPut, imdsAddress+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprint(int(imdsTokenTTL.Seconds())))
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata token request returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	m.value = strings.TrimSpace(string(body))
+	m.expires = time.Now().Add(imdsTokenTTL - time.Minute)
+	return m.value, nil
+}
+
+// get returns the metadata at path and whether it exists. Missing entries are the
+// normal case for interruption notices, so errors are treated the same way.
+func (m *imdsClient) get(path string) ([]byte, bool) {
+	token, err := m.token()
+	if err != nil {
+		return nil, false
+	}
+
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, imdsAddress+path, nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+
+	resp, err := m.http.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		m.value = ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
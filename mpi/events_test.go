@@ -0,0 +1,203 @@
+// mpi/events_test.go
+
+package mpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiveAll returns the events waiting in ch
+func receiveAll(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestPublishDropsOldest(t *testing.T) {
+	c := newComm(0, 1, make([]string, 1), "", connectOptions{})
+	events := c.Events()
+
+	const extra = 3
+	for i := 0; i < eventBufferSize+extra; i++ {
+		c.publish(Event{Kind: EventScaleRequest, Size: i})
+	}
+	got := receiveAll(events)
+	if len(got) != eventBufferSize {
+		t.Fatalf("got %d events, want %d", len(got), eventBufferSize)
+	}
+	for i, e := range got {
+		if e.Size != i+extra {
+			t.Fatalf("event %d is the request for %d ranks, want %d", i, e.Size, i+extra)
+		}
+	}
+}
+
+func TestPublishPeerLeft(t *testing.T) {
+	c := newComm(0, 3, make([]string, 3), "", connectOptions{})
+	events := c.Events()
+
+	for _, e := range []Event{
+		{Kind: EventPeerLeft, Rank: 1},
+		{Kind: EventPeerLeft, Rank: 1}, // The same departure, seen again
+		{Kind: EventPeerLeft, Rank: 2},
+		{Kind: EventPeerJoined, Rank: 1},
+		{Kind: EventPeerLeft, Rank: 1}, // A replacement that left again
+	} {
+		c.publish(e)
+	}
+	var got []string
+	for _, e := range receiveAll(events) {
+		got = append(got, fmt.Sprint(e.Kind, " ", e.Rank))
+	}
+	want := []string{"peer-left 1", "peer-left 2", "peer-joined 1", "peer-left 1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	c.closeEvents()
+	c.publish(Event{Kind: EventScaleRequest, Size: 2})
+	if _, open := <-events; open {
+		t.Error("got an event after the subscriptions were closed")
+	}
+}
+
+func TestReceiveEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		want     EventKind // What subscribers get; 0 for nothing
+		wantExit bool
+	}{
+		{name: "scale request", payload: `{"Kind":5,"Rank":1,"Size":8}`, want: EventScaleRequest},
+		{name: "abort", payload: `{"Kind":6,"Rank":1,"Detail":"diverged"}`, want: EventAbort, wantExit: true},
+		{name: "invalid", payload: `{"Kind":`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exits := make(chan int, 1)
+			saved := exit
+			exit = func(code int) { exits <- code }
+			t.Cleanup(func() { exit = saved })
+
+			c := newComm(0, 2, make([]string, 2), "", connectOptions{})
+			events := c.Events()
+			c.receiveEvent([]byte(test.payload))
+
+			got := receiveAll(events)
+			if test.want == 0 && len(got) != 0 || test.want != 0 && (len(got) != 1 || got[0].Kind != test.want) {
+				t.Errorf("got events %v, want %v", got, test.want)
+			}
+			select {
+			case code := <-exits:
+				if !test.wantExit || code != abortExitCode {
+					t.Errorf("exited with status %d", code)
+				}
+			default:
+				if test.wantExit {
+					t.Error("did not exit")
+				}
+			}
+		})
+	}
+}
+
+// fakeIMDS serves instance metadata from paths, which maps each path to the responses
+// of its successive requests; a path out of responses is not found
+func fakeIMDS(t *testing.T, paths map[string][]string) {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+			io.WriteString(w, "token")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		responses := paths[r.URL.Path]
+		if len(responses) > 0 {
+			paths[r.URL.Path] = responses[1:]
+		}
+		mu.Unlock()
+		if len(responses) == 0 || responses[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, responses[0])
+	}))
+	t.Cleanup(server.Close)
+
+	savedAddress, savedInterval := imdsAddress, spotWatchInterval
+	imdsAddress, spotWatchInterval = server.URL, 10*time.Millisecond
+	t.Cleanup(func() { imdsAddress, spotWatchInterval = savedAddress, savedInterval })
+}
+
+func TestWatchSpotNotices(t *testing.T) {
+	reclaimed := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	notice, _ := json.Marshal(map[string]any{"action": "terminate", "time": reclaimed})
+	fakeIMDS(t, map[string][]string{
+		// The notice, then a 404 the watcher must not take as a second one
+		spotInstanceAction: {string(notice)},
+		// No recommendation for a few polls
+		rebalanceNoticeEvent: {"", "", "", `{"noticeTime":"2026-10-15T11:58:00Z"}`},
+	})
+
+	c := newComm(0, 1, make([]string, 1), "", connectOptions{})
+	events := c.Events()
+	c.watchers.Add(1)
+	go c.watchSpotNotices()
+
+	// Having seen both, the watcher stops on its own
+	stopped := make(chan struct{})
+	go func() {
+		c.watchers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		close(c.done)
+		t.Fatal("the watcher did not stop after both notices")
+	}
+
+	got := receiveAll(events)
+	if len(got) != 2 {
+		t.Fatalf("got events %v, want an interruption and a recommendation", got)
+	}
+	if got[0].Kind != EventSpotInterruption || got[0].Detail != "terminate" || !got[0].Time.Equal(reclaimed) {
+		t.Errorf("got %+v, want the interruption at %v", got[0], reclaimed)
+	}
+	if got[1].Kind != EventRebalanceRecommendation {
+		t.Errorf("got %+v, want a rebalance recommendation", got[1])
+	}
+}
+
+func TestWatchSpotNoticesOffEC2(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	saved := imdsAddress
+	imdsAddress = server.URL
+	t.Cleanup(func() { imdsAddress = saved })
+
+	c := newComm(0, 1, make([]string, 1), "", connectOptions{})
+	events := c.Events()
+	c.watchers.Add(1)
+	c.watchSpotNotices()
+	if got := receiveAll(events); len(got) != 0 {
+		t.Errorf("got events %v without a metadata service", got)
+	}
+}
@@ -0,0 +1,127 @@
+// mpi/example_test.go
+
+package mpi_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Every rank connects to its peers with Init and leaves with Finalize
+func ExampleInit() {
+	comm, err := mpi.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer comm.Finalize()
+
+	fmt.Printf("rank %d of %d in job %s\n", comm.Rank(), comm.Size(), mpi.JobID())
+}
+
+// Rank 0 sends raw bytes to rank 1, which waits for them
+func ExampleComm_Send() {
+	comm, err := mpi.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer comm.Finalize()
+
+	const tag = 1
+	switch comm.Rank() {
+	case 0:
+		if err := comm.Send(1, tag, []byte("hello")); err != nil {
+			log.Fatal(err)
+		}
+	case 1:
+		data, err := comm.Recv(0, tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("rank 1 received %q\n", data)
+	}
+}
+
+// Every rank sends its partial sum to rank 0, which adds them up. Values are encoded
+// with the codec registered for their type, gob by default.
+func ExampleComm_SendValue() {
+	comm, err := mpi.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer comm.Finalize()
+
+	const tag = 2
+	partial := float64(comm.Rank() + 1)
+	if comm.Rank() != 0 {
+		if err := comm.SendValue(0, tag, partial); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	total := partial
+	for source := 1; source < comm.Size(); source++ {
+		var v float64
+		if err := comm.RecvValue(source, tag, &v); err != nil {
+			log.Fatal(err)
+		}
+		total += v
+	}
+	fmt.Println("total:", total)
+}
+
+// Every rank contributes its partial sums and receives the totals, without encoding
+// anything itself
+func ExampleAllreduceSum() {
+	comm, err := mpi.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer comm.Finalize()
+
+	partial := []float64{float64(comm.Rank()), 1}
+	total, err := mpi.AllreduceSum(comm, partial)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("rank %d: sum of ranks %v over %v ranks\n", comm.Rank(), total[0], total[1])
+}
+
+// Rank 0 reads the configuration and every rank gets a copy
+func ExampleBroadcastValue() {
+	comm, err := mpi.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer comm.Finalize()
+
+	type config struct {
+		Steps int
+		Mesh  string
+	}
+	var cfg config
+	if comm.Rank() == 0 {
+		cfg = config{Steps: 1000, Mesh: "wing.msh"}
+	}
+	cfg, err = mpi.BroadcastValue(comm, 0, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("rank %d runs %d steps on %s\n", comm.Rank(), cfg.Steps, cfg.Mesh)
+}
+
+// A rank drained by awsmpirun migrate saves its state, and its replacement loads it
+func ExampleLoadCheckpoint() {
+	state, found, err := mpi.LoadCheckpoint()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !found {
+		state = []byte("step=0")
+	}
+	// ... advance the computation, then save where it got to
+	if err := mpi.SaveCheckpoint(state); err != nil {
+		log.Fatal(err)
+	}
+}
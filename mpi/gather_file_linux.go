@@ -0,0 +1,46 @@
+//go:build linux
+
+// mpi/gather_file_linux.go
+// This file maps the file of GatherToFile into memory for writing.
+
+package mpi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile sizes file to size bytes and maps it for writing. The disk space is reserved
+// up front where the file system allows, since a write through the mapping that finds
+// the disk full kills the process instead of failing.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	fd := int(file.Fd())
+	if err := unix.Fallocate(fd, 0, 0, size); errors.Is(err, unix.EOPNOTSUPP) {
+		if err := file.Truncate(size); err != nil {
+			return nil, fmt.Errorf("failed to size %s: %v", file.Name(), err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to reserve %d bytes for %s: %v", size, file.Name(), err)
+	}
+	mapping, err := unix.Mmap(fd, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s: %v", file.Name(), err)
+	}
+	unix.Madvise(mapping, unix.MADV_SEQUENTIAL)
+	return mapping, nil
+}
+
+// unmapFile writes mapping back to its file and unmaps it
+func unmapFile(mapping []byte) error {
+	if err := unix.Msync(mapping, unix.MS_SYNC); err != nil {
+		unix.Munmap(mapping)
+		return err
+	}
+	return unix.Munmap(mapping)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+// mpi/gather_file_other.go
+// This file sizes the file of GatherToFile where it is not memory-mapped; ranks run on
+// Linux, so this only keeps the package building elsewhere.
+
+package mpi
+
+import "os"
+
+// mapFile sizes file to size bytes. The file is written with WriteAt instead of a mapping.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, file.Truncate(size)
+}
+
+func unmapFile(mapping []byte) error {
+	return nil
+}
@@ -0,0 +1,267 @@
+// mpi/gather_stream.go
+// This file implements gathers whose result is larger than root's memory. GatherTo
+// writes the data of every rank to an io.Writer on root, GatherToFile to a file on
+// root's disk through a memory mapping, and GatherToS3 to an object in the job's
+// bucket with a multipart upload. Root learns every rank's size from the rendezvous
+// announcements first, then fetches the ranks one at a time in rank order, and the
+// pieces of a rank's data go to the sink as they come off its stream. Root holds no
+// more than the small payloads sent eagerly and the piece being written; the senders
+// keep their data until root asks for it. A timeout bounds the wait for each rank to
+// join the gather, and for root's acknowledgement; the data itself is only bounded by
+// the context of WithContext, as a large rank takes as long as it takes to arrive.
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// GatherTo writes the data of every rank to w on root, in rank order, and returns the
+// size of each rank's data on root and nil on the other ranks; rank i's data follows
+// the data of the ranks before it. Every rank returns once root has written all of it,
+// so data may be changed afterwards. If a write fails, the rest is received and
+// dropped, and the gather fails on every rank.
+func GatherTo(c *Comm, root int, data []byte, w io.Writer, opts ...MessageOption) ([]int64, error) {
+	return c.gatherStream(root, data, opts, func([]int64) (gatherSink, error) {
+		return writerSink{w}, nil
+	})
+}
+
+// GatherToFile gathers like GatherTo into a new file at path on root, replacing any
+// file there. The file is created at its full size and, on Linux, written through a
+// memory mapping, so the page cache writes it back as it fills. It is synced to disk
+// before GatherToFile returns, and removed if the gather fails.
+func GatherToFile(c *Comm, root int, data []byte, path string, opts ...MessageOption) ([]int64, error) {
+	return c.gatherStream(root, data, opts, func(sizes []int64) (gatherSink, error) {
+		sink, err := createFileSink(path, totalSize(sizes))
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	})
+}
+
+// GatherToS3 gathers like GatherTo into root's result named name, stamped with its
+// provenance like SaveResult, and returns the object's S3 URI on root. The object is
+// uploaded in parts as they fill, so root buffers one part: 8 MiB, or more for gathers
+// that 10000 parts of 8 MiB, the most S3 allows, do not hold.
+func GatherToS3(c *Comm, root int, data []byte, name string, opts ...MessageOption) (string, []int64, error) {
+	var uri string
+	sizes, err := c.gatherStream(root, data, opts, func(sizes []int64) (gatherSink, error) {
+		client, key, err := resultLocation(name)
+		if err != nil {
+			return nil, err
+		}
+		upload, err := client.NewMultipartWriter(context.Background(), key, Provenance(), awsManager.PartSizeFor(totalSize(sizes)))
+		if err != nil {
+			return nil, err
+		}
+		uri = "s3://" + client.Bucket + "/" + key
+		return uploadSink{upload}, nil
+	})
+	if err != nil || c.rank != root {
+		return "", sizes, err
+	}
+	return uri, sizes, nil
+}
+
+// gatherSink is where root writes a streaming gather
+type gatherSink interface {
+	io.Writer
+	// finish completes the sink once everything is written, or discards it if err is set
+	finish(err error) error
+}
+
+// gatherStream runs a streaming gather, opening root's sink once the sizes are known
+func (c *Comm) gatherStream(root int, data []byte, opts []MessageOption, open func(sizes []int64) (gatherSink, error)) ([]int64, error) {
+	if err := c.checkRoot(root); err != nil {
+		return nil, err
+	}
+	call, err := c.collective("gather", opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.rank != root {
+		if err := c.sendStreamed(root, tagGatherStream, data); err != nil {
+			return nil, fmt.Errorf("gather: %w", err)
+		}
+		// Root acknowledges once everything is stored, with the reason if it was not
+		ack, err := call.recv(root, tagGatherStream)
+		if err != nil {
+			return nil, fmt.Errorf("gather: %w", err)
+		}
+		if len(ack) > 0 {
+			return nil, fmt.Errorf("gather: root failed to store the data: %s", ack)
+		}
+		return nil, nil
+	}
+
+	messages := make([]message, c.size)
+	sizes := make([]int64, c.size)
+	for source := range messages {
+		if source == root {
+			sizes[source] = int64(len(data))
+			continue
+		}
+		var msg message
+		err := call.wait(source, func(ctx context.Context) error {
+			var err error
+			msg, err = c.mailbox.take(ctx, source, tagGatherStream)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("gather: %w", err)
+		}
+		messages[source], sizes[source] = msg, msg.size
+		if !msg.rendezvous {
+			sizes[source] = int64(len(msg.payload))
+		}
+	}
+
+	// After a failure the remaining data is still fetched, so no sender holds on to it
+	sink, failed := open(sizes)
+	out := &gatherWriter{w: io.Discard}
+	if failed == nil {
+		out.w = sink
+	}
+	for source, msg := range messages {
+		switch {
+		case source == root:
+			out.Write(data)
+		case !msg.rendezvous:
+			out.Write(msg.payload)
+		default:
+			if err := c.fetchTo(call.ctx, source, tagGatherStream, msg.id, out); err != nil {
+				if sink != nil {
+					sink.finish(err)
+				}
+				return nil, fmt.Errorf("gather: %w", err)
+			}
+		}
+		if failed == nil && out.err != nil {
+			failed = fmt.Errorf("failed to write the data of rank %d: %v", source, out.err)
+		}
+	}
+	if sink != nil {
+		if err := sink.finish(failed); failed == nil {
+			failed = err
+		}
+	}
+
+	var ack []byte
+	if failed != nil {
+		ack = []byte(failed.Error())
+	}
+	for dest := range c.size {
+		if dest == root {
+			continue
+		}
+		if err := c.Send(dest, tagGatherStream, ack); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return nil, fmt.Errorf("gather: %v", failed)
+	}
+	return sizes, nil
+}
+
+// gatherWriter passes writes on until the first failure and drops them afterwards,
+// so it never fails itself
+type gatherWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (g *gatherWriter) Write(p []byte) (int, error) {
+	if g.err == nil {
+		_, g.err = g.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func totalSize(sizes []int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// writerSink is the sink of GatherTo, which leaves closing the writer to its caller
+type writerSink struct {
+	io.Writer
+}
+
+func (writerSink) finish(error) error {
+	return nil
+}
+
+// uploadSink is the sink of GatherToS3
+type uploadSink struct {
+	*awsManager.MultipartWriter
+}
+
+func (s uploadSink) finish(err error) error {
+	if err != nil {
+		return s.Abort()
+	}
+	return s.Close()
+}
+
+// fileSink is the sink of GatherToFile
+type fileSink struct {
+	file    *os.File
+	mapping []byte // The whole file, nil if it is written with WriteAt instead
+	offset  int64
+}
+
+func createFileSink(path string, size int64) (*fileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	mapping, err := mapFile(file, size)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &fileSink{file: file, mapping: mapping}, nil
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	if s.mapping == nil {
+		n, err := s.file.WriteAt(p, s.offset)
+		s.offset += int64(n)
+		return n, err
+	}
+	if int64(len(p)) > int64(len(s.mapping))-s.offset {
+		return 0, fmt.Errorf("write beyond the end of %s", s.file.Name())
+	}
+	s.offset += int64(copy(s.mapping[s.offset:], p))
+	return len(p), nil
+}
+
+func (s *fileSink) finish(err error) error {
+	var syncErr error
+	if s.mapping != nil {
+		syncErr = unmapFile(s.mapping)
+	} else if err == nil {
+		syncErr = s.file.Sync()
+	}
+	closeErr := s.file.Close()
+	if err != nil {
+		os.Remove(s.file.Name())
+		return nil
+	}
+	if syncErr != nil {
+		return fmt.Errorf("failed to sync %s: %v", s.file.Name(), syncErr)
+	}
+	return closeErr
+}
@@ -0,0 +1,252 @@
+// mpi/gather_stream_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gatherPayload is the data rank contributes to a streaming gather of size bytes
+func gatherPayload(rank, size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(rank*31 + i)
+	}
+	return payload
+}
+
+// recordingWriter collects what is written and the size of every write
+type recordingWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes []int
+	failAt int // Fails the write that would take the total past failAt, 0 never fails
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failAt > 0 && w.buf.Len()+len(p) > w.failAt {
+		return 0, errors.New("disk full")
+	}
+	w.writes = append(w.writes, len(p))
+	return w.buf.Write(p)
+}
+
+func TestGatherTo(t *testing.T) {
+	tests := []struct {
+		name       string
+		eagerLimit int
+		sizes      []int // By rank
+		root       int
+	}{
+		{name: "one rank", eagerLimit: defaultEagerLimit, sizes: []int{10}},
+		{name: "small", eagerLimit: defaultEagerLimit, sizes: []int{3, 0, 7}, root: 1},
+		{name: "large", eagerLimit: defaultEagerLimit, sizes: []int{100, 3*sendChunkSize + 5, 0, sendChunkSize + 1}, root: 0},
+		{name: "rendezvous off", eagerLimit: 0, sizes: []int{5, 2*sendChunkSize + 1, sendChunkSize}, root: 2},
+		{name: "eager limit below a chunk", eagerLimit: 1000, sizes: []int{5, 1001, 999}},
+	}
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				comms := startLocalWorld(t, len(tt.sizes), tt.eagerLimit, name)
+				defer finalizeAll(t, comms)
+				var got *recordingWriter
+				checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+					w := &recordingWriter{}
+					sizes, err := GatherTo(c, tt.root, gatherPayload(c.Rank(), tt.sizes[c.Rank()]), w)
+					if err != nil {
+						return err
+					}
+					if c.Rank() != tt.root {
+						if sizes != nil || w.buf.Len() > 0 {
+							return fmt.Errorf("GatherTo() = %v and wrote %d bytes off the root", sizes, w.buf.Len())
+						}
+						return nil
+					}
+					for rank, size := range sizes {
+						if size != int64(tt.sizes[rank]) {
+							return fmt.Errorf("GatherTo() sizes = %v, want %v", sizes, tt.sizes)
+						}
+					}
+					got = w
+					return nil
+				}))
+				var want []byte
+				for rank, size := range tt.sizes {
+					want = append(want, gatherPayload(rank, size)...)
+				}
+				if !bytes.Equal(got.buf.Bytes(), want) {
+					t.Errorf("gathered %d bytes, want %d in rank order", got.buf.Len(), len(want))
+				}
+				// Only the root's own data is written whole, the ranks' pieces as they arrive
+				for i, n := range got.writes {
+					if n > max(sendChunkSize, tt.sizes[tt.root]) {
+						t.Errorf("write %d of the gather took %d bytes at once", i, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGatherToWriteFailure(t *testing.T) {
+	comms := startLocalWorld(t, 3, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	sizes := []int{10, 2 * sendChunkSize, 3 * sendChunkSize}
+	w := &recordingWriter{failAt: 10 + sendChunkSize}
+	errs := onEveryRank(comms, func(c *Comm) error {
+		_, err := GatherTo(c, 0, gatherPayload(c.Rank(), sizes[c.Rank()]), w)
+		return err
+	})
+	wantErr := []string{
+		"gather: failed to write the data of rank 1: disk full",
+		"gather: root failed to store the data: failed to write the data of rank 1",
+		"gather: root failed to store the data",
+	}
+	for rank, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), wantErr[rank]) {
+			t.Errorf("rank %d: error = %v, want one containing %q", rank, err, wantErr[rank])
+		}
+	}
+	if w.buf.Len() != 10+sendChunkSize {
+		t.Errorf("wrote %d bytes, want only those before the failure", w.buf.Len())
+	}
+	// The communicator still works: the rest of the data was received and dropped
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		_, err := AllreduceSum(c, []int{1})
+		return err
+	}))
+}
+
+func TestGatherToFile(t *testing.T) {
+	sizes := []int{sendChunkSize + 3, 0, 2 * sendChunkSize}
+	comms := startLocalWorld(t, len(sizes), defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	path := filepath.Join(t.TempDir(), "gathered.bin")
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		_, err := GatherToFile(c, 1, gatherPayload(c.Rank(), sizes[c.Rank()]), path)
+		return err
+	}))
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for rank, size := range sizes {
+		want = append(want, gatherPayload(rank, size)...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file has %d bytes, want %d in rank order", len(got), len(want))
+	}
+
+	// Nothing at all is an empty file
+	empty := filepath.Join(t.TempDir(), "empty.bin")
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		_, err := GatherToFile(c, 0, nil, empty)
+		return err
+	}))
+	if info, err := os.Stat(empty); err != nil || info.Size() != 0 {
+		t.Errorf("empty gather: %v, %v", info, err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing", "gathered.bin")
+	for rank, err := range onEveryRank(comms, func(c *Comm) error {
+		_, err := GatherToFile(c, 0, gatherPayload(c.Rank(), sendChunkSize+1), missing)
+		return err
+	}) {
+		if err == nil || !strings.Contains(err.Error(), "failed to create") {
+			t.Errorf("rank %d: error = %v, want the file not created", rank, err)
+		}
+	}
+}
+
+func TestMailboxBulkSink(t *testing.T) {
+	m := newMailbox()
+
+	// Registered first, the payload is written as it arrives
+	var streamed bytes.Buffer
+	if _, ok := m.sinkBulk(1, 1, &streamed); ok {
+		t.Fatal("sinkBulk found a payload that never arrived")
+	}
+	m.bulkSinkFor(1, 1).write([]byte("all "))
+	m.bulkSinkFor(1, 1).write([]byte("pieces"))
+	m.finishBulkSink(1, 1)
+	if err := m.waitBulkSink(context.Background(), 1, 7, 1); err != nil || streamed.String() != "all pieces" {
+		t.Errorf("streamed %q, %v", streamed.String(), err)
+	}
+	if m.bulkSinkFor(1, 1) != nil {
+		t.Error("sink still registered after its payload was written")
+	}
+
+	// Arrived before the sink was registered
+	m.deliverBulk(1, 2, []byte("early"))
+	if payload, ok := m.sinkBulk(1, 2, &streamed); !ok || string(payload) != "early" {
+		t.Errorf("sinkBulk() = %q, %v, want the payload that arrived", payload, ok)
+	}
+
+	// Started arriving before the sink was registered, so collected in memory
+	var collected bytes.Buffer
+	m.sinkBulk(1, 3, &collected)
+	go m.deliverBulk(1, 3, []byte("collected"))
+	if err := m.waitBulkSink(context.Background(), 1, 7, 3); err != nil || collected.String() != "collected" {
+		t.Errorf("collected %q, %v", collected.String(), err)
+	}
+
+	var dropped bytes.Buffer
+	m.sinkBulk(1, 4, &dropped)
+	sink := m.bulkSinkFor(1, 4)
+	m.close(ErrFinalized)
+	if err := m.waitBulkSink(context.Background(), 1, 7, 4); !errors.Is(err, ErrFinalized) {
+		t.Errorf("waitBulkSink() after close = %v", err)
+	}
+	sink.write([]byte("late"))
+	if dropped.Len() != 0 {
+		t.Error("a detached sink was written to")
+	}
+}
+
+func TestGatherStreamAnnouncesSizes(t *testing.T) {
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+	var sizes []int64
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		_, err := c.gatherStream(0, make([]byte, 10+c.Rank()*sendChunkSize*2), nil, func(s []int64) (gatherSink, error) {
+			sizes = s
+			return writerSink{&recordingWriter{}}, nil
+		})
+		return err
+	}))
+	if want := []int64{10, 10 + 2*sendChunkSize}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("sink opened with sizes %v, want %v", sizes, want)
+	}
+}
+
+// BenchmarkGatherTo gathers 8 MiB from each of 3 ranks onto rank 0
+func BenchmarkGatherTo(b *testing.B) {
+	comms := startLocalWorld(b, 4, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(b, comms)
+	data := make([]byte, 8<<20)
+	b.SetBytes(int64(3 * len(data)))
+	b.ResetTimer()
+	for range b.N {
+		for rank, err := range onEveryRank(comms, func(c *Comm) error {
+			_, err := GatherTo(c, 0, data, io.Discard)
+			return err
+		}) {
+			if err != nil {
+				b.Fatalf("rank %d: %v", rank, err)
+			}
+		}
+	}
+}
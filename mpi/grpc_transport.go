@@ -0,0 +1,219 @@
+// mpi/grpc_transport.go
+// This file implements the gRPC transport, the default. Every peer stream is a
+// client-streaming call of a gRPC service whose descriptor and codec are written by
+// hand, so the runtime does not need generated protobuf code.
+package mpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/mem"
+)
+
+// Keepalives detect peers whose instance disappeared without closing its connections,
+// such as a reclaimed spot instance, so their streams fail instead of hanging
+var (
+	clientKeepalive      = keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 10 * time.Second, PermitWithoutStream: true}
+	serverKeepalive      = keepalive.ServerParameters{Time: 30 * time.Second, Timeout: 10 * time.Second}
+	keepaliveEnforcement = keepalive.EnforcementPolicy{MinTime: 20 * time.Second, PermitWithoutStream: true}
+)
+
+// frameCodec encodes frames as a fixed header followed by the payload. The payload
+// buffer is handed to gRPC as-is on send and aliased on receive, so raw messages are
+// never copied by the runtime itself.
+type frameCodec struct{}
+
+func (frameCodec) Marshal(v any) (mem.BufferSlice, error) {
+	f, ok := v.(*frame)
+	if !ok {
+		return nil, fmt.Errorf("frame codec cannot marshal %T", v)
+	}
+
+	header := make([]byte, frameHeaderSize)
+	putFrameHeader(header, f)
+
+	out := mem.BufferSlice{mem.SliceBuffer(header)}
+	if len(f.Payload) > 0 {
+		out = append(out, mem.SliceBuffer(f.Payload))
+	}
+	return out, nil
+}
+
+func (frameCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	f, ok := v.(*frame)
+	if !ok {
+		return fmt.Errorf("frame codec cannot unmarshal into %T", v)
+	}
+	if data.Len() < frameHeaderSize {
+		return fmt.Errorf("short frame of %d bytes", data.Len())
+	}
+
+	var raw []byte
+	if len(data) == 1 {
+		// Keep a reference so gRPC never recycles the buffer the payload aliases
+		data.Ref()
+		raw = data[0].ReadOnlyData()
+	} else {
+		raw = data.Materialize()
+	}
+
+	parseFrameHeader(raw, f)
+	f.Payload = raw[frameHeaderSize:]
+	return nil
+}
+
+func (frameCodec) Name() string {
+	return "awsmpirun-frame"
+}
+
+var _ encoding.CodecV2 = frameCodec{}
+
+// exchangeMethod is the full gRPC method name of the peer stream
+const exchangeMethod = "/awsmpirun.Transport/Exchange"
+
+// exchangeServer handles incoming peer streams
+type exchangeServer interface {
+	exchange(stream grpc.ServerStream) error
+}
+
+var transportServiceDesc = grpc.ServiceDesc{
+	ServiceName: "awsmpirun.Transport",
+	HandlerType: (*exchangeServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Exchange",
+			ClientStreams: true,
+			// The receiver answers a resume before the frames, see retry.go
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(exchangeServer).exchange(stream)
+			},
+		},
+	},
+}
+
+// grpcTransport carries peer streams as calls of the Exchange method
+type grpcTransport struct {
+	server *grpc.Server
+	handle func(frameStream) error
+}
+
+func newGRPCTransport() *grpcTransport {
+	return &grpcTransport{
+		server: grpc.NewServer(
+			grpc.ForceServerCodecV2(frameCodec{}),
+			grpc.KeepaliveParams(serverKeepalive),
+			grpc.KeepaliveEnforcementPolicy(keepaliveEnforcement),
+		),
+	}
+}
+
+func (t *grpcTransport) serve(listener net.Listener, handle func(frameStream) error) {
+	t.handle = handle
+	t.server.RegisterService(&transportServiceDesc, t)
+	go t.server.Serve(listener)
+}
+
+func (t *grpcTransport) exchange(stream grpc.ServerStream) error {
+	return t.handle(grpcStream{stream})
+}
+
+func (t *grpcTransport) dial(ctx context.Context, address string, attempt func(error)) (peerStream, error) {
+	// gRPC retries the handshake on its own; the dialer sees every attempt
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		attempt(err)
+		return conn, err
+	}
+
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(frameCodec{})),
+		grpc.WithKeepaliveParams(clientKeepalive),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   5 * time.Second,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			break
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			return nil, errors.New("timed out waiting for handshake")
+		}
+	}
+
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream, err := conn.NewStream(streamCtx, &transportServiceDesc.Streams[0], exchangeMethod)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	return &grpcPeerStream{grpcStream: grpcStream{stream}, client: stream, conn: conn, cancel: cancel}, nil
+}
+
+func (t *grpcTransport) gracefulStop() {
+	t.server.GracefulStop()
+}
+
+func (t *grpcTransport) stop() {
+	t.server.Stop()
+}
+
+// grpcStream adapts either side of a gRPC stream
+type grpcStream struct {
+	stream interface {
+		SendMsg(m any) error
+		RecvMsg(m any) error
+	}
+}
+
+func (s grpcStream) send(f *frame) error {
+	return s.stream.SendMsg(f)
+}
+
+func (s grpcStream) recv(f *frame) error {
+	return s.stream.RecvMsg(f)
+}
+
+// grpcPeerStream is the client side of an Exchange call, on a connection of its own
+type grpcPeerStream struct {
+	grpcStream
+	client grpc.ClientStream
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+}
+
+func (s *grpcPeerStream) closeSend() error {
+	return s.client.CloseSend()
+}
+
+func (s *grpcPeerStream) close() {
+	s.cancel()
+	s.conn.Close()
+}
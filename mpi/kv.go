@@ -0,0 +1,182 @@
+// mpi/kv.go
+// This file provides KV, a small shared key-value store backed by DynamoDB.
+// Ranks use it as a blackboard for counters, cross-job coordination, and
+// small pieces of shared state. Keys are namespaced by job ID so concurrent
+// jobs sharing one table never see each other's entries.
+package mpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	kvValueAttribute   = "Value"
+	kvCounterAttribute = "Counter"
+)
+
+// KVClient is the part of the DynamoDB API a KV calls, which *dynamodb.Client implements
+type KVClient interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// KV is a key-value store shared by all ranks of a job
+type KV struct {
+	client    KVClient
+	table     string
+	namespace string
+}
+
+// NewKV opens the job's key-value store using the table and job ID exported by awsmpirun
+func NewKV(ctx context.Context) (*KV, error) {
+	table := os.Getenv(EnvKVTable)
+	if table == "" {
+		return nil, fmt.Errorf("%s is not set, run awsmpirun with --kv-table", EnvKVTable)
+	}
+
+	jobID := JobID()
+	if jobID == "" {
+		return nil, fmt.Errorf("%s is not set, was the program started by awsmpirun?", EnvJobID)
+	}
+
+	dynamoClientCreator := awsManager.DynamoDBClientCreator{}
+	client, err := dynamoClientCreator.CreateClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DynamoDB client: %v", err)
+	}
+
+	return NewKVWithNamespace(client, table, jobID), nil
+}
+
+// NewKVWithNamespace opens a key-value store on an explicit table and namespace.
+// Jobs that agree on a namespace can use it to share state across job boundaries.
+func NewKVWithNamespace(client KVClient, table, namespace string) *KV {
+	return &KV{client: client, table: table, namespace: namespace}
+}
+
+// Put stores value under key, replacing any previous value
+func (kv *KV) Put(ctx context.Context, key string, value []byte) error {
+	_, err := kv.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(kv.table),
+		Item: map[string]types.AttributeValue{
+			awsManager.KVTableKeyAttribute: kv.keyAttribute(key),
+			kvValueAttribute:               &types.AttributeValueMemberB{Value: value},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put key %s: %v", key, err)
+	}
+	return nil
+}
+
+// Get returns the value stored under key and whether the key exists
+func (kv *KV) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	result, err := kv.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(kv.table),
+		Key: map[string]types.AttributeValue{
+			awsManager.KVTableKeyAttribute: kv.keyAttribute(key),
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get key %s: %v", key, err)
+	}
+	if result.Item == nil {
+		return nil, false, nil
+	}
+
+	value, ok := result.Item[kvValueAttribute].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, false, fmt.Errorf("key %s does not hold a value", key)
+	}
+	return value.Value, true, nil
+}
+
+// CompareAndSwap stores newValue under key only if the current value equals oldValue.
+// A nil oldValue means the key must not exist yet. It reports whether the swap happened.
+func (kv *KV) CompareAndSwap(ctx context.Context, key string, oldValue, newValue []byte) (bool, error) {
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(kv.table),
+		Item: map[string]types.AttributeValue{
+			awsManager.KVTableKeyAttribute: kv.keyAttribute(key),
+			kvValueAttribute:               &types.AttributeValueMemberB{Value: newValue},
+		},
+	}
+
+	if oldValue == nil {
+		input.ConditionExpression = aws.String("attribute_not_exists(#k)")
+		input.ExpressionAttributeNames = map[string]string{"#k": awsManager.KVTableKeyAttribute}
+	} else {
+		input.ConditionExpression = aws.String("#v = :old")
+		input.ExpressionAttributeNames = map[string]string{"#v": kvValueAttribute}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":old": &types.AttributeValueMemberB{Value: oldValue},
+		}
+	}
+
+	_, err := kv.client.PutItem(ctx, input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to compare and swap key %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// Delete removes key from the store
+func (kv *KV) Delete(ctx context.Context, key string) error {
+	_, err := kv.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(kv.table),
+		Key: map[string]types.AttributeValue{
+			awsManager.KVTableKeyAttribute: kv.keyAttribute(key),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s: %v", key, err)
+	}
+	return nil
+}
+
+// Add atomically adds delta to the counter stored under key and returns the new value.
+// Counters start at zero; use keys that are not also written with Put.
+func (kv *KV) Add(ctx context.Context, key string, delta int64) (int64, error) {
+	result, err := kv.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(kv.table),
+		Key: map[string]types.AttributeValue{
+			awsManager.KVTableKeyAttribute: kv.keyAttribute(key),
+		},
+		UpdateExpression:         aws.String("ADD #c :delta"),
+		ExpressionAttributeNames: map[string]string{"#c": kvCounterAttribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta": &types.AttributeValueMemberN{Value: strconv.FormatInt(delta, 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to add to counter %s: %v", key, err)
+	}
+
+	counter, ok := result.Attributes[kvCounterAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("counter %s missing from update result", key)
+	}
+	return strconv.ParseInt(counter.Value, 10, 64)
+}
+
+func (kv *KV) keyAttribute(key string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: kv.namespace + "/" + key}
+}
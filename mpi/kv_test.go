@@ -0,0 +1,210 @@
+// mpi/kv_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB keeps the items of one table in memory and evaluates the condition and
+// update expressions KV uses
+type fakeDynamoDB struct {
+	mu     sync.Mutex
+	items  map[string]map[string]types.AttributeValue // By key attribute
+	err    error                                      // Returned by every call when set
+	getCtx context.Context                            // The context of the latest GetItem
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]types.AttributeValue)}
+}
+
+func itemKey(key map[string]types.AttributeValue) string {
+	return key[awsManager.KVTableKeyAttribute].(*types.AttributeValueMemberS).Value
+}
+
+func (d *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	key := itemKey(params.Item)
+	current, exists := d.items[key]
+	switch aws.ToString(params.ConditionExpression) {
+	case "":
+	case "attribute_not_exists(#k)":
+		if exists {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	case "#v = :old":
+		value, ok := current[kvValueAttribute].(*types.AttributeValueMemberB)
+		old := params.ExpressionAttributeValues[":old"].(*types.AttributeValueMemberB)
+		if !ok || !bytes.Equal(value.Value, old.Value) {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	default:
+		return nil, errors.New("unexpected condition " + aws.ToString(params.ConditionExpression))
+	}
+	d.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *fakeDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.getCtx = ctx
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &dynamodb.GetItemOutput{Item: d.items[itemKey(params.Key)]}, nil
+}
+
+func (d *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	delete(d.items, itemKey(params.Key))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (d *fakeDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if aws.ToString(params.UpdateExpression) != "ADD #c :delta" {
+		return nil, errors.New("unexpected update " + aws.ToString(params.UpdateExpression))
+	}
+	key := itemKey(params.Key)
+	item, ok := d.items[key]
+	if !ok {
+		item = map[string]types.AttributeValue{awsManager.KVTableKeyAttribute: params.Key[awsManager.KVTableKeyAttribute]}
+		d.items[key] = item
+	}
+	var counter int64
+	if n, ok := item[kvCounterAttribute].(*types.AttributeValueMemberN); ok {
+		counter, _ = strconv.ParseInt(n.Value, 10, 64)
+	}
+	delta, _ := strconv.ParseInt(params.ExpressionAttributeValues[":delta"].(*types.AttributeValueMemberN).Value, 10, 64)
+	updated := &types.AttributeValueMemberN{Value: strconv.FormatInt(counter+delta, 10)}
+	item[kvCounterAttribute] = updated
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]types.AttributeValue{kvCounterAttribute: updated}}, nil
+}
+
+func TestKVPutGetDelete(t *testing.T) {
+	ctx := context.Background()
+	kv := NewKVWithNamespace(newFakeDynamoDB(), "kv", "job-1")
+
+	if _, exists, err := kv.Get(ctx, "k"); err != nil || exists {
+		t.Fatalf("got a missing key, %v", err)
+	}
+	if err := kv.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if value, exists, err := kv.Get(ctx, "k"); err != nil || !exists || string(value) != "v" {
+		t.Fatalf("got %q, %v, %v, want %q", value, exists, err, "v")
+	}
+	if err := kv.Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := kv.Get(ctx, "k"); err != nil || exists {
+		t.Fatalf("got a deleted key, %v", err)
+	}
+}
+
+func TestKVNamespaces(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeDynamoDB()
+	a, b := NewKVWithNamespace(client, "kv", "job-1"), NewKVWithNamespace(client, "kv", "job-2")
+
+	if err := a.Put(ctx, "k", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := b.Get(ctx, "k"); err != nil || exists {
+		t.Errorf("job-2 sees the key of job-1, %v", err)
+	}
+	if _, ok := client.items["job-1/k"]; !ok {
+		t.Errorf("got items %v, want job-1/k", client.items)
+	}
+}
+
+func TestKVCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	kv := NewKVWithNamespace(newFakeDynamoDB(), "kv", "job-1")
+
+	tests := []struct {
+		name       string
+		old, value []byte
+		want       bool
+	}{
+		{name: "create", old: nil, value: []byte("a"), want: true},
+		{name: "create an existing key", old: nil, value: []byte("b"), want: false},
+		{name: "stale value", old: []byte("b"), value: []byte("c"), want: false},
+		{name: "current value", old: []byte("a"), value: []byte("c"), want: true},
+	}
+	for _, test := range tests {
+		got, err := kv.CompareAndSwap(ctx, "k", test.old, test.value)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %v, %v, want %v", test.name, got, err, test.want)
+		}
+	}
+	if value, _, err := kv.Get(ctx, "k"); err != nil || string(value) != "c" {
+		t.Errorf("got %q, %v, want %q", value, err, "c")
+	}
+}
+
+func TestKVAdd(t *testing.T) {
+	ctx := context.Background()
+	kv := NewKVWithNamespace(newFakeDynamoDB(), "kv", "job-1")
+
+	for _, step := range []struct{ delta, want int64 }{{1, 1}, {4, 5}, {0, 5}, {-2, 3}} {
+		if got, err := kv.Add(ctx, "c", step.delta); err != nil || got != step.want {
+			t.Errorf("adding %d: got %d, %v, want %d", step.delta, got, err, step.want)
+		}
+	}
+	if _, _, err := kv.Get(ctx, "c"); err == nil {
+		t.Error("got a counter as a value")
+	}
+}
+
+func TestKVErrors(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	client := newFakeDynamoDB()
+	client.err = errors.New("throttled")
+	kv := NewKVWithNamespace(client, "kv", "job-1")
+
+	if _, _, err := kv.Get(ctx, "k"); err == nil {
+		t.Error("Get succeeded")
+	}
+	if client.getCtx != ctx {
+		t.Error("Get did not pass on the caller's context")
+	}
+	if err := kv.Put(ctx, "k", nil); err == nil {
+		t.Error("Put succeeded")
+	}
+	if _, err := kv.CompareAndSwap(ctx, "k", nil, nil); err == nil {
+		t.Error("CompareAndSwap succeeded")
+	}
+	if err := kv.Delete(ctx, "k"); err == nil {
+		t.Error("Delete succeeded")
+	}
+	if _, err := kv.Add(ctx, "k", 1); err == nil {
+		t.Error("Add succeeded")
+	}
+}
@@ -0,0 +1,243 @@
+// mpi/log.go
+// This file provides the rank's structured logger. Every record carries the rank and
+// job ID, the level can differ per rank, and identical messages are rate limited, so a
+// hundred ranks logging in a loop produce a readable log rather than gigabytes of it.
+//
+// MPI_LOG_LEVEL holds a default level and per-rank overrides, for example
+// "warn,0=info,4-7=debug". MPI_LOG_RATE is how many records with the same level and
+// message may be written per window, as "10/10s"; the rest are dropped and counted, and
+// the count is attached as "suppressed" to the next record that gets through. "0"
+// turns rate limiting off.
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables controlling Logger, set by awsmpirun from --log-level and --log-rate
+const (
+	EnvLogLevel = "MPI_LOG_LEVEL"
+	EnvLogRate  = "MPI_LOG_RATE"
+)
+
+const (
+	defaultLogBurst  = 10
+	defaultLogWindow = 10 * time.Second
+	maxRateEntries   = 10000 // Distinct messages tracked before expired ones are pruned
+)
+
+var (
+	loggerOnce sync.Once
+	logger     *slog.Logger
+)
+
+// Logger returns the rank's logger, which writes text records to standard error. It can
+// be used before Init; it reads the rank and job from the environment awsmpirun sets.
+func Logger() *slog.Logger {
+	loggerOnce.Do(func() {
+		var err error
+		logger, err = newLogger(os.Stderr, os.Getenv, time.Now)
+		if err != nil {
+			logger.Warn("ignoring invalid log settings", "error", err)
+		}
+	})
+	return logger
+}
+
+// newLogger builds a logger from the environment. On an invalid setting it still returns
+// a usable logger with that setting at its default, along with the error.
+func newLogger(w io.Writer, getenv func(string) string, now func() time.Time) (*slog.Logger, error) {
+	rank, rankErr := strconv.Atoi(getenv(EnvRank))
+	if rankErr != nil {
+		rank = -1
+	}
+
+	var firstErr error
+	level, err := ParseLogLevel(getenv(EnvLogLevel), rank)
+	if err != nil {
+		level, firstErr = slog.LevelInfo, err
+	}
+	burst, window, err := ParseLogRate(getenv(EnvLogRate))
+	if err != nil {
+		burst, window = defaultLogBurst, defaultLogWindow
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+	if burst > 0 {
+		handler = &rateLimitHandler{next: handler, limiter: &rateLimiter{burst: burst, window: window, now: now, seen: make(map[string]*rateEntry)}}
+	}
+	l := slog.New(handler)
+	if rankErr == nil {
+		l = l.With("rank", rank)
+	}
+	if jobID := getenv(EnvJobID); jobID != "" {
+		l = l.With("job", jobID)
+	}
+	return l, firstErr
+}
+
+// ParseLogLevel returns the level rank logs at under an MPI_LOG_LEVEL spec: a
+// comma-separated list of a default level and RANK=LEVEL or FIRST-LAST=LEVEL overrides.
+// Later entries win. An empty spec means info.
+func ParseLogLevel(spec string, rank int) (slog.Level, error) {
+	level := slog.LevelInfo
+	if strings.TrimSpace(spec) == "" {
+		return level, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		ranks, name, scoped := strings.Cut(entry, "=")
+		if !scoped {
+			name = entry
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return slog.LevelInfo, fmt.Errorf("invalid log level %q in %q", name, spec)
+		}
+		if !scoped {
+			level = l
+			continue
+		}
+		first, last, err := parseRankRange(ranks)
+		if err != nil {
+			return slog.LevelInfo, fmt.Errorf("invalid ranks %q in %q", ranks, spec)
+		}
+		if rank >= first && rank <= last {
+			level = l
+		}
+	}
+	return level, nil
+}
+
+// parseRankRange parses "N" or "A-B"
+func parseRankRange(s string) (int, int, error) {
+	a, b, isRange := strings.Cut(s, "-")
+	first, err := strconv.Atoi(a)
+	if err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("invalid rank %q", a)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(b)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid rank range %q", s)
+	}
+	return first, last, nil
+}
+
+// ParseLogRate parses an MPI_LOG_RATE value, "BURST/WINDOW" or "0" to disable rate limiting.
+// An empty value means the default.
+func ParseLogRate(value string) (int, time.Duration, error) {
+	switch value {
+	case "":
+		return defaultLogBurst, defaultLogWindow, nil
+	case "0":
+		return 0, 0, nil
+	}
+	count, per, ok := strings.Cut(value, "/")
+	burst, err := strconv.Atoi(count)
+	if !ok || err != nil || burst <= 0 {
+		return 0, 0, fmt.Errorf("invalid %s %q, expected COUNT/DURATION such as 10/10s", EnvLogRate, value)
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return 0, 0, fmt.Errorf("invalid %s %q, expected COUNT/DURATION such as 10/10s", EnvLogRate, value)
+	}
+	return burst, window, nil
+}
+
+// rateLimiter counts records per level and message in fixed windows
+type rateLimiter struct {
+	mu     sync.Mutex
+	burst  int
+	window time.Duration
+	now    func() time.Time
+	seen   map[string]*rateEntry
+}
+
+type rateEntry struct {
+	start      time.Time // Start of the current window
+	count      int       // Records written in the window
+	suppressed int       // Records dropped since the last one written
+}
+
+// allow reports whether a record with key may be written, and how many records with
+// the same key were dropped before it
+func (l *rateLimiter) allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	entry := l.seen[key]
+	if entry == nil || now.Sub(entry.start) >= l.window {
+		if entry == nil {
+			if len(l.seen) >= maxRateEntries {
+				l.prune(now)
+			}
+			entry = &rateEntry{}
+			l.seen[key] = entry
+		}
+		entry.start, entry.count = now, 0
+	}
+	if entry.count >= l.burst {
+		entry.suppressed++
+		return false, 0
+	}
+	entry.count++
+	suppressed := entry.suppressed
+	entry.suppressed = 0
+	return true, suppressed
+}
+
+// prune forgets messages whose window has passed
+func (l *rateLimiter) prune(now time.Time) {
+	for key, entry := range l.seen {
+		if now.Sub(entry.start) >= l.window {
+			delete(l.seen, key)
+		}
+	}
+}
+
+// rateLimitHandler drops records once their message has been written burst times in
+// the current window. Loggers derived with With share the limiter of their parent.
+type rateLimitHandler struct {
+	next    slog.Handler
+	limiter *rateLimiter
+}
+
+func (h *rateLimitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *rateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	ok, suppressed := h.limiter.allow(r.Level.String() + "\x00" + r.Message)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *rateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &rateLimitHandler{next: h.next.WithAttrs(attrs), limiter: h.limiter}
+}
+
+func (h *rateLimitHandler) WithGroup(name string) slog.Handler {
+	return &rateLimitHandler{next: h.next.WithGroup(name), limiter: h.limiter}
+}
@@ -0,0 +1,162 @@
+package mpi
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		spec    string
+		rank    int
+		want    slog.Level
+		wantErr bool
+	}{
+		{spec: "", rank: 0, want: slog.LevelInfo},
+		{spec: "debug", rank: 3, want: slog.LevelDebug},
+		{spec: "WARN", rank: 3, want: slog.LevelWarn},
+		{spec: "warn,0=info", rank: 0, want: slog.LevelInfo},
+		{spec: "warn,0=info", rank: 1, want: slog.LevelWarn},
+		{spec: "warn, 4-7=debug", rank: 4, want: slog.LevelDebug},
+		{spec: "warn,4-7=debug", rank: 7, want: slog.LevelDebug},
+		{spec: "warn,4-7=debug", rank: 8, want: slog.LevelWarn},
+		{spec: "2=error,info", rank: 2, want: slog.LevelInfo},
+		{spec: "info+2", rank: 0, want: slog.LevelInfo + 2},
+		{spec: "loud", wantErr: true},
+		{spec: "warn,x=debug", wantErr: true},
+		{spec: "warn,7-4=debug", wantErr: true},
+		{spec: "warn,-1=debug", wantErr: true},
+		{spec: "warn,3=", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLogLevel(tt.spec, tt.rank)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLogLevel(%q, %d) error = %v, wantErr %v", tt.spec, tt.rank, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseLogLevel(%q, %d) = %v, want %v", tt.spec, tt.rank, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogRate(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantBurst  int
+		wantWindow time.Duration
+		wantErr    bool
+	}{
+		{value: "", wantBurst: defaultLogBurst, wantWindow: defaultLogWindow},
+		{value: "0"},
+		{value: "5/1s", wantBurst: 5, wantWindow: time.Second},
+		{value: "100/1m", wantBurst: 100, wantWindow: time.Minute},
+		{value: "5", wantErr: true},
+		{value: "0/1s", wantErr: true},
+		{value: "5/0s", wantErr: true},
+		{value: "five/1s", wantErr: true},
+		{value: "5/soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		burst, window, err := ParseLogRate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLogRate(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if burst != tt.wantBurst || window != tt.wantWindow {
+			t.Errorf("ParseLogRate(%q) = %d, %v, want %d, %v", tt.value, burst, window, tt.wantBurst, tt.wantWindow)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &rateLimiter{burst: 2, window: 10 * time.Second, now: func() time.Time { return now }, seen: make(map[string]*rateEntry)}
+
+	type step struct {
+		advance        time.Duration
+		key            string
+		wantOK         bool
+		wantSuppressed int
+	}
+	steps := []step{
+		{key: "a", wantOK: true},
+		{key: "a", wantOK: true},
+		{key: "a"},
+		{key: "b", wantOK: true},
+		{key: "a"},
+		{advance: 9 * time.Second, key: "a"},
+		{advance: time.Second, key: "a", wantOK: true, wantSuppressed: 3},
+		{key: "a", wantOK: true},
+		{key: "a"},
+		{advance: time.Minute, key: "a", wantOK: true, wantSuppressed: 1},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		ok, suppressed := l.allow(s.key)
+		if ok != s.wantOK || suppressed != s.wantSuppressed {
+			t.Errorf("step %d (%q): allow = %v, %d, want %v, %d", i, s.key, ok, suppressed, s.wantOK, s.wantSuppressed)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	env := map[string]string{
+		EnvRank:     "4",
+		EnvJobID:    "job-1",
+		EnvLogLevel: "warn,4=debug",
+		EnvLogRate:  "2/1h",
+	}
+	var out strings.Builder
+	now := time.Unix(0, 0)
+	logger, err := newLogger(&out, func(name string) string { return env[name] }, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		logger.Debug("step done", "step", i)
+	}
+	now = now.Add(time.Hour)
+	logger.Debug("step done", "step", 5)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), out.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "level=DEBUG") || !strings.Contains(line, "rank=4") || !strings.Contains(line, "job=job-1") {
+			t.Errorf("line lacks level, rank, or job: %s", line)
+		}
+	}
+	if !strings.Contains(lines[2], "step=5") || !strings.Contains(lines[2], "suppressed=3") {
+		t.Errorf("last line = %s, want step 5 with 3 suppressed", lines[2])
+	}
+
+	env[EnvRank] = "1"
+	out.Reset()
+	logger, _ = newLogger(&out, func(name string) string { return env[name] }, time.Now)
+	logger.Info("quiet")
+	logger.Warn("loud")
+	if got := out.String(); strings.Contains(got, "quiet") || !strings.Contains(got, "loud") {
+		t.Errorf("rank 1 at warn wrote:\n%s", got)
+	}
+}
+
+func TestNewLoggerInvalidSettings(t *testing.T) {
+	env := map[string]string{EnvLogLevel: "chatty", EnvLogRate: "lots"}
+	var out strings.Builder
+	logger, err := newLogger(&out, func(name string) string { return env[name] }, time.Now)
+	if err == nil || !strings.Contains(err.Error(), "chatty") {
+		t.Errorf("error = %v, want the invalid level reported", err)
+	}
+	logger.Debug("hidden")
+	logger.Info("shown")
+	if got := out.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown") || strings.Contains(got, "rank=") {
+		t.Errorf("fallback logger wrote:\n%s", got)
+	}
+}
@@ -0,0 +1,243 @@
+// mpi/mailbox.go
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type mailboxKey struct {
+	source int
+	tag    int
+}
+
+type bulkKey struct {
+	source int
+	id     uint32
+}
+
+// message is a queued message. A rendezvous message has only been announced: its
+// payload stays with the sender until Recv asks for it by id, see rendezvous.go.
+type message struct {
+	payload    []byte
+	rendezvous bool
+	id         uint32
+	size       int64 // Size of the announced payload
+}
+
+// bulkSink takes the payload of a rendezvous message piece by piece as it arrives, so
+// the mailbox does not collect it in memory; see gather_stream.go
+type bulkSink struct {
+	w    io.Writer // Never fails, the caller keeps its own errors
+	done bool      // Set once the whole payload was written
+
+	mu       sync.Mutex // Held while writing, so a detached sink is no longer written to
+	detached bool
+}
+
+func (s *bulkSink) write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.detached {
+		s.w.Write(p)
+	}
+}
+
+// detach waits for a write in progress and drops every later one
+func (s *bulkSink) detach() {
+	s.mu.Lock()
+	s.detached = true
+	s.mu.Unlock()
+}
+
+// mailbox holds received messages until Recv asks for them, in arrival order per (source, tag)
+type mailbox struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[mailboxKey][]message
+	bulk   map[bulkKey][]byte    // Payloads of rendezvous messages, by sender and id
+	sinks  map[bulkKey]*bulkSink // Where rendezvous payloads go instead of bulk, by sender and id
+	closed error
+}
+
+func newMailbox() *mailbox {
+	m := &mailbox{
+		queues: make(map[mailboxKey][]message),
+		bulk:   make(map[bulkKey][]byte),
+		sinks:  make(map[bulkKey]*bulkSink),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+func (m *mailbox) deliver(source, tag int, payload []byte) {
+	m.enqueue(source, tag, message{payload: payload})
+}
+
+// announce queues a rendezvous message whose payload the sender holds back
+func (m *mailbox) announce(source, tag int, id uint32, size int64) {
+	m.enqueue(source, tag, message{rendezvous: true, id: id, size: size})
+}
+
+func (m *mailbox) enqueue(source, tag int, msg message) {
+	m.mu.Lock()
+	key := mailboxKey{source: source, tag: tag}
+	m.queues[key] = append(m.queues[key], msg)
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// deliverBulk files the payload of the rendezvous message source announced as id
+func (m *mailbox) deliverBulk(source int, id uint32, payload []byte) {
+	m.mu.Lock()
+	m.bulk[bulkKey{source: source, id: id}] = payload
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// hasBulk reports whether the payload of rendezvous message id from source has arrived
+func (m *mailbox) hasBulk(source int, id uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.bulk[bulkKey{source: source, id: id}]
+	return ok
+}
+
+// takeBulk blocks until the payload of rendezvous message id from source arrives, the
+// mailbox is closed, or ctx is done
+func (m *mailbox) takeBulk(ctx context.Context, source, tag int, id uint32) ([]byte, error) {
+	defer m.wakeOn(ctx)()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := bulkKey{source: source, id: id}
+	for {
+		if payload, ok := m.bulk[key]; ok {
+			delete(m.bulk, key)
+			return payload, nil
+		}
+		if m.closed != nil {
+			return nil, fmt.Errorf("receive from rank %d tag %d: %w", source, tag, m.closed)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("receive from rank %d tag %d: %w", source, tag, err)
+		}
+		m.cond.Wait()
+	}
+}
+
+// sinkBulk registers w to take the payload of rendezvous message id from source as it
+// arrives. A payload that has already arrived is returned instead.
+func (m *mailbox) sinkBulk(source int, id uint32, w io.Writer) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := bulkKey{source: source, id: id}
+	if payload, ok := m.bulk[key]; ok {
+		delete(m.bulk, key)
+		return payload, true
+	}
+	m.sinks[key] = &bulkSink{w: w}
+	return nil, false
+}
+
+// bulkSinkFor returns the sink registered for rendezvous message id from source, or nil
+func (m *mailbox) bulkSinkFor(source int, id uint32) *bulkSink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sinks[bulkKey{source: source, id: id}]
+}
+
+// finishBulkSink marks the payload of rendezvous message id from source as written
+func (m *mailbox) finishBulkSink(source int, id uint32) {
+	m.mu.Lock()
+	if s := m.sinks[bulkKey{source: source, id: id}]; s != nil {
+		s.done = true
+	}
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// waitBulkSink blocks until the sink registered for rendezvous message id from source
+// has taken the whole payload, the mailbox is closed, or ctx is done. A payload that
+// had started arriving before the sink was registered is collected in memory after
+// all, and written to the sink here.
+func (m *mailbox) waitBulkSink(ctx context.Context, source, tag int, id uint32) error {
+	defer m.wakeOn(ctx)()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := bulkKey{source: source, id: id}
+	s := m.sinks[key]
+	defer delete(m.sinks, key)
+	for !s.done {
+		if payload, ok := m.bulk[key]; ok {
+			delete(m.bulk, key)
+			m.mu.Unlock()
+			s.write(payload)
+			m.mu.Lock()
+			return nil
+		}
+		err := m.closed
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			m.mu.Unlock()
+			s.detach()
+			m.mu.Lock()
+			return fmt.Errorf("receive from rank %d tag %d: %w", source, tag, err)
+		}
+		m.cond.Wait()
+	}
+	return nil
+}
+
+// take blocks until a message from source with tag arrives, the mailbox is closed, or
+// ctx is done
+func (m *mailbox) take(ctx context.Context, source, tag int) (message, error) {
+	defer m.wakeOn(ctx)()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := mailboxKey{source: source, tag: tag}
+	for len(m.queues[key]) == 0 {
+		if m.closed != nil {
+			return message{}, fmt.Errorf("receive from rank %d tag %d: %w", source, tag, m.closed)
+		}
+		if err := ctx.Err(); err != nil {
+			return message{}, fmt.Errorf("receive from rank %d tag %d: %w", source, tag, err)
+		}
+		m.cond.Wait()
+	}
+
+	msg := m.queues[key][0]
+	m.queues[key] = m.queues[key][1:]
+	if len(m.queues[key]) == 0 {
+		delete(m.queues, key)
+	}
+	return msg, nil
+}
+
+// wakeOn wakes the blocked receivers once ctx is done, so they can give up. The
+// returned function stops it.
+func (m *mailbox) wakeOn(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		// Under the lock, so the wakeup cannot land between a receiver's check and Wait
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	})
+}
+
+// close wakes up all blocked receivers with err
+func (m *mailbox) close(err error) {
+	m.mu.Lock()
+	if m.closed == nil {
+		m.closed = err
+	}
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
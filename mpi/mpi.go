@@ -0,0 +1,72 @@
+// mpi/mpi.go
+// Package mpi is the runtime library for programs launched by awsmpirun.
+// It reads the rank, world size, and job information that awsmpirun exports
+// on every instance before starting the program.
+package mpi
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Environment variables set by awsmpirun for every rank
+const (
+	EnvRank             = "MPI_RANK"
+	EnvSize             = "MPI_SIZE"
+	EnvJobID            = "MPI_JOB_ID"
+	EnvProject          = "MPI_PROJECT" // Project the job belongs to, which namespaces its S3 keys
+	EnvKVTable          = "MPI_KV_TABLE"
+	EnvBucket           = "MPI_BUCKET"            // Staging bucket, set when the job was started with --bucket
+	EnvAdvertiseAddress = "MPI_ADVERTISE_ADDRESS" // Address peers reach this rank on
+	EnvRestarted        = "MPI_RESTARTED"         // Set to 1 when the rank was restarted by awsmpirun migrate
+)
+
+// Rank returns the rank of the calling process
+func Rank() (int, error) {
+	return intFromEnv(EnvRank)
+}
+
+// Size returns the number of ranks in the job
+func Size() (int, error) {
+	return intFromEnv(EnvSize)
+}
+
+// JobID returns the ID of the job the calling process belongs to
+func JobID() string {
+	return os.Getenv(EnvJobID)
+}
+
+// Project returns the project the job of the calling process belongs to
+func Project() string {
+	return os.Getenv(EnvProject)
+}
+
+// JobPrefix is the S3 prefix all objects of a job live under. Jobs of a project are
+// kept under projects/<project>/ so teams sharing a bucket cannot touch each other's
+// jobs; jobs started without a project use the top-level jobs/ prefix.
+func JobPrefix(project, jobID string) string {
+	if project == "" {
+		return "jobs/" + jobID
+	}
+	return "projects/" + project + "/jobs/" + jobID
+}
+
+// Restarted reports whether this process replaces an earlier incarnation of its rank,
+// in which case it should resume from its checkpoint instead of starting over
+func Restarted() bool {
+	return os.Getenv(EnvRestarted) == "1"
+}
+
+func intFromEnv(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, fmt.Errorf("%s is not set, was the program started by awsmpirun?", name)
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return n, nil
+}
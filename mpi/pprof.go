@@ -0,0 +1,48 @@
+// mpi/pprof.go
+// This file serves a rank's runtime profiles over HTTP when MPI_PPROF_PORT is set, with
+// the same handlers and paths as net/http/pprof. The server listens on localhost only,
+// so the profiles never need an open security group; awsmpirun profile reaches them
+// through an SSM port-forwarding session. It starts before the rank connects to its
+// peers, so a rank stuck in Init can be profiled too.
+
+package mpi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+)
+
+// EnvPprofPort is the localhost port the rank serves its profiles on, set by awsmpirun
+// from --pprof-port
+const EnvPprofPort = "MPI_PPROF_PORT"
+
+// startProfiler serves the profiling endpoints if EnvPprofPort is set and returns the
+// server, or nil when profiling is off
+func startProfiler() (*http.Server, error) {
+	value := os.Getenv(EnvPprofPort)
+	if value == "" {
+		return nil, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid %s %q", EnvPprofPort, value)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve profiles: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
@@ -0,0 +1,69 @@
+package mpi
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStartProfiler(t *testing.T) {
+	port := freePort(t)
+	tests := []struct {
+		name    string
+		value   string
+		wantOn  bool
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "port", value: port, wantOn: true},
+		{name: "not a number", value: "pprof", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "too large", value: "70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvPprofPort, tt.value)
+			server, err := startProfiler()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (server != nil) != tt.wantOn {
+				t.Fatalf("server = %v, want running %v", server, tt.wantOn)
+			}
+			if server == nil {
+				return
+			}
+			defer server.Close()
+
+			resp, err := http.Get("http://127.0.0.1:" + port + "/debug/pprof/goroutine?debug=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+				t.Errorf("goroutine profile: %s\n%s", resp.Status, body)
+			}
+		})
+	}
+}
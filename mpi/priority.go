@@ -0,0 +1,148 @@
+// mpi/priority.go
+// This file keeps control frames from waiting behind large data transfers to the same
+// peer. Every peer has one stream, so frames are written one at a time; a multi-GB
+// message written as one frame would hold the stream for its whole transfer, and a
+// spot interruption notice or a rendezvous clear-to-send queued behind it would sit
+// there as well. Data messages above sendChunkSize are therefore written as a run of
+// chunk frames, and the write lock hands the stream to a waiting control frame before
+// the next chunk. A control frame waits for at most one chunk. Data messages keep
+// their order: the chunks of one message are never interleaved with another's.
+
+package mpi
+
+import "sync"
+
+// sendChunkSize is the largest data frame written at once
+const sendChunkSize = 256 << 10
+
+// isControlFrame reports whether frames of kind jump ahead of data. Announcements of
+// rendezvous messages are data, since they take their place in the receiver's queue.
+func isControlFrame(kind uint8) bool {
+	return kind == frameEvent || kind == frameClearToSend || kind == frameRequest || kind == frameReply
+}
+
+// sendLock serializes writes to a stream, letting control writers go before data
+// writers that are waiting. The zero value is unlocked.
+type sendLock struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	busy           bool
+	waitingControl int
+}
+
+func (l *sendLock) lock(control bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	if control {
+		l.waitingControl++
+		defer func() { l.waitingControl-- }()
+	}
+	for l.busy || (!control && l.waitingControl > 0) {
+		l.cond.Wait()
+	}
+	l.busy = true
+}
+
+func (l *sendLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.busy = false
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+}
+
+// send writes f to the peer, in chunks if it is a large data frame
+func (p *peer) send(f *frame) error {
+	if isControlFrame(f.Kind) {
+		return p.write(f, true)
+	}
+
+	p.dataMu.Lock()
+	defer p.dataMu.Unlock()
+	// The chunks of a rendezvous payload name it, so the receiver can stream them to a
+	// sink as they arrive instead of collecting them, see gather_stream.go
+	kind, tag := frameChunk, int32(0)
+	if f.Kind == frameBulk {
+		kind, tag = frameBulkChunk, f.Tag
+	}
+	payload := f.Payload
+	for len(payload) > sendChunkSize {
+		if err := p.write(&frame{Kind: kind, Source: f.Source, Tag: tag, Payload: payload[:sendChunkSize]}, false); err != nil {
+			return err
+		}
+		payload = payload[sendChunkSize:]
+	}
+	last := *f
+	last.Payload = payload
+	return p.write(&last, false)
+}
+
+// write writes one frame once the stream is free and, for data, the rank's bandwidth
+// limit allows it
+func (p *peer) write(f *frame, control bool) error {
+	if control {
+		p.limiter.spend(frameHeaderSize + len(f.Payload))
+	} else {
+		p.limiter.wait(frameHeaderSize + len(f.Payload))
+		if p.redial != nil {
+			p.replay.waitForSpace()
+		}
+	}
+	p.writer.lock(control)
+	defer p.writer.unlock()
+	if p.closed {
+		return ErrFinalized
+	}
+	if p.broken != nil {
+		return p.broken
+	}
+	p.seq++
+	if p.redial != nil {
+		p.replay.add(p.seq, f)
+	}
+	if err := p.stream.send(f); err != nil {
+		// A resumed stream carries f again
+		if err := p.reconnect(err); err != nil {
+			return err
+		}
+	}
+	if p.traffic != nil {
+		p.traffic.bytes.Add(int64(frameHeaderSize + len(f.Payload)))
+	}
+	return nil
+}
+
+// chunkBuffer collects the chunks of the data message being received on a stream
+type chunkBuffer struct {
+	chunks [][]byte
+	size   int
+}
+
+// empty reports whether no message is being collected
+func (b *chunkBuffer) empty() bool {
+	return len(b.chunks) == 0
+}
+
+func (b *chunkBuffer) add(chunk []byte) {
+	b.chunks = append(b.chunks, chunk)
+	b.size += len(chunk)
+}
+
+// complete returns the whole payload of a message whose last piece is last. A message
+// that came in one frame is returned without a copy.
+func (b *chunkBuffer) complete(last []byte) []byte {
+	if len(b.chunks) == 0 {
+		return last
+	}
+	payload := make([]byte, 0, b.size+len(last))
+	for _, chunk := range b.chunks {
+		payload = append(payload, chunk...)
+	}
+	payload = append(payload, last...)
+	b.chunks, b.size = nil, 0
+	return payload
+}
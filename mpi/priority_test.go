@@ -0,0 +1,189 @@
+// mpi/priority_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStream is a peer stream that records the frames written to it. With block
+// set, the first write waits until release is closed.
+type recordingStream struct {
+	mu      sync.Mutex
+	frames  []frame
+	block   bool
+	blocked chan struct{} // Closed once the first write is waiting
+	release chan struct{}
+}
+
+func newRecordingStream(block bool) *recordingStream {
+	return &recordingStream{block: block, blocked: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (s *recordingStream) send(f *frame) error {
+	s.mu.Lock()
+	first := len(s.frames) == 0
+	s.frames = append(s.frames, frame{Kind: f.Kind, Tag: f.Tag, Payload: f.Payload})
+	s.mu.Unlock()
+	if first && s.block {
+		close(s.blocked)
+		<-s.release
+	}
+	return nil
+}
+
+func (s *recordingStream) recv(*frame) error { return nil }
+func (s *recordingStream) closeSend() error  { return nil }
+func (s *recordingStream) close()            {}
+
+func (s *recordingStream) kinds() []uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kinds []uint8
+	for _, f := range s.frames {
+		kinds = append(kinds, f.Kind)
+	}
+	return kinds
+}
+
+func TestPeerSendChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      uint8
+		size      int
+		wantKinds []uint8
+	}{
+		{name: "small data", kind: frameData, size: 10, wantKinds: []uint8{frameData}},
+		{name: "one chunk exactly", kind: frameData, size: sendChunkSize, wantKinds: []uint8{frameData}},
+		{name: "large data", kind: frameData, size: 2*sendChunkSize + 5, wantKinds: []uint8{frameChunk, frameChunk, frameData}},
+		{name: "large bulk", kind: frameBulk, size: sendChunkSize + 1, wantKinds: []uint8{frameBulkChunk, frameBulk}},
+		{name: "control is never split", kind: frameEvent, size: 2 * sendChunkSize, wantKinds: []uint8{frameEvent}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := newRecordingStream(false)
+			p := &peer{stream: stream}
+			payload := bytes.Repeat([]byte{7}, tt.size)
+			if err := p.send(&frame{Kind: tt.kind, Tag: 9, Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			if got := stream.kinds(); !bytes.Equal(got, tt.wantKinds) {
+				t.Fatalf("frames %v, want %v", got, tt.wantKinds)
+			}
+
+			var chunks chunkBuffer
+			for _, f := range stream.frames[:len(stream.frames)-1] {
+				if f.Kind == frameBulkChunk && f.Tag != 9 {
+					t.Errorf("bulk chunk tagged %d, want the id of its message", f.Tag)
+				}
+				chunks.add(f.Payload)
+			}
+			last := stream.frames[len(stream.frames)-1]
+			if last.Tag != 9 || !bytes.Equal(chunks.complete(last.Payload), payload) {
+				t.Errorf("reassembled message differs from the one sent")
+			}
+		})
+	}
+}
+
+func TestControlOvertakesData(t *testing.T) {
+	stream := newRecordingStream(true)
+	p := &peer{stream: stream}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.send(&frame{Kind: frameData, Payload: make([]byte, 2*sendChunkSize+1)})
+	}()
+	<-stream.blocked
+	go func() {
+		defer wg.Done()
+		p.send(&frame{Kind: frameEvent, Payload: []byte("{}")})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.writer.mu.Lock()
+		waiting := p.writer.waitingControl
+		p.writer.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stream.release)
+	wg.Wait()
+
+	want := []uint8{frameChunk, frameEvent, frameChunk, frameData}
+	if got := stream.kinds(); !bytes.Equal(got, want) {
+		t.Errorf("frames %v, want %v", got, want)
+	}
+}
+
+func TestSendLockOrder(t *testing.T) {
+	// Control writers queued behind each other all go before a data writer
+	var l sendLock
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	l.lock(false)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.lock(true)
+			record("control")
+			l.unlock()
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		waiting := l.waitingControl
+		l.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.lock(false)
+		record("data")
+		l.unlock()
+	}()
+	l.unlock()
+	wg.Wait()
+
+	if want := []string{"control", "control", "data"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order %v, want %v", order, want)
+	}
+}
+
+func TestLargeMessages(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), sendChunkSize/3)
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		for _, eagerLimit := range []int{0, 1024} {
+			comms := startLocalWorld(t, 2, eagerLimit, name)
+			if err := comms[0].Send(1, 1, payload); err != nil {
+				t.Fatal(err)
+			}
+			got, err := comms[1].Recv(0, 1)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("%s, eager limit %d: got %d bytes, %v", name, eagerLimit, len(got), err)
+			}
+			finalizeAll(t, comms)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// mpi/provenance.go
+// This file stamps the objects a rank uploads with where they came from. Every result
+// and checkpoint carries S3 user metadata naming the job, the rank, the sha256 of the
+// program that wrote it, and the job's run manifest, so awsmpirun provenance can trace
+// any output file back to the run, code version, and inputs that produced it.
+
+package mpi
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// EnvProgramSHA256 holds the sha256 of the program, set when awsmpirun could hash it
+const EnvProgramSHA256 = "MPI_PROGRAM_SHA256"
+
+// S3 user metadata keys of the objects a rank uploads
+const (
+	MetaJobID         = "awsmpirun-job-id"
+	MetaProject       = "awsmpirun-project"
+	MetaRank          = "awsmpirun-rank"
+	MetaProgramSHA256 = "awsmpirun-program-sha256"
+	MetaManifest      = "awsmpirun-manifest"
+)
+
+// RunManifestKey is the S3 key of a job's run manifest, job.yaml
+func RunManifestKey(project, jobID string) string {
+	return JobPrefix(project, jobID) + "/job.yaml"
+}
+
+// ResultKey is the S3 key a result named name of rank in job is saved under
+func ResultKey(project, jobID string, rank int, name string) string {
+	return fmt.Sprintf("%s/results/rank-%d/%s", JobPrefix(project, jobID), rank, name)
+}
+
+// Provenance returns the metadata that identifies the calling rank's uploads, for
+// programs that upload objects with their own S3 client
+func Provenance() map[string]string {
+	return provenance(os.Getenv)
+}
+
+func provenance(getenv func(string) string) map[string]string {
+	metadata := make(map[string]string)
+	jobID := getenv(EnvJobID)
+	if jobID == "" {
+		return metadata
+	}
+	metadata[MetaJobID] = jobID
+	project := getenv(EnvProject)
+	if project != "" {
+		metadata[MetaProject] = project
+	}
+	if rank := getenv(EnvRank); rank != "" {
+		metadata[MetaRank] = rank
+	}
+	if hash := getenv(EnvProgramSHA256); hash != "" {
+		metadata[MetaProgramSHA256] = hash
+	}
+	if bucket := getenv(EnvBucket); bucket != "" {
+		metadata[MetaManifest] = "s3://" + bucket + "/" + RunManifestKey(project, jobID)
+	}
+	return metadata
+}
+
+// SaveResult uploads data as the calling rank's result named name, stamped with its
+// provenance, and returns the object's S3 URI
+func SaveResult(name string, data []byte) (string, error) {
+	client, key, err := resultLocation(name)
+	if err != nil {
+		return "", err
+	}
+	if err := client.UploadBytesWithMetadata(context.Background(), data, key, Provenance()); err != nil {
+		return "", err
+	}
+	return "s3://" + client.Bucket + "/" + key, nil
+}
+
+// SaveResultFile uploads the file at path like SaveResult
+func SaveResultFile(name, path string) (string, error) {
+	client, key, err := resultLocation(name)
+	if err != nil {
+		return "", err
+	}
+	if err := client.UploadFileWithMetadata(context.Background(), path, key, Provenance()); err != nil {
+		return "", err
+	}
+	return "s3://" + client.Bucket + "/" + key, nil
+}
+
+func resultLocation(name string) (*awsManager.S3Client, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("result name is empty")
+	}
+	client, err := jobBucket()
+	if err != nil {
+		return nil, "", err
+	}
+	rank, err := Rank()
+	if err != nil {
+		return nil, "", err
+	}
+	return client, ResultKey(Project(), JobID(), rank, name), nil
+}
+
+// jobBucket returns a client for the job's staging bucket
+func jobBucket() (*awsManager.S3Client, error) {
+	bucket := os.Getenv(EnvBucket)
+	if bucket == "" {
+		return nil, fmt.Errorf("%s is not set, run awsmpirun with --bucket", EnvBucket)
+	}
+	if JobID() == "" {
+		return nil, fmt.Errorf("%s is not set, was the program started by awsmpirun?", EnvJobID)
+	}
+	client, err := awsManager.NewS3Client(context.Background(), bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,69 @@
+// mpi/provenance_test.go
+
+package mpi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want map[string]string
+	}{
+		{
+			name: "not started by awsmpirun",
+			env:  map[string]string{EnvRank: "3"},
+			want: map[string]string{},
+		},
+		{
+			name: "without bucket or hash",
+			env:  map[string]string{EnvJobID: "job-1", EnvRank: "3"},
+			want: map[string]string{MetaJobID: "job-1", MetaRank: "3"},
+		},
+		{
+			name: "full",
+			env:  map[string]string{EnvJobID: "job-1", EnvRank: "0", EnvBucket: "staging", EnvProgramSHA256: "abc"},
+			want: map[string]string{
+				MetaJobID:         "job-1",
+				MetaRank:          "0",
+				MetaProgramSHA256: "abc",
+				MetaManifest:      "s3://staging/jobs/job-1/job.yaml",
+			},
+		},
+		{
+			name: "in a project",
+			env:  map[string]string{EnvJobID: "job-1", EnvProject: "team-a", EnvRank: "1", EnvBucket: "staging"},
+			want: map[string]string{
+				MetaJobID:    "job-1",
+				MetaProject:  "team-a",
+				MetaRank:     "1",
+				MetaManifest: "s3://staging/projects/team-a/jobs/job-1/job.yaml",
+			},
+		},
+	}
+	for _, test := range tests {
+		got := provenance(func(name string) string { return test.env[name] })
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: provenance = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJobKeys(t *testing.T) {
+	tests := []struct {
+		name, got, want string
+	}{
+		{"result", ResultKey("", "job-1", 2, "out/grid.dat"), "jobs/job-1/results/rank-2/out/grid.dat"},
+		{"result in a project", ResultKey("team-a", "job-1", 2, "grid.dat"), "projects/team-a/jobs/job-1/results/rank-2/grid.dat"},
+		{"run manifest in a project", RunManifestKey("team-a", "job-1"), "projects/team-a/jobs/job-1/job.yaml"},
+		{"checkpoint in a project", CheckpointKey("team-a", "job-1", 0), "projects/team-a/jobs/job-1/checkpoints/rank-0"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: key = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
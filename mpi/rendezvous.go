@@ -0,0 +1,174 @@
+// mpi/rendezvous.go
+// This file implements the rendezvous protocol for large messages. Messages up to the
+// eager limit are sent at once with their envelope and wait in the receiver's mailbox
+// until Recv, so a burst of large messages nobody has asked for yet piles up in the
+// receiver's memory. Larger messages are only announced: a ready-to-send frame carries
+// the envelope and an id, the sender holds on to the payload, and the receiver asks for
+// it with a clear-to-send frame once a Recv matches the announcement. Send still
+// returns at once, so programs that send before they receive do not deadlock. Payloads
+// still held back at Finalize are pushed without being asked for, so no message is lost
+// to a receiver that has not got to its Recv yet.
+
+package mpi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// EnvEagerLimit is the largest payload in bytes sent eagerly, set by awsmpirun from
+// --eager-limit. Larger messages use the rendezvous protocol; 0 sends every message eagerly.
+const EnvEagerLimit = "MPI_EAGER_LIMIT"
+
+const defaultEagerLimit = 64 << 10
+
+func eagerLimitFromEnv() (int, error) {
+	value := os.Getenv(EnvEagerLimit)
+	if value == "" {
+		return defaultEagerLimit, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", EnvEagerLimit, value)
+	}
+	return n, nil
+}
+
+// rendezvousKey identifies a held-back payload by receiver and id
+type rendezvousKey struct {
+	dest int
+	id   uint32
+}
+
+// sendRendezvous announces data to dest and holds it until dest asks for it
+func (c *Comm) sendRendezvous(dest, tag int, data []byte) error {
+	c.rendezvousMu.Lock()
+	c.nextMessage++
+	key := rendezvousKey{dest: dest, id: c.nextMessage}
+	c.heldBack[key] = data
+	c.rendezvousMu.Unlock()
+
+	announcement := make([]byte, 12)
+	binary.BigEndian.PutUint32(announcement, key.id)
+	binary.BigEndian.PutUint64(announcement[4:], uint64(len(data)))
+	err := c.sendFrame(dest, &frame{Kind: frameReadyToSend, Source: int32(c.rank), Tag: int32(tag), Payload: announcement})
+	if err != nil {
+		c.rendezvousMu.Lock()
+		delete(c.heldBack, key)
+		c.rendezvousMu.Unlock()
+	}
+	return err
+}
+
+// clearToSend transfers the payload source asked for. The transfer runs on its own
+// goroutine: the caller is the loop reading source's stream, and blocking it on a
+// write to source could deadlock two ranks sending large messages to each other.
+func (c *Comm) clearToSend(source int, id uint32) {
+	key := rendezvousKey{dest: source, id: id}
+	c.rendezvousMu.Lock()
+	data, ok := c.heldBack[key]
+	if ok {
+		delete(c.heldBack, key)
+		c.transfers.Add(1)
+	}
+	c.rendezvousMu.Unlock()
+	if !ok {
+		// Already pushed by Finalize
+		return
+	}
+
+	go func() {
+		defer c.transfers.Done()
+		// A failed send reports the receiver as gone, like a failed eager send
+		c.sendFrame(source, &frame{Kind: frameBulk, Source: int32(c.rank), Tag: int32(id), Payload: data})
+	}()
+}
+
+// flushRendezvous pushes every held-back payload to its receiver and waits for the
+// transfers in flight
+func (c *Comm) flushRendezvous() error {
+	c.rendezvousMu.Lock()
+	held := c.heldBack
+	c.heldBack = make(map[rendezvousKey][]byte)
+	c.rendezvousMu.Unlock()
+
+	var firstErr error
+	for key, data := range held {
+		err := c.sendFrame(key.dest, &frame{Kind: frameBulk, Source: int32(c.rank), Tag: int32(key.id), Payload: data})
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to flush messages to rank %d: %v", key.dest, err)
+		}
+	}
+	c.transfers.Wait()
+	return firstErr
+}
+
+// fetch asks source for the payload of rendezvous message id and waits for it until
+// ctx is done
+func (c *Comm) fetch(ctx context.Context, source, tag int, id uint32) ([]byte, error) {
+	// A sender in Finalize pushes its payloads without being asked. If asking fails the
+	// sender may be doing just that, so wait for the payload either way.
+	if !c.mailbox.hasBulk(source, id) {
+		c.sendFrame(source, &frame{Kind: frameClearToSend, Source: int32(c.rank), Tag: int32(id)})
+	}
+	return c.mailbox.takeBulk(ctx, source, tag, id)
+}
+
+// fetchTo asks source for the payload of rendezvous message id and writes it to w
+// piece by piece as it arrives, until ctx is done. w must not fail.
+func (c *Comm) fetchTo(ctx context.Context, source, tag int, id uint32, w io.Writer) error {
+	if payload, ok := c.mailbox.sinkBulk(source, id, w); ok {
+		w.Write(payload)
+		return nil
+	}
+	c.sendFrame(source, &frame{Kind: frameClearToSend, Source: int32(c.rank), Tag: int32(id)})
+	return c.mailbox.waitBulkSink(ctx, source, tag, id)
+}
+
+// streamBulk writes a piece of a rendezvous payload from source to the sink waiting for
+// it and reports whether there was one. A payload that started arriving before its sink
+// was registered is collected in memory to the end.
+func (c *Comm) streamBulk(source int, f *frame, chunks *chunkBuffer) bool {
+	if !chunks.empty() {
+		return false
+	}
+	id := uint32(f.Tag)
+	sink := c.mailbox.bulkSinkFor(source, id)
+	if sink == nil {
+		return false
+	}
+	sink.write(f.Payload)
+	if f.Kind == frameBulk {
+		c.mailbox.finishBulkSink(source, id)
+	}
+	return true
+}
+
+// sendStreamed sends data like sendOwned, but holds back anything larger than one chunk
+// even when the eager limit is higher or off, so dest can stream it with fetchTo
+func (c *Comm) sendStreamed(dest, tag int, data []byte) error {
+	limit := sendChunkSize
+	if c.eagerLimit > 0 {
+		limit = min(limit, c.eagerLimit)
+	}
+	if dest == c.rank || len(data) <= limit {
+		return c.sendOwned(dest, tag, data)
+	}
+	if err := c.sendRendezvous(dest, tag, data); err != nil {
+		return err
+	}
+	c.traffic.messages.Add(1)
+	return nil
+}
+
+// receiveAnnouncement files a ready-to-send frame from source into the mailbox
+func (c *Comm) receiveAnnouncement(source int, f *frame) {
+	if len(f.Payload) != 12 {
+		return
+	}
+	c.mailbox.announce(source, int(f.Tag), binary.BigEndian.Uint32(f.Payload), int64(binary.BigEndian.Uint64(f.Payload[4:])))
+}
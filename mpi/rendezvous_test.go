@@ -0,0 +1,223 @@
+// mpi/rendezvous_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startLocalWorld connects size communicators over the loopback interface
+func startLocalWorld(t testing.TB, size, eagerLimit int, transportName string) []*Comm {
+	t.Helper()
+	return startLocalWorldWith(t, size, transportName, func(c *Comm) { c.eagerLimit = eagerLimit })
+}
+
+// startLocalWorldWith connects size communicators over the loopback interface after
+// calling configure on each of them
+func startLocalWorldWith(t testing.TB, size int, transportName string, configure func(c *Comm)) []*Comm {
+	t.Helper()
+	addresses := make([]string, size)
+	listeners := make([]net.Listener, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i], addresses[i] = listener, listener.Addr().String()
+	}
+
+	comms := make([]*Comm, size)
+	errs := make(chan error, size)
+	for i := range comms {
+		options := connectOptions{Concurrency: size, Timeout: 10 * time.Second, Transport: transportName}
+		comms[i] = newComm(i, size, append([]string(nil), addresses...), addresses[i], options)
+		comms[i].listener = listeners[i]
+		configure(comms[i])
+		go func(c *Comm) { errs <- c.start() }(comms[i])
+	}
+	for range comms {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return comms
+}
+
+// finalizeAll finalizes every communicator; each Finalize waits for the others
+func finalizeAll(t testing.TB, comms []*Comm) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make([]error, len(comms))
+	for i, c := range comms {
+		wg.Add(1)
+		go func(i int, c *Comm) {
+			defer wg.Done()
+			errs[i] = c.Finalize()
+		}(i, c)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("rank %d: Finalize: %v", i, err)
+		}
+	}
+}
+
+// heldBack returns how many payloads c holds for receivers that have not asked yet
+func heldBack(c *Comm) int {
+	c.rendezvousMu.Lock()
+	defer c.rendezvousMu.Unlock()
+	return len(c.heldBack)
+}
+
+func TestEagerLimitFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: defaultEagerLimit},
+		{value: "1024", want: 1024},
+		{value: "0", want: 0},
+		{value: "-1", wantErr: true},
+		{value: "64k", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv(EnvEagerLimit, tt.value)
+		got, err := eagerLimitFromEnv()
+		if (err != nil) != tt.wantErr || got != tt.want && !tt.wantErr {
+			t.Errorf("%q: got %d, %v; want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 100)
+	tests := []struct {
+		name       string
+		eagerLimit int
+		payloads   [][]byte // Sent by rank 0 to rank 1 in order, all with the same tag
+		wantHeld   int      // Payloads rank 0 holds back before rank 1 receives
+	}{
+		{name: "eager", eagerLimit: 64, payloads: [][]byte{small}},
+		{name: "rendezvous", eagerLimit: 64, payloads: [][]byte{large}, wantHeld: 1},
+		{name: "at the limit", eagerLimit: len(large), payloads: [][]byte{large}},
+		{name: "limit off", eagerLimit: 0, payloads: [][]byte{large}},
+		{name: "order kept", eagerLimit: 64, payloads: [][]byte{large, small, large, small}, wantHeld: 2},
+	}
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				comms := startLocalWorld(t, 2, tt.eagerLimit, name)
+				for _, payload := range tt.payloads {
+					if err := comms[0].Send(1, 5, payload); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := heldBack(comms[0]); got != tt.wantHeld {
+					t.Errorf("rank 0 holds %d payloads, want %d", got, tt.wantHeld)
+				}
+				for i, want := range tt.payloads {
+					got, err := comms[1].Recv(0, 5)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("message %d: got %d bytes, want %d", i, len(got), len(want))
+					}
+				}
+				if got := heldBack(comms[0]); got != 0 {
+					t.Errorf("rank 0 still holds %d payloads after they were received", got)
+				}
+				finalizeAll(t, comms)
+			})
+		}
+	}
+}
+
+func TestRendezvousSendBeforeRecv(t *testing.T) {
+	// Both ranks send a large message before receiving; Send must not wait for the match
+	comms := startLocalWorld(t, 2, 16, TransportTCP)
+	payload := bytes.Repeat([]byte{1}, 1<<20)
+	var wg sync.WaitGroup
+	for rank, c := range comms {
+		wg.Add(1)
+		go func(rank int, c *Comm) {
+			defer wg.Done()
+			if err := c.Send(1-rank, 0, payload); err != nil {
+				t.Error(err)
+				return
+			}
+			got, err := c.Recv(1-rank, 0)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("rank %d: got %d bytes, %v", rank, len(got), err)
+			}
+		}(rank, c)
+	}
+	wg.Wait()
+	finalizeAll(t, comms)
+}
+
+func TestRendezvousFlushedAtFinalize(t *testing.T) {
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			comms := startLocalWorld(t, 2, 16, name)
+			payload := bytes.Repeat([]byte{2}, 4096)
+			if err := comms[0].Send(1, 3, payload); err != nil {
+				t.Fatal(err)
+			}
+
+			// Rank 0 finalizes before rank 1 has asked for the message
+			done := make(chan error, 1)
+			go func() { done <- comms[0].Finalize() }()
+			deadline := time.Now().Add(5 * time.Second)
+			for heldBack(comms[0]) > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			got, err := comms[1].Recv(0, 3)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("got %d bytes, %v", len(got), err)
+			}
+			if err := comms[1].Finalize(); err != nil {
+				t.Error(err)
+			}
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMailboxRendezvous(t *testing.T) {
+	m := newMailbox()
+	m.announce(1, 7, 42, 4)
+	m.deliver(1, 7, []byte("eager"))
+
+	msg, err := m.take(context.Background(), 1, 7)
+	if err != nil || !msg.rendezvous || msg.id != 42 || msg.size != 4 || msg.payload != nil {
+		t.Fatalf("first message = %+v, %v; want the announcement", msg, err)
+	}
+	if m.hasBulk(1, 42) {
+		t.Error("payload reported before it arrived")
+	}
+	go m.deliverBulk(1, 42, []byte("bulk"))
+	payload, err := m.takeBulk(context.Background(), 1, 7, 42)
+	if err != nil || string(payload) != "bulk" {
+		t.Errorf("bulk = %q, %v", payload, err)
+	}
+	if msg, err := m.take(context.Background(), 1, 7); err != nil || string(msg.payload) != "eager" {
+		t.Errorf("second message = %+v, %v", msg, err)
+	}
+
+	m.close(ErrFinalized)
+	if _, err := m.takeBulk(context.Background(), 1, 7, 43); err == nil {
+		t.Error("takeBulk returned without an error after close")
+	}
+}
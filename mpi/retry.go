@@ -0,0 +1,339 @@
+// mpi/retry.go
+// This file keeps a peer stream alive across transient faults, such as a connection
+// reset by a NAT gateway or a network blip, instead of reporting the peer as gone. Every
+// frame a rank writes to a peer gets the next sequence number of the connection, and the
+// sender keeps the frames until the receiver acknowledges them, which it does every
+// ackInterval bytes on the same stream; writes wait while replayBufferSize bytes are
+// unacknowledged. When the stream fails, the sender dials the peer again and opens the
+// new stream with a resume frame. The receiver answers with the number of frames it has
+// received, and the sender writes the frames after that again before anything new. The
+// receiver counts frames on every stream of the connection and drops any it has already
+// seen, so every message arrives once and in order. The sender also watches the stream
+// while it is idle, so frames lost in the socket buffers of a stream that died are
+// resent without waiting for the next write. A reset stream may end like a clean one,
+// so a rank that finalizes says so with a last frame, and the receiver only takes the
+// end of a stream that follows it as the peer leaving.
+//
+// The receiver waits MPI_RECONNECT_TIMEOUT for a broken connection to resume before it
+// reports the peer as left, and the sender gives up after the same time, so ranks that
+// are really gone are noticed that much later.
+
+package mpi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// EnvReconnectTimeout is how long a broken peer stream may take to resume, set by
+// awsmpirun from --reconnect-timeout. 0 reports the peer as left at once.
+const EnvReconnectTimeout = "MPI_RECONNECT_TIMEOUT"
+
+const (
+	defaultReconnectTimeout = 30 * time.Second
+	// replayBufferSize is how many bytes of unacknowledged frames a peer keeps before
+	// writes wait for an acknowledgement
+	replayBufferSize = 4 << 20
+	// ackInterval is how many bytes a receiver takes in between acknowledgements
+	ackInterval = replayBufferSize / 4
+	// resumeRetryDelay is the pause before dialing again after a resume failed midway
+	resumeRetryDelay = 100 * time.Millisecond
+)
+
+// errResumeRefused is returned when the receiver no longer has the connection to resume
+var errResumeRefused = errors.New("the peer refused to resume the connection")
+
+func reconnectTimeoutFromEnv() (time.Duration, error) {
+	value := os.Getenv(EnvReconnectTimeout)
+	if value == "" {
+		return defaultReconnectTimeout, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", EnvReconnectTimeout, value)
+	}
+	return d, nil
+}
+
+// replayBuffer holds the frames written to a peer that it has not acknowledged, by
+// sequence number. The zero value is empty.
+type replayBuffer struct {
+	mu       sync.Mutex
+	space    *sync.Cond
+	frames   []frame
+	first    uint64 // Sequence number of frames[0]
+	size     int
+	released bool // Set once the connection failed for good, so nothing waits for space
+}
+
+// waitForSpace waits until the buffer is below replayBufferSize
+func (b *replayBuffer) waitForSpace() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.space == nil {
+		b.space = sync.NewCond(&b.mu)
+	}
+	for b.size >= replayBufferSize && !b.released {
+		b.space.Wait()
+	}
+}
+
+// release wakes every write waiting for space, for good
+func (b *replayBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.released = true
+	if b.space != nil {
+		b.space.Broadcast()
+	}
+}
+
+// add records f, written with sequence number seq
+func (b *replayBuffer) add(seq uint64, f *frame) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.frames) == 0 {
+		b.first = seq
+	}
+	b.frames = append(b.frames, *f)
+	b.size += frameHeaderSize + len(f.Payload)
+}
+
+// acknowledge drops the frames up to the first received
+func (b *replayBuffer) acknowledge(received uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.frames) > 0 && b.first <= received {
+		b.size -= frameHeaderSize + len(b.frames[0].Payload)
+		b.frames[0] = frame{}
+		b.frames = b.frames[1:]
+		b.first++
+	}
+	if b.space != nil {
+		b.space.Broadcast()
+	}
+}
+
+// since returns the frames after the first received, up to sent
+func (b *replayBuffer) since(received, sent uint64) ([]frame, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if received > sent {
+		return nil, fmt.Errorf("the peer received %d frames, but only %d were sent", received, sent)
+	}
+	if received == sent {
+		return nil, nil
+	}
+	if len(b.frames) == 0 || b.first > received+1 {
+		return nil, fmt.Errorf("frames after %d are no longer buffered", received)
+	}
+	return append([]frame(nil), b.frames[received+1-b.first:]...), nil
+}
+
+// inboundState is what the receiving side knows of the connection from one rank, which
+// outlives the streams that carry it
+type inboundState struct {
+	mu        sync.Mutex
+	received  uint64      // Frames received on the connection
+	current   int         // Generation of the stream that owns the connection
+	unacked   int         // Bytes received since the last acknowledgement
+	finalized bool        // Set once the last frame arrived, so the end of the stream is clean
+	chunks    chunkBuffer // Of the message being received, which may span streams
+	lost      bool        // Set under Comm.inboundMu once it can no longer be resumed
+}
+
+// watch reads what the peer sends back on stream, the peer's current one. It trims the
+// replay buffer on every acknowledgement, delivers the peer's answer to Finalize's
+// flush, and reconnects if the stream fails before that.
+func (p *peer) watch(stream peerStream) {
+	var f frame
+	var err error
+	for {
+		err = stream.recv(&f)
+		if err != nil || f.Kind != frameAck || len(f.Payload) != 8 {
+			break
+		}
+		p.replay.acknowledge(binary.BigEndian.Uint64(f.Payload))
+	}
+
+	p.writer.lock(true)
+	defer p.writer.unlock()
+	if p.stream != stream {
+		return
+	}
+	if p.closed {
+		p.acked <- err
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected frame from rank %d", p.rank)
+	}
+	p.reconnect(err)
+}
+
+// reconnect replaces the stream, which failed with cause, by a new stream that resumes
+// it, and returns an error once that is no longer possible. p.writer must be held.
+func (p *peer) reconnect(cause error) error {
+	if p.broken != nil {
+		return p.broken
+	}
+	if p.redial == nil {
+		p.broken = cause
+		return cause
+	}
+	defer func() {
+		if p.broken != nil {
+			p.replay.release()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.reconnectTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		err := p.resume(ctx)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errResumeRefused) || errors.Is(err, ErrFinalized) || ctx.Err() != nil {
+			p.broken = fmt.Errorf("%v, and reconnecting failed: %v", cause, err)
+			return p.broken
+		}
+		select {
+		case <-time.After(resumeRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// resume dials the peer, resends the frames it has not received, and makes the new
+// stream the peer's. p.writer must be held.
+func (p *peer) resume(ctx context.Context) error {
+	stream, err := p.redial(ctx)
+	if err != nil {
+		return err
+	}
+	// A peer that never answers must not outlast the timeout
+	stop := context.AfterFunc(ctx, stream.close)
+	defer stop()
+
+	var reply frame
+	if err := stream.recv(&reply); err != nil {
+		stream.close()
+		return err
+	}
+	if reply.Kind != frameResume || len(reply.Payload) != 8 {
+		stream.close()
+		return errResumeRefused
+	}
+	received := binary.BigEndian.Uint64(reply.Payload)
+	frames, err := p.replay.since(received, p.seq)
+	if err != nil {
+		stream.close()
+		return fmt.Errorf("%w: %v", errResumeRefused, err)
+	}
+	for i := range frames {
+		if err := stream.send(&frames[i]); err != nil {
+			stream.close()
+			return err
+		}
+	}
+
+	p.streamMu.Lock()
+	select {
+	case <-p.done:
+		p.streamMu.Unlock()
+		stream.close()
+		return ErrFinalized
+	default:
+	}
+	old := p.stream
+	p.stream = stream
+	p.streamMu.Unlock()
+	old.close()
+	p.replay.acknowledge(received)
+	go p.watch(stream)
+	return nil
+}
+
+// dialResume opens a stream to target that resumes our connection to it
+func (c *Comm) dialResume(ctx context.Context, target int) (peerStream, error) {
+	stream, err := c.transport.dial(ctx, c.address(target), func(error) {})
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.send(&frame{Kind: frameResume, Source: int32(c.rank), Tag: c.context}); err != nil {
+		stream.close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// resumeInbound takes over the connection from source with stream, which opened with a
+// resume frame, after telling source how many of its frames arrived
+func (c *Comm) resumeInbound(source int, stream frameStream) error {
+	c.inboundMu.Lock()
+	state := c.inbound[source]
+	if state == nil || state.lost {
+		c.inboundMu.Unlock()
+		return stream.send(&frame{Kind: frameResume, Source: int32(c.rank)})
+	}
+	c.inboundGen[source]++
+	gen := c.inboundGen[source]
+	c.inboundMu.Unlock()
+
+	// Streams of the connection that are still open deliver nothing from here on
+	state.mu.Lock()
+	state.current = gen
+	received := state.received
+	state.mu.Unlock()
+
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint64(reply, received)
+	if err := stream.send(&frame{Kind: frameResume, Source: int32(c.rank), Payload: reply}); err != nil {
+		c.streamLost(source, gen, err.Error())
+		return err
+	}
+	return c.receiveFrames(source, gen, state, received, stream)
+}
+
+// streamLost reports that the stream of generation gen from source failed. The peer
+// has the reconnect timeout to resume the connection before it is reported as left.
+func (c *Comm) streamLost(source, gen int, detail string) {
+	if c.reconnectTimeout <= 0 {
+		c.loseInbound(source, gen, detail)
+		return
+	}
+	time.AfterFunc(c.reconnectTimeout, func() {
+		select {
+		case <-c.done:
+		default:
+			c.loseInbound(source, gen, detail)
+		}
+	})
+}
+
+// loseInbound reports source as left, and its connection as beyond resuming, unless a
+// newer stream has taken over from the stream of generation gen
+func (c *Comm) loseInbound(source, gen int, detail string) {
+	c.inboundMu.Lock()
+	current := c.inboundGen[source] == gen
+	if state := c.inbound[source]; current && state != nil {
+		state.lost = true
+	}
+	c.inboundMu.Unlock()
+	if current {
+		c.leave(source, detail)
+	}
+}
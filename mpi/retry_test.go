@@ -0,0 +1,187 @@
+// mpi/retry_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetProxy forwards TCP connections to target, and resets all of them on cut
+type resetProxy struct {
+	listener net.Listener
+	target   string
+	mu       sync.Mutex
+	conns    []*net.TCPConn
+}
+
+func startResetProxy(t *testing.T, target string) *resetProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &resetProxy{listener: listener, target: target}
+	t.Cleanup(func() {
+		listener.Close()
+		p.cut()
+	})
+	go p.serve()
+	return p
+}
+
+func (p *resetProxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, client.(*net.TCPConn), server.(*net.TCPConn))
+		p.mu.Unlock()
+		go forward(server.(*net.TCPConn), client)
+		go forward(client.(*net.TCPConn), server)
+	}
+}
+
+// forward copies from to to, passing on the end of from's stream but not a reset
+func forward(to *net.TCPConn, from net.Conn) {
+	// Hiding the connections from io.Copy keeps it off splice, which reports a
+	// connection closed under it as the end of the stream
+	if _, err := io.Copy(struct{ io.Writer }{to}, struct{ io.Reader }{from}); err == nil {
+		to.CloseWrite()
+	}
+}
+
+// cut resets every connection, as a NAT gateway forgetting them would
+func (p *resetProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.SetLinger(0)
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestSendsSurviveResets(t *testing.T) {
+	const messages = 600
+	for _, transportName := range []string{TransportGRPC, TransportTCP} {
+		t.Run(transportName, func(t *testing.T) {
+			var proxy *resetProxy
+			comms := startLocalWorldWith(t, 2, transportName, func(c *Comm) {
+				c.eagerLimit = 0
+				c.reconnectTimeout = 10 * time.Second
+				if c.rank == 0 {
+					// Only the stream from rank 0 to rank 1 goes through the proxy
+					proxy = startResetProxy(t, c.addresses[1])
+					c.addresses[1] = proxy.listener.Addr().String()
+				}
+			})
+			events := comms[1].Events()
+
+			payload := func(i int) []byte {
+				// Every tenth message spans several chunks
+				size := 64
+				if i%10 == 0 {
+					size = 3*sendChunkSize + 5
+				}
+				data := bytes.Repeat([]byte{byte(i)}, size)
+				binary.BigEndian.PutUint32(data, uint32(i))
+				return data
+			}
+
+			sent := make(chan error, 1)
+			go func() {
+				for i := range messages {
+					if i > 0 && i%150 == 0 {
+						proxy.cut()
+					}
+					if err := comms[0].Send(1, 0, payload(i)); err != nil {
+						sent <- err
+						return
+					}
+				}
+				sent <- nil
+			}()
+
+			for i := range messages {
+				got, err := comms[1].Recv(0, 0)
+				if err != nil {
+					t.Fatalf("receiving message %d: %v", i, err)
+				}
+				if !bytes.Equal(got, payload(i)) {
+					t.Fatalf("message %d: got %d bytes starting with %d, want message %d", i, len(got), binary.BigEndian.Uint32(got), i)
+				}
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case event := <-events:
+				if event.Kind == EventPeerLeft {
+					t.Errorf("rank 0 reported as left after a reset: %s", event.Detail)
+				}
+			default:
+			}
+			finalizeAll(t, comms)
+		})
+	}
+}
+
+func TestReplayBufferSince(t *testing.T) {
+	var b replayBuffer
+	for seq := uint64(1); seq <= 3; seq++ {
+		b.add(seq, &frame{Kind: frameData, Tag: int32(seq)})
+	}
+	frames, err := b.since(1, 3)
+	if err != nil || len(frames) != 2 || frames[0].Tag != 2 || frames[1].Tag != 3 {
+		t.Fatalf("since(1, 3) = %v, %v, want frames 2 and 3", frames, err)
+	}
+	if frames, err := b.since(3, 3); err != nil || len(frames) != 0 {
+		t.Fatalf("since(3, 3) = %v, %v, want nothing", frames, err)
+	}
+	if _, err := b.since(4, 3); err == nil {
+		t.Fatal("since(4, 3) succeeded, want an error")
+	}
+
+	// Acknowledged frames are dropped, and cannot be resent
+	b.acknowledge(2)
+	if _, err := b.since(1, 3); err == nil {
+		t.Fatal("since(1, 3) succeeded after frame 2 was acknowledged, want an error")
+	}
+	if frames, err := b.since(2, 3); err != nil || len(frames) != 1 || frames[0].Tag != 3 {
+		t.Fatalf("since(2, 3) = %v, %v, want frame 3", frames, err)
+	}
+}
+
+func TestReconnectTimeoutFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: defaultReconnectTimeout},
+		{value: "0", want: 0},
+		{value: "5s", want: 5 * time.Second},
+		{value: "-1s", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Setenv(EnvReconnectTimeout, test.value)
+		got, err := reconnectTimeoutFromEnv()
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%q: got %v, %v, want %v, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// mpi/seed.go
+// This file derives reproducible random number generators for the ranks from one
+// job-level seed. awsmpirun exports the seed as MPI_SEED, either the one given with
+// --seed or a random one it prints, so a Monte Carlo run can be repeated exactly by
+// passing the same seed again. Each rank, and each stream within a rank, gets its own
+// seed mixed from the job seed with SplitMix64, so the ranks draw independent sequences
+// without coordinating.
+
+package mpi
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+)
+
+// EnvSeed is the job-level seed, set by awsmpirun
+const EnvSeed = "MPI_SEED"
+
+// JobSeed returns the seed of the job, which is the same on every rank
+func JobSeed() (uint64, error) {
+	value := os.Getenv(EnvSeed)
+	if value == "" {
+		return 0, fmt.Errorf("%s is not set, was the program started by awsmpirun?", EnvSeed)
+	}
+	seed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", EnvSeed, value, err)
+	}
+	return seed, nil
+}
+
+// DeriveSeed returns the seed of generator stream on rank for a job seed. Different
+// ranks and streams get unrelated seeds; the same inputs always give the same seed.
+func DeriveSeed(jobSeed uint64, rank int, stream uint64) uint64 {
+	x := splitMix64(jobSeed)
+	x = splitMix64(x ^ uint64(rank))
+	return splitMix64(x ^ splitMix64(stream))
+}
+
+// NewRand returns the generator for stream on the calling rank. Programs that need
+// several independent sequences per rank, such as one per worker goroutine, pass a
+// different stream for each.
+func NewRand(stream uint64) (*rand.Rand, error) {
+	jobSeed, err := JobSeed()
+	if err != nil {
+		return nil, err
+	}
+	rank, err := Rank()
+	if err != nil {
+		return nil, err
+	}
+	return newRankRand(jobSeed, rank, stream), nil
+}
+
+func newRankRand(jobSeed uint64, rank int, stream uint64) *rand.Rand {
+	seed := DeriveSeed(jobSeed, rank, stream)
+	return rand.New(rand.NewPCG(seed, splitMix64(seed)))
+}
+
+// splitMix64 is the finalizer of the SplitMix64 generator, a bijection that spreads
+// nearby inputs over the whole range
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
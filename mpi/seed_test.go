@@ -0,0 +1,96 @@
+package mpi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJobSeed(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "42", want: 42},
+		{value: "18446744073709551615", want: 1<<64 - 1},
+		{value: "", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "0x10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv(EnvSeed, tt.value)
+		got, err := JobSeed()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("JobSeed() with %q error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("JobSeed() with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveSeedIsDistinct(t *testing.T) {
+	seen := make(map[uint64]string)
+	for _, jobSeed := range []uint64{0, 1, 42} {
+		for rank := 0; rank < 64; rank++ {
+			for stream := uint64(0); stream < 4; stream++ {
+				seed := DeriveSeed(jobSeed, rank, stream)
+				if seed != DeriveSeed(jobSeed, rank, stream) {
+					t.Fatalf("DeriveSeed(%d, %d, %d) is not deterministic", jobSeed, rank, stream)
+				}
+				key := fmt.Sprintf("%d/%d/%d", jobSeed, rank, stream)
+				if other, ok := seen[seed]; ok {
+					t.Fatalf("DeriveSeed(%d, %d, %d) repeats the seed of %q", jobSeed, rank, stream, other)
+				}
+				seen[seed] = key
+			}
+		}
+	}
+}
+
+func TestNewRand(t *testing.T) {
+	draw := func(rank string, stream uint64) []uint64 {
+		t.Setenv(EnvSeed, "7")
+		t.Setenv(EnvRank, rank)
+		r, err := NewRand(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]uint64, 4)
+		for i := range values {
+			values[i] = r.Uint64()
+		}
+		return values
+	}
+	equal := func(a, b []uint64) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	tests := []struct {
+		name      string
+		a, b      []uint64
+		wantEqual bool
+	}{
+		{name: "same rank and stream", a: draw("3", 0), b: draw("3", 0), wantEqual: true},
+		{name: "other rank", a: draw("3", 0), b: draw("4", 0)},
+		{name: "other stream", a: draw("3", 0), b: draw("3", 1)},
+	}
+	for _, tt := range tests {
+		if got := equal(tt.a, tt.b); got != tt.wantEqual {
+			t.Errorf("%s: sequences equal = %v, want %v", tt.name, got, tt.wantEqual)
+		}
+	}
+
+	t.Setenv(EnvSeed, "")
+	if _, err := NewRand(0); err == nil {
+		t.Error("NewRand succeeded without a job seed")
+	}
+}
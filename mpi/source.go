@@ -0,0 +1,13 @@
+// mpi/source.go
+// This file embeds the package's source, including its examples, for awsmpirun docs
+// serve, which renders the API documentation from it on machines without access to
+// pkg.go.dev. Programs that do not reference Source do not carry it.
+
+package mpi
+
+import "embed"
+
+// Source holds the Go files of the package
+//
+//go:embed *.go
+var Source embed.FS
@@ -0,0 +1,237 @@
+// mpi/spawn.go
+// This file lets a running job grow its pool of ranks, like MPI_Comm_spawn. Comm.Spawn
+// uploads the calling program to the job's prefix in the staging bucket with a spawn
+// request; awsmpirun, which watches for requests while the job runs, picks idle
+// instances of the project in the VPC, starts the program on them, and answers with
+// their addresses. The spawning rank and the new ranks then form a communicator of their
+// own, in which the spawning rank is rank 0 and the new ranks are 1 to n. The job's
+// other ranks are not part of it. A spawned rank gets that communicator from Init, as
+// usual, and Spawned reports that it was spawned.
+//
+// The spawning rank serves the new communicator on the port it already serves the world
+// on, since that is the port the security groups open. The hello that starts every
+// stream names the communicator it belongs to with a context, zero for the world, so
+// that one listener can tell the communicators apart.
+
+package mpi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Environment variables of spawning
+const (
+	EnvMaxSpawn     = "MPI_MAX_SPAWN"     // Ranks the job may add with Spawn, set by awsmpirun from --max-spawn-ranks
+	EnvSpawnContext = "MPI_SPAWN_CONTEXT" // Context of the communicator a spawned rank belongs to
+)
+
+// Names of the objects under a spawn's prefix
+const (
+	SpawnRequestObject  = "request.json"
+	SpawnResponseObject = "response.json"
+	SpawnProgramObject  = "program"
+)
+
+const (
+	// spawnPollInterval is how often Spawn looks for the answer to its request
+	spawnPollInterval = 2 * time.Second
+	// spawnTimeout is how long Spawn waits for awsmpirun to start the new ranks
+	spawnTimeout = 10 * time.Minute
+)
+
+// SpawnRequest is what a rank asks awsmpirun for, at SpawnKey(..., SpawnRequestObject)
+type SpawnRequest struct {
+	Ranks   int      `json:"ranks"`          // Ranks to start
+	Args    []string `json:"args,omitempty"` // Arguments of the program on the new ranks
+	Parent  int      `json:"parent"`         // World rank of the spawning rank
+	Address string   `json:"address"`        // Where the new ranks reach the spawning rank
+	Context int32    `json:"context"`        // Context of the new communicator
+}
+
+// SpawnResponse is awsmpirun's answer to a SpawnRequest
+type SpawnResponse struct {
+	Addresses []string `json:"addresses,omitempty"` // Of ranks 1 to n of the new communicator
+	Instances []string `json:"instances,omitempty"` // Instance IDs of ranks 1 to n
+	Error     string   `json:"error,omitempty"`     // Why no ranks were started
+}
+
+// SpawnPrefix is the S3 prefix awsmpirun watches for the spawn requests of a job
+func SpawnPrefix(project, jobID string) string {
+	return JobPrefix(project, jobID) + "/spawn/"
+}
+
+// SpawnKey is the S3 key of object, one of the Spawn*Object names, of spawn id
+func SpawnKey(project, jobID, id, object string) string {
+	return SpawnPrefix(project, jobID) + id + "/" + object
+}
+
+// Spawned reports whether this process was started by Comm.Spawn, in which case rank 0
+// of the communicator Init returns is the rank that spawned it
+func Spawned() bool {
+	return os.Getenv(EnvSpawnContext) != ""
+}
+
+// spawnContextFromEnv returns the context of the communicator Init connects
+func spawnContextFromEnv() (int32, error) {
+	value := os.Getenv(EnvSpawnContext)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid %s %q", EnvSpawnContext, value)
+	}
+	return int32(n), nil
+}
+
+// Spawn starts n more ranks running this program with args, and returns the
+// communicator of the calling rank, as rank 0, and the new ranks, as 1 to n. Only the
+// calling rank takes part; it returns once every new rank is connected. The job must
+// have been started with --bucket and --max-spawn-ranks. The new communicator is
+// finalized on its own, before the one it was spawned from.
+func (c *Comm) Spawn(n int, args ...string) (*Comm, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("cannot spawn %d ranks", n)
+	}
+	if os.Getenv(EnvMaxSpawn) == "" {
+		return nil, fmt.Errorf("%s is not set, run awsmpirun with --max-spawn-ranks", EnvMaxSpawn)
+	}
+	client, err := jobBucket()
+	if err != nil {
+		return nil, err
+	}
+	program, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the program to spawn: %v", err)
+	}
+	return c.spawn(n, args, func(ctx context.Context, req SpawnRequest) ([]string, error) {
+		return requestSpawn(ctx, client, program, req)
+	})
+}
+
+// spawn creates the communicator of n new ranks, which ask returns the addresses of
+func (c *Comm) spawn(n int, args []string, ask func(context.Context, SpawnRequest) ([]string, error)) (*Comm, error) {
+	child := c.newChild(n + 1)
+	// Registered before asking: the new ranks may dial in before the answer arrives
+	defer func() {
+		if !child.running.Load() {
+			c.dropChild(child.context)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), spawnTimeout)
+	defer cancel()
+	addresses, err := ask(ctx, SpawnRequest{Ranks: n, Args: args, Parent: c.rank, Address: c.advertise, Context: child.context})
+	if err != nil {
+		return nil, fmt.Errorf("failed to spawn %d ranks: %w", n, err)
+	}
+	if len(addresses) != n {
+		return nil, fmt.Errorf("failed to spawn %d ranks: got %d addresses", n, len(addresses))
+	}
+	child.peersMu.Lock()
+	copy(child.addresses[1:], addresses)
+	child.peersMu.Unlock()
+
+	if err := child.connect(child.options); err != nil {
+		child.shutdown()
+		return nil, err
+	}
+	child.running.Store(true)
+	return child, nil
+}
+
+// newChild returns the unconnected communicator of a spawn of size ranks, served by c's
+// listener. Its peers share c's limits, cipher, and traffic count.
+func (c *Comm) newChild(size int) *Comm {
+	options := c.options
+	options.MinRanks = 0
+	child := newComm(0, size, make([]string, size), c.advertise, options)
+	child.addresses[0] = c.advertise
+	child.parent = c
+	child.eagerLimit = c.eagerLimit
+	child.reconnectTimeout = c.reconnectTimeout
+	child.collectiveTimeout = c.collectiveTimeout
+	child.timeoutPolicy = c.timeoutPolicy
+	child.limiter = c.limiter
+	child.traffic = c.traffic
+	child.cipher = c.cipher
+	child.transport = newTransport(options.Transport)
+	if child.cipher != nil {
+		child.transport = sealedTransport{transport: child.transport, cipher: child.cipher}
+	}
+
+	c.childrenMu.Lock()
+	defer c.childrenMu.Unlock()
+	if c.children == nil {
+		c.children = make(map[int32]*Comm)
+	}
+	for child.context == 0 || child.context == c.context || c.children[child.context] != nil {
+		child.context = rand.Int32()
+	}
+	c.children[child.context] = child
+	return child
+}
+
+// child returns the communicator c spawned with context id
+func (c *Comm) child(id int32) *Comm {
+	c.childrenMu.Lock()
+	defer c.childrenMu.Unlock()
+	return c.children[id]
+}
+
+func (c *Comm) dropChild(id int32) {
+	c.childrenMu.Lock()
+	delete(c.children, id)
+	c.childrenMu.Unlock()
+}
+
+// requestSpawn uploads program and req to a new spawn prefix, and waits for awsmpirun
+// to answer with the addresses of the new ranks
+func requestSpawn(ctx context.Context, client *awsManager.S3Client, program string, req SpawnRequest) ([]string, error) {
+	id := fmt.Sprintf("rank-%d-%08x", req.Parent, uint32(req.Context))
+	key := func(object string) string { return SpawnKey(Project(), JobID(), id, object) }
+	if err := client.UploadFile(ctx, program, key(SpawnProgramObject)); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	// The request goes last: awsmpirun acts on it as soon as it sees it
+	if err := client.UploadBytes(ctx, data, key(SpawnRequestObject)); err != nil {
+		return nil, err
+	}
+
+	for {
+		data, err := client.DownloadBytes(ctx, key(SpawnResponseObject))
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			if err := awsManager.SleepContext(ctx, spawnPollInterval); err != nil {
+				return nil, fmt.Errorf("no answer to spawn request %s: %w", id, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var resp SpawnResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("invalid answer to spawn request %s: %v", id, err)
+		}
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		return resp.Addresses, nil
+	}
+}
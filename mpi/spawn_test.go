@@ -0,0 +1,138 @@
+// mpi/spawn_test.go
+
+package mpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spawnLocally returns an ask function of Comm.spawn that starts the new ranks over the
+// loopback interface, as awsmpirun would on other instances, and sends their
+// communicators to spawned
+func spawnLocally(t *testing.T, spawned chan<- []*Comm) func(context.Context, SpawnRequest) ([]string, error) {
+	return func(ctx context.Context, req SpawnRequest) ([]string, error) {
+		size := req.Ranks + 1
+		addresses := make([]string, size)
+		addresses[0] = req.Address
+		listeners := make([]net.Listener, size)
+		for i := 1; i < size; i++ {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			listeners[i], addresses[i] = listener, listener.Addr().String()
+		}
+		comms := make([]*Comm, size)
+		errs := make(chan error, size)
+		for i := 1; i < size; i++ {
+			options := connectOptions{Concurrency: size, Timeout: 10 * time.Second, Transport: TransportTCP}
+			comms[i] = newComm(i, size, append([]string(nil), addresses...), addresses[i], options)
+			comms[i].context = req.Context
+			comms[i].listener = listeners[i]
+			go func(c *Comm) { errs <- c.start() }(comms[i])
+		}
+		go func() {
+			for i := 1; i < size; i++ {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+			spawned <- comms[1:]
+		}()
+		return addresses[1:], nil
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	world := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	spawned := make(chan []*Comm, 1)
+	child, err := world[1].spawn(2, []string{"--worker"}, spawnLocally(t, spawned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := <-spawned
+	if child.Rank() != 0 || child.Size() != 3 {
+		t.Fatalf("spawning rank is %d of %d, want 0 of 3", child.Rank(), child.Size())
+	}
+
+	// Each worker answers the spawning rank, and the world still works alongside
+	for _, worker := range workers {
+		go func(c *Comm) {
+			data, err := c.Recv(0, 1)
+			if err == nil {
+				err = c.Send(0, 2, []byte(fmt.Sprintf("%s from %d", data, c.Rank())))
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(worker)
+	}
+	for rank := 1; rank <= 2; rank++ {
+		if err := child.Send(rank, 1, []byte("task")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := world[1].Send(0, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	for rank := 1; rank <= 2; rank++ {
+		data, err := child.Recv(rank, 2)
+		if want := fmt.Sprintf("task from %d", rank); err != nil || string(data) != want {
+			t.Errorf("Recv(%d) = %q, %v, want %q", rank, data, err, want)
+		}
+	}
+	if data, err := world[0].Recv(1, 1); err != nil || string(data) != "world" {
+		t.Errorf("world Recv = %q, %v", data, err)
+	}
+
+	finalizeAll(t, append([]*Comm{child}, workers...))
+	if world[1].child(child.context) != nil {
+		t.Error("the finalized communicator is still registered")
+	}
+	finalizeAll(t, world)
+}
+
+func TestSpawnRefused(t *testing.T) {
+	world := startLocalWorld(t, 1, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, world)
+	var asked SpawnRequest
+	_, err := world[0].spawn(4, nil, func(ctx context.Context, req SpawnRequest) ([]string, error) {
+		asked = req
+		return nil, errors.New("the job may spawn 2 more ranks, 4 asked for")
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to spawn 4 ranks: the job may spawn 2 more") {
+		t.Fatalf("spawn error = %v", err)
+	}
+	if asked.Ranks != 4 || asked.Address != world[0].advertise || asked.Context == 0 {
+		t.Errorf("request = %+v", asked)
+	}
+	if world[0].child(asked.Context) != nil {
+		t.Error("the refused communicator is still registered")
+	}
+}
+
+func TestSpawnContextFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int32
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "12345", want: 12345},
+		{value: "0", wantErr: true},
+		{value: "world", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv(EnvSpawnContext, tt.value)
+		got, err := spawnContextFromEnv()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: spawnContextFromEnv() = %d, %v", tt.value, got, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// mpi/stats.go
+// This file counts what a rank sends to the other ranks. The count covers every frame
+// written to a peer stream, headers and control frames included, so it is what the rank
+// put on the network. When MPI_STATS_FILE is set, Finalize writes the totals there as
+// JSON, where the rank script picks them up for awsmpirun to publish with --metrics.
+
+package mpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// EnvStatsFile is where Finalize writes the rank's traffic totals, set by awsmpirun
+const EnvStatsFile = "MPI_STATS_FILE"
+
+// Stats are the traffic totals of a rank
+type Stats struct {
+	BytesSent    int64 `json:"bytes_sent"`    // Bytes written to the other ranks' streams
+	MessagesSent int64 `json:"messages_sent"` // Messages sent to other ranks
+}
+
+// trafficCounter is shared by the peers of a communicator
+type trafficCounter struct {
+	bytes    atomic.Int64
+	messages atomic.Int64
+}
+
+// Stats returns what the rank has sent to the other ranks so far
+func (c *Comm) Stats() Stats {
+	return Stats{BytesSent: c.traffic.bytes.Load(), MessagesSent: c.traffic.messages.Load()}
+}
+
+// writeStatsFile writes the rank's totals to EnvStatsFile if it is set
+func (c *Comm) writeStatsFile() error {
+	path := os.Getenv(EnvStatsFile)
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.Stats())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", EnvStatsFile, err)
+	}
+	return nil
+}
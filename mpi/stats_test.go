@@ -0,0 +1,90 @@
+// mpi/stats_test.go
+
+package mpi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		transport  string
+		eagerLimit int
+		size       int
+	}{
+		{name: "grpc eager", transport: "grpc", eagerLimit: 0, size: 1000},
+		{name: "tcp eager", transport: "tcp", eagerLimit: 0, size: 1000},
+		{name: "grpc rendezvous", transport: "grpc", eagerLimit: 100, size: 1000},
+		{name: "tcp chunked", transport: "tcp", eagerLimit: 0, size: 3*sendChunkSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comms := startLocalWorld(t, 2, tt.eagerLimit, tt.transport)
+			before := comms[0].Stats()
+			if err := comms[0].Send(1, 7, make([]byte, tt.size)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := comms[1].Recv(0, 7); err != nil {
+				t.Fatal(err)
+			}
+			// Rendezvous payloads are sent in the background once the receiver asks
+			comms[0].transfers.Wait()
+			after := comms[0].Stats()
+			if got := after.MessagesSent - before.MessagesSent; got != 1 {
+				t.Errorf("MessagesSent grew by %d, want 1", got)
+			}
+			if got := after.BytesSent - before.BytesSent; got < int64(tt.size) {
+				t.Errorf("BytesSent grew by %d, want at least the %d byte payload", got, tt.size)
+			}
+			if got := comms[1].Stats().MessagesSent; got != 0 {
+				t.Errorf("receiver MessagesSent = %d, want 0", got)
+			}
+			// Messages to the local rank do not cross the network
+			local := comms[0].Stats()
+			if err := comms[0].Send(0, 1, make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if got := comms[0].Stats(); got != local {
+				t.Errorf("a local send changed the stats from %+v to %+v", local, got)
+			}
+			finalizeAll(t, comms)
+		})
+	}
+}
+
+func TestWriteStatsFile(t *testing.T) {
+	c := newComm(0, 1, []string{"127.0.0.1:0"}, "127.0.0.1:0", connectOptions{})
+	c.traffic.bytes.Store(4096)
+	c.traffic.messages.Store(3)
+
+	t.Setenv(EnvStatsFile, "")
+	if err := c.writeStatsFile(); err != nil {
+		t.Fatalf("writeStatsFile() without %s: %v", EnvStatsFile, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "stats.json")
+	t.Setenv(EnvStatsFile, path)
+	if err := c.writeStatsFile(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Stats
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{BytesSent: 4096, MessagesSent: 3}); got != want {
+		t.Errorf("stats file = %+v, want %+v", got, want)
+	}
+
+	t.Setenv(EnvStatsFile, filepath.Join(t.TempDir(), "missing", "stats.json"))
+	if err := c.writeStatsFile(); err == nil {
+		t.Error("writeStatsFile() into a missing directory succeeded")
+	}
+}
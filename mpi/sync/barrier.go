@@ -0,0 +1,83 @@
+// mpi/sync/barrier.go
+
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Barrier blocks participants until a fixed number of them have arrived.
+// Barriers are reusable: every participant must call Wait the same number of times.
+type Barrier struct {
+	store      store
+	name       string
+	parties    int
+	generation int
+}
+
+// NewBarrier returns a named barrier of comm for the given number of participants,
+// which may be fewer than the ranks of comm
+func NewBarrier(comm *mpi.Comm, name string, parties int) *Barrier {
+	return newBarrier(comm.ControlStore(), name, parties)
+}
+
+func newBarrier(s store, name string, parties int) *Barrier {
+	return &Barrier{store: s, name: name, parties: parties}
+}
+
+// Wait blocks until all participants have reached the barrier
+func (b *Barrier) Wait() error {
+	return b.WaitTimeout(0)
+}
+
+// WaitTimeout is like Wait but gives up after timeout. A zero timeout waits forever.
+func (b *Barrier) WaitTimeout(timeout time.Duration) error {
+	if b.parties <= 0 {
+		return fmt.Errorf("barrier %s needs at least one participant", b.name)
+	}
+
+	generation := b.generation
+	b.generation++
+	key := b.key(generation)
+
+	arrived, err := b.store.Add(key, 1)
+	if err != nil {
+		return fmt.Errorf("failed to arrive at barrier %s: %v", b.name, err)
+	}
+	if arrived == int64(b.parties) && generation > 0 {
+		// The last to arrive knows every participant has left the previous generation,
+		// whose counter would otherwise stay in rank 0's memory for good. Failing to
+		// delete it costs only that memory, so the barrier still counts as passed.
+		b.store.Delete(b.key(generation - 1))
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	interval := minPollInterval
+	for arrived < int64(b.parties) {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("timed out at barrier %s with %d of %d participants", b.name, arrived, b.parties)
+		}
+
+		time.Sleep(interval)
+		interval = nextPollInterval(interval)
+
+		// Adding zero reads the counter without changing it
+		arrived, err = b.store.Add(key, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read barrier %s: %v", b.name, err)
+		}
+	}
+	return nil
+}
+
+// key returns the key of the counter of generation
+func (b *Barrier) key(generation int) string {
+	return fmt.Sprintf("barrier/%s/%d", b.name, generation)
+}
@@ -0,0 +1,82 @@
+// mpi/sync/barrier_test.go
+
+package sync
+
+import (
+	"fmt"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func TestBarrier(t *testing.T) {
+	tests := []struct {
+		name     string
+		parties  int
+		arriving int           // Participants that call WaitTimeout
+		timeout  time.Duration // Given to WaitTimeout
+		wantErr  bool
+	}{
+		{name: "one participant", parties: 1, arriving: 1},
+		{name: "all arrive", parties: 4, arriving: 4},
+		{name: "all arrive with a timeout", parties: 3, arriving: 3, timeout: time.Minute},
+		{name: "one missing", parties: 3, arriving: 2, timeout: testTTL, wantErr: true},
+		{name: "no participants", parties: 0, arriving: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newMemStore()
+			// Two rounds, to check the barrier is released again once reused
+			barriers := make([]*Barrier, test.arriving)
+			for i := range barriers {
+				barriers[i] = newBarrier(s, "b", test.parties)
+			}
+			for round := 0; round < 2; round++ {
+				errs := make([]error, test.arriving)
+				var wg gosync.WaitGroup
+				for i, b := range barriers {
+					wg.Add(1)
+					go func(i int, b *Barrier) {
+						defer wg.Done()
+						errs[i] = b.WaitTimeout(test.timeout)
+					}(i, b)
+				}
+				wg.Wait()
+				for i, err := range errs {
+					if (err != nil) != test.wantErr {
+						t.Errorf("round %d, participant %d: got %v, want error %v", round, i, err, test.wantErr)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBarrierGenerations(t *testing.T) {
+	const parties, rounds = 3, 20
+	s := newMemStore()
+	var wg gosync.WaitGroup
+	errs := make([]error, parties)
+	for i := 0; i < parties; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := newBarrier(s, "b", parties)
+			for round := 0; round < rounds && errs[i] == nil; round++ {
+				errs[i] = b.Wait()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("participant %d: %v", i, err)
+		}
+	}
+
+	// Only the counter of the last generation is left
+	want := map[string]int64{fmt.Sprintf("barrier/b/%d", rounds-1): parties}
+	if fmt.Sprint(s.counters) != fmt.Sprint(want) {
+		t.Errorf("got counters %v, want %v", s.counters, want)
+	}
+}
@@ -0,0 +1,57 @@
+// mpi/sync/election.go
+
+package sync
+
+import (
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Election elects a single leader among the candidates campaigning on a name
+type Election struct {
+	lease *lease
+}
+
+// NewElection returns an election among the ranks of comm where this process campaigns
+// as candidate, or under a name of its own if candidate is empty. Leadership is a lease
+// of ttl that is renewed while held; a zero ttl uses DefaultLeaseTTL.
+func NewElection(comm *mpi.Comm, name, candidate string, ttl time.Duration) *Election {
+	if candidate == "" {
+		candidate = defaultOwner(comm)
+	}
+	return newElection(comm.ControlStore(), name, candidate, ttl)
+}
+
+func newElection(s store, name, candidate string, ttl time.Duration) *Election {
+	return &Election{lease: newLease(s, "election/"+name, candidate, ttl)}
+}
+
+// Campaign blocks until this candidate becomes the leader
+func (e *Election) Campaign() error {
+	return e.lease.acquire()
+}
+
+// Leader returns the current leader, or an empty string if nobody holds a valid lease
+func (e *Election) Leader() (string, error) {
+	value, exists, err := e.lease.store.Get(e.lease.key)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	record, held := decodeLease(value)
+	if !held || time.Now().UnixNano() >= record.Expires {
+		return "", nil
+	}
+	return record.Owner, nil
+}
+
+// Resign gives up leadership so another candidate can win
+func (e *Election) Resign() error {
+	return e.lease.release()
+}
+
+// Lost is closed if leadership could not be renewed and may have passed to another candidate
+func (e *Election) Lost() <-chan struct{} {
+	return e.lease.lostChannel()
+}
@@ -0,0 +1,91 @@
+// mpi/sync/election_test.go
+
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElectionHandover(t *testing.T) {
+	tests := []struct {
+		name    string
+		leave   func(t *testing.T, e *Election) // How the first leader gives up
+		timeout time.Duration                   // How long the second candidate may take to win
+	}{
+		{
+			name: "resign",
+			leave: func(t *testing.T, e *Election) {
+				if err := e.Resign(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			timeout: testTTL,
+		},
+		{
+			name: "expiry",
+			leave: func(t *testing.T, e *Election) {
+				// The leader dies: renewal stops but the lease stays in the store
+				e.lease.mu.Lock()
+				close(e.lease.stop)
+				e.lease.stop = nil
+				e.lease.mu.Unlock()
+				e.lease.done.Wait()
+			},
+			timeout: 3 * testTTL,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newMemStore()
+			a, b := newElection(s, "e", "a", testTTL), newElection(s, "e", "b", testTTL)
+
+			if err := a.Campaign(); err != nil {
+				t.Fatal(err)
+			}
+			if leader, err := a.Leader(); err != nil || leader != "a" {
+				t.Fatalf("got leader %q, %v, want a", leader, err)
+			}
+
+			won := make(chan error, 1)
+			go func() { won <- b.Campaign() }()
+			select {
+			case err := <-won:
+				t.Fatalf("b won while a led: %v", err)
+			case <-time.After(testTTL):
+			}
+
+			test.leave(t, a)
+			select {
+			case err := <-won:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(test.timeout + maxPollInterval):
+				t.Fatal("b did not win after a left")
+			}
+			defer b.Resign()
+			if leader, err := a.Leader(); err != nil || leader != "b" {
+				t.Errorf("got leader %q, %v, want b", leader, err)
+			}
+		})
+	}
+}
+
+func TestElectionNoLeader(t *testing.T) {
+	s := newMemStore()
+	e := newElection(s, "e", "a", testTTL)
+	if leader, err := e.Leader(); err != nil || leader != "" {
+		t.Errorf("got leader %q, %v before anyone campaigned", leader, err)
+	}
+
+	if err := e.Campaign(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := e.Leader(); err != nil || leader != "" {
+		t.Errorf("got leader %q, %v after the leader resigned", leader, err)
+	}
+}
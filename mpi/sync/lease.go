@@ -0,0 +1,255 @@
+// mpi/sync/lease.go
+// Package sync provides distributed coordination primitives for awsmpirun jobs:
+// named barriers, mutexes, and leader election. They keep their state in the control
+// store of a communicator (see mpi.ControlStore), which its rank 0 holds in memory, so
+// they need nothing outside the job and are shared by the ranks of that communicator
+// only. The state is lost if rank 0 leaves.
+//
+// Leases compare expiry times written by other ranks against the local clock,
+// so instances are expected to keep their clocks in sync (chrony on EC2 does).
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+const (
+	// DefaultLeaseTTL is how long a lock or leadership is held without renewal
+	DefaultLeaseTTL = 15 * time.Second
+
+	minPollInterval = 50 * time.Millisecond
+	maxPollInterval = time.Second
+)
+
+// store keeps the state of the primitives; the communicator's control store outside of tests
+type store interface {
+	Get(key string) ([]byte, bool, error)
+	CompareAndSwap(key string, old, value []byte) (bool, error)
+	Add(key string, delta int64) (int64, error)
+	Delete(key string) error
+}
+
+// leaseRecord is the value stored in the store for a held lease
+type leaseRecord struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"`
+}
+
+// lease is a time-limited claim on a key, renewed in the background while held.
+// The owner string is shared by everything using one lease, so holder keeps the
+// goroutines of this process from all believing they hold it at once.
+type lease struct {
+	store store
+	key   string
+	owner string
+	ttl   time.Duration
+
+	holder gosync.Mutex // Held locally for as long as the lease is held
+
+	mu      gosync.Mutex
+	current []byte
+	stop    chan struct{}
+	lost    chan struct{}
+	done    gosync.WaitGroup
+}
+
+func newLease(s store, key, owner string, ttl time.Duration) *lease {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &lease{store: s, key: key, owner: owner, ttl: ttl}
+}
+
+// acquire blocks until the lease is held, then starts renewing it
+func (l *lease) acquire() error {
+	l.holder.Lock()
+
+	interval := minPollInterval
+	for {
+		acquired, err := l.claim()
+		if err != nil {
+			l.holder.Unlock()
+			return err
+		}
+		if acquired {
+			l.startRenewal()
+			return nil
+		}
+
+		time.Sleep(interval)
+		interval = nextPollInterval(interval)
+	}
+}
+
+// tryAcquire claims the lease if it is free or expired and starts renewing it
+func (l *lease) tryAcquire() (bool, error) {
+	if !l.holder.TryLock() {
+		return false, nil
+	}
+
+	acquired, err := l.claim()
+	if err != nil || !acquired {
+		l.holder.Unlock()
+		return false, err
+	}
+	l.startRenewal()
+	return true, nil
+}
+
+// claim writes our record if the stored lease is free, expired, or left over
+// from an earlier holder with the same owner
+func (l *lease) claim() (bool, error) {
+	value, exists, err := l.store.Get(l.key)
+	if err != nil {
+		return false, err
+	}
+
+	var previous []byte
+	if exists {
+		record, held := decodeLease(value)
+		if held && time.Now().UnixNano() < record.Expires && record.Owner != l.owner {
+			return false, nil
+		}
+		previous = value
+	}
+
+	next, err := l.encode()
+	if err != nil {
+		return false, err
+	}
+
+	swapped, err := l.store.CompareAndSwap(l.key, previous, next)
+	if err != nil || !swapped {
+		return false, err
+	}
+
+	l.mu.Lock()
+	l.current = next
+	l.mu.Unlock()
+	return true, nil
+}
+
+// startRenewal extends the lease every third of its TTL until release is called
+func (l *lease) startRenewal() {
+	stop := make(chan struct{})
+	lost := make(chan struct{})
+
+	l.mu.Lock()
+	l.stop = stop
+	l.lost = lost
+	l.mu.Unlock()
+
+	l.done.Add(1)
+	go func() {
+		defer l.done.Done()
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				renewed, err := l.renew()
+				if err != nil || !renewed {
+					close(lost)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// lostChannel returns the channel closed when the current hold is lost
+func (l *lease) lostChannel() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// renew pushes the expiry forward, failing if another owner took the lease
+func (l *lease) renew() (bool, error) {
+	next, err := l.encode()
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	swapped, err := l.store.CompareAndSwap(l.key, l.current, next)
+	if err != nil || !swapped {
+		return false, err
+	}
+	l.current = next
+	return true, nil
+}
+
+// release stops renewal and frees the lease if it is still ours
+func (l *lease) release() error {
+	l.mu.Lock()
+	stop := l.stop
+	l.stop = nil
+	l.mu.Unlock()
+	if stop == nil {
+		return fmt.Errorf("lease %s is not held", l.key)
+	}
+	defer l.holder.Unlock()
+
+	close(stop)
+	l.done.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// An empty value marks the lease as free without losing the CAS guard
+	_, err := l.store.CompareAndSwap(l.key, l.current, []byte{})
+	l.current = nil
+	return err
+}
+
+func (l *lease) encode() ([]byte, error) {
+	record := leaseRecord{Owner: l.owner, Expires: time.Now().Add(l.ttl).UnixNano()}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode lease %s: %v", l.key, err)
+	}
+	return value, nil
+}
+
+// decodeLease parses a stored lease, reporting false for free or unreadable values
+func decodeLease(value []byte) (leaseRecord, bool) {
+	var record leaseRecord
+	if len(bytes.TrimSpace(value)) == 0 {
+		return record, false
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func nextPollInterval(interval time.Duration) time.Duration {
+	interval *= 2
+	if interval > maxPollInterval {
+		return maxPollInterval
+	}
+	return interval
+}
+
+// owners counts the owners made by defaultOwner in this process
+var owners atomic.Int64
+
+// defaultOwner returns an owner no other lease of the communicator has: ranks differ
+// in rank, a rank's incarnations in process, and its leases in the count
+func defaultOwner(comm *mpi.Comm) string {
+	return fmt.Sprintf("rank-%d-%d-%d", comm.Rank(), os.Getpid(), owners.Add(1))
+}
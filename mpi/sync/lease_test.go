@@ -0,0 +1,202 @@
+// mpi/sync/lease_test.go
+
+package sync
+
+import (
+	"bytes"
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+const testTTL = 150 * time.Millisecond
+
+// memStore is a store in memory, as rank 0 keeps the control store
+type memStore struct {
+	mu       gosync.Mutex
+	values   map[string][]byte
+	counters map[string]int64
+	err      error // Returned by every call when set
+}
+
+func newMemStore() *memStore {
+	return &memStore{values: make(map[string][]byte), counters: make(map[string]int64)}
+}
+
+func (s *memStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, exists := s.values[key]
+	return value, exists, s.err
+}
+
+func (s *memStore) CompareAndSwap(key string, old, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	current, exists := s.values[key]
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+	s.values[key] = bytes.Clone(value)
+	return true, nil
+}
+
+func (s *memStore) Add(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.counters[key] += delta
+	return s.counters[key], nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.values, key)
+	delete(s.counters, key)
+	return nil
+}
+
+func (s *memStore) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func TestLeaseAcquire(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *memStore) // Leaves the lease as the test needs it
+		wait  time.Duration
+		owner string
+		want  bool
+	}{
+		{name: "free", setup: func(t *testing.T, s *memStore) {}, owner: "b", want: true},
+		{
+			name: "held and renewed",
+			setup: func(t *testing.T, s *memStore) {
+				l := newLease(s, "key", "a", testTTL)
+				if err := l.acquire(); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { l.release() })
+			},
+			wait:  3 * testTTL,
+			owner: "b",
+			want:  false,
+		},
+		{
+			name: "held by a holder that stopped renewing",
+			setup: func(t *testing.T, s *memStore) {
+				if _, err := newLease(s, "key", "a", testTTL).claim(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			owner: "b",
+			want:  false,
+		},
+		{
+			name: "expired",
+			setup: func(t *testing.T, s *memStore) {
+				if _, err := newLease(s, "key", "a", testTTL).claim(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wait:  2 * testTTL,
+			owner: "b",
+			want:  true,
+		},
+		{
+			name: "released",
+			setup: func(t *testing.T, s *memStore) {
+				l := newLease(s, "key", "a", testTTL)
+				if err := l.acquire(); err != nil {
+					t.Fatal(err)
+				}
+				if err := l.release(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			owner: "b",
+			want:  true,
+		},
+		{
+			name: "left over by the same owner",
+			setup: func(t *testing.T, s *memStore) {
+				if _, err := newLease(s, "key", "a", time.Hour).claim(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			owner: "a",
+			want:  true,
+		},
+		{
+			name:  "unreadable",
+			setup: func(t *testing.T, s *memStore) { s.values["key"] = []byte("not a lease") },
+			owner: "b",
+			want:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newMemStore()
+			test.setup(t, s)
+			time.Sleep(test.wait)
+
+			l := newLease(s, "key", test.owner, testTTL)
+			got, err := l.tryAcquire()
+			if err != nil || got != test.want {
+				t.Fatalf("got %v, %v, want %v", got, err, test.want)
+			}
+			if got {
+				l.release()
+			}
+		})
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	tests := []struct {
+		name      string
+		interfere func(s *memStore)
+	}{
+		{name: "taken by another owner", interfere: func(s *memStore) {
+			s.mu.Lock()
+			s.values["key"] = []byte(`{"owner":"b","expires":0}`)
+			s.mu.Unlock()
+		}},
+		{name: "store failing", interfere: func(s *memStore) { s.fail(errors.New("rank 0 left")) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newMemStore()
+			l := newLease(s, "key", "a", testTTL)
+			if err := l.acquire(); err != nil {
+				t.Fatal(err)
+			}
+			defer l.release()
+
+			test.interfere(s)
+			select {
+			case <-l.lostChannel():
+			case <-time.After(2 * testTTL):
+				t.Fatal("the lease was not reported lost")
+			}
+		})
+	}
+}
+
+func TestLeaseReleaseNotHeld(t *testing.T) {
+	if err := newLease(newMemStore(), "key", "a", testTTL).release(); err == nil {
+		t.Error("released a lease that was never held")
+	}
+}
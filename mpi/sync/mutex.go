@@ -0,0 +1,46 @@
+// mpi/sync/mutex.go
+
+package sync
+
+import (
+	"time"
+
+	"github.com/Otter2022/cloud-native-mpi-for-aws-cli/mpi"
+)
+
+// Mutex is a named lock shared by the ranks of a communicator.
+// The lock is a lease: it is renewed while held and expires if the holder dies.
+type Mutex struct {
+	lease *lease
+}
+
+// NewMutex returns a named mutex of comm whose lease lasts ttl without renewal.
+// A zero ttl uses DefaultLeaseTTL.
+func NewMutex(comm *mpi.Comm, name string, ttl time.Duration) *Mutex {
+	return newMutex(comm.ControlStore(), name, defaultOwner(comm), ttl)
+}
+
+func newMutex(s store, name, owner string, ttl time.Duration) *Mutex {
+	return &Mutex{lease: newLease(s, "mutex/"+name, owner, ttl)}
+}
+
+// Lock blocks until the mutex is acquired
+func (m *Mutex) Lock() error {
+	return m.lease.acquire()
+}
+
+// TryLock acquires the mutex if it is free and reports whether it did
+func (m *Mutex) TryLock() (bool, error) {
+	return m.lease.tryAcquire()
+}
+
+// Unlock releases the mutex
+func (m *Mutex) Unlock() error {
+	return m.lease.release()
+}
+
+// Lost is closed if the lease could not be renewed while the mutex was held,
+// meaning another rank may now hold it
+func (m *Mutex) Lost() <-chan struct{} {
+	return m.lease.lostChannel()
+}
@@ -0,0 +1,81 @@
+// mpi/sync/mutex_test.go
+
+package sync
+
+import (
+	"fmt"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMutexExclusion(t *testing.T) {
+	tests := []struct {
+		name   string
+		shared bool // All goroutines lock one Mutex, as the goroutines of a rank do
+	}{
+		{name: "a mutex per rank", shared: false},
+		{name: "one mutex shared by goroutines", shared: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const goroutines, rounds = 4, 3
+			s := newMemStore()
+			shared := newMutex(s, "m", "shared", testTTL)
+
+			var holders atomic.Int32
+			var wg gosync.WaitGroup
+			errs := make(chan error, goroutines*rounds)
+			for i := 0; i < goroutines; i++ {
+				m := shared
+				if !test.shared {
+					m = newMutex(s, "m", fmt.Sprint("rank-", i), testTTL)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < rounds; j++ {
+						if err := m.Lock(); err != nil {
+							errs <- err
+							return
+						}
+						if n := holders.Add(1); n != 1 {
+							errs <- fmt.Errorf("%d goroutines hold the mutex", n)
+						}
+						holders.Add(-1)
+						if err := m.Unlock(); err != nil {
+							errs <- err
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMutexTryLock(t *testing.T) {
+	s := newMemStore()
+	a, b := newMutex(s, "m", "a", testTTL), newMutex(s, "m", "b", testTTL)
+
+	if locked, err := a.TryLock(); err != nil || !locked {
+		t.Fatalf("got %v, %v locking a free mutex", locked, err)
+	}
+	if locked, err := b.TryLock(); err != nil || locked {
+		t.Fatalf("got %v, %v locking a held mutex", locked, err)
+	}
+	if locked, err := a.TryLock(); err != nil || locked {
+		t.Fatalf("got %v, %v locking a mutex its own holder holds", locked, err)
+	}
+	if err := a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := b.TryLock(); err != nil || !locked {
+		t.Fatalf("got %v, %v locking a released mutex", locked, err)
+	}
+	b.Unlock()
+}
@@ -0,0 +1,11 @@
+// mpi/sync/source.go
+// This file embeds the package's source for awsmpirun docs serve, as mpi/source.go does.
+
+package sync
+
+import "embed"
+
+// Source holds the Go files of the package
+//
+//go:embed *.go
+var Source embed.FS
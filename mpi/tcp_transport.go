@@ -0,0 +1,214 @@
+// mpi/tcp_transport.go
+// This file implements the raw TCP transport selected with MPI_TRANSPORT=tcp. Every
+// peer stream is a TCP connection of its own carrying length-prefixed frames: a 4-byte
+// big-endian length of the header and payload, the frame header, then the payload. A
+// send is a single vectored write without copying the payload, and there is none of
+// the HTTP/2 framing and flow control of gRPC, which is what small, latency-sensitive
+// messages pay for most. Closing a stream for sending is a TCP half-close, so the
+// receiver's acknowledgement still gets through.
+package mpi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpLengthSize = 4
+	tcpPrefixSize = tcpLengthSize + frameHeaderSize
+	tcpMaxPayload = math.MaxUint32 - frameHeaderSize
+	tcpReadBuffer = 64 << 10
+
+	tcpBaseDelay   = 100 * time.Millisecond
+	tcpMaxDelay    = 5 * time.Second
+	tcpDialTimeout = 5 * time.Second
+)
+
+// tcpKeepalive detects peers whose instance disappeared, like the gRPC keepalives
+var tcpKeepalive = net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 10 * time.Second, Count: 3}
+
+// tcpTransport carries every peer stream on a TCP connection of its own
+type tcpTransport struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool // Inbound connections with a running handler
+	stopped  bool
+	handlers sync.WaitGroup
+}
+
+func newTCPTransport() *tcpTransport {
+	return &tcpTransport{conns: make(map[net.Conn]bool)}
+}
+
+func (t *tcpTransport) serve(listener net.Listener, handle func(frameStream) error) {
+	t.mu.Lock()
+	t.listener = listener
+	t.mu.Unlock()
+	go t.accept(listener, handle)
+}
+
+// accept runs handle for every connection until the listener is closed
+func (t *tcpTransport) accept(listener net.Listener, handle func(frameStream) error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Out of file descriptors and the like; back off instead of spinning
+			time.Sleep(tcpBaseDelay)
+			continue
+		}
+
+		t.mu.Lock()
+		if t.stopped {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = true
+		t.handlers.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer t.handlers.Done()
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetKeepAliveConfig(tcpKeepalive)
+			}
+			handle(newTCPStream(conn))
+			conn.Close()
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+func (t *tcpTransport) dial(ctx context.Context, address string, attempt func(error)) (peerStream, error) {
+	dialer := &net.Dialer{Timeout: tcpDialTimeout, KeepAliveConfig: tcpKeepalive}
+	delay := tcpBaseDelay
+	var lastErr error
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			attempt(nil)
+			return newTCPStream(conn), nil
+		}
+		if ctx.Err() != nil {
+			// The dial was cut short, so it says nothing about the peer
+			break
+		}
+		attempt(err)
+		lastErr = err
+
+		// Back off like gRPC does: grow by 1.6 with 20% jitter
+		jittered := time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+		timer := time.NewTimer(jittered)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay = min(time.Duration(float64(delay)*1.6), tcpMaxDelay)
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, lastErr
+}
+
+func (t *tcpTransport) gracefulStop() {
+	t.mu.Lock()
+	t.closeListenerLocked()
+	t.mu.Unlock()
+	t.handlers.Wait()
+}
+
+func (t *tcpTransport) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeListenerLocked()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// closeListenerLocked stops accepting connections. t.mu must be held.
+func (t *tcpTransport) closeListenerLocked() {
+	t.stopped = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+// tcpStream is either side of a peer stream on a TCP connection
+type tcpStream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	prefix [tcpPrefixSize]byte // Scratch for send, which callers serialize
+}
+
+func newTCPStream(conn net.Conn) *tcpStream {
+	return &tcpStream{conn: conn, reader: bufio.NewReaderSize(conn, tcpReadBuffer)}
+}
+
+func (s *tcpStream) send(f *frame) error {
+	if uint64(len(f.Payload)) > tcpMaxPayload {
+		return fmt.Errorf("frame payload of %d bytes exceeds the TCP transport limit of %d", len(f.Payload), tcpMaxPayload)
+	}
+	binary.BigEndian.PutUint32(s.prefix[:tcpLengthSize], uint32(frameHeaderSize+len(f.Payload)))
+	putFrameHeader(s.prefix[tcpLengthSize:], f)
+
+	buffers := net.Buffers{s.prefix[:]}
+	if len(f.Payload) > 0 {
+		buffers = append(buffers, f.Payload)
+	}
+	_, err := buffers.WriteTo(s.conn)
+	return err
+}
+
+func (s *tcpStream) recv(f *frame) error {
+	var prefix [tcpPrefixSize]byte
+	if _, err := io.ReadFull(s.reader, prefix[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(prefix[:tcpLengthSize])
+	if length < frameHeaderSize {
+		return fmt.Errorf("short frame of %d bytes", length)
+	}
+	parseFrameHeader(prefix[tcpLengthSize:], f)
+	f.Payload = nil
+	if size := int(length) - frameHeaderSize; size > 0 {
+		f.Payload = make([]byte, size)
+		if _, err := io.ReadFull(s.reader, f.Payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *tcpStream) closeSend() error {
+	if tcp, ok := s.conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return s.conn.Close()
+}
+
+func (s *tcpStream) close() {
+	s.conn.Close()
+}
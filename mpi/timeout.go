@@ -0,0 +1,228 @@
+// mpi/timeout.go
+// This file bounds how long a collective waits for the other ranks, so one hung rank
+// does not wedge every rank inside an Allreduce forever. A collective gives up on a
+// rank once the context of WithContext is done, or once it has waited WithTimeout, or
+// MPI_COLLECTIVE_TIMEOUT for collectives without options, for one message. What
+// happens then is the timeout policy's call:
+//
+//   - TimeoutError returns an error wrapping ErrTimeout that names the rank waited
+//     for. The ranks no longer agree on which collective they are in, so every later
+//     collective on the communicator fails with the same error.
+//   - TimeoutAbort ends the job, like Abort.
+//   - TimeoutRetry logs a warning naming the rank and waits again, up to
+//     timeoutRetries times, before it fails like TimeoutError. A done WithContext
+//     context is not waited on again.
+//
+// The policy comes from WithTimeoutPolicy, or MPI_TIMEOUT_POLICY for every collective.
+
+package mpi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Environment variables of collective timeouts, set by awsmpirun from
+// --collective-timeout and --timeout-policy
+const (
+	EnvCollectiveTimeout = "MPI_COLLECTIVE_TIMEOUT"
+	EnvTimeoutPolicy     = "MPI_TIMEOUT_POLICY"
+)
+
+// TimeoutPolicy is what a collective does when it times out
+type TimeoutPolicy string
+
+// Timeout policies accepted in MPI_TIMEOUT_POLICY and WithTimeoutPolicy
+const (
+	TimeoutError TimeoutPolicy = "error" // Return ErrTimeout, the default
+	TimeoutAbort TimeoutPolicy = "abort" // End every rank of the job
+	TimeoutRetry TimeoutPolicy = "retry" // Warn and wait again, then return ErrTimeout
+)
+
+const (
+	// timeoutRetries is how many more times TimeoutRetry waits for a rank
+	timeoutRetries = 3
+	// abortExitCode is the status Abort ends the ranks with
+	abortExitCode = 1
+	// abortGrace is how long Abort tries to reach the other ranks before it exits
+	abortGrace = 5 * time.Second
+)
+
+// ErrTimeout is wrapped by the error of a collective that gave up waiting for a rank
+var ErrTimeout = errors.New("collective timed out")
+
+// exit ends the process on Abort; tests replace it
+var exit = os.Exit
+
+// ValidateTimeoutPolicy returns an error if name is not a timeout policy
+func ValidateTimeoutPolicy(name string) error {
+	switch TimeoutPolicy(name) {
+	case TimeoutError, TimeoutAbort, TimeoutRetry:
+		return nil
+	}
+	return fmt.Errorf("unknown timeout policy %q, expected %s, %s, or %s", name, TimeoutError, TimeoutAbort, TimeoutRetry)
+}
+
+// collectiveTimeoutFromEnv returns MPI_COLLECTIVE_TIMEOUT, 0 when collectives wait
+// forever, and MPI_TIMEOUT_POLICY
+func collectiveTimeoutFromEnv() (time.Duration, TimeoutPolicy, error) {
+	var timeout time.Duration
+	if value := os.Getenv(EnvCollectiveTimeout); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, "", fmt.Errorf("invalid %s %q", EnvCollectiveTimeout, value)
+		}
+		timeout = d
+	}
+	policy := TimeoutError
+	if value := os.Getenv(EnvTimeoutPolicy); value != "" {
+		if err := ValidateTimeoutPolicy(value); err != nil {
+			return 0, "", fmt.Errorf("invalid %s: %v", EnvTimeoutPolicy, err)
+		}
+		policy = TimeoutPolicy(value)
+	}
+	return timeout, policy, nil
+}
+
+// WithContext bounds a collective by ctx: once ctx is done, the collective stops
+// waiting and applies its timeout policy
+func WithContext(ctx context.Context) MessageOption {
+	return func(o *messageOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithTimeout bounds how long a collective waits for each message, overriding
+// MPI_COLLECTIVE_TIMEOUT; 0 waits forever
+func WithTimeout(d time.Duration) MessageOption {
+	return func(o *messageOptions) {
+		o.timeout, o.timeoutSet = d, true
+	}
+}
+
+// WithTimeoutPolicy selects what a collective does when it times out, overriding
+// MPI_TIMEOUT_POLICY
+func WithTimeoutPolicy(policy TimeoutPolicy) MessageOption {
+	return func(o *messageOptions) {
+		o.policy = policy
+	}
+}
+
+// collectiveCall is one collective on one rank, with the limits its waits keep to
+type collectiveCall struct {
+	c       *Comm
+	op      string
+	ctx     context.Context
+	timeout time.Duration // For each wait; 0 waits until ctx is done
+	policy  TimeoutPolicy
+}
+
+// collective starts collective op with opts, unless an earlier one timed out
+func (c *Comm) collective(op string, opts []MessageOption) (*collectiveCall, error) {
+	c.collectiveMu.Lock()
+	failed := c.collectiveErr
+	c.collectiveMu.Unlock()
+	if failed != nil {
+		return nil, fmt.Errorf("%s: the ranks are out of step since an earlier collective failed: %w", op, failed)
+	}
+
+	var options messageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	call := &collectiveCall{c: c, op: op, ctx: options.ctx, timeout: c.collectiveTimeout, policy: c.timeoutPolicy}
+	if call.ctx == nil {
+		call.ctx = context.Background()
+	}
+	if options.timeoutSet {
+		call.timeout = options.timeout
+	}
+	if options.policy != "" {
+		if err := ValidateTimeoutPolicy(string(options.policy)); err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+		call.policy = options.policy
+	}
+	return call, nil
+}
+
+// recv receives the message with tag from source within the call's limits. Once the
+// message is announced, a rendezvous payload is only bounded by the call's context, as
+// it is on its way and the message cannot be taken again.
+func (call *collectiveCall) recv(source, tag int) ([]byte, error) {
+	c := call.c
+	if source < 0 || source >= c.size {
+		return nil, fmt.Errorf("receive from invalid rank %d", source)
+	}
+	var msg message
+	err := call.wait(source, func(ctx context.Context) error {
+		var err error
+		msg, err = c.mailbox.take(ctx, source, tag)
+		return err
+	})
+	if err != nil || !msg.rendezvous {
+		return msg.payload, err
+	}
+	return c.fetch(call.ctx, source, tag, msg.id)
+}
+
+// wait runs receive, which waits for source until its context is done, and applies
+// the timeout policy if it gives up
+func (call *collectiveCall) wait(source int, receive func(context.Context) error) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := call.ctx, context.CancelFunc(func() {})
+		if call.timeout > 0 {
+			ctx, cancel = context.WithTimeout(call.ctx, call.timeout)
+		}
+		err := receive(ctx)
+		expired := ctx.Err() != nil
+		cancel()
+		if err == nil || !expired {
+			return err
+		}
+
+		waited := time.Since(start).Round(time.Millisecond)
+		if call.policy == TimeoutRetry && attempt < timeoutRetries && call.ctx.Err() == nil {
+			Logger().Warn("collective is still waiting for a rank", "op", call.op, "rank", source, "waited", waited)
+			continue
+		}
+		err = fmt.Errorf("%w after waiting %v for rank %d", ErrTimeout, waited, source)
+		if call.policy == TimeoutAbort {
+			call.c.Abort(fmt.Sprintf("%s: %v", call.op, err))
+		}
+		call.c.collectiveMu.Lock()
+		if call.c.collectiveErr == nil {
+			call.c.collectiveErr = fmt.Errorf("%s: %w", call.op, err)
+		}
+		call.c.collectiveMu.Unlock()
+		return err
+	}
+}
+
+// Abort ends every rank of the job, like MPI_Abort: it tells the other ranks it can
+// reach, within a few seconds, and exits with a non-zero status. Each rank logs reason
+// and exits as well, so awsmpirun reports the job as failed.
+func (c *Comm) Abort(reason string) {
+	Logger().Error("aborting the job", "reason", reason)
+	// A hung rank may not read its stream, and a send to it may never return
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		c.broadcastEvent(Event{Kind: EventAbort, Rank: c.rank, Time: time.Now(), Detail: reason})
+	}()
+	select {
+	case <-sent:
+	case <-time.After(abortGrace):
+	}
+	exit(abortExitCode)
+}
+
+// receiveAbort ends this rank after another rank aborted the job
+func (c *Comm) receiveAbort(e Event) {
+	Logger().Error("another rank aborted the job", "rank", e.Rank, "reason", e.Detail)
+	exit(abortExitCode)
+}
@@ -0,0 +1,104 @@
+// mpi/timeout_test.go
+
+package mpi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCollectiveTimeout(t *testing.T) {
+	comms := startLocalWorld(t, 3, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+
+	// Rank 2 never joins the barrier
+	errs := onEveryRank(comms[:2], func(c *Comm) error {
+		return Barrier(c, WithTimeout(200*time.Millisecond))
+	})
+	for rank, err := range errs {
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("rank %d: got %v, want %v", rank, err, ErrTimeout)
+		}
+	}
+
+	// The ranks are out of step, so later collectives fail at once
+	if _, err := AllreduceSum(comms[0], []int{1}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("allreduce after a timeout: got %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestCollectiveContext(t *testing.T) {
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := BroadcastValue(comms[1], 0, "", WithContext(ctx)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestCollectiveTimeoutRetry(t *testing.T) {
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportGRPC)
+	defer finalizeAll(t, comms)
+
+	// Rank 1 is late, but within the retries of rank 0
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		if c.Rank() == 1 {
+			time.Sleep(300 * time.Millisecond)
+			return Barrier(c)
+		}
+		return Barrier(c, WithTimeout(100*time.Millisecond), WithTimeoutPolicy(TimeoutRetry))
+	}))
+}
+
+func TestCollectiveTimeoutAbort(t *testing.T) {
+	exits := make(chan int, 2)
+	saved := exit
+	exit = func(code int) { exits <- code }
+	t.Cleanup(func() { exit = saved })
+
+	comms := startLocalWorld(t, 2, defaultEagerLimit, TransportTCP)
+	defer finalizeAll(t, comms)
+
+	// Rank 0 ends itself, and rank 1 once it hears of it
+	if err := Barrier(comms[0], WithTimeout(100*time.Millisecond), WithTimeoutPolicy(TimeoutAbort)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	for range 2 {
+		select {
+		case code := <-exits:
+			if code != abortExitCode {
+				t.Errorf("exited with status %d, want %d", code, abortExitCode)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for both ranks to exit")
+		}
+	}
+}
+
+func TestCollectiveTimeoutFromEnv(t *testing.T) {
+	tests := []struct {
+		timeout, policy string
+		want            time.Duration
+		wantPolicy      TimeoutPolicy
+		wantErr         bool
+	}{
+		{want: 0, wantPolicy: TimeoutError},
+		{timeout: "90s", policy: "abort", want: 90 * time.Second, wantPolicy: TimeoutAbort},
+		{timeout: "1m", policy: "retry", want: time.Minute, wantPolicy: TimeoutRetry},
+		{timeout: "-1s", wantErr: true},
+		{timeout: "soon", wantErr: true},
+		{policy: "ignore", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Setenv(EnvCollectiveTimeout, test.timeout)
+		t.Setenv(EnvTimeoutPolicy, test.policy)
+		got, policy, err := collectiveTimeoutFromEnv()
+		if (err != nil) != test.wantErr || got != test.want || policy != test.wantPolicy {
+			t.Errorf("%q, %q: got %v, %q, %v, want %v, %q, error %v", test.timeout, test.policy, got, policy, err, test.want, test.wantPolicy, test.wantErr)
+		}
+	}
+}
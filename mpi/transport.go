@@ -0,0 +1,115 @@
+// mpi/transport.go
+// This file defines the frames ranks exchange and the transport interface that carries
+// them. Each rank opens one outgoing stream to every peer and pushes frames over it;
+// the receiving side decodes frames and files them into its mailbox. The transport is
+// chosen per job with MPI_TRANSPORT: gRPC by default (grpc_transport.go), or raw TCP
+// with length-prefixed frames (tcp_transport.go), which skips HTTP/2 framing and flow
+// control for lower small-message latency.
+package mpi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// EnvTransport selects the transport between ranks, set by awsmpirun from --transport
+const EnvTransport = "MPI_TRANSPORT"
+
+// Transports accepted in MPI_TRANSPORT
+const (
+	TransportGRPC = "grpc"
+	TransportTCP  = "tcp"
+)
+
+// Frame kinds carried on a peer stream
+const (
+	frameHello       uint8 = iota + 1 // First frame on a stream, identifies the sending rank
+	frameData                         // Point-to-point message payload
+	frameEvent                        // Cluster event forwarded to peers, JSON encoded
+	frameReadyToSend                  // Envelope of a rendezvous message, with its id and size as payload
+	frameClearToSend                  // Receiver asks for the rendezvous message whose id is the tag
+	frameBulk                         // Payload of the rendezvous message whose id is the tag
+	frameChunk                        // Leading part of a large data frame, see priority.go
+	frameBulkChunk                    // Leading part of a large bulk frame, with its id as the tag
+	frameResume                       // First frame of a stream resuming a broken one, see retry.go
+	frameAck                          // Receiver acknowledges the frames of the connection up to the payload
+	frameFinal                        // Last frame before a finalizing rank closes the stream
+	frameSession                      // First frame each way on an encrypted stream, see encryption.go
+	frameRequest                      // Request to rank 0's key-value store, with its id as the tag, see control.go
+	frameReply                        // Rank 0's reply to the control request whose id is the tag
+)
+
+const frameHeaderSize = 9
+
+// frame is the unit of data exchanged between ranks
+type frame struct {
+	Kind    uint8
+	Source  int32
+	Tag     int32
+	Payload []byte
+}
+
+// putFrameHeader writes the fixed header of f into the first frameHeaderSize bytes of b
+func putFrameHeader(b []byte, f *frame) {
+	b[0] = f.Kind
+	binary.BigEndian.PutUint32(b[1:5], uint32(f.Source))
+	binary.BigEndian.PutUint32(b[5:9], uint32(f.Tag))
+}
+
+// parseFrameHeader reads the fixed header in the first frameHeaderSize bytes of b into f
+func parseFrameHeader(b []byte, f *frame) {
+	f.Kind = b[0]
+	f.Source = int32(binary.BigEndian.Uint32(b[1:5]))
+	f.Tag = int32(binary.BigEndian.Uint32(b[5:9]))
+}
+
+// transport carries frames between ranks
+type transport interface {
+	// serve accepts peer streams on listener in the background, passing each to handle.
+	// The stream ends when handle returns.
+	serve(listener net.Listener, handle func(frameStream) error)
+	// dial opens a stream to address, retrying with backoff until ctx is done. attempt
+	// is called after every connection attempt with its error, nil once it succeeded.
+	dial(ctx context.Context, address string, attempt func(error)) (peerStream, error)
+	// gracefulStop stops accepting streams and waits for the handlers to return
+	gracefulStop()
+	// stop closes the listener and every inbound stream without waiting
+	stop()
+}
+
+// frameStream is one direction of a peer stream as the receiving side sees it
+type frameStream interface {
+	// send writes f; the transport may read f.Payload until send returns
+	send(f *frame) error
+	// recv reads the next frame, returning io.EOF once the peer has closed for sending.
+	// The payload is never reused by the transport.
+	recv(f *frame) error
+}
+
+// peerStream is an outgoing stream to a peer
+type peerStream interface {
+	frameStream
+	// closeSend tells the peer no more frames follow; recv still returns its reply
+	closeSend() error
+	// close tears the stream down
+	close()
+}
+
+// ValidateTransport returns an error if name is not a transport this runtime provides
+func ValidateTransport(name string) error {
+	switch name {
+	case TransportGRPC, TransportTCP:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q, expected %s or %s", name, TransportGRPC, TransportTCP)
+}
+
+// newTransport returns the transport called name, which ValidateTransport accepted
+func newTransport(name string) transport {
+	if name == TransportTCP {
+		return newTCPTransport()
+	}
+	return newGRPCTransport()
+}
@@ -0,0 +1,210 @@
+// mpi/transport_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startLoopback serves the transport called name on a local port. The frames of every
+// inbound stream go to the returned channel, and each stream is acknowledged once the
+// peer closes it for sending, as Comm.exchange does.
+func startLoopback(tb testing.TB, name string) (transport, string, <-chan frame) {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	frames := make(chan frame, 1024)
+	t := newTransport(name)
+	t.serve(listener, func(stream frameStream) error {
+		for {
+			var f frame
+			err := stream.recv(&f)
+			if err == io.EOF {
+				return stream.send(&frame{Kind: frameHello, Source: 7})
+			}
+			if err != nil {
+				return err
+			}
+			frames <- f
+		}
+	})
+	tb.Cleanup(t.stop)
+	return t, listener.Addr().String(), frames
+}
+
+func TestTransportStream(t *testing.T) {
+	payloads := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "empty"},
+		{name: "small", payload: []byte("hello")},
+		{name: "large", payload: bytes.Repeat([]byte{0xab}, 1<<20)},
+	}
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			tr, address, frames := startLoopback(t, name)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream, err := tr.dial(ctx, address, func(error) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.close()
+
+			for i, p := range payloads {
+				if err := stream.send(&frame{Kind: frameData, Source: 3, Tag: int32(i - 1), Payload: p.payload}); err != nil {
+					t.Fatalf("send %s: %v", p.name, err)
+				}
+			}
+			if err := stream.closeSend(); err != nil {
+				t.Fatal(err)
+			}
+			var ack frame
+			if err := stream.recv(&ack); err != nil {
+				t.Fatalf("no acknowledgement: %v", err)
+			}
+			if ack.Kind != frameHello || ack.Source != 7 {
+				t.Errorf("acknowledgement %+v, want a hello from 7", ack)
+			}
+
+			for i, p := range payloads {
+				f := <-frames
+				if f.Kind != frameData || f.Source != 3 || f.Tag != int32(i-1) || !bytes.Equal(f.Payload, p.payload) {
+					t.Errorf("%s: got kind %d source %d tag %d and %d bytes", p.name, f.Kind, f.Source, f.Tag, len(f.Payload))
+				}
+			}
+			tr.gracefulStop()
+		})
+	}
+}
+
+func TestTransportDialUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	for _, name := range []string{TransportGRPC, TransportTCP} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			// gRPC calls attempt from its own goroutines, possibly after dial has returned
+			var mu sync.Mutex
+			var attempts, failed int
+			_, err := newTransport(name).dial(ctx, address, func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if err != nil {
+					failed++
+				}
+			})
+			if err == nil {
+				t.Fatal("dial succeeded without a listener")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts == 0 || failed != attempts {
+				t.Errorf("%d attempts, %d failed; want at least one, all failed", attempts, failed)
+			}
+		})
+	}
+}
+
+func TestTCPStreamRecvErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil accepts any error other than io.EOF
+	}{
+		{name: "closed", data: nil, want: io.EOF},
+		{name: "partial prefix", data: []byte{0, 0, 0}, want: io.ErrUnexpectedEOF},
+		{name: "partial payload", data: []byte{0, 0, 0, 12, frameData, 0, 0, 0, 1, 0, 0, 0, 2, 'a'}, want: io.ErrUnexpectedEOF},
+		{name: "short length", data: []byte{0, 0, 0, 4, frameData, 0, 0, 0, 1, 0, 0, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				client.Write(tt.data)
+				client.Close()
+			}()
+			var f frame
+			err := newTCPStream(server).recv(&f)
+			if err == nil || (tt.want != nil && err != tt.want) || (tt.want == nil && err == io.EOF) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: TransportGRPC},
+		{name: TransportTCP},
+		{name: "quic", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := ValidateTransport(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateTransport(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// benchmarkTransport streams b.N frames of each size to a loopback peer and waits for
+// the acknowledgement, so the time per operation is the cost of one message
+func benchmarkTransport(b *testing.B, name string) {
+	for _, size := range []int{64, 4 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			tr, address, frames := startLoopback(b, name)
+			go func() {
+				for range frames {
+				}
+			}()
+			stream, err := tr.dial(context.Background(), address, func(error) {})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer stream.close()
+			f := &frame{Kind: frameData, Payload: make([]byte, size)}
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := stream.send(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := stream.closeSend(); err != nil {
+				b.Fatal(err)
+			}
+			if err := stream.recv(&frame{}); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkTransportGRPC(b *testing.B) {
+	benchmarkTransport(b, TransportGRPC)
+}
+
+func BenchmarkTransportTCP(b *testing.B) {
+	benchmarkTransport(b, TransportTCP)
+}
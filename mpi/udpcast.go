@@ -0,0 +1,506 @@
+// mpi/udpcast.go
+// This file implements an experimental broadcast over UDP for large payloads among
+// ranks in one placement group, where the binomial tree makes the root send the
+// payload log2(size) times. With MPI_BROADCAST=udp the root splits a payload of at
+// least udpcastMinSize into chunks and sends each chunk once, to one of the other
+// ranks in turn, which relays it to every other rank. The root thus sends the
+// payload about once whatever the size of the job, and the relaying is spread over
+// all ranks.
+//
+// UDP loses and reorders packets, so a rank that stops getting chunks asks the root
+// for the missing ones with a NACK, and the root sends them again to that rank alone.
+// The root announces the size and sha256 of the payload down the tree first; once a
+// rank has all chunks, or gives up on them after udpcastGiveUp without progress, the
+// ranks tell the root with a reduction whether they have it, and if any rank does
+// not, the root sends the whole payload down the tree after all. Smaller payloads,
+// and every broadcast of a rank that could not open its UDP socket, take the tree
+// inside the announcement, so they cost one byte more than without the option.
+//
+// Chunks travel in the clear, so the option is ignored on a job with a payload key,
+// and only the world communicator uses it; spawned communicators keep the tree.
+
+package mpi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// EnvBroadcast selects how large broadcasts travel, set by awsmpirun from --broadcast
+const EnvBroadcast = "MPI_BROADCAST"
+
+// Broadcast modes accepted in MPI_BROADCAST
+const (
+	BroadcastTree = "tree" // Down the binomial tree over the rank streams, the default
+	BroadcastUDP  = "udp"  // Large payloads over UDP, relayed by the other ranks
+)
+
+const (
+	// udpcastMinSize is the smallest payload sent over UDP; smaller ones take the tree
+	udpcastMinSize = 1 << 20
+	// udpcastMaxSize is the largest payload sent over UDP
+	udpcastMaxSize = 1<<32 - 1
+	// udpcastChunk is the payload of one packet. Placement groups carry jumbo frames,
+	// and elsewhere IP fragments the packets.
+	udpcastChunk = 8192
+	// udpcastNackEvery is how long a rank waits for a chunk before asking for the missing ones
+	udpcastNackEvery = 20 * time.Millisecond
+	// udpcastMaxNack is the most chunks one NACK asks for
+	udpcastMaxNack = 1024
+	// udpcastWindow is how many broadcasts ahead of its own a rank keeps chunks for
+	udpcastWindow = 4
+	// udpcastSocketBuffer is the receive buffer asked for, to ride out bursts of chunks
+	udpcastSocketBuffer = 8 << 20
+	// udpcastRelayQueue is how many chunks a rank holds to relay; more are dropped and repaired
+	udpcastRelayQueue = 1024
+)
+
+// udpcastGiveUp is how long a rank waits without getting a chunk before it gives up on
+// UDP and lets the root send the payload down the tree; tests shorten it
+var udpcastGiveUp = 2 * time.Second
+
+// Layout of a UDP broadcast packet: magic, kind, flags, sending rank, broadcast ID,
+// chunk index, and payload length, followed by a chunk or, in a NACK, the indices of
+// the missing chunks
+const (
+	udpcastMagic      = 0x4d42 // "MB"
+	udpcastHeaderSize = 24
+)
+
+// Kinds of UDP broadcast packets
+const (
+	udpcastData uint8 = iota + 1
+	udpcastNack
+)
+
+// udpcastRelay flags a chunk the receiver forwards to the other ranks
+const udpcastRelay uint8 = 1
+
+// How a broadcast's announcement down the tree carries the payload
+const (
+	castInline byte = iota // The payload follows in the announcement
+	castUDP                // The payload's length and sha256 follow; the payload comes over UDP
+)
+
+// ValidateBroadcast returns an error if name is not a broadcast mode
+func ValidateBroadcast(name string) error {
+	switch name {
+	case BroadcastTree, BroadcastUDP:
+		return nil
+	}
+	return fmt.Errorf("unknown broadcast %q, expected %s or %s", name, BroadcastTree, BroadcastUDP)
+}
+
+// broadcastFromEnv returns MPI_BROADCAST, BroadcastTree when it is not set
+func broadcastFromEnv() (string, error) {
+	value := os.Getenv(EnvBroadcast)
+	if value == "" {
+		return BroadcastTree, nil
+	}
+	if err := ValidateBroadcast(value); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", EnvBroadcast, err)
+	}
+	return value, nil
+}
+
+// udpcastPacket is one packet of a UDP broadcast
+type udpcastPacket struct {
+	kind    uint8
+	flags   uint8
+	rank    int    // Sender
+	id      uint32 // Broadcast, numbered from 1 in the order the ranks run them
+	chunk   uint32
+	length  uint64 // Of the whole payload
+	payload []byte
+}
+
+func (p *udpcastPacket) marshal() []byte {
+	b := make([]byte, udpcastHeaderSize, udpcastHeaderSize+len(p.payload))
+	binary.BigEndian.PutUint16(b[0:2], udpcastMagic)
+	b[2], b[3] = p.kind, p.flags
+	binary.BigEndian.PutUint32(b[4:8], uint32(p.rank))
+	binary.BigEndian.PutUint32(b[8:12], p.id)
+	binary.BigEndian.PutUint32(b[12:16], p.chunk)
+	binary.BigEndian.PutUint64(b[16:24], p.length)
+	return append(b, p.payload...)
+}
+
+// parseUDPCastPacket decodes b, which the packet's payload keeps pointing into
+func parseUDPCastPacket(b []byte) (udpcastPacket, bool) {
+	if len(b) < udpcastHeaderSize || binary.BigEndian.Uint16(b[0:2]) != udpcastMagic {
+		return udpcastPacket{}, false
+	}
+	return udpcastPacket{
+		kind:    b[2],
+		flags:   b[3],
+		rank:    int(int32(binary.BigEndian.Uint32(b[4:8]))),
+		id:      binary.BigEndian.Uint32(b[8:12]),
+		chunk:   binary.BigEndian.Uint32(b[12:16]),
+		length:  binary.BigEndian.Uint64(b[16:24]),
+		payload: b[udpcastHeaderSize:],
+	}, true
+}
+
+// udpcastChunks is the number of chunks of a payload of length bytes
+func udpcastChunks(length int) int {
+	return (length + udpcastChunk - 1) / udpcastChunk
+}
+
+// udpTransfer is the payload of one UDP broadcast as a rank has it so far
+type udpTransfer struct {
+	data     []byte
+	have     []bool
+	missing  int
+	last     time.Time     // When the latest new chunk arrived
+	complete chan struct{} // Closed once every chunk is in
+	root     bool          // The payload is this rank's own, and NACKs for it are answered
+}
+
+func newUDPTransfer(length int) *udpTransfer {
+	chunks := udpcastChunks(length)
+	return &udpTransfer{data: make([]byte, length), have: make([]bool, chunks), missing: chunks, complete: make(chan struct{})}
+}
+
+// missingChunks returns up to limit chunks not yet in
+func (t *udpTransfer) missingChunks(limit int) []uint32 {
+	var chunks []uint32
+	for i, have := range t.have {
+		if !have {
+			chunks = append(chunks, uint32(i))
+			if len(chunks) == limit {
+				break
+			}
+		}
+	}
+	return chunks
+}
+
+// udpcastForward is a chunk to relay, and the root of its broadcast, which has it
+type udpcastForward struct {
+	packet []byte
+	root   int
+}
+
+// udpCaster is a rank's side of UDP broadcasts: its socket, which listens on the
+// rank's address, and the transfers under way
+type udpCaster struct {
+	c      *Comm
+	conn   *net.UDPConn        // Nil when the socket could not be opened; the rank's broadcasts take the tree
+	relays chan udpcastForward // Chunks to forward to the other ranks
+	closed chan struct{}
+
+	mu        sync.Mutex
+	transfers map[uint32]*udpTransfer
+	finished  uint32 // Broadcasts up to this one are over, and their packets are dropped
+	next      uint32 // The last broadcast this rank started
+}
+
+// newUDPCaster opens the UDP socket of c on its listener's address. A rank whose
+// socket cannot be opened still takes part in the broadcasts, over the tree.
+func newUDPCaster(c *Comm) *udpCaster {
+	u := &udpCaster{c: c, relays: make(chan udpcastForward, udpcastRelayQueue), closed: make(chan struct{}), transfers: make(map[uint32]*udpTransfer)}
+	addr, err := net.ResolveUDPAddr("udp", c.listener.Addr().String())
+	if err == nil {
+		u.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		Logger().Warn("broadcasts of this rank take the tree, the UDP socket failed to open", "error", err)
+		return u
+	}
+	u.conn.SetReadBuffer(udpcastSocketBuffer)
+	go u.read()
+	go u.relay()
+	return u
+}
+
+// close closes the socket, which ends the background goroutines
+func (u *udpCaster) close() {
+	if u.conn != nil {
+		close(u.closed)
+		u.conn.Close()
+	}
+}
+
+// sendTo sends packet to rank, within the rank's bandwidth limit
+func (u *udpCaster) sendTo(rank int, packet []byte) {
+	addr, err := net.ResolveUDPAddr("udp", u.c.address(rank))
+	if err != nil {
+		return
+	}
+	u.c.limiter.wait(len(packet))
+	if _, err := u.conn.WriteToUDP(packet, addr); err == nil {
+		u.c.traffic.bytes.Add(int64(len(packet)))
+	}
+}
+
+// read files the packets arriving on the socket until it is closed
+func (u *udpCaster) read() {
+	buf := make([]byte, udpcastHeaderSize+udpcastChunk)
+	for {
+		n, _, err := u.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		p, ok := parseUDPCastPacket(buf[:n])
+		if !ok || p.rank < 0 || p.rank >= u.c.size || p.rank == u.c.rank {
+			continue
+		}
+		switch p.kind {
+		case udpcastData:
+			u.receiveChunk(p)
+		case udpcastNack:
+			u.repair(p)
+		}
+	}
+}
+
+// transfer returns the transfer of broadcast id, creating it for a payload of length
+// bytes if it is within the window, or nil. A transfer of another length is replaced.
+func (u *udpCaster) transfer(id uint32, length int) *udpTransfer {
+	if id <= u.finished || id > u.finished+udpcastWindow || length > udpcastMaxSize {
+		return nil
+	}
+	t := u.transfers[id]
+	if t == nil || len(t.data) != length {
+		t = newUDPTransfer(length)
+		u.transfers[id] = t
+	}
+	return t
+}
+
+// receiveChunk stores a chunk, and queues it for the other ranks if it is ours to relay
+func (u *udpCaster) receiveChunk(p udpcastPacket) {
+	length := int(min(p.length, udpcastMaxSize+1))
+	chunk := int(p.chunk)
+	if chunk >= udpcastChunks(length) || len(p.payload) != min(udpcastChunk, length-chunk*udpcastChunk) {
+		return
+	}
+	u.mu.Lock()
+	t := u.transfer(p.id, length)
+	if t != nil && !t.have[chunk] {
+		copy(t.data[chunk*udpcastChunk:], p.payload)
+		t.have[chunk] = true
+		t.last = time.Now()
+		if t.missing--; t.missing == 0 {
+			close(t.complete)
+		}
+	}
+	u.mu.Unlock()
+
+	if t != nil && p.flags&udpcastRelay != 0 {
+		relayed := udpcastPacket{kind: udpcastData, rank: u.c.rank, id: p.id, chunk: p.chunk, length: p.length, payload: p.payload}
+		select {
+		case u.relays <- udpcastForward{packet: relayed.marshal(), root: p.rank}:
+		default: // The ranks ask the root for it instead
+		}
+	}
+}
+
+// relay forwards the queued chunks to every rank but their root and this one
+func (u *udpCaster) relay() {
+	for {
+		select {
+		case <-u.closed:
+			return
+		case forward := <-u.relays:
+			for rank := range u.c.size {
+				if rank != u.c.rank && rank != forward.root {
+					u.sendTo(rank, forward.packet)
+				}
+			}
+		}
+	}
+}
+
+// repair sends the chunks a NACK asks for again, to the rank that sent it, if this
+// rank is the root of the broadcast
+func (u *udpCaster) repair(p udpcastPacket) {
+	u.mu.Lock()
+	t := u.transfers[p.id]
+	u.mu.Unlock()
+	if t == nil || !t.root {
+		return
+	}
+	for i := 0; i+4 <= len(p.payload); i += 4 {
+		chunk := int(binary.BigEndian.Uint32(p.payload[i:]))
+		if chunk < len(t.have) {
+			u.sendTo(p.rank, u.chunkPacket(p.id, t.data, chunk, 0))
+		}
+	}
+}
+
+// chunkPacket returns the packet of one chunk of data
+func (u *udpCaster) chunkPacket(id uint32, data []byte, chunk int, flags uint8) []byte {
+	end := min((chunk+1)*udpcastChunk, len(data))
+	p := udpcastPacket{kind: udpcastData, flags: flags, rank: u.c.rank, id: id, chunk: uint32(chunk), length: uint64(len(data)), payload: data[chunk*udpcastChunk : end]}
+	return p.marshal()
+}
+
+// begin returns the ID of the next UDP broadcast
+func (u *udpCaster) begin() uint32 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.next++
+	return u.next
+}
+
+// finish drops the transfer of broadcast id, and the packets that still arrive for it
+func (u *udpCaster) finish(id uint32) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.finished = max(u.finished, id)
+	for other := range u.transfers {
+		if other <= u.finished {
+			delete(u.transfers, other)
+		}
+	}
+}
+
+// serve keeps data as broadcast id of this rank, so NACKs for its chunks are answered
+func (u *udpCaster) serve(id uint32, data []byte) {
+	t := &udpTransfer{data: data, have: make([]bool, udpcastChunks(len(data))), complete: make(chan struct{}), root: true}
+	for i := range t.have {
+		t.have[i] = true
+	}
+	close(t.complete)
+	u.mu.Lock()
+	u.transfers[id] = t
+	u.mu.Unlock()
+}
+
+// send sends data as broadcast id from the root, every chunk to one relaying rank
+func (u *udpCaster) send(id uint32, data []byte) {
+	u.serve(id, data)
+	var relays []int
+	for rank := range u.c.size {
+		if rank != u.c.rank {
+			relays = append(relays, rank)
+		}
+	}
+	for chunk := range udpcastChunks(len(data)) {
+		u.sendTo(relays[chunk%len(relays)], u.chunkPacket(id, data, chunk, udpcastRelay))
+	}
+}
+
+// await waits for the length bytes of broadcast id from root, asking root for the
+// chunks that do not arrive, and returns nil if it gives up on them
+func (u *udpCaster) await(ctx context.Context, id uint32, root, length int) []byte {
+	if u.conn == nil {
+		return nil
+	}
+	u.mu.Lock()
+	t := u.transfer(id, length)
+	u.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	entered := time.Now()
+	ticker := time.NewTicker(udpcastNackEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.complete:
+			return t.data
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		u.mu.Lock()
+		quiet := time.Since(entered)
+		if !t.last.IsZero() {
+			quiet = min(quiet, time.Since(t.last))
+		}
+		missing := t.missingChunks(udpcastMaxNack)
+		u.mu.Unlock()
+		if quiet > udpcastGiveUp {
+			return nil
+		}
+		if quiet >= udpcastNackEvery && len(missing) > 0 {
+			nack := udpcastPacket{kind: udpcastNack, rank: u.c.rank, id: id, length: uint64(length)}
+			for _, chunk := range missing {
+				nack.payload = binary.BigEndian.AppendUint32(nack.payload, chunk)
+			}
+			u.sendTo(root, nack.marshal())
+		}
+	}
+}
+
+// udpBroadcast broadcasts root's data, announcing it down the tree and sending it over
+// UDP when it is large enough, and down the tree after all if a rank missed it
+func (call *collectiveCall) udpBroadcast(root int, data []byte) ([]byte, error) {
+	c, u := call.c, call.c.udpcast
+	var announcement []byte
+	if c.rank == root {
+		if len(data) < udpcastMinSize || len(data) > udpcastMaxSize || c.size < 3 || u.conn == nil {
+			announcement = append([]byte{castInline}, data...)
+		} else {
+			sum := sha256.Sum256(data)
+			announcement = binary.BigEndian.AppendUint64([]byte{castUDP}, uint64(len(data)))
+			announcement = append(announcement, sum[:]...)
+		}
+	}
+	announcement, err := call.treeBroadcast(root, announcement)
+	if err != nil {
+		return nil, err
+	}
+	if len(announcement) > 0 && announcement[0] == castInline {
+		if c.rank == root {
+			return data, nil
+		}
+		return announcement[1:], nil
+	}
+	if len(announcement) != 1+8+sha256.Size {
+		return nil, fmt.Errorf("malformed broadcast announcement of %d bytes from rank %d", len(announcement), root)
+	}
+	length := int(binary.BigEndian.Uint64(announcement[1:9]))
+
+	id := u.begin()
+	defer u.finish(id)
+	have := []int{1}
+	var received []byte
+	if c.rank == root {
+		u.send(id, data)
+	} else {
+		received = u.await(call.ctx, id, root, length)
+		if received == nil || sha256.Sum256(received) != [sha256.Size]byte(announcement[9:]) {
+			have[0] = 0
+		}
+	}
+	have, err = reduce(call, root, have, Min)
+	if err != nil {
+		return nil, err
+	}
+
+	// One if every rank has the payload, else zero and the payload
+	var verdict []byte
+	if c.rank == root {
+		verdict = []byte{1}
+		if have[0] == 0 {
+			Logger().Warn("a UDP broadcast missed a rank, sending it down the tree", "bytes", len(data))
+			verdict = append([]byte{0}, data...)
+		}
+	}
+	verdict, err = call.treeBroadcast(root, verdict)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.rank == root:
+		return data, nil
+	case len(verdict) == 0:
+		return nil, fmt.Errorf("empty broadcast verdict from rank %d", root)
+	case verdict[0] == 1:
+		return received, nil
+	}
+	return verdict[1:], nil
+}
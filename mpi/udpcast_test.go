@@ -0,0 +1,138 @@
+// mpi/udpcast_test.go
+
+package mpi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func startUDPCastWorld(t *testing.T, size int) []*Comm {
+	t.Helper()
+	comms := startLocalWorldWith(t, size, TransportTCP, func(c *Comm) { c.broadcast = BroadcastUDP })
+	for rank, c := range comms {
+		if c.udpcast == nil || c.udpcast.conn == nil {
+			t.Fatalf("rank %d has no UDP socket", rank)
+		}
+	}
+	return comms
+}
+
+// udpcastPayload is a payload over udpcastMinSize whose last chunk is a short one
+func udpcastPayload() []byte {
+	payload := make([]byte, 3*udpcastMinSize+100)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestUDPBroadcast(t *testing.T) {
+	comms := startUDPCastWorld(t, 4)
+	defer finalizeAll(t, comms)
+	payload := udpcastPayload()
+
+	for _, root := range []int{0, 2} {
+		checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+			var v []byte
+			if c.Rank() == root {
+				v = payload
+			}
+			got, err := BroadcastValue(c, root, v)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, payload) {
+				return fmt.Errorf("got %d bytes, want the %d of the payload", len(got), len(payload))
+			}
+			return nil
+		}))
+	}
+
+	// Small payloads take the tree
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		got, err := BroadcastValue(c, 1, fmt.Sprint("from ", c.Rank()))
+		if err == nil && got != "from 1" {
+			err = fmt.Errorf("got %q, want %q", got, "from 1")
+		}
+		return err
+	}))
+}
+
+func TestUDPBroadcastFallback(t *testing.T) {
+	saved := udpcastGiveUp
+	udpcastGiveUp = 200 * time.Millisecond
+	t.Cleanup(func() { udpcastGiveUp = saved })
+
+	comms := startUDPCastWorld(t, 3)
+	defer finalizeAll(t, comms)
+	// Rank 2 gets no chunks, and relays none, so rank 1 has the root repair its share
+	comms[2].udpcast.conn.Close()
+
+	payload := udpcastPayload()
+	checkRanks(t, onEveryRank(comms, func(c *Comm) error {
+		var v []byte
+		if c.Rank() == 0 {
+			v = payload
+		}
+		got, err := BroadcastValue(c, 0, v)
+		if err == nil && !bytes.Equal(got, payload) {
+			err = fmt.Errorf("got %d bytes, want the %d of the payload", len(got), len(payload))
+		}
+		return err
+	}))
+}
+
+func TestUDPCastRepair(t *testing.T) {
+	comms := startUDPCastWorld(t, 2)
+	defer finalizeAll(t, comms)
+
+	// Rank 0 sends nothing, but answers the NACKs of rank 1 for every chunk
+	payload := udpcastPayload()
+	comms[0].udpcast.serve(1, payload)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if got := comms[1].udpcast.await(ctx, 1, 0, len(payload)); !bytes.Equal(got, payload) {
+		t.Errorf("got %d bytes, want the %d of the payload", len(got), len(payload))
+	}
+
+	// A broadcast outside the window is not taken
+	if got := comms[1].udpcast.await(ctx, 1+udpcastWindow+1, 0, len(payload)); got != nil {
+		t.Errorf("a broadcast beyond the window got %d bytes", len(got))
+	}
+}
+
+func TestUDPCastPacket(t *testing.T) {
+	p := udpcastPacket{kind: udpcastData, flags: udpcastRelay, rank: 3, id: 7, chunk: 12, length: 1 << 33, payload: []byte("chunk")}
+	got, ok := parseUDPCastPacket(p.marshal())
+	if !ok || got.kind != p.kind || got.flags != p.flags || got.rank != p.rank || got.id != p.id || got.chunk != p.chunk || got.length != p.length || string(got.payload) != "chunk" {
+		t.Errorf("got %+v, %v, want %+v", got, ok, p)
+	}
+	for _, b := range [][]byte{nil, make([]byte, udpcastHeaderSize)} {
+		if _, ok := parseUDPCastPacket(b); ok {
+			t.Errorf("parsed %d bytes without the magic", len(b))
+		}
+	}
+}
+
+func TestBroadcastFromEnv(t *testing.T) {
+	tests := []struct {
+		value, want string
+		wantErr     bool
+	}{
+		{value: "", want: BroadcastTree},
+		{value: "tree", want: BroadcastTree},
+		{value: "udp", want: BroadcastUDP},
+		{value: "quic", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Setenv(EnvBroadcast, test.value)
+		got, err := broadcastFromEnv()
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%q: got %q, %v, want %q, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// placement/builtin.go
+// This file implements the built-in selectors. Each one breaks ties by the order EC2
+// listed the instances, so it picks the same instances every time it sees the same
+// ones.
+//
+//	first     the first instances found, the default
+//	cheapest  the lowest estimated hourly cost: spot before on-demand, small sizes first
+//	newest    the most recently launched instances
+//	spread    across as many availability zones as there are, evenly
+//	packed    in as few placement groups and zones as possible
+//
+// spread and packed keep the ranks of one zone or placement group next to each other,
+// so neighbouring ranks are near each other too. With Requirements.MaxPerAZ, each one
+// passes over the instances of a zone that already has that many, and takes the next
+// it would have chosen.
+
+package placement
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// spotCostFactor estimates a spot instance's cost relative to the on-demand price
+const spotCostFactor = 0.3
+
+func selectFirst(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	return takeFirst(instances, req), nil
+}
+
+func selectCheapest(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	type pricedInstance struct {
+		cost     float64
+		instance awsManager.InstanceInfo
+	}
+	priced := make([]pricedInstance, len(instances))
+	for i, instance := range instances {
+		priced[i] = pricedInstance{cost: estimatedCost(instance), instance: instance}
+	}
+	slices.SortStableFunc(priced, func(a, b pricedInstance) int { return cmp.Compare(a.cost, b.cost) })
+	ordered := make([]awsManager.InstanceInfo, len(priced))
+	for i := range ordered {
+		ordered[i] = priced[i].instance
+	}
+	return takeFirst(ordered, req), nil
+}
+
+func selectNewest(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].LaunchTime.After(instances[j].LaunchTime)
+	})
+	return takeFirst(instances, req), nil
+}
+
+func selectSpread(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	groups := groupInstances(instances, func(instance awsManager.InstanceInfo) string {
+		return instance.AvailabilityZone
+	})
+	// Take one instance from every zone in turn
+	taken := make([]int, len(groups))
+	chosen := 0
+	for progress := true; chosen < req.Ranks && progress; {
+		progress = false
+		for i := range groups {
+			if taken[i] < zoneLimit(len(groups[i].instances), req) && chosen < req.Ranks {
+				taken[i]++
+				chosen++
+				progress = true
+			}
+		}
+	}
+	var selected []awsManager.InstanceInfo
+	for i, group := range groups {
+		selected = append(selected, group.instances[:taken[i]]...)
+	}
+	return selected, nil
+}
+
+func selectPacked(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	groups := groupInstances(instances, func(instance awsManager.InstanceInfo) string {
+		return instance.AvailabilityZone + "/" + instance.PlacementGroup
+	})
+	// Fill the largest groups first, so the fewest are used; at the same size, a
+	// placement group beats instances that are only in the same zone
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if len(a.instances) != len(b.instances) {
+			return len(a.instances) > len(b.instances)
+		}
+		return a.instances[0].PlacementGroup != "" && b.instances[0].PlacementGroup == ""
+	})
+	var selected []awsManager.InstanceInfo
+	perZone := make(map[string]int)
+	for _, group := range groups {
+		zone := group.instances[0].AvailabilityZone
+		n := min(zoneLimit(len(group.instances)+perZone[zone], req)-perZone[zone], req.Ranks-len(selected))
+		selected = append(selected, group.instances[:n]...)
+		perZone[zone] += n
+		if len(selected) == req.Ranks {
+			break
+		}
+	}
+	return selected, nil
+}
+
+// takeFirst returns the first req.Ranks of instances, passing over those in a zone
+// that already has req.MaxPerAZ
+func takeFirst(instances []awsManager.InstanceInfo, req Requirements) []awsManager.InstanceInfo {
+	if req.MaxPerAZ == 0 {
+		return instances[:req.Ranks]
+	}
+	var selected []awsManager.InstanceInfo
+	perZone := make(map[string]int)
+	for _, instance := range instances {
+		if perZone[instance.AvailabilityZone] == req.MaxPerAZ {
+			continue
+		}
+		perZone[instance.AvailabilityZone]++
+		if selected = append(selected, instance); len(selected) == req.Ranks {
+			break
+		}
+	}
+	return selected
+}
+
+// zoneLimit returns how many of n instances in one zone may be chosen
+func zoneLimit(n int, req Requirements) int {
+	if req.MaxPerAZ == 0 {
+		return n
+	}
+	return min(n, req.MaxPerAZ)
+}
+
+// instanceGroup is the instances that share a key, in the order they were found
+type instanceGroup struct {
+	key       string
+	instances []awsManager.InstanceInfo
+}
+
+// groupInstances groups instances by key, and orders the groups by key
+func groupInstances(instances []awsManager.InstanceInfo, key func(awsManager.InstanceInfo) string) []instanceGroup {
+	var groups []instanceGroup
+	index := make(map[string]int)
+	for _, instance := range instances {
+		k := key(instance)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, instanceGroup{key: k})
+		}
+		groups[i].instances = append(groups[i].instances, instance)
+	}
+	slices.SortFunc(groups, func(a, b instanceGroup) int { return strings.Compare(a.key, b.key) })
+	return groups
+}
+
+// estimatedCost estimates the hourly cost of an instance from its size and lifecycle
+// alone, in units of a small on-demand instance. It orders the sizes of one family
+// correctly and families only roughly.
+func estimatedCost(instance awsManager.InstanceInfo) float64 {
+	cost := normalizedSize(instance.InstanceType)
+	if instance.Lifecycle == awsManager.LifecycleSpot {
+		cost *= spotCostFactor
+	}
+	return cost
+}
+
+// namedSizes are the EC2 size normalization factors of the sizes without a multiplier
+var namedSizes = map[string]float64{
+	"nano":   0.25,
+	"micro":  0.5,
+	"small":  1,
+	"medium": 2,
+	"large":  4,
+	"xlarge": 8,
+}
+
+// normalizedSize returns the EC2 normalization factor of an instance type's size, such
+// as 8 for c7g.xlarge and 128 for c7g.16xlarge. Sizes it cannot tell, such as plain
+// metal, are infinitely large.
+func normalizedSize(instanceType string) float64 {
+	_, size, ok := strings.Cut(instanceType, ".")
+	if !ok {
+		return math.Inf(1)
+	}
+	if factor, ok := namedSizes[size]; ok {
+		return factor
+	}
+	size = strings.TrimPrefix(size, "metal-")
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "large"), "xl")
+	size = strings.TrimSuffix(size, "x")
+	if n, err := strconv.ParseFloat(size, 64); err == nil && n > 0 {
+		return 8 * n
+	}
+	return math.Inf(1)
+}
@@ -0,0 +1,156 @@
+// placement/placement.go
+// Package placement decides which of the instances found in a VPC a job runs on and
+// in what rank order. awsmpirun --instance-selector picks one of the built-in
+// strategies (first, cheapest, newest, spread, packed) or loads a Go plugin that
+// exports its own InstanceSelector, so a site can encode a placement policy, such as
+// keeping ranks on instances tagged with the same rack, without changing awsmpirun.
+//
+// A plugin is a main package built with go build -buildmode=plugin against the same
+// version of this module as the awsmpirun binary loading it, which exports a variable
+// named Selector:
+//
+//	package main
+//
+//	var Selector placement.InstanceSelector = rackSelector{}
+package placement
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// DefaultSelector is the selector used when none is given: the first instances found
+const DefaultSelector = "first"
+
+// Requirements is what a job asks of its instances
+type Requirements struct {
+	Ranks   int      // Instances to select; every instance runs one rank
+	Require []string // The job's --require constraints as given, such as same-az; awsmpirun checks them after selection
+	Project string   // Project the job belongs to
+
+	// MaxPerAZ is the most instances the job may have in one availability zone, so
+	// losing a zone loses at most that many ranks; 0 is no limit. Select enforces it.
+	MaxPerAZ int
+}
+
+// InstanceSelector chooses the instances of a job
+type InstanceSelector interface {
+	// Select returns req.Ranks of instances, in rank order. instances holds every
+	// running instance the job may use, in the order EC2 listed them, with their
+	// tags, zone, placement group, lifecycle, and launch time.
+	Select(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error)
+}
+
+// SelectorFunc adapts a function to InstanceSelector
+type SelectorFunc func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error)
+
+// Select calls f
+func (f SelectorFunc) Select(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	return f(instances, req)
+}
+
+// builtins are the selectors built into awsmpirun, by name
+var builtins = map[string]InstanceSelector{
+	"first":    SelectorFunc(selectFirst),
+	"cheapest": SelectorFunc(selectCheapest),
+	"newest":   SelectorFunc(selectNewest),
+	"spread":   SelectorFunc(selectSpread),
+	"packed":   SelectorFunc(selectPacked),
+}
+
+// Builtins returns the names of the built-in selectors
+func Builtins() []string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsPlugin reports whether spec names a plugin file rather than a built-in selector
+func IsPlugin(spec string) bool {
+	return strings.HasSuffix(spec, ".so")
+}
+
+// Resolve returns the selector spec names: a built-in, or the path of a plugin
+func Resolve(spec string) (InstanceSelector, error) {
+	if spec == "" {
+		spec = DefaultSelector
+	}
+	if IsPlugin(spec) {
+		return LoadPlugin(spec)
+	}
+	selector, ok := builtins[spec]
+	if !ok {
+		return nil, fmt.Errorf("unknown instance selector %q, expected one of %s or the path of a plugin ending in .so", spec, strings.Join(Builtins(), ", "))
+	}
+	return selector, nil
+}
+
+// Select runs selector on instances and checks what it chose: req.Ranks distinct
+// instances out of instances. The chosen instances are returned as they were given,
+// whatever the selector changed in its copies.
+func Select(selector InstanceSelector, instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	if len(instances) < req.Ranks {
+		return nil, fmt.Errorf("not enough instances in the VPC. Requested: %d, Available: %d", req.Ranks, len(instances))
+	}
+	if req.MaxPerAZ > 0 {
+		if capacity := zoneCapacity(instances, req.MaxPerAZ); capacity < req.Ranks {
+			return nil, fmt.Errorf("not enough availability zones for %d instances with at most %d in each: the instances found allow %d", req.Ranks, req.MaxPerAZ, capacity)
+		}
+	}
+	offered := make([]awsManager.InstanceInfo, len(instances))
+	copy(offered, instances)
+	chosen, err := selector.Select(offered, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(chosen) != req.Ranks {
+		return nil, fmt.Errorf("the selector chose %d instances, expected %d", len(chosen), req.Ranks)
+	}
+
+	byID := make(map[string]awsManager.InstanceInfo, len(instances))
+	for _, instance := range instances {
+		byID[instance.InstanceID] = instance
+	}
+	selected := make([]awsManager.InstanceInfo, len(chosen))
+	seen := make(map[string]bool, len(chosen))
+	for i, instance := range chosen {
+		original, ok := byID[instance.InstanceID]
+		if !ok {
+			return nil, fmt.Errorf("the selector chose %q, which is not one of the instances found", instance.InstanceID)
+		}
+		if seen[instance.InstanceID] {
+			return nil, fmt.Errorf("the selector chose %s twice, every instance runs one rank", instance.InstanceID)
+		}
+		seen[instance.InstanceID] = true
+		selected[i] = original
+	}
+	if req.MaxPerAZ > 0 {
+		perZone := make(map[string]int)
+		for _, instance := range selected {
+			if perZone[instance.AvailabilityZone]++; perZone[instance.AvailabilityZone] > req.MaxPerAZ {
+				return nil, fmt.Errorf("the selector chose more than %d instances in %s", req.MaxPerAZ, instance.AvailabilityZone)
+			}
+		}
+	}
+	return selected, nil
+}
+
+// zoneCapacity returns how many of instances can be chosen with at most maxPerAZ in
+// each availability zone
+func zoneCapacity(instances []awsManager.InstanceInfo, maxPerAZ int) int {
+	perZone := make(map[string]int)
+	for _, instance := range instances {
+		perZone[instance.AvailabilityZone]++
+	}
+	capacity := 0
+	for _, n := range perZone {
+		capacity += min(n, maxPerAZ)
+	}
+	return capacity
+}
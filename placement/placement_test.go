@@ -0,0 +1,333 @@
+// placement/placement_test.go
+
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	awsManager "github.com/Otter2022/cloud-native-mpi-for-aws-cli/aws"
+)
+
+// testInstances returns instances i-0 to i-5 over two zones, with a placement group in
+// us-east-1a
+func testInstances() []awsManager.InstanceInfo {
+	launched := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	spec := []struct {
+		zone, group, instanceType, lifecycle string
+		age                                  int // Days since launch
+	}{
+		{"us-east-1b", "", "c7g.4xlarge", awsManager.LifecycleOnDemand, 3},
+		{"us-east-1a", "hpc", "c7g.16xlarge", awsManager.LifecycleOnDemand, 1},
+		{"us-east-1b", "", "c7g.large", awsManager.LifecycleOnDemand, 5},
+		{"us-east-1a", "hpc", "c7g.16xlarge", awsManager.LifecycleSpot, 2},
+		{"us-east-1a", "", "c7g.xlarge", awsManager.LifecycleSpot, 4},
+		{"us-east-1b", "", "c7g.4xlarge", awsManager.LifecycleOnDemand, 0},
+	}
+	instances := make([]awsManager.InstanceInfo, len(spec))
+	for i, s := range spec {
+		instances[i] = awsManager.InstanceInfo{
+			InstanceID:       fmt.Sprintf("i-%d", i),
+			PrivateIP:        fmt.Sprintf("10.0.0.%d", i),
+			InstanceType:     s.instanceType,
+			InstanceRank:     -1,
+			AvailabilityZone: s.zone,
+			PlacementGroup:   s.group,
+			Lifecycle:        s.lifecycle,
+			LaunchTime:       launched.AddDate(0, 0, -s.age),
+		}
+	}
+	return instances
+}
+
+func instanceIDs(instances []awsManager.InstanceInfo) []string {
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.InstanceID
+	}
+	return ids
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []struct {
+		selector string
+		ranks    int
+		want     []string
+	}{
+		{"first", 3, []string{"i-0", "i-1", "i-2"}},
+		// Spot xlarge (2.4), large (4), spot 16xlarge (38.4), then the 4xlarges in order
+		{"cheapest", 4, []string{"i-4", "i-2", "i-0", "i-5"}},
+		{"newest", 3, []string{"i-5", "i-1", "i-3"}},
+		{"spread", 3, []string{"i-1", "i-3", "i-0"}},
+		{"spread", 5, []string{"i-1", "i-3", "i-4", "i-0", "i-2"}},
+		// Zone b without a group has 3, then the hpc group in zone a
+		{"packed", 4, []string{"i-0", "i-2", "i-5", "i-1"}},
+		{"packed", 2, []string{"i-0", "i-2"}},
+		{"first", 6, []string{"i-0", "i-1", "i-2", "i-3", "i-4", "i-5"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.selector, tt.ranks), func(t *testing.T) {
+			selector, err := Resolve(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			instances := testInstances()
+			got, err := Select(selector, instances, Requirements{Ranks: tt.ranks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := instanceIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Select() = %v, want %v", ids, tt.want)
+			}
+			if !reflect.DeepEqual(instances, testInstances()) {
+				t.Error("Select() reordered the instances it was given")
+			}
+		})
+	}
+}
+
+func TestPackedPrefersPlacementGroups(t *testing.T) {
+	instances := []awsManager.InstanceInfo{
+		{InstanceID: "i-0", AvailabilityZone: "us-east-1a"},
+		{InstanceID: "i-1", AvailabilityZone: "us-east-1a"},
+		{InstanceID: "i-2", AvailabilityZone: "us-east-1b", PlacementGroup: "hpc"},
+		{InstanceID: "i-3", AvailabilityZone: "us-east-1b", PlacementGroup: "hpc"},
+	}
+	got, err := Select(SelectorFunc(selectPacked), instances, Requirements{Ranks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := instanceIDs(got); !reflect.DeepEqual(ids, []string{"i-2", "i-3"}) {
+		t.Errorf("Select() = %v, want the hpc placement group", ids)
+	}
+}
+
+func TestMaxPerAZ(t *testing.T) {
+	tests := []struct {
+		selector string
+		ranks    int
+		max      int
+		want     []string
+		wantErr  string
+	}{
+		{selector: "first", ranks: 2, max: 1, want: []string{"i-0", "i-1"}},
+		// i-5 would be third cheapest in us-east-1b
+		{selector: "cheapest", ranks: 4, max: 2, want: []string{"i-4", "i-2", "i-0", "i-3"}},
+		{selector: "newest", ranks: 2, max: 1, want: []string{"i-5", "i-1"}},
+		{selector: "spread", ranks: 4, max: 2, want: []string{"i-1", "i-3", "i-0", "i-2"}},
+		// Two of zone b without a group, then the hpc group fills zone a
+		{selector: "packed", ranks: 4, max: 2, want: []string{"i-0", "i-2", "i-1", "i-3"}},
+		{selector: "packed", ranks: 5, max: 2, wantErr: "the instances found allow 4"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d-%d", tt.selector, tt.ranks, tt.max), func(t *testing.T) {
+			selector, err := Resolve(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Select(selector, testInstances(), Requirements{Ranks: tt.ranks, MaxPerAZ: tt.max})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := instanceIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Select() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	t.Run("plugin over the limit", func(t *testing.T) {
+		zoneA := SelectorFunc(func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+			return []awsManager.InstanceInfo{instances[1], instances[3], instances[4]}, nil
+		})
+		_, err := Select(zoneA, testInstances(), Requirements{Ranks: 3, MaxPerAZ: 2})
+		if err == nil || !strings.Contains(err.Error(), "more than 2 instances in us-east-1a") {
+			t.Errorf("Select() error = %v, want the limit broken", err)
+		}
+	})
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranks    int
+		selector SelectorFunc
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:  "reordered",
+			ranks: 2,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				return []awsManager.InstanceInfo{instances[4], instances[2]}, nil
+			},
+			want: []string{"i-4", "i-2"},
+		},
+		{
+			name:  "changes to the copies are dropped",
+			ranks: 1,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				instances[0].PrivateIP = "192.0.2.1"
+				return instances[:1], nil
+			},
+			want: []string{"i-0"},
+		},
+		{
+			name:  "wrong count",
+			ranks: 2,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				return instances[:3], nil
+			},
+			wantErr: "chose 3 instances, expected 2",
+		},
+		{
+			name:  "twice",
+			ranks: 2,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				return []awsManager.InstanceInfo{instances[1], instances[1]}, nil
+			},
+			wantErr: "chose i-1 twice",
+		},
+		{
+			name:  "unknown instance",
+			ranks: 1,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				return []awsManager.InstanceInfo{{InstanceID: "i-other"}}, nil
+			},
+			wantErr: `chose "i-other", which is not one of the instances found`,
+		},
+		{
+			name:  "selector error",
+			ranks: 1,
+			selector: func(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+				return nil, errors.New("no rack has 1 instance")
+			},
+			wantErr: "no rack has 1 instance",
+		},
+		{name: "more than found", ranks: 7, selector: selectFirst, wantErr: "Requested: 7, Available: 6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Select(tt.selector, testInstances(), Requirements{Ranks: tt.ranks})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(instanceIDs(got), tt.want) {
+				t.Errorf("Select() = %v, want %v", instanceIDs(got), tt.want)
+			}
+			if got[0].PrivateIP == "192.0.2.1" {
+				t.Error("Select() returned the selector's changes")
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	if _, err := Resolve(""); err != nil {
+		t.Errorf("Resolve(\"\") = %v, want the default", err)
+	}
+	if _, err := Resolve("random"); err == nil || !strings.Contains(err.Error(), "expected one of cheapest, first, newest, packed, spread") {
+		t.Errorf("Resolve(random) = %v", err)
+	}
+	if _, err := Resolve("/nonexistent/selector.so"); err == nil || !strings.Contains(err.Error(), "failed to load instance selector plugin") {
+		t.Errorf("Resolve(plugin) = %v", err)
+	}
+}
+
+type rackSelector struct{}
+
+func (rackSelector) Select(instances []awsManager.InstanceInfo, req Requirements) ([]awsManager.InstanceInfo, error) {
+	return instances[:req.Ranks], nil
+}
+
+func TestSelectorOf(t *testing.T) {
+	var variable InstanceSelector = rackSelector{}
+	var unset InstanceSelector
+	value := rackSelector{}
+	notSelector := 42
+	tests := []struct {
+		name    string
+		symbol  any
+		wantErr string
+	}{
+		{name: "interface variable", symbol: &variable},
+		{name: "value variable", symbol: &value},
+		{name: "nil interface", symbol: &unset, wantErr: "Selector is nil"},
+		{name: "other type", symbol: &notSelector, wantErr: "*int, which does not implement"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := selectorOf(tt.symbol)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectorOf() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || selector == nil {
+				t.Fatalf("selectorOf() = %v, %v", selector, err)
+			}
+		})
+	}
+}
+
+func TestNormalizedSize(t *testing.T) {
+	tests := []struct {
+		instanceType string
+		want         float64
+	}{
+		{"t3.nano", 0.25},
+		{"t3.medium", 2},
+		{"c7g.large", 4},
+		{"c7g.xlarge", 8},
+		{"c7g.16xlarge", 128},
+		{"c7i.metal-48xl", 384},
+		{"c7g.metal", math.Inf(1)},
+		{"unknown", math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := normalizedSize(tt.instanceType); got != tt.want {
+			t.Errorf("normalizedSize(%q) = %v, want %v", tt.instanceType, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkSelect selects half of 4096 instances over six zones and 32 placement groups
+func BenchmarkSelect(b *testing.B) {
+	instances := make([]awsManager.InstanceInfo, 4096)
+	for i := range instances {
+		instances[i] = awsManager.InstanceInfo{
+			InstanceID:       fmt.Sprintf("i-%d", i),
+			InstanceType:     fmt.Sprintf("c7g.%dxlarge", 1<<(i%5)),
+			AvailabilityZone: fmt.Sprintf("us-east-1%c", 'a'+i%6),
+			PlacementGroup:   fmt.Sprintf("pg-%d", i%32),
+			LaunchTime:       time.Unix(int64(i*7919%4096), 0),
+		}
+	}
+	for _, name := range Builtins() {
+		b.Run(name, func(b *testing.B) {
+			selector, _ := Resolve(name)
+			for range b.N {
+				if _, err := Select(selector, instances, Requirements{Ranks: 2048}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// placement/plugin.go
+// This file loads instance selectors from Go plugins. Plugins need cgo and are only
+// supported on Linux and macOS; elsewhere, and in binaries built with CGO_ENABLED=0,
+// plugin.Open fails and so does the run, before any instance is touched.
+
+package placement
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// pluginSymbol is the variable a plugin exports its selector as
+const pluginSymbol = "Selector"
+
+// LoadPlugin opens the plugin at path and returns the selector it exports
+func LoadPlugin(path string) (InstanceSelector, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load instance selector plugin: %v", err)
+	}
+	symbol, err := p.Lookup(pluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("instance selector plugin %s: %v", path, err)
+	}
+	selector, err := selectorOf(symbol)
+	if err != nil {
+		return nil, fmt.Errorf("instance selector plugin %s: %v", path, err)
+	}
+	return selector, nil
+}
+
+// selectorOf returns the selector a plugin's Selector symbol holds. Lookup returns a
+// pointer to the variable, which is either the interface itself or a value of a type
+// implementing it.
+func selectorOf(symbol plugin.Symbol) (InstanceSelector, error) {
+	switch s := symbol.(type) {
+	case *InstanceSelector:
+		if *s == nil {
+			return nil, fmt.Errorf("%s is nil", pluginSymbol)
+		}
+		return *s, nil
+	case InstanceSelector:
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s is a %T, which does not implement placement.InstanceSelector", pluginSymbol, symbol)
+}
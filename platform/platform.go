@@ -0,0 +1,189 @@
+// platform/platform.go
+// Package platform hides the differences between the operating systems awsmpirun runs
+// on as an operator tool: where configuration lives, how local paths map to S3 keys,
+// how private key files are protected, and whether the terminal can redraw a progress
+// line. The instances themselves are always Linux; only the operator's machine varies.
+//
+// Every function works on a Host instead of reading runtime.GOOS directly, so the
+// Windows and macOS behavior is covered by unit tests on any machine.
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Host describes the operator's machine
+type Host struct {
+	GOOS        string
+	Getenv      func(string) string
+	UserHomeDir func() (string, error)
+	Run         func(name string, args ...string) error // Runs a system tool, such as icacls
+}
+
+// Current returns the machine awsmpirun is running on
+func Current() Host {
+	return Host{
+		GOOS:        runtime.GOOS,
+		Getenv:      os.Getenv,
+		UserHomeDir: os.UserHomeDir,
+		Run: func(name string, args ...string) error {
+			out, err := exec.Command(name, args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		},
+	}
+}
+
+func (h Host) windows() bool {
+	return h.GOOS == "windows"
+}
+
+// ConfigDir returns the directory awsmpirun keeps its configuration in:
+// %APPDATA%\awsmpirun on Windows, ~/Library/Application Support/awsmpirun on macOS,
+// and $XDG_CONFIG_HOME/awsmpirun (default ~/.config/awsmpirun) elsewhere
+func (h Host) ConfigDir() (string, error) {
+	switch h.GOOS {
+	case "windows":
+		if dir := h.Getenv("APPDATA"); dir != "" {
+			return h.Join(dir, "awsmpirun"), nil
+		}
+		return "", fmt.Errorf("%%APPDATA%% is not set")
+	case "darwin", "ios":
+		home, err := h.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return h.Join(home, "Library", "Application Support", "awsmpirun"), nil
+	}
+	if dir := h.Getenv("XDG_CONFIG_HOME"); dir != "" && strings.HasPrefix(dir, "/") {
+		return h.Join(dir, "awsmpirun"), nil
+	}
+	home, err := h.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return h.Join(home, ".config", "awsmpirun"), nil
+}
+
+// Join joins local path elements with the host's separator
+func (h Host) Join(elem ...string) string {
+	separator := "/"
+	if h.windows() {
+		separator = `\`
+	}
+	var parts []string
+	for i, e := range elem {
+		if i > 0 {
+			e = strings.TrimLeft(e, `/\`)
+		}
+		if i < len(elem)-1 {
+			e = strings.TrimRight(e, `/\`)
+		}
+		if e != "" {
+			parts = append(parts, e)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+// SplitLocal splits a local path into its elements. Windows accepts both separators
+// and the volume ("C:" or "\\server\share") is dropped.
+func (h Host) SplitLocal(path string) []string {
+	if h.windows() {
+		path = strings.ReplaceAll(path, `\`, "/")
+		if strings.HasPrefix(path, "//") {
+			// UNC path: skip the server and share
+			rest := strings.SplitN(strings.TrimPrefix(path, "//"), "/", 3)
+			path = ""
+			if len(rest) == 3 {
+				path = rest[2]
+			}
+		} else if len(path) >= 2 && path[1] == ':' {
+			path = path[2:]
+		}
+	}
+
+	var elems []string
+	for _, e := range strings.Split(path, "/") {
+		if e != "" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// ObjectKey returns the S3 key a local file is uploaded to under prefix. Keys always
+// use "/", whatever separator the local path was written with.
+func (h Host) ObjectKey(prefix, localPath string) string {
+	elems := h.SplitLocal(localPath)
+	name := ""
+	if len(elems) > 0 {
+		name = elems[len(elems)-1]
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// RelativeObjectKey returns the S3 key for localPath inside root, keeping the
+// directory structure below root
+func (h Host) RelativeObjectKey(prefix, root, localPath string) (string, error) {
+	rootElems := h.SplitLocal(root)
+	elems := h.SplitLocal(localPath)
+	if len(elems) <= len(rootElems) {
+		return "", fmt.Errorf("%s is not inside %s", localPath, root)
+	}
+	for i, e := range rootElems {
+		same := e == elems[i]
+		if h.windows() {
+			same = strings.EqualFold(e, elems[i])
+		}
+		if !same {
+			return "", fmt.Errorf("%s is not inside %s", localPath, root)
+		}
+	}
+	for _, e := range elems[len(rootElems):] {
+		if e == ".." {
+			return "", fmt.Errorf("%s leaves %s", localPath, root)
+		}
+	}
+
+	key := strings.Join(elems[len(rootElems):], "/")
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key, nil
+}
+
+// WritePrivateFile writes data, such as a PEM private key, so that only the current
+// user can read it. Unix permission bits do nothing on Windows, so there the file's
+// inherited ACL entries are replaced with a single grant to the current user.
+func (h Host) WritePrivateFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return h.restrictToUser(path)
+}
+
+func (h Host) restrictToUser(path string) error {
+	if !h.windows() {
+		// WriteFile only applies the mode to new files
+		return os.Chmod(path, 0600)
+	}
+	user := h.Getenv("USERNAME")
+	if user == "" {
+		return fmt.Errorf("cannot restrict %s: %%USERNAME%% is not set", path)
+	}
+	if domain := h.Getenv("USERDOMAIN"); domain != "" {
+		user = domain + `\` + user
+	}
+	return h.Run("icacls", path, "/inheritance:r", "/grant:r", user+":F")
+}
@@ -0,0 +1,189 @@
+package platform
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// fakeHost returns a Host for goos with the given environment and home directory
+func fakeHost(goos, home string, env map[string]string) Host {
+	return Host{
+		GOOS:   goos,
+		Getenv: func(name string) string { return env[name] },
+		UserHomeDir: func() (string, error) {
+			if home == "" {
+				return "", errors.New("no home directory")
+			}
+			return home, nil
+		},
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    Host
+		want    string
+		wantErr bool
+	}{
+		{name: "windows", host: fakeHost("windows", `C:\Users\ana`, map[string]string{"APPDATA": `C:\Users\ana\AppData\Roaming`}), want: `C:\Users\ana\AppData\Roaming\awsmpirun`},
+		{name: "windows without APPDATA", host: fakeHost("windows", `C:\Users\ana`, nil), wantErr: true},
+		{name: "macOS", host: fakeHost("darwin", "/Users/ana", nil), want: "/Users/ana/Library/Application Support/awsmpirun"},
+		{name: "linux", host: fakeHost("linux", "/home/ana", nil), want: "/home/ana/.config/awsmpirun"},
+		{name: "linux with XDG", host: fakeHost("linux", "/home/ana", map[string]string{"XDG_CONFIG_HOME": "/cfg/"}), want: "/cfg/awsmpirun"},
+		{name: "relative XDG is ignored", host: fakeHost("linux", "/home/ana", map[string]string{"XDG_CONFIG_HOME": "cfg"}), want: "/home/ana/.config/awsmpirun"},
+		{name: "no home", host: fakeHost("linux", "", nil), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.host.ConfigDir()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: ConfigDir() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSplitLocal(t *testing.T) {
+	windows := fakeHost("windows", "", nil)
+	linux := fakeHost("linux", "", nil)
+	tests := []struct {
+		host Host
+		path string
+		want []string
+	}{
+		{windows, `C:\data\run 1\input.bin`, []string{"data", "run 1", "input.bin"}},
+		{windows, `C:/data/mixed\input.bin`, []string{"data", "mixed", "input.bin"}},
+		{windows, `\\fileserver\share\sets\input.bin`, []string{"sets", "input.bin"}},
+		{windows, `.\input.bin`, []string{"input.bin"}},
+		{linux, "/data/run 1/input.bin", []string{"data", "run 1", "input.bin"}},
+		{linux, `/data/back\slash.bin`, []string{"data", `back\slash.bin`}},
+		{linux, "./a//b/", []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.host.SplitLocal(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s SplitLocal(%q) = %q, want %q", tt.host.GOOS, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	windows := fakeHost("windows", "", nil)
+	linux := fakeHost("linux", "", nil)
+
+	if got := windows.ObjectKey("jobs/job-1/", `C:\Users\ana\solver.exe`); got != "jobs/job-1/solver.exe" {
+		t.Errorf("windows ObjectKey = %q", got)
+	}
+	if got := linux.ObjectKey("", "/home/ana/solver"); got != "solver" {
+		t.Errorf("linux ObjectKey = %q", got)
+	}
+
+	key, err := windows.RelativeObjectKey("inputs", `C:\Data`, `c:\data\sets\2024\train.bin`)
+	if err != nil || key != "inputs/sets/2024/train.bin" {
+		t.Errorf("windows RelativeObjectKey = %q, %v", key, err)
+	}
+	if _, err := linux.RelativeObjectKey("inputs", "/Data", "/data/train.bin"); err == nil {
+		t.Error("linux RelativeObjectKey ignored case")
+	}
+	if _, err := linux.RelativeObjectKey("", "/data", "/data/../etc/passwd"); err == nil {
+		t.Error("RelativeObjectKey accepted a path leaving the root")
+	}
+	if _, err := linux.RelativeObjectKey("", "/data", "/data"); err == nil {
+		t.Error("RelativeObjectKey accepted the root itself")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	if got := fakeHost("windows", "", nil).Join(`C:\Users\`, `\ana`, "awsmpirun"); got != `C:\Users\ana\awsmpirun` {
+		t.Errorf("windows Join = %q", got)
+	}
+	if got := fakeHost("linux", "", nil).Join("/home/", "/ana", "x"); got != "/home/ana/x" {
+		t.Errorf("linux Join = %q", got)
+	}
+}
+
+func TestWritePrivateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+
+	// Windows replaces the ACL with a grant to the current user
+	var ran []string
+	windows := fakeHost("windows", "", map[string]string{"USERNAME": "ana", "USERDOMAIN": "CORP"})
+	windows.Run = func(name string, args ...string) error {
+		ran = append([]string{name}, args...)
+		return nil
+	}
+	if err := windows.WritePrivateFile(path, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"icacls", path, "/inheritance:r", "/grant:r", `CORP\ana:F`}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+	if err := fakeHost("windows", "", nil).WritePrivateFile(path, []byte("secret")); err == nil {
+		t.Error("windows without USERNAME did not report that the key is unprotected")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// An existing world-readable file is tightened, not just new ones
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeHost(runtime.GOOS, "", nil).WritePrivateFile(path, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("key mode = %o, want 600", mode)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var plain bytes.Buffer
+	p := NewProgress(&plain, false)
+	p.Update("waiting %d/%d", 1, 4)
+	p.Update("waiting %d/%d", 1, 4)
+	p.Println("rank %d failed", 2)
+	p.Update("waiting %d/%d", 4, 4)
+	p.Done()
+	if got, want := plain.String(), "waiting 1/4\nrank 2 failed\nwaiting 4/4\n"; got != want {
+		t.Errorf("plain progress = %q, want %q", got, want)
+	}
+
+	var tty bytes.Buffer
+	p = NewProgress(&tty, true)
+	p.Update("waiting 1/4")
+	p.Println("rank 2 failed")
+	p.Update("waiting 4/4")
+	p.Done()
+	want := "\r\x1b[Kwaiting 1/4" + "\r\x1b[Krank 2 failed\nwaiting 1/4" + "\r\x1b[Kwaiting 4/4" + "\n"
+	if got := tty.String(); got != want {
+		t.Errorf("interactive progress = %q, want %q", got, want)
+	}
+}
+
+func TestInteractiveRejectsFiles(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if Current().Interactive(f) {
+		t.Error("a regular file was treated as a terminal")
+	}
+}
@@ -0,0 +1,89 @@
+// platform/terminal.go
+// This file renders progress on the operator's terminal. On a terminal that understands
+// ANSI escapes the status is redrawn in place on one line; when output is redirected,
+// or the Windows console cannot enable escape processing, each change is printed as a
+// plain line instead so logs stay readable.
+
+package platform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Interactive reports whether f is a terminal that can redraw a line in place
+func (h Host) Interactive(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if h.Getenv("TERM") == "dumb" {
+		return false
+	}
+	if h.windows() {
+		return enableVirtualTerminal(f)
+	}
+	return true
+}
+
+// Progress shows one changing status line
+type Progress struct {
+	mu          sync.Mutex
+	w           io.Writer
+	interactive bool
+	last        string
+	drawn       bool
+}
+
+// NewProgress returns a progress line on w; interactive selects redrawing in place
+func NewProgress(w io.Writer, interactive bool) *Progress {
+	return &Progress{w: w, interactive: interactive}
+}
+
+// NewStdoutProgress returns a progress line on standard output, redrawn in place when
+// standard output is a capable terminal
+func NewStdoutProgress() *Progress {
+	return NewProgress(os.Stdout, Current().Interactive(os.Stdout))
+}
+
+// Update replaces the status. Unchanged statuses are not printed again.
+func (p *Progress) Update(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := fmt.Sprintf(format, args...)
+	if status == p.last {
+		return
+	}
+	p.last = status
+	if p.interactive {
+		// Return to the start of the line and clear what was there
+		fmt.Fprintf(p.w, "\r\x1b[K%s", status)
+		p.drawn = true
+		return
+	}
+	fmt.Fprintln(p.w, status)
+}
+
+// Println prints a line above the status without losing it
+func (p *Progress) Println(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interactive && p.drawn {
+		fmt.Fprintf(p.w, "\r\x1b[K"+format+"\n%s", append(args, p.last)...)
+		return
+	}
+	fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+// Done ends the status line, leaving the last status on screen
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interactive && p.drawn {
+		fmt.Fprintln(p.w)
+	}
+	p.drawn = false
+	p.last = ""
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package platform
+
+import "os"
+
+// enableVirtualTerminal is only needed for the Windows console
+func enableVirtualTerminal(f *os.File) bool {
+	return true
+}